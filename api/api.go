@@ -0,0 +1,730 @@
+// Package api serves a JSON REST API for controlling a session remotely:
+//
+//	GET    /api/torrents              list torrents with their status
+//	POST   /api/torrents              add a torrent (see handleAdd)
+//	GET    /api/torrents/{hash}       one torrent's status
+//	DELETE /api/torrents/{hash}       remove a torrent, keeping its files
+//	POST   /api/torrents/{hash}/pause
+//	POST   /api/torrents/{hash}/resume
+//	GET    /api/torrents/{hash}/peers connected peers
+//	GET    /api/torrents/{hash}/trackers
+//
+// Torrents are identified by their hex-encoded info hash. Errors are
+// returned as {"error": "..."} with a matching status code.
+//
+// Request bodies must be JSON, sent as application/json, so browsers ask
+// before sending them from other sites, and requests changing anything from
+// another origin are refused. Without a token (see SetToken) only requests
+// for an IP address or localhost are served, so other sites can't reach the
+// API through their own names either.
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/download"
+	"github.com/omkarkirpan/bittorrent-client/session"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// fetchTimeout bounds downloading a .torrent file from a URL
+const fetchTimeout = 30 * time.Second
+
+// TorrentStatus is the JSON form of a torrent's progress
+type TorrentStatus struct {
+	InfoHash     string  `json:"info_hash"`
+	Name         string  `json:"name"`
+	State        string  `json:"state"`
+	PiecesDone   int     `json:"pieces_done"`
+	Pieces       int     `json:"pieces"`
+	Percent      float64 `json:"percent"`
+	Length       int64   `json:"length"`
+	Wanted       int64   `json:"wanted"`
+	Downloaded   int64   `json:"downloaded"`
+	Uploaded     int64   `json:"uploaded"`
+	DownloadRate int64   `json:"download_rate"`
+	UploadRate   int64   `json:"upload_rate"`
+	Peers        int     `json:"peers"`
+	Seeds        int     `json:"seeds"`
+	Leeches      int     `json:"leeches"`
+	ETASeconds   *int64  `json:"eta_seconds,omitempty"`
+	HashFailures int64   `json:"hash_failures"`
+	Wasted       int64   `json:"wasted"`
+	Copies       float64 `json:"distributed_copies"`
+	Unavailable  int     `json:"unavailable_pieces"`
+	ForceStart   bool    `json:"force_start"`
+	QueuePos     int     `json:"queue_position,omitempty"` // from 1 while queued
+	Error        string  `json:"error,omitempty"`
+}
+
+// NewTorrentStatus captures the current status of t
+func NewTorrentStatus(t *session.Torrent) TorrentStatus {
+	stats := t.Stats()
+	status := TorrentStatus{
+		InfoHash:     hex.EncodeToString(infoHash(t)),
+		Name:         t.Name(),
+		State:        t.State().String(),
+		PiecesDone:   stats.PiecesDone,
+		Pieces:       stats.Pieces,
+		Percent:      stats.Percent(),
+		Length:       stats.Length,
+		Wanted:       stats.Wanted,
+		Downloaded:   stats.Downloaded,
+		Uploaded:     stats.Uploaded,
+		DownloadRate: int64(stats.DownloadRate),
+		UploadRate:   int64(stats.UploadRate),
+		Peers:        stats.Peers,
+		Seeds:        stats.Seeds,
+		Leeches:      stats.Leeches,
+		HashFailures: stats.HashFailures,
+		Wasted:       stats.Wasted,
+		Copies:       stats.Copies,
+		Unavailable:  stats.Unavailable,
+		ForceStart:   t.ForceStart(),
+		QueuePos:     t.QueuePosition(),
+	}
+	if eta, ok := stats.ETA(); ok && t.State() == session.StateDownloading {
+		seconds := int64(eta.Seconds())
+		status.ETASeconds = &seconds
+	}
+	if err := t.Err(); err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func infoHash(t *session.Torrent) []byte {
+	h := t.InfoHash()
+	return h[:]
+}
+
+// PeerStatus is the JSON form of a connected peer
+type PeerStatus struct {
+	Addr         string  `json:"addr"`
+	PeerID       string  `json:"peer_id"` // printable characters kept, others shown as dots
+	Client       string  `json:"client,omitempty"`
+	Incoming     bool    `json:"incoming"`
+	Choked       bool    `json:"choked"`
+	Interested   bool    `json:"interested"`
+	Seed         bool    `json:"seed"`
+	Progress     float64 `json:"progress"`
+	Downloaded   int64   `json:"downloaded"`
+	Uploaded     int64   `json:"uploaded"`
+	DownloadRate float64 `json:"download_rate"`
+	UploadRate   float64 `json:"upload_rate"`
+	LatencyMS    float64 `json:"latency_ms"`
+}
+
+// printableID returns a peer ID with bytes outside printable ASCII replaced
+// by dots, so client prefixes such as -qB4630- stay readable
+func printableID(id [20]byte) string {
+	b := id
+	for i, c := range b {
+		if c < ' ' || c > '~' {
+			b[i] = '.'
+		}
+	}
+	return string(b[:])
+}
+
+// NewPeerStatus converts a connected peer to its JSON form
+func NewPeerStatus(p download.PeerInfo) PeerStatus {
+	return PeerStatus{
+		Addr:         p.Addr,
+		PeerID:       printableID(p.PeerID),
+		Client:       p.Client,
+		Incoming:     p.Incoming,
+		Choked:       p.Choked,
+		Interested:   p.Interested,
+		Seed:         p.Seed,
+		Progress:     p.Progress,
+		Downloaded:   p.Downloaded,
+		Uploaded:     p.Uploaded,
+		DownloadRate: p.DownloadRate,
+		UploadRate:   p.UploadRate,
+		LatencyMS:    float64(p.Latency) / float64(time.Millisecond),
+	}
+}
+
+// FileStatus is the JSON form of a file of a torrent and how much of it has
+// been downloaded
+type FileStatus struct {
+	Path     string  `json:"path"`
+	Length   int64   `json:"length"`
+	Done     int64   `json:"done"`
+	Percent  float64 `json:"percent"`
+	Priority int     `json:"priority"`          // 1 high, 0 normal, -1 skipped
+	Padding  bool    `json:"padding,omitempty"` // BEP 47 padding, which isn't saved
+}
+
+// FilePriorities is the JSON body for changing which files of a torrent are
+// downloaded: a priority per file in the torrent's order, 1 for high, 0 for
+// normal and -1 to skip it
+type FilePriorities struct {
+	Priorities []int `json:"priorities"`
+}
+
+// NewFileStatus converts a file's progress to its JSON form
+func NewFileStatus(f session.FileProgress) FileStatus {
+	status := FileStatus{Path: f.Path, Length: f.Length, Done: f.Done, Percent: 100, Priority: int(f.Priority), Padding: f.Padding}
+	if f.Length > 0 {
+		status.Percent = float64(f.Done) * 100 / float64(f.Length)
+	}
+	return status
+}
+
+// SuspectStatus is the JSON form of a peer that sent pieces failing the hash
+// check
+type SuspectStatus struct {
+	IP       string `json:"ip"`
+	Client   string `json:"client,omitempty"`
+	Failed   int    `json:"failed"`
+	Verified int    `json:"verified"`
+	Pieces   []int  `json:"pieces"`
+	Banned   bool   `json:"banned"`
+}
+
+// TrackerStatus is the JSON form of a tracker and its last announce
+type TrackerStatus struct {
+	URL          string     `json:"url"`
+	LastAnnounce *time.Time `json:"last_announce,omitempty"`
+	Peers        int        `json:"peers"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// ForceStart is the JSON body for letting a torrent run regardless of the
+// session's active limits, or putting it back under them
+type ForceStart struct {
+	ForceStart bool `json:"force_start"`
+}
+
+// ConnectionLimit is the JSON form of how many peer connections a torrent
+// may have. Setting it caps the torrent; 0 goes back to its share of the
+// session's budget.
+type ConnectionLimit struct {
+	MaxConnections int `json:"max_connections"`
+}
+
+// RateLimits is the JSON form of the session's transfer limits in bytes per
+// second, 0 meaning unlimited: the normal ones, the alternative ones, and
+// whether the alternative ones are in effect ("turtle mode"). In updates,
+// omitted fields are left as they are.
+type RateLimits struct {
+	MaxDownload    *int64 `json:"max_download"`
+	MaxUpload      *int64 `json:"max_upload"`
+	AltMaxDownload *int64 `json:"alt_max_download"`
+	AltMaxUpload   *int64 `json:"alt_max_upload"`
+	AltSpeed       *bool  `json:"alt_speed"`
+}
+
+// TorrentRateLimits is the JSON form of a torrent's own transfer limits in
+// bytes per second, 0 meaning only the session's limits apply. In updates,
+// omitted fields are left as they are.
+type TorrentRateLimits struct {
+	MaxDownload *int64 `json:"max_download"`
+	MaxUpload   *int64 `json:"max_upload"`
+}
+
+// SeedingLimits is the JSON form of when a torrent stops seeding: at an
+// upload ratio or after a time in seconds, 0 meaning no limit, and whether
+// it pauses or completes then. In updates, omitted fields are left as they
+// are.
+type SeedingLimits struct {
+	Ratio *float64 `json:"ratio"`
+	Time  *float64 `json:"time"`
+	Pause *bool    `json:"pause"`
+}
+
+// NetworkStatus is the JSON form of what trackers and peers told us about
+// our external addresses, to tell why peers might not reach us
+type NetworkStatus struct {
+	ExternalIPv4 string        `json:"external_ipv4,omitempty"` // omitted until enough sources agree
+	ExternalIPv6 string        `json:"external_ipv6,omitempty"`
+	BehindNAT    bool          `json:"behind_nat"`
+	PortMapped   bool          `json:"port_mapped"`
+	AnnouncePort uint16        `json:"announce_port"`
+	Incoming     int64         `json:"incoming_connections"`
+	Blocked      BlockedStatus `json:"blocked"`
+}
+
+// BlockedStatus is the JSON form of what the blocklist filtered out
+type BlockedStatus struct {
+	Ranges      int   `json:"ranges"` // 0 without a blocklist
+	Connections int64 `json:"connections"`
+	Peers       int64 `json:"peers"`
+	DHT         int64 `json:"dht"`
+}
+
+// addRequest is the JSON body for adding a torrent by magnet link or URL
+type addRequest struct {
+	URI string `json:"uri"`
+}
+
+// Server handles API requests for a session
+type Server struct {
+	sess  *session.Session
+	http  *http.Client // fetches .torrent files by URL
+	mux   *http.ServeMux
+	token string // required as a bearer token, if set
+}
+
+// NewServer creates an API server for sess
+func NewServer(sess *session.Session) *Server {
+	// Fetch through the session's route, e.g. its strict proxy
+	fetch := *sess.HTTPClient()
+	fetch.Timeout = fetchTimeout
+	s := &Server{
+		sess: sess,
+		http: &fetch,
+		mux:  http.NewServeMux(),
+	}
+	s.mux.HandleFunc("GET /api/torrents", s.handleList)
+	s.mux.HandleFunc("POST /api/torrents", s.handleAdd)
+	s.mux.HandleFunc("GET /api/torrents/{hash}", s.withTorrent(s.handleGet))
+	s.mux.HandleFunc("DELETE /api/torrents/{hash}", s.withTorrent(s.handleRemove))
+	s.mux.HandleFunc("POST /api/torrents/{hash}/pause", s.withTorrent(s.handlePause))
+	s.mux.HandleFunc("POST /api/torrents/{hash}/resume", s.withTorrent(s.handleResume))
+	s.mux.HandleFunc("PUT /api/torrents/{hash}/force-start", s.withTorrent(s.handleForceStart))
+	s.mux.HandleFunc("GET /api/torrents/{hash}/peers", s.withTorrent(s.handlePeers))
+	s.mux.HandleFunc("GET /api/torrents/{hash}/files", s.withTorrent(s.handleFiles))
+	s.mux.HandleFunc("PUT /api/torrents/{hash}/files", s.withTorrent(s.handleSetFiles))
+	s.mux.HandleFunc("GET /api/torrents/{hash}/trackers", s.withTorrent(s.handleTrackers))
+	s.mux.HandleFunc("GET /api/torrents/{hash}/suspects", s.withTorrent(s.handleSuspects))
+	s.mux.HandleFunc("GET /api/torrents/{hash}/connections", s.withTorrent(s.handleConnections))
+	s.mux.HandleFunc("PUT /api/torrents/{hash}/connections", s.withTorrent(s.handleSetConnections))
+	s.mux.HandleFunc("GET /api/torrents/{hash}/limits", s.withTorrent(s.handleTorrentLimits))
+	s.mux.HandleFunc("PUT /api/torrents/{hash}/limits", s.withTorrent(s.handleSetTorrentLimits))
+	s.mux.HandleFunc("GET /api/torrents/{hash}/seeding", s.withTorrent(s.handleSeeding))
+	s.mux.HandleFunc("PUT /api/torrents/{hash}/seeding", s.withTorrent(s.handleSetSeeding))
+	s.mux.HandleFunc("DELETE /api/torrents/{hash}/seeding", s.withTorrent(s.handleResetSeeding))
+	s.mux.HandleFunc("GET /api/limits", s.handleLimits)
+	s.mux.HandleFunc("PUT /api/limits", s.handleSetLimits)
+	s.mux.HandleFunc("GET /api/network", s.handleNetwork)
+	return s
+}
+
+// Handle registers an extra handler, e.g. for a UI served alongside the API
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// SetToken requires API requests to carry token in an "Authorization:
+// Bearer" header. With a token the API may be served under any host name,
+// e.g. to other machines.
+func (s *Server) SetToken(token string) {
+	s.token = token
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token == "" && !localHost(r.Host) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("host %q refused: set an API token to serve it", r.Host))
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && crossOrigin(r) {
+		writeError(w, http.StatusForbidden, errors.New("cross-origin request refused"))
+		return
+	}
+	if s.token != "" && strings.HasPrefix(r.URL.Path, "/api/") {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid API token"))
+			return
+		}
+	}
+	if r.ContentLength != 0 && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		if ct := mediaType(r); ct != "application/json" && ct != "application/x-bittorrent" {
+			writeError(w, http.StatusUnsupportedMediaType, errors.New("request body must be application/json"))
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// localHost reports whether host, from a request's Host header, is an IP
+// address or localhost. Other names may be a site rebinding its own name to
+// the API's address.
+func localHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return net.ParseIP(host) != nil || strings.EqualFold(host, "localhost")
+}
+
+// crossOrigin reports whether r was sent by a page from another origin
+func crossOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Older browsers leave Origin out of some requests, but say where
+		// they come from here
+		site := r.Header.Get("Sec-Fetch-Site")
+		return site != "" && site != "same-origin" && site != "none"
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != r.Host
+}
+
+// mediaType returns the media type of r's body, without parameters
+func mediaType(r *http.Request) string {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return ct
+}
+
+// withTorrent resolves the {hash} path parameter before calling handler
+func (s *Server) withTorrent(handler func(http.ResponseWriter, *http.Request, *session.Torrent)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw, err := hex.DecodeString(r.PathValue("hash"))
+		if err != nil || len(raw) != 20 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid info hash"))
+			return
+		}
+		t := s.sess.Torrent([20]byte(raw))
+		if t == nil {
+			writeError(w, http.StatusNotFound, session.ErrTorrentNotFound)
+			return
+		}
+		handler(w, r, t)
+	}
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	statuses := []TorrentStatus{}
+	for _, t := range s.sess.Torrents() {
+		statuses = append(statuses, NewTorrentStatus(t))
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// handleAdd adds a torrent from a raw .torrent upload (Content-Type
+// application/x-bittorrent) or from a JSON body {"uri": "..."} holding a
+// magnet link or an http(s) URL of a .torrent file
+func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
+	body := io.LimitReader(r.Body, torrent.MaxFileSize+1)
+
+	var t *session.Torrent
+	var err error
+	switch mediaType(r) {
+	case "application/x-bittorrent":
+		var data []byte
+		if data, err = io.ReadAll(body); err == nil {
+			t, err = s.addData(data)
+		}
+	case "application/json":
+		var req addRequest
+		if err = json.NewDecoder(body).Decode(&req); err == nil {
+			t, err = s.addURI(req.URI)
+		}
+	default:
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("send a .torrent file as application/x-bittorrent or a URI as application/json"))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, NewTorrentStatus(t))
+}
+
+// addData adds a torrent from the contents of a .torrent file
+func (s *Server) addData(data []byte) (*session.Torrent, error) {
+	if len(data) > torrent.MaxFileSize {
+		return nil, errors.New("torrent file too large")
+	}
+	tf, err := torrent.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid torrent file: %v", err)
+	}
+	return s.sess.AddTorrent(tf)
+}
+
+// addURI adds a torrent from a magnet link or a URL. Local paths are
+// refused, since they'd let API clients read files on the daemon's host.
+func (s *Server) addURI(uri string) (*session.Torrent, error) {
+	switch {
+	case strings.HasPrefix(uri, "magnet:"):
+		return s.sess.AddMagnet(uri)
+	case strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://"):
+		tf, err := torrent.LoadWith(s.http, uri)
+		if err != nil {
+			return nil, err
+		}
+		return s.sess.AddTorrent(tf)
+	default:
+		return nil, errors.New("uri must be a magnet link or an http(s) URL")
+	}
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	writeJSON(w, http.StatusOK, NewTorrentStatus(t))
+}
+
+func (s *Server) handleRemove(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	if err := s.sess.Remove(t.InfoHash()); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handlePause(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	if err := t.Pause(); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, NewTorrentStatus(t))
+}
+
+func (s *Server) handleResume(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	if err := t.Resume(); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, NewTorrentStatus(t))
+}
+
+func (s *Server) handleForceStart(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	var req ForceStart
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := t.SetForceStart(req.ForceStart); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, NewTorrentStatus(t))
+}
+
+func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	peers := []PeerStatus{}
+	for _, p := range t.Peers() {
+		peers = append(peers, NewPeerStatus(p))
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	files := []FileStatus{}
+	for _, f := range t.Files() {
+		files = append(files, NewFileStatus(f))
+	}
+	writeJSON(w, http.StatusOK, files)
+}
+
+// handleSetFiles changes the file priorities given in a FilePriorities body
+func (s *Server) handleSetFiles(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	var req FilePriorities
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	priorities := make([]download.Priority, len(req.Priorities))
+	for i, p := range req.Priorities {
+		if p < int(download.PrioritySkip) || p > int(download.PriorityHigh) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid priority %d", p))
+			return
+		}
+		priorities[i] = download.Priority(p)
+	}
+	if err := t.SetFilePriorities(priorities); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	s.handleFiles(w, r, t)
+}
+
+func (s *Server) handleSuspects(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	suspects := []SuspectStatus{}
+	for _, p := range t.Suspects() {
+		suspects = append(suspects, SuspectStatus(p))
+	}
+	writeJSON(w, http.StatusOK, suspects)
+}
+
+func (s *Server) handleTrackers(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	trackers := []TrackerStatus{}
+	for _, tr := range t.Trackers() {
+		status := TrackerStatus{URL: tr.URL, Peers: tr.Peers}
+		if !tr.LastAnnounce.IsZero() {
+			status.LastAnnounce = &tr.LastAnnounce
+		}
+		if tr.Err != nil {
+			status.Error = tr.Err.Error()
+		}
+		trackers = append(trackers, status)
+	}
+	writeJSON(w, http.StatusOK, trackers)
+}
+
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	writeJSON(w, http.StatusOK, ConnectionLimit{MaxConnections: t.MaxConnections()})
+}
+
+func (s *Server) handleSetConnections(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	var req ConnectionLimit
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := t.SetMaxConnections(req.MaxConnections); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.handleConnections(w, r, t)
+}
+
+func (s *Server) handleTorrentLimits(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	down, up := t.RateLimits()
+	writeJSON(w, http.StatusOK, TorrentRateLimits{MaxDownload: &down, MaxUpload: &up})
+}
+
+func (s *Server) handleSetTorrentLimits(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	var req TorrentRateLimits
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	down, up := t.RateLimits()
+	if req.MaxDownload != nil {
+		down = *req.MaxDownload
+	}
+	if req.MaxUpload != nil {
+		up = *req.MaxUpload
+	}
+	if err := t.SetRateLimits(down, up); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.handleTorrentLimits(w, r, t)
+}
+
+func (s *Server) handleSeeding(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	limits := t.SeedLimits()
+	seconds := limits.Time.Seconds()
+	writeJSON(w, http.StatusOK, SeedingLimits{Ratio: &limits.Ratio, Time: &seconds, Pause: &limits.Pause})
+}
+
+func (s *Server) handleSetSeeding(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	var req SeedingLimits
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limits := t.SeedLimits()
+	if req.Ratio != nil {
+		limits.Ratio = *req.Ratio
+	}
+	if req.Time != nil {
+		limits.Time = time.Duration(*req.Time * float64(time.Second))
+	}
+	if req.Pause != nil {
+		limits.Pause = *req.Pause
+	}
+	if err := t.SetSeedLimits(&limits); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.handleSeeding(w, r, t)
+}
+
+func (s *Server) handleResetSeeding(w http.ResponseWriter, r *http.Request, t *session.Torrent) {
+	t.SetSeedLimits(nil)
+	s.handleSeeding(w, r, t)
+}
+
+func (s *Server) handleLimits(w http.ResponseWriter, r *http.Request) {
+	down, up := s.sess.RateLimits()
+	altDown, altUp := s.sess.AltRateLimits()
+	altSpeed := s.sess.AltSpeed()
+	writeJSON(w, http.StatusOK, RateLimits{
+		MaxDownload:    &down,
+		MaxUpload:      &up,
+		AltMaxDownload: &altDown,
+		AltMaxUpload:   &altUp,
+		AltSpeed:       &altSpeed,
+	})
+}
+
+// handleSetLimits changes the rate limits given in a RateLimits body without
+// interrupting transfers
+func (s *Server) handleSetLimits(w http.ResponseWriter, r *http.Request) {
+	var req RateLimits
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	down, up := s.sess.RateLimits()
+	if req.MaxDownload != nil {
+		down = *req.MaxDownload
+	}
+	if req.MaxUpload != nil {
+		up = *req.MaxUpload
+	}
+	altDown, altUp := s.sess.AltRateLimits()
+	if req.AltMaxDownload != nil {
+		altDown = *req.AltMaxDownload
+	}
+	if req.AltMaxUpload != nil {
+		altUp = *req.AltMaxUpload
+	}
+	if down < 0 || up < 0 || altDown < 0 || altUp < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("rate limits can't be negative"))
+		return
+	}
+	s.sess.SetRateLimits(down, up)
+	s.sess.SetAltRateLimits(altDown, altUp)
+	if req.AltSpeed != nil {
+		s.sess.SetAltSpeed(*req.AltSpeed)
+	}
+	s.handleLimits(w, r)
+}
+
+// handleNetwork shows our external addresses and whether peers can reach us
+func (s *Server) handleNetwork(w http.ResponseWriter, r *http.Request) {
+	nat := s.sess.NATStatus()
+	status := NetworkStatus{
+		BehindNAT:    nat.BehindNAT,
+		PortMapped:   nat.PortMapped,
+		AnnouncePort: s.sess.AnnouncePort(),
+		Incoming:     nat.Incoming,
+	}
+	blocked := s.sess.BlockStats()
+	status.Blocked = BlockedStatus{
+		Ranges:      blocked.Ranges,
+		Connections: blocked.Connections,
+		Peers:       blocked.Peers,
+		DHT:         blocked.DHT,
+	}
+	if nat.ExternalIPv4 != nil {
+		status.ExternalIPv4 = nat.ExternalIPv4.String()
+	}
+	if nat.ExternalIPv6 != nil {
+		status.ExternalIPv6 = nat.ExternalIPv6.String()
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// writeJSON writes v as the response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,306 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+	"github.com/omkarkirpan/bittorrent-client/download"
+	"github.com/omkarkirpan/bittorrent-client/session"
+)
+
+// newTestServer starts an API server for a session without DHT
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	sess, err := session.New(session.Config{DownloadDir: t.TempDir(), RandomPort: true, DisableDHT: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	server := httptest.NewServer(NewServer(sess))
+	t.Cleanup(func() {
+		server.Close()
+		sess.Close()
+	})
+	return server
+}
+
+// torrentFile returns a .torrent file whose tracker can't be reached
+func torrentFile(t *testing.T) []byte {
+	t.Helper()
+	data, err := bencode.EncodeDict(map[string]interface{}{
+		"announce": "http://127.0.0.1:1/announce",
+		"info": map[string]interface{}{
+			"name":         "file.bin",
+			"length":       10,
+			"piece length": 16384,
+			"pieces":       strings.Repeat("x", 20),
+		},
+	})
+	if err != nil {
+		t.Fatalf("EncodeDict failed: %v", err)
+	}
+	return data
+}
+
+// do sends a request and decodes the JSON response into v, if given
+func do(t *testing.T, method, url, contentType string, body []byte, v interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("Failed to decode response of %s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestTorrentLifecycle(t *testing.T) {
+	server := newTestServer(t)
+	base := server.URL + "/api/torrents"
+
+	var added TorrentStatus
+	if code := do(t, "POST", base, "application/x-bittorrent", torrentFile(t), &added); code != http.StatusCreated {
+		t.Fatalf("Expected 201 adding a torrent, got %d", code)
+	}
+	if added.Name != "file.bin" || len(added.InfoHash) != 40 || added.Pieces != 1 {
+		t.Errorf("Unexpected status for added torrent: %+v", added)
+	}
+	one := base + "/" + added.InfoHash
+
+	var list []TorrentStatus
+	if code := do(t, "GET", base, "", nil, &list); code != http.StatusOK || len(list) != 1 {
+		t.Errorf("Expected 1 torrent, got %d (status %d)", len(list), code)
+	}
+
+	var status TorrentStatus
+	if code := do(t, "POST", one+"/pause", "", nil, &status); code != http.StatusOK || status.State != "paused" {
+		t.Errorf("Expected paused torrent, got %q (status %d)", status.State, code)
+	}
+	if code := do(t, "POST", one+"/pause", "", nil, nil); code != http.StatusConflict {
+		t.Errorf("Expected 409 pausing twice, got %d", code)
+	}
+	if code := do(t, "POST", one+"/resume", "", nil, &status); code != http.StatusOK || status.State != "downloading" {
+		t.Errorf("Expected downloading torrent, got %q (status %d)", status.State, code)
+	}
+
+	var files []FileStatus
+	if code := do(t, "GET", one+"/files", "", nil, &files); code != http.StatusOK || len(files) != 1 || files[0].Done != 0 {
+		t.Errorf("Expected one file with nothing done, got %v (status %d)", files, code)
+	}
+	if code := do(t, "PUT", one+"/files", "application/json", []byte(`{"priorities": [1]}`), &files); code != http.StatusOK || len(files) != 1 || files[0].Priority != 1 {
+		t.Errorf("Expected the file at high priority, got %v (status %d)", files, code)
+	}
+	if code := do(t, "PUT", one+"/files", "application/json", []byte(`{"priorities": [5]}`), nil); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid priority, got %d", code)
+	}
+	if code := do(t, "PUT", one+"/files", "application/json", []byte(`{"priorities": [0, 0]}`), nil); code != http.StatusConflict {
+		t.Errorf("Expected 409 for too many priorities, got %d", code)
+	}
+
+	var peers []PeerStatus
+	if code := do(t, "GET", one+"/peers", "", nil, &peers); code != http.StatusOK || len(peers) != 0 {
+		t.Errorf("Expected no peers, got %v (status %d)", peers, code)
+	}
+
+	var suspects []SuspectStatus
+	if code := do(t, "GET", one+"/suspects", "", nil, &suspects); code != http.StatusOK || len(suspects) != 0 {
+		t.Errorf("Expected no suspects, got %v (status %d)", suspects, code)
+	}
+
+	var trackers []TrackerStatus
+	if code := do(t, "GET", one+"/trackers", "", nil, &trackers); code != http.StatusOK || len(trackers) != 1 {
+		t.Errorf("Expected 1 tracker, got %v (status %d)", trackers, code)
+	} else if trackers[0].URL != "http://127.0.0.1:1/announce" {
+		t.Errorf("Expected the torrent's tracker, got %q", trackers[0].URL)
+	}
+
+	var conns ConnectionLimit
+	if code := do(t, "PUT", one+"/connections", "application/json", []byte(`{"max_connections": 20}`), &conns); code != http.StatusOK || conns.MaxConnections != 20 {
+		t.Errorf("Expected a cap of 20 connections, got %d (status %d)", conns.MaxConnections, code)
+	}
+	if code := do(t, "PUT", one+"/connections", "application/json", []byte(`{"max_connections": -1}`), nil); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative cap, got %d", code)
+	}
+
+	var limits TorrentRateLimits
+	if code := do(t, "PUT", one+"/limits", "application/json", []byte(`{"max_upload": 1000}`), &limits); code != http.StatusOK || *limits.MaxUpload != 1000 || *limits.MaxDownload != 0 {
+		t.Errorf("Expected an upload limit of 1000 only, got %v/%v (status %d)", limits.MaxDownload, limits.MaxUpload, code)
+	}
+	if code := do(t, "PUT", one+"/limits", "application/json", []byte(`{"max_download": -1}`), nil); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative limit, got %d", code)
+	}
+
+	var seeding SeedingLimits
+	if code := do(t, "PUT", one+"/seeding", "application/json", []byte(`{"ratio": 2, "time": 3600}`), &seeding); code != http.StatusOK || *seeding.Ratio != 2 || *seeding.Time != 3600 || *seeding.Pause {
+		t.Errorf("Expected a ratio of 2 and an hour, got %v/%v/%v (status %d)", *seeding.Ratio, *seeding.Time, *seeding.Pause, code)
+	}
+	if code := do(t, "PUT", one+"/seeding", "application/json", []byte(`{"time": -1}`), nil); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative seeding time, got %d", code)
+	}
+	if code := do(t, "DELETE", one+"/seeding", "", nil, &seeding); code != http.StatusOK || *seeding.Ratio != 0 || *seeding.Time != 0 {
+		t.Errorf("Expected the session's limits, none, got %v/%v (status %d)", *seeding.Ratio, *seeding.Time, code)
+	}
+
+	if code := do(t, "DELETE", one, "", nil, nil); code != http.StatusNoContent {
+		t.Errorf("Expected 204 removing the torrent, got %d", code)
+	}
+	if code := do(t, "GET", one, "", nil, nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for removed torrent, got %d", code)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server := newTestServer(t)
+	base := server.URL + "/api/torrents"
+
+	tests := []struct {
+		name        string
+		method, url string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"bad hash", "GET", base + "/xyz", "", "", http.StatusBadRequest},
+		{"unknown torrent", "GET", base + "/" + strings.Repeat("ab", 20), "", "", http.StatusNotFound},
+		{"local path", "POST", base, "application/json", `{"uri": "/etc/passwd"}`, http.StatusBadRequest},
+		{"bad json", "POST", base, "application/json", `{`, http.StatusBadRequest},
+		{"bad torrent", "POST", base, "application/x-bittorrent", "garbage", http.StatusBadRequest},
+		{"negative limit", "PUT", server.URL + "/api/limits", "application/json", `{"max_upload": -1}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body map[string]string
+			code := do(t, tt.method, tt.url, tt.contentType, []byte(tt.body), &body)
+			if code != tt.want {
+				t.Errorf("Expected status %d, got %d", tt.want, code)
+			}
+			if body["error"] == "" {
+				t.Error("Expected an error message")
+			}
+		})
+	}
+}
+
+func TestRequestChecks(t *testing.T) {
+	sess, err := session.New(session.Config{DownloadDir: t.TempDir(), RandomPort: true, DisableDHT: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+	magnet := `{"uri": "magnet:?xt=urn:btih:` + strings.Repeat("ab", 20) + `&tr=http://127.0.0.1:1/announce"}`
+
+	tests := []struct {
+		name    string
+		token   string
+		method  string
+		host    string
+		headers map[string]string
+		body    string
+		want    int
+	}{
+		{"list", "", "GET", "127.0.0.1:9091", nil, "", http.StatusOK},
+		{"localhost", "", "GET", "localhost:9091", nil, "", http.StatusOK},
+		{"other host", "", "GET", "rebound.example:9091", nil, "", http.StatusForbidden},
+		{"plain text body", "", "POST", "127.0.0.1:9091", map[string]string{"Content-Type": "text/plain"}, magnet, http.StatusUnsupportedMediaType},
+		{"form body", "", "POST", "127.0.0.1:9091", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, magnet, http.StatusUnsupportedMediaType},
+		{"cross-origin", "", "POST", "127.0.0.1:9091", map[string]string{"Content-Type": "application/json", "Origin": "http://evil.example"}, magnet, http.StatusForbidden},
+		{"cross-site fetch", "", "POST", "127.0.0.1:9091", map[string]string{"Content-Type": "application/json", "Sec-Fetch-Site": "cross-site"}, magnet, http.StatusForbidden},
+		{"same origin", "", "POST", "127.0.0.1:9091", map[string]string{"Content-Type": "application/json", "Origin": "http://127.0.0.1:9091"}, magnet, http.StatusCreated},
+		{"no token", "secret", "GET", "nas.example:9091", nil, "", http.StatusUnauthorized},
+		{"wrong token", "secret", "GET", "nas.example:9091", map[string]string{"Authorization": "Bearer guess"}, "", http.StatusUnauthorized},
+		{"token", "secret", "GET", "nas.example:9091", map[string]string{"Authorization": "Bearer secret"}, "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(sess)
+			server.SetToken(tt.token)
+			req := httptest.NewRequest(tt.method, "/api/torrents", strings.NewReader(tt.body))
+			req.Host = tt.host
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("Expected status %d, got %d: %s", tt.want, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	server := newTestServer(t)
+	url := server.URL + "/api/limits"
+
+	var limits RateLimits
+	if code := do(t, "GET", url, "", nil, &limits); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if *limits.MaxDownload != 0 || *limits.MaxUpload != 0 {
+		t.Errorf("Expected no limits, got %d down, %d up", *limits.MaxDownload, *limits.MaxUpload)
+	}
+
+	// Omitted limits stay as they are
+	for _, body := range []string{`{"max_download": 2097152, "max_upload": 1000}`, `{"max_upload": 512000}`} {
+		if code := do(t, "PUT", url, "application/json", []byte(body), &limits); code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", code)
+		}
+	}
+	if *limits.MaxDownload != 2097152 || *limits.MaxUpload != 512000 {
+		t.Errorf("Expected 2097152 down and 512000 up, got %d down, %d up", *limits.MaxDownload, *limits.MaxUpload)
+	}
+
+	// Turtle mode switches to the alternative limits and keeps the normal ones
+	body := `{"alt_max_download": 10000, "alt_max_upload": 5000, "alt_speed": true}`
+	if code := do(t, "PUT", url, "application/json", []byte(body), &limits); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if !*limits.AltSpeed || *limits.AltMaxDownload != 10000 || *limits.AltMaxUpload != 5000 || *limits.MaxDownload != 2097152 {
+		t.Errorf("Expected turtle mode at 10000 down and 5000 up, got %v at %d down, %d up",
+			*limits.AltSpeed, *limits.AltMaxDownload, *limits.AltMaxUpload)
+	}
+
+	if code := do(t, "PUT", url, "application/json", []byte(`{"alt_max_upload": -1}`), nil); code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a negative limit, got %d", code)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	server := newTestServer(t)
+
+	// No tracker or peer has told us our address yet
+	var status NetworkStatus
+	if code := do(t, "GET", server.URL+"/api/network", "", nil, &status); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if status.ExternalIPv4 != "" || status.BehindNAT || status.Incoming != 0 || status.Blocked.Ranges != 0 {
+		t.Errorf("Expected no external address yet, got %+v", status)
+	}
+}
+
+func TestPeerStatusID(t *testing.T) {
+	var id [20]byte
+	copy(id[:], "-qB4630-")
+	id[8], id[19] = 0xff, 0x01
+	status := NewPeerStatus(download.PeerInfo{PeerID: id, Client: "qBittorrent 4.6.3"})
+	if expected := "-qB4630-" + strings.Repeat(".", 12); status.PeerID != expected {
+		t.Errorf("Expected the peer ID with dots for unprintable bytes, got %q", status.PeerID)
+	}
+}
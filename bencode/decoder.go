@@ -4,23 +4,107 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"sync"
 )
 
 // Decode parses a bencoded string into its corresponding Go type
 func Decode(data []byte) (interface{}, int, error) {
+	return DecodeWith(data, Limits{})
+}
+
+// DecodeWith is like Decode but rejects input beyond limits
+func DecodeWith(data []byte, limits Limits) (interface{}, int, error) {
+	d := decoders.Get().(*decoder)
+	defer d.release()
+	d.limitState = limitState{limits: limits}
+	return d.decode(data)
+}
+
+// Lookup returns the value under key in the dictionary at the start of
+// data, still bencoded as it appears there, e.g. to hash a torrent's info
+// dictionary exactly as its author encoded it. The values before it are
+// checked but not decoded.
+func Lookup(data []byte, key string) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, errors.New("not a dictionary")
+	}
+	d := decoders.Get().(*decoder)
+	defer d.release()
+	d.limitState = limitState{}
+
+	pos := 1 // Skip the 'd' marker
+	for pos < len(data) && data[pos] != 'e' {
+		k, bytesRead, err := d.keyBytes(data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		pos += bytesRead
+		if pos >= len(data) {
+			return nil, errors.New("unexpected end of data: missing value")
+		}
+		bytesRead, err = d.skip(data[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("error decoding dictionary value: %w", err)
+		}
+		if string(k) == key {
+			return data[pos : pos+bytesRead], nil
+		}
+		pos += bytesRead
+	}
+	return nil, fmt.Errorf("key %q not found", key)
+}
+
+// maxInterned bounds how many dictionary keys a decoder remembers, so hostile
+// input with endless distinct keys can't grow it without limit
+const maxInterned = 1024
+
+// maxInternedLength is the longest dictionary key worth interning. Longer
+// keys are rare and seldom repeat.
+const maxInternedLength = 32
+
+// decoder holds buffers reused across decodes. Large tracker responses and
+// metadata are mostly lists of dictionaries with the same keys, e.g. the
+// "length" and "path" of every file, so interning keys and collecting list
+// items on a shared stack leaves little garbage behind.
+type decoder struct {
+	limitState
+	stack []interface{}     // items of the lists being decoded, innermost last
+	keys  map[string]string // dictionary keys seen so far
+}
+
+var decoders = sync.Pool{New: func() any {
+	return &decoder{keys: make(map[string]string)}
+}}
+
+// release returns the decoder to the pool, dropping references to decoded
+// values so they can be collected
+func (d *decoder) release() {
+	clear(d.stack[:cap(d.stack)])
+	d.stack = d.stack[:0]
+	// Don't let one huge list pin its stack
+	if cap(d.stack) > 64*1024 {
+		d.stack = nil
+	}
+	decoders.Put(d)
+}
+
+func (d *decoder) decode(data []byte) (interface{}, int, error) {
 	if len(data) == 0 {
 		return nil, 0, errors.New("empty data")
 	}
+	if err := d.value(); err != nil {
+		return nil, 0, err
+	}
 
 	switch data[0] {
 	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-		return decodeString(data)
+		return d.decodeString(data)
 	case 'i':
 		return decodeInteger(data)
 	case 'l':
-		return decodeList(data)
+		return d.decodeList(data)
 	case 'd':
-		return decodeDictionary(data)
+		return d.decodeDictionary(data)
 	default:
 		return nil, 0, fmt.Errorf("unknown type: %c", data[0])
 	}
@@ -29,7 +113,17 @@ func Decode(data []byte) (interface{}, int, error) {
 // decodeString parses a bencoded string
 // Format: <length>:<contents>
 // Example: 5:hello -> "hello"
-func decodeString(data []byte) (string, int, error) {
+func (d *decoder) decodeString(data []byte) (string, int, error) {
+	contents, n, err := d.stringBytes(data)
+	if err != nil {
+		return "", 0, err
+	}
+	return string(contents), n, nil
+}
+
+// stringBytes returns the contents of the bencoded string at the start of
+// data without copying them, and the bytes consumed
+func (d *decoder) stringBytes(data []byte) ([]byte, int, error) {
 	i := 0
 
 	// Find the colon separator
@@ -38,25 +132,33 @@ func decodeString(data []byte) (string, int, error) {
 	}
 
 	if i >= len(data) {
-		return "", 0, errors.New("invalid string format: no colon found")
+		return nil, 0, errors.New("invalid string format: no colon found")
 	}
 
-	// Parse the length of the string
-	length, err := strconv.Atoi(string(data[:i]))
-	if err != nil {
-		return "", 0, fmt.Errorf(("invalid string format: %v"), err)
+	// Parse the length in place, saving a conversion to a string
+	length := 0
+	for _, c := range data[:i] {
+		if c < '0' || c > '9' {
+			return nil, 0, fmt.Errorf("invalid string format: invalid length %q", data[:i])
+		}
+		length = length*10 + int(c-'0')
+		// Any longer and the data can't hold it; stop before overflowing
+		if length > len(data) {
+			return nil, 0, errors.New("string data too short")
+		}
+	}
+
+	if err := d.stringLength(int64(length)); err != nil {
+		return nil, 0, err
 	}
 
 	// Check if we have enough data
 	if i+1+length > len(data) {
-		return "", 0, errors.New("string data too short")
+		return nil, 0, errors.New("string data too short")
 	}
 
-	// Extract the string content
-	result := string(data[i+1 : i+1+length])
-
-	// Return string, total bytes consumed, nil error
-	return result, i + 1 + length, nil
+	// Return contents, total bytes consumed, nil error
+	return data[i+1 : i+1+length], i + 1 + length, nil
 }
 
 // decodeInteger parses a bencoded integer
@@ -78,19 +180,24 @@ func decodeInteger(data []byte) (int64, int, error) {
 	}
 
 	// Parse the integer
-	numStr := string(data[1:endIndex])
+	digits := data[1:endIndex]
 
 	// Check for leading zeros or empty string
-	if len(numStr) > 1 && numStr[0] == '0' {
+	if len(digits) > 1 && digits[0] == '0' {
 		return 0, 0, errors.New("invalid integer format: leading zeros")
 	}
 
 	// Check for negative zero
-	if len(numStr) > 1 && numStr[0] == '-' && numStr[1] == '0' {
+	if len(digits) > 1 && digits[0] == '-' && digits[1] == '0' {
 		return 0, 0, errors.New("invalid integer format: negative zero")
 	}
 
-	num, err := strconv.ParseInt(numStr, 10, 64)
+	// Plain numbers that can't overflow are parsed in place. strconv handles
+	// the rest, and words the errors, at the cost of converting to a string.
+	if num, ok := parseSmall(digits); ok {
+		return num, endIndex + 1, nil
+	}
+	num, err := strconv.ParseInt(string(digits), 10, 64)
 	if err != nil {
 		return 0, 0, fmt.Errorf("invalid integer: %v", err)
 	}
@@ -99,26 +206,57 @@ func decodeInteger(data []byte) (int64, int, error) {
 	return num, endIndex + 1, nil
 }
 
+// parseSmall parses an optionally negative number of up to 18 digits, which
+// always fits an int64
+func parseSmall(digits []byte) (int64, bool) {
+	neg := len(digits) > 0 && digits[0] == '-'
+	if neg {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 || len(digits) > 18 {
+		return 0, false
+	}
+	var n int64
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+	}
+	if neg {
+		n = -n
+	}
+	return n, true
+}
+
 // decodeList parses a bencoded list
 // Format: l<contents>e
 // Example: li1ei2ei3ee -> [1, 2, 3]
-func decodeList(data []byte) ([]interface{}, int, error) {
+func (d *decoder) decodeList(data []byte) ([]interface{}, int, error) {
 	if len(data) < 2 || data[0] != 'l' {
 		return nil, 0, errors.New("invalid list format")
 	}
+	if err := d.enter(); err != nil {
+		return nil, 0, err
+	}
+	defer d.leave()
 
-	result := []interface{}{}
+	// Collect the items on the shared stack, above those of any enclosing
+	// lists, so the result can be allocated once at its final size instead
+	// of growing as items arrive
+	base := len(d.stack)
+	defer func() { d.stack = d.stack[:base] }()
 	pos := 1 // Skip the 'l' marker
 
 	for pos < len(data) && data[pos] != 'e' {
 		// Decode the next item in the list
-		item, bytesRead, err := Decode(data[pos:])
+		item, bytesRead, err := d.decode(data[pos:])
 		if err != nil {
-			return nil, 0, fmt.Errorf("error decoding list item: %v", err)
+			return nil, 0, fmt.Errorf("error decoding list item: %w", err)
 		}
 
-		// Add item to result and move position forward
-		result = append(result, item)
+		// Add item to the stack and move position forward
+		d.stack = append(d.stack, item)
 		pos += bytesRead
 	}
 
@@ -129,6 +267,9 @@ func decodeList(data []byte) ([]interface{}, int, error) {
 	// Skip the 'e' marker
 	pos++
 
+	result := make([]interface{}, len(d.stack)-base)
+	copy(result, d.stack[base:])
+
 	// Return list, total bytes consumed, nil error
 	return result, pos, nil
 }
@@ -136,27 +277,30 @@ func decodeList(data []byte) ([]interface{}, int, error) {
 // decodeDictionary parses a bencoded dictionary
 // Format: d<key><value>...e
 // Example: d3:foo3:bar5:helloi52ee -> {"foo": "bar", "hello": 52}
-func decodeDictionary(data []byte) (map[string]interface{}, int, error) {
+func (d *decoder) decodeDictionary(data []byte) (map[string]interface{}, int, error) {
 	if len(data) < 2 || data[0] != 'd' {
 		return nil, 0, errors.New("invalid dictionary format")
 	}
+	if err := d.enter(); err != nil {
+		return nil, 0, err
+	}
+	defer d.leave()
 
 	result := make(map[string]interface{})
 	pos := 1 // Skip the 'd' marker
+	var prev string
 
 	// Dictionary format is a series of key-value pairs
 	for pos < len(data) && data[pos] != 'e' {
 		// Keys must be strings in bencode
-		keyInterface, bytesRead, err := Decode(data[pos:])
+		key, bytesRead, err := d.decodeKey(data[pos:])
 		if err != nil {
-			return nil, 0, fmt.Errorf("error decoding dictionary key: %v", err)
+			return nil, 0, err
 		}
-
-		// Ensure the key is a string
-		key, ok := keyInterface.(string)
-		if !ok {
-			return nil, 0, errors.New("dictionary key must be a string")
+		if err := d.key(prev, key, len(result) == 0); err != nil {
+			return nil, 0, fmt.Errorf("%w: %q", err, key)
 		}
+		prev = key
 
 		pos += bytesRead
 
@@ -165,9 +309,9 @@ func decodeDictionary(data []byte) (map[string]interface{}, int, error) {
 			return nil, 0, errors.New("unexpected end of data: missing value")
 		}
 
-		value, bytesRead, err := Decode(data[pos:])
+		value, bytesRead, err := d.decode(data[pos:])
 		if err != nil {
-			return nil, 0, fmt.Errorf("error decoding dictionary value: %v", err)
+			return nil, 0, fmt.Errorf("error decoding dictionary value: %w", err)
 		}
 
 		// Add key-value pair to result
@@ -185,3 +329,44 @@ func decodeDictionary(data []byte) (map[string]interface{}, int, error) {
 	// Return dictionary, total bytes consumed, nil error
 	return result, pos, nil
 }
+
+// decodeKey parses a dictionary key, reusing the string of an equal key seen
+// before instead of allocating a new one
+func (d *decoder) decodeKey(data []byte) (string, int, error) {
+	b, n, err := d.keyBytes(data)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(b) > maxInternedLength {
+		return string(b), n, nil
+	}
+	// The lookup converts b without allocating
+	if key, ok := d.keys[string(b)]; ok {
+		return key, n, nil
+	}
+	key := string(b)
+	if len(d.keys) < maxInterned {
+		d.keys[key] = key
+	}
+	return key, n, nil
+}
+
+// keyBytes parses a dictionary key without copying it
+func (d *decoder) keyBytes(data []byte) ([]byte, int, error) {
+	if data[0] < '0' || data[0] > '9' {
+		// Not a string; check it anyway to report what it is
+		if _, err := d.skip(data); err != nil {
+			return nil, 0, fmt.Errorf("error decoding dictionary key: %v", err)
+		}
+		return nil, 0, errors.New("dictionary key must be a string")
+	}
+
+	if err := d.value(); err != nil {
+		return nil, 0, err
+	}
+	b, n, err := d.stringBytes(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error decoding dictionary key: %w", err)
+	}
+	return b, n, nil
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -32,6 +33,20 @@ func TestDecode(t *testing.T) {
 				bytes:    0,
 				err:      errors.New("string data too short"),
 			},
+			{
+				name:     "Invalid bencoded string (non-numeric length)",
+				input:    []byte("1x:hello"),
+				expected: "",
+				bytes:    0,
+				err:      errors.New(`invalid string format: invalid length "1x"`),
+			},
+			{
+				name:     "Length beyond the data",
+				input:    []byte("99999999999999999999999:a"),
+				expected: "",
+				bytes:    0,
+				err:      errors.New("string data too short"),
+			},
 		})
 	})
 
@@ -98,6 +113,18 @@ func TestDecode(t *testing.T) {
 				bytes:    0,
 				err:      errors.New("error decoding list item: invalid string format: no colon found"),
 			},
+			{
+				name:  "Valid nested lists",
+				input: []byte("lli1ei2eeli3eelei4ee"),
+				expected: []interface{}{
+					[]interface{}{int64(1), int64(2)},
+					[]interface{}{int64(3)},
+					[]interface{}{},
+					int64(4),
+				},
+				bytes: 20,
+				err:   nil,
+			},
 		})
 	})
 
@@ -258,3 +285,51 @@ func runTests(t *testing.T, tests []testCase) {
 		})
 	}
 }
+
+func TestDecodeAllocs(t *testing.T) {
+	// Metadata of a torrent with many files repeats the same keys in every
+	// file's dictionary
+	var b strings.Builder
+	b.WriteString("d5:filesl")
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("file%d", i)
+		fmt.Fprintf(&b, "d6:lengthi%de4:pathl%d:%see", 100000+i, len(name), name)
+	}
+	b.WriteString("ee")
+	data := []byte(b.String())
+
+	result, _, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	files := result.(map[string]interface{})["files"].([]interface{})
+	if len(files) != 1000 || cap(files) != 1000 {
+		t.Errorf("Expected a list of 1000 files sized exactly, got length %d and capacity %d", len(files), cap(files))
+	}
+
+	// Each file costs its map, the boxed length, the path list and the
+	// boxed name; keys and list growth should cost nothing
+	allocs := testing.AllocsPerRun(10, func() {
+		if _, _, err := Decode(data); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > 7.5*1000 {
+		t.Errorf("Expected at most 7.5 allocations per file, got %.1f", allocs/1000)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	data := []byte("d1:ad1:xi1ee1:bli2ei3ee1:c1:ze")
+	for key, expected := range map[string]string{"a": "d1:xi1ee", "b": "li2ei3ee", "c": "1:z"} {
+		if got, err := Lookup(data, key); err != nil || string(got) != expected {
+			t.Errorf("Lookup(%q): expected %q, got %q (err: %v)", key, expected, got, err)
+		}
+	}
+	if _, err := Lookup(data, "d"); err == nil {
+		t.Error("Expected error for a missing key")
+	}
+	if _, err := Lookup([]byte("li1ee"), "a"); err == nil {
+		t.Error("Expected error for a list")
+	}
+}
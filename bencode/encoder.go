@@ -7,6 +7,9 @@ import (
 	"strconv"
 )
 
+// RawValue is an already bencoded value, written out as is
+type RawValue []byte
+
 // EncodeDict encodes a map into a bencoded dictionary
 func EncodeDict(dict map[string]interface{}) ([]byte, error) {
 	var buf bytes.Buffer
@@ -42,6 +45,15 @@ func EncodeDict(dict map[string]interface{}) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// Encode encodes a single value: a string, integer, list or dictionary
+func Encode(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeValue(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // encodeValue encodes a value based on its type
 func encodeValue(buf *bytes.Buffer, value interface{}) error {
 	switch v := value.(type) {
@@ -78,6 +90,8 @@ func encodeValue(buf *bytes.Buffer, value interface{}) error {
 			return err
 		}
 		buf.Write(dictBytes)
+	case RawValue:
+		buf.Write(v)
 	case []string:
 		// Special case for string slices
 		buf.WriteByte('l')
@@ -0,0 +1,86 @@
+package bencode
+
+import "errors"
+
+// DefaultMaxDepth is how deeply lists and dictionaries may nest unless
+// Limits say otherwise. Real torrents and messages nest a few levels; the
+// bound keeps hostile input from exhausting the stack.
+const DefaultMaxDepth = 256
+
+// Errors for input that breaks the limits, wrapped with where it happened.
+// Use errors.Is to check for them.
+var (
+	ErrTooDeep       = errors.New("nesting too deep")
+	ErrStringTooLong = errors.New("string too long")
+	ErrTooManyValues = errors.New("too many values")
+	ErrKeyOrder      = errors.New("dictionary keys out of order")
+	ErrDuplicateKey  = errors.New("duplicate dictionary key")
+)
+
+// Limits bound what a decoder accepts from untrusted input, such as tracker
+// responses and peer messages
+type Limits struct {
+	MaxDepth  int  // Nesting of lists and dictionaries; 0 means DefaultMaxDepth
+	MaxString int  // Bytes in one string; 0 is unlimited
+	MaxValues int  // Values in total, counting every list item, key and value; 0 is unlimited
+	Strict    bool // Reject dictionaries whose keys aren't sorted or repeat, as bencode requires
+}
+
+// maxDepth returns the nesting allowed
+func (l Limits) maxDepth() int {
+	if l.MaxDepth > 0 {
+		return l.MaxDepth
+	}
+	return DefaultMaxDepth
+}
+
+// limitState tracks a decode against its limits
+type limitState struct {
+	limits Limits
+	depth  int // lists and dictionaries open
+	values int // values decoded so far
+}
+
+// value counts a value, at the depth of the list or dictionary around it
+func (s *limitState) value() error {
+	s.values++
+	if s.limits.MaxValues > 0 && s.values > s.limits.MaxValues {
+		return ErrTooManyValues
+	}
+	return nil
+}
+
+// enter opens a list or dictionary; leave closes it
+func (s *limitState) enter() error {
+	s.depth++
+	if s.depth > s.limits.maxDepth() {
+		return ErrTooDeep
+	}
+	return nil
+}
+
+func (s *limitState) leave() {
+	s.depth--
+}
+
+// stringLength checks the length of a string about to be read
+func (s *limitState) stringLength(n int64) error {
+	if s.limits.MaxString > 0 && n > int64(s.limits.MaxString) {
+		return ErrStringTooLong
+	}
+	return nil
+}
+
+// key checks a dictionary key against the one before it in strict mode
+func (s *limitState) key(prev, key string, first bool) error {
+	if !s.limits.Strict || first {
+		return nil
+	}
+	switch {
+	case key == prev:
+		return ErrDuplicateKey
+	case key < prev:
+		return ErrKeyOrder
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// maxIntegerLength bounds the digits of an integer, sign included; int64
+// needs at most 20
+const maxIntegerLength = 20
+
+// A Decoder reads bencoded values from a stream as they arrive, so a
+// tracker response or .torrent file needn't be read into memory first. It
+// buffers its input and may read past the end of a value.
+type Decoder struct {
+	// Limits bound each value decoded. Set MaxString to keep a peer or
+	// tracker from making the decoder buffer as much as it cares to send.
+	Limits Limits
+
+	r     *bufio.Reader
+	state limitState
+	raw   bytes.Buffer // the encoding of the value being read
+}
+
+// NewDecoder returns a decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// Decode reads the next value and stores it in v as Unmarshal does. At the
+// end of the stream it returns io.EOF, and io.ErrUnexpectedEOF if it ends
+// partway through a value.
+func (d *Decoder) Decode(v interface{}) error {
+	if err := checkPointer(v); err != nil {
+		return err
+	}
+	d.state = limitState{limits: d.Limits}
+	// A fresh buffer, since a Value in v may keep the last one
+	d.raw = bytes.Buffer{}
+	if err := d.readValue(); err != nil {
+		return err
+	}
+	return assign(reflect.ValueOf(v).Elem(), Value{raw: d.raw.Bytes()})
+}
+
+// readValue reads a value, checking it and collecting its encoding
+func (d *Decoder) readValue() error {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if err := d.state.value(); err != nil {
+		return err
+	}
+	switch {
+	case c >= '0' && c <= '9':
+		d.r.UnreadByte()
+		_, err := d.readString()
+		return err
+	case c == 'i':
+		return d.readInteger()
+	case c == 'l':
+		return d.readList()
+	case c == 'd':
+		return d.readDictionary()
+	default:
+		return fmt.Errorf("unknown type: %c", c)
+	}
+}
+
+// readString reads a string, growing its buffer with the data that arrives
+// rather than trusting the length up front, and returns its contents
+func (d *Decoder) readString() ([]byte, error) {
+	header, err := d.r.ReadSlice(':')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("invalid string format: invalid length %q", header)
+	}
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	length := int64(0)
+	for _, c := range header[:len(header)-1] {
+		if c < '0' || c > '9' {
+			return nil, fmt.Errorf("invalid string format: invalid length %q", header[:len(header)-1])
+		}
+		length = length*10 + int64(c-'0')
+		if length > 1<<50 {
+			return nil, errors.New("invalid string format: length too large")
+		}
+	}
+	if err := d.state.stringLength(length); err != nil {
+		return nil, err
+	}
+
+	d.raw.Write(header)
+	start := d.raw.Len()
+	if n, err := io.CopyN(&d.raw, d.r, length); n < length {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return d.raw.Bytes()[start:], nil
+}
+
+// readInteger reads an integer after its 'i' marker
+func (d *Decoder) readInteger() error {
+	digits := []byte{'i'}
+	for {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		digits = append(digits, c)
+		if c == 'e' {
+			break
+		}
+		if len(digits) > maxIntegerLength+1 {
+			return errors.New("invalid integer format: too long")
+		}
+	}
+	if _, _, err := decodeInteger(digits); err != nil {
+		return err
+	}
+	d.raw.Write(digits)
+	return nil
+}
+
+// readList reads a list after its 'l' marker
+func (d *Decoder) readList() error {
+	if err := d.state.enter(); err != nil {
+		return err
+	}
+	defer d.state.leave()
+	d.raw.WriteByte('l')
+	for {
+		if end, err := d.readEnd(); end || err != nil {
+			return err
+		}
+		if err := d.readValue(); err != nil {
+			return fmt.Errorf("error decoding list item: %w", unexpected(err))
+		}
+	}
+}
+
+// readDictionary reads a dictionary after its 'd' marker
+func (d *Decoder) readDictionary() error {
+	if err := d.state.enter(); err != nil {
+		return err
+	}
+	defer d.state.leave()
+	d.raw.WriteByte('d')
+	var prev []byte
+	for first := true; ; first = false {
+		if end, err := d.readEnd(); end || err != nil {
+			return err
+		}
+		c, err := d.r.Peek(1)
+		if err != nil {
+			return unexpected(err)
+		}
+		if c[0] < '0' || c[0] > '9' {
+			return errors.New("dictionary key must be a string")
+		}
+		if err := d.state.value(); err != nil {
+			return err
+		}
+		key, err := d.readString()
+		if err != nil {
+			return fmt.Errorf("error decoding dictionary key: %w", err)
+		}
+		if d.state.limits.Strict {
+			if err := d.state.key(string(prev), string(key), first); err != nil {
+				return fmt.Errorf("%w: %q", err, key)
+			}
+		}
+		prev = key
+		if err := d.readValue(); err != nil {
+			return fmt.Errorf("error decoding dictionary value: %w", unexpected(err))
+		}
+	}
+}
+
+// readEnd consumes the 'e' closing a list or dictionary, if it is next
+func (d *Decoder) readEnd() (bool, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return false, unexpected(err)
+	}
+	if c == 'e' {
+		d.raw.WriteByte('e')
+		return true, nil
+	}
+	return false, d.r.UnreadByte()
+}
+
+// unexpected turns the end of the stream inside a value into
+// io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
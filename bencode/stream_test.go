@@ -0,0 +1,110 @@
+package bencode
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecoder(t *testing.T) {
+	// Values arrive one byte at a time, back to back
+	input := "d4:infod4:name3:fooe4:listli-3e0:ee" + "i42e" + "4:spam"
+	d := NewDecoder(iotest.OneByteReader(strings.NewReader(input)))
+
+	var first struct {
+		Info struct {
+			Name string `bencode:"name"`
+		} `bencode:"info"`
+		List []interface{} `bencode:"list"`
+	}
+	if err := d.Decode(&first); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if first.Info.Name != "foo" || !reflect.DeepEqual(first.List, []interface{}{int64(-3), ""}) {
+		t.Errorf("Unexpected first value: %+v", first)
+	}
+	var second int
+	if err := d.Decode(&second); err != nil || second != 42 {
+		t.Errorf("Expected 42, got %d (err: %v)", second, err)
+	}
+	var third interface{}
+	if err := d.Decode(&third); err != nil || third != "spam" {
+		t.Errorf("Expected spam, got %v (err: %v)", third, err)
+	}
+	if err := d.Decode(&third); err != io.EOF {
+		t.Errorf("Expected io.EOF at the end, got %v", err)
+	}
+
+	testCases := []struct {
+		input string
+		err   string
+	}{
+		{"d3:fooli1e", "error decoding dictionary value: unexpected EOF"},
+		{"10:abc", "unexpected EOF"},
+		{"99999999999999999999:a", "invalid string format: length too large"},
+		{"1x:a", `invalid string format: invalid length "1x"`},
+		{"i12345678901234567890123e", "invalid integer format: too long"},
+		{"i03e", "invalid integer format: leading zeros"},
+		{"di1e1:ae", "dictionary key must be a string"},
+		{"x", "unknown type: x"},
+	}
+	for _, tc := range testCases {
+		var v interface{}
+		err := NewDecoder(strings.NewReader(tc.input)).Decode(&v)
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("Decode(%q): expected error %q, got %v", tc.input, tc.err, err)
+		}
+	}
+	var v interface{}
+	if err := NewDecoder(strings.NewReader("l1:a")).Decode(&v); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected io.ErrUnexpectedEOF for a truncated list, got %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	testCases := []struct {
+		name   string
+		input  string
+		limits Limits
+		err    error
+	}{
+		{"Within the limits", "d1:ali1ei2ee1:b3:abce", Limits{MaxDepth: 2, MaxString: 3, MaxValues: 7, Strict: true}, nil},
+		{"Default depth", strings.Repeat("l", DefaultMaxDepth+1) + strings.Repeat("e", DefaultMaxDepth+1), Limits{}, ErrTooDeep},
+		{"Depth", "d1:alleee", Limits{MaxDepth: 2}, ErrTooDeep},
+		{"String length", "l3:abc4:abcde", Limits{MaxString: 3}, ErrStringTooLong},
+		{"Key length", "d4:abcdi1ee", Limits{MaxString: 3}, ErrStringTooLong},
+		{"Values", "li1ei2ei3ee", Limits{MaxValues: 3}, ErrTooManyValues},
+		{"Unsorted keys", "d1:bi1e1:ai2ee", Limits{Strict: true}, ErrKeyOrder},
+		{"Duplicate keys", "d1:ai1e1:ai2ee", Limits{Strict: true}, ErrDuplicateKey},
+		{"Unsorted keys allowed", "d1:bi1e1:ai2ee", Limits{}, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := DecodeWith([]byte(tc.input), tc.limits); !errors.Is(err, tc.err) {
+				t.Errorf("DecodeWith: expected %v, got %v", tc.err, err)
+			}
+			if _, _, err := ScanWith([]byte(tc.input), tc.limits); !errors.Is(err, tc.err) {
+				t.Errorf("ScanWith: expected %v, got %v", tc.err, err)
+			}
+			d := NewDecoder(strings.NewReader(tc.input))
+			d.Limits = tc.limits
+			var v interface{}
+			if err := d.Decode(&v); !errors.Is(err, tc.err) {
+				t.Errorf("Decoder: expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+
+	// Limits apply to each value on its own
+	d := NewDecoder(strings.NewReader("li1ei2eeli3ei4ee"))
+	d.Limits = Limits{MaxValues: 3}
+	for i := 0; i < 2; i++ {
+		var v []int
+		if err := d.Decode(&v); err != nil {
+			t.Errorf("Decode %d failed: %v", i, err)
+		}
+	}
+}
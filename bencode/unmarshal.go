@@ -0,0 +1,251 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Unmarshal decodes bencoded data into the value v points to. Strings go
+// into strings, byte slices and byte arrays of the same length, integers
+// into integer types and bools (nonzero is true), lists into slices and
+// dictionaries into maps with string keys or structs. An interface{} takes
+// the value as Decode returns it, a RawValue its encoding and a Value a view
+// of it that shares data's memory. Data after the first value is ignored.
+//
+// Struct fields are matched by their `bencode:"name"` tag, or by their name
+// in lower case without one; a tag of "-" skips the field. The fields of
+// embedded structs are matched as if they were the outer struct's. A field
+// is required unless its tag says omitempty: a required key that is missing
+// or doesn't fit the field is an error, while an optional one is left at its
+// zero value, as parsers of the loosely written torrents in the wild need.
+//
+// The data is scanned in place rather than decoded first, so only what ends
+// up in v is copied: a struct skips the keys it has no field for, and maps
+// are only built for map and interface{} destinations.
+func Unmarshal(data []byte, v interface{}) error {
+	if err := checkPointer(v); err != nil {
+		return err
+	}
+	value, _, err := Scan(data)
+	if err != nil {
+		return err
+	}
+	return assign(reflect.ValueOf(v).Elem(), value)
+}
+
+// checkPointer makes sure v can be decoded into
+func checkPointer(v interface{}) error {
+	if rv := reflect.ValueOf(v); rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("unmarshal needs a non-nil pointer, got %T", v)
+	}
+	return nil
+}
+
+var (
+	valueType    = reflect.TypeOf(Value{})
+	rawValueType = reflect.TypeOf(RawValue(nil))
+)
+
+// assign stores a scanned value in dst
+func assign(dst reflect.Value, src Value) error {
+	switch dst.Type() {
+	case valueType:
+		dst.Set(reflect.ValueOf(src))
+		return nil
+	case rawValueType:
+		dst.SetBytes(bytes.Clone(src.raw))
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Pointer:
+		elem := reflect.New(dst.Type().Elem())
+		if err := assign(elem.Elem(), src); err != nil {
+			return err
+		}
+		dst.Set(elem)
+		return nil
+	case reflect.Interface:
+		if dst.NumMethod() != 0 {
+			return fmt.Errorf("cannot unmarshal into %s", dst.Type())
+		}
+		decoded, err := src.Decode()
+		if err != nil {
+			return err
+		}
+		dst.Set(reflect.ValueOf(decoded))
+		return nil
+	}
+
+	switch src.Kind() {
+	case String:
+		b, _ := src.Bytes()
+		switch {
+		case dst.Kind() == reflect.String:
+			dst.SetString(string(b))
+		case dst.Kind() == reflect.Slice && dst.Type().Elem().Kind() == reflect.Uint8:
+			dst.SetBytes(append([]byte{}, b...))
+		case dst.Kind() == reflect.Array && dst.Type().Elem().Kind() == reflect.Uint8:
+			if len(b) != dst.Len() {
+				return fmt.Errorf("expected a string of %d bytes, got %d", dst.Len(), len(b))
+			}
+			reflect.Copy(dst, reflect.ValueOf(b))
+		default:
+			return mismatch(dst, src)
+		}
+	case Integer:
+		n, _ := src.Int()
+		switch dst.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if dst.OverflowInt(n) {
+				return fmt.Errorf("integer %d out of range for %s", n, dst.Type())
+			}
+			dst.SetInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if n < 0 || dst.OverflowUint(uint64(n)) {
+				return fmt.Errorf("integer %d out of range for %s", n, dst.Type())
+			}
+			dst.SetUint(uint64(n))
+		case reflect.Bool:
+			dst.SetBool(n != 0)
+		default:
+			return mismatch(dst, src)
+		}
+	case List:
+		if dst.Kind() != reflect.Slice {
+			return mismatch(dst, src)
+		}
+		n := src.Len()
+		items := reflect.MakeSlice(dst.Type(), n, n)
+		var err error
+		i := 0
+		src.Items(func(item Value) bool {
+			if err = assign(items.Index(i), item); err != nil {
+				err = fmt.Errorf("item %d: %v", i, err)
+				return false
+			}
+			i++
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		dst.Set(items)
+	case Dictionary:
+		switch {
+		case dst.Kind() == reflect.Struct:
+			return assignStruct(dst, src)
+		case dst.Kind() == reflect.Map && dst.Type().Key().Kind() == reflect.String:
+			m := reflect.MakeMapWithSize(dst.Type(), src.Len())
+			var err error
+			src.Entries(func(key []byte, value Value) bool {
+				elem := reflect.New(dst.Type().Elem()).Elem()
+				if err = assign(elem, value); err != nil {
+					err = fmt.Errorf("%s: %v", key, err)
+					return false
+				}
+				m.SetMapIndex(reflect.ValueOf(string(key)).Convert(dst.Type().Key()), elem)
+				return true
+			})
+			if err != nil {
+				return err
+			}
+			dst.Set(m)
+		default:
+			return mismatch(dst, src)
+		}
+	default:
+		return errors.New("invalid value")
+	}
+	return nil
+}
+
+// structField is how a struct field is filled from a dictionary
+type structField struct {
+	name     string
+	optional bool
+	embedded bool // an untagged embedded struct, whose fields count as the outer one's
+	skip     bool // unexported, or tagged "-"
+}
+
+// assignStruct fills a struct's fields from a dictionary, finding every
+// field's value in a single pass over it
+func assignStruct(dst reflect.Value, dict Value) error {
+	typ := dst.Type()
+	fields := make([]structField, typ.NumField())
+	for i := range fields {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			fields[i].skip = true
+			continue
+		}
+		if _, tagged := field.Tag.Lookup("bencode"); field.Anonymous && !tagged && field.Type.Kind() == reflect.Struct {
+			fields[i].embedded = true
+			continue
+		}
+		fields[i].name, fields[i].optional = fieldKey(field)
+		fields[i].skip = fields[i].name == "-"
+	}
+
+	// Of repeated keys the last wins, as with Decode
+	values := make([]Value, len(fields))
+	dict.Entries(func(key []byte, value Value) bool {
+		for i, f := range fields {
+			if !f.skip && !f.embedded && f.name == string(key) {
+				values[i] = value
+			}
+		}
+		return true
+	})
+
+	for i, f := range fields {
+		switch {
+		case f.skip:
+			continue
+		case f.embedded:
+			if err := assignStruct(dst.Field(i), dict); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if values[i].Kind() == Invalid {
+			if !f.optional {
+				return fmt.Errorf("missing or invalid %s", f.name)
+			}
+			continue
+		}
+		// Decode into a fresh value, so a field that fails halfway stays zero
+		decoded := reflect.New(typ.Field(i).Type).Elem()
+		if err := assign(decoded, values[i]); err != nil {
+			if !f.optional {
+				return fmt.Errorf("missing or invalid %s: %v", f.name, err)
+			}
+			continue
+		}
+		dst.Field(i).Set(decoded)
+	}
+	return nil
+}
+
+// fieldKey returns the dictionary key of a struct field and whether it may
+// be left out
+func fieldKey(field reflect.StructField) (string, bool) {
+	tag, ok := field.Tag.Lookup("bencode")
+	if !ok {
+		return strings.ToLower(field.Name), false
+	}
+	name, opts, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name, opts == "omitempty"
+}
+
+// mismatch describes a value that doesn't fit dst
+func mismatch(dst reflect.Value, src Value) error {
+	return fmt.Errorf("cannot unmarshal %s into %s", src.Kind(), dst.Type())
+}
@@ -0,0 +1,126 @@
+package bencode
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshal(t *testing.T) {
+	type file struct {
+		Length int64
+		Path   []string `bencode:"path"`
+	}
+	type info struct {
+		Name     string         `bencode:"name"`
+		Pieces   []byte         `bencode:"pieces"`
+		Files    []file         `bencode:"files,omitempty"`
+		Private  bool           `bencode:"private,omitempty"`
+		Port     uint16         `bencode:"port,omitempty"`
+		IP       net.IP         `bencode:"ip,omitempty"`
+		Hash     [4]byte        `bencode:"hash,omitempty"`
+		Extra    any            `bencode:"extra,omitempty"`
+		Sizes    *[]int         `bencode:"sizes,omitempty"`
+		Ignored  string         `bencode:"-"`
+		Counts   map[string]int `bencode:"counts,omitempty"`
+		internal string
+	}
+
+	testCases := []struct {
+		name     string
+		input    string
+		expected info
+		err      string
+	}{
+		{
+			name:  "Every field",
+			input: "d6:countsd1:ai1e1:bi2ee5:extrali1ee5:filesld6:lengthi5e4:pathl1:a1:beee4:hash4:abcd2:ip4:\x7f\x00\x00\x017:Ignored1:x4:name3:foo6:pieces2:xy4:porti6881e7:privatei1e5:sizesli3eee",
+			expected: info{
+				Name:    "foo",
+				Pieces:  []byte("xy"),
+				Files:   []file{{Length: 5, Path: []string{"a", "b"}}},
+				Private: true,
+				Port:    6881,
+				IP:      net.IPv4(127, 0, 0, 1).To4(),
+				Hash:    [4]byte{'a', 'b', 'c', 'd'},
+				Extra:   []interface{}{int64(1)},
+				Sizes:   &[]int{3},
+				Counts:  map[string]int{"a": 1, "b": 2},
+			},
+		},
+		{
+			name:     "Optional fields of the wrong type are left out",
+			input:    "d5:filesli1ee4:hash2:ab4:name3:foo6:pieces0:4:porti70000e7:private3:yese",
+			expected: info{Name: "foo", Pieces: []byte{}},
+		},
+		{
+			name:  "Missing required field",
+			input: "d6:pieces0:e",
+			err:   "missing or invalid name",
+		},
+		{
+			name:  "Required field of the wrong type",
+			input: "d4:namei1e6:pieces0:e",
+			err:   "missing or invalid name: cannot unmarshal integer into string",
+		},
+		{
+			name:  "Not a dictionary",
+			input: "li1ee",
+			err:   "cannot unmarshal list into bencode.info",
+		},
+		{
+			name:  "Invalid bencode",
+			input: "d4:name",
+			err:   "unexpected end of data: missing value",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got info
+			err := Unmarshal([]byte(tc.input), &got)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Errorf("Expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+
+	// Nested required fields report where they failed
+	var files struct {
+		Files []file `bencode:"files"`
+	}
+	err := Unmarshal([]byte("d5:filesld6:lengthi1e4:pathl1:aeed6:lengthi2eeee"), &files)
+	if err == nil || err.Error() != "missing or invalid files: item 1: missing or invalid path" {
+		t.Errorf("Expected an error for the second file's path, got %v", err)
+	}
+
+	// Values can be kept encoded, as a copy or a view of the input
+	var raw struct {
+		Info  RawValue `bencode:"info"`
+		Files Value    `bencode:"files"`
+	}
+	data := []byte("d5:filesli1ee4:infod4:name1:aee")
+	if err := Unmarshal(data, &raw); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if string(raw.Info) != "d4:name1:ae" || string(raw.Files.Raw()) != "li1ee" {
+		t.Errorf("Expected the encoded info and files, got %q and %q", raw.Info, raw.Files.Raw())
+	}
+	data[len("d5:filesli")] = '2'
+	if string(raw.Files.Raw()) != "li2ee" {
+		t.Errorf("Expected the Value to share the input, got %q", raw.Files.Raw())
+	}
+
+	if err := Unmarshal([]byte("i1e"), files); err == nil {
+		t.Error("Expected an error for a non-pointer")
+	}
+}
@@ -0,0 +1,292 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Kind is the type of a bencoded value
+type Kind int
+
+// Kinds of values; a zero Value is Invalid
+const (
+	Invalid Kind = iota
+	String
+	Integer
+	List
+	Dictionary
+)
+
+func (k Kind) String() string {
+	switch k {
+	case String:
+		return "string"
+	case Integer:
+		return "integer"
+	case List:
+		return "list"
+	case Dictionary:
+		return "dictionary"
+	default:
+		return "invalid"
+	}
+}
+
+// Value is a bencoded value viewed in place, in the data it was scanned from.
+// Nothing is decoded until asked for, and strings come back as slices of the
+// data rather than copies, so a large .torrent can be read without copying
+// its piece hashes or building a map for every dictionary. The data must not
+// change while the Value is in use.
+type Value struct {
+	raw []byte // exactly the value's encoding, checked to be well formed
+}
+
+// Scan checks the bencoded value at the start of data, as Decode does, and
+// returns a view of it and the number of bytes it spans, without decoding
+// or allocating anything
+func Scan(data []byte) (Value, int, error) {
+	return ScanWith(data, Limits{})
+}
+
+// ScanWith is like Scan but rejects input beyond limits
+func ScanWith(data []byte, limits Limits) (Value, int, error) {
+	d := decoders.Get().(*decoder)
+	defer d.release()
+	d.limitState = limitState{limits: limits}
+	n, err := d.skip(data)
+	if err != nil {
+		return Value{}, 0, err
+	}
+	return Value{raw: data[:n]}, n, nil
+}
+
+// Kind returns the type of the value
+func (v Value) Kind() Kind {
+	if len(v.raw) == 0 {
+		return Invalid
+	}
+	switch v.raw[0] {
+	case 'i':
+		return Integer
+	case 'l':
+		return List
+	case 'd':
+		return Dictionary
+	default:
+		return String
+	}
+}
+
+// Raw returns the value's encoding, sharing the scanned data's memory
+func (v Value) Raw() []byte {
+	return v.raw
+}
+
+// Bytes returns the contents of a string, sharing the scanned data's memory
+func (v Value) Bytes() ([]byte, bool) {
+	if v.Kind() != String {
+		return nil, false
+	}
+	return v.raw[bytes.IndexByte(v.raw, ':')+1:], true
+}
+
+// Int returns the value of an integer
+func (v Value) Int() (int64, bool) {
+	if v.Kind() != Integer {
+		return 0, false
+	}
+	n, _, err := decodeInteger(v.raw)
+	return n, err == nil
+}
+
+// Len returns the bytes of a string, the items of a list or the entries of a
+// dictionary, and 0 for anything else
+func (v Value) Len() int {
+	n := 0
+	switch v.Kind() {
+	case String:
+		b, _ := v.Bytes()
+		n = len(b)
+	case List:
+		v.Items(func(Value) bool { n++; return true })
+	case Dictionary:
+		v.Entries(func([]byte, Value) bool { n++; return true })
+	}
+	return n
+}
+
+// Items calls fn with each item of a list in order, until fn returns false
+func (v Value) Items(fn func(item Value) bool) {
+	if v.Kind() != List {
+		return
+	}
+	for pos := 1; v.raw[pos] != 'e'; {
+		n := span(v.raw[pos:])
+		if !fn(Value{raw: v.raw[pos : pos+n]}) {
+			return
+		}
+		pos += n
+	}
+}
+
+// Entries calls fn with each key and value of a dictionary in order, until fn
+// returns false. The key shares the scanned data's memory.
+func (v Value) Entries(fn func(key []byte, value Value) bool) {
+	if v.Kind() != Dictionary {
+		return
+	}
+	for pos := 1; v.raw[pos] != 'e'; {
+		n := span(v.raw[pos:])
+		key, _ := Value{raw: v.raw[pos : pos+n]}.Bytes()
+		pos += n
+		n = span(v.raw[pos:])
+		if !fn(key, Value{raw: v.raw[pos : pos+n]}) {
+			return
+		}
+		pos += n
+	}
+}
+
+// Get returns the value under key in a dictionary. Of repeated keys the last
+// wins, as with Decode.
+func (v Value) Get(key string) (Value, bool) {
+	var found Value
+	v.Entries(func(k []byte, value Value) bool {
+		if string(k) == key {
+			found = value
+		}
+		return true
+	})
+	return found, found.Kind() != Invalid
+}
+
+// Decode decodes the value as Decode does, copying its strings
+func (v Value) Decode() (interface{}, error) {
+	if v.Kind() == Invalid {
+		return nil, errors.New("invalid value")
+	}
+	decoded, _, err := DecodeWith(v.raw, Limits{MaxDepth: maxInt})
+	return decoded, err
+}
+
+// maxInt is the largest int, lifting the nesting limit for values that were
+// checked when they were scanned
+const maxInt = int(^uint(0) >> 1)
+
+// span returns the length of the well formed value at the start of data
+func span(data []byte) int {
+	depth, pos := 0, 0
+	for {
+		switch c := data[pos]; c {
+		case 'i':
+			pos += bytes.IndexByte(data[pos:], 'e') + 1
+		case 'l', 'd':
+			depth++
+			pos++
+		case 'e':
+			depth--
+			pos++
+		default:
+			colon := pos + bytes.IndexByte(data[pos:], ':')
+			length := 0
+			for _, c := range data[pos:colon] {
+				length = length*10 + int(c-'0')
+			}
+			pos = colon + 1 + length
+		}
+		if depth == 0 {
+			return pos
+		}
+	}
+}
+
+// skip checks the value at the start of data as decode does, without
+// building it, and returns the number of bytes it spans
+func (d *decoder) skip(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, errors.New("empty data")
+	}
+	if err := d.value(); err != nil {
+		return 0, err
+	}
+
+	switch data[0] {
+	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		_, n, err := d.stringBytes(data)
+		return n, err
+	case 'i':
+		_, n, err := decodeInteger(data)
+		return n, err
+	case 'l':
+		return d.skipList(data)
+	case 'd':
+		return d.skipDictionary(data)
+	default:
+		return 0, fmt.Errorf("unknown type: %c", data[0])
+	}
+}
+
+// skipList checks a list as decodeList does
+func (d *decoder) skipList(data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, errors.New("invalid list format")
+	}
+	if err := d.enter(); err != nil {
+		return 0, err
+	}
+	defer d.leave()
+
+	pos := 1 // Skip the 'l' marker
+	for pos < len(data) && data[pos] != 'e' {
+		n, err := d.skip(data[pos:])
+		if err != nil {
+			return 0, fmt.Errorf("error decoding list item: %w", err)
+		}
+		pos += n
+	}
+	if pos >= len(data) {
+		return 0, errors.New("invalid list format: no end marker")
+	}
+	return pos + 1, nil
+}
+
+// skipDictionary checks a dictionary as decodeDictionary does
+func (d *decoder) skipDictionary(data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, errors.New("invalid dictionary format")
+	}
+	if err := d.enter(); err != nil {
+		return 0, err
+	}
+	defer d.leave()
+
+	pos := 1 // Skip the 'd' marker
+	var prev []byte
+	for first := true; pos < len(data) && data[pos] != 'e'; first = false {
+		key, n, err := d.keyBytes(data[pos:])
+		if err != nil {
+			return 0, err
+		}
+		if d.limits.Strict {
+			if err := d.key(string(prev), string(key), first); err != nil {
+				return 0, fmt.Errorf("%w: %q", err, key)
+			}
+		}
+		prev = key
+		pos += n
+
+		if pos >= len(data) {
+			return 0, errors.New("unexpected end of data: missing value")
+		}
+		n, err = d.skip(data[pos:])
+		if err != nil {
+			return 0, fmt.Errorf("error decoding dictionary value: %w", err)
+		}
+		pos += n
+	}
+	if pos >= len(data) {
+		return 0, errors.New("invalid dictionary format: no end marker")
+	}
+	return pos + 1, nil
+}
@@ -0,0 +1,152 @@
+package bencode
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	data := []byte("d4:listli1e2:abe4:name3:foo4:sizei-42e4:name3:bare5:extra")
+	v, n, err := Scan(data)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if n != len(data)-len("5:extra") || v.Kind() != Dictionary || v.Len() != 4 {
+		t.Errorf("Expected a dictionary of 4 entries in %d bytes, got %v of %d in %d", len(data)-7, v.Kind(), v.Len(), n)
+	}
+
+	// Of repeated keys the last wins, and strings share the input
+	name, ok := v.Get("name")
+	if b, _ := name.Bytes(); !ok || string(b) != "bar" {
+		t.Errorf("Expected name bar, got %q", b)
+	}
+	b, _ := name.Bytes()
+	b[0] = 'c'
+	if decoded, _ := v.Decode(); decoded.(map[string]interface{})["name"] != "car" {
+		t.Errorf("Expected the string to share the input, got %v", decoded)
+	}
+	if size, _ := v.Get("size"); size.Kind() != Integer {
+		t.Errorf("Expected an integer, got %v", size.Kind())
+	} else if n, ok := size.Int(); !ok || n != -42 {
+		t.Errorf("Expected -42, got %d", n)
+	}
+	if _, ok := v.Get("missing"); ok {
+		t.Error("Expected no value for a missing key")
+	}
+
+	list, _ := v.Get("list")
+	var items []string
+	list.Items(func(item Value) bool {
+		items = append(items, string(item.Raw()))
+		return true
+	})
+	if !reflect.DeepEqual(items, []string{"i1e", "2:ab"}) {
+		t.Errorf("Expected the list's items, got %q", items)
+	}
+	var keys []string
+	v.Entries(func(key []byte, _ Value) bool {
+		keys = append(keys, string(key))
+		return len(keys) < 2
+	})
+	if !reflect.DeepEqual(keys, []string{"list", "name"}) {
+		t.Errorf("Expected to stop after two keys, got %q", keys)
+	}
+
+	// Accessors of the wrong kind return nothing
+	if _, ok := list.Bytes(); ok {
+		t.Error("Expected Bytes of a list to fail")
+	}
+	if _, ok := list.Int(); ok {
+		t.Error("Expected Int of a list to fail")
+	}
+	if _, ok := list.Get("a"); ok {
+		t.Error("Expected Get on a list to fail")
+	}
+	if (Value{}).Kind() != Invalid {
+		t.Error("Expected the zero Value to be invalid")
+	}
+
+	// Invalid input fails as it does with Decode
+	for _, input := range []string{"", "d4:name", "li1e", "i03e", "5:abc", "di1ei2ee", "x"} {
+		_, _, decodeErr := Decode([]byte(input))
+		if _, _, err := Scan([]byte(input)); err == nil || decodeErr == nil || err.Error() != decodeErr.Error() {
+			t.Errorf("Scan(%q): expected error %v, got %v", input, decodeErr, err)
+		}
+	}
+}
+
+func TestScanAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	data, err := os.ReadFile("../Debian.torrent")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		v, _, err := Scan(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, _ := v.Get("info")
+		pieces, _ := info.Get("pieces")
+		if b, _ := pieces.Bytes(); len(b) == 0 {
+			t.Fatal("Expected piece hashes")
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Expected Scan not to allocate, got %.1f allocations", allocs)
+	}
+}
+
+// BenchmarkTorrent reads a real .torrent, with megabytes of piece hashes,
+// each way
+func BenchmarkTorrent(b *testing.B) {
+	data, err := os.ReadFile("../Debian.torrent")
+	if err != nil {
+		b.Fatalf("ReadFile failed: %v", err)
+	}
+	var torrent struct {
+		Announce string `bencode:"announce"`
+		Info     struct {
+			Name        string `bencode:"name"`
+			Length      int64  `bencode:"length"`
+			PieceLength int64  `bencode:"piece length"`
+			Pieces      string `bencode:"pieces"`
+		} `bencode:"info"`
+	}
+
+	b.Run("Decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := Decode(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Scan", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := Scan(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Unmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := Unmarshal(data, &torrent); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Lookup", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := Lookup(data, "info"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
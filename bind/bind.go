@@ -0,0 +1,137 @@
+// Package bind pins sockets to a chosen local address or network interface,
+// such as a VPN tunnel. Interfaces are looked up again for every new socket,
+// so if the interface goes away connections fail instead of silently using
+// another route. Sockets are bound to the interface's address, and on Linux
+// also to the interface itself (SO_BINDTODEVICE), so their packets can't
+// leave through another one when routes change.
+package bind
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Binding is a local IP address or the name of a network interface
+type Binding struct {
+	ip    net.IP // fixed address, or nil when bound to an interface
+	iface string
+}
+
+// Parse returns a binding for an IP address or an interface name such as "tun0"
+func Parse(spec string) (*Binding, error) {
+	if spec == "" {
+		return nil, errors.New("empty bind address")
+	}
+	if ip := net.ParseIP(spec); ip != nil {
+		return &Binding{ip: ip}, nil
+	}
+	if _, err := net.InterfaceByName(spec); err != nil {
+		return nil, fmt.Errorf("unknown interface %s: %v", spec, err)
+	}
+	return &Binding{iface: spec}, nil
+}
+
+// String returns the address or interface name
+func (b *Binding) String() string {
+	if b.ip != nil {
+		return b.ip.String()
+	}
+	return b.iface
+}
+
+// LocalIP returns the address to bind for the given family. It fails if the
+// interface is gone, down or has no address of that family.
+func (b *Binding) LocalIP(ipv6 bool) (net.IP, error) {
+	if b.ip != nil {
+		if (b.ip.To4() == nil) != ipv6 {
+			return nil, fmt.Errorf("bind address %s is not %s", b.ip, family(ipv6))
+		}
+		return b.ip, nil
+	}
+
+	iface, err := net.InterfaceByName(b.iface)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s unavailable: %v", b.iface, err)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("interface %s is down", b.iface)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface %s unavailable: %v", b.iface, err)
+	}
+
+	// Prefer routable addresses over link-local ones, which need a zone
+	var linkLocal net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() == nil) != ipv6 {
+			continue
+		}
+		if ipNet.IP.IsLinkLocalUnicast() {
+			linkLocal = ipNet.IP
+			continue
+		}
+		return ipNet.IP, nil
+	}
+	if linkLocal != nil && !ipv6 {
+		return linkLocal, nil
+	}
+	return nil, fmt.Errorf("interface %s has no %s address", b.iface, family(ipv6))
+}
+
+// Dial connects to addr from the bound address of the matching family. Host
+// names are dialed over IPv4 if the binding has an IPv4 address, else IPv6.
+func (b *Binding) Dial(network, addr string) (net.Conn, error) {
+	return b.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial but honours ctx
+func (b *Binding) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var local net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		local, err = b.LocalIP(ip.To4() == nil)
+	} else if local, err = b.LocalIP(false); err != nil {
+		local, err = b.LocalIP(true)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, Control: b.Control}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		dialer.LocalAddr = &net.TCPAddr{IP: local}
+	case "udp", "udp4", "udp6":
+		dialer.LocalAddr = &net.UDPAddr{IP: local}
+	default:
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// Control pins sockets to the bound interface where the system allows it,
+// for use as the Control function of a net.Dialer or net.ListenConfig.
+// Bindings to an address leave sockets alone.
+func (b *Binding) Control(network, address string, c syscall.RawConn) error {
+	if b.iface == "" {
+		return nil
+	}
+	return bindToDevice(c, b.iface)
+}
+
+func family(ipv6 bool) string {
+	if ipv6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
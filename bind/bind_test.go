@@ -0,0 +1,78 @@
+package bind
+
+import (
+	"net"
+	"testing"
+)
+
+// loopbackInterface returns the name of the loopback interface
+func loopbackInterface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("Cannot list interfaces: %v", err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("No loopback interface")
+	return ""
+}
+
+func TestLocalIP(t *testing.T) {
+	b, err := Parse("127.0.0.1")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if ip, err := b.LocalIP(false); err != nil || !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Expected 127.0.0.1, got %v (err: %v)", ip, err)
+	}
+	if _, err := b.LocalIP(true); err == nil {
+		t.Error("Expected error for IPv6 with an IPv4 bind address")
+	}
+
+	b, err = Parse(loopbackInterface(t))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if ip, err := b.LocalIP(false); err != nil || !ip.IsLoopback() {
+		t.Errorf("Expected a loopback address, got %v (err: %v)", ip, err)
+	}
+
+	if _, err := Parse("no-such-interface0"); err == nil {
+		t.Error("Expected error for unknown interface")
+	}
+
+	// An interface that disappears fails closed
+	gone := &Binding{iface: "no-such-interface0"}
+	if _, err := gone.LocalIP(false); err == nil {
+		t.Error("Expected error once the interface is gone")
+	}
+	if _, err := gone.Dial("tcp", "127.0.0.1:1"); err == nil {
+		t.Error("Expected dial to fail once the interface is gone")
+	}
+}
+
+func TestDial(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	b, err := Parse(loopbackInterface(t))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	conn, err := b.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.TCPAddr).IP
+	if !local.IsLoopback() {
+		t.Errorf("Expected connection from the loopback interface, got %v", local)
+	}
+}
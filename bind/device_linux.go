@@ -0,0 +1,25 @@
+//go:build linux
+
+package bind
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindToDevice pins the socket behind c to the interface with
+// SO_BINDTODEVICE, so its packets leave through the interface whatever the
+// routing table says. Kernels before 5.7 only allow that with CAP_NET_RAW;
+// without it the socket is just bound to the interface's address.
+func bindToDevice(c syscall.RawConn, iface string) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+	}); cerr != nil {
+		return cerr
+	}
+	if errors.Is(err, syscall.EPERM) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,32 @@
+package bind
+
+import (
+	"net"
+	"testing"
+)
+
+func TestControl(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer conn.Close()
+	raw, err := conn.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %v", err)
+	}
+
+	b, err := Parse(loopbackInterface(t))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if err := b.Control("udp4", conn.LocalAddr().String(), raw); err != nil {
+		t.Errorf("Expected the socket pinned to %s, got %v", b, err)
+	}
+
+	// The kernel refuses an interface that is gone
+	gone := &Binding{iface: "no-such-interface0"}
+	if err := gone.Control("udp4", conn.LocalAddr().String(), raw); err == nil {
+		t.Error("Expected SO_BINDTODEVICE to fail once the interface is gone")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package bind
+
+import "syscall"
+
+// bindToDevice does nothing where sockets can't be pinned to an interface;
+// they are bound to the interface's address only
+func bindToDevice(c syscall.RawConn, iface string) error {
+	return nil
+}
@@ -0,0 +1,308 @@
+// Package blocklist loads IP range blocklists in the PeerGuardian text (P2P)
+// and eMule DAT formats or as CIDR lists, plain or gzipped, and answers
+// whether an address is blocked.
+//
+// P2P lines look like:
+//
+//	Some organization:1.2.4.0-1.2.4.255
+//
+// DAT lines look like:
+//
+//	001.002.004.000 - 001.002.004.255 , 000 , Some organization
+//
+// CIDR lines hold a prefix or a single address of either family, optionally
+// followed by a comment:
+//
+//	1.2.4.0/24 # Some organization
+//	2001:db8::/32
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxBlockedLevel is the highest DAT access level that still blocks a range;
+// eMule treats ranges above it as allowed
+const MaxBlockedLevel = 127
+
+// Range is an inclusive range of blocked addresses
+type Range struct {
+	First netip.Addr
+	Last  netip.Addr
+}
+
+// List is a set of blocked ranges, sorted and merged for binary search
+type List struct {
+	ranges []Range
+}
+
+// Parse reads a blocklist in P2P, DAT or CIDR format, decompressing it first
+// if it is gzipped. The formats may be mixed. Comments and lines that don't parse are skipped.
+func Parse(r io.Reader) (*List, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip blocklist: %v", err)
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	var ranges []Range
+	scanner := bufio.NewScanner(br)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		if r, ok := parseLine(line); ok {
+			ranges = append(ranges, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read blocklist: %v", err)
+	}
+
+	return newList(ranges), nil
+}
+
+// Load reads a blocklist from a local path or an http(s) URL
+func Load(source string) (*List, error) {
+	return LoadWith(http.DefaultClient, source)
+}
+
+// LoadWith is like Load but downloads URLs with client
+func LoadWith(client *http.Client, source string) (*List, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open blocklist: %v", err)
+		}
+		defer f.Close()
+		return Parse(f)
+	}
+
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download blocklist: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download blocklist: %s", resp.Status)
+	}
+	return Parse(resp.Body)
+}
+
+// LoadCached is like LoadWith, but keeps a copy of a downloaded list at
+// cache. The download asks the server to skip a list that hasn't changed
+// since the copy was made. If the download fails, the cached copy is returned
+// along with the error, so a list server being down doesn't leave peers
+// unfiltered. An empty cache path caches nothing.
+func LoadCached(client *http.Client, source, cache string) (*List, error) {
+	if cache == "" || (!strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://")) {
+		return LoadWith(client, source)
+	}
+
+	list, err := download(client, source, cache)
+	if err == nil {
+		return list, nil
+	}
+	f, openErr := os.Open(cache)
+	if openErr != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if list, parseErr := Parse(f); parseErr == nil {
+		return list, err
+	}
+	return nil, err
+}
+
+// download fetches a list into cache, unless the server says it is unchanged
+// since the cache was written, and parses the cached copy
+func download(client *http.Client, source, cache string) (*List, error) {
+	req, err := http.NewRequest(http.MethodGet, source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download blocklist: %v", err)
+	}
+	if info, err := os.Stat(cache); err == nil {
+		req.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download blocklist: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+	case http.StatusOK:
+		// Write a temporary file and rename it over the cache, so a failed
+		// download never replaces a good copy
+		if err := os.MkdirAll(filepath.Dir(cache), 0700); err != nil {
+			return nil, fmt.Errorf("failed to cache blocklist: %v", err)
+		}
+		tmp, err := os.CreateTemp(filepath.Dir(cache), filepath.Base(cache)+".*")
+		if err != nil {
+			return nil, fmt.Errorf("failed to cache blocklist: %v", err)
+		}
+		defer os.Remove(tmp.Name())
+		_, err = io.Copy(tmp, resp.Body)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to download blocklist: %v", err)
+		}
+		if err := os.Rename(tmp.Name(), cache); err != nil {
+			return nil, fmt.Errorf("failed to cache blocklist: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("failed to download blocklist: %s", resp.Status)
+	}
+
+	f, err := os.Open(cache)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cached blocklist: %v", err)
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// parseLine parses one P2P, DAT or CIDR line
+func parseLine(line string) (Range, bool) {
+	if r, ok := parseCIDR(line); ok {
+		return r, true
+	}
+
+	var first, last string
+
+	if fields := strings.Split(line, ","); len(fields) >= 2 && strings.Contains(fields[0], " - ") {
+		// DAT: range , level , description
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil || level > MaxBlockedLevel {
+			return Range{}, false
+		}
+		first, last, _ = strings.Cut(fields[0], "-")
+	} else {
+		// P2P: description:range, where the description may contain colons
+		colon := strings.LastIndex(line, ":")
+		if colon < 0 {
+			return Range{}, false
+		}
+		first, last, _ = strings.Cut(line[colon+1:], "-")
+	}
+
+	from, err := parseAddr(first)
+	if err != nil {
+		return Range{}, false
+	}
+	to, err := parseAddr(last)
+	if err != nil || to.Less(from) {
+		return Range{}, false
+	}
+	return Range{First: from, Last: to}, true
+}
+
+// parseCIDR parses a prefix or a single address, with an optional comment
+func parseCIDR(line string) (Range, bool) {
+	line, _, _ = strings.Cut(line, "#")
+	line = strings.TrimSpace(line)
+	if addr, err := netip.ParseAddr(line); err == nil && addr.Zone() == "" {
+		addr = addr.Unmap()
+		return Range{First: addr, Last: addr}, true
+	}
+	prefix, err := netip.ParsePrefix(line)
+	if err != nil {
+		return Range{}, false
+	}
+	if prefix.Addr().Is4In6() {
+		// ::ffff:1.2.3.0/120 is 1.2.3.0/24
+		if prefix.Bits() < 96 {
+			return Range{}, false
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	first := prefix.Masked().Addr()
+	last := first.AsSlice()
+	for bit := prefix.Bits(); bit < len(last)*8; bit++ {
+		last[bit/8] |= 0x80 >> (bit % 8)
+	}
+	to, _ := netip.AddrFromSlice(last)
+	return Range{First: first, Last: to}, true
+}
+
+// parseAddr parses an IPv4 address that may be zero-padded, as in DAT files
+func parseAddr(s string) (netip.Addr, error) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) != 4 {
+		return netip.Addr{}, errors.New("invalid IPv4 address")
+	}
+	var ip [4]byte
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("invalid IPv4 address: %v", err)
+		}
+		ip[i] = byte(n)
+	}
+	return netip.AddrFrom4(ip), nil
+}
+
+// newList sorts the ranges and merges overlapping or adjacent ones of the
+// same address family
+func newList(ranges []Range) *List {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].First.Less(ranges[j].First)
+	})
+
+	var merged []Range
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && merged[n-1].First.BitLen() == r.First.BitLen() {
+			prev := &merged[n-1]
+			if next := prev.Last.Next(); !next.IsValid() || r.First.Compare(next) <= 0 {
+				if prev.Last.Less(r.Last) {
+					prev.Last = r.Last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return &List{ranges: merged}
+}
+
+// Len returns the number of merged ranges
+func (l *List) Len() int {
+	return len(l.ranges)
+}
+
+// Contains reports whether ip falls in a blocked range. IPv4-mapped IPv6
+// addresses are matched against the IPv4 ranges.
+func (l *List) Contains(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+
+	// Find the last range starting at or before addr
+	i := sort.Search(len(l.ranges), func(i int) bool {
+		return addr.Less(l.ranges[i].First)
+	})
+	return i > 0 && l.ranges[i-1].Last.Compare(addr) >= 0 && l.ranges[i-1].First.BitLen() == addr.BitLen()
+}
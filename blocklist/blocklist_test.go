@@ -0,0 +1,155 @@
+package blocklist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testList = `# PeerGuardian text format
+Bad Org:1.2.4.0-1.2.4.255
+Colons: in: name:10.0.0.5-10.0.0.9
+Adjacent:10.0.0.10-10.0.0.20
+not a range
+// eMule DAT format
+003.000.000.000 - 003.000.000.255 , 000 , Some ISP
+004.000.000.000 - 004.000.000.255 , 200 , Allowed range
+# CIDR lists
+5.6.0.0/16 # Some hoster
+7.7.7.7
+2001:db8::/32
+255.255.255.255
+`
+
+func TestParse(t *testing.T) {
+	list, err := Parse(strings.NewReader(testList))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	// 10.0.0.5-9 and 10.0.0.10-20 are merged, but the IPv6 range isn't
+	// merged into the one ending at the last IPv4 address
+	if list.Len() != 7 {
+		t.Errorf("Expected 7 ranges, got %d", list.Len())
+	}
+
+	testCases := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"1.2.4.0", true},
+		{"1.2.4.128", true},
+		{"1.2.5.0", false},
+		{"10.0.0.4", false},
+		{"10.0.0.15", true},
+		{"10.0.0.21", false},
+		{"3.0.0.7", true},
+		{"4.0.0.7", false}, // access level above 127
+		{"::ffff:1.2.4.1", true},
+		{"5.6.255.255", true},
+		{"5.7.0.0", false},
+		{"7.7.7.7", true},
+		{"7.7.7.8", false},
+		{"255.255.255.255", true},
+		{"2001:db8::1", true},
+		{"2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", true},
+		{"2001:db9::", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.ip, func(t *testing.T) {
+			if got := list.Contains(net.ParseIP(tc.ip)); got != tc.blocked {
+				t.Errorf("Expected blocked=%v, got %v", tc.blocked, got)
+			}
+		})
+	}
+}
+
+func TestLoadGzipURL(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(testList))
+	gz.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf.Bytes())
+	}))
+	defer ts.Close()
+
+	list, err := Load(ts.URL + "/level1.gz")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if !list.Contains(net.ParseIP("1.2.4.1")) {
+		t.Error("Expected 1.2.4.1 to be blocked")
+	}
+
+	if _, err := Load("/nonexistent/blocklist.p2p"); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestLoadCached(t *testing.T) {
+	var (
+		fail     bool
+		modified string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		modified = r.Header.Get("If-Modified-Since")
+		switch {
+		case fail:
+			w.WriteHeader(http.StatusInternalServerError)
+		case modified != "":
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Write([]byte(testList))
+		}
+	}))
+	defer ts.Close()
+	cache := filepath.Join(t.TempDir(), "blocklist.cache")
+
+	list, err := LoadCached(http.DefaultClient, ts.URL, cache)
+	if err != nil {
+		t.Fatalf("LoadCached failed: %v", err)
+	}
+	if modified != "" {
+		t.Errorf("Expected no If-Modified-Since without a cache, got %q", modified)
+	}
+	if _, err := os.Stat(cache); err != nil {
+		t.Errorf("Expected the list to be cached: %v", err)
+	}
+
+	// The server says the list is unchanged, so the cache is used
+	list, err = LoadCached(http.DefaultClient, ts.URL, cache)
+	if err != nil {
+		t.Fatalf("LoadCached failed: %v", err)
+	}
+	if _, err := time.Parse(http.TimeFormat, modified); err != nil {
+		t.Errorf("Expected If-Modified-Since, got %q", modified)
+	}
+	if !list.Contains(net.ParseIP("1.2.4.1")) {
+		t.Error("Expected 1.2.4.1 to be blocked")
+	}
+
+	// A failed download falls back to the cache, reporting the error
+	fail = true
+	list, err = LoadCached(http.DefaultClient, ts.URL, cache)
+	if err == nil {
+		t.Error("Expected the download error")
+	}
+	if list == nil || !list.Contains(net.ParseIP("1.2.4.1")) {
+		t.Error("Expected the cached list")
+	}
+
+	os.Remove(cache)
+	if list, err := LoadCached(http.DefaultClient, ts.URL, cache); err == nil || list != nil {
+		t.Errorf("Expected an error and no list without a cache, got %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+// Package client is the entry point for embedding the BitTorrent client in
+// other Go programs. A Client downloads any number of torrents from torrent
+// files, URLs and magnet links, sharing one peer ID, DHT node and download
+// directory between them.
+//
+//	c, err := client.New(client.Config{DownloadDir: "downloads"})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	t, err := c.Add("ubuntu.iso.torrent")
+//	if err != nil {
+//		return err
+//	}
+//	<-t.Done()
+//
+// The packages it is built on, such as session, torrent, tracker and dht,
+// can also be used on their own.
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/events"
+	"github.com/omkarkirpan/bittorrent-client/magnet"
+	"github.com/omkarkirpan/bittorrent-client/session"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// fetchTimeout bounds downloading a .torrent file from a URL
+const fetchTimeout = 30 * time.Second
+
+// Config controls a Client. The zero value downloads into the current
+// directory, listens on port 6881 and joins the DHT.
+type Config = session.Config
+
+// Option changes a Config field, e.g. session.WithMaxPeers
+type Option = session.Option
+
+// Torrent is a torrent added to a Client
+type Torrent = session.Torrent
+
+// Hooks are callbacks for metrics and tracing, set in Config.Hooks
+type Hooks = session.Hooks
+
+// Client runs any number of torrents
+type Client struct {
+	session *session.Session
+	http    *http.Client
+}
+
+// Stats sums up the activity of every torrent of a Client
+type Stats struct {
+	Torrents     int     // Torrents added and not removed
+	Active       int     // Torrents fetching metadata, downloading or seeding
+	Downloaded   int64   // Bytes of piece data received
+	Uploaded     int64   // Bytes of piece data sent
+	DownloadRate float64 // Recent download speed in bytes per second
+	UploadRate   float64 // Recent upload speed in bytes per second
+	Peers        int     // Connected peers
+}
+
+// New creates a client and, unless disabled, starts listening for peers and
+// joining the DHT. Options are applied to cfg first.
+func New(cfg Config, opts ...Option) (*Client, error) {
+	s, err := session.New(cfg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// Fetch through the session's route, e.g. its strict proxy
+	fetch := *s.HTTPClient()
+	fetch.Timeout = fetchTimeout
+	return &Client{session: s, http: &fetch}, nil
+}
+
+// Add starts downloading a magnet link, or a .torrent file from a local path
+// or an http(s) URL
+func (c *Client) Add(source string) (*Torrent, error) {
+	if magnet.IsMagnet(source) {
+		return c.AddMagnet(source)
+	}
+	tf, err := torrent.LoadWith(c.http, source)
+	if err != nil {
+		return nil, err
+	}
+	return c.AddTorrent(tf)
+}
+
+// AddTorrent starts downloading a parsed torrent file
+func (c *Client) AddTorrent(tf *torrent.TorrentFile) (*Torrent, error) {
+	return c.session.AddTorrent(tf)
+}
+
+// AddMagnet starts downloading a magnet link. Its metadata is fetched from
+// peers first.
+func (c *Client) AddMagnet(uri string) (*Torrent, error) {
+	return c.session.AddMagnet(uri)
+}
+
+// Torrent returns the torrent with the given info hash, or nil
+func (c *Client) Torrent(infoHash [20]byte) *Torrent {
+	return c.session.Torrent(infoHash)
+}
+
+// Torrents returns every torrent of the client
+func (c *Client) Torrents() []*Torrent {
+	return c.session.Torrents()
+}
+
+// Remove stops a torrent and forgets it. Downloaded files are left on disk.
+func (c *Client) Remove(infoHash [20]byte) error {
+	return c.session.Remove(infoHash)
+}
+
+// Pause stops downloading a torrent, keeping what it has so far
+func (c *Client) Pause(infoHash [20]byte) error {
+	t := c.session.Torrent(infoHash)
+	if t == nil {
+		return fmt.Errorf("%w: %x", session.ErrTorrentNotFound, infoHash)
+	}
+	return t.Pause()
+}
+
+// Resume restarts a paused torrent
+func (c *Client) Resume(infoHash [20]byte) error {
+	t := c.session.Torrent(infoHash)
+	if t == nil {
+		return fmt.Errorf("%w: %x", session.ErrTorrentNotFound, infoHash)
+	}
+	return t.Resume()
+}
+
+// SetRateLimits caps the download and upload rates across every torrent, in
+// bytes per second, 0 meaning unlimited. Torrent.SetRateLimits caps a single
+// torrent further.
+func (c *Client) SetRateLimits(download, upload int64) error {
+	return c.session.SetRateLimits(download, upload)
+}
+
+// Stats returns the combined activity of every torrent
+func (c *Client) Stats() Stats {
+	var stats Stats
+	for _, t := range c.session.Torrents() {
+		ts := t.Stats()
+		stats.Torrents++
+		switch t.State() {
+		case session.StateFetchingMetadata, session.StateDownloading, session.StateSeeding:
+			stats.Active++
+		}
+		stats.Downloaded += ts.Downloaded
+		stats.Uploaded += ts.Uploaded
+		stats.DownloadRate += ts.DownloadRate
+		stats.UploadRate += ts.UploadRate
+		stats.Peers += ts.Peers
+	}
+	return stats
+}
+
+// Subscribe returns a subscription to events of the given types, such as
+// events.PieceVerified, or of every type if none are given. Up to buffer
+// events wait for the subscriber; more are dropped.
+func (c *Client) Subscribe(buffer int, types ...events.Type) *events.Subscription {
+	return c.session.Subscribe(buffer, types...)
+}
+
+// Session returns the session behind the client, for settings and details
+// the facade doesn't cover
+func (c *Client) Session() *session.Session {
+	return c.session
+}
+
+// Shutdown stops every torrent cleanly, telling trackers the client is
+// leaving, and waits until done or ctx expires
+func (c *Client) Shutdown(ctx context.Context) error {
+	return c.session.Shutdown(ctx)
+}
+
+// Close stops every torrent at once
+func (c *Client) Close() error {
+	return c.session.Close()
+}
+
+// Download saves the content of a torrent file in the directory outPath and
+// returns once it is complete or has failed. It runs a session of its own
+// with the default settings, which opts can change.
+func Download(tf *torrent.TorrentFile, outPath string, opts ...Option) error {
+	return DownloadContext(context.Background(), tf, outPath, opts...)
+}
+
+// DownloadContext is like Download but gives up once ctx is done
+func DownloadContext(ctx context.Context, tf *torrent.TorrentFile, outPath string, opts ...Option) error {
+	s, err := session.New(Config{DownloadDir: outPath}, opts...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	t, err := s.AddTorrent(tf)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-t.Done():
+		return t.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
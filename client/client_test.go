@@ -0,0 +1,164 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+	"github.com/omkarkirpan/bittorrent-client/download"
+	"github.com/omkarkirpan/bittorrent-client/session"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+	"github.com/omkarkirpan/bittorrent-client/tracker/trackertest"
+)
+
+func TestClient(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(Config{DownloadDir: dir, NoListen: true, DisableDHT: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+
+	// A peer that never answers keeps the magnet fetching metadata
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer silent.Close()
+	magnet, err := c.Add("magnet:?xt=urn:btih:83e53cb48c4af4989cd1a53a5b4671da821b1ff4&x.pe=" + silent.Addr().String())
+	if err != nil {
+		t.Fatalf("Add magnet failed: %v", err)
+	}
+
+	// A torrent file whose only tracker doesn't exist
+	data := []byte("hello, world")
+	hash := sha1.Sum(data)
+	encoded, _ := bencode.EncodeDict(map[string]interface{}{
+		"announce": "http://127.0.0.1:1/announce",
+		"info": map[string]interface{}{
+			"name":         "hello.txt",
+			"length":       len(data),
+			"piece length": 16384,
+			"pieces":       string(hash[:]),
+		},
+	})
+	path := filepath.Join(dir, "hello.torrent")
+	if err := os.WriteFile(path, encoded, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	file, err := c.Add(path)
+	if err != nil {
+		t.Fatalf("Add file failed: %v", err)
+	}
+	if file.Name() != "hello.txt" {
+		t.Errorf("Expected name hello.txt, got %q", file.Name())
+	}
+
+	if _, err := c.Add(filepath.Join(dir, "missing.torrent")); err == nil {
+		t.Error("Expected error adding a missing file")
+	}
+	if _, err := c.Add(path); err == nil {
+		t.Error("Expected error adding a torrent twice")
+	}
+
+	stats := c.Stats()
+	if stats.Torrents != 2 || stats.Active != 2 {
+		t.Errorf("Expected 2 torrents, 2 active, got %d, %d", stats.Torrents, stats.Active)
+	}
+	if c.Torrent(magnet.InfoHash()) != magnet {
+		t.Error("Expected to look up the magnet by info hash")
+	}
+
+	if err := c.Pause(magnet.InfoHash()); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	if magnet.State() != session.StatePaused {
+		t.Errorf("Expected paused, got %v", magnet.State())
+	}
+	if err := c.Resume(magnet.InfoHash()); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if err := c.Pause([20]byte{1}); !errors.Is(err, session.ErrTorrentNotFound) {
+		t.Errorf("Expected ErrTorrentNotFound pausing an unknown torrent, got %v", err)
+	}
+
+	if err := c.Remove(magnet.InfoHash()); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if n := len(c.Torrents()); n != 1 {
+		t.Errorf("Expected 1 torrent after removing one, got %d", n)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	data := make([]byte, 50000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	var pieces []byte
+	for i := 0; i < len(data); i += 16384 {
+		hash := sha1.Sum(data[i:min(i+16384, len(data))])
+		pieces = append(pieces, hash[:]...)
+	}
+	tr := &trackertest.Tracker{}
+	tf := &torrent.TorrentFile{
+		Announce: tr.Listen(t),
+		Info:     torrent.TorrentInfo{Name: "data.bin", Length: int64(len(data)), PieceLength: 16384, Pieces: string(pieces)},
+	}
+
+	// A seeder with the whole file, recorded as verified, found through the
+	// tracker
+	seedDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(seedDir, "data.bin"), data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	layout := download.Layout{Dir: seedDir}
+	result, err := download.Verify(tf, layout, nil)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	infoHash, _ := tf.InfoHash()
+	if err := download.SaveResume(download.ResumePath(seedDir, infoHash), infoHash, layout.Root(tf), result.Have, nil); err != nil {
+		t.Fatalf("SaveResume failed: %v", err)
+	}
+	seeder, err := New(Config{DownloadDir: seedDir, DisableDHT: true, RandomPort: true, Seed: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer seeder.Close()
+	seed, err := seeder.AddTorrent(tf)
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); seed.State() != session.StateSeeding || len(tr.Announces()) == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the seeder to announce itself, got %v", seed.State())
+		}
+	}
+
+	out := t.TempDir()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	noDHT := func(cfg *Config) { cfg.DisableDHT, cfg.NoListen = true, true }
+	if err := DownloadContext(ctx, tf, out, noDHT); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(out, "data.bin")); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Expected the downloaded file to match, got %d bytes (err: %v)", len(got), err)
+	}
+
+	// Without peers it gives up once ctx is done
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	lonely := &torrent.TorrentFile{Announce: "http://127.0.0.1:1/announce", Info: tf.Info}
+	if err := DownloadContext(ctx, lonely, t.TempDir(), noDHT); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to end the download, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+
+	timer := f.NewTimer(3 * time.Second)
+	ticker := f.NewTicker(time.Second)
+	after := f.After(10 * time.Second)
+	if f.Waiters() != 3 {
+		t.Errorf("Expected 3 waiters, got %d", f.Waiters())
+	}
+
+	f.Advance(2500 * time.Millisecond)
+	if got := f.Since(start); got != 2500*time.Millisecond {
+		t.Errorf("Expected 2.5s elapsed, got %v", got)
+	}
+	// Two ticks were due but only one fits in the channel
+	if tick := <-ticker.C(); !tick.Equal(start.Add(time.Second)) {
+		t.Errorf("Expected the first tick at 1s, got %v", tick.Sub(start))
+	}
+	select {
+	case <-ticker.C():
+		t.Error("Expected the unreceived tick to be dropped")
+	case <-timer.C():
+		t.Error("Expected the timer not to fire before 3s")
+	default:
+	}
+
+	f.Advance(time.Second)
+	if fired := <-timer.C(); !fired.Equal(start.Add(3 * time.Second)) {
+		t.Errorf("Expected the timer to fire at 3s, got %v", fired.Sub(start))
+	}
+	if timer.Stop() {
+		t.Error("Expected Stop to report a fired timer as not pending")
+	}
+	if timer.Reset(time.Second) {
+		t.Error("Expected Reset to report a fired timer as not pending")
+	}
+	if !timer.Stop() {
+		t.Error("Expected Stop to report a reset timer as pending")
+	}
+
+	ticker.Stop()
+	<-ticker.C()
+	f.Advance(10 * time.Second)
+	select {
+	case <-ticker.C():
+		t.Error("Expected a stopped ticker not to tick")
+	default:
+	}
+	if fired := <-after; !fired.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("Expected After to fire at 10s, got %v", fired.Sub(start))
+	}
+	if f.Waiters() != 0 {
+		t.Errorf("Expected no waiters left, got %d", f.Waiters())
+	}
+}
+
+func TestOr(t *testing.T) {
+	if Or(nil) != Real {
+		t.Error("Expected Or(nil) to be the real clock")
+	}
+	f := NewFake(time.Now())
+	if Or(f) != f {
+		t.Error("Expected Or to keep a given clock")
+	}
+}
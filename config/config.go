@@ -0,0 +1,253 @@
+// Package config loads settings from a config file and the environment and
+// layers them under command-line flags. Every setting is named after its
+// flag, so the file, the environment and the command line share one
+// vocabulary.
+//
+// Files are a flat subset of TOML or YAML. Keys inside a section (TOML) or a
+// nested mapping (YAML) are joined to the section name with a dash, so
+//
+//	[proxy]
+//	username = "alice"
+//
+// and
+//
+//	proxy:
+//	  username: alice
+//
+// both set the proxy-username flag.
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the environment variable for every setting, e.g.
+// BITTORRENT_OUTPUT_DIR for output-dir
+const EnvPrefix = "BITTORRENT_"
+
+// appName is the directory config files live in
+const appName = "bittorrent-client"
+
+// Values maps setting names to their unparsed values
+type Values map[string]string
+
+// DefaultPaths returns the config files looked for when none is given, most
+// specific first
+func DefaultPaths() []string {
+	var dirs []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(dir, appName))
+	}
+	if runtime.GOOS != "windows" {
+		dirs = append(dirs, filepath.Join("/etc", appName))
+	}
+
+	var paths []string
+	for _, dir := range dirs {
+		for _, name := range []string{"config.toml", "config.yaml", "config.yml"} {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	return paths
+}
+
+// Load reads the config file at path. With an empty path it reads the first
+// default path that exists, and returns no values if there is none.
+func Load(path string) (Values, error) {
+	if path == "" {
+		for _, p := range DefaultPaths() {
+			if _, err := os.Stat(p); err == nil {
+				path = p
+				break
+			}
+		}
+		if path == "" {
+			return Values{}, nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config: %v", err)
+	}
+	defer f.Close()
+
+	values, err := Parse(f, isYAML(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return values, nil
+}
+
+// isYAML reports whether path names a YAML file rather than TOML
+func isYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// Parse reads a config file in TOML or YAML form
+func Parse(r io.Reader, yaml bool) (Values, error) {
+	values := Values{}
+	section := ""
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		raw := scanner.Text()
+		line := strings.TrimSpace(stripComment(raw))
+		if line == "" || line == "---" {
+			continue
+		}
+
+		var key, value string
+		var ok bool
+		if yaml {
+			// An indented key belongs to the last unindented key without a value
+			indented := raw[0] == ' ' || raw[0] == '\t'
+			key, value, ok = strings.Cut(line, ":")
+			key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected key: value", n)
+			}
+			if !indented {
+				section = ""
+				if value == "" {
+					section = key
+					continue
+				}
+			} else if section == "" {
+				return nil, fmt.Errorf("line %d: unexpected indentation", n)
+			}
+		} else {
+			if strings.HasPrefix(line, "[") {
+				if !strings.HasSuffix(line, "]") {
+					return nil, fmt.Errorf("line %d: unterminated section header", n)
+				}
+				section = strings.TrimSpace(line[1 : len(line)-1])
+				continue
+			}
+			key, value, ok = strings.Cut(line, "=")
+			key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected key = value", n)
+			}
+		}
+
+		if key == "" {
+			return nil, fmt.Errorf("line %d: empty key", n)
+		}
+		value, err := unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if section != "" {
+			key = section + "-" + key
+		}
+		values[strings.ReplaceAll(key, "_", "-")] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	return values, nil
+}
+
+// stripComment removes a # comment that isn't inside a quoted string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// unquote returns the contents of a single- or double-quoted string, or a
+// bare value unchanged
+func unquote(value string) (string, error) {
+	if len(value) < 2 {
+		return value, nil
+	}
+	switch value[0] {
+	case '"':
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return "", errors.New("invalid quoted string")
+		}
+		return s, nil
+	case '\'':
+		if value[len(value)-1] != '\'' {
+			return "", errors.New("unterminated string")
+		}
+		return value[1 : len(value)-1], nil
+	}
+	return value, nil
+}
+
+// EnvName returns the environment variable for a setting
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Apply fills in the flags of fs that weren't set on the command line, from
+// values first and then from the environment. It must be called after
+// fs.Parse. One config file serves several commands, so keys that only the
+// flags of others define are skipped; keys nobody defines are an error, so
+// typos don't go unnoticed.
+func Apply(fs *flag.FlagSet, values Values, getenv func(string) string, others ...*flag.FlagSet) error {
+	for key := range values {
+		if fs.Lookup(key) == nil && !defined(others, key) {
+			return fmt.Errorf("unknown config setting %q", key)
+		}
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		value, ok := values[f.Name]
+		source := "config setting " + f.Name
+		if !ok {
+			source = EnvName(f.Name)
+			value = getenv(source)
+			ok = value != ""
+		}
+		if ok {
+			if e := fs.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", value, source, e)
+			}
+		}
+	})
+	return err
+}
+
+// defined reports whether any of the flag sets has a flag called name
+func defined(sets []*flag.FlagSet, name string) bool {
+	for _, fs := range sets {
+		if fs.Lookup(name) != nil {
+			return true
+		}
+	}
+	return false
+}
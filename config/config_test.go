@@ -0,0 +1,166 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		yaml  bool
+		want  Values
+	}{
+		{
+			name: "toml",
+			input: `# Downloads
+output-dir = "/data/torrents" # trailing comment
+port = 6881
+no_dht = true
+
+[proxy]
+username = 'alice'
+password = "p#ss"
+`,
+			want: Values{
+				"output-dir":     "/data/torrents",
+				"port":           "6881",
+				"no-dht":         "true",
+				"proxy-username": "alice",
+				"proxy-password": "p#ss",
+			},
+		},
+		{
+			name: "yaml",
+			input: `---
+output-dir: /data/torrents
+port: 6881
+proxy:
+  username: alice
+  password: "p#ss"
+no-dht: true
+`,
+			yaml: true,
+			want: Values{
+				"output-dir":     "/data/torrents",
+				"port":           "6881",
+				"no-dht":         "true",
+				"proxy-username": "alice",
+				"proxy-password": "p#ss",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.input), tt.yaml)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("Expected %d values, got %v", len(tt.want), got)
+			}
+			for key, value := range tt.want {
+				if got[key] != value {
+					t.Errorf("Expected %s=%q, got %q", key, value, got[key])
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		yaml  bool
+	}{
+		{"toml missing equals", "port 6881", false},
+		{"toml bad section", "[proxy", false},
+		{"toml bad string", `dir = "unterminated`, false},
+		{"yaml missing colon", "port 6881", true},
+		{"yaml stray indent", "  port: 6881", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(strings.NewReader(tt.input), tt.yaml); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte("port: 7000\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	values, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if values["port"] != "7000" {
+		t.Errorf("Expected port 7000, got %q", values["port"])
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Error("Expected error for missing config file")
+	}
+}
+
+func TestApply(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	port := fs.Int("port", 6881, "")
+	dir := fs.String("output-dir", ".", "")
+	proxy := fs.String("proxy", "", "")
+	dht := fs.Bool("no-dht", false, "")
+	if err := fs.Parse([]string{"--port", "9000"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	env := map[string]string{
+		"BITTORRENT_PORT":       "1",
+		"BITTORRENT_OUTPUT_DIR": "/from/env",
+		"BITTORRENT_PROXY":      "127.0.0.1:1080",
+	}
+	values := Values{"port": "2", "output-dir": "/from/config"}
+	if err := Apply(fs, values, func(key string) string { return env[key] }); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	// Flags beat the config file, which beats the environment
+	if *port != 9000 {
+		t.Errorf("Expected port from flag, got %d", *port)
+	}
+	if *dir != "/from/config" {
+		t.Errorf("Expected output dir from config, got %q", *dir)
+	}
+	if *proxy != "127.0.0.1:1080" {
+		t.Errorf("Expected proxy from environment, got %q", *proxy)
+	}
+	if *dht {
+		t.Error("Expected no-dht to keep its default")
+	}
+
+	if err := Apply(fs, Values{"prot": "1"}, os.Getenv); err == nil {
+		t.Error("Expected error for unknown setting")
+	}
+	if err := Apply(fs, Values{"no-dht": "maybe"}, os.Getenv); err == nil {
+		t.Error("Expected error for invalid value")
+	}
+
+	// Settings of other commands are skipped rather than refused
+	other := flag.NewFlagSet("other", flag.ContinueOnError)
+	other.String("api-addr", "", "")
+	if err := Apply(fs, Values{"api-addr": "127.0.0.1:1"}, os.Getenv, other); err != nil {
+		t.Errorf("Expected other command's setting to be skipped, got %v", err)
+	}
+	if err := Apply(fs, Values{"prot": "1"}, os.Getenv, other); err == nil {
+		t.Error("Expected error for setting no command knows")
+	}
+}
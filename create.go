@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// createdBy is recorded in torrents made by the create command
+const createdBy = "bittorrent-client"
+
+// stringList is a flag value that may be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// runCreate implements the create command and returns the exit code
+func runCreate(args []string) int {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	var trackers stringList
+	fs.Var(&trackers, "announce", "tracker announce URL; repeat for backup trackers (required)")
+	pieceLength := fs.String("piece-length", "auto", "piece size, e.g. 256K or 4M, or auto to pick one from the total size")
+	private := fs.Bool("private", false, "mark the torrent private, so peers only come from its trackers")
+	comment := fs.String("comment", "", "comment stored in the torrent")
+	name := fs.String("name", "", "torrent name (default: the base name of the only path; required with several)")
+	updateURL := fs.String("update-url", "", "feed `URL` where newer versions of the torrent will be published (BEP 39)")
+	out := fs.String("out", "", "where to write the .torrent file (default: <name>.torrent)")
+	force := fs.Bool("force", false, "overwrite the output file if it exists")
+	printMagnet := fs.Bool("magnet", false, "print a magnet link for the new torrent")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s create [flags] <file or directory>...\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	if len(trackers) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: at least one --announce URL is required")
+		return exitUsage
+	}
+
+	opts := torrent.CreateOptions{
+		Name:      *name,
+		Trackers:  trackers,
+		Private:   *private,
+		Comment:   *comment,
+		CreatedBy: createdBy,
+		UpdateURL: *updateURL,
+	}
+	if *pieceLength != "auto" {
+		if opts.PieceLength, err = parseSize(*pieceLength); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid --piece-length: %v\n", err)
+			return exitUsage
+		}
+	}
+
+	// Show hashing progress on a terminal only
+	if isTerminal(os.Stderr) {
+		opts.Progress = func(done, total int) {
+			if done%16 == 0 || done == total {
+				fmt.Fprintf(os.Stderr, "\rHashing: %d/%d pieces", done, total)
+			}
+		}
+	}
+	tf, err := torrent.Create(positional, opts)
+	if opts.Progress != nil {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+
+	path := *out
+	if path == "" {
+		path = tf.Info.Name + ".torrent"
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !*force {
+		flags |= os.O_EXCL
+	}
+	if err := writeFile(path, tf, flags); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			err = fmt.Errorf("%s already exists, use --force to overwrite it", path)
+		}
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitStorage
+	}
+
+	infoHash, _ := tf.InfoHash()
+	fmt.Printf("Created %s (%s in %d pieces of %s, info hash %x)\n",
+		path, humanReadableSize(tf.TotalLength()), tf.NumPieces(), humanReadableSize(tf.Info.PieceLength), infoHash)
+	if *printMagnet {
+		link, _ := tf.MagnetLink()
+		fmt.Println(link)
+	}
+	return exitOK
+}
+
+// writeFile writes a torrent to a file opened with flags
+func writeFile(path string, tf *torrent.TorrentFile, flags int) error {
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := tf.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// parseSize parses a byte count with an optional K, M or G suffix (powers of 1024)
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToUpper(s[len(s)-min(len(s), 1):]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a size", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/api"
+	"github.com/omkarkirpan/bittorrent-client/session"
+	"github.com/omkarkirpan/bittorrent-client/webui"
+)
+
+// daemonOptions are the daemon's settings on top of those of a download
+type daemonOptions struct {
+	options
+	apiAddr        string
+	apiToken       string
+	updateInterval time.Duration
+	retireUpdated  bool
+}
+
+// register defines the flags for o on fs
+func (o *daemonOptions) register(fs *flag.FlagSet) {
+	o.options.register(fs)
+	fs.StringVar(&o.apiAddr, "api-addr", "127.0.0.1:9091", "address to serve the REST API and web UI on")
+	fs.StringVar(&o.apiToken, "api-token", "", "require this bearer `token` on API requests; needed to serve the API under a host name rather than an IP address or localhost")
+	fs.DurationVar(&o.updateInterval, "update-interval", 0, "check the update feeds of torrents that name one (BEP 39), and the DHT for mutable torrents (BEP 46), this often and add newer versions; 0 never checks")
+	fs.BoolVar(&o.retireUpdated, "retire-updated", false, "remove a torrent, keeping its files, once its newer version completes")
+}
+
+// runDaemon runs a session without a terminal, controlled through the REST
+// API, until it is interrupted. It returns the exit code.
+func runDaemon(args []string) int {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	var opts daemonOptions
+	opts.register(fs)
+
+	// The daemon has no progress display, so it logs more by default
+	fs.Lookup("log-level").DefValue = "info"
+	fs.Set("log-level", "info")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s daemon [flags]\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	cfg, err := opts.load(fs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	if opts.updateInterval < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --update-interval must not be negative")
+		return exitUsage
+	}
+	cfg.UpdateInterval, cfg.RetireUpdated = opts.updateInterval, opts.retireUpdated
+	cfg.KeepTorrents = true // carry on with the torrents added through the API after a restart
+
+	log := cfg.Logger.With("component", "daemon")
+
+	sess, err := session.New(cfg)
+	if err != nil {
+		log.Error("failed to start session", "error", err)
+		return exitFailure
+	}
+	defer sess.Close()
+
+	if opts.debugAddr != "" {
+		ln, err := startDebugServer(opts.debugAddr, sess, cfg.Logger)
+		if err != nil {
+			log.Error("failed to start debug server", "error", err)
+			return exitFailure
+		}
+		defer ln.Close()
+	}
+
+	handler := api.NewServer(sess)
+	handler.SetToken(opts.apiToken)
+	handler.Handle("GET /", webui.Handler())
+	server := &http.Server{Addr: opts.apiAddr, Handler: handler}
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServe() }()
+	log.Info("serving web UI and API", "ui", "http://"+opts.apiAddr+"/", "api", "http://"+opts.apiAddr+"/api/torrents")
+
+	ctx, stop := notifyShutdown(log)
+	defer stop()
+
+	select {
+	case err := <-served:
+		log.Error("failed to serve API", "error", err)
+		return exitFailure
+	case <-ctx.Done():
+	}
+
+	shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdown); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error("failed to stop API", "error", err)
+	}
+	if err := sess.Shutdown(shutdown); err != nil {
+		log.Warn("shutdown cut short", "error", err)
+	}
+	return exitOK
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/omkarkirpan/bittorrent-client/session"
+)
+
+// debugState is the JSON served at /debug/state
+type debugState struct {
+	Goroutines   int              `json:"goroutines"`
+	HeapAlloc    uint64           `json:"heap_alloc"`
+	ListenAddrs  []string         `json:"listen_addrs"`
+	AnnouncePort uint16           `json:"announce_port"`
+	NAT          debugNAT         `json:"nat"`
+	DHTNodes     map[string]int   `json:"dht_nodes"`
+	Blocked      map[string]int64 `json:"blocked"`
+	Torrents     []debugTorrent   `json:"torrents"`
+}
+
+// debugNAT is what trackers and peers told us about our external addresses
+type debugNAT struct {
+	ExternalIPv4 net.IP `json:"external_ipv4"` // null until enough sources agree
+	ExternalIPv6 net.IP `json:"external_ipv6"`
+	BehindNAT    bool   `json:"behind_nat"`
+	PortMapped   bool   `json:"port_mapped"`
+	Incoming     int64  `json:"incoming_connections"`
+}
+
+// debugTorrent is the internal state of one torrent
+type debugTorrent struct {
+	InfoHash     string         `json:"info_hash"`
+	Name         string         `json:"name"`
+	State        string         `json:"state"`
+	PiecesDone   int            `json:"pieces_done"`
+	Pieces       int            `json:"pieces"`
+	QueuedPieces int            `json:"queued_pieces"` // waiting for a peer
+	KnownPeers   map[string]int `json:"known_peers"`   // by source
+	Peers        []debugPeer    `json:"peers"`
+}
+
+// debugPeer is the request state of one connected peer
+type debugPeer struct {
+	Addr       string `json:"addr"`
+	Choked     bool   `json:"choked"`
+	Seed       bool   `json:"seed"`
+	Piece      int    `json:"piece"` // -1 when idle
+	Requests   int    `json:"requests"`
+	Downloaded int64  `json:"downloaded"`
+}
+
+// startDebugServer serves net/http/pprof under /debug/pprof/ and a dump of
+// the session's internal state under /debug/state. It returns once the
+// address is listening, and the server stops when the listener is closed.
+func startDebugServer(addr string, sess *session.Session, log *slog.Logger) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /debug/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(collectDebugState(sess))
+	})
+
+	log.With("component", "debug").Info("serving debug endpoints", "pprof", "http://"+ln.Addr().String()+"/debug/pprof/", "state", "http://"+ln.Addr().String()+"/debug/state")
+	go http.Serve(ln, mux)
+	return ln, nil
+}
+
+// collectDebugState captures the current state of the process and session
+func collectDebugState(sess *session.Session) debugState {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	ipv4, ipv6 := sess.DHTNodes()
+	state := debugState{
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    mem.HeapAlloc,
+		AnnouncePort: sess.AnnouncePort(),
+		DHTNodes:     map[string]int{"ipv4": ipv4, "ipv6": ipv6},
+		Torrents:     []debugTorrent{},
+	}
+	nat := sess.NATStatus()
+	state.NAT = debugNAT{
+		ExternalIPv4: nat.ExternalIPv4,
+		ExternalIPv6: nat.ExternalIPv6,
+		BehindNAT:    nat.BehindNAT,
+		PortMapped:   nat.PortMapped,
+		Incoming:     nat.Incoming,
+	}
+	blocked := sess.BlockStats()
+	state.Blocked = map[string]int64{"connections": blocked.Connections, "peers": blocked.Peers, "dht": blocked.DHT, "ranges": int64(blocked.Ranges)}
+	for _, addr := range sess.ListenAddrs() {
+		state.ListenAddrs = append(state.ListenAddrs, addr.String())
+	}
+
+	for _, t := range sess.Torrents() {
+		infoHash := t.InfoHash()
+		done, total := t.Progress()
+		dt := debugTorrent{
+			InfoHash:     hex.EncodeToString(infoHash[:]),
+			Name:         t.Name(),
+			State:        t.State().String(),
+			PiecesDone:   done,
+			Pieces:       total,
+			QueuedPieces: t.QueuedPieces(),
+			KnownPeers:   map[string]int{},
+			Peers:        []debugPeer{},
+		}
+		for source, n := range t.PeerCounts() {
+			dt.KnownPeers[source.String()] = n
+		}
+		for _, p := range t.Peers() {
+			dt.Peers = append(dt.Peers, debugPeer{
+				Addr:       p.Addr,
+				Choked:     p.Choked,
+				Seed:       p.Seed,
+				Piece:      p.Piece,
+				Requests:   p.Requests,
+				Downloaded: p.Downloaded,
+			})
+		}
+		state.Torrents = append(state.Torrents, dt)
+	}
+	return state
+}
@@ -0,0 +1,369 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompactNodeInfo(t *testing.T) {
+	nodes := []Node{
+		{ID: NodeID{1}, Addr: &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 6881}},
+		{ID: NodeID{2}, Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6882}},
+	}
+
+	t.Run("IPv4", func(t *testing.T) {
+		compact := encodeNodes(nodes, false)
+		if len(compact) != compactNodeLen4 {
+			t.Fatalf("Expected %d bytes, got %d", compactNodeLen4, len(compact))
+		}
+
+		decoded, err := decodeNodes(compact, false)
+		if err != nil {
+			t.Fatalf("decodeNodes failed: %v", err)
+		}
+		if len(decoded) != 1 || decoded[0].ID != nodes[0].ID || decoded[0].Addr.String() != "192.168.1.10:6881" {
+			t.Errorf("Unexpected IPv4 nodes: %v", decoded)
+		}
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		compact := encodeNodes(nodes, true)
+		if len(compact) != compactNodeLen6 {
+			t.Fatalf("Expected %d bytes, got %d", compactNodeLen6, len(compact))
+		}
+
+		decoded, err := decodeNodes(compact, true)
+		if err != nil {
+			t.Fatalf("decodeNodes failed: %v", err)
+		}
+		if len(decoded) != 1 || decoded[0].ID != nodes[1].ID || decoded[0].Addr.String() != "[2001:db8::1]:6882" {
+			t.Errorf("Unexpected IPv6 nodes: %v", decoded)
+		}
+	})
+
+	t.Run("InvalidLength", func(t *testing.T) {
+		if _, err := decodeNodes("short", true); err == nil {
+			t.Error("Expected error for truncated node info")
+		}
+	})
+}
+
+func TestCompactPeerInfo(t *testing.T) {
+	for _, addr := range []string{"10.0.0.1", "2001:db8::2"} {
+		p, err := decodePeer(encodePeer(net.ParseIP(addr), 51413))
+		if err != nil {
+			t.Fatalf("decodePeer(%s) failed: %v", addr, err)
+		}
+		if !p.IP.Equal(net.ParseIP(addr)) || p.Port != 51413 {
+			t.Errorf("Expected %s:51413, got %s:%d", addr, p.IP, p.Port)
+		}
+	}
+}
+
+func TestWant(t *testing.T) {
+	testCases := []struct {
+		name         string
+		args         map[string]interface{}
+		ipv6         bool
+		want4, want6 bool
+	}{
+		{"DefaultIPv4", map[string]interface{}{}, false, true, false},
+		{"DefaultIPv6", map[string]interface{}{}, true, false, true},
+		{"Both", map[string]interface{}{"want": []interface{}{"n4", "n6"}}, false, true, true},
+		{"OnlyIPv6OverIPv4", map[string]interface{}{"want": []interface{}{"n6"}}, false, false, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			want4, want6 := wants(tc.args, tc.ipv6)
+			if want4 != tc.want4 || want6 != tc.want6 {
+				t.Errorf("wants() = %v, %v; expected %v, %v", want4, want6, tc.want4, tc.want6)
+			}
+		})
+	}
+}
+
+// newTestServer starts a server that does not contact the public bootstrap nodes
+func newTestServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	cfg.BootstrapNodes = []string{}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Skipf("Cannot start DHT server: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cfg      Config
+		loopback string
+	}{
+		{"IPv4", Config{DisableIPv6: true}, "127.0.0.1"},
+		{"IPv6", Config{DisableIPv4: true}, "::1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newTestServer(t, tc.cfg)
+			b := newTestServer(t, tc.cfg)
+			c := newTestServer(t, tc.cfg)
+
+			addrA := net.JoinHostPort(tc.loopback, fmt.Sprint(a.Port()))
+			if err := b.AddNode(context.Background(), addrA); err != nil {
+				t.Skipf("Loopback %s unavailable: %v", tc.loopback, err)
+			}
+			if err := c.AddNode(context.Background(), addrA); err != nil {
+				t.Fatalf("AddNode failed: %v", err)
+			}
+
+			infoHash := [20]byte{0xde, 0xad, 0xbe, 0xef}
+			if _, err := b.Announce(context.Background(), infoHash, 6881); err != nil {
+				t.Fatalf("Announce failed: %v", err)
+			}
+
+			peers, err := c.GetPeers(context.Background(), infoHash)
+			if err != nil {
+				t.Fatalf("GetPeers failed: %v", err)
+			}
+			if len(peers) != 1 || !peers[0].IP.Equal(net.ParseIP(tc.loopback)) || peers[0].Port != 6881 {
+				t.Errorf("Expected peer %s:6881, got %v", tc.loopback, peers)
+			}
+
+			// A cancelled lookup gives up at once
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if _, err := c.GetPeers(ctx, infoHash); !errors.Is(err, context.Canceled) {
+				t.Errorf("Expected context.Canceled, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDualStackNodes6(t *testing.T) {
+	a := newTestServer(t, Config{})
+	b := newTestServer(t, Config{})
+	if len(a.stacks) < 2 || len(b.stacks) < 2 {
+		t.Skip("IPv6 is not available")
+	}
+
+	// b learns a over IPv6 so a has it in its IPv6 table
+	if err := b.AddNode(context.Background(), fmt.Sprintf("[::1]:%d", a.Port())); err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+
+	// A find_node sent over IPv4 with want=n4,n6 must return nodes6
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: a.Port()}
+	resp, err := b.query(context.Background(), b.stacks[0], addr, "find_node", map[string]interface{}{"target": string(b.id[:])})
+	if err != nil {
+		t.Fatalf("find_node failed: %v", err)
+	}
+
+	_, other := b.responseNodes(b.stacks[0], resp)
+	if len(other) != 1 || other[0].ID != b.ID() {
+		t.Errorf("Expected our own node in nodes6, got %v", other)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	normal := newTestServer(t, Config{DisableIPv6: true})
+	readOnly := newTestServer(t, Config{DisableIPv6: true, ReadOnly: true})
+
+	// A read-only node can query others...
+	if err := readOnly.AddNode(context.Background(), fmt.Sprintf("127.0.0.1:%d", normal.Port())); err != nil {
+		t.Fatalf("Read-only ping failed: %v", err)
+	}
+	if n, _ := readOnly.NumNodes(); n != 1 {
+		t.Errorf("Expected read-only node to learn 1 node, got %d", n)
+	}
+
+	// ...but is not added to their routing tables
+	if n, _ := normal.NumNodes(); n != 0 {
+		t.Errorf("Expected read-only node to be kept out of the table, got %d nodes", n)
+	}
+
+	// ...and does not answer queries
+	if err := normal.AddNode(context.Background(), fmt.Sprintf("127.0.0.1:%d", readOnly.Port())); err == nil {
+		t.Error("Expected read-only node not to answer a ping")
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	a := newTestServer(t, Config{DisableIPv6: true})
+	b := newTestServer(t, Config{DisableIPv6: true, Blocked: func(ip net.IP) bool { return ip.IsLoopback() }})
+
+	// b ignores a's ping entirely
+	if err := a.AddNode(context.Background(), fmt.Sprintf("127.0.0.1:%d", b.Port())); err == nil {
+		t.Error("Expected ping from a blocked address to go unanswered")
+	}
+	if n, _ := b.NumNodes(); n != 0 {
+		t.Errorf("Expected no nodes in b's table, got %d", n)
+	}
+}
+
+func TestSecureNodeID(t *testing.T) {
+	// Test vectors from BEP 42: the first 21 bits of each ID follow from the
+	// IP and the last byte
+	testCases := []struct {
+		ip string
+		id string
+	}{
+		{"124.31.75.21", "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"},
+		{"21.75.31.124", "5a3ce9c14e7a08645677bbd1cfe7d8f956d53256"},
+		{"65.23.51.170", "a5d43220bc8f112a3d426c84764f8c2a1150e616"},
+		{"84.124.73.14", "1b0321dd1bb1fe518101ceef99462b947a01ff41"},
+		{"43.213.53.83", "e56f6cbf5b7c4be0237986d5243b87aa6d51305a"},
+	}
+	for _, tc := range testCases {
+		var id NodeID
+		hex.Decode(id[:], []byte(tc.id))
+		ip := net.ParseIP(tc.ip)
+		if !id.SecureFor(ip) {
+			t.Errorf("Expected %s to be secure for %s", tc.id, tc.ip)
+		}
+		if id.SecureFor(net.ParseIP("192.0.2.1")) {
+			t.Errorf("Expected %s not to be secure for 192.0.2.1", tc.id)
+		}
+	}
+
+	for _, addr := range []string{"203.0.113.7", "2001:db8::7"} {
+		ip := net.ParseIP(addr)
+		if id := SecureNodeID(ip); !id.SecureFor(ip) {
+			t.Errorf("Expected a secure node ID for %s, got %s", addr, id)
+		}
+	}
+}
+
+func TestSetExternalIP(t *testing.T) {
+	s, err := NewServer(Config{DisableIPv6: true, BootstrapNodes: []string{}})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	defer s.Close()
+	node := Node{ID: RandomNodeID(), Addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 6881}}
+	s.stacks[0].table.insert(node)
+
+	ip := net.IPv4(203, 0, 113, 7)
+	if !s.SetExternalIP(ip) {
+		t.Fatal("Expected the node ID to change")
+	}
+	if !s.ID().SecureFor(ip) {
+		t.Errorf("Expected a node ID secure for %s, got %s", ip, s.ID())
+	}
+	if s.SetExternalIP(ip) {
+		t.Error("Expected a secure node ID to be kept")
+	}
+	if nodes := s.stacks[0].table.closest(node.ID, 1); len(nodes) != 1 || nodes[0].ID != node.ID {
+		t.Errorf("Expected known nodes to be kept, got %v", nodes)
+	}
+}
+
+func TestMutableItems(t *testing.T) {
+	a := newTestServer(t, Config{DisableIPv6: true})
+	b := newTestServer(t, Config{DisableIPv6: true})
+	c := newTestServer(t, Config{DisableIPv6: true})
+	for _, s := range []*Server{b, c} {
+		if err := s.AddNode(context.Background(), fmt.Sprintf("127.0.0.1:%d", a.Port())); err != nil {
+			t.Skipf("Loopback unavailable: %v", err)
+		}
+	}
+
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("series")
+	put := func(seq int64, value string) error {
+		it, err := NewItem(priv, salt, seq, map[string]interface{}{"ih": value})
+		if err != nil {
+			t.Fatalf("NewItem failed: %v", err)
+		}
+		return b.Put(context.Background(), it)
+	}
+
+	if err := put(1, "first"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := put(2, "second"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := put(1, "stale"); err == nil {
+		t.Error("Expected an older sequence number to be refused")
+	}
+
+	var key [ed25519.PublicKeySize]byte
+	copy(key[:], priv.Public().(ed25519.PublicKey))
+	it, err := c.Get(context.Background(), key, salt)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	value, _ := it.Value.(map[string]interface{})
+	if it.Seq != 2 || value["ih"] != "second" {
+		t.Errorf("Expected seq 2 with the second value, got %d %v", it.Seq, it.Value)
+	}
+
+	// A different salt is a different item
+	if _, err := c.Get(context.Background(), key, []byte("other")); err == nil {
+		t.Error("Expected no item under another salt")
+	}
+
+	// Tampering breaks the signature
+	it.Seq = 3
+	if err := it.Verify(); err == nil {
+		t.Error("Expected a tampered item to fail verification")
+	}
+}
+
+func TestSaveTable(t *testing.T) {
+	a := newTestServer(t, Config{DisableIPv6: true})
+	b := newTestServer(t, Config{DisableIPv6: true})
+	if err := b.AddNode(context.Background(), fmt.Sprintf("127.0.0.1:%d", a.Port())); err != nil {
+		t.Skipf("Loopback unavailable: %v", err)
+	}
+	stale := Node{ID: RandomNodeID(), Addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 6881}}
+	b.stacks[0].table.restore(stale, time.Now().Add(-2*savedNodeMaxAge))
+
+	path := filepath.Join(t.TempDir(), "dht.dat")
+	if err := b.SaveTable(path); err != nil {
+		t.Fatalf("SaveTable failed: %v", err)
+	}
+
+	// The node ID and the nodes heard from lately come back, not stale ones
+	c := newTestServer(t, Config{DisableIPv6: true})
+	n, err := c.LoadTable(path)
+	if err != nil {
+		t.Fatalf("LoadTable failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 node loaded, got %d", n)
+	}
+	if c.ID() != b.ID() {
+		t.Errorf("Expected node ID %s, got %s", b.ID(), c.ID())
+	}
+
+	// Bootstrapping starts from the saved node, which learns about us
+	if err := c.Bootstrap(context.Background()); err != nil {
+		t.Fatalf("Bootstrap failed: %v", err)
+	}
+	known := false
+	for _, e := range a.stacks[0].table.entries() {
+		known = known || e.node.Addr.Port == c.Port()
+	}
+	if !known {
+		t.Error("Expected the saved node to know us")
+	}
+
+	if _, err := c.LoadTable(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+}
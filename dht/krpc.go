@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"errors"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+)
+
+// KRPC error codes from BEP 5
+const (
+	errGeneric       = 201
+	errServer        = 202
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+// message is a decoded KRPC message
+// Format: d1:t<tid>1:y<q|r|e>[1:q<method>1:a<args> | 1:r<values> | 1:e<error>]e
+type message struct {
+	T  string                 // Transaction ID
+	Y  string                 // Message type: "q", "r" or "e"
+	Q  string                 // Query method name
+	A  map[string]interface{} // Query arguments
+	R  map[string]interface{} // Response values
+	E  []interface{}          // Error code and message
+	RO bool                   // Sender is a read-only node (BEP 43)
+}
+
+// decodeMessage parses a bencoded KRPC message
+func decodeMessage(data []byte) (*message, error) {
+	decoded, _, err := bencode.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("krpc message is not a dictionary")
+	}
+
+	m := &message{}
+	if m.T, ok = dict["t"].(string); !ok {
+		return nil, errors.New("krpc message missing transaction id")
+	}
+	if m.Y, ok = dict["y"].(string); !ok {
+		return nil, errors.New("krpc message missing type")
+	}
+
+	if ro, ok := dict["ro"].(int64); ok && ro == 1 {
+		m.RO = true
+	}
+
+	switch m.Y {
+	case "q":
+		m.Q, _ = dict["q"].(string)
+		if m.A, ok = dict["a"].(map[string]interface{}); !ok {
+			return nil, errors.New("krpc query missing arguments")
+		}
+	case "r":
+		if m.R, ok = dict["r"].(map[string]interface{}); !ok {
+			return nil, errors.New("krpc response missing values")
+		}
+	case "e":
+		m.E, _ = dict["e"].([]interface{})
+	default:
+		return nil, errors.New("unknown krpc message type")
+	}
+
+	return m, nil
+}
+
+// encodeQuery builds a bencoded KRPC query. Read-only nodes set the top-level
+// "ro" key so that they are not added to routing tables (BEP 43).
+func encodeQuery(tid, method string, args map[string]interface{}, readOnly bool) ([]byte, error) {
+	dict := map[string]interface{}{
+		"t": tid,
+		"y": "q",
+		"q": method,
+		"a": args,
+	}
+	if readOnly {
+		dict["ro"] = 1
+	}
+	return bencode.EncodeDict(dict)
+}
+
+// encodeResponse builds a bencoded KRPC response
+func encodeResponse(tid string, values map[string]interface{}) ([]byte, error) {
+	return bencode.EncodeDict(map[string]interface{}{
+		"t": tid,
+		"y": "r",
+		"r": values,
+	})
+}
+
+// encodeError builds a bencoded KRPC error
+func encodeError(tid string, code int, msg string) ([]byte, error) {
+	return bencode.EncodeDict(map[string]interface{}{
+		"t": tid,
+		"y": "e",
+		"e": []interface{}{code, msg},
+	})
+}
+
+// nodeIDArg extracts a 20-byte node ID from a query argument or response value
+func nodeIDArg(dict map[string]interface{}, key string) (NodeID, bool) {
+	var id NodeID
+	s, ok := dict[key].(string)
+	if !ok || len(s) != len(id) {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
+
+// wants parses the BEP 32 "want" argument. When absent, the requester only
+// gets nodes of the address family the query arrived on.
+func wants(args map[string]interface{}, ipv6 bool) (want4, want6 bool) {
+	list, ok := args["want"].([]interface{})
+	if !ok {
+		return !ipv6, ipv6
+	}
+
+	for _, item := range list {
+		switch item {
+		case "n4":
+			want4 = true
+		case "n6":
+			want6 = true
+		}
+	}
+	return want4, want6
+}
@@ -0,0 +1,162 @@
+// Package dht implements the BitTorrent Mainline DHT (BEP 5) with the IPv6
+// extension (BEP 32), allowing peers to be discovered without a tracker.
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+)
+
+// Sizes of the compact encodings used in KRPC messages
+const (
+	compactNodeLen4 = 26 // 20 bytes node ID + 4 bytes IP + 2 bytes port
+	compactNodeLen6 = 38 // 20 bytes node ID + 16 bytes IP + 2 bytes port (BEP 32)
+	compactPeerLen4 = 6
+	compactPeerLen6 = 18
+)
+
+// NodeID is a 160-bit identifier in the DHT keyspace
+type NodeID [20]byte
+
+// RandomNodeID generates a random node ID
+func RandomNodeID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+// String returns the node ID in hex
+func (id NodeID) String() string {
+	return fmt.Sprintf("%x", id[:])
+}
+
+// distance returns the XOR distance between two IDs
+func distance(a, b NodeID) NodeID {
+	var d NodeID
+	for i := range a {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// closer reports whether a is closer to target than b
+func closer(target, a, b NodeID) bool {
+	for i := range target {
+		da := a[i] ^ target[i]
+		db := b[i] ^ target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// prefixLen returns the number of leading bits shared by a and b
+func prefixLen(a, b NodeID) int {
+	d := distance(a, b)
+	for i, x := range d {
+		if x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return 160
+}
+
+// Node is a remote DHT node
+type Node struct {
+	ID   NodeID
+	Addr *net.UDPAddr
+}
+
+// isIPv6 reports whether the address belongs to the IPv6 family
+func isIPv6(ip net.IP) bool {
+	return ip.To4() == nil
+}
+
+// encodeNodes packs nodes of one address family into compact node info.
+// Nodes of the other family are skipped.
+func encodeNodes(nodes []Node, ipv6 bool) string {
+	size := compactNodeLen4
+	if ipv6 {
+		size = compactNodeLen6
+	}
+
+	buf := make([]byte, 0, len(nodes)*size)
+	for _, n := range nodes {
+		if isIPv6(n.Addr.IP) != ipv6 {
+			continue
+		}
+		ip := n.Addr.IP.To4()
+		if ipv6 {
+			ip = n.Addr.IP.To16()
+		}
+		buf = append(buf, n.ID[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n.Addr.Port))
+	}
+	return string(buf)
+}
+
+// decodeNodes unpacks compact node info (26 bytes per IPv4 node, 38 per IPv6 node)
+func decodeNodes(data string, ipv6 bool) ([]Node, error) {
+	size, ipLen := compactNodeLen4, net.IPv4len
+	if ipv6 {
+		size, ipLen = compactNodeLen6, net.IPv6len
+	}
+
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("invalid compact node info length: %d", len(data))
+	}
+
+	nodes := make([]Node, 0, len(data)/size)
+	for i := 0; i < len(data); i += size {
+		var n Node
+		copy(n.ID[:], data[i:i+20])
+
+		ip := make(net.IP, ipLen)
+		copy(ip, data[i+20:i+20+ipLen])
+		port := binary.BigEndian.Uint16([]byte(data[i+20+ipLen : i+size]))
+		if port == 0 {
+			continue
+		}
+
+		n.Addr = &net.UDPAddr{IP: ip, Port: int(port)}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// encodePeer packs a peer address into compact peer info (6 or 18 bytes)
+func encodePeer(ip net.IP, port int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	buf := append([]byte{}, ip...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(port))
+	return string(buf)
+}
+
+// decodePeer unpacks compact peer info of either address family
+func decodePeer(data string) (tracker.Peer, error) {
+	var ipLen int
+	switch len(data) {
+	case compactPeerLen4:
+		ipLen = net.IPv4len
+	case compactPeerLen6:
+		ipLen = net.IPv6len
+	default:
+		return tracker.Peer{}, errors.New("invalid compact peer info length")
+	}
+
+	ip := make(net.IP, ipLen)
+	copy(ip, data[:ipLen])
+	port := binary.BigEndian.Uint16([]byte(data[ipLen:]))
+
+	return tracker.Peer{IP: ip, Port: port}, nil
+}
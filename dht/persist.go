@@ -0,0 +1,108 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+)
+
+// savedNodeMaxAge is how long after we last heard from a saved node it is
+// still worth trying; older nodes aren't loaded
+const savedNodeMaxAge = 24 * time.Hour
+
+// SaveTable writes our node ID and the nodes of the routing tables that
+// haven't failed a query since we last heard from them, with when that was,
+// to path, so the next run can rejoin the DHT through them without asking
+// the bootstrap nodes
+func (s *Server) SaveTable(path string) error {
+	id := s.ID()
+	nodes := []interface{}{}
+	for _, st := range s.stacks {
+		for _, e := range st.table.entries() {
+			if e.failures > 0 {
+				continue
+			}
+			nodes = append(nodes, map[string]interface{}{
+				"id":   string(e.node.ID[:]),
+				"addr": encodePeer(e.node.Addr.IP, e.node.Addr.Port),
+				"seen": e.lastSeen.Unix(),
+			})
+		}
+	}
+	data, err := bencode.EncodeDict(map[string]interface{}{
+		"id":    string(id[:]),
+		"nodes": nodes,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write a temporary file first so a crash can't leave half a file behind
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadTable takes the node ID saved by SaveTable, so nodes that knew us find
+// us again, and adds the saved nodes heard from within the last day to the
+// routing tables. The next Bootstrap starts from them, and only asks the
+// bootstrap nodes if none answers. It returns how many nodes were added.
+func (s *Server) LoadTable(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	decoded, _, err := bencode.Decode(data)
+	if err != nil {
+		return 0, fmt.Errorf("invalid DHT table: %v", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return 0, errors.New("invalid DHT table: not a dictionary")
+	}
+	saved, _ := dict["id"].(string)
+	if len(saved) != len(NodeID{}) {
+		return 0, errors.New("invalid DHT table: no node ID")
+	}
+
+	var id NodeID
+	copy(id[:], saved)
+	s.mu.Lock()
+	s.id = id
+	s.restored = true
+	s.mu.Unlock()
+	for _, st := range s.stacks {
+		st.table.rebase(id)
+	}
+
+	added := 0
+	list, _ := dict["nodes"].([]interface{})
+	for _, item := range list {
+		entry, _ := item.(map[string]interface{})
+		nodeID, _ := entry["id"].(string)
+		addr, _ := entry["addr"].(string)
+		seen, _ := entry["seen"].(int64)
+		p, err := decodePeer(addr)
+		if err != nil || len(nodeID) != len(NodeID{}) || time.Since(time.Unix(seen, 0)) > savedNodeMaxAge {
+			continue
+		}
+		n := Node{Addr: &net.UDPAddr{IP: p.IP, Port: int(p.Port)}}
+		copy(n.ID[:], nodeID)
+		for _, st := range s.stacks {
+			if st.ipv6 == isIPv6(p.IP) && !s.blocked(p.IP) && st.table.restore(n, time.Unix(seen, 0)) {
+				added++
+			}
+		}
+	}
+	return added, nil
+}
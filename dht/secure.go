@@ -0,0 +1,74 @@
+package dht
+
+import (
+	"hash/crc32"
+	"net"
+)
+
+// castagnoli is the CRC32-C table secure node IDs are derived with
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Masks applied to the leading bytes of an IP before hashing it into a node ID
+// (BEP 42), keeping enough of the address that one host can't pick its ID
+var (
+	v4IDMask = []byte{0x03, 0x0f, 0x3f, 0xff}
+	v6IDMask = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+)
+
+// idPrefix returns the CRC32-C of ip masked for node ID derivation, with the
+// low three bits of r mixed into the top of the first byte
+func idPrefix(ip net.IP, r byte) uint32 {
+	mask := v4IDMask
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		ip, mask = ip.To16(), v6IDMask
+	}
+	masked := make([]byte, len(mask))
+	for i := range mask {
+		masked[i] = ip[i] & mask[i]
+	}
+	masked[0] |= (r & 0x07) << 5
+	return crc32.Checksum(masked, castagnoli)
+}
+
+// SecureNodeID returns a random node ID tied to our external IP (BEP 42),
+// which nodes enforcing BEP 42 accept from that address
+func SecureNodeID(ip net.IP) NodeID {
+	id := RandomNodeID()
+	crc := idPrefix(ip, id[19])
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x07
+	return id
+}
+
+// SecureFor reports whether id is a valid node ID for a node at ip (BEP 42):
+// its first 21 bits must be derived from the IP and its last byte
+func (id NodeID) SecureFor(ip net.IP) bool {
+	if ip.To16() == nil {
+		return false
+	}
+	crc := idPrefix(ip, id[19])
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) && id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+// SetExternalIP switches to a node ID secure for our external IP (BEP 42),
+// unless ours already is, and reports whether it changed. Known nodes are
+// kept; they are sorted into the buckets of the new ID.
+func (s *Server) SetExternalIP(ip net.IP) bool {
+	s.mu.Lock()
+	if s.id.SecureFor(ip) {
+		s.mu.Unlock()
+		return false
+	}
+	s.id = SecureNodeID(ip)
+	id := s.id
+	s.mu.Unlock()
+
+	for _, st := range s.stacks {
+		st.table.rebase(id)
+	}
+	s.log.Info("DHT node ID derived from external IP", "ip", ip, "id", id)
+	return true
+}
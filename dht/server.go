@@ -0,0 +1,857 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/logging"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+)
+
+// Protocol tuning constants
+const (
+	alpha           = 3 // parallel queries per lookup round
+	maxLookupRounds = 8
+	queryTimeout    = 2 * time.Second
+	secretRotation  = 5 * time.Minute
+	peerExpiry      = 30 * time.Minute
+	maxValues       = 50 // peers returned per get_peers response
+)
+
+// DefaultBootstrapNodes are well-known routers used to join the DHT
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// Config controls how a DHT server is started
+type Config struct {
+	Port           int      // UDP port shared by both stacks; 0 picks a random port
+	DisableIPv4    bool     // Do not run the IPv4 DHT
+	DisableIPv6    bool     // Do not run the IPv6 DHT (BEP 32)
+	BootstrapNodes []string // host:port of nodes used to join; defaults to DefaultBootstrapNodes
+	ReadOnly       bool     // Only issue queries, never answer them (BEP 43)
+	LocalIPv4      net.IP   // Local address of the IPv4 socket; nil binds all
+	LocalIPv6      net.IP   // Local address of the IPv6 socket; nil binds all
+
+	// Blocked, if set, reports addresses whose packets, nodes and peers are ignored
+	Blocked func(ip net.IP) bool
+
+	// ListenPacket, if set, opens the sockets instead of net.ListenUDP, e.g. to
+	// relay them through a proxy
+	ListenPacket func(network string, laddr *net.UDPAddr) (net.PacketConn, error)
+
+	// Logger, if set, receives the node's log records
+	Logger *slog.Logger
+}
+
+// stack is one address family of the DHT: a UDP socket and its routing table.
+// BEP 32 keeps separate routing tables for IPv4 and IPv6.
+type stack struct {
+	ipv6  bool
+	conn  net.PacketConn
+	table *routingTable
+}
+
+// Server is a DHT node running over IPv4, IPv6 or both
+type Server struct {
+	cfg    Config
+	stacks []*stack
+	log    *slog.Logger
+
+	mu         sync.Mutex
+	id         NodeID
+	pending    map[string]chan *message
+	nextTID    uint16
+	secret     [20]byte
+	prevSecret [20]byte
+	peers      map[[20]byte]map[string]time.Time // info hash -> compact peer -> announce time
+	items      map[NodeID]*storedItem            // mutable items stored by other nodes (BEP 44)
+	restored   bool                              // the routing table was loaded with LoadTable and not bootstrapped yet
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewServer opens the UDP sockets and starts serving DHT queries.
+// Failing to open the IPv6 socket is not fatal when IPv4 is available.
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.DisableIPv4 && cfg.DisableIPv6 {
+		return nil, errors.New("dht: both address families disabled")
+	}
+	if cfg.BootstrapNodes == nil {
+		cfg.BootstrapNodes = DefaultBootstrapNodes
+	}
+
+	s := &Server{
+		id:      RandomNodeID(),
+		cfg:     cfg,
+		pending: make(map[string]chan *message),
+		peers:   make(map[[20]byte]map[string]time.Time),
+		items:   make(map[NodeID]*storedItem),
+		done:    make(chan struct{}),
+		log:     logging.Or(cfg.Logger),
+	}
+	rand.Read(s.secret[:])
+	s.prevSecret = s.secret
+
+	listen := cfg.ListenPacket
+	if listen == nil {
+		listen = func(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+			return net.ListenUDP(network, laddr)
+		}
+	}
+
+	port := cfg.Port
+	if !cfg.DisableIPv4 {
+		conn, err := listen("udp4", &net.UDPAddr{IP: cfg.LocalIPv4, Port: port})
+		if err != nil {
+			return nil, fmt.Errorf("dht: failed to listen on udp4: %v", err)
+		}
+		s.stacks = append(s.stacks, &stack{conn: conn, table: newRoutingTable(s.id)})
+		port = conn.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	if !cfg.DisableIPv6 {
+		conn, err := listen("udp6", &net.UDPAddr{IP: cfg.LocalIPv6, Port: port})
+		if err != nil {
+			if len(s.stacks) == 0 {
+				return nil, fmt.Errorf("dht: failed to listen on udp6: %v", err)
+			}
+			s.log.Warn("IPv6 DHT disabled", "error", err)
+		} else {
+			s.stacks = append(s.stacks, &stack{ipv6: true, conn: conn, table: newRoutingTable(s.id)})
+		}
+	}
+
+	for _, st := range s.stacks {
+		s.wg.Add(1)
+		go s.readLoop(st)
+	}
+
+	s.wg.Add(1)
+	go s.maintenance()
+
+	return s, nil
+}
+
+// ID returns our node ID
+func (s *Server) ID() NodeID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
+
+// Port returns the UDP port the server listens on
+func (s *Server) Port() int {
+	return s.stacks[0].conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// NumNodes returns the number of nodes in the IPv4 and IPv6 routing tables
+func (s *Server) NumNodes() (ipv4, ipv6 int) {
+	for _, st := range s.stacks {
+		if st.ipv6 {
+			ipv6 = st.table.len()
+		} else {
+			ipv4 = st.table.len()
+		}
+	}
+	return ipv4, ipv6
+}
+
+// Close shuts down the sockets and background goroutines
+func (s *Server) Close() error {
+	close(s.done)
+	for _, st := range s.stacks {
+		st.conn.Close()
+	}
+	s.wg.Wait()
+	return nil
+}
+
+// SetBootstrapNodes replaces the nodes used by later calls to Bootstrap.
+// A nil slice restores DefaultBootstrapNodes.
+func (s *Server) SetBootstrapNodes(nodes []string) {
+	if nodes == nil {
+		nodes = DefaultBootstrapNodes
+	}
+	s.mu.Lock()
+	s.cfg.BootstrapNodes = nodes
+	s.mu.Unlock()
+}
+
+// Bootstrap joins the DHT by querying the bootstrap nodes and then looking up
+// our own ID. IPv6 nodes learned over IPv4 seed the IPv6 table and vice versa.
+// After LoadTable, the saved nodes are looked up from first, and the
+// bootstrap nodes only asked if none of them answers. It gives up when ctx
+// is done.
+func (s *Server) Bootstrap(ctx context.Context) error {
+	s.mu.Lock()
+	bootstrapNodes := s.cfg.BootstrapNodes
+	restored := s.restored
+	s.restored = false
+	s.mu.Unlock()
+
+	var hints []Node
+	id := s.ID()
+
+	for _, st := range s.stacks {
+		if restored && st.table.len() > 0 {
+			result := s.lookup(ctx, st, id, "find_node", nil)
+			if len(result.closest) > 0 {
+				hints = append(hints, result.other...)
+				continue
+			}
+			s.log.Debug("no saved DHT node answered", "ipv6", st.ipv6)
+		}
+
+		var seeds []Node
+		for _, addr := range bootstrapNodes {
+			udpAddr, err := net.ResolveUDPAddr(st.network(), addr)
+			if err != nil {
+				continue
+			}
+			resp, err := s.query(ctx, st, udpAddr, "find_node", map[string]interface{}{"target": string(id[:])})
+			if err != nil {
+				continue
+			}
+			found, other := s.responseNodes(st, resp)
+			seeds = append(seeds, found...)
+			hints = append(hints, other...)
+		}
+
+		// Nodes of this family learned by the other stack's bootstrap
+		for _, n := range hints {
+			if isIPv6(n.Addr.IP) == st.ipv6 {
+				seeds = append(seeds, n)
+			}
+		}
+
+		result := s.lookup(ctx, st, id, "find_node", seeds)
+		hints = append(hints, result.other...)
+	}
+
+	for _, st := range s.stacks {
+		if st.table.len() > 0 {
+			ipv4, ipv6 := s.NumNodes()
+			s.log.Info("DHT bootstrapped", "ipv4_nodes", ipv4, "ipv6_nodes", ipv6)
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.New("dht: bootstrap failed, no nodes responded")
+}
+
+// AddNode pings a node and adds it to the routing table if it responds
+func (s *Server) AddNode(ctx context.Context, addr string) error {
+	for _, st := range s.stacks {
+		udpAddr, err := net.ResolveUDPAddr(st.network(), addr)
+		if err != nil {
+			continue
+		}
+		_, err = s.query(ctx, st, udpAddr, "ping", map[string]interface{}{})
+		return err
+	}
+	return fmt.Errorf("dht: no stack can reach %s", addr)
+}
+
+// GetPeers searches both address families for peers of a torrent. Once ctx
+// is done it returns what it found so far along with ctx's error.
+func (s *Server) GetPeers(ctx context.Context, infoHash [20]byte) ([]tracker.Peer, error) {
+	results := s.lookupAll(ctx, NodeID(infoHash), "get_peers")
+	return mergePeers(results), ctx.Err()
+}
+
+// Announce finds the nodes closest to the info hash on every stack and
+// announces that we are downloading it on the given TCP port. Peers found
+// along the way are returned. It gives up when ctx is done.
+func (s *Server) Announce(ctx context.Context, infoHash [20]byte, port int) ([]tracker.Peer, error) {
+	results := s.lookupAll(ctx, NodeID(infoHash), "get_peers")
+
+	announced := 0
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i, st := range s.stacks {
+		for _, ln := range results[i].closest {
+			if ln.token == "" {
+				continue
+			}
+			wg.Add(1)
+			go func(st *stack, ln *lookupNode) {
+				defer wg.Done()
+				_, err := s.query(ctx, st, ln.node.Addr, "announce_peer", map[string]interface{}{
+					"info_hash":    string(infoHash[:]),
+					"port":         port,
+					"token":        ln.token,
+					"implied_port": 0,
+				})
+				if err == nil {
+					mu.Lock()
+					announced++
+					mu.Unlock()
+				}
+			}(st, ln)
+		}
+	}
+	wg.Wait()
+
+	peers := mergePeers(results)
+	if ctx.Err() != nil {
+		return peers, ctx.Err()
+	}
+	if announced == 0 {
+		return peers, errors.New("dht: no node accepted the announce")
+	}
+	return peers, nil
+}
+
+// lookupAll runs a get_peers or get lookup on every stack concurrently
+func (s *Server) lookupAll(ctx context.Context, target NodeID, method string) []lookupResult {
+	results := make([]lookupResult, len(s.stacks))
+	var wg sync.WaitGroup
+	for i, st := range s.stacks {
+		wg.Add(1)
+		go func(i int, st *stack) {
+			defer wg.Done()
+			results[i] = s.lookup(ctx, st, target, method, nil)
+		}(i, st)
+	}
+	wg.Wait()
+	return results
+}
+
+// mergePeers collects the peers of several lookups, removing duplicates
+func mergePeers(results []lookupResult) []tracker.Peer {
+	seen := make(map[string]bool)
+	var peers []tracker.Peer
+	for _, r := range results {
+		for _, p := range r.peers {
+			key := net.JoinHostPort(p.IP.String(), fmt.Sprint(p.Port))
+			if !seen[key] {
+				seen[key] = true
+				peers = append(peers, p)
+			}
+		}
+	}
+	return peers
+}
+
+// lookupNode is a node visited during an iterative lookup
+type lookupNode struct {
+	node    Node
+	token   string
+	queried bool
+	replied bool
+}
+
+// lookupResult is the outcome of an iterative lookup on one stack
+type lookupResult struct {
+	peers   []tracker.Peer
+	items   []*Item       // mutable items returned by get, unverified
+	closest []*lookupNode // responding nodes closest to the target
+	other   []Node        // nodes of the other address family that were returned
+}
+
+// lookup performs an iterative Kademlia lookup for target using find_node,
+// get_peers or get (BEP 44), starting from the routing table plus any seed nodes. It stops
+// early when ctx is done.
+func (s *Server) lookup(ctx context.Context, st *stack, target NodeID, method string, seeds []Node) lookupResult {
+	var result lookupResult
+	seen := make(map[string]bool)
+	var shortlist []*lookupNode
+	self := s.ID()
+
+	add := func(n Node) {
+		key := n.Addr.String()
+		if n.ID == self || seen[key] {
+			return
+		}
+		seen[key] = true
+		shortlist = append(shortlist, &lookupNode{node: n})
+	}
+	for _, n := range st.table.closest(target, BucketSize*2) {
+		add(n)
+	}
+	for _, n := range seeds {
+		add(n)
+	}
+
+	args := map[string]interface{}{"target": string(target[:])}
+	if method == "get_peers" {
+		args = map[string]interface{}{"info_hash": string(target[:])}
+	}
+
+	type reply struct {
+		ln   *lookupNode
+		resp *message
+	}
+
+	for round := 0; round < maxLookupRounds && ctx.Err() == nil; round++ {
+		sort.Slice(shortlist, func(i, j int) bool {
+			return closer(target, shortlist[i].node.ID, shortlist[j].node.ID)
+		})
+
+		// Query the closest nodes that haven't been asked yet
+		var batch []*lookupNode
+		for i := 0; i < len(shortlist) && i < BucketSize && len(batch) < alpha; i++ {
+			if !shortlist[i].queried {
+				shortlist[i].queried = true
+				batch = append(batch, shortlist[i])
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		replies := make(chan reply, len(batch))
+		for _, ln := range batch {
+			go func(ln *lookupNode) {
+				resp, err := s.query(ctx, st, ln.node.Addr, method, args)
+				if err != nil {
+					resp = nil
+				}
+				replies <- reply{ln, resp}
+			}(ln)
+		}
+
+		for range batch {
+			r := <-replies
+			if r.resp == nil {
+				continue
+			}
+			r.ln.replied = true
+			r.ln.token, _ = r.resp.R["token"].(string)
+
+			// Collect peers from "values"
+			if values, ok := r.resp.R["values"].([]interface{}); ok {
+				for _, v := range values {
+					if str, ok := v.(string); ok {
+						if p, err := decodePeer(str); err == nil && !s.blocked(p.IP) {
+							result.peers = append(result.peers, p)
+						}
+					}
+				}
+			}
+
+			if method == "get" {
+				if it, ok := responseItem(r.resp.R); ok {
+					result.items = append(result.items, it)
+				}
+			}
+
+			found, other := s.responseNodes(st, r.resp)
+			for _, n := range found {
+				add(n)
+			}
+			result.other = append(result.other, other...)
+		}
+	}
+
+	sort.Slice(shortlist, func(i, j int) bool {
+		return closer(target, shortlist[i].node.ID, shortlist[j].node.ID)
+	})
+	for _, ln := range shortlist {
+		if ln.replied {
+			result.closest = append(result.closest, ln)
+			if len(result.closest) == BucketSize {
+				break
+			}
+		}
+	}
+	return result
+}
+
+// blocked reports whether an address is filtered out by Config.Blocked
+func (s *Server) blocked(ip net.IP) bool {
+	return s.cfg.Blocked != nil && s.cfg.Blocked(ip)
+}
+
+// allowedNodes drops blocked nodes
+func (s *Server) allowedNodes(nodes []Node) []Node {
+	allowed := nodes[:0]
+	for _, n := range nodes {
+		if !s.blocked(n.Addr.IP) {
+			allowed = append(allowed, n)
+		}
+	}
+	return allowed
+}
+
+// responseNodes splits the "nodes" and "nodes6" values of a response into
+// nodes of this stack's family and nodes of the other family
+func (s *Server) responseNodes(st *stack, resp *message) (same, other []Node) {
+	if compact, ok := resp.R["nodes"].(string); ok {
+		if nodes, err := decodeNodes(compact, false); err == nil {
+			nodes = s.allowedNodes(nodes)
+			if st.ipv6 {
+				other = append(other, nodes...)
+			} else {
+				same = append(same, nodes...)
+			}
+		}
+	}
+	if compact, ok := resp.R["nodes6"].(string); ok {
+		if nodes, err := decodeNodes(compact, true); err == nil {
+			nodes = s.allowedNodes(nodes)
+			if st.ipv6 {
+				same = append(same, nodes...)
+			} else {
+				other = append(other, nodes...)
+			}
+		}
+	}
+	return same, other
+}
+
+// query sends a KRPC query and waits for the response, until ctx is done
+func (s *Server) query(ctx context.Context, st *stack, addr *net.UDPAddr, method string, queryArgs map[string]interface{}) (*message, error) {
+	// Copy the arguments since lookups share them between goroutines
+	args := make(map[string]interface{}, len(queryArgs)+2)
+	for k, v := range queryArgs {
+		args[k] = v
+	}
+	id := s.ID()
+	args["id"] = string(id[:])
+	if len(s.stacks) > 1 {
+		// BEP 32: ask for nodes of both families when we run both stacks
+		args["want"] = []interface{}{"n4", "n6"}
+	}
+
+	s.mu.Lock()
+	s.nextTID++
+	var tidBuf [2]byte
+	binary.BigEndian.PutUint16(tidBuf[:], s.nextTID)
+	tid := string(tidBuf[:])
+	ch := make(chan *message, 1)
+	s.pending[tid] = ch
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, tid)
+		s.mu.Unlock()
+	}()
+
+	data, err := encodeQuery(tid, method, args, s.cfg.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := st.conn.WriteTo(data, addr); err != nil {
+		return nil, err
+	}
+	s.trace(logging.Sent, addr, "q", method, tid, len(data))
+
+	select {
+	case resp := <-ch:
+		if resp.Y == "e" {
+			return nil, fmt.Errorf("dht: %s error from %s: %v", method, addr, resp.E)
+		}
+		id, ok := nodeIDArg(resp.R, "id")
+		if !ok {
+			return nil, errors.New("dht: response missing node id")
+		}
+		st.table.insert(Node{ID: id, Addr: addr})
+		return resp, nil
+	case <-time.After(queryTimeout):
+		return nil, fmt.Errorf("dht: %s to %s timed out", method, addr)
+	case <-s.done:
+		return nil, errors.New("dht: server closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readLoop receives KRPC packets on one stack
+func (s *Server) readLoop(st *stack) {
+	defer s.wg.Done()
+
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := st.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			// The socket is gone for good, e.g. a proxy dropped the relay
+			if errors.Is(err, net.ErrClosed) {
+				s.log.Error("DHT socket closed", "ipv6", st.ipv6, "error", err)
+				return
+			}
+			continue
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		if s.blocked(addr.IP) {
+			continue
+		}
+
+		msg, err := decodeMessage(buf[:n])
+		if err != nil {
+			s.log.Debug("invalid KRPC packet", "addr", addr, "error", err)
+			continue
+		}
+		s.trace(logging.Received, addr, msg.Y, msg.Q, msg.T, n)
+
+		if msg.Y == "q" {
+			// Read-only nodes stay silent so that others drop them
+			if !s.cfg.ReadOnly {
+				s.handleQuery(st, addr, msg)
+			}
+			continue
+		}
+
+		// Dispatch responses and errors to the waiting query
+		s.mu.Lock()
+		ch, ok := s.pending[msg.T]
+		s.mu.Unlock()
+		if ok {
+			select {
+			case ch <- msg:
+			default:
+			}
+		}
+	}
+}
+
+// handleQuery answers an incoming KRPC query
+func (s *Server) handleQuery(st *stack, addr *net.UDPAddr, msg *message) {
+	id, ok := nodeIDArg(msg.A, "id")
+	if !ok {
+		s.reply(st, addr, msg.T, nil, errProtocol, "missing node id")
+		return
+	}
+	// Read-only nodes can't answer our queries, so keep them out of the table
+	if !msg.RO {
+		st.table.insert(Node{ID: id, Addr: addr})
+	}
+
+	self := s.ID()
+	values := map[string]interface{}{"id": string(self[:])}
+
+	switch msg.Q {
+	case "ping":
+		// Only our ID is returned
+
+	case "find_node":
+		target, ok := nodeIDArg(msg.A, "target")
+		if !ok {
+			s.reply(st, addr, msg.T, nil, errProtocol, "missing target")
+			return
+		}
+		s.addClosestNodes(values, msg.A, st.ipv6, target)
+
+	case "get_peers":
+		infoHash, ok := nodeIDArg(msg.A, "info_hash")
+		if !ok {
+			s.reply(st, addr, msg.T, nil, errProtocol, "missing info_hash")
+			return
+		}
+		s.mu.Lock()
+		secret := s.secret
+		s.mu.Unlock()
+		values["token"] = makeToken(addr.IP, secret)
+		if peers := s.storedPeers(infoHash, st.ipv6); len(peers) > 0 {
+			values["values"] = peers
+		}
+		s.addClosestNodes(values, msg.A, st.ipv6, infoHash)
+
+	case "announce_peer":
+		infoHash, ok := nodeIDArg(msg.A, "info_hash")
+		if !ok {
+			s.reply(st, addr, msg.T, nil, errProtocol, "missing info_hash")
+			return
+		}
+		token, _ := msg.A["token"].(string)
+		if !s.validToken(addr.IP, token) {
+			s.reply(st, addr, msg.T, nil, errProtocol, "bad token")
+			return
+		}
+		port, _ := msg.A["port"].(int64)
+		if implied, _ := msg.A["implied_port"].(int64); implied == 1 {
+			port = int64(addr.Port)
+		}
+		if port <= 0 || port > 65535 {
+			s.reply(st, addr, msg.T, nil, errProtocol, "invalid port")
+			return
+		}
+		s.storePeer(infoHash, encodePeer(addr.IP, int(port)))
+
+	case "get":
+		target, ok := nodeIDArg(msg.A, "target")
+		if !ok {
+			s.reply(st, addr, msg.T, nil, errProtocol, "missing target")
+			return
+		}
+		s.mu.Lock()
+		secret := s.secret
+		s.mu.Unlock()
+		values["token"] = makeToken(addr.IP, secret)
+		s.handleGet(values, msg.A, target)
+		s.addClosestNodes(values, msg.A, st.ipv6, target)
+
+	case "put":
+		if code, errMsg := s.handlePut(addr, msg.A); code != 0 {
+			s.reply(st, addr, msg.T, nil, code, errMsg)
+			return
+		}
+
+	default:
+		s.reply(st, addr, msg.T, nil, errMethodUnknown, "method unknown")
+		return
+	}
+
+	s.reply(st, addr, msg.T, values, 0, "")
+}
+
+// addClosestNodes fills "nodes" and/or "nodes6" according to the want argument
+func (s *Server) addClosestNodes(values, args map[string]interface{}, ipv6 bool, target NodeID) {
+	want4, want6 := wants(args, ipv6)
+	for _, st := range s.stacks {
+		closest := st.table.closest(target, BucketSize)
+		if st.ipv6 && want6 {
+			values["nodes6"] = encodeNodes(closest, true)
+		} else if !st.ipv6 && want4 {
+			values["nodes"] = encodeNodes(closest, false)
+		}
+	}
+}
+
+// reply sends a response, or an error when code is non-zero
+func (s *Server) reply(st *stack, addr *net.UDPAddr, tid string, values map[string]interface{}, code int, errMsg string) {
+	var data []byte
+	var err error
+	if code != 0 {
+		data, err = encodeError(tid, code, errMsg)
+	} else {
+		data, err = encodeResponse(tid, values)
+	}
+	if err != nil {
+		return
+	}
+	if _, err := st.conn.WriteTo(data, addr); err == nil {
+		y := "r"
+		if code != 0 {
+			y = "e"
+		}
+		s.trace(logging.Sent, addr, y, "", tid, len(data))
+	}
+}
+
+// trace logs a KRPC packet exchanged with a node at the wire level: its type,
+// "q", "r" or "e", the method of a query, and its transaction ID
+func (s *Server) trace(dir string, addr *net.UDPAddr, y, method, tid string, size int) {
+	if !s.log.Enabled(context.Background(), logging.LevelWire) {
+		return
+	}
+	attrs := []interface{}{"dir", dir, "node", addr.String(), "y", y, "tid", fmt.Sprintf("%x", tid), "size", size}
+	if method != "" {
+		attrs = append(attrs, "method", method)
+	}
+	s.log.Log(context.Background(), logging.LevelWire, "KRPC packet", attrs...)
+}
+
+// makeToken derives the announce token handed out to an IP address
+func makeToken(ip net.IP, secret [20]byte) string {
+	sum := sha1.Sum(append(secret[:], ip...))
+	return string(sum[:8])
+}
+
+// validToken accepts tokens generated from the current or previous secret
+func (s *Server) validToken(ip net.IP, token string) bool {
+	s.mu.Lock()
+	current, previous := s.secret, s.prevSecret
+	s.mu.Unlock()
+	return token != "" && (token == makeToken(ip, current) || token == makeToken(ip, previous))
+}
+
+// storePeer records an announced peer for an info hash
+func (s *Server) storePeer(infoHash NodeID, compact string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, ok := s.peers[infoHash]
+	if !ok {
+		set = make(map[string]time.Time)
+		s.peers[infoHash] = set
+	}
+	set[compact] = time.Now()
+}
+
+// storedPeers returns announced peers of the requested address family
+func (s *Server) storedPeers(infoHash NodeID, ipv6 bool) []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	want := compactPeerLen4
+	if ipv6 {
+		want = compactPeerLen6
+	}
+
+	var values []interface{}
+	for compact := range s.peers[infoHash] {
+		if len(compact) == want {
+			values = append(values, compact)
+			if len(values) == maxValues {
+				break
+			}
+		}
+	}
+	return values
+}
+
+// maintenance rotates the token secret and expires stale announced peers
+// and items
+func (s *Server) maintenance() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(secretRotation)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			s.prevSecret = s.secret
+			rand.Read(s.secret[:])
+			for infoHash, set := range s.peers {
+				for compact, at := range set {
+					if time.Since(at) > peerExpiry {
+						delete(set, compact)
+					}
+				}
+				if len(set) == 0 {
+					delete(s.peers, infoHash)
+				}
+			}
+			s.expireItems()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// network returns the UDP network name of the stack
+func (st *stack) network() string {
+	if st.ipv6 {
+		return "udp6"
+	}
+	return "udp4"
+}
@@ -0,0 +1,269 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+)
+
+// Limits on mutable items (BEP 44)
+const (
+	MaxItemSize = 1000 // bytes of a bencoded value
+	MaxSaltSize = 64
+	itemExpiry  = 2 * time.Hour
+	maxItems    = 1000 // items we store for other nodes
+)
+
+// KRPC error codes from BEP 44
+const (
+	errTooBig       = 205
+	errBadSignature = 206
+	errSaltTooBig   = 207
+	errSeqTooLow    = 302
+)
+
+// Item is a mutable item stored in the DHT (BEP 44): a bencoded value signed
+// by the owner of an ed25519 key. The owner publishes a new version with a
+// higher sequence number under the same key and salt.
+type Item struct {
+	Key   [ed25519.PublicKeySize]byte
+	Salt  []byte
+	Seq   int64
+	Value interface{} // decoded bencode value, e.g. a dictionary
+	Sig   [ed25519.SignatureSize]byte
+}
+
+// storedItem is an item we hold for other nodes
+type storedItem struct {
+	item   Item
+	stored time.Time
+}
+
+// MutableTarget returns the DHT key a mutable item is stored under
+func MutableTarget(key [ed25519.PublicKeySize]byte, salt []byte) NodeID {
+	return sha1.Sum(append(key[:], salt...))
+}
+
+// NewItem signs value as version seq of the item of priv's public key and salt
+func NewItem(priv ed25519.PrivateKey, salt []byte, seq int64, value interface{}) (*Item, error) {
+	it := &Item{Salt: salt, Seq: seq, Value: value}
+	copy(it.Key[:], priv.Public().(ed25519.PublicKey))
+	v, err := it.encodedValue()
+	if err != nil {
+		return nil, err
+	}
+	copy(it.Sig[:], ed25519.Sign(priv, signedBytes(salt, seq, v)))
+	return it, nil
+}
+
+// Target returns the DHT key the item is stored under
+func (it *Item) Target() NodeID {
+	return MutableTarget(it.Key, it.Salt)
+}
+
+// Verify checks the item's size limits and signature
+func (it *Item) Verify() error {
+	if len(it.Salt) > MaxSaltSize {
+		return errors.New("dht: salt too big")
+	}
+	v, err := it.encodedValue()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(it.Key[:], signedBytes(it.Salt, it.Seq, v), it.Sig[:]) {
+		return errors.New("dht: invalid item signature")
+	}
+	return nil
+}
+
+// encodedValue returns the bencoded value, which must fit in MaxItemSize
+func (it *Item) encodedValue() ([]byte, error) {
+	v, err := bencode.Encode(it.Value)
+	if err != nil {
+		return nil, fmt.Errorf("dht: invalid item value: %v", err)
+	}
+	if len(v) > MaxItemSize {
+		return nil, errors.New("dht: item value too big")
+	}
+	return v, nil
+}
+
+// signedBytes returns what the signature of an item covers
+// Format: [4:salt<len>:<salt>]3:seqi<seq>e1:v<bencoded value>
+func signedBytes(salt []byte, seq int64, v []byte) []byte {
+	var b []byte
+	if len(salt) > 0 {
+		b = append(b, "4:salt"+strconv.Itoa(len(salt))+":"...)
+		b = append(b, salt...)
+	}
+	b = append(b, "3:seqi"+strconv.FormatInt(seq, 10)+"e1:v"...)
+	return append(b, v...)
+}
+
+// Get looks up the mutable item of a public key and salt on both address
+// families and returns the valid version with the highest sequence number.
+// It gives up when ctx is done.
+func (s *Server) Get(ctx context.Context, key [ed25519.PublicKeySize]byte, salt []byte) (*Item, error) {
+	var best *Item
+	for _, r := range s.lookupAll(ctx, MutableTarget(key, salt), "get") {
+		for _, it := range r.items {
+			it.Salt = salt
+			if it.Key != key || it.Verify() != nil {
+				continue
+			}
+			if best == nil || it.Seq > best.Seq {
+				best = it
+			}
+		}
+	}
+	if best != nil {
+		return best, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, errors.New("dht: item not found")
+}
+
+// Put stores a signed item on the nodes closest to its target on every
+// stack. It gives up when ctx is done.
+func (s *Server) Put(ctx context.Context, it *Item) error {
+	if err := it.Verify(); err != nil {
+		return err
+	}
+	args := map[string]interface{}{
+		"k":   string(it.Key[:]),
+		"seq": it.Seq,
+		"sig": string(it.Sig[:]),
+		"v":   it.Value,
+	}
+	if len(it.Salt) > 0 {
+		args["salt"] = string(it.Salt)
+	}
+
+	results := s.lookupAll(ctx, it.Target(), "get")
+	stored := 0
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i, st := range s.stacks {
+		for _, ln := range results[i].closest {
+			if ln.token == "" {
+				continue
+			}
+			query := make(map[string]interface{}, len(args)+1)
+			for k, v := range args {
+				query[k] = v
+			}
+			query["token"] = ln.token
+			wg.Add(1)
+			go func(st *stack, ln *lookupNode) {
+				defer wg.Done()
+				if _, err := s.query(ctx, st, ln.node.Addr, "put", query); err == nil {
+					mu.Lock()
+					stored++
+					mu.Unlock()
+				}
+			}(st, ln)
+		}
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if stored == 0 {
+		return errors.New("dht: no node accepted the item")
+	}
+	return nil
+}
+
+// responseItem extracts the item of a get response, without its salt, which
+// responses don't carry
+func responseItem(values map[string]interface{}) (*Item, bool) {
+	k, _ := values["k"].(string)
+	sig, _ := values["sig"].(string)
+	seq, ok := values["seq"].(int64)
+	v, hasValue := values["v"]
+	if !ok || !hasValue || len(k) != ed25519.PublicKeySize || len(sig) != ed25519.SignatureSize {
+		return nil, false
+	}
+	it := &Item{Seq: seq, Value: v}
+	copy(it.Key[:], k)
+	copy(it.Sig[:], sig)
+	return it, true
+}
+
+// handleGet adds the item stored under target to a get response. A requester
+// that already has sequence number seq or newer gets only our seq.
+func (s *Server) handleGet(values, args map[string]interface{}, target NodeID) {
+	s.mu.Lock()
+	stored, ok := s.items[target]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	values["seq"] = stored.item.Seq
+	if seq, ok := args["seq"].(int64); ok && stored.item.Seq <= seq {
+		return
+	}
+	values["k"] = string(stored.item.Key[:])
+	values["sig"] = string(stored.item.Sig[:])
+	values["v"] = stored.item.Value
+}
+
+// handlePut validates and stores the item of a put query, returning a KRPC
+// error code and message when it is refused
+func (s *Server) handlePut(addr *net.UDPAddr, args map[string]interface{}) (int, string) {
+	token, _ := args["token"].(string)
+	if !s.validToken(addr.IP, token) {
+		return errProtocol, "bad token"
+	}
+	salt, _ := args["salt"].(string)
+	if len(salt) > MaxSaltSize {
+		return errSaltTooBig, "salt too big"
+	}
+	it, ok := responseItem(args)
+	if !ok {
+		return errProtocol, "invalid mutable item"
+	}
+	if salt != "" {
+		it.Salt = []byte(salt)
+	}
+	if v, err := bencode.Encode(it.Value); err != nil || len(v) > MaxItemSize {
+		return errTooBig, "message too big"
+	}
+	if it.Verify() != nil {
+		return errBadSignature, "invalid signature"
+	}
+
+	target := it.Target()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, ok := s.items[target]; ok {
+		if it.Seq < stored.item.Seq {
+			return errSeqTooLow, "sequence number less than current"
+		}
+	} else if len(s.items) >= maxItems {
+		return errServer, "storage full"
+	}
+	s.items[target] = &storedItem{item: *it, stored: time.Now()}
+	return 0, ""
+}
+
+// expireItems forgets items not refreshed for itemExpiry. The caller must
+// hold s.mu.
+func (s *Server) expireItems() {
+	for target, stored := range s.items {
+		if time.Since(stored.stored) > itemExpiry {
+			delete(s.items, target)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Routing table parameters from BEP 5
+const (
+	BucketSize    = 8                // K: maximum nodes per bucket
+	staleAfter    = 15 * time.Minute // nodes not heard from in this long are questionable
+	maxNodeFailed = 3                // failed queries before a node is evicted
+)
+
+// tableEntry tracks the liveness of a node in the routing table
+type tableEntry struct {
+	node     Node
+	lastSeen time.Time
+	failures int
+}
+
+// routingTable is a simplified Kademlia routing table: one bucket per
+// shared-prefix length with our own ID. Each address family gets its own table.
+type routingTable struct {
+	mu      sync.Mutex
+	self    NodeID
+	buckets [161][]*tableEntry
+}
+
+func newRoutingTable(self NodeID) *routingTable {
+	return &routingTable{self: self}
+}
+
+// insert adds or refreshes a node. When the bucket is full a failing or
+// stale node is replaced; otherwise the new node is dropped.
+func (t *routingTable) insert(n Node) {
+	if n.ID == t.self {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	idx := prefixLen(t.self, n.ID)
+	bucket := t.buckets[idx]
+
+	// Refresh an existing entry
+	for _, e := range bucket {
+		if e.node.ID == n.ID {
+			e.node.Addr = n.Addr
+			e.lastSeen = time.Now()
+			e.failures = 0
+			return
+		}
+	}
+
+	entry := &tableEntry{node: n, lastSeen: time.Now()}
+	if len(bucket) < BucketSize {
+		t.buckets[idx] = append(bucket, entry)
+		return
+	}
+
+	// Bucket is full: evict the worst bad or questionable node, if any
+	worst := -1
+	for i, e := range bucket {
+		if e.failures > 0 || time.Since(e.lastSeen) > staleAfter {
+			if worst < 0 || e.failures > bucket[worst].failures {
+				worst = i
+			}
+		}
+	}
+	if worst >= 0 {
+		bucket[worst] = entry
+	}
+}
+
+// restore adds a node saved by an earlier run, last heard from at lastSeen,
+// if its bucket has room, and reports whether it did
+func (t *routingTable) restore(n Node, lastSeen time.Time) bool {
+	if n.ID == t.self {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	idx := prefixLen(t.self, n.ID)
+	bucket := t.buckets[idx]
+	if len(bucket) >= BucketSize {
+		return false
+	}
+	for _, e := range bucket {
+		if e.node.ID == n.ID {
+			return false
+		}
+	}
+	t.buckets[idx] = append(bucket, &tableEntry{node: n, lastSeen: lastSeen})
+	return true
+}
+
+// entries returns a copy of every node's entry
+func (t *routingTable) entries() []tableEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries := make([]tableEntry, 0, t.lenLocked())
+	for _, bucket := range t.buckets {
+		for _, e := range bucket {
+			entries = append(entries, *e)
+		}
+	}
+	return entries
+}
+
+// markFailed records a failed query and evicts the node after repeated failures
+func (t *routingTable) markFailed(id NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	idx := prefixLen(t.self, id)
+	bucket := t.buckets[idx]
+	for i, e := range bucket {
+		if e.node.ID == id {
+			e.failures++
+			if e.failures >= maxNodeFailed {
+				t.buckets[idx] = append(bucket[:i], bucket[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// closest returns up to count nodes ordered by distance to target
+func (t *routingTable) closest(target NodeID, count int) []Node {
+	t.mu.Lock()
+	nodes := make([]Node, 0, t.lenLocked())
+	for _, bucket := range t.buckets {
+		for _, e := range bucket {
+			nodes = append(nodes, e.node)
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return closer(target, nodes[i].ID, nodes[j].ID)
+	})
+
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// rebase moves the table to a new own ID, sorting the known nodes into its
+// buckets. Nodes that no longer fit in a full bucket are dropped.
+func (t *routingTable) rebase(self NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.buckets
+	t.self = self
+	t.buckets = [161][]*tableEntry{}
+	for _, bucket := range old {
+		for _, e := range bucket {
+			if e.node.ID == self {
+				continue
+			}
+			idx := prefixLen(self, e.node.ID)
+			if len(t.buckets[idx]) < BucketSize {
+				t.buckets[idx] = append(t.buckets[idx], e)
+			}
+		}
+	}
+}
+
+// len returns the number of nodes in the table
+func (t *routingTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lenLocked()
+}
+
+func (t *routingTable) lenLocked() int {
+	total := 0
+	for _, bucket := range t.buckets {
+		total += len(bucket)
+	}
+	return total
+}
@@ -0,0 +1,36 @@
+package download
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// reserve reserves the disk space of f's first length bytes with fallocate,
+// growing f to length if it's shorter
+func reserve(f *os.File, length int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, length)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return errors.ErrUnsupported
+	}
+	return err
+}
+
+// diskUsage returns how many bytes of disk a file takes up, which for a
+// sparse file is less than its size
+func diskUsage(info os.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return min(st.Blocks*512, info.Size())
+	}
+	return info.Size()
+}
+
+// freeSpace returns how many bytes can be written to the file system holding
+// dir
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package download
+
+import (
+	"errors"
+	"os"
+)
+
+// reserve can't reserve disk space on this system, so files are allocated
+// sparsely
+func reserve(f *os.File, length int64) error {
+	return errors.ErrUnsupported
+}
+
+// diskUsage returns the size of a file, which is taken as the disk space it
+// uses
+func diskUsage(info os.FileInfo) int64 {
+	return info.Size()
+}
+
+// freeSpace can't tell the free space on this system, so it isn't checked
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
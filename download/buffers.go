@@ -0,0 +1,32 @@
+package download
+
+import "sync"
+
+// bufferPool recycles byte slices, so a fast download doesn't allocate a new
+// buffer for every piece or block
+type bufferPool struct {
+	pool sync.Pool
+}
+
+// Buffers for assembling pieces, which are handed back once a piece is
+// written or fails its hash check, and for blocks read to serve requests
+var (
+	pieceBuffers bufferPool
+	blockBuffers bufferPool
+)
+
+// get returns a buffer of n bytes, reusing a released one if it is large
+// enough. Its contents are undefined.
+func (p *bufferPool) get(n int) []byte {
+	if v := p.pool.Get(); v != nil {
+		if buf := *v.(*[]byte); cap(buf) >= n {
+			return buf[:n]
+		}
+	}
+	return make([]byte, n)
+}
+
+// put releases a buffer for reuse; it must not be used afterwards
+func (p *bufferPool) put(buf []byte) {
+	p.pool.Put(&buf)
+}
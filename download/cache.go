@@ -0,0 +1,80 @@
+package download
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+const (
+	// maxCoalesce caps how much of a run of adjacent pieces goes to disk in
+	// one write
+	maxCoalesce = 4 << 20
+
+	// writeCacheAge is how often a write cache that hasn't filled up is
+	// flushed anyway, so readers and resume data don't wait on a slow swarm
+	writeCacheAge = 5 * time.Second
+)
+
+// writeCache holds verified pieces in memory until enough have gathered to
+// write them together, in torrent order and with runs of adjacent pieces in
+// one write, so the disk sees a few large sequential writes instead of one
+// scattered write per piece
+type writeCache struct {
+	out         io.WriterAt
+	pieceLength int64
+	budget      int64 // Bytes held before the cache is full; 0 holds nothing
+
+	pieces  []*pieceResult
+	size    int64
+	scratch []byte // Joins a run of adjacent pieces for one write
+}
+
+// add caches a verified piece
+func (c *writeCache) add(res *pieceResult) {
+	c.pieces = append(c.pieces, res)
+	c.size += int64(len(res.buf))
+}
+
+// full reports whether the cached pieces have reached the budget
+func (c *writeCache) full() bool {
+	return len(c.pieces) > 0 && c.size >= c.budget
+}
+
+// flush writes every cached piece and calls written with the index of each
+// once it's on disk. After a failed write the pieces not yet written are
+// dropped, to be downloaded again.
+func (c *writeCache) flush(written func(index int)) error {
+	slices.SortFunc(c.pieces, func(a, b *pieceResult) int { return a.index - b.index })
+	defer func() {
+		c.pieces, c.size = c.pieces[:0], 0
+	}()
+
+	for pending := c.pieces; len(pending) > 0; {
+		run, size := 1, len(pending[0].buf)
+		for run < len(pending) && pending[run].index == pending[run-1].index+1 && size+len(pending[run].buf) <= maxCoalesce {
+			size += len(pending[run].buf)
+			run++
+		}
+		buf := pending[0].buf
+		if run > 1 {
+			c.scratch = c.scratch[:0]
+			for _, res := range pending[:run] {
+				c.scratch = append(c.scratch, res.buf...)
+			}
+			buf = c.scratch
+		}
+
+		offset := int64(pending[0].index) * c.pieceLength
+		if _, err := c.out.WriteAt(buf, offset); err != nil {
+			return fmt.Errorf("%w: failed to write piece %d: %v", ErrStorage, pending[0].index, err)
+		}
+		for _, res := range pending[:run] {
+			pieceBuffers.put(res.buf)
+			written(res.index)
+		}
+		pending = pending[run:]
+	}
+	return nil
+}
@@ -0,0 +1,695 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/clock"
+	"github.com/omkarkirpan/bittorrent-client/logging"
+	"github.com/omkarkirpan/bittorrent-client/peer"
+	"github.com/omkarkirpan/bittorrent-client/ratelimit"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+)
+
+// writeTimeout bounds sending one message, so a stalled peer can't block us
+const writeTimeout = 30 * time.Second
+
+// errTimeout is returned when the peer didn't send what we waited for in time
+var errTimeout = errors.New("timed out waiting for the peer")
+
+// errRejected is returned when the peer rejected a block request while
+// letting us request it, i.e. it won't serve the piece for now (BEP 6)
+var errRejected = errors.New("the peer rejected our request")
+
+// errRefusedClient is returned when Task.ClientPolicy refuses the peer's client
+var errRefusedClient = errors.New("client refused by policy")
+
+// peerConn is a handshaken connection to a peer together with its state
+type peerConn struct {
+	conn      net.Conn
+	peerID    [20]byte
+	incoming  bool // the peer dialed us
+	extended  bool // the peer supports the extension protocol
+	fast      bool // both sides support the Fast extension (BEP 6)
+	bitfield  peer.Bitfield
+	numPieces int
+	stats     *Stats       // nil until a worker owns the connection
+	log       *slog.Logger // receives every message at logging.LevelWire
+	clock     clock.Clock  // times idling and piece downloads
+
+	// blockReceived, if set, is called with every new block of the piece
+	// being downloaded
+	blockReceived func(index, begin, length int)
+
+	// yourIP is our IP as the peer reported it in its extension handshake,
+	// passed to yourIPReported if set
+	yourIP         net.IP
+	yourIPReported func(ip net.IP)
+
+	// dhtPort is the port of the peer's DHT node from its PORT message,
+	// passed to portReported if set
+	dhtPort      uint16
+	portReported func(port uint16)
+
+	// allowedFast holds the pieces the peer lets us request while it chokes
+	// us (BEP 6)
+	allowedFast map[int]bool
+
+	// clientReported, if set, is called with the client the peer reports in
+	// its extension handshake; an error drops the connection
+	clientReported func(client string) error
+
+	// ext holds the extension protocol messages we handle and the peer's
+	// IDs for them. metadata is the info dictionary we serve peers fetching
+	// it with ut_metadata, nil if we have none to serve.
+	ext      peer.Extensions
+	metadata []byte
+
+	// Fed by readMessages while a worker owns the connection. readErr is set
+	// before msgs is closed.
+	msgs    chan *peer.Message
+	readErr error
+	closed  chan struct{} // closed when the worker is done with the connection
+
+	writeMu  sync.Mutex   // serializes the worker's messages and HAVE broadcasts
+	wbuf     []byte       // reused for every message sent, guarded by writeMu
+	lastSent atomic.Int64 // unix nanoseconds of the last message sent, for keepAlive
+
+	// uploads holds the peer's block requests until the worker's uploader
+	// sends them
+	uploads peer.RequestQueue
+
+	// Read by Stats.PeerList while the worker runs
+	choked     atomic.Bool
+	interested atomic.Bool // the peer wants pieces from us
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	have       atomic.Int32 // pieces the peer has
+	seed       atomic.Bool
+	piece      atomic.Int32           // piece being downloaded, -1 when idle
+	requests   atomic.Int32           // block requests in flight
+	latency    atomic.Int64           // smoothed time from requesting a block to receiving it, in nanoseconds
+	client     atomic.Pointer[string] // "v" from the peer's extension handshake
+	uploadOnly atomic.Bool            // the peer said it only uploads
+	throttled  atomic.Bool            // uploads to the peer are capped by its client policy
+	listenPort atomic.Uint32          // "p" from the peer's extension handshake
+
+	// pexReceived, if set, is called with the peers the peer tells us about
+	// through peer exchange. pexSent holds the peers we last told it about;
+	// it is only used by Stats.sendPEX.
+	pexReceived func(peers []tracker.Peer)
+	pexSent     map[string]bool
+
+	// holepunchConnect, if set, is called with the peer a relay tells us to
+	// connect to (BEP 55); holepunches counts those calls
+	holepunchConnect func(p tracker.Peer)
+	holepunches      int
+
+	// Smoothed transfer rates in bytes per second, guarded by Stats.mu
+	downRate, upRate float64
+	lastDown, lastUp int64
+}
+
+// connOptions is what we tell a peer about ourselves as a connection opens
+type connOptions struct {
+	numPieces  int           // in the torrent
+	bitfield   peer.Bitfield // the pieces we have
+	uploadOnly bool          // we are a partial seed (BEP 21)
+	metadata   []byte        // the info dictionary served with ut_metadata, if any
+	pex        bool          // we exchange peers (BEP 11)
+	holepunch  bool          // we relay and ask for holepunch rendezvous (BEP 55)
+}
+
+// dial connects to a peer, completes the handshake and reads its bitfield.
+// We advertise the extension protocol to learn the peer's client version, and
+// the Fast extension. A nonzero dhtPort is advertised in the handshake and, if the peer runs a DHT
+// node too, sent in a PORT message.
+func dial(ctx context.Context, dialFunc peer.DialFunc, addr string, infoHash, peerID [20]byte, opts connOptions, dhtPort uint16, log *slog.Logger) (*peerConn, error) {
+	hs := peer.NewHandshake(infoHash, peerID)
+	hs.SetExtension(peer.ExtensionExtensions)
+	hs.SetExtension(peer.ExtensionFast)
+	if dhtPort != 0 {
+		hs.SetExtension(peer.ExtensionDHT)
+	}
+
+	remote, conn, err := peer.ConnectWith(ctx, dialFunc, addr, hs)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newPeerConn(ctx, conn, remote.PeerID, remote.HasExtension(peer.ExtensionExtensions), remote.HasExtension(peer.ExtensionFast), opts, log)
+	if err != nil {
+		return nil, err
+	}
+
+	if dhtPort != 0 && remote.HasExtension(peer.ExtensionDHT) {
+		c.send(peer.PortMessage(dhtPort))
+	}
+	return c, nil
+}
+
+// newPeerConn wraps a handshaken connection, sends our bitfield unless we
+// have no pieces yet and our extension handshake if the peer supports the
+// extension protocol, and reads the peer's bitfield. With the Fast extension
+// HAVE ALL or HAVE NONE stand in for the bitfield when they say the same. It
+// gives up when ctx is done.
+func newPeerConn(ctx context.Context, conn net.Conn, peerID [20]byte, extensions, fast bool, opts connOptions, log *slog.Logger) (*peerConn, error) {
+	c := &peerConn{
+		conn:        conn,
+		peerID:      peerID,
+		extended:    extensions,
+		fast:        fast,
+		metadata:    opts.metadata,
+		log:         logging.Or(log),
+		clock:       clock.Real,
+		bitfield:    make(peer.Bitfield, len(opts.bitfield)),
+		numPieces:   opts.numPieces,
+		allowedFast: make(map[int]bool),
+		msgs:        make(chan *peer.Message),
+		closed:      make(chan struct{}),
+	}
+	c.choked.Store(true)
+	c.piece.Store(-1)
+	c.registerExtensions(opts.pex, opts.holepunch)
+
+	// Peers normally send their bitfield right after the handshake
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	bitfield := opts.bitfield.Message()
+	switch {
+	case fast && opts.bitfield.Empty():
+		bitfield = peer.FormatMessage(peer.MsgHaveNone, nil)
+	case fast && opts.bitfield.Complete(opts.numPieces):
+		bitfield = peer.FormatMessage(peer.MsgHaveAll, nil)
+	case opts.bitfield.Empty():
+		bitfield = nil
+	}
+	if bitfield != nil {
+		if err := c.send(bitfield); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to send bitfield: %v", err)
+		}
+	}
+	if extensions {
+		if err := c.send(c.extHandshake(opts.uploadOnly)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to send extension handshake: %v", err)
+		}
+	}
+
+	msg, err := peer.ReadMessage(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read bitfield: %v", err)
+	}
+	c.trace(logging.Received, msg)
+	if err := c.handle(msg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// sameAs reports whether two connections lead to the same peer: one with the
+// same peer ID at the same IP address
+func (c *peerConn) sameAs(other *peerConn) bool {
+	if c.peerID != other.peerID || c.peerID == ([20]byte{}) {
+		return false
+	}
+	a, okA := c.conn.RemoteAddr().(*net.TCPAddr)
+	b, okB := other.conn.RemoteAddr().(*net.TCPAddr)
+	return okA && okB && a.IP.Equal(b.IP)
+}
+
+// remoteIP returns the peer's IP address, or nil if it isn't a TCP address
+func (c *peerConn) remoteIP() net.IP {
+	if addr, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// host identifies the peer across connections: its IP, or its address if it
+// has none
+func (c *peerConn) host() string {
+	if ip := c.remoteIP(); ip != nil {
+		return ip.String()
+	}
+	return c.conn.RemoteAddr().String()
+}
+
+// clientName returns the client the peer reported, or else the one its peer
+// ID suggests; empty if unknown
+func (c *peerConn) clientName() string {
+	if v := c.client.Load(); v != nil {
+		return *v
+	}
+	return peer.ClientName(c.peerID)
+}
+
+// priority returns the canonical priority of the connection's endpoints
+// (BEP 40), or 0 if they aren't TCP addresses
+func (c *peerConn) priority() uint32 {
+	local, okL := c.conn.LocalAddr().(*net.TCPAddr)
+	remote, okR := c.conn.RemoteAddr().(*net.TCPAddr)
+	if !okL || !okR || (local.IP.To4() == nil) != (remote.IP.To4() == nil) {
+		return 0
+	}
+	return peer.Priority(local, remote)
+}
+
+// preferConn picks which of two connections to the same peer to keep, so
+// that the peer, making the same choice, keeps the same one. The connection
+// with the higher canonical priority wins. Usually both have the same, since
+// only the ports differ; then the one dialed by the side with the higher peer
+// ID wins.
+func preferConn(a, b *peerConn, ourID [20]byte) *peerConn {
+	if pa, pb := a.priority(), b.priority(); pa != pb {
+		if pa > pb {
+			return a
+		}
+		return b
+	}
+	keepIncoming := bytes.Compare(ourID[:], a.peerID[:]) < 0
+	if a.incoming != keepIncoming && b.incoming == keepIncoming {
+		return b
+	}
+	return a
+}
+
+// send writes a message to the peer. It is safe to call from any goroutine.
+func (c *peerConn) send(msg *peer.Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	c.wbuf = msg.AppendTo(c.wbuf[:0])
+	_, err := c.conn.Write(c.wbuf)
+	if err == nil {
+		c.lastSent.Store(time.Now().UnixNano())
+		c.trace(logging.Sent, msg)
+	}
+	return err
+}
+
+// keepAlive sends a keep-alive whenever we've sent the peer nothing for
+// interval, so it doesn't drop us while neither side has anything to say,
+// until the worker is done with the connection. Like the connection's
+// deadlines it goes by the system clock.
+func (c *peerConn) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, c.lastSent.Load())) >= interval {
+				c.send(&peer.KeepAliveMessage)
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// trace logs a message exchanged with the peer at the wire level, going in
+// direction dir
+func (c *peerConn) trace(dir string, msg *peer.Message) {
+	log := logging.Or(c.log)
+	if log.Enabled(context.Background(), logging.LevelWire) {
+		event := "received message"
+		if dir == logging.Sent {
+			event = "sent message"
+		}
+		log.Log(context.Background(), logging.LevelWire, event, "dir", dir, "msg", msg.String(), "size", 4+msg.Length)
+	}
+}
+
+// readMessages reads messages from the peer into msgs until reading fails or
+// the worker is done with the connection. A peer that sends nothing, not even
+// a keep-alive, for peer.IdleTimeout is given up on. Piece data is throttled
+// by limit; while waiting on it we stop reading, so TCP slows the peer down.
+func (c *peerConn) readMessages(ctx context.Context, limit *ratelimit.Limiter) {
+	defer close(c.msgs)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(peer.IdleTimeout))
+		msg, err := peer.ReadPooledMessage(c.conn)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = fmt.Errorf("peer silent for %v", peer.IdleTimeout)
+		}
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		c.trace(logging.Received, msg)
+		if msg.Length > 0 && msg.Type == peer.MsgPiece {
+			if err := limit.Wait(ctx, len(msg.Payload)); err != nil {
+				c.readErr = err
+				return
+			}
+		}
+		select {
+		case c.msgs <- msg:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// receive returns the next message from the peer, or errTimeout if timeout
+// fires first
+func (c *peerConn) receive(timeout <-chan time.Time) (*peer.Message, error) {
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			return nil, c.readErr
+		}
+		return msg, nil
+	case <-timeout:
+		return nil, errTimeout
+	}
+}
+
+// handle updates the connection state for messages that aren't piece data.
+// Fast extension messages are an error unless both sides support it.
+func (c *peerConn) handle(msg *peer.Message) error {
+	if msg.Length == 0 {
+		return nil // keep-alive
+	}
+	if msg.Type.IsFast() && !c.fast {
+		return fmt.Errorf("%v without the Fast extension", msg)
+	}
+
+	switch msg.Type {
+	case peer.MsgChoke:
+		c.choked.Store(true)
+	case peer.MsgUnchoke:
+		c.choked.Store(false)
+	case peer.MsgInterested:
+		c.interested.Store(true)
+	case peer.MsgNotInterested:
+		c.interested.Store(false)
+	case peer.MsgHave:
+		index, err := peer.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		if !c.bitfield.HasPiece(int(index)) {
+			c.bitfield.SetPiece(int(index))
+			c.have.Store(int32(c.bitfield.Count()))
+			if c.stats != nil {
+				c.stats.pieceAdded(c, int(index))
+			}
+		}
+	case peer.MsgBitfield:
+		c.setPieces(msg.Payload)
+	case peer.MsgHaveAll:
+		c.setPieces(peer.FullBitfield(c.numPieces))
+	case peer.MsgHaveNone:
+		c.setPieces(nil)
+	case peer.MsgAllowedFast:
+		index, err := peer.ParseAllowedFast(msg)
+		if err != nil {
+			return err
+		}
+		if int(index) < c.numPieces {
+			c.allowedFast[int(index)] = true
+		}
+	case peer.MsgSuggestPiece:
+		// Only a hint; we keep to our own piece order
+		if _, err := peer.ParseSuggest(msg); err != nil {
+			return err
+		}
+	case peer.MsgCancel:
+		// A block still queued is dropped before we read it. Fast peers
+		// expect a reject for it instead of the piece (BEP 6).
+		index, begin, length, err := peer.ParseCancel(msg)
+		if err != nil {
+			return err
+		}
+		if c.uploads.Cancel(peer.Request{Index: index, Begin: begin, Length: length}) && c.fast {
+			return c.send(peer.RejectMessage(index, begin, length))
+		}
+	case peer.MsgRejectRequest:
+		// A reject outside downloadPiece is for a request it gave up on
+		if _, _, _, err := peer.ParseReject(msg); err != nil {
+			return err
+		}
+	case peer.MsgPort:
+		// A malformed PORT message just leaves the peer's node unknown
+		port, err := peer.ParsePort(msg)
+		if err != nil || port == 0 || c.remoteIP() == nil {
+			break
+		}
+		c.dhtPort = port
+		if c.portReported != nil {
+			c.portReported(port)
+		}
+	case peer.MsgExtended:
+		if len(msg.Payload) == 0 {
+			break
+		}
+		h, err := c.ext.Handle(msg)
+		if err != nil && msg.Payload[0] == peer.ExtHandshakeID {
+			break // a malformed extension handshake just leaves the client unknown
+		}
+		if err != nil {
+			return err
+		}
+		if h != nil {
+			return c.extHandshakeReceived(h)
+		}
+	}
+	return nil
+}
+
+// setPieces replaces the pieces the peer has with those of bf, keeping the
+// swarm's availability in step
+func (c *peerConn) setPieces(bf peer.Bitfield) {
+	var old peer.Bitfield
+	if c.stats != nil {
+		old = slices.Clone(c.bitfield)
+	}
+	clear(c.bitfield)
+	copy(c.bitfield, bf)
+	c.have.Store(int32(c.bitfield.Count()))
+	if c.stats != nil {
+		c.stats.piecesChanged(c, old)
+	}
+}
+
+// idle handles messages from the peer for d while there is nothing to
+// download from it, passing requests to serve
+func (c *peerConn) idle(d time.Duration, serve func(*peer.Message) error) error {
+	timeout := c.clock.After(d)
+	for {
+		msg, err := c.receive(timeout)
+		if err == errTimeout {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if msg.Length > 0 && msg.Type == peer.MsgRequest {
+			if err := serve(msg); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.handle(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// sampleLatency folds the round trip of a block request into the peer's
+// smoothed latency, giving it the weight of an eighth as TCP does
+func (c *peerConn) sampleLatency(sample time.Duration) {
+	old := time.Duration(c.latency.Load())
+	if old > 0 {
+		sample = old + (sample-old)/8
+	}
+	c.latency.Store(int64(sample))
+}
+
+// pieceProgress tracks the blocks of one piece being downloaded
+type pieceProgress struct {
+	buf       []byte
+	received  []bool      // per block
+	pending   []bool      // per block, requested and neither received nor rejected
+	requested []time.Time // per block, when it was last requested
+	remaining int         // blocks not received yet
+	next      int         // next block to consider requesting
+	backlog   int         // requests in flight
+}
+
+// settle marks a block's request as answered, returning whether it was in
+// flight
+func (c *peerConn) settle(state *pieceProgress, block int) bool {
+	if !state.pending[block] {
+		return false
+	}
+	state.pending[block] = false
+	state.backlog--
+	c.requests.Store(int32(state.backlog))
+	return true
+}
+
+// downloadPiece requests the blocks of a piece not received yet, keeping up
+// to MaxBacklog requests in flight, and returns the assembled piece data. If
+// it fails, the blocks received are kept in pw for the next peer. Requests
+// from the peer that arrive meanwhile are passed to serve. While the peer
+// chokes us only a piece it allowed fast is requested (BEP 6), and a request
+// it rejects while letting us request returns errRejected.
+func (c *peerConn) downloadPiece(pw *pieceWork, serve func(*peer.Message) error) ([]byte, error) {
+	numBlocks := pw.numBlocks()
+	if pw.buf == nil {
+		pw.buf = pieceBuffers.get(pw.length)
+		pw.from = make([]string, numBlocks)
+	}
+	state := pieceProgress{
+		buf:       pw.buf,
+		received:  make([]bool, numBlocks),
+		pending:   make([]bool, numBlocks),
+		requested: make([]time.Time, numBlocks),
+		remaining: numBlocks,
+	}
+	// Blocks another peer sent before dropping out aren't requested again
+	for block, host := range pw.from {
+		if host != "" {
+			state.received[block] = true
+			state.remaining--
+		}
+	}
+	canRequest := func() bool {
+		return !c.choked.Load() || c.allowedFast[pw.index]
+	}
+
+	// A piece that stalls for this long is abandoned and requeued
+	deadline := c.clock.NewTimer(PieceTimeout)
+	defer deadline.Stop()
+
+	c.piece.Store(int32(pw.index))
+	defer func() {
+		c.piece.Store(-1)
+		c.requests.Store(0)
+	}()
+
+	for state.remaining > 0 {
+		// Pipeline requests while the peer lets us
+		if canRequest() {
+			for state.backlog < MaxBacklog && state.next < numBlocks {
+				block := state.next
+				state.next++
+				if state.received[block] || state.pending[block] {
+					continue
+				}
+
+				begin := block * MaxBlockSize
+				blockSize := min(MaxBlockSize, pw.length-begin)
+				msg := peer.RequestMessage(uint32(pw.index), uint32(begin), uint32(blockSize))
+				if err := c.send(msg); err != nil {
+					return nil, err
+				}
+				state.pending[block] = true
+				state.requested[block] = c.clock.Now()
+				state.backlog++
+				c.requests.Store(int32(state.backlog))
+			}
+		}
+
+		msg, err := c.receive(deadline.C())
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.Length > 0 && msg.Type == peer.MsgRequest {
+			if err := serve(msg); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if msg.Length > 0 && msg.Type == peer.MsgRejectRequest && c.fast {
+			index, begin, _, err := peer.ParseReject(msg)
+			if err != nil {
+				return nil, err
+			}
+			block := int(begin) / MaxBlockSize
+			if index != uint32(pw.index) || block >= numBlocks || !c.settle(&state, block) {
+				continue // a request given up on before
+			}
+			if canRequest() {
+				return nil, errRejected
+			}
+			// Choked: ask again once unchoked
+			state.next = min(state.next, block)
+			continue
+		}
+		if msg.Length == 0 || msg.Type != peer.MsgPiece {
+			wasChoked := c.choked.Load()
+			if err := c.handle(msg); err != nil {
+				return nil, err
+			}
+			// A choking peer discards our requests, so start over once
+			// unchoked. With the Fast extension it rejects each instead.
+			if c.choked.Load() && !wasChoked && !c.fast {
+				state.next = 0
+				state.backlog = 0
+				clear(state.pending)
+				c.requests.Store(0)
+			}
+			continue
+		}
+
+		// Blocks of another piece were requested before a choke or a timeout
+		// and are no use anymore
+		if len(msg.Payload) >= 8 && binary.BigEndian.Uint32(msg.Payload) != uint32(pw.index) {
+			continue
+		}
+		begin, data, err := peer.ParsePiece(uint32(pw.index), msg)
+		if err != nil {
+			return nil, err
+		}
+		block := int(begin) / MaxBlockSize
+		if int(begin)%MaxBlockSize != 0 || block >= numBlocks || int(begin)+len(data) > pw.length {
+			return nil, errors.New("block out of piece bounds")
+		}
+		inFlight := c.settle(&state, block)
+		if !state.received[block] {
+			copy(state.buf[begin:], data)
+			msg.Release()
+			state.received[block] = true
+			pw.from[block] = c.host()
+			state.remaining--
+			if !deadline.Stop() {
+				<-deadline.C()
+			}
+			deadline.Reset(PieceTimeout)
+			if inFlight {
+				c.sampleLatency(c.clock.Since(state.requested[block]))
+			}
+			c.downloaded.Add(int64(len(data)))
+			if c.stats != nil {
+				c.stats.Downloaded.Add(int64(len(data)))
+			}
+			if c.blockReceived != nil {
+				c.blockReceived(pw.index, int(begin), len(data))
+			}
+		}
+	}
+
+	pw.buf = nil // the hash check owns it now
+	return state.buf, nil
+}
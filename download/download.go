@@ -0,0 +1,796 @@
+// Package download implements the piece download engine: a pool of peer
+// workers pulls pieces from a shared queue, requests their blocks, verifies
+// each piece against its SHA-1 hash and hands it off to be written to disk.
+// Workers also serve the blocks we have to peers that request them.
+package download
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/clock"
+	"github.com/omkarkirpan/bittorrent-client/logging"
+	"github.com/omkarkirpan/bittorrent-client/peer"
+	"github.com/omkarkirpan/bittorrent-client/ratelimit"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+)
+
+// Engine tuning constants
+const (
+	MaxBlockSize = 16384            // Largest block size peers are expected to serve
+	MaxBacklog   = 5                // Requests kept in flight per peer
+	PieceTimeout = 30 * time.Second // Time allowed without a block of the piece being downloaded
+	MaxRequest   = 128 * 1024       // Largest block we serve; larger requests drop the peer
+)
+
+// Errors a download can fail with, for errors.Is
+var (
+	ErrNoPeers           = errors.New("no peers available")
+	ErrStorage           = errors.New("storage error")
+	ErrDiskFull          = errors.New("not enough disk space") // Also matches ErrStorage
+	ErrPieceHashMismatch = errors.New("piece hash mismatch")
+
+	errBanned = errors.New("peer is banned")
+)
+
+// IncomingConn is a handshaken connection from a peer that dialed us
+type IncomingConn struct {
+	Conn       net.Conn
+	PeerID     [20]byte // From the peer's handshake
+	Extensions bool     // Both handshakes advertised the extension protocol
+	Fast       bool     // Both handshakes advertised the Fast extension
+}
+
+// pieceWork is a piece waiting to be downloaded
+type pieceWork struct {
+	index  int
+	hash   [20]byte
+	length int
+
+	failedBy []string  // hosts whose copy failed the hash check
+	failedAt time.Time // when the last copy failed
+
+	// The blocks received so far, kept when the peer downloading the piece
+	// drops out so the next one only requests the rest, and the host that
+	// sent each block, empty until received
+	buf  []byte
+	from []string
+	// Blocks of failed copies that several peers sent blocks of, to compare
+	// with the copy that passes
+	quarantine []quarantinedBlock
+}
+
+// pieceResult is a downloaded and verified piece
+type pieceResult struct {
+	index int
+	buf   []byte
+}
+
+// Task describes a download of one torrent from a set of peers
+type Task struct {
+	Torrent  *torrent.TorrentFile
+	InfoHash [20]byte
+	PeerID   [20]byte
+	Peers    []tracker.Peer
+	Output   io.WriterAt   // Receives each verified piece; if it's also an io.ReaderAt, pieces are uploaded
+	Dial     peer.DialFunc // Opens peer connections; nil uses a plain TCP dial
+	DHTPort  uint16        // Our DHT port sent to peers in PORT messages; 0 if DHT is off
+
+	// Incoming, if set, delivers handshaken connections from peers that
+	// connected to us. Each gets a worker just like the dialed peers.
+	Incoming <-chan IncomingConn
+
+	// PeerTimeout, if set, gives up with ErrNoPeers after this long without
+	// any connected peer while waiting on Incoming
+	PeerTimeout time.Duration
+
+	// Clock, if set, times the peer timeout and stalled pieces instead of the
+	// system clock, e.g. so tests can advance time
+	Clock clock.Clock
+
+	// Priorities, if set, holds a priority per piece, e.g. from
+	// PiecePriorities. Skipped pieces aren't downloaded and high priority
+	// ones are queued first. Nil downloads every piece.
+	Priorities []Priority
+
+	// Progress, if set, is called after each piece is written with the
+	// wanted pieces done and their total
+	Progress func(done, total int)
+
+	// Stats, if set, is updated as the download runs
+	Stats *Stats
+
+	// DownloadLimit and UploadLimit, if set, throttle the piece data
+	// received and sent. They may be shared between tasks for global limits.
+	DownloadLimit *ratelimit.Limiter
+	UploadLimit   *ratelimit.Limiter
+
+	// Logger, if set, receives records about peers and pieces
+	Logger *slog.Logger
+
+	// Have, if set, marks pieces already written, which aren't downloaded
+	// again. Run marks each piece it writes, so a later Task can pick up
+	// where this one stopped.
+	Have []bool
+
+	// Written, if set, is called with the index of each piece right after
+	// it is written, e.g. to wake readers waiting for it
+	Written func(index int)
+
+	// PeerConnected and PeerDisconnected, if set, are called with a peer's
+	// address once its connection is ready and after it is dropped
+	PeerConnected    func(addr string)
+	PeerDisconnected func(addr string)
+
+	// PeerFailed, if set, is called with a peer's address when connecting
+	// to it or completing the handshake fails
+	PeerFailed func(addr string)
+
+	// BlockReceived, if set, is called from the peer's worker with every
+	// block of a piece being downloaded that arrives
+	BlockReceived func(addr string, index, begin, length int)
+
+	// PieceChecked, if set, is called from a hashing goroutine with the
+	// outcome of each piece's hash check
+	PieceChecked func(index int, ok bool)
+
+	// HashWorkers is how many pieces are hash checked at once, off the
+	// peers' connections; 0 means one per CPU
+	HashWorkers int
+
+	// WriteCache, if set, is how many bytes of verified pieces are held in
+	// memory before they're written together, in torrent order and with
+	// adjacent pieces in one write. The cache is also flushed once every
+	// wanted piece is in, every few seconds, and when Run returns. Pieces
+	// count as written, and are uploaded, only once they're on disk.
+	WriteCache int64
+
+	// Seed keeps Run serving peers after every piece is written, until ctx
+	// is cancelled. Run then returns nil.
+	Seed bool
+
+	// Complete, if set, is called once every wanted piece has been written
+	Complete func()
+
+	// ExternalIP, if set, is called from a peer's worker with the peer's IP
+	// and our IP as the peer sees it, from its extension handshake
+	ExternalIP func(peer, ip net.IP)
+
+	// PeersFound, if set, turns on peer exchange (BEP 11): it is called from
+	// a peer's worker with the peers the peer says it connected to, and
+	// connected peers are told which peers we connected to and dropped. Leave
+	// it nil for private torrents (BEP 27).
+	PeersFound func(peers []tracker.Peer)
+
+	// Holepunch, with PeersFound, turns on the holepunch extension (BEP 55)
+	// for peers behind NATs: a peer we can't connect to that a connected
+	// peer told us about is asked, through that peer, to connect to us while
+	// we connect to it. We relay the same between the peers connected to us.
+	Holepunch bool
+
+	// MorePeers, if set, delivers peers to connect to while the task runs,
+	// e.g. ones learned through peer exchange. They are dialed while
+	// MaxConns allows.
+	MorePeers <-chan tracker.Peer
+
+	// DHTNode, if set, is called from a peer's worker with the address of
+	// the DHT node the peer advertises in a PORT message (BEP 5), so it can
+	// be pinged and added to the routing table
+	DHTNode func(addr string)
+
+	// ClientPolicy, if set, decides from a peer's ID, and the client it
+	// reports in its extension handshake, whether to drop its connection or
+	// cap what we upload to it to ThrottleLimit. It is asked again whenever
+	// the peer reports its client.
+	ClientPolicy  func(peerID [20]byte, client string) peer.Action
+	ThrottleLimit *ratelimit.Limiter
+
+	// Metadata, if set, is the bencoded info dictionary served to peers
+	// fetching it with ut_metadata (BEP 9), e.g. to resolve a magnet link.
+	// Otherwise the torrent's info dictionary is served if it matches
+	// InfoHash.
+	Metadata []byte
+
+	// WebSeeds, if set, are the URLs of HTTP servers holding the content
+	// (BEP 19), such as the torrent's url-list. Pieces are fetched from them
+	// alongside the peers, with WebSeedClient or else http.DefaultClient.
+	WebSeeds      []string
+	WebSeedClient *http.Client
+
+	// BanAfter, if set, bans a peer once this many pieces it sent failed the
+	// hash check: its connections are closed and it isn't connected to
+	// again. PeerBanned, if set, is then called with the peer's IP.
+	BanAfter   int
+	PeerBanned func(ip string)
+
+	// MaxConns, if set, returns how many peer connections the task may have
+	// at once. Incoming connections beyond it are refused. It is asked again
+	// whenever a peer connects, so the cap can change while the task runs.
+	MaxConns func() int
+}
+
+// Run downloads every wanted piece and writes it to Output. It returns when the
+// download is complete, every peer has given up, or ctx is cancelled. With
+// Incoming set it keeps waiting for peers to connect instead of giving up.
+// With Seed set it carries on uploading after the download completes.
+func (t *Task) Run(ctx context.Context) error {
+	numPieces := t.Torrent.NumPieces()
+	if t.Stats == nil {
+		t.Stats = &Stats{}
+	}
+	if t.Logger == nil {
+		t.Logger = logging.Discard
+	}
+
+	if t.Have == nil {
+		t.Have = make([]bool, numPieces)
+	}
+	have := &pieceSet{have: t.Have}
+
+	info := t.Metadata
+	if info == nil {
+		if encoded, err := t.Torrent.InfoBytes(); err == nil && sha1.Sum(encoded) == t.InfoHash {
+			info = encoded
+		}
+	}
+
+	if t.Priorities != nil && len(t.Priorities) != numPieces {
+		return fmt.Errorf("got %d piece priorities for %d pieces", len(t.Priorities), numPieces)
+	}
+	priority := func(i int) Priority {
+		if t.Priorities == nil {
+			return PriorityNormal
+		}
+		return t.Priorities[i]
+	}
+
+	// Queue every wanted piece we don't have yet, high priority ones first
+	done, wanted := 0, 0
+	workQueue := make(chan *pieceWork, numPieces)
+	for _, level := range []Priority{PriorityHigh, PriorityNormal} {
+		for i := 0; i < numPieces; i++ {
+			if priority(i) != level {
+				continue
+			}
+			wanted++
+			if t.Have[i] {
+				done++
+				continue
+			}
+			hash, err := t.Torrent.PieceHash(i)
+			if err != nil {
+				return err
+			}
+			workQueue <- &pieceWork{index: i, hash: hash, length: int(t.Torrent.PieceLength(i))}
+		}
+	}
+	t.Stats.setQueue(workQueue)
+	defer t.Stats.setQueue(nil)
+
+	// Seeding only some of the pieces, we tell peers we only upload
+	// (BEP 21), so they don't wait on us for pieces we'll never have
+	var uploadOnly atomic.Bool
+	partialSeed := func() {
+		if t.Seed && wanted < numPieces {
+			uploadOnly.Store(true)
+			t.Stats.broadcastExtHandshake(true)
+		}
+	}
+
+	// What we tell each peer as its connection opens
+	connOpts := func() connOptions {
+		return connOptions{numPieces: t.Torrent.NumPieces(), bitfield: have.bitfield(), uploadOnly: uploadOnly.Load(), metadata: info, pex: t.PeersFound != nil, holepunch: t.Holepunch}
+	}
+
+	if done == wanted {
+		if t.Complete != nil {
+			t.Complete()
+		}
+		if !t.Seed {
+			return nil
+		}
+		partialSeed()
+	}
+
+	// Workers report peers leaving as they exit, so wait for them once
+	// they're cancelled, before the torrent's run is over
+	var workers sync.WaitGroup
+	defer workers.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Start one worker per peer, handing downloaded pieces to the hashers
+	results := make(chan *pieceResult)
+	hashJobs := t.startHashers(ctx, t.HashWorkers, workQueue, results)
+	exited := make(chan struct{})
+	holepunched := make(chan tracker.Peer, holepunchMaxConnects)
+	startWorker := func(addr string, connect func(log *slog.Logger) (*peerConn, error)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			log := t.Logger.With("peer", addr)
+			if c, err := connect(log); err == nil {
+				if t.PeerConnected != nil {
+					t.PeerConnected(addr)
+				}
+				if t.Holepunch {
+					c.holepunchConnect = func(p tracker.Peer) {
+						select {
+						case holepunched <- p:
+						default:
+						}
+					}
+				}
+				t.worker(ctx, log, c, have, workQueue, hashJobs)
+				if t.PeerDisconnected != nil {
+					t.PeerDisconnected(addr)
+				}
+			} else {
+				log.Debug("peer connection failed", "error", err)
+				if t.PeerFailed != nil {
+					t.PeerFailed(addr)
+				}
+			}
+			select {
+			case exited <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}()
+	}
+	dialWorker := func(p tracker.Peer) {
+		addr := p.String()
+		startWorker(addr, func(log *slog.Logger) (*peerConn, error) {
+			if t.Stats.Banned(p.IP.String()) {
+				return nil, errBanned
+			}
+			c, err := dial(ctx, t.Dial, addr, t.InfoHash, t.PeerID, connOpts(), t.DHTPort, log)
+			if errors.Is(err, peer.ErrUnreachable) && t.Holepunch && t.Stats.rendezvous(addr) {
+				log.Debug("holepunch rendezvous requested")
+			}
+			return c, err
+		})
+	}
+	for _, p := range t.Peers {
+		dialWorker(p)
+	}
+	alive := len(t.Peers)
+
+	// Web seeds work the queue alongside the peers and count as them
+	client := t.WebSeedClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	for _, u := range t.WebSeeds {
+		ws, err := newWebSeed(t.Torrent, u, client)
+		if err != nil {
+			t.Logger.Warn("web seed ignored", "error", err)
+			continue
+		}
+		alive++
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			t.webSeedWorker(ctx, t.Logger.With("web_seed", u), ws, workQueue, hashJobs)
+			select {
+			case exited <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	// Collect verified pieces, then keep seeding if asked to
+	clk := clock.Or(t.Clock)
+	morePeers := t.MorePeers
+	var pex <-chan time.Time
+	if t.PeersFound != nil {
+		ticker := clk.NewTicker(pexInterval)
+		defer ticker.Stop()
+		pex = ticker.C()
+	}
+	var idle <-chan time.Time // fires when we've been without peers too long
+
+	// Verified pieces go through the write cache, and count as done once
+	// they're on disk
+	cache := &writeCache{out: t.Output, pieceLength: t.Torrent.Info.PieceLength, budget: t.WriteCache}
+	flush := func() error {
+		return cache.flush(func(index int) {
+			have.add(index)
+			if t.Written != nil {
+				t.Written(index)
+			}
+			done++
+			if t.Progress != nil {
+				t.Progress(done, wanted)
+			}
+			t.Stats.broadcast(peer.FormatMessage(peer.MsgHave, binary.BigEndian.AppendUint32(nil, uint32(index))))
+		})
+	}
+	defer func() {
+		if err := flush(); err != nil {
+			t.Logger.Error("failed to flush the write cache", "error", err)
+		}
+	}()
+	var flushCache <-chan time.Time
+	if t.WriteCache > 0 {
+		ticker := clk.NewTicker(writeCacheAge)
+		defer ticker.Stop()
+		flushCache = ticker.C()
+	}
+	for done < wanted || t.Seed {
+		seeding := done == wanted
+		if alive == 0 && t.Incoming == nil && !seeding {
+			return fmt.Errorf("%w: all peers disconnected with %d/%d pieces done", ErrNoPeers, done, wanted)
+		}
+		if alive > 0 || seeding {
+			idle = nil
+		} else if idle == nil && t.PeerTimeout > 0 {
+			idle = clk.After(t.PeerTimeout)
+		}
+
+		select {
+		case res := <-results:
+			cache.add(res)
+			if !cache.full() && done+len(cache.pieces) < wanted {
+				continue
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+			if done == wanted {
+				if t.Complete != nil {
+					t.Complete()
+				}
+				partialSeed()
+			}
+		case in := <-t.Incoming:
+			if t.MaxConns != nil && alive >= t.MaxConns() {
+				t.Logger.Debug("incoming peer refused", "peer", in.Conn.RemoteAddr(), "error", "too many connections")
+				in.Conn.Close()
+				continue
+			}
+			alive++
+			startWorker(in.Conn.RemoteAddr().String(), func(log *slog.Logger) (*peerConn, error) {
+				if addr, ok := in.Conn.RemoteAddr().(*net.TCPAddr); ok && t.Stats.Banned(addr.IP.String()) {
+					in.Conn.Close()
+					return nil, errBanned
+				}
+				c, err := newPeerConn(ctx, in.Conn, in.PeerID, in.Extensions, in.Fast, connOpts(), log)
+				if err == nil {
+					c.incoming = true
+				}
+				return c, err
+			})
+		case p, ok := <-morePeers:
+			if !ok {
+				morePeers = nil
+				continue
+			}
+			if t.MaxConns != nil && alive >= t.MaxConns() {
+				continue
+			}
+			alive++
+			dialWorker(p)
+		case p := <-holepunched:
+			// The other peer is dialing us at the same time, so the
+			// connection opens through both NATs
+			if t.MaxConns != nil && alive >= t.MaxConns() {
+				continue
+			}
+			alive++
+			dialWorker(p)
+		case <-flushCache:
+			if err := flush(); err != nil {
+				return err
+			}
+		case <-pex:
+			t.Stats.sendPEX()
+		case <-exited:
+			alive--
+		case <-idle:
+			return fmt.Errorf("%w: no peer connected for %v with %d/%d pieces done", ErrNoPeers, t.PeerTimeout, done, wanted)
+		case <-ctx.Done():
+			if seeding {
+				return nil
+			}
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// worker downloads pieces from a single peer, passing them to be hash
+// checked, and serves its requests until the peer misbehaves, there is
+// nothing left to exchange with it, or ctx is cancelled. Pieces it fails to
+// download go back on the queue.
+func (t *Task) worker(ctx context.Context, log *slog.Logger, c *peerConn, have *pieceSet, workQueue chan *pieceWork, hashJobs chan<- *hashJob) {
+	defer c.conn.Close()
+	defer close(c.closed)
+	readCtx, cancelRead := context.WithCancel(ctx)
+	defer cancelRead()
+	go c.readMessages(readCtx, t.DownloadLimit)
+	go c.keepAlive(peer.KeepAliveInterval)
+
+	// Unblock any pending read when the download is cancelled
+	stop := context.AfterFunc(ctx, func() { c.conn.Close() })
+	defer stop()
+
+	// Count the peer, and count it as a seed once it has every piece
+	numPieces := t.Torrent.NumPieces()
+	c.numPieces = numPieces
+	c.stats = t.Stats
+	c.clock = clock.Or(t.Clock)
+	if t.BlockReceived != nil {
+		addr := c.conn.RemoteAddr().String()
+		c.blockReceived = func(index, begin, length int) {
+			t.BlockReceived(addr, index, begin, length)
+		}
+	}
+	if t.ExternalIP != nil {
+		remote := c.remoteIP()
+		c.yourIPReported = func(ip net.IP) {
+			t.ExternalIP(remote, ip)
+		}
+		if c.yourIP != nil {
+			c.yourIPReported(c.yourIP)
+		}
+	}
+	if t.PeersFound != nil {
+		c.pexReceived = t.PeersFound
+	}
+	if t.DHTNode != nil {
+		c.portReported = func(port uint16) {
+			t.DHTNode(net.JoinHostPort(c.remoteIP().String(), strconv.Itoa(int(port))))
+		}
+		if c.dhtPort != 0 {
+			c.portReported(c.dhtPort)
+		}
+	}
+	if t.ClientPolicy != nil {
+		c.clientReported = func(client string) error {
+			switch t.ClientPolicy(c.peerID, client) {
+			case peer.Refuse:
+				return errRefusedClient
+			case peer.Throttle:
+				c.throttled.Store(true)
+			default:
+				c.throttled.Store(false)
+			}
+			return nil
+		}
+		var client string
+		if v := c.client.Load(); v != nil {
+			client = *v
+		}
+		if err := c.clientReported(client); err != nil {
+			log.Debug("peer dropped", "error", err)
+			return
+		}
+	}
+	if drop := t.Stats.addUnique(c, t.PeerID); drop == c {
+		log.Debug("peer dropped", "error", "already connected")
+		return
+	} else if drop != nil {
+		drop.conn.Close()
+	}
+	defer t.Stats.removePeer(c)
+	checkSeed := func() {
+		if !c.seed.Load() && c.bitfield.Complete(numPieces) {
+			c.seed.Store(true)
+			t.Stats.Seeds.Add(1)
+		}
+	}
+	checkSeed()
+	log.Debug("peer connected", "seed", c.seed.Load())
+
+	serve := func(msg *peer.Message) error {
+		return t.serve(c, have, msg)
+	}
+	go t.upload(readCtx, log, c)
+
+	c.send(peer.FormatMessage(peer.MsgUnchoke, nil))
+	c.send(peer.FormatMessage(peer.MsgInterested, nil))
+
+	skipped := 0
+	for {
+		var pw *pieceWork
+		select {
+		case pw = <-workQueue:
+		case <-ctx.Done():
+			return
+		default:
+			// Nothing queued: answer the peer's requests while waiting for
+			// failed pieces to come back. Two seeds have nothing to swap.
+			if c.seed.Load() && have.complete() {
+				log.Debug("peer dropped", "error", "both sides are seeds")
+				return
+			}
+			if err := c.idle(time.Second, serve); err != nil {
+				log.Debug("peer dropped", "error", err)
+				return
+			}
+			checkSeed()
+			continue
+		}
+
+		// Leave pieces this peer doesn't have to other workers, and pieces
+		// it sent corrupt to other peers for a while
+		if !c.bitfield.HasPiece(pw.index) || (t.Stats.Peers.Load() > 1 && pw.avoid(c.host(), c.clock.Now())) {
+			workQueue <- pw
+			skipped++
+			if skipped >= cap(workQueue) {
+				// Nothing we can get from this peer right now
+				skipped = 0
+				if err := c.idle(time.Second, serve); err != nil {
+					log.Debug("peer dropped", "error", err)
+					return
+				}
+				checkSeed()
+			}
+			continue
+		}
+		skipped = 0
+
+		buf, err := c.downloadPiece(pw, serve)
+		checkSeed()
+		if errors.Is(err, errRejected) {
+			// The peer won't serve the piece for now: leave it to others
+			// for a while
+			workQueue <- pw
+			log.Debug("piece rejected", "piece", pw.index)
+			if err := c.idle(time.Second, serve); err != nil {
+				log.Debug("peer dropped", "error", err)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			workQueue <- pw
+			log.Debug("peer dropped", "piece", pw.index, "error", err)
+			return
+		}
+
+		select {
+		case hashJobs <- &hashJob{pw: pw, buf: buf, peer: c, log: log}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serve queues a block request from the peer for upload to send. Requests
+// for pieces we don't have, when Output can't be read back, or beyond the
+// peer's queue are ignored, or rejected if the peer supports the Fast
+// extension.
+func (t *Task) serve(c *peerConn, have *pieceSet, msg *peer.Message) error {
+	index, begin, length, err := peer.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	_, ok := t.Output.(io.ReaderAt)
+	ok = ok && have.has(int(index))
+	if ok {
+		if length > MaxRequest || int64(begin)+int64(length) > t.Torrent.PieceLength(int(index)) {
+			return fmt.Errorf("invalid request for %d bytes at %d in piece %d", length, begin, index)
+		}
+		ok = c.uploads.Push(peer.Request{Index: index, Begin: begin, Length: length})
+	}
+	if !ok && c.fast {
+		return c.send(peer.RejectMessage(index, begin, length))
+	}
+	return nil
+}
+
+// upload sends the peer the blocks it has queued with serve, one at a time,
+// until ctx is cancelled. Requests the peer cancels first are never read
+// from Output. If sending fails the connection is closed, so the worker
+// drops the peer.
+func (t *Task) upload(ctx context.Context, log *slog.Logger, c *peerConn) {
+	reader, ok := t.Output.(io.ReaderAt)
+	if !ok {
+		return
+	}
+	for {
+		r, err := c.uploads.Pop(ctx)
+		if err != nil {
+			return
+		}
+		if err := t.sendBlock(ctx, c, reader, r); err != nil {
+			if ctx.Err() == nil {
+				log.Debug("upload failed", "piece", r.Index, "error", err)
+				c.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// sendBlock reads a requested block from reader and sends it to the peer
+// once UploadLimit, and ThrottleLimit for throttled peers, allow
+func (t *Task) sendBlock(ctx context.Context, c *peerConn, reader io.ReaderAt, r peer.Request) error {
+	block := blockBuffers.get(int(r.Length))
+	defer blockBuffers.put(block)
+	offset := int64(r.Index)*t.Torrent.Info.PieceLength + int64(r.Begin)
+	if _, err := reader.ReadAt(block, offset); err != nil {
+		return fmt.Errorf("%w: failed to read piece %d: %v", ErrStorage, r.Index, err)
+	}
+	if err := t.UploadLimit.Wait(ctx, len(block)); err != nil {
+		return err
+	}
+	if c.throttled.Load() {
+		if err := t.ThrottleLimit.Wait(ctx, len(block)); err != nil {
+			return err
+		}
+	}
+	if err := c.send(peer.PieceMessage(r.Index, r.Begin, block)); err != nil {
+		return err
+	}
+	c.uploaded.Add(int64(r.Length))
+	t.Stats.Uploaded.Add(int64(r.Length))
+	return nil
+}
+
+// pieceSet is the set of pieces written so far, shared by Run and the workers
+type pieceSet struct {
+	mu   sync.RWMutex
+	have []bool
+}
+
+// has reports whether a piece has been written
+func (ps *pieceSet) has(index int) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return index >= 0 && index < len(ps.have) && ps.have[index]
+}
+
+// add marks a piece as written
+func (ps *pieceSet) add(index int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.have[index] = true
+}
+
+// complete reports whether every piece has been written
+func (ps *pieceSet) complete() bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	for _, have := range ps.have {
+		if !have {
+			return false
+		}
+	}
+	return true
+}
+
+// bitfield returns the pieces written as a BITFIELD payload
+func (ps *pieceSet) bitfield() peer.Bitfield {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	bf := peer.NewBitfield(len(ps.have))
+	for i, have := range ps.have {
+		if have {
+			bf.SetPiece(i)
+		}
+	}
+	return bf
+}
+
+// checkPiece returns an ErrPieceHashMismatch error unless buf hashes to hash
+func checkPiece(index int, buf []byte, hash [20]byte) error {
+	if sha1.Sum(buf) != hash {
+		return fmt.Errorf("%w: piece %d", ErrPieceHashMismatch, index)
+	}
+	return nil
+}
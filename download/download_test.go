@@ -0,0 +1,2192 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/clock"
+	"github.com/omkarkirpan/bittorrent-client/logging"
+	"github.com/omkarkirpan/bittorrent-client/metadata"
+	"github.com/omkarkirpan/bittorrent-client/peer"
+	"github.com/omkarkirpan/bittorrent-client/peer/peertest"
+	"github.com/omkarkirpan/bittorrent-client/ratelimit"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+)
+
+// makeTorrent builds a single-file torrent describing data
+func makeTorrent(data []byte, pieceLength int) *torrent.TorrentFile {
+	var pieces []byte
+	for i := 0; i < len(data); i += pieceLength {
+		hash := sha1.Sum(data[i:min(i+pieceLength, len(data))])
+		pieces = append(pieces, hash[:]...)
+	}
+	return &torrent.TorrentFile{
+		Info: torrent.TorrentInfo{
+			Name:        "test.bin",
+			PieceLength: int64(pieceLength),
+			Pieces:      string(pieces),
+			Length:      int64(len(data)),
+		},
+	}
+}
+
+// startSeeder runs a minimal seeding peer on localhost that serves data
+func startSeeder(t *testing.T, infoHash [20]byte, data []byte, tf *torrent.TorrentFile) tracker.Peer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, infoHash, data, tf.NumPieces(), int(tf.Info.PieceLength))
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return tracker.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func serveConn(conn net.Conn, infoHash [20]byte, data []byte, numPieces, pieceLength int) {
+	defer conn.Close()
+
+	if _, err := peer.ParseHandshake(conn); err != nil {
+		return
+	}
+	conn.Write(peer.NewHandshake(infoHash, [20]byte{'s'}).Serialize())
+
+	// Advertise every piece
+	bitfield := peer.NewBitfield(numPieces)
+	for i := 0; i < numPieces; i++ {
+		bitfield.SetPiece(i)
+	}
+	conn.Write(bitfield.Message().Serialize())
+
+	for {
+		msg, err := peer.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		switch msg.Type {
+		case peer.MsgInterested:
+			conn.Write(peer.FormatMessage(peer.MsgUnchoke, nil).Serialize())
+		case peer.MsgRequest:
+			index := binary.BigEndian.Uint32(msg.Payload[0:4])
+			begin := binary.BigEndian.Uint32(msg.Payload[4:8])
+			length := binary.BigEndian.Uint32(msg.Payload[8:12])
+
+			start := int(index)*pieceLength + int(begin)
+			payload := make([]byte, 8, 8+length)
+			copy(payload, msg.Payload[0:8])
+			payload = append(payload, data[start:start+int(length)]...)
+			conn.Write(peer.FormatMessage(peer.MsgPiece, payload).Serialize())
+		}
+	}
+}
+
+// memoryWriter collects WriteAt calls into a buffer and reads them back
+type memoryWriter struct {
+	buf []byte
+}
+
+func (m *memoryWriter) WriteAt(p []byte, off int64) (int, error) {
+	return copy(m.buf[off:], p), nil
+}
+
+func (m *memoryWriter) ReadAt(p []byte, off int64) (int, error) {
+	return copy(p, m.buf[off:]), nil
+}
+
+func TestTaskRun(t *testing.T) {
+	const pieceLength = 32768
+	data := make([]byte, pieceLength*3+1000) // short last piece
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	tf := makeTorrent(data, pieceLength)
+	infoHash := [20]byte{1, 2, 3}
+	seeder := startSeeder(t, infoHash, data, tf)
+
+	out := &memoryWriter{buf: make([]byte, len(data))}
+	var progress, queued []int
+	var peers [][]PeerInfo
+	stats := &Stats{}
+	task := &Task{
+		Torrent:  tf,
+		InfoHash: infoHash,
+		PeerID:   [20]byte{'l'},
+		Peers:    []tracker.Peer{seeder},
+		Output:   out,
+		Progress: func(done, total int) {
+			progress = append(progress, done)
+			queued = append(queued, stats.Queued())
+			peers = append(peers, stats.PeerList())
+		},
+		Stats: stats,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := task.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if !bytes.Equal(out.buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+	if len(progress) != tf.NumPieces() {
+		t.Errorf("Expected %d progress callbacks, got %d", tf.NumPieces(), len(progress))
+	}
+	if got := task.Stats.Downloaded.Load(); got != int64(len(data)) {
+		t.Errorf("Expected %d bytes downloaded, got %d", len(data), got)
+	}
+	if got := task.Stats.Verified.Load(); got != int64(tf.NumPieces()) {
+		t.Errorf("Expected %d pieces verified, got %d", tf.NumPieces(), got)
+	}
+
+	// The only peer hands out pieces in order, so the queue drains one by one
+	for i, n := range queued {
+		if want := tf.NumPieces() - i - 2; n > max(want, 0) {
+			t.Errorf("Expected at most %d queued pieces after %d done, got %d", max(want, 0), i+1, n)
+		}
+	}
+	if len(peers) == 0 || len(peers[0]) != 1 || peers[0][0].Choked {
+		t.Fatalf("Expected one unchoking peer while downloading, got %+v", peers)
+	}
+	if p := peers[0][0]; p.Progress != 1 || p.Incoming || p.PeerID != [20]byte{'s'} {
+		t.Errorf("Expected an outgoing connection to peer s with every piece, got %+v", p)
+	}
+	if p := peers[0][0]; p.Latency <= 0 {
+		t.Errorf("Expected the peer's request latency to be measured, got %v", p.Latency)
+	}
+	if stats.Queued() != 0 {
+		t.Errorf("Expected an empty queue after Run, got %d", stats.Queued())
+	}
+}
+
+func TestSampleLatency(t *testing.T) {
+	c := &peerConn{}
+	c.sampleLatency(80 * time.Millisecond)
+	if got := time.Duration(c.latency.Load()); got != 80*time.Millisecond {
+		t.Errorf("Expected the first sample to be taken as is, got %v", got)
+	}
+	c.sampleLatency(160 * time.Millisecond)
+	if got := time.Duration(c.latency.Load()); got != 90*time.Millisecond {
+		t.Errorf("Expected 90ms after a sample of 160ms, got %v", got)
+	}
+}
+
+func TestStatsPrioritize(t *testing.T) {
+	queue := make(chan *pieceWork, 6)
+	for i := 0; i < 5; i++ {
+		queue <- &pieceWork{index: i}
+	}
+	stats := &Stats{}
+	stats.Prioritize([]int{3}) // no running task
+	stats.setQueue(queue)
+
+	// Piece 7 isn't queued, e.g. it is being downloaded
+	stats.Prioritize([]int{3, 7, 1, 3})
+	var order []int
+	for len(queue) > 0 {
+		order = append(order, (<-queue).index)
+	}
+	if expected := []int{3, 1, 0, 2, 4}; !slices.Equal(order, expected) {
+		t.Errorf("Expected queue %v, got %v", expected, order)
+	}
+}
+
+func TestTaskRunHashers(t *testing.T) {
+	const pieceLength = 16384
+	data := make([]byte, pieceLength*4)
+	for i := range data {
+		data[i] = byte(i * 3)
+	}
+	tf := makeTorrent(data, pieceLength)
+	infoHash := [20]byte{2, 3, 4}
+	seeder := startSeeder(t, infoHash, data, tf)
+
+	// The first hash check stalls until every block has arrived, which only
+	// happens if checks don't hold up the peer
+	var blocks atomic.Int32
+	allBlocks := make(chan struct{})
+	var stalled atomic.Bool
+	task := &Task{
+		Torrent:     tf,
+		InfoHash:    infoHash,
+		Peers:       []tracker.Peer{seeder},
+		Output:      &memoryWriter{buf: make([]byte, len(data))},
+		HashWorkers: 1,
+		BlockReceived: func(addr string, index, begin, length int) {
+			if blocks.Add(1) == int32(tf.NumPieces()) {
+				close(allBlocks)
+			}
+		},
+		PieceChecked: func(index int, ok bool) {
+			if stalled.CompareAndSwap(false, true) {
+				select {
+				case <-allBlocks:
+				case <-time.After(5 * time.Second):
+					t.Error("Expected the download to go on while a piece was hashed")
+				}
+			}
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := task.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got := task.Stats.Verified.Load(); got != int64(tf.NumPieces()) {
+		t.Errorf("Expected %d pieces verified, got %d", tf.NumPieces(), got)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	var pool bufferPool
+	buf := pool.get(100)
+	if len(buf) != 100 {
+		t.Fatalf("Expected 100 bytes, got %d", len(buf))
+	}
+
+	// A released buffer serves smaller requests but not larger ones. Only
+	// put allocates, for the slice header.
+	pool.put(buf)
+	if allocs := testing.AllocsPerRun(100, func() { pool.put(pool.get(50)) }); allocs >= 2 {
+		t.Errorf("Expected reused buffers, got %.1f allocations", allocs)
+	}
+	if got := pool.get(200); len(got) != 200 {
+		t.Errorf("Expected 200 bytes, got %d", len(got))
+	}
+}
+
+// writeRecorder records the writes it gets
+type writeRecorder struct {
+	memoryWriter
+	writes [][2]int64 // Offset and length of each write
+}
+
+func (w *writeRecorder) WriteAt(p []byte, off int64) (int, error) {
+	w.writes = append(w.writes, [2]int64{off, int64(len(p))})
+	return w.memoryWriter.WriteAt(p, off)
+}
+
+func TestWriteCache(t *testing.T) {
+	out := &writeRecorder{memoryWriter: memoryWriter{buf: make([]byte, 40)}}
+	cache := &writeCache{out: out, pieceLength: 10, budget: 30}
+	for _, index := range []int{3, 0, 1} {
+		cache.add(&pieceResult{index: index, buf: bytes.Repeat([]byte{byte('a' + index)}, 10)})
+	}
+	if !cache.full() {
+		t.Errorf("Expected the cache to be full with %d bytes", cache.size)
+	}
+
+	// Pieces are written in order, adjacent ones together
+	var written []int
+	if err := cache.flush(func(index int) { written = append(written, index) }); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if want := []int{0, 1, 3}; !reflect.DeepEqual(written, want) {
+		t.Errorf("Expected pieces %v written, got %v", want, written)
+	}
+	if want := [][2]int64{{0, 20}, {30, 10}}; !reflect.DeepEqual(out.writes, want) {
+		t.Errorf("Expected writes %v, got %v", want, out.writes)
+	}
+	if want := "aaaaaaaaaabbbbbbbbbb\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00dddddddddd"; string(out.buf) != want {
+		t.Errorf("Expected %q on disk, got %q", want, out.buf)
+	}
+	if cache.full() || cache.size != 0 {
+		t.Errorf("Expected an empty cache, got %d bytes", cache.size)
+	}
+}
+
+func TestTaskRunWriteCache(t *testing.T) {
+	const pieceLength = 16384
+	data := make([]byte, pieceLength*4+100)
+	for i := range data {
+		data[i] = byte(i * 5)
+	}
+	tf := makeTorrent(data, pieceLength)
+	infoHash := [20]byte{3, 4, 5}
+	seeder := startSeeder(t, infoHash, data, tf)
+
+	// The whole torrent fits the cache, so it's written at once on completion
+	out := &writeRecorder{memoryWriter: memoryWriter{buf: make([]byte, len(data))}}
+	var written []int
+	task := &Task{
+		Torrent:    tf,
+		InfoHash:   infoHash,
+		Peers:      []tracker.Peer{seeder},
+		Output:     out,
+		WriteCache: 1 << 20,
+		Written:    func(index int) { written = append(written, index) },
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := task.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if !bytes.Equal(out.buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+	if want := [][2]int64{{0, int64(len(data))}}; !reflect.DeepEqual(out.writes, want) {
+		t.Errorf("Expected writes %v, got %v", want, out.writes)
+	}
+	if want := []int{0, 1, 2, 3, 4}; !reflect.DeepEqual(written, want) {
+		t.Errorf("Expected pieces %v written, got %v", want, written)
+	}
+}
+
+func TestCheckPiece(t *testing.T) {
+	buf := []byte("piece data")
+	if err := checkPiece(3, buf, sha1.Sum(buf)); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if err := checkPiece(3, buf, [20]byte{}); !errors.Is(err, ErrPieceHashMismatch) {
+		t.Errorf("Expected ErrPieceHashMismatch, got %v", err)
+	}
+}
+
+func TestTaskRunHave(t *testing.T) {
+	const pieceLength = 32768
+	data := make([]byte, pieceLength*3)
+	for i := range data {
+		data[i] = byte(i * 3)
+	}
+
+	tf := makeTorrent(data, pieceLength)
+	infoHash := [20]byte{4, 5, 6}
+	seeder := startSeeder(t, infoHash, data, tf)
+
+	// Only the middle piece is missing
+	out := &memoryWriter{buf: make([]byte, len(data))}
+	task := &Task{
+		Torrent:  tf,
+		InfoHash: infoHash,
+		PeerID:   [20]byte{'l'},
+		Peers:    []tracker.Peer{seeder},
+		Output:   out,
+		Have:     []bool{true, false, true},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := task.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if !bytes.Equal(out.buf[pieceLength:2*pieceLength], data[pieceLength:2*pieceLength]) {
+		t.Error("Missing piece does not match")
+	}
+	if !bytes.Equal(out.buf[:pieceLength], make([]byte, pieceLength)) {
+		t.Error("Expected pieces we have not to be downloaded again")
+	}
+	if !task.Have[1] {
+		t.Error("Expected downloaded piece to be marked")
+	}
+}
+
+func TestTaskRunPriorities(t *testing.T) {
+	const pieceLength = 32768
+	data := make([]byte, pieceLength*3)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	tf := makeTorrent(data, pieceLength)
+	infoHash := [20]byte{4, 5, 7}
+	seeder := startSeeder(t, infoHash, data, tf)
+
+	out := &memoryWriter{buf: make([]byte, len(data))}
+	var progress [][2]int
+	task := &Task{
+		Torrent:    tf,
+		InfoHash:   infoHash,
+		PeerID:     [20]byte{'l'},
+		Peers:      []tracker.Peer{seeder},
+		Output:     out,
+		Priorities: []Priority{PriorityNormal, PrioritySkip, PriorityHigh},
+		Progress:   func(done, total int) { progress = append(progress, [2]int{done, total}) },
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := task.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if !task.Have[0] || task.Have[1] || !task.Have[2] {
+		t.Errorf("Expected pieces 0 and 2 only, got %v", task.Have)
+	}
+	if !bytes.Equal(out.buf[pieceLength:2*pieceLength], make([]byte, pieceLength)) {
+		t.Error("Expected skipped piece not to be downloaded")
+	}
+	expected := [][2]int{{1, 2}, {2, 2}}
+	if !slices.Equal(progress, expected) {
+		t.Errorf("Expected progress %v, got %v", expected, progress)
+	}
+}
+
+func TestTaskRunDownloadLimit(t *testing.T) {
+	const pieceLength = 32768
+	data := make([]byte, pieceLength*4)
+	for i := range data {
+		data[i] = byte(i * 5)
+	}
+
+	tf := makeTorrent(data, pieceLength)
+	infoHash := [20]byte{4, 5, 8}
+	seeder := startSeeder(t, infoHash, data, tf)
+
+	// One second's burst of 64 KiB, then 64 KiB more take a second
+	out := &memoryWriter{buf: make([]byte, len(data))}
+	task := &Task{
+		Torrent:       tf,
+		InfoHash:      infoHash,
+		PeerID:        [20]byte{'l'},
+		Peers:         []tracker.Peer{seeder},
+		Output:        out,
+		DownloadLimit: ratelimit.New(2 * pieceLength),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := task.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("Expected the limit to slow the download to about 1s, took %v", elapsed)
+	}
+	if !bytes.Equal(out.buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+}
+
+func TestPiecePriorities(t *testing.T) {
+	// Pieces of 10 bytes over files of 5, 20, 0 and 15 bytes:
+	// piece 0 covers a and b, 1 covers b, 2 covers b and d, 3 covers d
+	tf := &torrent.TorrentFile{
+		Info: torrent.TorrentInfo{
+			Name:        "multi",
+			PieceLength: 10,
+			Pieces:      string(make([]byte, 4*20)),
+			Files: []torrent.FileInfo{
+				{Length: 5, Path: []string{"a"}},
+				{Length: 20, Path: []string{"b"}},
+				{Length: 0, Path: []string{"c"}},
+				{Length: 15, Path: []string{"d"}},
+			},
+		},
+	}
+
+	tests := []struct {
+		files    []Priority
+		expected []Priority
+	}{
+		{
+			[]Priority{PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal},
+			[]Priority{PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal},
+		},
+		{
+			[]Priority{PrioritySkip, PrioritySkip, PriorityNormal, PriorityNormal},
+			[]Priority{PrioritySkip, PrioritySkip, PriorityNormal, PriorityNormal},
+		},
+		{
+			[]Priority{PriorityHigh, PrioritySkip, PrioritySkip, PrioritySkip},
+			[]Priority{PriorityHigh, PrioritySkip, PrioritySkip, PrioritySkip},
+		},
+		{
+			[]Priority{PrioritySkip, PriorityHigh, PrioritySkip, PriorityNormal},
+			[]Priority{PriorityHigh, PriorityHigh, PriorityHigh, PriorityNormal},
+		},
+	}
+	for _, tt := range tests {
+		got, err := PiecePriorities(tf, tt.files)
+		if err != nil {
+			t.Fatalf("PiecePriorities failed: %v", err)
+		}
+		if !slices.Equal(got, tt.expected) {
+			t.Errorf("Files %v: expected %v, got %v", tt.files, tt.expected, got)
+		}
+	}
+
+	if _, err := PiecePriorities(tf, []Priority{PriorityNormal}); err == nil {
+		t.Error("Expected error for the wrong number of priorities")
+	}
+}
+
+func TestPrioritizeFileEdges(t *testing.T) {
+	// Pieces of 10 bytes over files of 5, 40 and 25 bytes: a is in piece 0,
+	// b in pieces 0-4 and c in pieces 4-6
+	tf := &torrent.TorrentFile{
+		Info: torrent.TorrentInfo{
+			Name:        "multi",
+			PieceLength: 10,
+			Pieces:      string(make([]byte, 7*20)),
+			Files: []torrent.FileInfo{
+				{Length: 5, Path: []string{"a"}},
+				{Length: 40, Path: []string{"b"}},
+				{Length: 25, Path: []string{"c"}},
+			},
+		},
+	}
+	N, H, S := PriorityNormal, PriorityHigh, PrioritySkip
+
+	pieces := make([]Priority, 7)
+	PrioritizeFileEdges(tf, nil, pieces)
+	if expected := []Priority{H, N, N, N, H, N, H}; !slices.Equal(pieces, expected) {
+		t.Errorf("Every file wanted: expected %v, got %v", expected, pieces)
+	}
+
+	files := []Priority{N, S, N}
+	pieces, err := PiecePriorities(tf, files)
+	if err != nil {
+		t.Fatalf("PiecePriorities failed: %v", err)
+	}
+	PrioritizeFileEdges(tf, files, pieces)
+	if expected := []Priority{H, S, S, S, H, N, H}; !slices.Equal(pieces, expected) {
+		t.Errorf("b skipped: expected %v, got %v", expected, pieces)
+	}
+}
+
+func TestTaskRunSeed(t *testing.T) {
+	const pieceLength = 32768
+	data := make([]byte, pieceLength*2+500)
+	for i := range data {
+		data[i] = byte(i * 5)
+	}
+	tf := makeTorrent(data, pieceLength)
+	infoHash := [20]byte{7, 8, 9}
+
+	// The seeding task already has every piece and takes incoming peers
+	incoming := make(chan IncomingConn)
+	completed := 0
+	seeder := &Task{
+		Torrent:  tf,
+		InfoHash: infoHash,
+		PeerID:   [20]byte{'s'},
+		Output:   &memoryWriter{buf: bytes.Clone(data)},
+		Incoming: incoming,
+		Have:     []bool{true, true, true},
+		Seed:     true,
+		Complete: func() { completed++ },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	seeded := make(chan error, 1)
+	go func() { seeded <- seeder.Run(ctx) }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if _, err := peer.ParseHandshake(conn); err != nil {
+			conn.Close()
+			return
+		}
+		conn.Write(peer.NewHandshake(infoHash, [20]byte{'s'}).Serialize())
+		incoming <- IncomingConn{Conn: conn, PeerID: [20]byte{'l'}}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	out := &memoryWriter{buf: make([]byte, len(data))}
+	leecher := &Task{
+		Torrent:  tf,
+		InfoHash: infoHash,
+		PeerID:   [20]byte{'l'},
+		Peers:    []tracker.Peer{{IP: addr.IP, Port: uint16(addr.Port)}},
+		Output:   out,
+	}
+	leechCtx, leechCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer leechCancel()
+	if err := leecher.Run(leechCtx); err != nil {
+		t.Fatalf("Leecher Run failed: %v", err)
+	}
+	if !bytes.Equal(out.buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+	// The seeder counts a block once it has been sent, which may be just
+	// after the leecher received it
+	for deadline := time.Now().Add(2 * time.Second); seeder.Stats.Uploaded.Load() < int64(len(data)) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := seeder.Stats.Uploaded.Load(); got != int64(len(data)) {
+		t.Errorf("Expected %d bytes uploaded, got %d", len(data), got)
+	}
+
+	// Seeding goes on until the context is cancelled
+	select {
+	case err := <-seeded:
+		t.Fatalf("Expected seeding to continue, Run returned %v", err)
+	default:
+	}
+	cancel()
+	if err := <-seeded; err != nil {
+		t.Errorf("Expected nil error after seeding, got %v", err)
+	}
+	if completed != 1 {
+		t.Errorf("Expected Complete to be called once, got %d", completed)
+	}
+}
+
+func TestTaskRunServeMetadata(t *testing.T) {
+	data := make([]byte, 40000)
+	tf := makeTorrent(data, 16384)
+	info, err := tf.InfoBytes()
+	if err != nil {
+		t.Fatalf("InfoBytes failed: %v", err)
+	}
+	infoHash := sha1.Sum(info)
+
+	// A seeding task takes the connection of a peer resolving a magnet link
+	incoming := make(chan IncomingConn)
+	seeder := &Task{
+		Torrent:  tf,
+		InfoHash: infoHash,
+		PeerID:   [20]byte{'s'},
+		Output:   &memoryWriter{buf: bytes.Clone(data)},
+		Incoming: incoming,
+		Have:     []bool{true, true, true},
+		Seed:     true,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	seeded := make(chan error, 1)
+	go func() { seeded <- seeder.Run(ctx) }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		hs, err := peer.ParseHandshake(conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		ours := peer.NewHandshake(infoHash, [20]byte{'s'})
+		ours.SetExtension(peer.ExtensionExtensions)
+		conn.Write(ours.Serialize())
+		incoming <- IncomingConn{Conn: conn, PeerID: hs.PeerID, Extensions: hs.HasExtension(peer.ExtensionExtensions)}
+	}()
+
+	got, err := metadata.Fetch(ctx, ln.Addr().String(), infoHash, [20]byte{'m'})
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if !bytes.Equal(got, info) {
+		t.Errorf("Expected the %d byte info dictionary, got %d bytes", len(info), len(got))
+	}
+	cancel()
+	<-seeded
+}
+
+func TestTaskRunNoPeers(t *testing.T) {
+	tf := makeTorrent(make([]byte, 100), 64)
+	task := &Task{
+		Torrent: tf,
+		Peers:   []tracker.Peer{{IP: net.IPv4(127, 0, 0, 1), Port: 1}},
+		Output:  &memoryWriter{buf: make([]byte, 100)},
+	}
+
+	if err := task.Run(context.Background()); err == nil {
+		t.Error("Expected error when no peer can be reached")
+	}
+}
+
+func TestTaskRunMockPeer(t *testing.T) {
+	const pieceLength = 32768
+	data := make([]byte, pieceLength*3+500)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	tf := makeTorrent(data, pieceLength)
+	infoHash := [20]byte{4, 5, 6}
+	unchoke := peertest.Send(peer.FormatMessage(peer.MsgUnchoke, nil))
+
+	// Corrupts the first block it sends of piece 1
+	var corrupted atomic.Bool
+	corruptOnce := func(index int, block []byte) {
+		if index == 1 && corrupted.CompareAndSwap(false, true) {
+			block[0] ^= 0xff
+		}
+	}
+	bitfield := peer.FormatMessage(peer.MsgBitfield, []byte{0xf0}).Serialize()
+
+	// Fast extension peers (BEP 6) claim the bit in their handshake
+	var fast [8]byte
+	fast[7] = 0x04
+	haveAll := peertest.Send(peer.FormatMessage(peer.MsgHaveAll, nil))
+	// Chokes us with two requests in flight and rejects both
+	chokeAndReject := func(c *peertest.Conn) error {
+		if err := c.Send(peer.FormatMessage(peer.MsgChoke, nil)); err != nil {
+			return err
+		}
+		for rejected := 0; rejected < 2; {
+			msg, err := c.Receive()
+			if err != nil {
+				return err
+			}
+			if msg.Length == 0 || msg.Type != peer.MsgRequest {
+				continue
+			}
+			index, begin, length, _ := peer.ParseRequest(msg)
+			if err := c.Send(peer.RejectMessage(index, begin, length)); err != nil {
+				return err
+			}
+			rejected++
+		}
+		return nil
+	}
+	// Rejects the first request without choking
+	rejectOnce := func(c *peertest.Conn) error {
+		for {
+			msg, err := c.Receive()
+			if err != nil {
+				return err
+			}
+			if msg.Length > 0 && msg.Type == peer.MsgRequest {
+				index, begin, length, _ := peer.ParseRequest(msg)
+				return c.Send(peer.RejectMessage(index, begin, length))
+			}
+		}
+	}
+	var allowed []*peer.Message
+	for i := 0; i < tf.NumPieces(); i++ {
+		allowed = append(allowed, peer.AllowedFastMessage(uint32(i)))
+	}
+
+	tests := []struct {
+		name         string
+		reserved     [8]byte
+		script       []peertest.Step
+		hashFailures int64
+	}{
+		{
+			name:   "well behaved",
+			script: []peertest.Step{peertest.Bitfield(tf.NumPieces()), peertest.Expect(peer.MsgInterested), unchoke, peertest.ServeRequests(data, pieceLength, 0, nil)},
+		},
+		{
+			name:         "corrupt piece",
+			script:       []peertest.Step{peertest.Bitfield(tf.NumPieces()), peertest.Expect(peer.MsgInterested), unchoke, peertest.ServeRequests(data, pieceLength, 0, corruptOnce)},
+			hashFailures: 1,
+		},
+		{
+			name:   "slow bitfield",
+			script: []peertest.Step{peertest.Drip(bitfield, 1, 10*time.Millisecond), peertest.Expect(peer.MsgInterested), unchoke, peertest.ServeRequests(data, pieceLength, 0, nil)},
+		},
+		{
+			name: "chokes before serving",
+			script: []peertest.Step{
+				peertest.Bitfield(tf.NumPieces()), peertest.Expect(peer.MsgInterested),
+				unchoke, peertest.Send(peer.FormatMessage(peer.MsgChoke, nil)), peertest.Sleep(50 * time.Millisecond),
+				unchoke, peertest.ServeRequests(data, pieceLength, 0, nil),
+			},
+		},
+		{
+			name:     "fast extension",
+			reserved: fast,
+			script:   []peertest.Step{haveAll, peertest.Expect(peer.MsgInterested), unchoke, peertest.ServeRequests(data, pieceLength, 0, nil)},
+		},
+		{
+			name:     "rejects while choking",
+			reserved: fast,
+			script: []peertest.Step{
+				haveAll, peertest.Expect(peer.MsgInterested), unchoke, chokeAndReject, peertest.Sleep(50 * time.Millisecond),
+				unchoke, peertest.ServeRequests(data, pieceLength, 0, nil),
+			},
+		},
+		{
+			name:     "rejects a piece",
+			reserved: fast,
+			script:   []peertest.Step{haveAll, peertest.Expect(peer.MsgInterested), unchoke, rejectOnce, peertest.ServeRequests(data, pieceLength, 0, nil)},
+		},
+		{
+			name:     "requests a piece we lack",
+			reserved: fast,
+			script: []peertest.Step{
+				haveAll, peertest.Expect(peer.MsgInterested), peertest.Send(peer.RequestMessage(0, 0, 16384)), peertest.Expect(peer.MsgRejectRequest),
+				unchoke, peertest.ServeRequests(data, pieceLength, 0, nil),
+			},
+		},
+		{
+			name:     "allowed fast while choking",
+			reserved: fast,
+			script:   []peertest.Step{haveAll, peertest.Send(allowed...), peertest.ServeRequests(data, pieceLength, 0, nil)},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := &peertest.MockPeer{InfoHash: infoHash, PeerID: [20]byte{'m'}, Reserved: tc.reserved, Script: tc.script}
+			addr := mock.Listen(t)
+
+			out := &memoryWriter{buf: make([]byte, len(data))}
+			task := &Task{
+				Torrent:  tf,
+				InfoHash: infoHash,
+				PeerID:   [20]byte{'l'},
+				Peers:    []tracker.Peer{{IP: addr.IP, Port: uint16(addr.Port)}},
+				Output:   out,
+				Stats:    &Stats{},
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := task.Run(ctx); err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if !bytes.Equal(out.buf, data) {
+				t.Error("Downloaded data does not match")
+			}
+			if got := task.Stats.HashFailures.Load(); got != tc.hashFailures {
+				t.Errorf("Expected %d hash failures, got %d", tc.hashFailures, got)
+			}
+			// Having no pieces, we tell a Fast extension peer so outright
+			if received := mock.Received(); tc.reserved == fast && (len(received) == 0 || received[0].Type != peer.MsgHaveNone) {
+				t.Error("Expected HAVE NONE first")
+			}
+		})
+	}
+}
+
+func TestTaskRunCorruptPeer(t *testing.T) {
+	const pieceLength = 32768
+	data := make([]byte, pieceLength*4)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	tf := makeTorrent(data, pieceLength)
+	infoHash := [20]byte{4, 5, 8}
+
+	for _, banAfter := range []int{0, 1} {
+		t.Run("ban after "+strconv.Itoa(banAfter), func(t *testing.T) {
+			var banned []string
+
+			// The poisoner corrupts every copy of piece 1 it sends. The other peer,
+			// on another IP, only gets piece 1 once the poisoner has sent it.
+			var poisoned atomic.Bool
+			corrupt := func(index int, block []byte) {
+				if index == 1 {
+					block[0] ^= 0xff
+					poisoned.Store(true)
+				}
+			}
+			unchoke := peertest.Send(peer.FormatMessage(peer.MsgUnchoke, nil))
+			poisoner := &peertest.MockPeer{InfoHash: infoHash, PeerID: [20]byte{'p'}, Script: []peertest.Step{
+				peertest.Bitfield(tf.NumPieces()), peertest.Expect(peer.MsgInterested), unchoke, peertest.ServeRequests(data, pieceLength, 0, corrupt),
+			}}
+			poisonerAddr := poisoner.Listen(t)
+
+			ln, err := net.Listen("tcp", "127.0.0.2:0")
+			if err != nil {
+				t.Skipf("Can't listen on a second loopback IP: %v", err)
+			}
+			defer ln.Close()
+			waitPoisoned := func(c *peertest.Conn) error {
+				for !poisoned.Load() {
+					time.Sleep(time.Millisecond)
+				}
+				return nil
+			}
+			honest := &peertest.MockPeer{InfoHash: infoHash, PeerID: [20]byte{'h'}, Script: []peertest.Step{
+				peertest.Send(peer.FormatMessage(peer.MsgBitfield, []byte{0xb0})), peertest.Expect(peer.MsgInterested), unchoke, waitPoisoned,
+				peertest.Send(peer.FormatMessage(peer.MsgHave, binary.BigEndian.AppendUint32(nil, 1))), peertest.ServeRequests(data, pieceLength, 0, nil),
+			}}
+			go func() {
+				if conn, err := ln.Accept(); err == nil {
+					honest.Serve(conn)
+				}
+			}()
+			honestAddr := ln.Addr().(*net.TCPAddr)
+
+			out := &memoryWriter{buf: make([]byte, len(data))}
+			task := &Task{
+				Torrent:  tf,
+				InfoHash: infoHash,
+				PeerID:   [20]byte{'l'},
+				Peers: []tracker.Peer{
+					{IP: poisonerAddr.IP, Port: uint16(poisonerAddr.Port)},
+					{IP: honestAddr.IP, Port: uint16(honestAddr.Port)},
+				},
+				Output:     out,
+				Stats:      &Stats{},
+				BanAfter:   banAfter,
+				PeerBanned: func(ip string) { banned = append(banned, ip) },
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := task.Run(ctx); err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if !bytes.Equal(out.buf, data) {
+				t.Error("Downloaded data does not match")
+			}
+
+			// The poisoner isn't given piece 1 again while the honest peer can send it
+			suspects := task.Stats.Suspects()
+			if len(suspects) != 1 {
+				t.Fatalf("Expected 1 suspect, got %+v", suspects)
+			}
+			if s := suspects[0]; s.IP != "127.0.0.1" || s.Failed != 1 || !slices.Equal(s.Pieces, []int{1}) || s.Banned != (banAfter == 1) {
+				t.Errorf("Expected 127.0.0.1 to have sent piece 1 corrupt once, got %+v", s)
+			}
+
+			// Banned after its first failure, the poisoner is disconnected and
+			// not dialed again
+			if banAfter == 1 {
+				if !slices.Equal(banned, []string{"127.0.0.1"}) {
+					t.Errorf("Expected 127.0.0.1 to be banned, got %v", banned)
+				}
+				if !task.Stats.Banned("127.0.0.1") {
+					t.Error("Expected Banned to report 127.0.0.1")
+				}
+			} else if len(banned) != 0 {
+				t.Errorf("Expected no bans, got %v", banned)
+			}
+		})
+	}
+}
+
+func TestTaskRunQuarantine(t *testing.T) {
+	const pieceLength = 4 * MaxBlockSize
+	data := make([]byte, pieceLength)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	tf := makeTorrent(data, pieceLength)
+	infoHash := [20]byte{4, 5, 9}
+	listen := func(ip string) (net.Listener, *net.TCPAddr) {
+		ln, err := net.Listen("tcp", ip+":0")
+		if err != nil {
+			t.Skipf("Can't listen on %s: %v", ip, err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		return ln, ln.Addr().(*net.TCPAddr)
+	}
+	serveOnce := func(ln net.Listener, m *peertest.MockPeer) {
+		go func() {
+			if conn, err := ln.Accept(); err == nil {
+				m.Serve(conn)
+			}
+		}()
+	}
+
+	// The first peer sends two corrupt blocks and hangs up. The other only
+	// has the piece once it has.
+	var dropped atomic.Bool
+	corrupt := func(index int, block []byte) { block[0] ^= 0xff }
+	unchoke := peertest.Send(peer.FormatMessage(peer.MsgUnchoke, nil))
+	flaky := &peertest.MockPeer{InfoHash: infoHash, PeerID: [20]byte{'f'}, Script: []peertest.Step{
+		peertest.Bitfield(tf.NumPieces()), peertest.Expect(peer.MsgInterested), unchoke, peertest.ServeRequests(data, pieceLength, 2, corrupt),
+		func(c *peertest.Conn) error { dropped.Store(true); return nil },
+	}}
+	flakyLn, flakyAddr := listen("127.0.0.1")
+	serveOnce(flakyLn, flaky)
+	waitDropped := func(c *peertest.Conn) error {
+		for !dropped.Load() {
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	}
+	honest := &peertest.MockPeer{InfoHash: infoHash, PeerID: [20]byte{'h'}, Script: []peertest.Step{
+		peertest.Send(peer.FormatMessage(peer.MsgBitfield, []byte{0})), peertest.Expect(peer.MsgInterested), unchoke, waitDropped,
+		peertest.Send(peer.FormatMessage(peer.MsgHave, binary.BigEndian.AppendUint32(nil, 0))), peertest.ServeRequests(data, pieceLength, 0, nil),
+	}}
+	honestLn, honestAddr := listen("127.0.0.2")
+	serveOnce(honestLn, honest)
+
+	out := &memoryWriter{buf: make([]byte, len(data))}
+	task := &Task{
+		Torrent:  tf,
+		InfoHash: infoHash,
+		PeerID:   [20]byte{'l'},
+		Peers: []tracker.Peer{
+			{IP: flakyAddr.IP, Port: uint16(flakyAddr.Port)},
+			{IP: honestAddr.IP, Port: uint16(honestAddr.Port)},
+		},
+		Output: out,
+		Stats:  &Stats{},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := task.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if !bytes.Equal(out.buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+
+	// The honest peer was first asked for the two missing blocks only, then
+	// for the whole piece once the mixed copy failed
+	requests := 0
+	for _, msg := range honest.Received() {
+		if msg.Type == peer.MsgRequest {
+			requests++
+		}
+	}
+	if requests != 6 {
+		t.Errorf("Expected 2 requests and then 4, got %d", requests)
+	}
+	if failed, wasted := task.Stats.HashFailures.Load(), task.Stats.Wasted.Load(); failed != 1 || wasted != pieceLength {
+		t.Errorf("Expected 1 failed piece and %d bytes wasted, got %d and %d", pieceLength, failed, wasted)
+	}
+
+	// The quarantined blocks compared with the verified piece point at the
+	// flaky peer alone
+	suspects := task.Stats.Suspects()
+	if len(suspects) != 1 || suspects[0].IP != "127.0.0.1" || suspects[0].Failed != 1 || !slices.Equal(suspects[0].Pieces, []int{0}) {
+		t.Errorf("Expected 127.0.0.1 to be blamed for piece 0, got %+v", suspects)
+	}
+}
+
+func TestTaskRunWebSeed(t *testing.T) {
+	const pieceLength = 32768
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	tf := makeTorrent(data, pieceLength)
+	tf.Info.Name, tf.Info.Length = "album", 0
+	tf.Info.Files = []torrent.FileInfo{
+		{Length: 40000, Path: []string{"a 1.bin"}},
+		{Length: 0, Path: []string{"empty"}},
+		{Length: 60000, Path: []string{"disc", "b.bin"}},
+	}
+
+	// The seed serves the files under the torrent's folder, with ranges
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "album", "disc"), 0755)
+	os.WriteFile(filepath.Join(dir, "album", "a 1.bin"), data[:40000], 0644)
+	os.WriteFile(filepath.Join(dir, "album", "disc", "b.bin"), data[40000:], 0644)
+	var ranges atomic.Int32
+	files := http.FileServer(http.Dir(dir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	out := &memoryWriter{buf: make([]byte, len(data))}
+	task := &Task{
+		Torrent:  tf,
+		InfoHash: [20]byte{9},
+		PeerID:   [20]byte{'l'},
+		Output:   out,
+		WebSeeds: []string{server.URL, "ftp://example.com/"},
+		Stats:    &Stats{},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := task.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if !bytes.Equal(out.buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+	// Piece 1 spans both files, so there's one request more than pieces
+	if got := ranges.Load(); got != int32(tf.NumPieces()+1) {
+		t.Errorf("Expected %d range requests, got %d", tf.NumPieces()+1, got)
+	}
+	if got := task.Stats.Downloaded.Load(); got != int64(len(data)) {
+		t.Errorf("Expected %d bytes downloaded, got %d", len(data), got)
+	}
+
+	// A single-file torrent's URL names the file unless it ends in a slash
+	single := makeTorrent(data, pieceLength)
+	for url, expected := range map[string]string{
+		"http://example.com/test.bin": "http://example.com/test.bin",
+		"http://example.com/pub/":     "http://example.com/pub/test.bin",
+	} {
+		ws, err := newWebSeed(single, url, http.DefaultClient)
+		if err != nil || ws.files[0].url != expected {
+			t.Errorf("Expected %s for web seed %s, got %+v (err: %v)", expected, url, ws, err)
+		}
+	}
+	ws, _ := newWebSeed(tf, server.URL+"/", http.DefaultClient)
+	if got := ws.files[2].url; got != server.URL+"/album/disc/b.bin" {
+		t.Errorf("Expected the multi-file URL to name the folder, got %s", got)
+	}
+}
+
+func TestTaskRunClientPolicy(t *testing.T) {
+	const pieceLength = 32768
+	data := make([]byte, pieceLength*2)
+	tf := makeTorrent(data, pieceLength)
+	infoHash := [20]byte{4, 5, 7}
+	policy := peer.ClientPolicy{Refuse: peer.KnownBadClients}
+
+	testCases := []struct {
+		name    string
+		peerID  string
+		refused bool
+	}{
+		{"Allowed", "-qB4630-abcdefghijkl", false},
+		{"Refused", "-XL0012-abcdefghijkl", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := &peertest.MockPeer{InfoHash: infoHash, Script: []peertest.Step{
+				peertest.Bitfield(tf.NumPieces()), peertest.Expect(peer.MsgInterested),
+				peertest.Send(peer.FormatMessage(peer.MsgUnchoke, nil)), peertest.ServeRequests(data, pieceLength, 0, nil),
+			}}
+			copy(mock.PeerID[:], tc.peerID)
+			addr := mock.Listen(t)
+
+			task := &Task{
+				Torrent:      tf,
+				InfoHash:     infoHash,
+				PeerID:       [20]byte{'l'},
+				Peers:        []tracker.Peer{{IP: addr.IP, Port: uint16(addr.Port)}},
+				Output:       &memoryWriter{buf: make([]byte, len(data))},
+				Stats:        &Stats{},
+				ClientPolicy: policy.Decide,
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err := task.Run(ctx)
+			if tc.refused && !errors.Is(err, ErrNoPeers) {
+				t.Errorf("Expected the peer to be refused, got %v", err)
+			} else if !tc.refused && err != nil {
+				t.Errorf("Run failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestTaskRunPeerFailed(t *testing.T) {
+	data := make([]byte, 1000)
+	tf := makeTorrent(data, 500)
+
+	// Nothing listens where the only peer should be
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+
+	var failed []string
+	task := &Task{
+		Torrent:    tf,
+		InfoHash:   [20]byte{8},
+		PeerID:     [20]byte{'l'},
+		Peers:      []tracker.Peer{{IP: addr.IP, Port: uint16(addr.Port)}},
+		Output:     &memoryWriter{buf: make([]byte, len(data))},
+		PeerFailed: func(addr string) { failed = append(failed, addr) },
+	}
+	if err := task.Run(context.Background()); !errors.Is(err, ErrNoPeers) {
+		t.Errorf("Expected ErrNoPeers, got %v", err)
+	}
+	if len(failed) != 1 || failed[0] != addr.String() {
+		t.Errorf("Expected PeerFailed with %s, got %v", addr, failed)
+	}
+}
+
+func TestTaskRunClock(t *testing.T) {
+	data := make([]byte, 1000)
+	tf := makeTorrent(data, 500)
+	infoHash := [20]byte{9}
+
+	// A peer that takes requests but never answers them
+	mock := &peertest.MockPeer{InfoHash: infoHash, Script: []peertest.Step{
+		peertest.Bitfield(tf.NumPieces()),
+		peertest.Expect(peer.MsgInterested),
+		peertest.Send(peer.FormatMessage(peer.MsgUnchoke, nil)),
+		peertest.Hang(),
+	}}
+	addr := mock.Listen(t)
+
+	fake := clock.NewFake(time.Now())
+	task := &Task{
+		Torrent:  tf,
+		InfoHash: infoHash,
+		Peers:    []tracker.Peer{{IP: addr.IP, Port: uint16(addr.Port)}},
+		Output:   &memoryWriter{buf: make([]byte, len(data))},
+		Clock:    fake,
+	}
+	done := make(chan error)
+	go func() { done <- task.Run(context.Background()) }()
+
+	// The stalled piece is given up on once PieceTimeout passes on the clock
+	for !slices.ContainsFunc(mock.Received(), func(m *peer.Message) bool { return m.Type == peer.MsgRequest }) {
+		time.Sleep(time.Millisecond)
+	}
+	fake.Advance(PieceTimeout)
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrNoPeers) {
+			t.Errorf("Expected ErrNoPeers once the only peer stalled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return after advancing the clock")
+	}
+}
+
+func TestDialMockPeer(t *testing.T) {
+	infoHash := [20]byte{7}
+	tests := []struct {
+		name   string
+		mock   *peertest.MockPeer
+		expect string
+	}{
+		{"wrong torrent", &peertest.MockPeer{InfoHash: [20]byte{8}}, "info hash mismatch"},
+		{"no bitfield", &peertest.MockPeer{InfoHash: infoHash}, "failed to read bitfield"},
+		{"bogus length", &peertest.MockPeer{InfoHash: infoHash, Script: []peertest.Step{peertest.SendRaw([]byte{0xff, 0xff, 0xff, 0xff, 5})}}, "exceeds the limit"},
+		{"truncated message", &peertest.MockPeer{InfoHash: infoHash, Script: []peertest.Step{peertest.SendRaw([]byte{0, 0, 0, 9, 5, 0xff})}}, "failed to read bitfield"},
+		{"bad handshake", &peertest.MockPeer{SkipHandshake: true, Script: []peertest.Step{peertest.SendRaw([]byte{0})}}, "protocol string length is 0"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := tc.mock.Listen(t)
+			c, err := dial(context.Background(), nil, addr.String(), infoHash, [20]byte{'l'}, connOptions{bitfield: peer.NewBitfield(1)}, 0, nil)
+			if err == nil {
+				c.conn.Close()
+				t.Fatal("Expected dial to fail")
+			}
+			if !strings.Contains(err.Error(), tc.expect) {
+				t.Errorf("Expected error containing %q, got %v", tc.expect, err)
+			}
+		})
+	}
+}
+
+func TestFilesWriteAt(t *testing.T) {
+	dir := t.TempDir()
+	tf := &torrent.TorrentFile{
+		Info: torrent.TorrentInfo{
+			Name: "multi",
+			Files: []torrent.FileInfo{
+				{Length: 3, Path: []string{"a.txt"}},
+				{Length: 5, Path: []string{"sub", "b.txt"}},
+			},
+		},
+	}
+
+	fs, err := CreateFiles(tf, Layout{Dir: dir})
+	if err != nil {
+		t.Fatalf("CreateFiles failed: %v", err)
+	}
+
+	// This write spans both files
+	if _, err := fs.WriteAt([]byte("abcdefgh"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := fs.WriteAt([]byte("x"), 8); err == nil {
+		t.Error("Expected error writing past the end of the torrent")
+	}
+	got := make([]byte, 6)
+	if _, err := fs.ReadAt(got, 1); err != nil || string(got) != "bcdefg" {
+		t.Errorf("Expected to read bcdefg across both files, got %q (err: %v)", got, err)
+	}
+	if _, err := fs.ReadAt(got, 4); err == nil {
+		t.Error("Expected error reading past the end of the torrent")
+	}
+	fs.Close()
+
+	for path, expected := range map[string]string{
+		filepath.Join(dir, "multi", "a.txt"):        "abc",
+		filepath.Join(dir, "multi", "sub", "b.txt"): "defgh",
+	} {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if string(got) != expected {
+			t.Errorf("%s: expected %s, got %s", path, strconv.Quote(expected), strconv.Quote(string(got)))
+		}
+	}
+}
+
+func TestCreateFilesWith(t *testing.T) {
+	tf := &torrent.TorrentFile{
+		Info: torrent.TorrentInfo{
+			Name: "multi",
+			Files: []torrent.FileInfo{
+				{Length: 3000, Path: []string{"a.bin"}},
+				{Length: 5000, Path: []string{"b.bin"}},
+			},
+		},
+	}
+	skipB := []Priority{PriorityNormal, PrioritySkip}
+
+	for _, a := range []Allocation{AllocateNone, AllocateSparse, AllocateFull} {
+		t.Run(a.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			fs, err := CreateFilesWith(tf, Layout{Dir: dir}, CreateOptions{Allocate: a, Priorities: skipB})
+			if err != nil {
+				t.Fatalf("CreateFilesWith failed: %v", err)
+			}
+			fs.Close()
+
+			// Skipped files are created but never allocated
+			sizes := map[string]int64{"a.bin": 3000, "b.bin": 0}
+			if a == AllocateNone {
+				sizes["a.bin"] = 0
+			}
+			for name, want := range sizes {
+				info, err := os.Stat(filepath.Join(dir, "multi", name))
+				if err != nil {
+					t.Fatalf("Stat failed: %v", err)
+				}
+				if info.Size() != want {
+					t.Errorf("%s: expected %d bytes, got %d", name, want, info.Size())
+				}
+			}
+		})
+	}
+
+	var a Allocation
+	if err := a.UnmarshalText([]byte("full")); err != nil || a != AllocateFull {
+		t.Errorf("Expected full, got %v (err: %v)", a, err)
+	}
+	if err := a.UnmarshalText([]byte("lots")); err == nil {
+		t.Error("Expected an unknown allocation to fail")
+	}
+	if _, err := CreateFilesWith(tf, Layout{Dir: t.TempDir()}, CreateOptions{Priorities: skipB[:1]}); err == nil {
+		t.Error("Expected an error for a priority per file missing")
+	}
+}
+
+func TestFilesPadding(t *testing.T) {
+	dir := t.TempDir()
+	tf := &torrent.TorrentFile{
+		Info: torrent.TorrentInfo{
+			Name: "multi",
+			Files: []torrent.FileInfo{
+				{Length: 3, Path: []string{"run.sh"}, Attr: "x"},
+				{Length: 5, Path: []string{".pad", "5"}, Attr: "p"},
+				{Length: 2, Path: []string{"sub", "b.txt"}},
+				{Path: []string{"sub", "link"}, Attr: "l", SymlinkPath: []string{"run.sh"}},
+			},
+		},
+	}
+
+	fs, err := CreateFiles(tf, Layout{Dir: dir})
+	if err != nil {
+		t.Fatalf("CreateFiles failed: %v", err)
+	}
+	if _, err := fs.WriteAt([]byte("abcPPPPPde"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	got := make([]byte, 10)
+	if _, err := fs.ReadAt(got, 0); err != nil || string(got) != "abc\x00\x00\x00\x00\x00de" {
+		t.Errorf("Expected padding to read as zeros, got %q (err: %v)", got, err)
+	}
+	fs.Close()
+
+	// Padding isn't saved, and the rest keeps its attributes
+	if _, err := os.Stat(filepath.Join(dir, "multi", ".pad")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected no padding on disk, got %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "multi", "run.sh")); err != nil || info.Mode().Perm()&0100 == 0 {
+		t.Errorf("Expected an executable file, got %v (err: %v)", info, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "multi", "sub", "link")); err != nil || target != filepath.Join("..", "run.sh") {
+		t.Errorf("Expected a link to ../run.sh, got %q (err: %v)", target, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "multi", "sub", "b.txt")); err != nil || string(data) != "de" {
+		t.Errorf("Expected de, got %q (err: %v)", data, err)
+	}
+
+	// Pieces spanning the padding verify with it read as zeros
+	data := []byte("abc\x00\x00\x00\x00\x00de")
+	tf.Info.PieceLength = 4
+	for i := 0; i < len(data); i += 4 {
+		hash := sha1.Sum(data[i:min(i+4, len(data))])
+		tf.Info.Pieces += string(hash[:])
+	}
+	result, err := Verify(tf, Layout{Dir: dir}, nil)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if want := []bool{true, true, true}; !reflect.DeepEqual(result.Have, want) {
+		t.Errorf("Expected pieces %v verified, got %v", want, result.Have)
+	}
+
+	// Links can't point out of the torrent's folder
+	tf.Info.Files[3].SymlinkPath = []string{"..", "escape"}
+	if _, err := CreateFiles(tf, Layout{Dir: t.TempDir()}); err == nil {
+		t.Error("Expected an error for a link out of the torrent")
+	}
+}
+
+func TestSymlinkEscape(t *testing.T) {
+	link := func(path, target []string) torrent.FileInfo {
+		return torrent.FileInfo{Path: path, Attr: "l", SymlinkPath: target}
+	}
+	tests := []struct {
+		name  string
+		files []torrent.FileInfo
+	}{
+		// d/a is d, so d/a/l is really d/l and ../../t from there leaves the
+		// torrent's folder
+		{"chained links", []torrent.FileInfo{
+			link([]string{"d", "a"}, []string{"d"}),
+			link([]string{"d", "a", "l"}, []string{"t"}),
+			{Length: 5, Path: []string{"d", "a", "l", "pwned"}},
+		}},
+		{"file inside a link", []torrent.FileInfo{
+			{Length: 5, Path: []string{"d", "a", "pwned"}},
+			link([]string{"d"}, []string{"e"}),
+		}},
+		{"link loop", []torrent.FileInfo{
+			link([]string{"a"}, []string{"b"}),
+			link([]string{"b"}, []string{"a"}),
+			{Length: 5, Path: []string{"f"}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A folder next to the torrent's, which the links must not reach
+			dir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(dir, "t"), 0755); err != nil {
+				t.Fatalf("Mkdir failed: %v", err)
+			}
+			tf := &torrent.TorrentFile{Info: torrent.TorrentInfo{Name: "multi", Files: tt.files}}
+			if fs, err := CreateFiles(tf, Layout{Dir: dir}); err == nil {
+				fs.WriteAt([]byte("HELLO"), 0)
+				fs.Close()
+				t.Fatal("Expected an error for links leading out of the torrent")
+			}
+			if _, err := os.Stat(filepath.Join(dir, "t", "pwned")); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Expected nothing written outside the torrent, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCreateFilesDiskFull(t *testing.T) {
+	dir := t.TempDir()
+	free, err := freeSpace(dir)
+	if err != nil {
+		t.Skipf("Free space unknown: %v", err)
+	}
+
+	// Far more than the disk holds, which must fail before anything is
+	// allocated
+	tf := &torrent.TorrentFile{Info: torrent.TorrentInfo{Name: "huge", Length: free + 1<<40}}
+	if _, err := CreateFilesWith(tf, Layout{Dir: dir}, CreateOptions{Allocate: AllocateSparse}); !errors.Is(err, ErrDiskFull) || !errors.Is(err, ErrStorage) {
+		t.Fatalf("Expected ErrDiskFull, got %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "huge")); err != nil || info.Size() != 0 {
+		t.Errorf("Expected an empty file, got %v (err: %v)", info, err)
+	}
+
+	// Skipping the file needs no space
+	if _, err := CreateFilesWith(tf, Layout{Dir: dir}, CreateOptions{Priorities: []Priority{PrioritySkip}}); err != nil {
+		t.Errorf("Expected a skipped file to need no space, got %v", err)
+	}
+}
+
+func TestFileEntries(t *testing.T) {
+	multi := &torrent.TorrentFile{
+		Info: torrent.TorrentInfo{
+			Name: "multi",
+			Files: []torrent.FileInfo{
+				{Length: 3, Path: []string{"a.txt"}},
+				{Length: 5, Path: []string{"sub", "b.txt"}},
+			},
+		},
+	}
+	single := &torrent.TorrentFile{Info: torrent.TorrentInfo{Name: "file.iso", Length: 8}}
+
+	tests := []struct {
+		name     string
+		tf       *torrent.TorrentFile
+		layout   Layout
+		expected []string
+	}{
+		{"single", single, Layout{Dir: "out"}, []string{"out/file.iso"}},
+		{"single renamed", single, Layout{Dir: "out", Name: "debian.iso"}, []string{"out/debian.iso"}},
+		{"single flat", single, Layout{Dir: "out", Flat: true}, []string{"out/file.iso"}},
+		{"multi", multi, Layout{Dir: "out"}, []string{"out/multi/a.txt", "out/multi/sub/b.txt"}},
+		{"multi renamed", multi, Layout{Dir: "out", Name: "other"}, []string{"out/other/a.txt", "out/other/sub/b.txt"}},
+		{"multi flat", multi, Layout{Dir: "out", Flat: true}, []string{"out/a.txt", "out/sub/b.txt"}},
+		{"default dir", single, Layout{}, []string{"file.iso"}},
+	}
+	for _, tt := range tests {
+		entries, err := fileEntries(tt.tf, tt.layout)
+		if err != nil {
+			t.Errorf("%s: fileEntries failed: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, filepath.ToSlash(e.path))
+		}
+		if !slices.Equal(got, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+
+	// Names from a torrent or a rename must not escape the directory
+	evil := []*torrent.TorrentFile{
+		{Info: torrent.TorrentInfo{Name: "..", Length: 1}},
+		{Info: torrent.TorrentInfo{Name: "a/b", Length: 1}},
+		{Info: torrent.TorrentInfo{Name: "x", Files: []torrent.FileInfo{{Length: 1, Path: []string{"..", "etc", "passwd"}}}}},
+		{Info: torrent.TorrentInfo{Name: "x", Files: []torrent.FileInfo{{Length: 1, Path: []string{"a\\..\\b"}}}}},
+		{Info: torrent.TorrentInfo{Name: "x", Files: []torrent.FileInfo{{Length: 1}}}},
+	}
+	for i, tf := range evil {
+		if _, err := fileEntries(tf, Layout{Dir: "out"}); err == nil {
+			t.Errorf("Expected error for unsafe torrent %d", i)
+		}
+	}
+	if _, err := fileEntries(single, Layout{Dir: "out", Name: "../x"}); err == nil {
+		t.Error("Expected error for unsafe rename")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("abcdefghijklmnop")
+	tf := makeTorrent(data, 4)
+	tf.Info.Name = "multi"
+	tf.Info.Length = 0
+	tf.Info.Files = []torrent.FileInfo{
+		{Length: 6, Path: []string{"a.txt"}},
+		{Length: 6, Path: []string{"b.txt"}},
+		{Length: 4, Path: []string{"c.txt"}},
+	}
+
+	fs, err := CreateFiles(tf, Layout{Dir: dir})
+	if err != nil {
+		t.Fatalf("CreateFiles failed: %v", err)
+	}
+	fs.WriteAt(data, 0)
+	fs.WriteAt([]byte("X"), 9) // corrupts piece 2
+	fs.Close()
+	os.Remove(filepath.Join(dir, "multi", "c.txt")) // piece 3 is missing
+
+	calls := 0
+	result, err := Verify(tf, Layout{Dir: dir}, func(done, total int) { calls++ })
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+
+	expectedHave := []bool{true, true, false, false}
+	for i, have := range result.Have {
+		if have != expectedHave[i] {
+			t.Errorf("Piece %d: expected have %v, got %v", i, expectedHave[i], have)
+		}
+	}
+	if len(result.Corrupt) != 1 || result.Corrupt[0] != 2 {
+		t.Errorf("Expected piece 2 to be corrupt, got %v", result.Corrupt)
+	}
+	if bf := result.Bitfield(); len(bf) != 1 || bf[0] != 0xc0 {
+		t.Errorf("Expected bitfield c0, got %x", bf)
+	}
+	if calls != 4 {
+		t.Errorf("Expected 4 progress calls, got %d", calls)
+	}
+
+	// Any number of hashers finds the same
+	for _, workers := range []int{1, 3, 8} {
+		got, err := VerifyWith(tf, Layout{Dir: dir}, VerifyOptions{HashWorkers: workers})
+		if err != nil || !reflect.DeepEqual(got, result) {
+			t.Errorf("VerifyWith %d hashers: expected %+v, got %+v (err: %v)", workers, result, got, err)
+		}
+	}
+
+	progress := FileProgress(tf, result.Have)
+	expectedProgress := []int64{6, 2, 0}
+	for i, done := range progress {
+		if done != expectedProgress[i] {
+			t.Errorf("File %d: expected %d bytes done, got %d", i, expectedProgress[i], done)
+		}
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	const pieceLength = 256 << 10
+	data := make([]byte, 64<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	tf := makeTorrent(data, pieceLength)
+	dir := b.TempDir()
+	fs, err := CreateFiles(tf, Layout{Dir: dir})
+	if err != nil {
+		b.Fatalf("CreateFiles failed: %v", err)
+	}
+	fs.WriteAt(data, 0)
+	fs.Close()
+
+	for _, workers := range []int{1, 0} {
+		b.Run("workers="+strconv.Itoa(workers), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := VerifyWith(tf, Layout{Dir: dir}, VerifyOptions{HashWorkers: workers}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state", "resume", "1.resume")
+	root := filepath.Join(dir, "data", "file.bin")
+	have := []bool{true, false, true, true, false, false, false, false, true}
+	if err := SaveResume(path, [20]byte{1}, root, have, nil); err != nil {
+		t.Fatalf("SaveResume failed: %v", err)
+	}
+
+	got, err := LoadResume(path, [20]byte{1}, root, len(have))
+	if err != nil {
+		t.Fatalf("LoadResume failed: %v", err)
+	}
+	for i := range have {
+		if got[i] != have[i] {
+			t.Errorf("Piece %d: expected %v, got %v", i, have[i], got[i])
+		}
+	}
+
+	if _, err := LoadResume(path, [20]byte{2}, root, len(have)); err == nil {
+		t.Error("Expected error loading resume data for another torrent")
+	}
+	if _, err := LoadResume(path, [20]byte{1}, root, 20); err == nil {
+		t.Error("Expected error loading resume data with another piece count")
+	}
+	if _, err := LoadResume(path, [20]byte{1}, filepath.Join(dir, "elsewhere", "file.bin"), len(have)); err == nil {
+		t.Error("Expected error loading resume data for data elsewhere")
+	}
+}
+
+func TestSampleRates(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	c := &peerConn{conn: conn}
+	stats := &Stats{}
+	stats.addPeer(c)
+
+	c.downloaded.Store(1000)
+	c.uploaded.Store(200)
+	stats.SampleRates(time.Second, 0.5)
+	c.downloaded.Store(2000)
+	stats.SampleRates(time.Second, 0.5)
+
+	p := stats.PeerList()[0]
+	if p.DownloadRate != 750 || p.UploadRate != 50 {
+		t.Errorf("Expected rates of 750 down and 50 up, got %v and %v", p.DownloadRate, p.UploadRate)
+	}
+}
+
+func TestAvailability(t *testing.T) {
+	stats := &Stats{}
+	newConn := func(pieces ...int) *peerConn {
+		conn, other := net.Pipe()
+		t.Cleanup(func() { conn.Close(); other.Close() })
+		c := &peerConn{conn: conn, bitfield: peer.NewBitfield(5), numPieces: 5, stats: stats}
+		for _, index := range pieces {
+			c.bitfield.SetPiece(index)
+		}
+		return c
+	}
+	a, b := newConn(0, 1, 2, 3, 4), newConn(0, 1)
+	stats.addPeer(a)
+	stats.addPeer(b)
+	if avail := stats.Availability(); !slices.Equal(avail, []int{2, 2, 1, 1, 1}) {
+		t.Errorf("Expected availability [2 2 1 1 1], got %v", avail)
+	}
+
+	// HAVE, BITFIELD, HAVE ALL and HAVE NONE keep it in step
+	have := func(index int) *peer.Message {
+		return peer.FormatMessage(peer.MsgHave, binary.BigEndian.AppendUint32(nil, uint32(index)))
+	}
+	b.fast = true
+	testCases := []struct {
+		msg      *peer.Message
+		expected []int
+		copies   float64
+	}{
+		{have(2), []int{2, 2, 2, 1, 1}, 1.6},
+		{have(2), []int{2, 2, 2, 1, 1}, 1.6},
+		{peer.FormatMessage(peer.MsgBitfield, []byte{0b00011000}), []int{1, 1, 1, 2, 2}, 1.4},
+		{peer.FormatMessage(peer.MsgHaveAll, nil), []int{2, 2, 2, 2, 2}, 2},
+		{peer.FormatMessage(peer.MsgHaveNone, nil), []int{1, 1, 1, 1, 1}, 1},
+	}
+	for _, tc := range testCases {
+		if err := b.handle(tc.msg); err != nil {
+			t.Fatalf("%v: handle failed: %v", tc.msg, err)
+		}
+		avail := stats.Availability()
+		if !slices.Equal(avail, tc.expected) {
+			t.Errorf("%v: expected availability %v, got %v", tc.msg, tc.expected, avail)
+		}
+		if copies := DistributedCopies(avail); math.Abs(copies-tc.copies) > 1e-9 {
+			t.Errorf("%v: expected %v distributed copies, got %v", tc.msg, tc.copies, copies)
+		}
+	}
+
+	// A peer leaving takes its pieces along
+	stats.removePeer(a)
+	if avail := stats.Availability(); !slices.Equal(avail, []int{0, 0, 0, 0, 0}) || DistributedCopies(avail) != 0 {
+		t.Errorf("Expected no piece available, got %v", avail)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	c := &peerConn{conn: conn, closed: make(chan struct{})}
+	go c.keepAlive(40 * time.Millisecond)
+	defer close(c.closed)
+
+	// A silent connection gets keep-alives
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := peer.ReadMessage(other)
+	if err != nil || msg.Length != 0 {
+		t.Fatalf("Expected a keep-alive, got %v (err: %v)", msg, err)
+	}
+
+	// One that just sent something doesn't
+	go c.send(peer.FormatMessage(peer.MsgInterested, nil))
+	if msg, err := peer.ReadMessage(other); err != nil || msg.Type != peer.MsgInterested {
+		t.Fatalf("Expected INTERESTED, got %v (err: %v)", msg, err)
+	}
+	other.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if msg, err := peer.ReadMessage(other); err == nil {
+		t.Errorf("Expected nothing right after a message, got %v", msg)
+	}
+}
+
+func TestServeQueue(t *testing.T) {
+	const pieceLength = 32768
+	data := make([]byte, pieceLength*2)
+	for i := range data {
+		data[i] = byte(i * 3)
+	}
+	task := &Task{Torrent: makeTorrent(data, pieceLength), Output: &memoryWriter{buf: data}, Stats: &Stats{}}
+	have := &pieceSet{have: []bool{true, false}}
+
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	c := &peerConn{conn: conn, fast: true, closed: make(chan struct{})}
+	c.uploads.Max = 2
+	received := make(chan *peer.Message, 8)
+	go func() {
+		defer close(received)
+		for {
+			msg, err := peer.ReadMessage(other)
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+	expect := func(typ peer.MessageType, index, begin uint32) *peer.Message {
+		t.Helper()
+		select {
+		case msg := <-received:
+			if msg == nil || msg.Type != typ || binary.BigEndian.Uint32(msg.Payload) != index || binary.BigEndian.Uint32(msg.Payload[4:]) != begin {
+				t.Fatalf("Expected message %d for %d:%d, got %v", typ, index, begin, msg)
+			}
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected message %d for %d:%d, got nothing", typ, index, begin)
+			return nil
+		}
+	}
+
+	// Requests beyond the queue, or for pieces we don't have, are rejected
+	for _, r := range [][2]uint32{{0, 0}, {0, 16384}, {0, 1024}, {1, 0}} {
+		if err := task.serve(c, have, peer.RequestMessage(r[0], r[1], 1024)); err != nil {
+			t.Fatalf("serve failed: %v", err)
+		}
+	}
+	expect(peer.MsgRejectRequest, 0, 1024)
+	expect(peer.MsgRejectRequest, 1, 0)
+	if err := task.serve(c, have, peer.RequestMessage(0, pieceLength, 1024)); err == nil {
+		t.Error("Expected an error serving a request past the end of the piece")
+	}
+
+	// A cancelled request is rejected, not read and sent
+	if err := c.handle(peer.CancelMessage(0, 16384, 1024)); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+	expect(peer.MsgRejectRequest, 0, 16384)
+	if c.uploads.Len() != 1 {
+		t.Errorf("Expected 1 queued request after the cancel, got %d", c.uploads.Len())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go task.upload(ctx, logging.Discard, c)
+	msg := expect(peer.MsgPiece, 0, 0)
+	if !bytes.Equal(msg.Payload[8:], data[:1024]) {
+		t.Error("Expected the block's data in the piece message")
+	}
+	for deadline := time.Now().Add(2 * time.Second); task.Stats.Uploaded.Load() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if got := task.Stats.Uploaded.Load(); got != 1024 {
+		t.Errorf("Expected 1024 bytes uploaded, got %d", got)
+	}
+}
+
+func TestPeerClient(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	var id [20]byte
+	copy(id[:], "-TR4050-abcdefghijkl")
+	c := &peerConn{conn: conn, peerID: id}
+	stats := &Stats{}
+	stats.addPeer(c)
+
+	if client := stats.PeerList()[0].Client; client != "Transmission 4.0.5" {
+		t.Errorf("Expected client guessed from the peer ID, got %q", client)
+	}
+
+	// The extension handshake's "v" wins over the peer ID
+	testCases := []struct {
+		payload  string
+		expected string
+	}{
+		{"d1:md6:ut_pexi1ee1:v17:qBittorrent 4.6.3e", "qBittorrent 4.6.3"},
+		{"d1:v13:Evil\x1b[2J\x07 1.0e", "Evil[2J 1.0"},
+		{"not bencode", "Evil[2J 1.0"},
+		{"d1:mdee", "Evil[2J 1.0"},
+	}
+	for _, tc := range testCases {
+		msg := peer.FormatMessage(peer.MsgExtended, append([]byte{peer.ExtHandshakeID}, tc.payload...))
+		if err := c.handle(msg); err != nil {
+			t.Errorf("handle(%q) failed: %v", tc.payload, err)
+		}
+		if client := stats.PeerList()[0].Client; client != tc.expected {
+			t.Errorf("After %q: expected client %q, got %q", tc.payload, tc.expected, client)
+		}
+	}
+
+	// A partial seed says it only uploads (BEP 21)
+	msg := peer.FormatMessage(peer.MsgExtended, append([]byte{peer.ExtHandshakeID}, "d11:upload_onlyi1ee"...))
+	if err := c.handle(msg); err != nil {
+		t.Errorf("handle failed: %v", err)
+	}
+	if p := stats.PeerList()[0]; !p.UploadOnly || p.Client != "Evil[2J 1.0" {
+		t.Errorf("Expected an upload-only peer keeping its client, got %+v", p)
+	}
+
+	// The peer tells us the IP it sees us at; malformed ones are ignored
+	var reported []net.IP
+	c.yourIPReported = func(ip net.IP) { reported = append(reported, ip) }
+	for _, payload := range []string{"d6:youripi1ee", "d6:yourip3:abce", "d6:yourip4:\xcb\x00\x71\x07e"} {
+		msg := peer.FormatMessage(peer.MsgExtended, append([]byte{peer.ExtHandshakeID}, payload...))
+		if err := c.handle(msg); err != nil {
+			t.Errorf("handle(%q) failed: %v", payload, err)
+		}
+	}
+	if len(reported) != 1 || !reported[0].Equal(net.IPv4(203, 0, 113, 7)) {
+		t.Errorf("Expected 203.0.113.7 reported once, got %v", reported)
+	}
+}
+
+// addrConn is a connection reporting the given addresses
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestPortMessage(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 9), Port: 51413}
+	c := &peerConn{conn: addrConn{remote: remote}}
+
+	// A PORT message before the worker takes the connection is kept
+	if err := c.handle(peer.PortMessage(6881)); err != nil || c.dhtPort != 6881 {
+		t.Fatalf("Expected port 6881 kept, got %d (err: %v)", c.dhtPort, err)
+	}
+	var nodes []uint16
+	c.portReported = func(port uint16) { nodes = append(nodes, port) }
+	for _, msg := range []*peer.Message{peer.PortMessage(0), peer.FormatMessage(peer.MsgPort, []byte{1}), peer.PortMessage(6882)} {
+		if err := c.handle(msg); err != nil {
+			t.Errorf("handle(%v) failed: %v", msg, err)
+		}
+	}
+	if c.dhtPort != 6882 || len(nodes) != 1 || nodes[0] != 6882 {
+		t.Errorf("Expected port 6882 reported once, got %v with port %d kept", nodes, c.dhtPort)
+	}
+}
+
+func TestPEXMessage(t *testing.T) {
+	m := &pexMessage{
+		added:      []tracker.Peer{{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, {IP: net.ParseIP("2001:db8::1"), Port: 6882}},
+		addedFlags: []byte{pexSeed, pexConnectable},
+		dropped:    []tracker.Peer{{IP: net.IPv4(10, 0, 0, 2), Port: 6883}},
+	}
+	got, err := parsePEX(m.encode())
+	if err != nil {
+		t.Fatalf("parsePEX failed: %v", err)
+	}
+	if len(got.added) != 2 || got.added[0].String() != "10.0.0.1:6881" || got.added[1].String() != "[2001:db8::1]:6882" ||
+		!bytes.Equal(got.addedFlags, m.addedFlags) || len(got.dropped) != 1 || got.dropped[0].String() != "10.0.0.2:6883" {
+		t.Errorf("Expected %+v back, got %+v", m, got)
+	}
+
+	// Port 0 and a trailing partial entry are skipped, missing flags are 0
+	got, err = parsePEX([]byte("d5:added15:\x0a\x00\x00\x03\x00\x00\x0a\x00\x00\x04\x1a\xe1\x0a\x00\x00e"))
+	if err != nil || len(got.added) != 1 || got.added[0].String() != "10.0.0.4:6881" || got.addedFlags[0] != 0 {
+		t.Errorf("Expected only 10.0.0.4:6881, got %+v (err: %v)", got, err)
+	}
+	if _, err := parsePEX([]byte("le")); err == nil {
+		t.Error("Expected error parsing a list")
+	}
+}
+
+func TestSendPEX(t *testing.T) {
+	// a supports ut_pex and is told about b, which we dialed, but not about
+	// c, which dialed us without saying which port it listens on
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	a := &peerConn{conn: addrConn{Conn: local, remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}}}
+	hs := &peer.ExtensionHandshake{M: map[string]uint8{"ut_pex": 9}}
+	if _, err := a.ext.Handle(hs.Message()); err != nil {
+		t.Fatalf("Handle failed: %v", err)
+	}
+	b := &peerConn{conn: addrConn{remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6882}}}
+	b.seed.Store(true)
+	c := &peerConn{conn: addrConn{remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 50000}}, incoming: true}
+	stats := &Stats{}
+	for _, conn := range []*peerConn{a, b, c} {
+		stats.addPeer(conn)
+	}
+
+	receive := func() *pexMessage {
+		t.Helper()
+		msg, err := peer.ReadMessage(remote)
+		if err != nil {
+			t.Fatalf("ReadMessage failed: %v", err)
+		}
+		if msg.Type != peer.MsgExtended || msg.Payload[0] != 9 {
+			t.Fatalf("Expected a ut_pex message, got %v", msg)
+		}
+		m, err := parsePEX(msg.Payload[1:])
+		if err != nil {
+			t.Fatalf("parsePEX failed: %v", err)
+		}
+		return m
+	}
+
+	stats.sendPEX()
+	m := receive()
+	if len(m.added) != 1 || m.added[0].String() != "10.0.0.2:6882" || m.addedFlags[0] != pexSeed|pexConnectable || len(m.dropped) != 0 {
+		t.Errorf("Expected 10.0.0.2:6882 added as a seed, got %+v", m)
+	}
+
+	// c says where it listens and b leaves
+	c.listenPort.Store(6883)
+	stats.removePeer(b)
+	stats.sendPEX()
+	m = receive()
+	if len(m.added) != 1 || m.added[0].String() != "10.0.0.3:6883" || len(m.dropped) != 1 || m.dropped[0].String() != "10.0.0.2:6882" {
+		t.Errorf("Expected 10.0.0.3:6883 added and 10.0.0.2:6882 dropped, got %+v", m)
+	}
+}
+
+func TestHolepunch(t *testing.T) {
+	// a and b support ut_holepunch, c doesn't
+	stats := &Stats{}
+	newConn := func(ip byte, holepunch bool) (*peerConn, net.Conn) {
+		local, remote := net.Pipe()
+		t.Cleanup(func() { local.Close(); remote.Close() })
+		c := &peerConn{conn: addrConn{Conn: local, remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, ip), Port: 6881}}, stats: stats, log: logging.Discard}
+		c.registerExtensions(true, true)
+		m := map[string]uint8{"ut_pex": 9}
+		if holepunch {
+			m["ut_holepunch"] = 7
+		}
+		if _, err := c.ext.Handle((&peer.ExtensionHandshake{M: m}).Message()); err != nil {
+			t.Fatalf("Handle failed: %v", err)
+		}
+		stats.addPeer(c)
+		return c, remote
+	}
+	a, aRemote := newConn(1, true)
+	b, bRemote := newConn(2, true)
+	newConn(3, false)
+
+	receive := func(remote net.Conn) *peer.HolepunchMessage {
+		t.Helper()
+		remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+		msg, err := peer.ReadMessage(remote)
+		if err != nil {
+			t.Fatalf("ReadMessage failed: %v", err)
+		}
+		if msg.Type != peer.MsgExtended || msg.Payload[0] != 7 {
+			t.Fatalf("Expected a ut_holepunch message, got %v", msg)
+		}
+		m, err := peer.ParseHolepunch(msg.Payload[1:])
+		if err != nil {
+			t.Fatalf("ParseHolepunch failed: %v", err)
+		}
+		return m
+	}
+	rendezvous := func(addr string) []byte {
+		p := peerFromAddr(addr)
+		return (&peer.HolepunchMessage{Type: peer.HolepunchRendezvous, IP: p.IP, Port: p.Port}).Encode()
+	}
+
+	// As the relay, we introduce a to b, and both to each other
+	if err := a.receiveHolepunch(rendezvous("10.0.0.2:6881")); err != nil {
+		t.Fatalf("receiveHolepunch failed: %v", err)
+	}
+	if m := receive(bRemote); m.Type != peer.HolepunchConnect || m.Addr() != "10.0.0.1:6881" {
+		t.Errorf("Expected b to be told to connect to a, got %+v", m)
+	}
+	if m := receive(aRemote); m.Type != peer.HolepunchConnect || m.Addr() != "10.0.0.2:6881" {
+		t.Errorf("Expected a to be told to connect to b, got %+v", m)
+	}
+
+	// Otherwise a hears why not
+	testCases := []struct {
+		addr     string
+		expected peer.HolepunchErr
+	}{
+		{"10.0.0.3:6881", peer.HolepunchNoSupport},
+		{"10.0.0.4:6881", peer.HolepunchNotConnected},
+		{"10.0.0.1:6881", peer.HolepunchNoSelf},
+		{"10.0.0.2:0", peer.HolepunchNoSuchPeer},
+	}
+	for _, tc := range testCases {
+		a.receiveHolepunch(rendezvous(tc.addr))
+		if m := receive(aRemote); m.Type != peer.HolepunchError || m.Err != tc.expected {
+			t.Errorf("%s: expected a %v error, got %+v", tc.addr, tc.expected, m)
+		}
+	}
+
+	// A peer b told us about through peer exchange can be reached through
+	// b, once, if it supports ut_holepunch
+	stats.holepunchRelays(b, &pexMessage{
+		added:      []tracker.Peer{{IP: net.IPv4(10, 0, 0, 5), Port: 6881}, {IP: net.IPv4(10, 0, 0, 6), Port: 6881}},
+		addedFlags: []byte{pexHolepunch, 0},
+	})
+	if !stats.rendezvous("10.0.0.5:6881") {
+		t.Fatal("Expected b to be asked for a rendezvous")
+	}
+	if m := receive(bRemote); m.Type != peer.HolepunchRendezvous || m.Addr() != "10.0.0.5:6881" {
+		t.Errorf("Expected a rendezvous with 10.0.0.5:6881, got %+v", m)
+	}
+	if stats.rendezvous("10.0.0.5:6881") || stats.rendezvous("10.0.0.6:6881") {
+		t.Error("Expected no rendezvous again, or with a peer without ut_holepunch")
+	}
+
+	// b's answer has us connect, up to holepunchMaxConnects times
+	var connects []string
+	b.holepunchConnect = func(p tracker.Peer) { connects = append(connects, p.String()) }
+	connect := (&peer.HolepunchMessage{Type: peer.HolepunchConnect, IP: net.IPv4(10, 0, 0, 5), Port: 6881}).Encode()
+	for range holepunchMaxConnects + 1 {
+		b.receiveHolepunch(connect)
+	}
+	if len(connects) != holepunchMaxConnects || connects[0] != "10.0.0.5:6881" {
+		t.Errorf("Expected %d connects to 10.0.0.5:6881, got %v", holepunchMaxConnects, connects)
+	}
+
+	// Once b leaves it can't relay anymore
+	stats.removePeer(b)
+	stats.holepunchRelays(a, &pexMessage{added: []tracker.Peer{{IP: net.IPv4(10, 0, 0, 7), Port: 6881}}, addedFlags: []byte{pexHolepunch}})
+	if len(stats.relays) != 1 {
+		t.Errorf("Expected only a's relay to be left, got %v", stats.relays)
+	}
+}
+
+func TestDuplicateConnections(t *testing.T) {
+	// Two peers dialed each other at once: each has an outgoing and an
+	// incoming connection to the other, seen from both ends
+	ourAddr := func(port int) *net.TCPAddr { return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port} }
+	theirAddr := func(port int) *net.TCPAddr { return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: port} }
+	ourID, theirID := [20]byte{'b'}, [20]byte{'a'}
+	conn := func(local, remote *net.TCPAddr, id [20]byte, incoming bool) *peerConn {
+		return &peerConn{conn: addrConn{local: local, remote: remote}, peerID: id, incoming: incoming}
+	}
+
+	testCases := []struct {
+		name                 string
+		ours, theirs         *net.TCPAddr // the ends of the connection we dialed
+		oursBack, theirsBack *net.TCPAddr // the ends of the one they dialed
+	}{
+		{"different hosts", ourAddr(50000), theirAddr(6881), ourAddr(6881), theirAddr(50001)},
+		{"same host", ourAddr(50000), ourAddr(6882), ourAddr(6881), ourAddr(50001)},
+	}
+	for _, tc := range testCases {
+		ourOut, ourIn := conn(tc.ours, tc.theirs, theirID, false), conn(tc.oursBack, tc.theirsBack, theirID, true)
+		theirIn, theirOut := conn(tc.theirs, tc.ours, ourID, true), conn(tc.theirsBack, tc.oursBack, ourID, false)
+
+		ourChoice := preferConn(ourOut, ourIn, ourID)
+		theirChoice := preferConn(theirIn, theirOut, theirID)
+		if (ourChoice == ourOut) != (theirChoice == theirIn) {
+			t.Errorf("%s: expected both sides to keep the same connection", tc.name)
+		}
+		if preferConn(ourIn, ourOut, ourID) != ourChoice {
+			t.Errorf("%s: expected the choice not to depend on the order", tc.name)
+		}
+
+		// The connection that loses is dropped
+		stats := &Stats{}
+		if drop := stats.addUnique(ourOut, ourID); drop != nil {
+			t.Errorf("%s: expected the first connection to be kept", tc.name)
+		}
+		drop := stats.addUnique(ourIn, ourID)
+		if drop == nil || drop == ourChoice {
+			t.Errorf("%s: expected the other connection to be dropped", tc.name)
+		}
+	}
+
+	// On a tie between priorities, the higher peer ID's outgoing connection
+	// is kept
+	ourOut := conn(ourAddr(50000), theirAddr(6881), [20]byte{'a'}, false)
+	ourIn := conn(ourAddr(6881), theirAddr(50001), [20]byte{'a'}, true)
+	if preferConn(ourIn, ourOut, [20]byte{'b'}) != ourOut {
+		t.Error("Expected the outgoing connection of the higher peer ID to be kept")
+	}
+}
@@ -0,0 +1,75 @@
+package download
+
+import (
+	"github.com/omkarkirpan/bittorrent-client/metadata"
+	"github.com/omkarkirpan/bittorrent-client/peer"
+)
+
+// registerExtensions registers the extension protocol messages we handle on
+// the connection: ut_metadata (BEP 9) when we have metadata to serve,
+// ut_pex (BEP 11) if we exchange peers and ut_holepunch (BEP 55) if we
+// punch holes too
+func (c *peerConn) registerExtensions(pex, holepunch bool) {
+	if c.metadata != nil {
+		c.ext.Register("ut_metadata", metadata.LocalID, c.serveMetadata)
+	}
+	if pex {
+		c.ext.Register("ut_pex", pexID, c.receivePEX)
+	}
+	if pex && holepunch {
+		c.ext.Register("ut_holepunch", holepunchID, c.receiveHolepunch)
+	}
+}
+
+// extHandshake builds our extension handshake. Besides the registered
+// extensions and the size of the metadata we serve, it tells the peer which
+// client we are, the IP we see it at so it can learn its external address,
+// and, as a partial seed (BEP 21), that we only upload.
+func (c *peerConn) extHandshake(uploadOnly bool) *peer.Message {
+	h := c.ext.Handshake()
+	h.Client = peer.ClientVersion
+	h.YourIP = c.remoteIP()
+	h.MetadataSize = len(c.metadata)
+	h.UploadOnly = uploadOnly
+	h.Reqq = peer.MaxQueuedRequests
+	return h.Message()
+}
+
+// extHandshakeReceived keeps what matters to us of the peer's extension
+// handshake. Peers may send it again to update it; a client left out keeps
+// the one reported before.
+func (c *peerConn) extHandshakeReceived(h *peer.ExtensionHandshake) error {
+	if h.Client != "" {
+		c.client.Store(&h.Client)
+		if c.clientReported != nil {
+			if err := c.clientReported(h.Client); err != nil {
+				return err
+			}
+		}
+	}
+	c.uploadOnly.Store(h.UploadOnly)
+	if h.ListenPort != 0 {
+		c.listenPort.Store(uint32(h.ListenPort))
+	}
+	if h.YourIP != nil {
+		c.yourIP = h.YourIP
+		if c.yourIPReported != nil {
+			c.yourIPReported(h.YourIP)
+		}
+	}
+	return nil
+}
+
+// serveMetadata answers a ut_metadata message from the peer. A peer that
+// didn't offer ut_metadata in its handshake gets no answer.
+func (c *peerConn) serveMetadata(payload []byte) error {
+	answer, err := metadata.Answer(c.metadata, payload)
+	if err != nil || answer == nil {
+		return err
+	}
+	msg, err := c.ext.Message("ut_metadata", answer)
+	if err != nil {
+		return nil
+	}
+	return c.send(msg)
+}
@@ -0,0 +1,450 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// Files lays the torrent's content out on disk. Torrent offsets are mapped
+// onto the files in order, so a piece may be split across several files.
+// Padding files and symlinks have no file on disk: what is written to them
+// is dropped, and they read as zeros.
+type Files struct {
+	files   []*os.File // nil for padding files and symlinks
+	lengths []int64
+}
+
+// Layout says where a torrent's content goes on disk. By default single-file
+// torrents are stored as Dir/<name> and multi-file torrents under
+// Dir/<name>/.
+type Layout struct {
+	Dir  string // Directory to save in; defaults to the current directory
+	Name string // Replaces the torrent's name as the file or folder name if set
+	Flat bool   // Put a multi-file torrent's files directly in Dir, without the folder
+}
+
+// Root returns where a torrent's content is saved: the file of a single-file
+// torrent, or the folder of a multi-file one, which is Dir itself when Flat
+func (l Layout) Root(t *torrent.TorrentFile) string {
+	if l.Dir == "" {
+		l.Dir = "."
+	}
+	if len(t.Info.Files) > 0 && l.Flat {
+		return l.Dir
+	}
+	if l.Name != "" {
+		return filepath.Join(l.Dir, l.Name)
+	}
+	return filepath.Join(l.Dir, t.Info.Name)
+}
+
+// Allocation is how a torrent's files get their disk space
+type Allocation int
+
+const (
+	AllocateNone   Allocation = iota // Files grow as pieces are written
+	AllocateSparse                   // Files are set to their full size up front, without reserving disk space
+	AllocateFull                     // Disk space is reserved up front, so it can't run out mid-download
+)
+
+var allocations = []string{"none", "sparse", "full"}
+
+func (a Allocation) String() string {
+	if a < 0 || int(a) >= len(allocations) {
+		return fmt.Sprintf("Allocation(%d)", int(a))
+	}
+	return allocations[a]
+}
+
+// MarshalText returns the allocation's name
+func (a Allocation) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText parses an allocation's name: none, sparse or full
+func (a *Allocation) UnmarshalText(text []byte) error {
+	for i, name := range allocations {
+		if string(text) == name {
+			*a = Allocation(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown allocation %q: want none, sparse or full", text)
+}
+
+// CreateOptions are the storage settings of CreateFilesWith
+type CreateOptions struct {
+	Allocate Allocation
+
+	// Priorities, if set, holds a priority per file in torrent order.
+	// Skipped files are created but not allocated, and don't count towards
+	// the disk space needed.
+	Priorities []Priority
+}
+
+// CreateFiles creates (or opens) the files of a torrent as laid out by l
+func CreateFiles(t *torrent.TorrentFile, l Layout) (*Files, error) {
+	return CreateFilesWith(t, l, CreateOptions{})
+}
+
+// CreateFilesWith is like CreateFiles but allocates the files as opts says.
+// It first checks that the disk has room for what isn't written yet, and
+// fails with ErrDiskFull rather than running out of space mid-download.
+func CreateFilesWith(t *torrent.TorrentFile, l Layout, opts CreateOptions) (*Files, error) {
+	entries, err := fileEntries(t, l)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Priorities != nil && len(opts.Priorities) != len(entries) {
+		return nil, fmt.Errorf("got %d file priorities for %d files", len(opts.Priorities), len(entries))
+	}
+
+	fs := &Files{}
+	for _, e := range entries {
+		f, err := createFile(e)
+		if err != nil {
+			fs.Close()
+			return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+		}
+		fs.files = append(fs.files, f)
+		fs.lengths = append(fs.lengths, e.length)
+	}
+
+	skipped := func(i int) bool {
+		return opts.Priorities != nil && opts.Priorities[i] == PrioritySkip
+	}
+	if err := fs.checkSpace(filepath.Dir(entries[0].path), skipped); err != nil {
+		fs.Close()
+		return nil, err
+	}
+	if opts.Allocate != AllocateNone {
+		for i, f := range fs.files {
+			if f == nil || skipped(i) {
+				continue
+			}
+			if err := allocate(f, fs.lengths[i], opts.Allocate); err != nil {
+				fs.Close()
+				return nil, fmt.Errorf("%w: failed to allocate %s: %v", ErrStorage, entries[i].path, err)
+			}
+		}
+	}
+
+	return fs, nil
+}
+
+// createFile creates (or opens) a file of a torrent. Padding files aren't
+// created and symlinks are made as links, so both come back nil.
+func createFile(e fileEntry) (*os.File, error) {
+	if e.padding {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(e.path), 0755); err != nil {
+		return nil, err
+	}
+	if e.link != "" {
+		if _, err := os.Lstat(e.path); err == nil {
+			return nil, nil
+		}
+		return nil, os.Symlink(e.link, e.path)
+	}
+	perm := os.FileMode(0644)
+	if e.executable {
+		perm = 0755
+	}
+	return os.OpenFile(e.path, os.O_RDWR|os.O_CREATE, perm)
+}
+
+// checkSpace fails with ErrDiskFull if the file system holding dir has less
+// room than the files still need. Where free space can't be told, it passes.
+func (fs *Files) checkSpace(dir string, skipped func(i int) bool) error {
+	var needed int64
+	for i, f := range fs.files {
+		if f == nil || skipped(i) {
+			continue
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrStorage, err)
+		}
+		needed += max(fs.lengths[i]-diskUsage(info), 0)
+	}
+	if needed == 0 {
+		return nil
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		return nil
+	}
+	if needed > free {
+		return fmt.Errorf("%w: %w: %d MiB more needed in %s, %d MiB free", ErrStorage, ErrDiskFull, (needed+1<<20-1)>>20, dir, free>>20)
+	}
+	return nil
+}
+
+// allocate grows f to its full length as a says, never shrinking it. Full
+// allocation falls back to a sparse file where the file system can't
+// reserve space.
+func allocate(f *os.File, length int64, a Allocation) error {
+	if a == AllocateFull {
+		err := reserve(f, length)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < length {
+		return f.Truncate(length)
+	}
+	return nil
+}
+
+// fileEntry is a file of a torrent laid out on disk
+type fileEntry struct {
+	path       string
+	length     int64
+	padding    bool   // Zeros that aren't saved (BEP 47)
+	executable bool   // Created with the executable bits set
+	link       string // Target of a symlink, relative to the link's folder
+}
+
+// fileEntries returns the paths and lengths of a torrent's files as laid out
+// by l in torrent order. Every name from the torrent or the layout must be a
+// plain file name, so a malicious torrent can't write outside l.Dir.
+func fileEntries(t *torrent.TorrentFile, l Layout) ([]fileEntry, error) {
+	if l.Dir == "" {
+		l.Dir = "."
+	}
+	name := t.Info.Name
+	if l.Name != "" {
+		name = l.Name
+	}
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	if len(t.Info.Files) == 0 {
+		file := torrent.FileInfo{Attr: t.Info.Attr}
+		return []fileEntry{{path: filepath.Join(l.Dir, name), length: t.Info.Length, executable: file.IsExecutable()}}, nil
+	}
+	root := l.Dir
+	if !l.Flat {
+		root = filepath.Join(l.Dir, name)
+	}
+	var entries []fileEntry
+	targets := make(map[string]string) // link path to the path it points at
+	for _, f := range t.Info.Files {
+		if len(f.Path) == 0 {
+			return nil, errors.New("torrent has a file without a path")
+		}
+		path, err := joinNames(root, f.Path)
+		if err != nil {
+			return nil, err
+		}
+		e := fileEntry{path: path, length: f.Length, padding: f.IsPadding(), executable: f.IsExecutable()}
+		if f.IsSymlink() && !e.padding {
+			if targets[path], err = joinNames(root, f.SymlinkPath); err != nil {
+				return nil, fmt.Errorf("invalid symlink %q: %v", f.Path, err)
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	// Links may only point within the torrent's folder. The OS follows links
+	// already made on the way to a path, so nothing may lie inside a link,
+	// and targets must stay in the folder once the links they pass through
+	// are followed.
+	for i, e := range entries {
+		names := relNames(root, e.path)
+		dir := root
+		for _, name := range names[:len(names)-1] {
+			if dir = filepath.Join(dir, name); targets[dir] != "" {
+				return nil, fmt.Errorf("%s lies inside the symlink %s", e.path, dir)
+			}
+		}
+		target, ok := targets[e.path]
+		if !ok {
+			continue
+		}
+		resolved, err := resolveLinks(target, root, targets)
+		if err != nil {
+			return nil, fmt.Errorf("invalid symlink %s: %v", e.path, err)
+		}
+		if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+			return nil, fmt.Errorf("symlink %s points out of the torrent", e.path)
+		}
+		if entries[i].link, err = filepath.Rel(filepath.Dir(e.path), target); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// maxLinkHops bounds the links followed resolving a path, as the OS does
+const maxLinkHops = 40
+
+// resolveLinks returns where path under root leads once the torrent's own
+// links on the way, and in their targets, are followed
+func resolveLinks(path, root string, targets map[string]string) (string, error) {
+	resolved, rest := root, relNames(root, path)
+	for hops := 0; len(rest) > 0; {
+		resolved, rest = filepath.Join(resolved, rest[0]), rest[1:]
+		if target, ok := targets[resolved]; ok {
+			if hops++; hops > maxLinkHops {
+				return "", errors.New("too many levels of symlinks")
+			}
+			resolved, rest = root, append(relNames(root, target), rest...)
+		}
+	}
+	return resolved, nil
+}
+
+// relNames splits a path joined onto root from a torrent's names back into
+// those names
+func relNames(root, path string) []string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return nil
+	}
+	return strings.Split(rel, string(filepath.Separator))
+}
+
+// joinNames joins plain file names from a torrent onto dir
+func joinNames(dir string, names []string) (string, error) {
+	parts := []string{dir}
+	for _, name := range names {
+		if err := ValidateName(name); err != nil {
+			return "", err
+		}
+		parts = append(parts, name)
+	}
+	return filepath.Join(parts...), nil
+}
+
+// FileSpan is a torrent file: where it is saved and where its data lies in
+// the torrent
+type FileSpan struct {
+	Path   string
+	Offset int64 // Torrent offset of the file's first byte
+	Length int64
+}
+
+// FileSpans returns a torrent's files as laid out by l, in torrent order
+func FileSpans(t *torrent.TorrentFile, l Layout) ([]FileSpan, error) {
+	entries, err := fileEntries(t, l)
+	if err != nil {
+		return nil, err
+	}
+	spans := make([]FileSpan, len(entries))
+	var offset int64
+	for i, e := range entries {
+		spans[i] = FileSpan{Path: e.path, Offset: offset, Length: e.length}
+		offset += e.length
+	}
+	return spans, nil
+}
+
+// fileLengths returns the lengths of a torrent's files in torrent order
+func fileLengths(t *torrent.TorrentFile) []int64 {
+	if len(t.Info.Files) == 0 {
+		return []int64{t.Info.Length}
+	}
+	lengths := make([]int64, len(t.Info.Files))
+	for i, f := range t.Info.Files {
+		lengths[i] = f.Length
+	}
+	return lengths
+}
+
+// ValidateName checks that name can be used as a single file or folder name:
+// not empty, not "." or "..", and without path separators or NUL bytes
+func ValidateName(name string) error {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return fmt.Errorf("invalid file name %q", name)
+	case strings.ContainsAny(name, "/\\\x00"):
+		return fmt.Errorf("invalid file name %q: contains a path separator or NUL", name)
+	}
+	return nil
+}
+
+// WriteAt writes p at a torrent offset, spanning file boundaries as needed
+func (fs *Files) WriteAt(p []byte, off int64) (int, error) {
+	written := 0
+	for i, f := range fs.files {
+		length := fs.lengths[i]
+		if off >= length {
+			// The write starts after this file
+			off -= length
+			continue
+		}
+
+		n := min(int64(len(p)-written), length-off)
+		if f != nil {
+			if _, err := f.WriteAt(p[written:written+int(n)], off); err != nil {
+				return written, err
+			}
+		}
+		written += int(n)
+		off = 0
+
+		if written == len(p) {
+			return written, nil
+		}
+	}
+
+	return written, errors.New("write past end of torrent")
+}
+
+// ReadAt reads len(p) bytes at a torrent offset, spanning file boundaries as
+// needed
+func (fs *Files) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for i, f := range fs.files {
+		length := fs.lengths[i]
+		if off >= length {
+			off -= length
+			continue
+		}
+
+		n := min(int64(len(p)-read), length-off)
+		if f == nil {
+			clear(p[read : read+int(n)])
+		} else if _, err := f.ReadAt(p[read:read+int(n)], off); err != nil {
+			return read, err
+		}
+		read += int(n)
+		off = 0
+
+		if read == len(p) {
+			return read, nil
+		}
+	}
+
+	return read, errors.New("read past end of torrent")
+}
+
+// Close flushes all files to disk and closes them, so that pieces already
+// written survive a crash after the download stops
+func (fs *Files) Close() error {
+	var firstErr error
+	for _, f := range fs.files {
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
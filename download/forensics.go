@@ -0,0 +1,193 @@
+package download
+
+import (
+	"crypto/sha1"
+	"slices"
+	"sort"
+	"time"
+)
+
+// corruptRetryDelay is how long a peer that sent a piece failing its hash
+// check leaves the piece to other peers before it may download it again
+const corruptRetryDelay = 10 * time.Second
+
+// Suspect is a peer that sent pieces failing their hash check, and so may be
+// poisoning the swarm. A failed piece whose blocks all came from one peer is
+// down to that peer. When several peers sent blocks of it, their blocks are
+// quarantined, and the peer whose block differs from the copy that finally
+// passes is blamed.
+type Suspect struct {
+	IP       string // Peers are told apart by IP, since they reconnect from other ports
+	Client   string // Client software the peer last reported or was guessed from its ID
+	Failed   int    // Pieces from the peer that failed the hash check
+	Verified int    // Pieces from the peer that passed it
+	Pieces   []int  // Indexes of the pieces that failed, in the order they did
+	Banned   bool   // The peer was banned and isn't connected to again
+}
+
+// pieceSource is what the pieces from one peer IP hashed to
+type pieceSource struct {
+	client   string
+	failed   int
+	verified int
+	pieces   []int
+}
+
+// recordPiece notes the outcome of the hash check of a piece the peer at
+// host, running client, sent, and returns how many of its pieces failed
+func (s *Stats) recordPiece(host, client string, index int, ok bool) (failed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sources == nil {
+		s.sources = make(map[string]*pieceSource)
+	}
+	src := s.sources[host]
+	if src == nil {
+		src = &pieceSource{}
+		s.sources[host] = src
+	}
+	if client != "" {
+		src.client = client
+	}
+	if ok {
+		src.verified++
+		return src.failed
+	}
+	src.failed++
+	if !slices.Contains(src.pieces, index) {
+		src.pieces = append(src.pieces, index)
+	}
+	return src.failed
+}
+
+// Ban closes the connections to the peer at host, its IP, and keeps the task
+// from connecting to it again
+func (s *Stats) Ban(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.banned == nil {
+		s.banned = make(map[string]bool)
+	}
+	s.banned[host] = true
+	for c := range s.conns {
+		if c.host() == host {
+			c.conn.Close()
+		}
+	}
+}
+
+// Banned reports whether the peer at host was banned
+func (s *Stats) Banned(host string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.banned[host]
+}
+
+// Suspects returns the peers that sent pieces failing the hash check, the
+// most failures first, including peers no longer connected
+func (s *Stats) Suspects() []Suspect {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	suspects := []Suspect{}
+	for ip, src := range s.sources {
+		if src.failed == 0 {
+			continue
+		}
+		suspects = append(suspects, Suspect{
+			IP:       ip,
+			Client:   src.client,
+			Failed:   src.failed,
+			Verified: src.verified,
+			Pieces:   slices.Clone(src.pieces),
+			Banned:   s.banned[ip],
+		})
+	}
+	sort.Slice(suspects, func(i, j int) bool {
+		if suspects[i].Failed != suspects[j].Failed {
+			return suspects[i].Failed > suspects[j].Failed
+		}
+		return suspects[i].IP < suspects[j].IP
+	})
+	return suspects
+}
+
+// corruptFrom records that the copy of the piece from host failed the hash
+// check at now
+func (pw *pieceWork) corruptFrom(host string, now time.Time) {
+	if !slices.Contains(pw.failedBy, host) {
+		pw.failedBy = append(pw.failedBy, host)
+	}
+	pw.failedAt = now
+}
+
+// avoid reports whether a peer at host should leave the piece to other peers
+// at now, because its copy failed the hash check within corruptRetryDelay.
+// After that the peer may try again, in case no other peer has the piece.
+func (pw *pieceWork) avoid(host string, now time.Time) bool {
+	return now.Sub(pw.failedAt) < corruptRetryDelay && slices.Contains(pw.failedBy, host)
+}
+
+// quarantinedBlock is a block of a failed copy of a piece that several peers
+// sent blocks of, kept as a hash until the piece passes and shows whether
+// this block was the corrupt one
+type quarantinedBlock struct {
+	block int
+	host  string
+	sum   [20]byte
+}
+
+// numBlocks returns the number of blocks the piece is requested in
+func (pw *pieceWork) numBlocks() int {
+	return (pw.length + MaxBlockSize - 1) / MaxBlockSize
+}
+
+// sentWhole records that host sent every block of the piece at once, as a
+// web seed does, dropping any blocks kept from peers
+func (pw *pieceWork) sentWhole(host string) {
+	if pw.buf != nil {
+		pieceBuffers.put(pw.buf)
+		pw.buf = nil
+	}
+	pw.from = make([]string, pw.numBlocks())
+	for i := range pw.from {
+		pw.from[i] = host
+	}
+}
+
+// sources returns the hosts that sent blocks of the piece, in block order
+func (pw *pieceWork) sources() []string {
+	var hosts []string
+	for _, host := range pw.from {
+		if host != "" && !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// quarantineBlocks keeps the hash of each block of buf, a failed copy of the
+// piece, with the host that sent it
+func (pw *pieceWork) quarantineBlocks(buf []byte) {
+	for block, host := range pw.from {
+		begin := block * MaxBlockSize
+		pw.quarantine = append(pw.quarantine, quarantinedBlock{
+			block: block,
+			host:  host,
+			sum:   sha1.Sum(buf[begin:min(begin+MaxBlockSize, len(buf))]),
+		})
+	}
+}
+
+// corruptSources returns the hosts of the quarantined blocks that differ from
+// buf, the piece's verified data
+func (pw *pieceWork) corruptSources(buf []byte) []string {
+	var hosts []string
+	for _, q := range pw.quarantine {
+		begin := q.block * MaxBlockSize
+		if sha1.Sum(buf[begin:min(begin+MaxBlockSize, len(buf))]) != q.sum && !slices.Contains(hosts, q.host) {
+			hosts = append(hosts, q.host)
+		}
+	}
+	return hosts
+}
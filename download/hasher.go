@@ -0,0 +1,115 @@
+package download
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+
+	"github.com/omkarkirpan/bittorrent-client/clock"
+)
+
+// hashJob is a downloaded piece waiting for its hash check
+type hashJob struct {
+	pw   *pieceWork
+	buf  []byte
+	peer *peerConn    // the peer that sent the last block of the piece, if not a web seed
+	seed *webSeed     // the web seed it was fetched from, if not a peer
+	log  *slog.Logger // the downloading peer's logger
+}
+
+// client returns the client of host, one of the piece's sources, if known
+func (job *hashJob) client(host string) string {
+	switch {
+	case job.seed != nil && host == job.seed.host:
+		return "web seed"
+	case job.peer != nil && host == job.peer.host():
+		return job.peer.clientName()
+	}
+	return ""
+}
+
+// hashQueueSize is how many downloaded pieces may wait for a hasher per
+// hashing goroutine before workers block
+const hashQueueSize = 2
+
+// startHashers starts n goroutines, or one per CPU if n is 0, that check the
+// pieces sent on the returned channel until ctx is done. Verified pieces go to
+// results and failed ones back on workQueue, so peer workers keep reading
+// while pieces are hashed.
+func (t *Task) startHashers(ctx context.Context, n int, workQueue chan<- *pieceWork, results chan<- *pieceResult) chan<- *hashJob {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	jobs := make(chan *hashJob, n*hashQueueSize)
+	for i := 0; i < n; i++ {
+		go func() {
+			for {
+				select {
+				case job := <-jobs:
+					t.check(ctx, job, workQueue, results)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	return jobs
+}
+
+// check verifies a downloaded piece and hands it on. A failed piece is
+// blamed on the peer that sent it, or quarantined when several did, and
+// requeued for peers that didn't send it.
+func (t *Task) check(ctx context.Context, job *hashJob, workQueue chan<- *pieceWork, results chan<- *pieceResult) {
+	pw := job.pw
+	err := checkPiece(pw.index, job.buf, pw.hash)
+	if t.PieceChecked != nil {
+		t.PieceChecked(pw.index, err == nil)
+	}
+	hosts := pw.sources()
+	if err != nil {
+		t.Stats.HashFailures.Add(1)
+		t.Stats.Wasted.Add(int64(len(job.buf)))
+		now := clock.Or(t.Clock).Now()
+		for _, host := range hosts {
+			pw.corruptFrom(host, now)
+		}
+		job.log.Warn("piece failed hash check", "piece", pw.index, "sources", len(hosts), "error", err)
+		if len(hosts) == 1 {
+			t.blame(job, hosts[0])
+		} else {
+			// Which of them sent the corrupt block shows once the piece passes
+			pw.quarantineBlocks(job.buf)
+		}
+		pw.from = nil
+		pieceBuffers.put(job.buf)
+		workQueue <- pw
+		return
+	}
+	t.Stats.Verified.Add(1)
+	for _, host := range hosts {
+		t.Stats.recordPiece(host, job.client(host), pw.index, true)
+	}
+	for _, host := range pw.corruptSources(job.buf) {
+		t.blame(job, host)
+	}
+	pw.from, pw.quarantine = nil, nil
+
+	select {
+	case results <- &pieceResult{index: pw.index, buf: job.buf}:
+	case <-ctx.Done():
+	}
+}
+
+// blame records that host sent a corrupt copy of the job's piece, and bans it
+// once BanAfter of its pieces failed, unless it's a web seed
+func (t *Task) blame(job *hashJob, host string) {
+	failed := t.Stats.recordPiece(host, job.client(host), job.pw.index, false)
+	webSeed := job.seed != nil && host == job.seed.host
+	if !webSeed && t.BanAfter > 0 && failed == t.BanAfter {
+		job.log.Warn("peer banned", "host", host, "failed_pieces", failed)
+		t.Stats.Ban(host)
+		if t.PeerBanned != nil {
+			t.PeerBanned(host)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package download
+
+import (
+	"github.com/omkarkirpan/bittorrent-client/peer"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+)
+
+// Holepunch extension (BEP 55)
+const (
+	holepunchID          = 4 // ID we assign to ut_holepunch in our extension handshake
+	holepunchMaxConnects = 8 // connect messages we act on per relay, so one can't make us dial at will
+)
+
+// holepunchAddr returns the address other peers should reach the peer at:
+// the one it accepts connections on if known, else the one it connected
+// from, which is what its NAT maps to it
+func (c *peerConn) holepunchAddr() string {
+	if addr := c.pexAddr(); addr != "" {
+		return addr
+	}
+	return c.conn.RemoteAddr().String()
+}
+
+// holepunchMessage sends the peer a ut_holepunch message about addr,
+// without waiting if it's slow. Peers that didn't offer ut_holepunch get
+// nothing.
+func (c *peerConn) holepunchMessage(typ peer.HolepunchType, addr string, code peer.HolepunchErr) {
+	p := peerFromAddr(addr)
+	m := &peer.HolepunchMessage{Type: typ, IP: p.IP, Port: p.Port, Err: code}
+	if msg, err := c.ext.Message("ut_holepunch", m.Encode()); err == nil {
+		go c.send(msg)
+	}
+}
+
+// receiveHolepunch handles a ut_holepunch message; a malformed one is
+// ignored. A rendezvous asks us to relay, a connect is a relay's answer to
+// ours, or another peer's rendezvous with us, and an error says why the
+// relay couldn't help.
+func (c *peerConn) receiveHolepunch(payload []byte) error {
+	m, err := peer.ParseHolepunch(payload)
+	if err != nil || c.stats == nil {
+		return nil
+	}
+	switch m.Type {
+	case peer.HolepunchRendezvous:
+		c.stats.relayHolepunch(c, m)
+	case peer.HolepunchConnect:
+		if c.holepunchConnect == nil || c.holepunches >= holepunchMaxConnects || m.Port == 0 {
+			break
+		}
+		c.holepunches++
+		c.log.Debug("holepunch connect", "to", m.Addr())
+		c.holepunchConnect(tracker.Peer{IP: m.IP, Port: m.Port})
+	case peer.HolepunchError:
+		c.log.Debug("holepunch refused", "to", m.Addr(), "error", m.Err)
+	}
+	return nil
+}
+
+// holepunchRelays records which peers a connected peer that supports
+// ut_holepunch told us about through peer exchange, so it can introduce us
+// to those we can't connect to
+func (s *Stats) holepunchRelays(c *peerConn, m *pexMessage) {
+	if !c.ext.Supports("ut_holepunch") {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[c]; !ok {
+		return
+	}
+	if s.relays == nil {
+		s.relays = make(map[string]*peerConn)
+	}
+	for i, p := range m.added {
+		if m.addedFlags[i]&pexHolepunch != 0 {
+			s.relays[p.String()] = c
+		}
+	}
+	for _, p := range m.dropped {
+		if s.relays[p.String()] == c {
+			delete(s.relays, p.String())
+		}
+	}
+}
+
+// rendezvous asks the connected peer that told us about the peer at addr to
+// introduce us, so both connect to each other at once through our NATs. It
+// reports whether a relay was asked; each address is only tried once.
+func (s *Stats) rendezvous(addr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	relay := s.relays[addr]
+	if _, ok := s.conns[relay]; !ok || s.punched[addr] {
+		return false
+	}
+	if s.punched == nil {
+		s.punched = make(map[string]bool)
+	}
+	s.punched[addr] = true
+	relay.holepunchMessage(peer.HolepunchRendezvous, addr, 0)
+	return true
+}
+
+// relayHolepunch answers a rendezvous from c with the peer at the message's
+// address: if we're connected to that peer and it supports ut_holepunch,
+// both are told to connect to each other; otherwise c is told why not
+func (s *Stats) relayHolepunch(c *peerConn, m *peer.HolepunchMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr := m.Addr()
+	if m.Port == 0 || m.IP.IsUnspecified() {
+		c.holepunchMessage(peer.HolepunchError, addr, peer.HolepunchNoSuchPeer)
+		return
+	}
+	if addr == c.holepunchAddr() {
+		c.holepunchMessage(peer.HolepunchError, addr, peer.HolepunchNoSelf)
+		return
+	}
+	var target *peerConn
+	for other := range s.conns {
+		if other != c && (other.holepunchAddr() == addr || other.conn.RemoteAddr().String() == addr) {
+			target = other
+			break
+		}
+	}
+	switch {
+	case target == nil:
+		c.holepunchMessage(peer.HolepunchError, addr, peer.HolepunchNotConnected)
+	case !target.ext.Supports("ut_holepunch"):
+		c.holepunchMessage(peer.HolepunchError, addr, peer.HolepunchNoSupport)
+	default:
+		target.holepunchMessage(peer.HolepunchConnect, c.holepunchAddr(), 0)
+		c.holepunchMessage(peer.HolepunchConnect, target.holepunchAddr(), 0)
+	}
+}
+
+// forgetRelay drops the addresses a disconnected peer could introduce us to.
+// s.mu must be held.
+func (s *Stats) forgetRelay(c *peerConn) {
+	for addr, relay := range s.relays {
+		if relay == c {
+			delete(s.relays, addr)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package download
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+)
+
+// Peer exchange (BEP 11)
+const (
+	pexID       = 2           // ID we assign to ut_pex in our extension handshake
+	pexMaxPeers = 50          // Peers added, and dropped, per message
+	pexInterval = time.Minute // BEP 11 asks for at most one message a minute
+)
+
+// Flags of added peers
+const (
+	pexSeed        = 0x02 // the peer has every piece
+	pexHolepunch   = 0x08 // the peer supports ut_holepunch (BEP 55)
+	pexConnectable = 0x10 // the peer accepts incoming connections
+)
+
+// pexMessage is a ut_pex message: the peers the sender connected to and
+// dropped since its last message
+type pexMessage struct {
+	added, dropped []tracker.Peer
+	addedFlags     []byte // one per added peer
+}
+
+// parsePEX parses a ut_pex payload, merging the IPv4 and IPv6 lists
+func parsePEX(payload []byte) (*pexMessage, error) {
+	decoded, _, err := bencode.Decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("ut_pex message is not a dictionary")
+	}
+	m := &pexMessage{}
+	for _, family := range []struct {
+		suffix string
+		ipLen  int
+	}{{"", net.IPv4len}, {"6", net.IPv6len}} {
+		added, _ := dict["added"+family.suffix].(string)
+		flags, _ := dict["added"+family.suffix+".f"].(string)
+		peers := decodePeers(added, family.ipLen)
+		for i := range peers {
+			var f byte
+			if i < len(flags) {
+				f = flags[i]
+			}
+			m.addedFlags = append(m.addedFlags, f)
+		}
+		m.added = append(m.added, peers...)
+		dropped, _ := dict["dropped"+family.suffix].(string)
+		m.dropped = append(m.dropped, decodePeers(dropped, family.ipLen)...)
+	}
+	return m, nil
+}
+
+// encode bencodes the message, splitting the peers by address family
+func (m *pexMessage) encode() []byte {
+	var added, added6, flags, flags6, dropped, dropped6 []byte
+	for i, p := range m.added {
+		if ip4 := p.IP.To4(); ip4 != nil {
+			added = binary.BigEndian.AppendUint16(append(added, ip4...), p.Port)
+			flags = append(flags, m.addedFlags[i])
+		} else if ip6 := p.IP.To16(); ip6 != nil {
+			added6 = binary.BigEndian.AppendUint16(append(added6, ip6...), p.Port)
+			flags6 = append(flags6, m.addedFlags[i])
+		}
+	}
+	for _, p := range m.dropped {
+		if ip4 := p.IP.To4(); ip4 != nil {
+			dropped = binary.BigEndian.AppendUint16(append(dropped, ip4...), p.Port)
+		} else if ip6 := p.IP.To16(); ip6 != nil {
+			dropped6 = binary.BigEndian.AppendUint16(append(dropped6, ip6...), p.Port)
+		}
+	}
+	payload, _ := bencode.EncodeDict(map[string]interface{}{
+		"added":    string(added),
+		"added.f":  string(flags),
+		"added6":   string(added6),
+		"added6.f": string(flags6),
+		"dropped":  string(dropped),
+		"dropped6": string(dropped6),
+	})
+	return payload
+}
+
+// decodePeers unpacks compact peers with ipLen byte addresses, skipping a
+// trailing partial entry and port 0
+func decodePeers(compact string, ipLen int) []tracker.Peer {
+	var peers []tracker.Peer
+	for i := 0; i+ipLen+2 <= len(compact); i += ipLen + 2 {
+		ip := net.IP([]byte(compact[i : i+ipLen]))
+		port := binary.BigEndian.Uint16([]byte(compact[i+ipLen : i+ipLen+2]))
+		if port != 0 {
+			peers = append(peers, tracker.Peer{IP: ip, Port: port})
+		}
+	}
+	return peers
+}
+
+// receivePEX handles a ut_pex message, passing on the peers added; a
+// malformed one is ignored. Peers beyond pexMaxPeers are dropped, so one peer
+// can't flood us.
+func (c *peerConn) receivePEX(payload []byte) error {
+	m, err := parsePEX(payload)
+	if err != nil || len(m.added) == 0 || c.pexReceived == nil {
+		return nil
+	}
+	if len(m.added) > pexMaxPeers {
+		m.added, m.addedFlags = m.added[:pexMaxPeers], m.addedFlags[:pexMaxPeers]
+	}
+	if c.stats != nil {
+		c.stats.holepunchRelays(c, m)
+	}
+	c.pexReceived(m.added)
+	return nil
+}
+
+// pexAddr returns the address the peer accepts connections on: the one we
+// dialed, or for a peer that dialed us, its IP and the port from its
+// extension handshake. It is empty when unknown.
+func (c *peerConn) pexAddr() string {
+	ip := c.remoteIP()
+	if ip == nil {
+		return ""
+	}
+	if !c.incoming {
+		return c.conn.RemoteAddr().String()
+	}
+	if port := c.listenPort.Load(); port != 0 {
+		return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+	}
+	return ""
+}
+
+// sendPEX tells every connected peer that supports ut_pex which peers we
+// connected to and dropped since we last told it, up to pexMaxPeers of each.
+// Peers are never told about themselves.
+func (s *Stats) sendPEX() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The peers we could tell about, and their flags
+	current := make(map[string]byte)
+	for c := range s.conns {
+		if addr := c.pexAddr(); addr != "" {
+			var flags byte = pexConnectable
+			if c.seed.Load() {
+				flags |= pexSeed
+			}
+			if c.ext.Supports("ut_holepunch") {
+				flags |= pexHolepunch
+			}
+			current[addr] = flags
+		}
+	}
+
+	for c := range s.conns {
+		if !c.ext.Supports("ut_pex") {
+			continue
+		}
+		self := c.pexAddr()
+		m := &pexMessage{}
+		for addr, flags := range current {
+			if addr != self && !c.pexSent[addr] && len(m.added) < pexMaxPeers {
+				m.added = append(m.added, peerFromAddr(addr))
+				m.addedFlags = append(m.addedFlags, flags)
+			}
+		}
+		for addr := range c.pexSent {
+			if _, ok := current[addr]; !ok && len(m.dropped) < pexMaxPeers {
+				m.dropped = append(m.dropped, peerFromAddr(addr))
+			}
+		}
+		if len(m.added) == 0 && len(m.dropped) == 0 {
+			continue
+		}
+
+		if c.pexSent == nil {
+			c.pexSent = make(map[string]bool)
+		}
+		for _, p := range m.added {
+			c.pexSent[p.String()] = true
+		}
+		for _, p := range m.dropped {
+			delete(c.pexSent, p.String())
+		}
+		if msg, err := c.ext.Message("ut_pex", m.encode()); err == nil {
+			go c.send(msg)
+		}
+	}
+}
+
+// peerFromAddr parses a host:port address made by pexAddr
+func peerFromAddr(addr string) tracker.Peer {
+	host, port, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(port)
+	return tracker.Peer{IP: net.ParseIP(host), Port: uint16(n)}
+}
@@ -0,0 +1,63 @@
+package download
+
+import (
+	"fmt"
+
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// Priority says whether and how eagerly a file or piece is downloaded
+type Priority int8
+
+const (
+	PrioritySkip   Priority = -1 // Not downloaded
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1 // Queued before normal pieces
+)
+
+// PiecePriorities maps file priorities, one per file in torrent order, to
+// piece priorities. A piece takes the highest priority of the files it
+// overlaps, so the pieces at the edges of a skipped file are still fetched
+// for the wanted files next to it.
+func PiecePriorities(t *torrent.TorrentFile, files []Priority) ([]Priority, error) {
+	lengths := fileLengths(t)
+	if len(files) != len(lengths) {
+		return nil, fmt.Errorf("got %d file priorities for %d files", len(files), len(lengths))
+	}
+
+	pieces := make([]Priority, t.NumPieces())
+	for i := range pieces {
+		pieces[i] = PrioritySkip
+	}
+	var start int64 // torrent offset of the current file
+	for i, length := range lengths {
+		end := start + length
+		if length > 0 {
+			for piece := int(start / t.Info.PieceLength); piece < len(pieces) && int64(piece)*t.Info.PieceLength < end; piece++ {
+				pieces[piece] = max(pieces[piece], files[i])
+			}
+		}
+		start = end
+	}
+	return pieces, nil
+}
+
+// PrioritizeFileEdges raises the first and last piece of every wanted file
+// to PriorityHigh, so a media player gets a file's header and index before
+// the rest of it arrives in order. files holds one priority per file as for
+// PiecePriorities, or is nil if every file is wanted.
+func PrioritizeFileEdges(t *torrent.TorrentFile, files, pieces []Priority) {
+	var start int64
+	for i, length := range fileLengths(t) {
+		end := start + length
+		if length > 0 && (files == nil || files[i] != PrioritySkip) {
+			first, last := int(start/t.Info.PieceLength), int((end-1)/t.Info.PieceLength)
+			for _, piece := range []int{first, last} {
+				if piece < len(pieces) {
+					pieces[piece] = PriorityHigh
+				}
+			}
+		}
+		start = end
+	}
+}
@@ -0,0 +1,102 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+	"github.com/omkarkirpan/bittorrent-client/peer"
+)
+
+// ResumePath returns where resume data for a torrent is kept in its download
+// directory when there's no state directory to keep it in
+func ResumePath(dir string, infoHash [20]byte) string {
+	return filepath.Join(dir, fmt.Sprintf(".%x.resume", infoHash))
+}
+
+// SaveResume records which pieces of a torrent are on disk at root, the
+// file or folder given by Layout.Root, so a later download can skip them
+// without hashing the data again. files, as FileProgress returns it, is
+// recorded for tools reading the file; it may be nil.
+func SaveResume(path string, infoHash [20]byte, root string, have []bool, files []int64) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	bf := peer.NewBitfield(len(have))
+	for i, ok := range have {
+		if ok {
+			bf.SetPiece(i)
+		}
+	}
+
+	dict := map[string]interface{}{
+		"info hash": string(infoHash[:]),
+		"pieces":    len(have),
+		"bitfield":  string(bf),
+		"root":      root,
+	}
+	if files != nil {
+		progress := make([]interface{}, len(files))
+		for i, n := range files {
+			progress[i] = n
+		}
+		dict["files"] = progress
+	}
+	data, err := bencode.EncodeDict(dict)
+	if err != nil {
+		return err
+	}
+
+	// Write a temporary file first so a crash can't leave half a file behind
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadResume reads resume data written by SaveResume. It fails if the data
+// belongs to another torrent, describes data at another root, or the piece
+// count doesn't match.
+func LoadResume(path string, infoHash [20]byte, root string, numPieces int) ([]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, _, err := bencode.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resume data: %v", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid resume data: not a dictionary")
+	}
+	hash, _ := dict["info hash"].(string)
+	pieces, _ := dict["pieces"].(int64)
+	bf, _ := dict["bitfield"].(string)
+	if hash != string(infoHash[:]) {
+		return nil, errors.New("resume data is for another torrent")
+	}
+	// Data written before roots were recorded has none
+	if saved, _ := dict["root"].(string); saved != "" {
+		if root, err := filepath.Abs(root); err != nil || root != saved {
+			return nil, fmt.Errorf("resume data is for %s", saved)
+		}
+	}
+	if pieces != int64(numPieces) || len(bf) != (numPieces+7)/8 {
+		return nil, fmt.Errorf("resume data has %d pieces, expected %d", pieces, numPieces)
+	}
+
+	have := make([]bool, numPieces)
+	for i := range have {
+		have[i] = peer.Bitfield(bf).HasPiece(i)
+	}
+	return have, nil
+}
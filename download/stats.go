@@ -0,0 +1,285 @@
+package download
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/peer"
+)
+
+// Stats counts the activity of a running Task. The counters may be read at
+// any time while the task runs.
+type Stats struct {
+	Downloaded   atomic.Int64 // Block data received, including pieces that later fail verification
+	Uploaded     atomic.Int64 // Piece data sent to peers
+	Peers        atomic.Int32 // Connected peers
+	Seeds        atomic.Int32 // Connected peers that have every piece
+	Verified     atomic.Int64 // Pieces that passed the hash check
+	HashFailures atomic.Int64 // Pieces that failed the hash check
+	Wasted       atomic.Int64 // Piece data discarded because it failed the hash check
+
+	mu      sync.Mutex
+	conns   map[*peerConn]struct{}
+	queue   chan *pieceWork         // pieces waiting for a worker
+	sources map[string]*pieceSource // hash check outcomes by peer host
+	banned  map[string]bool         // hosts not to connect to again
+	avail   []int                   // connected peers having each piece
+	relays  map[string]*peerConn    // peers that can introduce us to the peer at an address (BEP 55)
+	punched map[string]bool         // addresses we asked a relay to introduce us to
+}
+
+// PeerInfo describes a connected peer
+type PeerInfo struct {
+	Addr         string
+	PeerID       [20]byte
+	Client       string        // Client software the peer reports, or guessed from its peer ID; empty if unknown
+	Incoming     bool          // The peer connected to us
+	Downloaded   int64         // Block data received from this peer
+	Uploaded     int64         // Block data sent to this peer
+	DownloadRate float64       // Recent download speed from this peer in bytes per second
+	UploadRate   float64       // Recent upload speed to this peer in bytes per second
+	Progress     float64       // Fraction of the pieces the peer has, from 0 to 1
+	Seed         bool          // The peer has every piece
+	UploadOnly   bool          // The peer only uploads, e.g. as a partial seed (BEP 21)
+	Choked       bool          // The peer is choking us
+	Interested   bool          // The peer wants pieces from us
+	Piece        int           // Piece being downloaded from the peer, -1 when idle
+	Requests     int           // Block requests in flight to the peer
+	Latency      time.Duration // Smoothed time from requesting a block to receiving it; 0 until one arrived
+}
+
+// PeerList returns the currently connected peers
+func (s *Stats) PeerList() []PeerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := make([]PeerInfo, 0, len(s.conns))
+	for c := range s.conns {
+		var progress float64
+		if c.numPieces > 0 {
+			progress = min(float64(c.have.Load())/float64(c.numPieces), 1)
+		}
+		peers = append(peers, PeerInfo{
+			Addr:         c.conn.RemoteAddr().String(),
+			PeerID:       c.peerID,
+			Client:       c.clientName(),
+			Incoming:     c.incoming,
+			Downloaded:   c.downloaded.Load(),
+			Uploaded:     c.uploaded.Load(),
+			DownloadRate: c.downRate,
+			UploadRate:   c.upRate,
+			Progress:     progress,
+			Seed:         c.seed.Load(),
+			UploadOnly:   c.uploadOnly.Load(),
+			Choked:       c.choked.Load(),
+			Interested:   c.interested.Load(),
+			Piece:        int(c.piece.Load()),
+			Requests:     int(c.requests.Load()),
+			Latency:      time.Duration(c.latency.Load()),
+		})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Addr < peers[j].Addr })
+	return peers
+}
+
+// SampleRates updates each peer's transfer rates with the bytes moved over
+// elapsed, giving the newest sample the weight smoothing
+func (s *Stats) SampleRates(elapsed time.Duration, smoothing float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seconds := elapsed.Seconds()
+	for c := range s.conns {
+		down, up := c.downloaded.Load(), c.uploaded.Load()
+		c.downRate += smoothing * (float64(down-c.lastDown)/seconds - c.downRate)
+		c.upRate += smoothing * (float64(up-c.lastUp)/seconds - c.upRate)
+		c.lastDown, c.lastUp = down, up
+	}
+}
+
+// Queued returns the number of pieces waiting for a peer to download them.
+// Pieces being downloaded are listed per peer by PeerList.
+func (s *Stats) Queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// Prioritize moves pieces to the front of the running task's queue, in the
+// order given, so the next idle peers download them first, e.g. the pieces
+// a media player is about to read. Pieces that aren't queued, because they
+// are being downloaded or are written already, are left alone.
+func (s *Stats) Prioritize(pieces []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queue == nil || len(pieces) == 0 {
+		return
+	}
+
+	// Take out everything queued and put it back reordered. Workers finding
+	// the queue empty meanwhile idle briefly; the refill can't block, as no
+	// piece is ever queued twice.
+	var queued []*pieceWork
+	for drained := false; !drained; {
+		select {
+		case pw := <-s.queue:
+			queued = append(queued, pw)
+		default:
+			drained = true
+		}
+	}
+	rank := make(map[int]int, len(pieces))
+	for i, index := range pieces {
+		if _, ok := rank[index]; !ok {
+			rank[index] = i
+		}
+	}
+	sort.SliceStable(queued, func(i, j int) bool {
+		ri, oki := rank[queued[i].index]
+		rj, okj := rank[queued[j].index]
+		return oki && (!okj || ri < rj)
+	})
+	for _, pw := range queued {
+		s.queue <- pw
+	}
+}
+
+// setQueue records the work queue of the running task
+func (s *Stats) setQueue(queue chan *pieceWork) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = queue
+}
+
+// addPeer counts a connected peer
+func (s *Stats) addPeer(c *peerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[*peerConn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	s.Peers.Add(1)
+	s.countPieces(c.bitfield, c.numPieces, 1)
+}
+
+// addUnique counts a connected peer like addPeer, unless we're already
+// connected to the same peer over another connection, as happens when two
+// peers dial each other at once. Then only the connection both sides prefer
+// is kept, and the other is returned to be closed.
+func (s *Stats) addUnique(c *peerConn, ourID [20]byte) (drop *peerConn) {
+	s.mu.Lock()
+	for other := range s.conns {
+		if !other.sameAs(c) {
+			continue
+		}
+		if preferConn(other, c, ourID) == other {
+			s.mu.Unlock()
+			return c
+		}
+		drop = other
+		break
+	}
+	s.mu.Unlock()
+	s.addPeer(c)
+	return drop
+}
+
+// broadcast sends msg to every connected peer without waiting for slow ones
+func (s *Stats) broadcast(msg *peer.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		go c.send(msg)
+	}
+}
+
+// broadcastExtHandshake sends our extension handshake again to every
+// connected peer that supports the extension protocol, without waiting for
+// slow ones
+func (s *Stats) broadcastExtHandshake(uploadOnly bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		if c.extended {
+			go c.send(c.extHandshake(uploadOnly))
+		}
+	}
+}
+
+// removePeer forgets a disconnected peer
+func (s *Stats) removePeer(c *peerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+	s.Peers.Add(-1)
+	if c.seed.Load() {
+		s.Seeds.Add(-1)
+	}
+	s.countPieces(c.bitfield, c.numPieces, -1)
+	s.forgetRelay(c)
+}
+
+// Availability returns how many connected peers have each piece, indexed by
+// piece. It is nil until a peer connects.
+func (s *Stats) Availability() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.avail)
+}
+
+// countPieces adds delta to the availability of each of numPieces pieces
+// set in bf. s.mu must be held.
+func (s *Stats) countPieces(bf peer.Bitfield, numPieces, delta int) {
+	if len(s.avail) < numPieces {
+		s.avail = append(s.avail, make([]int, numPieces-len(s.avail))...)
+	}
+	for i := range numPieces {
+		if bf.HasPiece(i) {
+			s.avail[i] += delta
+		}
+	}
+}
+
+// piecesChanged updates the availability for a connected peer whose pieces
+// changed from old to its current bitfield
+func (s *Stats) piecesChanged(c *peerConn, old peer.Bitfield) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[c]; !ok {
+		return
+	}
+	s.countPieces(old, c.numPieces, -1)
+	s.countPieces(c.bitfield, c.numPieces, 1)
+}
+
+// pieceAdded counts a piece a connected peer announced with HAVE
+func (s *Stats) pieceAdded(c *peerConn, index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[c]; ok && index < len(s.avail) {
+		s.avail[index]++
+	}
+}
+
+// DistributedCopies returns how many whole copies of the torrent the
+// availability counts add up to: the fewest peers having any piece, plus the
+// fraction of pieces more peers have. 2.7 means every piece is available
+// twice and 70% of them three times; below 1 some piece is available from
+// no peer.
+func DistributedCopies(avail []int) float64 {
+	if len(avail) == 0 {
+		return 0
+	}
+	least := slices.Min(avail)
+	more := 0
+	for _, n := range avail {
+		if n > least {
+			more++
+		}
+	}
+	return float64(least) + float64(more)/float64(len(avail))
+}
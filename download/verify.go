@@ -0,0 +1,228 @@
+package download
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/omkarkirpan/bittorrent-client/peer"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// VerifyResult is the outcome of checking a torrent's data on disk
+type VerifyResult struct {
+	Have    []bool // Pieces whose data matches their hash
+	Corrupt []int  // Pieces with data on disk that doesn't match their hash
+}
+
+// Bitfield returns the verified pieces as a bitfield, as peers are sent it
+func (r *VerifyResult) Bitfield() peer.Bitfield {
+	bf := peer.NewBitfield(len(r.Have))
+	for i, have := range r.Have {
+		if have {
+			bf.SetPiece(i)
+		}
+	}
+	return bf
+}
+
+// verifyMemory bounds the piece data read ahead for the hashers, though at
+// least two pieces are
+const verifyMemory = 64 << 20
+
+// VerifyOptions configures VerifyWith
+type VerifyOptions struct {
+	// HashWorkers is how many pieces are hashed at once while the next ones
+	// are read; 0 means one per CPU
+	HashWorkers int
+
+	// Progress, if set, is called after each piece is hashed. Calls don't
+	// overlap, but may come from different goroutines.
+	Progress func(done, total int)
+}
+
+// Verify hashes the torrent's data, laid out by l as CreateFiles does,
+// against the piece hashes. Pieces in missing or short files, or that are
+// still all zeros, count as missing rather than corrupt. Progress, if set, is
+// called after each piece.
+func Verify(t *torrent.TorrentFile, l Layout, progress func(done, total int)) (*VerifyResult, error) {
+	return VerifyWith(t, l, VerifyOptions{Progress: progress})
+}
+
+// VerifyWith is like Verify, with options. Pieces are read in order and
+// hashed by workers in parallel, with a few read ahead so the disk and CPUs
+// are both busy.
+func VerifyWith(t *torrent.TorrentFile, l Layout, opts VerifyOptions) (*VerifyResult, error) {
+	entries, err := fileEntries(t, l)
+	if err != nil {
+		return nil, err
+	}
+
+	// Missing files stay nil, so the pieces in them count as missing.
+	// Padding files and symlinks hold nothing on disk to read.
+	files := make([]*os.File, len(entries))
+	for i, e := range entries {
+		if e.padding || e.link != "" {
+			continue
+		}
+		f, err := os.Open(e.path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			closeAll(files)
+			return nil, fmt.Errorf("%w: %v", ErrStorage, err)
+		}
+		files[i] = f
+	}
+	defer closeAll(files)
+
+	workers := opts.HashWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	inFlight := max(2, min(2*workers, int(verifyMemory/t.Info.PieceLength)))
+	workers = min(workers, inFlight)
+
+	// Buffers go round between the reader and the hashers; there are never
+	// more than inFlight, so returning one never blocks
+	buffers := make(chan []byte, inFlight)
+	for i := 0; i < inFlight; i++ {
+		buffers <- make([]byte, t.Info.PieceLength)
+	}
+	type piece struct {
+		index    int
+		hash     [20]byte
+		data     []byte
+		complete bool
+	}
+	jobs := make(chan piece)
+
+	numPieces := t.NumPieces()
+	result := &VerifyResult{Have: make([]bool, numPieces)}
+	corrupt := make([]bool, numPieces)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		hashed int
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				switch {
+				case p.complete && sha1.Sum(p.data) == p.hash:
+					result.Have[p.index] = true
+				case p.complete && !allZero(p.data):
+					corrupt[p.index] = true
+				}
+				buffers <- p.data[:cap(p.data)]
+				if opts.Progress != nil {
+					mu.Lock()
+					hashed++
+					opts.Progress(hashed, numPieces)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < numPieces && err == nil; i++ {
+		var hash [20]byte
+		if hash, err = t.PieceHash(i); err != nil {
+			break
+		}
+		buf := <-buffers
+		data := buf[:t.PieceLength(i)]
+		complete, readErr := readPiece(files, entries, data, int64(i)*t.Info.PieceLength)
+		if readErr != nil {
+			err = fmt.Errorf("%w: failed to read piece %d: %v", ErrStorage, i, readErr)
+			break
+		}
+		jobs <- piece{index: i, hash: hash, data: data, complete: complete}
+	}
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, bad := range corrupt {
+		if bad {
+			result.Corrupt = append(result.Corrupt, i)
+		}
+	}
+	return result, nil
+}
+
+// readPiece reads a piece at a torrent offset across the files. It reports
+// false if part of the piece is in a missing or short file.
+func readPiece(files []*os.File, entries []fileEntry, p []byte, off int64) (bool, error) {
+	read := 0
+	for i, e := range entries {
+		if off >= e.length {
+			off -= e.length
+			continue
+		}
+		n := min(int64(len(p)-read), e.length-off)
+		if e.padding {
+			clear(p[read : read+int(n)])
+		} else if files[i] == nil {
+			return false, nil
+		} else if _, err := files[i].ReadAt(p[read:read+int(n)], off); err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		read += int(n)
+		off = 0
+
+		if read == len(p) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// allZero reports whether p holds only zero bytes, as space we preallocated
+// but never wrote does
+func allZero(p []byte) bool {
+	return len(bytes.Trim(p, "\x00")) == 0
+}
+
+// closeAll closes the files that are open
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// FileProgress returns, for each file of the torrent in order, how many of
+// its bytes lie in pieces marked in have
+func FileProgress(t *torrent.TorrentFile, have []bool) []int64 {
+	lengths := fileLengths(t)
+	done := make([]int64, len(lengths))
+
+	var start int64 // torrent offset of the current file
+	for i, length := range lengths {
+		end := start + length
+		for piece := int(start / t.Info.PieceLength); piece < len(have) && int64(piece)*t.Info.PieceLength < end; piece++ {
+			if !have[piece] {
+				continue
+			}
+			pieceStart := int64(piece) * t.Info.PieceLength
+			pieceEnd := pieceStart + t.PieceLength(piece)
+			done[i] += min(end, pieceEnd) - max(start, pieceStart)
+		}
+		start = end
+	}
+	return done
+}
@@ -0,0 +1,193 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/clock"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// Web seed tuning constants
+const (
+	webSeedRetry       = 5 * time.Second // Wait after a failed request, doubling with each failure in a row
+	maxWebSeedFailures = 5               // Failed requests in a row before a web seed is given up on
+)
+
+// webSeed is an HTTP server holding the torrent's content (BEP 19). Pieces
+// are fetched from it with range requests on the files they span.
+type webSeed struct {
+	url    string
+	host   string
+	files  []webFile
+	client *http.Client
+}
+
+// webFile is a torrent file on a web seed
+type webFile struct {
+	url    string
+	offset int64 // Torrent offset of the file's first byte
+	length int64
+	pad    bool // Padding, which servers don't have (BEP 47)
+}
+
+// newWebSeed returns the web seed at rawURL. A single-file torrent's URL
+// names the file itself, unless it ends in a slash; a multi-file torrent's
+// names the folder holding the torrent's folder.
+func newWebSeed(t *torrent.TorrentFile, rawURL string, client *http.Client) (*webSeed, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid web seed URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported web seed URL %q", rawURL)
+	}
+
+	ws := &webSeed{url: rawURL, host: u.Host, client: client}
+	if len(t.Info.Files) == 0 {
+		fileURL := rawURL
+		if strings.HasSuffix(rawURL, "/") {
+			fileURL += url.PathEscape(t.Info.Name)
+		}
+		ws.files = []webFile{{url: fileURL, length: t.Info.Length}}
+		return ws, nil
+	}
+
+	base := strings.TrimSuffix(rawURL, "/") + "/" + url.PathEscape(t.Info.Name)
+	var offset int64
+	for _, f := range t.Info.Files {
+		parts := make([]string, len(f.Path))
+		for i, part := range f.Path {
+			parts[i] = url.PathEscape(part)
+		}
+		ws.files = append(ws.files, webFile{url: base + "/" + strings.Join(parts, "/"), offset: offset, length: f.Length, pad: f.IsPadding()})
+		offset += f.Length
+	}
+	return ws, nil
+}
+
+// webSeedWorker downloads pieces from a web seed, passing them to be hash
+// checked, until the seed fails too many times in a row or ctx is
+// cancelled. Pieces it fails to download go back on the queue.
+func (t *Task) webSeedWorker(ctx context.Context, log *slog.Logger, ws *webSeed, workQueue chan *pieceWork, hashJobs chan<- *hashJob) {
+	clk := clock.Or(t.Clock)
+	failures := 0
+	for {
+		var pw *pieceWork
+		select {
+		case pw = <-workQueue:
+		case <-ctx.Done():
+			return
+		}
+
+		// Leave a piece the seed sent corrupt to peers for a while
+		if pw.avoid(ws.host, clk.Now()) {
+			workQueue <- pw
+			select {
+			case <-clk.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		buf, err := t.fetchPiece(ctx, ws, pw)
+		if err == nil {
+			failures = 0
+			pw.sentWhole(ws.host)
+			select {
+			case hashJobs <- &hashJob{pw: pw, buf: buf, seed: ws, log: log}:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		workQueue <- pw
+		if ctx.Err() != nil {
+			return
+		}
+		failures++
+		if failures >= maxWebSeedFailures {
+			log.Debug("web seed dropped", "piece", pw.index, "error", err)
+			return
+		}
+		log.Debug("web seed request failed", "piece", pw.index, "error", err)
+		select {
+		case <-clk.After(webSeedRetry << (failures - 1)):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetchPiece downloads a piece from a web seed, with a range request on each
+// file it spans
+func (t *Task) fetchPiece(ctx context.Context, ws *webSeed, pw *pieceWork) ([]byte, error) {
+	buf := pieceBuffers.get(pw.length)
+	start := int64(pw.index) * t.Torrent.Info.PieceLength
+	end := start + int64(pw.length)
+	filled := 0
+	for _, f := range ws.files {
+		if f.length == 0 || f.offset+f.length <= start || f.offset >= end {
+			continue
+		}
+		from := max(start, f.offset) - f.offset
+		n := min(end, f.offset+f.length) - f.offset - from
+		if f.pad {
+			clear(buf[filled : filled+int(n)])
+		} else if err := t.fetchRange(ctx, ws, f.url, from, buf[filled:filled+int(n)]); err != nil {
+			return nil, err
+		}
+		filled += int(n)
+	}
+	if filled != len(buf) {
+		return nil, fmt.Errorf("piece %d lies past the end of the files", pw.index)
+	}
+	return buf, nil
+}
+
+// fetchRange reads len(buf) bytes of the file at fileURL, from offset
+func (t *Task) fetchRange(ctx context.Context, ws *webSeed, fileURL string, offset int64, buf []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buf))-1))
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// A server ignoring the range sends the whole file, which will do for
+	// its start
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && offset == 0:
+	case resp.StatusCode == http.StatusOK:
+		return errors.New("web seed doesn't support range requests")
+	default:
+		return fmt.Errorf("web seed returned %s", resp.Status)
+	}
+
+	for read := 0; read < len(buf); {
+		block := buf[read:min(read+MaxBlockSize, len(buf))]
+		if err := t.DownloadLimit.Wait(ctx, len(block)); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(resp.Body, block); err != nil {
+			return fmt.Errorf("failed to read from web seed: %v", err)
+		}
+		read += len(block)
+		t.Stats.Downloaded.Add(int64(len(block)))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// runEdit implements the edit command and returns the exit code
+func runEdit(args []string) int {
+	fs := flag.NewFlagSet("edit", flag.ContinueOnError)
+	var addTrackers, removeTrackers, replaceTrackers, addWebSeeds, removeWebSeeds stringList
+	fs.Var(&addTrackers, "add-tracker", "append this announce `URL` as a backup tier; may be repeated")
+	fs.Var(&removeTrackers, "remove-tracker", "remove this announce `URL`; may be repeated")
+	fs.Var(&replaceTrackers, "replace-tracker", "replace an announce URL in place, given as `old=new`; may be repeated")
+	fs.Var(&addWebSeeds, "add-web-seed", "add this web seed `URL` (BEP 19); may be repeated")
+	fs.Var(&removeWebSeeds, "remove-web-seed", "remove this web seed `URL`; may be repeated")
+	comment := fs.String("comment", "", "replace the comment; empty removes it")
+	createdBy := fs.String("created-by", "", "replace the creator; empty removes it")
+	private := fs.Bool("private", false, "mark the torrent private, or public with --private=false; this changes the info hash")
+	out := fs.String("out", "", "where to write the edited .torrent file (default: the torrent itself)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s edit [flags] <torrent file>\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Changes the trackers, web seeds, comment, creator or private flag of a")
+		fmt.Fprintln(fs.Output(), "torrent file, e.g. to move it to another tracker.\n\nFlags:")
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	edit := torrent.Edit{
+		AddTrackers:    addTrackers,
+		RemoveTrackers: removeTrackers,
+		AddWebSeeds:    addWebSeeds,
+		RemoveWebSeeds: removeWebSeeds,
+	}
+	for _, pair := range replaceTrackers {
+		old, replacement, ok := strings.Cut(pair, "=")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error: invalid --replace-tracker %q, want old=new\n", pair)
+			return exitUsage
+		}
+		if edit.ReplaceTrackers == nil {
+			edit.ReplaceTrackers = map[string]string{}
+		}
+		edit.ReplaceTrackers[old] = replacement
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "comment":
+			edit.Comment = comment
+		case "created-by":
+			edit.CreatedBy = createdBy
+		case "private":
+			edit.Private = private
+		}
+	})
+
+	path := positional[0]
+	tf, err := torrent.ParseFromFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	oldHash, _ := tf.InfoHash()
+	changed, err := tf.Edit(edit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+
+	if *out != "" {
+		path = *out
+	}
+	if err := tf.Save(path); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitStorage
+	}
+	newHash, _ := tf.InfoHash()
+	fmt.Printf("Wrote %s (info hash %x)\n", path, newHash)
+	if changed {
+		fmt.Fprintf(os.Stderr, "Warning: the info hash changed from %x, so this is a new swarm without the old one's peers\n", oldHash)
+	}
+	return exitOK
+}
@@ -0,0 +1,161 @@
+// Package events delivers what happens inside a session, such as peers
+// connecting and pieces being verified, to any number of subscribers, so
+// user interfaces, logs and hooks don't need to reach into the engine.
+package events
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type identifies what happened
+type Type int
+
+const (
+	PeerConnected Type = iota
+	PeerDisconnected
+	PieceVerified
+	AnnounceOK
+	AnnounceFailed
+	MetadataReceived
+	TorrentCompleted
+	PieceFailed
+	TorrentFailed
+)
+
+// String returns the event name
+func (t Type) String() string {
+	switch t {
+	case PeerConnected:
+		return "peer connected"
+	case PeerDisconnected:
+		return "peer disconnected"
+	case PieceVerified:
+		return "piece verified"
+	case AnnounceOK:
+		return "announce ok"
+	case AnnounceFailed:
+		return "announce failed"
+	case MetadataReceived:
+		return "metadata received"
+	case TorrentCompleted:
+		return "torrent completed"
+	case PieceFailed:
+		return "piece failed"
+	case TorrentFailed:
+		return "torrent failed"
+	default:
+		return fmt.Sprintf("Type(%d)", int(t))
+	}
+}
+
+// Event is something that happened to a torrent. Fields that don't apply to
+// its type are left zero.
+type Event struct {
+	Type     Type
+	Time     time.Time
+	InfoHash [20]byte
+	Peer     string // Peer address, for peer events
+	Piece    int    // Piece index, for PieceVerified and PieceFailed
+	Tracker  string // Announce URL, for announce events
+	Peers    int    // Peers the tracker returned, for AnnounceOK
+	Err      error  // Why it failed, for AnnounceFailed and TorrentFailed
+}
+
+// Bus hands published events to its subscribers. The zero value is ready to
+// use and it is safe for concurrent use.
+type Bus struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// Subscription receives the events of a bus. A subscriber that doesn't keep
+// up loses events rather than stalling the publisher.
+type Subscription struct {
+	bus     *Bus
+	ch      chan Event
+	types   map[Type]bool // nil for every type
+	dropped atomic.Int64
+}
+
+// Subscribe returns a subscription buffering up to buffer events of the
+// given types, or of every type if none are given
+func (b *Bus) Subscribe(buffer int, types ...Type) *Subscription {
+	sub := &Subscription{bus: b, ch: make(chan Event, max(buffer, 0))}
+	if len(types) > 0 {
+		sub.types = make(map[Type]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.ch)
+		return sub
+	}
+	if b.subs == nil {
+		b.subs = make(map[*Subscription]struct{})
+	}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// Publish hands e to every subscriber that wants its type and has room for
+// it, stamping it with the current time if it has none. It never blocks.
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		if sub.types != nil && !sub.types[e.Type] {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Close ends every subscription. Later subscriptions start out closed.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for sub := range b.subs {
+		close(sub.ch)
+	}
+	b.subs = nil
+}
+
+// Events returns the channel events are delivered on. It is closed when the
+// subscription or its bus is closed.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns how many events were lost because the buffer was full
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Close stops delivery and closes the events channel
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.ch)
+	}
+}
@@ -0,0 +1,56 @@
+package events
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBus(t *testing.T) {
+	var b Bus
+	all := b.Subscribe(10)
+	pieces := b.Subscribe(1, PieceVerified)
+
+	b.Publish(Event{Type: PeerConnected, Peer: "1.2.3.4:5"})
+	b.Publish(Event{Type: PieceVerified, Piece: 1})
+	b.Publish(Event{Type: PieceVerified, Piece: 2}) // pieces is full
+	b.Publish(Event{Type: AnnounceFailed, Err: errors.New("timeout")})
+
+	var got []Type
+	for range 4 {
+		e := <-all.Events()
+		if e.Time.IsZero() {
+			t.Errorf("Expected %v to have a time", e.Type)
+		}
+		got = append(got, e.Type)
+	}
+	expected := []Type{PeerConnected, PieceVerified, PieceVerified, AnnounceFailed}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Expected event %d to be %v, got %v", i, expected[i], got[i])
+		}
+	}
+
+	if e := <-pieces.Events(); e.Type != PieceVerified || e.Piece != 1 {
+		t.Errorf("Expected piece 1 verified, got %v piece %d", e.Type, e.Piece)
+	}
+	if pieces.Dropped() != 1 {
+		t.Errorf("Expected 1 dropped event, got %d", pieces.Dropped())
+	}
+
+	// Closed subscriptions get nothing more
+	pieces.Close()
+	if _, ok := <-pieces.Events(); ok {
+		t.Error("Expected the events channel to be closed")
+	}
+	b.Publish(Event{Type: PieceVerified})
+	pieces.Close()
+
+	b.Close()
+	<-all.Events()
+	if _, ok := <-all.Events(); ok {
+		t.Error("Expected closing the bus to close its subscriptions")
+	}
+	if _, ok := <-b.Subscribe(1).Events(); ok {
+		t.Error("Expected a subscription to a closed bus to be closed")
+	}
+}
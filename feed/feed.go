@@ -0,0 +1,198 @@
+// Package feed reads the RSS and Atom feeds that torrents name in their
+// update-url (BEP 39), where publishers of continuously updated content
+// announce newer versions of a torrent
+package feed
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// Limits on what a feed may cost us
+const (
+	MaxFeedSize = 1 << 20 // bytes of feed read
+	maxChecked  = 5       // newest items whose torrents are downloaded looking for an update
+)
+
+// Item is one entry of a feed: a version of the torrent
+type Item struct {
+	Title     string
+	URL       string    // where the .torrent file is, absolute
+	Published time.Time // zero if the feed didn't say
+}
+
+// rss is the part of an RSS 2.0 document we read
+type rss struct {
+	Items []struct {
+		Title     string `xml:"title"`
+		Link      string `xml:"link"`
+		PubDate   string `xml:"pubDate"`
+		Enclosure struct {
+			URL string `xml:"url,attr"`
+		} `xml:"enclosure"`
+	} `xml:"channel>item"`
+}
+
+// atom is the part of an Atom document we read
+type atom struct {
+	Entries []struct {
+		Title   string `xml:"title"`
+		Updated string `xml:"updated"`
+		Links   []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+// Parse reads an RSS 2.0 or Atom feed. Items point to their torrent through
+// an enclosure, or else their link, resolved against base. They are returned
+// newest first, or in feed order unless every item has a date.
+func Parse(data []byte, base *url.URL) ([]Item, error) {
+	var root struct{ XMLName xml.Name }
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("invalid feed: %v", err)
+	}
+
+	var items []Item
+	switch root.XMLName.Local {
+	case "rss":
+		var doc rss
+		if err := xml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("invalid feed: %v", err)
+		}
+		for _, it := range doc.Items {
+			link := it.Enclosure.URL
+			if link == "" {
+				link = it.Link
+			}
+			published, _ := time.Parse(time.RFC1123Z, strings.TrimSpace(it.PubDate))
+			if published.IsZero() {
+				published, _ = time.Parse(time.RFC1123, strings.TrimSpace(it.PubDate))
+			}
+			items = append(items, Item{Title: it.Title, URL: link, Published: published})
+		}
+	case "feed":
+		var doc atom
+		if err := xml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("invalid feed: %v", err)
+		}
+		for _, entry := range doc.Entries {
+			var link string
+			for _, l := range entry.Links {
+				if l.Rel == "enclosure" || (link == "" && (l.Rel == "" || l.Rel == "alternate")) {
+					link = l.Href
+				}
+			}
+			published, _ := time.Parse(time.RFC3339, strings.TrimSpace(entry.Updated))
+			items = append(items, Item{Title: entry.Title, URL: link, Published: published})
+		}
+	default:
+		return nil, fmt.Errorf("invalid feed: unknown document type %q", root.XMLName.Local)
+	}
+
+	// Resolve relative links, dropping items without one
+	resolved := items[:0]
+	for _, it := range items {
+		ref, err := url.Parse(strings.TrimSpace(it.URL))
+		if err != nil || it.URL == "" {
+			continue
+		}
+		if base != nil {
+			ref = base.ResolveReference(ref)
+		}
+		it.URL = ref.String()
+		resolved = append(resolved, it)
+	}
+	for _, it := range resolved {
+		if it.Published.IsZero() {
+			return resolved, nil
+		}
+	}
+	sort.SliceStable(resolved, func(i, j int) bool {
+		return resolved[i].Published.After(resolved[j].Published)
+	})
+	return resolved, nil
+}
+
+// Fetch downloads and parses the feed at feedURL
+func Fetch(ctx context.Context, client *http.Client, feedURL string) ([]Item, error) {
+	base, err := url.Parse(feedURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid feed URL: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid feed URL: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch feed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch feed: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxFeedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch feed: %v", err)
+	}
+	if len(data) > MaxFeedSize {
+		return nil, errors.New("feed too large")
+	}
+	return Parse(data, base)
+}
+
+// Latest checks the update feed of tf for a newer version. The newest item
+// whose torrent names the same update URL is the current version; it is
+// returned unless it is tf itself, in which case Latest returns nil. Items
+// that point elsewhere are skipped, so a feed shared by several series works.
+func Latest(ctx context.Context, client *http.Client, tf *torrent.TorrentFile) (*torrent.TorrentFile, error) {
+	if tf.Info.UpdateURL == "" {
+		return nil, errors.New("torrent has no update URL")
+	}
+	items, err := Fetch(ctx, client, tf.Info.UpdateURL)
+	if err != nil {
+		return nil, err
+	}
+	current, err := tf.InfoHash()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, it := range items {
+		if i == maxChecked {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// Only URLs, never local files
+		if !strings.HasPrefix(it.URL, "http://") && !strings.HasPrefix(it.URL, "https://") {
+			continue
+		}
+		candidate, err := torrent.LoadWith(client, it.URL)
+		if err != nil || candidate.Info.UpdateURL != tf.Info.UpdateURL {
+			continue
+		}
+		infoHash, err := candidate.InfoHash()
+		if err != nil {
+			continue
+		}
+		if infoHash == current {
+			return nil, nil
+		}
+		return candidate, nil
+	}
+	return nil, nil
+}
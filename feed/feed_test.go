@@ -0,0 +1,117 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+func TestParse(t *testing.T) {
+	base, _ := url.Parse("http://example.com/feeds/data.rss")
+	testCases := []struct {
+		name     string
+		feed     string
+		expected []string
+	}{
+		{
+			"RSS newest first",
+			`<rss version="2.0"><channel>
+				<item><title>v1</title><pubDate>Mon, 02 Jan 2006 15:04:05 +0000</pubDate><enclosure url="v1.torrent" type="application/x-bittorrent"/></item>
+				<item><title>v2</title><pubDate>Tue, 03 Jan 2006 15:04:05 +0000</pubDate><link>https://mirror.example/v2.torrent</link></item>
+				<item><title>no link</title><pubDate>Wed, 04 Jan 2006 15:04:05 +0000</pubDate></item>
+			</channel></rss>`,
+			[]string{"https://mirror.example/v2.torrent", "http://example.com/feeds/v1.torrent"},
+		},
+		{
+			"RSS without dates keeps feed order",
+			`<rss><channel><item><link>/a.torrent</link></item><item><link>/b.torrent</link></item></channel></rss>`,
+			[]string{"http://example.com/a.torrent", "http://example.com/b.torrent"},
+		},
+		{
+			"Atom prefers enclosures",
+			`<feed xmlns="http://www.w3.org/2005/Atom">
+				<entry><title>v1</title><updated>2006-01-02T15:04:05Z</updated><link href="page1.html"/></entry>
+				<entry><title>v2</title><updated>2006-01-03T15:04:05Z</updated><link href="page2.html"/><link rel="enclosure" href="v2.torrent"/></entry>
+			</feed>`,
+			[]string{"http://example.com/feeds/v2.torrent", "http://example.com/feeds/page1.html"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			items, err := Parse([]byte(tc.feed), base)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			var urls []string
+			for _, it := range items {
+				urls = append(urls, it.URL)
+			}
+			if strings.Join(urls, " ") != strings.Join(tc.expected, " ") {
+				t.Errorf("Expected %v, got %v", tc.expected, urls)
+			}
+		})
+	}
+
+	for _, feed := range []string{"not xml", "<html></html>"} {
+		if _, err := Parse([]byte(feed), base); err == nil {
+			t.Errorf("Expected error for %q", feed)
+		}
+	}
+}
+
+// version returns a small torrent announcing updates in feedURL
+func version(name, feedURL string) *torrent.TorrentFile {
+	return &torrent.TorrentFile{
+		Announce: "http://tracker.example/announce",
+		Info: torrent.TorrentInfo{
+			Name:        name,
+			PieceLength: 16384,
+			Pieces:      strings.Repeat("x", 20),
+			Length:      100,
+			UpdateURL:   feedURL,
+		},
+	}
+}
+
+func TestLatest(t *testing.T) {
+	mux := http.NewServeMux()
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	feedURL := ts.URL + "/feed.rss"
+
+	v1, v2, other := version("data-v1", feedURL), version("data-v2", feedURL), version("other", ts.URL+"/other.rss")
+	for path, tf := range map[string]*torrent.TorrentFile{"/v1.torrent": v1, "/v2.torrent": v2, "/other.torrent": other} {
+		data, _ := tf.Encode()
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) { w.Write(data) })
+	}
+	items := ""
+	mux.HandleFunc("/feed.rss", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<rss><channel>%s</channel></rss>", items)
+	})
+
+	// The newest item of another series is skipped
+	items = "<item><link>other.torrent</link></item><item><link>v1.torrent</link></item>"
+	latest, err := Latest(context.Background(), http.DefaultClient, v1)
+	if err != nil || latest != nil {
+		t.Errorf("Expected v1 to be up to date, got %v (err: %v)", latest, err)
+	}
+
+	items = "<item><link>v2.torrent</link></item><item><link>v1.torrent</link></item>"
+	latest, err = Latest(context.Background(), http.DefaultClient, v1)
+	if err != nil || latest == nil || latest.Info.Name != "data-v2" {
+		t.Errorf("Expected data-v2, got %v (err: %v)", latest, err)
+	}
+
+	if _, err := Latest(context.Background(), http.DefaultClient, version("none", "")); err == nil {
+		t.Error("Expected error for a torrent without update URL")
+	}
+	if _, err := Latest(context.Background(), http.DefaultClient, version("missing", ts.URL+"/missing.rss")); err == nil {
+		t.Error("Expected error for a missing feed")
+	}
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/bind"
+	"github.com/omkarkirpan/bittorrent-client/config"
+	"github.com/omkarkirpan/bittorrent-client/dht"
+	"github.com/omkarkirpan/bittorrent-client/download"
+	"github.com/omkarkirpan/bittorrent-client/logging"
+	"github.com/omkarkirpan/bittorrent-client/peer"
+	"github.com/omkarkirpan/bittorrent-client/session"
+	"github.com/omkarkirpan/bittorrent-client/socks5"
+	"github.com/omkarkirpan/bittorrent-client/statedir"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+	"github.com/omkarkirpan/bittorrent-client/transport"
+)
+
+// options holds every setting that can come from a flag, the config file or
+// the environment
+type options struct {
+	config    string
+	outputDir string
+	flat      bool
+	stateDir  string
+
+	port        uint
+	portRange   portRange
+	randomPort  bool
+	noIPv4      bool
+	noIPv6      bool
+	noListen    bool
+	noDHT       bool
+	dhtPort     uint
+	dhtNodes    string
+	noHolepunch bool
+	portMapping bool
+
+	peerTimeout time.Duration
+	sequential  bool
+
+	maxPeers       int
+	numWant        int
+	maxConnections int
+
+	maxActiveDownloads int
+	maxActiveSeeds     int
+
+	maxDownload byteRate
+	maxUpload   byteRate
+
+	altMaxDownload byteRate
+	altMaxUpload   byteRate
+	altSpeed       bool
+	altSchedule    string
+
+	bandwidthSchedule string
+
+	seed      bool
+	seedRatio float64
+	seedTime  time.Duration
+	seedPause bool
+
+	announceWhilePaused bool
+
+	execOnComplete string
+	webhook        string
+
+	netOptions
+	proxyUDP bool
+
+	blocklist        string
+	blocklistRefresh time.Duration
+	banAfter         int
+
+	writeCache byteSize
+	allocate   download.Allocation
+
+	refuseClients    string
+	refuseBadClients bool
+	throttleClients  string
+	throttleRate     byteRate
+
+	quiet      bool
+	verbose    int
+	logLevel   string
+	logFormat  string
+	logFile    string
+	logMaxSize byteSize
+	logBackups int
+	debugAddr  string
+
+	traceFile    string
+	traceMaxSize byteSize
+}
+
+// register defines the flags for o on fs
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.config, "config", "", "config file (default: first of the standard locations that exists)")
+	fs.StringVar(&o.outputDir, "output-dir", ".", "directory to save downloaded files in")
+	fs.Func("o", "save downloaded files in `dir`: short for --output-dir", func(dir string) error { return fs.Set("output-dir", dir) })
+	fs.StringVar(&o.stateDir, "state-dir", "", "directory for resume data and other state kept between runs; state is moved over when it changes (default: $XDG_STATE_HOME/bittorrent-client or ~/.local/state/bittorrent-client)")
+	fs.BoolVar(&o.flat, "flat", false, "put a multi-file torrent's files directly in --output-dir instead of a folder named after the torrent")
+
+	fs.UintVar(&o.port, "port", session.DefaultPort, "TCP port to accept peers on")
+	fs.Var(&o.portRange, "port-range", "ports to fall back to when --port is taken, e.g. 6881-6889")
+	fs.BoolVar(&o.randomPort, "random-port", false, "listen on a random port instead of --port")
+	fs.BoolVar(&o.noIPv4, "no-ipv4", false, "don't use IPv4")
+	fs.BoolVar(&o.noIPv6, "no-ipv6", false, "don't use IPv6")
+	fs.BoolVar(&o.noListen, "no-listen", false, "don't accept incoming peer connections, only connect out")
+	fs.BoolVar(&o.noDHT, "no-dht", false, "don't use the DHT to find peers")
+	fs.UintVar(&o.dhtPort, "dht-port", 0, "UDP port for the DHT (default: the listen port if it's free over UDP, else a random one)")
+	fs.StringVar(&o.dhtNodes, "dht-bootstrap", "", "join the DHT through these comma-separated host:port `nodes` instead of the public routers, e.g. for a private network")
+	fs.BoolVar(&o.noHolepunch, "no-holepunch", false, "don't connect to or relay for peers behind NATs through other peers (BEP 55)")
+	fs.BoolVar(&o.portMapping, "port-mapping", false, "forward the listen port on the gateway with PCP, NAT-PMP or UPnP")
+
+	fs.DurationVar(&o.peerTimeout, "peer-timeout", 0, "give up on a torrent after this long without peers, e.g. 10m (default: wait forever)")
+	fs.IntVar(&o.maxPeers, "max-peers", 0, "peers each torrent connects to (default: 50)")
+	fs.IntVar(&o.numWant, "numwant", 0, "peers to ask each tracker for per announce (default: as many as the tracker gives)")
+	fs.IntVar(&o.maxConnections, "max-connections", 0, "peer connections across all torrents, shared out with downloads getting more than seeds (default: 500)")
+	fs.IntVar(&o.maxActiveDownloads, "max-active-downloads", 0, "torrents downloading at once, the others queued in the order given until one completes, stalls or is paused (default: no limit)")
+	fs.IntVar(&o.maxActiveSeeds, "max-active-seeds", 0, "torrents seeding at once with --seed, the others queued until one stops seeding (default: no limit)")
+	fs.BoolVar(&o.sequential, "sequential", false, "download pieces in order, each file's first and last piece first, so videos can play while downloading")
+
+	fs.Var(&o.maxDownload, "max-download", "limit the download `rate` across all torrents, in bytes per second with an optional K, M or G suffix, e.g. 2M (default: unlimited)")
+	fs.Var(&o.maxUpload, "max-upload", "limit the upload `rate` across all torrents, e.g. 500K (default: unlimited)")
+	fs.Var(&o.altMaxDownload, "alt-max-download", "alternative download `rate` limit of turtle mode, e.g. 100K (default: unlimited)")
+	fs.Var(&o.altMaxUpload, "alt-max-upload", "alternative upload `rate` limit of turtle mode, e.g. 20K (default: unlimited)")
+	fs.BoolVar(&o.altSpeed, "alt-speed", false, "start in turtle mode, with the alternative rate limits in effect")
+	fs.StringVar(&o.altSchedule, "alt-schedule", "", "switch to turtle mode during this daily `window`, e.g. \"mon-fri 09:00-17:00\"")
+	fs.StringVar(&o.bandwidthSchedule, "bandwidth-schedule", "", "`rules` replacing the rate limits during daily windows, separated by semicolons, e.g. \"mon-fri 09:00-17:00 down=1M up=1M; 01:00-07:00 unlimited; sat 12:00-14:00 pause\"")
+
+	fs.BoolVar(&o.seed, "seed", false, "keep uploading after a download completes, until a seeding limit is reached or you stop the client")
+	fs.Float64Var(&o.seedRatio, "seed-ratio", 0, "stop seeding once this many times the torrent size was uploaded, e.g. 2.0; implies --seed")
+	fs.DurationVar(&o.seedTime, "seed-time", 0, "stop seeding after this long, e.g. 1h; implies --seed")
+	fs.BoolVar(&o.seedPause, "seed-pause", false, "pause torrents at --seed-ratio or --seed-time instead of completing them, so they can be resumed (daemon only)")
+
+	fs.BoolVar(&o.announceWhilePaused, "announce-while-paused", false, "keep announcing paused torrents to their trackers, asking for no peers, instead of telling the trackers we left")
+
+	fs.StringVar(&o.execOnComplete, "exec-on-complete", "", "run this `command` when a torrent finishes, with {name}, {path} and {hash} replaced, e.g. \"notify-send {name}\"")
+	fs.StringVar(&o.webhook, "webhook", "", "POST a JSON summary to this `URL` when a torrent finishes")
+
+	o.netOptions.register(fs)
+	fs.BoolVar(&o.proxyUDP, "proxy-udp", false, "relay DHT traffic through the proxy too")
+
+	fs.StringVar(&o.blocklist, "blocklist", "", "path or URL of a P2P, DAT or CIDR blocklist")
+	fs.DurationVar(&o.blocklistRefresh, "blocklist-refresh", 24*time.Hour, "how often to reload the blocklist")
+	fs.IntVar(&o.banAfter, "ban-after", 3, "ban peers once this many pieces they sent failed the hash check (0: never)")
+
+	o.writeCache = 16 << 20
+	fs.Var(&o.writeCache, "write-cache", "hold up to this `size` of downloaded pieces per torrent in memory, to write them to disk in order (0: write each piece at once)")
+	fs.TextVar(&o.allocate, "allocate", download.AllocateNone, "how files get their disk space as a download starts, by `mode`: none grows them as pieces arrive, sparse sets their full size, full reserves the space; downloads fail at once if the disk lacks room")
+
+	fs.StringVar(&o.refuseClients, "refuse-clients", "", "refuse peers running these clients: comma-separated `patterns` matching a peer ID prefix such as -XL, or a client name and version such as \"Transmission 2.*\"")
+	fs.BoolVar(&o.refuseBadClients, "refuse-bad-clients", false, "refuse clients known to leech without uploading or to fake their identity, such as Xunlei")
+	fs.StringVar(&o.throttleClients, "throttle-clients", "", "cap the upload to peers running these clients, given as `patterns` like --refuse-clients, to --throttle-rate")
+	fs.Var(&o.throttleRate, "throttle-rate", "upload `rate` shared by the peers --throttle-clients matches (default: 16K)")
+
+	fs.BoolVar(&o.quiet, "quiet", false, "only log errors and don't report progress")
+	fs.Var(verbosity{&o.verbose, 1}, "v", "log more: same as --log-level info")
+	fs.Var(verbosity{&o.verbose, 1}, "verbose", "same as -v")
+	fs.Var(verbosity{&o.verbose, 2}, "vv", "log even more: same as --log-level debug")
+	fs.Var(verbosity{&o.verbose, 3}, "vvv", "log every message exchanged with peers: same as --log-level wire")
+	fs.StringVar(&o.logLevel, "log-level", "warn", "least severe log records written: wire, debug, info, warn or error")
+	fs.StringVar(&o.logFormat, "log-format", "text", "log record format: text or json")
+	fs.StringVar(&o.logFile, "log-file", "", "write log records to this `file` instead of stderr, keeping the terminal clean for progress")
+	o.logMaxSize = 10 << 20
+	fs.Var(&o.logMaxSize, "log-max-size", "rotate the log file once it reaches this `size`, e.g. 10M")
+	fs.IntVar(&o.logBackups, "log-backups", 3, "how many rotated log files to keep")
+	fs.StringVar(&o.traceFile, "trace-file", "", "record every message exchanged with peers, trackers and DHT nodes in this `file`, as JSON lines without piece data or tracker passkeys, e.g. to attach to a bug report")
+	o.traceMaxSize = 50 << 20
+	fs.Var(&o.traceMaxSize, "trace-max-size", "start the trace file over once it reaches this `size`, keeping the previous one as a .1 file")
+	fs.StringVar(&o.debugAddr, "debug-addr", "", "address to serve pprof and a state dump on, e.g. 127.0.0.1:6060 (off by default)")
+}
+
+// netOptions are the settings for the route to peers, trackers and web
+// servers, which commands that only look a torrent up share with downloads
+type netOptions struct {
+	bind          string
+	proxy         string
+	proxyUsername string
+	proxyPassword string
+	proxyStrict   bool
+}
+
+// register defines the flags for o on fs
+func (o *netOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.bind, "bind", "", "local IP address or interface name to use for all connections")
+	fs.StringVar(&o.proxy, "proxy", "", "host:port of a SOCKS5 proxy for peer connections")
+	fs.StringVar(&o.proxyUsername, "proxy-username", "", "SOCKS5 proxy username")
+	fs.StringVar(&o.proxyPassword, "proxy-password", "", "SOCKS5 proxy password")
+	fs.BoolVar(&o.proxyStrict, "proxy-strict", false, "never connect without the proxy")
+}
+
+// route returns the way to peers and trackers a session with o would take
+func (o *netOptions) route() (*netRoute, error) {
+	cfg := session.Config{
+		BindAddress:   o.bind,
+		Proxy:         o.proxy,
+		ProxyUsername: o.proxyUsername,
+		ProxyPassword: o.proxyPassword,
+		ProxyStrict:   o.proxyStrict,
+	}
+	client, err := session.NewHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	fetch, err := fetchClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := &netRoute{fetch: fetch, strict: o.proxy != "" && o.proxyStrict}
+	r.client = new(http.Client)
+	*r.client = *client
+	r.client.Timeout = scrapeTimeout
+
+	direct := (&net.Dialer{}).DialContext
+	if o.bind != "" {
+		if r.bind, err = bind.Parse(o.bind); err != nil {
+			return nil, err
+		}
+		direct = r.bind.DialContext
+	}
+	r.dialUDP, r.dial = direct, direct
+	if o.proxy != "" {
+		proxy := &socks5.Dialer{
+			ProxyAddr: o.proxy,
+			Username:  o.proxyUsername,
+			Password:  o.proxyPassword,
+			Forward:   direct,
+		}
+		r.dial = proxy.DialContext
+		if !r.strict {
+			// Fall back to a direct connection only when the proxy is down
+			r.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := proxy.DialContext(ctx, network, addr)
+				if errors.Is(err, socks5.ErrProxyUnavailable) {
+					return direct(ctx, network, addr)
+				}
+				return conn, err
+			}
+		}
+	}
+	return r, nil
+}
+
+// netRoute reaches peers, trackers and web servers from the bound address
+// and through the proxy, like a session does
+type netRoute struct {
+	fetch   *http.Client       // for .torrent URLs
+	client  *http.Client       // for HTTP trackers
+	dial    transport.DialFunc // for peers
+	dialUDP transport.DialFunc // for UDP trackers
+	bind    *bind.Binding      // nil if not bound
+	strict  bool               // never connect without the proxy, so no UDP
+}
+
+// scrape asks the tracker at announce for the swarm's counts
+func (r *netRoute) scrape(ctx context.Context, announce string, infoHash [20]byte) (*tracker.ScrapeResult, error) {
+	if !strings.HasPrefix(announce, "udp://") {
+		return tracker.Scrape(ctx, r.client, announce, infoHash)
+	}
+	if r.strict {
+		return nil, errors.New("UDP trackers can't be used in strict proxy mode")
+	}
+	return tracker.ScrapeUDP(ctx, r.dialUDP, announce, infoHash)
+}
+
+// load fills in the settings not given on the command line from the config
+// file and the environment, and returns the resulting session configuration.
+// fs must already be parsed.
+func (o *options) load(fs *flag.FlagSet) (session.Config, error) {
+	if o.config == "" {
+		o.config = os.Getenv(config.EnvName("config"))
+	}
+	values, err := config.Load(o.config)
+	if err != nil {
+		return session.Config{}, err
+	}
+	if err := config.Apply(fs, values, os.Getenv, commandFlags()...); err != nil {
+		return session.Config{}, err
+	}
+	return o.sessionConfig()
+}
+
+// commandFlags returns the flags of every command that reads the config
+// file, whose settings may all appear in one
+func commandFlags() []*flag.FlagSet {
+	download := flag.NewFlagSet("download", flag.ContinueOnError)
+	new(downloadOptions).register(download)
+	daemon := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	new(daemonOptions).register(daemon)
+	stream := flag.NewFlagSet("stream", flag.ContinueOnError)
+	new(streamOptions).register(stream)
+	return []*flag.FlagSet{download, daemon, stream}
+}
+
+// sessionConfig converts the options to a session configuration
+func (o *options) sessionConfig() (session.Config, error) {
+	if o.port > 65535 {
+		return session.Config{}, fmt.Errorf("invalid port %d", o.port)
+	}
+	if o.dhtPort > 65535 {
+		return session.Config{}, fmt.Errorf("invalid DHT port %d", o.dhtPort)
+	}
+	dhtNodes := splitList(o.dhtNodes)
+	for _, node := range dhtNodes {
+		if _, _, err := net.SplitHostPort(node); err != nil {
+			return session.Config{}, fmt.Errorf("invalid DHT bootstrap node %q: expected host:port", node)
+		}
+	}
+	if o.noListen && o.portMapping {
+		return session.Config{}, errors.New("--port-mapping needs a listen port, so it can't be combined with --no-listen")
+	}
+	if o.maxActiveDownloads < 0 || o.maxActiveSeeds < 0 {
+		return session.Config{}, errors.New("active torrent limits can't be negative")
+	}
+	if o.seedRatio < 0 || o.seedTime < 0 {
+		return session.Config{}, errors.New("seeding limits can't be negative")
+	}
+	var altSchedule *session.Schedule
+	if o.altSchedule != "" {
+		var err error
+		if altSchedule, err = session.ParseSchedule(o.altSchedule); err != nil {
+			return session.Config{}, err
+		}
+	}
+	bandwidthSchedule, err := parseBandwidthSchedule(o.bandwidthSchedule)
+	if err != nil {
+		return session.Config{}, err
+	}
+	logger, err := o.logger()
+	if err != nil {
+		return session.Config{}, err
+	}
+	hook, err := newCompletionHook(o.execOnComplete, o.webhook, logger)
+	if err != nil {
+		return session.Config{}, err
+	}
+	state, err := statedir.Open(o.stateDir)
+	if err != nil {
+		return session.Config{}, err
+	}
+	cfg := session.Config{
+		DownloadDir:      o.outputDir,
+		Flat:             o.flat,
+		StateDir:         state,
+		Port:             uint16(o.port),
+		PortRange:        o.portRange,
+		RandomPort:       o.randomPort,
+		BindAddress:      o.bind,
+		DisableIPv4:      o.noIPv4,
+		DisableIPv6:      o.noIPv6,
+		NoListen:         o.noListen,
+		DisableDHT:       o.noDHT,
+		DHT:              dht.Config{Port: int(o.dhtPort), BootstrapNodes: dhtNodes},
+		NoHolepunch:      o.noHolepunch,
+		PortMapping:      o.portMapping,
+		PeerTimeout:      o.peerTimeout,
+		Sequential:       o.sequential,
+		MaxDownload:      int64(o.maxDownload),
+		MaxUpload:        int64(o.maxUpload),
+		Seed:             o.seed || o.seedRatio > 0 || o.seedTime > 0,
+		SeedRatio:        o.seedRatio,
+		SeedTime:         o.seedTime,
+		SeedPause:        o.seedPause,
+		Proxy:            o.proxy,
+		ProxyUsername:    o.proxyUsername,
+		ProxyPassword:    o.proxyPassword,
+		ProxyUDP:         o.proxyUDP,
+		ProxyStrict:      o.proxyStrict,
+		Blocklist:        o.blocklist,
+		BlocklistRefresh: o.blocklistRefresh,
+		BanAfter:         o.banAfter,
+		WriteCache:       int64(o.writeCache),
+		Allocate:         o.allocate,
+		ThrottleRate:     int64(o.throttleRate),
+		Logger:           logger,
+	}
+	cfg.MaxPeers, cfg.MaxConnections, cfg.NumWant = o.maxPeers, o.maxConnections, o.numWant
+	cfg.MaxActiveDownloads, cfg.MaxActiveSeeds = o.maxActiveDownloads, o.maxActiveSeeds
+	cfg.AnnounceWhilePaused = o.announceWhilePaused
+	cfg.AltMaxDownload, cfg.AltMaxUpload = int64(o.altMaxDownload), int64(o.altMaxUpload)
+	cfg.AltSpeed, cfg.AltSchedule = o.altSpeed, altSchedule
+	cfg.BandwidthSchedule = bandwidthSchedule
+	cfg.ClientPolicy = peer.ClientPolicy{
+		Refuse:   splitList(o.refuseClients),
+		Throttle: splitList(o.throttleClients),
+	}
+	if o.refuseBadClients {
+		cfg.ClientPolicy.Refuse = append(cfg.ClientPolicy.Refuse, peer.KnownBadClients...)
+	}
+	if hook != nil {
+		if hook.client, err = session.NewHTTPClient(cfg); err != nil {
+			return session.Config{}, err
+		}
+		cfg.OnComplete = hook.run
+	}
+	return cfg, nil
+}
+
+// parseBandwidthSchedule parses semicolon-separated bandwidth rules, each a
+// window as accepted by session.ParseSchedule followed by "pause",
+// "unlimited" or down= and up= rates. A direction left out is unlimited.
+func parseBandwidthSchedule(s string) ([]session.BandwidthRule, error) {
+	var rules []session.BandwidthRule
+	for _, spec := range strings.Split(s, ";") {
+		fields := strings.Fields(spec)
+		if len(fields) == 0 {
+			continue
+		}
+		window := slices.IndexFunc(fields, func(f string) bool { return strings.Contains(f, ":") })
+		if window < 0 || window == len(fields)-1 {
+			return nil, fmt.Errorf("invalid bandwidth rule %q: expected [days] hh:mm-hh:mm followed by pause, unlimited or down= and up= rates", strings.TrimSpace(spec))
+		}
+		sc, err := session.ParseSchedule(strings.Join(fields[:window+1], " "))
+		if err != nil {
+			return nil, err
+		}
+
+		rule := session.BandwidthRule{Schedule: *sc}
+		for _, action := range fields[window+1:] {
+			action = strings.ToLower(action)
+			name, value, _ := strings.Cut(action, "=")
+			var rate byteRate
+			switch {
+			case action == "pause":
+				rule.Pause = true
+			case action == "unlimited":
+			case name == "down" && rate.Set(value) == nil:
+				rule.MaxDownload = int64(rate)
+			case name == "up" && rate.Set(value) == nil:
+				rule.MaxUpload = int64(rate)
+			default:
+				return nil, fmt.Errorf("invalid bandwidth rule %q: unknown action %q", strings.TrimSpace(spec), action)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// splitList splits a comma-separated list such as client policy patterns,
+// dropping blank entries
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// logger creates the logger configured by --log-level, -v, --quiet,
+// --log-file and --trace-file
+func (o *options) logger() (*slog.Logger, error) {
+	level := o.logLevel
+	switch {
+	case o.quiet && o.verbose > 0:
+		return nil, errors.New("--quiet and -v or --verbose can't be combined")
+	case o.quiet:
+		level = "error"
+	case o.verbose > 0:
+		level = [...]string{"info", "debug", "wire"}[min(o.verbose, 3)-1]
+	}
+
+	var w io.Writer = os.Stderr
+	if o.logFile != "" {
+		f, err := logging.OpenRotating(o.logFile, int64(o.logMaxSize), o.logBackups)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	logger, err := logging.New(w, level, o.logFormat)
+	if err != nil || o.traceFile == "" {
+		return logger, err
+	}
+	trace, err := logging.OpenRotating(o.traceFile, int64(o.traceMaxSize), 1)
+	if err != nil {
+		return nil, err
+	}
+	return slog.New(logging.Tee(logger.Handler(), logging.NewTrace(trace))), nil
+}
+
+// parseInterspersed parses args with fs, allowing flags after positional
+// arguments as in "verify file.torrent --data dir", and returns the
+// positional arguments
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// portRange is a flag value of the form first-last
+type portRange [2]uint16
+
+func (r *portRange) String() string {
+	if r[0] == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", r[0], r[1])
+}
+
+func (r *portRange) Set(s string) error {
+	first, last, ok := strings.Cut(s, "-")
+	if !ok {
+		return errors.New("expected first-last")
+	}
+	a, err := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", first)
+	}
+	b, err := strconv.ParseUint(strings.TrimSpace(last), 10, 16)
+	if err != nil || b < a {
+		return fmt.Errorf("invalid port %s", last)
+	}
+	*r = portRange{uint16(a), uint16(b)}
+	return nil
+}
+
+// byteRate is a flag value in bytes per second, like 500K or 2M/s; 0 means
+// unlimited
+type byteRate int64
+
+func (r *byteRate) String() string {
+	if *r == 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64(*r), 10)
+}
+
+func (r *byteRate) Set(s string) error {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	if s == "0" {
+		*r = 0
+		return nil
+	}
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*r = byteRate(n)
+	return nil
+}
+
+// byteSize is a flag value in bytes, like 10M
+type byteSize int64
+
+func (b *byteSize) String() string {
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if *b != 0 && int64(*b)%unit.size == 0 {
+			return strconv.FormatInt(int64(*b)/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	n, err := parseSize(strings.TrimSpace(s))
+	if err != nil {
+		return err
+	}
+	*b = byteSize(n)
+	return nil
+}
+
+// verbosity is a boolean flag raising a verbosity level to n, so that -v,
+// -vv and -vvv can be given as separate flags
+type verbosity struct {
+	level *int
+	n     int
+}
+
+func (v verbosity) IsBoolFlag() bool { return true }
+
+func (v verbosity) String() string { return "" }
+
+func (v verbosity) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if on {
+		*v.level = max(*v.level, v.n)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSharedConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	data := "state-dir = \"" + filepath.Join(dir, "state") + "\"\n" +
+		"max-peers = 20\n" +
+		"show-peers = true\n" +
+		"api-addr = \"127.0.0.1:9999\"\n" +
+		"update-interval = \"1h\"\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var download downloadOptions
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	download.register(fs)
+	if err := fs.Parse([]string{"--config", path}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	cfg, err := download.load(fs)
+	if err != nil {
+		t.Fatalf("Expected the daemon's settings to be skipped by download, got %v", err)
+	}
+	if cfg.MaxPeers != 20 || !download.showPeers {
+		t.Errorf("Expected download to read max-peers and show-peers, got %d and %v", cfg.MaxPeers, download.showPeers)
+	}
+
+	var daemon daemonOptions
+	fs = flag.NewFlagSet("daemon", flag.ContinueOnError)
+	daemon.register(fs)
+	if err := fs.Parse([]string{"--config", path}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if cfg, err = daemon.load(fs); err != nil {
+		t.Fatalf("Expected download's settings to be skipped by the daemon, got %v", err)
+	}
+	if cfg.MaxPeers != 20 || daemon.apiAddr != "127.0.0.1:9999" || daemon.updateInterval.Hours() != 1 {
+		t.Errorf("Expected the daemon to read max-peers, api-addr and update-interval, got %d, %q and %v", cfg.MaxPeers, daemon.apiAddr, daemon.updateInterval)
+	}
+
+	if err := os.WriteFile(path, []byte("api-adr = \"127.0.0.1:9999\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var typo downloadOptions
+	fs = flag.NewFlagSet("download", flag.ContinueOnError)
+	typo.register(fs)
+	if err := fs.Parse([]string{"--config", path}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if _, err := typo.load(fs); err == nil {
+		t.Error("Expected error for a setting no command knows")
+	}
+}
+
+func TestDHTFlags(t *testing.T) {
+	state := t.TempDir()
+	tests := []struct {
+		args  []string
+		port  int
+		nodes []string
+		err   bool
+	}{
+		{args: nil},
+		{args: []string{"--dht-port", "7000"}, port: 7000},
+		{args: []string{"--dht-bootstrap", "10.0.0.1:6881, node.example:6882"}, nodes: []string{"10.0.0.1:6881", "node.example:6882"}},
+		{args: []string{"--dht-port", "70000"}, err: true},
+		{args: []string{"--dht-bootstrap", "10.0.0.1"}, err: true},
+	}
+	for _, test := range tests {
+		var opts options
+		fs := flag.NewFlagSet("download", flag.ContinueOnError)
+		opts.register(fs)
+		if err := fs.Parse(append([]string{"--state-dir", state}, test.args...)); err != nil {
+			t.Fatalf("Parse %v failed: %v", test.args, err)
+		}
+		cfg, err := opts.sessionConfig()
+		if test.err {
+			if err == nil {
+				t.Errorf("Expected error for %v", test.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected %v to be accepted, got %v", test.args, err)
+			continue
+		}
+		if cfg.DHT.Port != test.port || !slices.Equal(cfg.DHT.BootstrapNodes, test.nodes) {
+			t.Errorf("Expected DHT port %d and nodes %v for %v, got %d and %v", test.port, test.nodes, test.args, cfg.DHT.Port, cfg.DHT.BootstrapNodes)
+		}
+	}
+
+	// The flags double as config settings
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("dht-port = 7001\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BITTORRENT_DHT_BOOTSTRAP", "127.0.0.1:6881")
+	var opts options
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	opts.register(fs)
+	if err := fs.Parse([]string{"--state-dir", state, "--config", path}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	cfg, err := opts.load(fs)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if cfg.DHT.Port != 7001 || !slices.Equal(cfg.DHT.BootstrapNodes, []string{"127.0.0.1:6881"}) {
+		t.Errorf("Expected DHT port 7001 and node 127.0.0.1:6881 from config and environment, got %d and %v", cfg.DHT.Port, cfg.DHT.BootstrapNodes)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/dht"
+	"github.com/omkarkirpan/bittorrent-client/magnet"
+	"github.com/omkarkirpan/bittorrent-client/metadata"
+	"github.com/omkarkirpan/bittorrent-client/peer"
+	"github.com/omkarkirpan/bittorrent-client/session"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+)
+
+const (
+	// sampleWait bounds how long a sampled peer has to send its bitfield
+	sampleWait = 5 * time.Second
+	// metadataTries is how many peers we ask for a magnet link's metadata
+	metadataTries = 5
+)
+
+// healthReport is what the health command found, in the JSON output too
+type healthReport struct {
+	InfoHash string      `json:"info_hash"`
+	Trackers []scrapeRow `json:"trackers"`
+	DHTPeers *int        `json:"dht_peers"` // nil if the DHT wasn't asked or failed
+	DHTError string      `json:"dht_error,omitempty"`
+
+	Sampled      int      `json:"sampled"`       // peers that answered with their pieces
+	SampledSeeds int      `json:"sampled_seeds"` // of those, peers with every piece
+	Coverage     *float64 `json:"coverage"`      // fraction of pieces at least one sampled peer has
+
+	Seeds     int    `json:"estimated_seeds"`
+	Leeches   int    `json:"estimated_leeches"`
+	Available *bool  `json:"available"` // nil if there is too little to tell
+	Reason    string `json:"reason"`
+}
+
+// runHealth implements the health command and returns the exit code
+func runHealth(args []string) int {
+	fs := flag.NewFlagSet("health", flag.ContinueOnError)
+	jsonOutput := fs.Bool("json", false, "print the report as JSON")
+	sample := fs.Int("sample", 0, "connect to up to `n` peers to see which pieces they have")
+	noDHT := fs.Bool("no-dht", false, "don't look the torrent up in the DHT")
+	var opts netOptions
+	opts.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s health [--sample n] [--no-dht] [--json] [--bind addr] [--proxy host:port] <torrent>\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Scrapes every tracker of a torrent file, URL or magnet link, counts its peers")
+		fmt.Fprintln(fs.Output(), "in the DHT and estimates its seeds and leeches and whether the whole content")
+		fmt.Fprintln(fs.Output(), "is available. With --sample, also asks a few peers which pieces they have.")
+		fmt.Fprintln(fs.Output(), "Exits with status 4 unless the content appears available.\n\nFlags:")
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	if *sample < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --sample must not be negative")
+		return exitUsage
+	}
+
+	route, err := opts.route()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	a, err := loadTorrentArg(positional[0], route.fetch)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading %s: %v\n", positional[0], err)
+		return exitUsage
+	}
+	var infoHash [20]byte
+	var trackers, peers []string
+	if a.tf == nil {
+		m, err := magnet.Parse(a.arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitUsage
+		}
+		if m.InfoHash == [20]byte{} {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", errMutableMagnet)
+			return exitUsage
+		}
+		infoHash, trackers, peers = m.InfoHash, m.Trackers, m.Peers
+	} else {
+		if infoHash, err = a.tf.InfoHash(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to calculate info hash: %v\n", err)
+			return exitUsage
+		}
+		trackers = a.tf.Trackers()
+	}
+
+	ctx, stop := notifyShutdown(slog.Default())
+	defer stop()
+
+	report := &healthReport{InfoHash: fmt.Sprintf("%x", infoHash)}
+	peerID := peer.GenerateID()
+
+	// Trackers and the DHT are independent, so ask them at once
+	var wg sync.WaitGroup
+	var trackerPeers, dhtPeers []string
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		report.Trackers = scrapeAll(route, infoHash, trackers)
+		if *sample > 0 {
+			trackerPeers = announcePeers(ctx, route, infoHash, peerID, trackers)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if *noDHT {
+			return
+		}
+		found, err := dhtPeerAddrs(ctx, route, infoHash)
+		if err != nil {
+			report.DHTError = err.Error()
+			return
+		}
+		n := len(found)
+		report.DHTPeers = &n
+		dhtPeers = found
+	}()
+	wg.Wait()
+	if ctx.Err() != nil {
+		return exitInterrupted
+	}
+	peers = uniqueStrings(append(append(peers, trackerPeers...), dhtPeers...))
+
+	if *sample > 0 && len(peers) > 0 {
+		tf := a.tf
+		if tf == nil {
+			tf = fetchMetadata(ctx, route, infoHash, peerID, peers)
+		}
+		if tf != nil {
+			samplePeers(ctx, route, report, tf, infoHash, peerID, peers[:min(*sample, len(peers))])
+		}
+	}
+	if ctx.Err() != nil {
+		return exitInterrupted
+	}
+	estimateHealth(report, len(peers))
+
+	if *jsonOutput {
+		if err := printJSON(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitFailure
+		}
+	} else {
+		printHealth(report)
+	}
+	if report.Available != nil && *report.Available {
+		return exitOK
+	}
+	return exitNoPeers
+}
+
+// announcePeers asks every HTTP tracker for peers and returns their
+// addresses. It announces as stopped afterwards so the trackers don't list us.
+func announcePeers(ctx context.Context, route *netRoute, infoHash, peerID [20]byte, trackers []string) []string {
+	var mu sync.Mutex
+	var addrs []string
+	var wg sync.WaitGroup
+	for _, announce := range trackers {
+		if !strings.HasPrefix(announce, "http://") && !strings.HasPrefix(announce, "https://") {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := &tracker.AnnounceRequest{InfoHash: infoHash, PeerID: peerID, Port: session.DefaultPort, Left: 1}
+			found, err := tracker.AnnounceContext(ctx, route.client, announce, req)
+			if err != nil {
+				return
+			}
+			req.Event = tracker.EventStopped
+			tracker.AnnounceContext(ctx, route.client, announce, req)
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, p := range found {
+				addrs = append(addrs, p.String())
+			}
+		}()
+	}
+	wg.Wait()
+	return addrs
+}
+
+// dhtPeerAddrs looks the torrent up in the DHT from a read-only node, which
+// other nodes won't add to their routing tables. Like a session's, the node
+// is bound with the rest and can't run in strict proxy mode.
+func dhtPeerAddrs(ctx context.Context, route *netRoute, infoHash [20]byte) ([]string, error) {
+	if route.strict {
+		return nil, errors.New("DHT can't run in strict proxy mode")
+	}
+	cfg := dht.Config{ReadOnly: true}
+	if route.bind != nil {
+		if ip, err := route.bind.LocalIP(false); err == nil {
+			cfg.LocalIPv4 = ip
+		} else {
+			cfg.DisableIPv4 = true
+		}
+		if ip, err := route.bind.LocalIP(true); err == nil {
+			cfg.LocalIPv6 = ip
+		} else {
+			cfg.DisableIPv6 = true
+		}
+		lc := net.ListenConfig{Control: route.bind.Control}
+		cfg.ListenPacket = func(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+			return lc.ListenPacket(ctx, network, laddr.String())
+		}
+	}
+	server, err := dht.NewServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer server.Close()
+	if err := server.Bootstrap(ctx); err != nil {
+		return nil, err
+	}
+	found, err := server.GetPeers(ctx, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(found))
+	for i, p := range found {
+		addrs[i] = p.String()
+	}
+	return uniqueStrings(addrs), nil
+}
+
+// fetchMetadata gets a magnet link's info dictionary from the first of a few
+// peers that has it, or returns nil
+func fetchMetadata(ctx context.Context, route *netRoute, infoHash, peerID [20]byte, peers []string) *torrent.TorrentFile {
+	for _, addr := range peers[:min(metadataTries, len(peers))] {
+		data, err := metadata.FetchWith(ctx, route.dial, addr, infoHash, peerID)
+		if err != nil {
+			continue
+		}
+		info, err := torrent.ParseInfo(data)
+		if err != nil {
+			continue
+		}
+		return &torrent.TorrentFile{Info: *info}
+	}
+	return nil
+}
+
+// samplePeers connects to peers at once and records which pieces they have
+func samplePeers(ctx context.Context, route *netRoute, report *healthReport, tf *torrent.TorrentFile, infoHash, peerID [20]byte, peers []string) {
+	numPieces := tf.NumPieces()
+	seen := make([]bool, numPieces)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, addr := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			have, err := sampleBitfield(ctx, route, addr, infoHash, peerID, numPieces)
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Sampled++
+			count := 0
+			for i, ok := range have {
+				if ok {
+					seen[i] = true
+					count++
+				}
+			}
+			if count == numPieces {
+				report.SampledSeeds++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if report.Sampled == 0 {
+		return
+	}
+	covered := 0
+	for _, ok := range seen {
+		if ok {
+			covered++
+		}
+	}
+	coverage := float64(covered) / float64(max(numPieces, 1))
+	report.Coverage = &coverage
+}
+
+// sampleBitfield connects to a peer and returns the pieces it says it has,
+// from its bitfield and any have messages sent within sampleWait. A peer
+// that sends neither has no pieces.
+func sampleBitfield(ctx context.Context, route *netRoute, addr string, infoHash, peerID [20]byte, numPieces int) ([]bool, error) {
+	_, conn, err := peer.ConnectWith(ctx, route.dial, addr, peer.NewHandshake(infoHash, peerID))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	have := make([]bool, numPieces)
+	conn.SetDeadline(time.Now().Add(sampleWait))
+	for {
+		msg, err := peer.ReadMessage(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			// Peers often go quiet after their bitfield; what they sent so far counts
+			return have, nil
+		}
+		switch msg.Type {
+		case peer.MsgBitfield:
+			bf, err := peer.ParseBitfield(msg, numPieces)
+			if err != nil {
+				return nil, err
+			}
+			for i := range have {
+				have[i] = have[i] || bf.HasPiece(i)
+			}
+		case peer.MsgHave:
+			if len(msg.Payload) == 4 {
+				index := int(msg.Payload[0])<<24 | int(msg.Payload[1])<<16 | int(msg.Payload[2])<<8 | int(msg.Payload[3])
+				if index < numPieces {
+					have[index] = true
+				}
+			}
+		}
+	}
+}
+
+// estimateHealth fills in the estimated seeds and leeches and whether the
+// content appears available, from what the trackers, the DHT and the
+// sampled peers said. known is how many distinct peer addresses we found.
+func estimateHealth(report *healthReport, known int) {
+	answered := false
+	for _, row := range report.Trackers {
+		if row.Error == "" {
+			answered = true
+			report.Seeds = max(report.Seeds, row.Seeders)
+			report.Leeches = max(report.Leeches, row.Leechers)
+		}
+	}
+
+	// Without a tracker's counts, scale the sample up to every peer we found
+	if !answered && report.Sampled > 0 {
+		total := max(known, report.Sampled)
+		report.Seeds = max(total*report.SampledSeeds/report.Sampled, report.SampledSeeds)
+		report.Leeches = total - report.Seeds
+	}
+
+	yes, no := true, false
+	switch {
+	case report.SampledSeeds > 0:
+		report.Available, report.Reason = &yes, "a sampled peer has every piece"
+	case report.Coverage != nil && *report.Coverage == 1:
+		report.Available, report.Reason = &yes, "the sampled peers have every piece between them"
+	case answered && report.Seeds > 0:
+		report.Available, report.Reason = &yes, "trackers report seeds"
+	case report.Coverage != nil:
+		report.Available = &no
+		report.Reason = fmt.Sprintf("no seeds, and the sampled peers have %.1f%% of the pieces", *report.Coverage*100)
+	case answered && report.Leeches == 0 && (report.DHTPeers == nil || *report.DHTPeers == 0):
+		report.Available, report.Reason = &no, "no peers found"
+	case answered:
+		report.Reason = "trackers report no seeds; sample peers with --sample to check the leeches"
+	default:
+		report.Reason = "no tracker answered and no peer was sampled"
+	}
+}
+
+// printHealth prints the report for people
+func printHealth(report *healthReport) {
+	if len(report.Trackers) > 0 {
+		printScrapeTable(os.Stdout, report.Trackers)
+		fmt.Println()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	switch {
+	case report.DHTPeers != nil:
+		fmt.Fprintf(w, "DHT peers:\t%d\n", *report.DHTPeers)
+	case report.DHTError != "":
+		fmt.Fprintf(w, "DHT peers:\terror: %s\n", report.DHTError)
+	}
+	if report.Coverage != nil {
+		fmt.Fprintf(w, "Sampled peers:\t%d, %d with every piece, %.1f%% of pieces seen\n",
+			report.Sampled, report.SampledSeeds, *report.Coverage*100)
+	}
+	fmt.Fprintf(w, "Estimated seeds:\t%d\n", report.Seeds)
+	fmt.Fprintf(w, "Estimated leeches:\t%d\n", report.Leeches)
+	available := "unknown"
+	if report.Available != nil {
+		available = map[bool]string{true: "yes", false: "no"}[*report.Available]
+	}
+	fmt.Fprintf(w, "Available:\t%s, %s\n", available, report.Reason)
+	w.Flush()
+}
+
+// uniqueStrings returns s without duplicates, keeping the first of each
+func uniqueStrings(s []string) []string {
+	seen := make(map[string]bool, len(s))
+	unique := s[:0]
+	for _, v := range s {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/api"
+	"github.com/omkarkirpan/bittorrent-client/session"
+)
+
+// webhookTimeout bounds posting a completion webhook
+const webhookTimeout = 30 * time.Second
+
+// completionHook runs a command and posts a webhook when a torrent finishes
+type completionHook struct {
+	command []string     // argv with {name}, {path} and {hash} placeholders; nil for none
+	webhook string       // URL to post a completionPayload to; empty for none
+	client  *http.Client // posts to webhook, the way the session reaches web servers
+	log     *slog.Logger
+}
+
+// completionPayload is the JSON body posted to the webhook
+type completionPayload struct {
+	Name     string            `json:"name"`
+	InfoHash string            `json:"info_hash"`
+	Path     string            `json:"path"`
+	Stats    api.TorrentStatus `json:"stats"`
+}
+
+// newCompletionHook checks the --exec-on-complete command and --webhook URL.
+// It returns nil if neither is set.
+func newCompletionHook(command, webhook string, log *slog.Logger) (*completionHook, error) {
+	if command == "" && webhook == "" {
+		return nil, nil
+	}
+	h := &completionHook{webhook: webhook, log: log.With("component", "hook")}
+	if command != "" {
+		args, err := splitCommand(command)
+		if err != nil {
+			return nil, fmt.Errorf("--exec-on-complete: %v", err)
+		}
+		h.command = args
+	}
+	if webhook != "" {
+		u, err := url.Parse(webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("--webhook must be an http(s) URL")
+		}
+	}
+	return h, nil
+}
+
+// run is the session's OnComplete callback
+func (h *completionHook) run(t *session.Torrent) {
+	infoHash := t.InfoHash()
+	hash := hex.EncodeToString(infoHash[:])
+	if h.command != nil {
+		h.exec(t.Name(), t.Path(), hash)
+	}
+	if h.webhook != "" {
+		h.post(completionPayload{Name: t.Name(), InfoHash: hash, Path: t.Path(), Stats: api.NewTorrentStatus(t)})
+	}
+}
+
+// exec runs the command with the placeholders filled in. Each argument is
+// passed as is, without a shell, so names can't inject commands.
+func (h *completionHook) exec(name, path, hash string) {
+	replacer := strings.NewReplacer("{name}", name, "{path}", path, "{hash}", hash)
+	args := make([]string, len(h.command))
+	for i, arg := range h.command {
+		args[i] = replacer.Replace(arg)
+	}
+
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		h.log.Warn("completion command failed", "command", args[0], "error", err, "output", strings.TrimSpace(string(out)))
+		return
+	}
+	h.log.Info("completion command ran", "command", args[0])
+}
+
+// post sends the payload to the webhook
+func (h *completionHook) post(payload completionPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		h.log.Warn("webhook failed", "error", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.webhook, bytes.NewReader(body))
+	if err != nil {
+		h.log.Warn("webhook failed", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		h.log.Warn("webhook failed", "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		h.log.Warn("webhook failed", "status", resp.Status)
+		return
+	}
+	h.log.Info("webhook sent", "name", payload.Name)
+}
+
+// splitCommand splits a command line into arguments at spaces outside
+// single or double quotes, like a shell without expansions
+func splitCommand(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
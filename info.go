@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// torrentInfo is the JSON form of a torrent's metadata
+type torrentInfo struct {
+	Name         string     `json:"name"`
+	InfoHash     string     `json:"info_hash"`
+	InfoHashV2   string     `json:"info_hash_v2,omitempty"`
+	Magnet       string     `json:"magnet"`
+	Announce     string     `json:"announce,omitempty"`
+	AnnounceList [][]string `json:"announce_list,omitempty"`
+	Trackers     []string   `json:"trackers"` // every tracker once, in tier order
+	Comment      string     `json:"comment,omitempty"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	CreationDate *time.Time `json:"creation_date,omitempty"`
+	Private      bool       `json:"private"`
+	UpdateURL    string     `json:"update_url,omitempty"`
+	WebSeeds     []string   `json:"web_seeds,omitempty"`
+	PieceLength  int64      `json:"piece_length"`
+	NumPieces    int        `json:"num_pieces"`
+	TotalLength  int64      `json:"total_length"`
+	Files        []fileInfo `json:"files"`
+	PieceHashes  []string   `json:"piece_hashes"`
+	Swarm        *swarmInfo `json:"swarm,omitempty"` // with --scrape
+}
+
+// swarmInfo is what the trackers say about a torrent's swarm. The totals are
+// the most any tracker reported, as trackers share most of their peers.
+type swarmInfo struct {
+	Seeders   int         `json:"seeders"`
+	Leechers  int         `json:"leechers"`
+	Completed int         `json:"completed"`
+	Trackers  []scrapeRow `json:"trackers"`
+}
+
+// fileInfo is a file inside a torrent
+type fileInfo struct {
+	Index  int    `json:"index"` // 1-based, as --files takes it
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+	Attr   string `json:"attr,omitempty"` // BEP 47 attributes: p for padding, x executable, h hidden, l symlink
+}
+
+// runInfo implements the info command and returns the exit code
+func runInfo(args []string) int {
+	fs := flag.NewFlagSet("info", flag.ContinueOnError)
+	jsonOutput := fs.Bool("json", false, "print the metadata as JSON")
+	filesOnly := fs.Bool("files", false, "only list the files with the indices --files takes when downloading")
+	magnetOnly := fs.Bool("magnet", false, "only print a magnet link for the torrent, to share it without the file")
+	scrape := fs.Bool("scrape", false, "also ask the trackers for the swarm's seeders and leechers")
+	var opts netOptions
+	opts.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s info [--json] [--scrape] [--files | --magnet] <torrent file or URL>\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	route, err := opts.route()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	arg := fs.Arg(0)
+	var tf *torrent.TorrentFile
+	switch {
+	case strings.HasPrefix(arg, "magnet:"):
+		err = fmt.Errorf("magnet links carry no metadata to show")
+	default:
+		tf, err = torrent.LoadWith(route.fetch, arg)
+	}
+	var info *torrentInfo
+	if err == nil {
+		info, err = newTorrentInfo(tf)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+
+	if *scrape && !*filesOnly && !*magnetOnly {
+		info.Swarm = scrapeSwarm(route, tf)
+	}
+
+	var v interface{} = info
+	switch {
+	case *filesOnly:
+		v = info.Files
+	case *magnetOnly:
+		v = info.Magnet
+	}
+	switch {
+	case *jsonOutput:
+		if err := printJSON(v); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitFailure
+		}
+	case *filesOnly:
+		printFiles(info.Files)
+	case *magnetOnly:
+		fmt.Println(info.Magnet)
+	default:
+		printInfo(info)
+	}
+	return exitOK
+}
+
+// newTorrentInfo collects the metadata of tf
+func newTorrentInfo(tf *torrent.TorrentFile) (*torrentInfo, error) {
+	infoHash, err := tf.InfoHash()
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate info hash: %v", err)
+	}
+
+	info := &torrentInfo{
+		Name:         tf.Info.Name,
+		InfoHash:     hex.EncodeToString(infoHash[:]),
+		Announce:     tf.Announce,
+		AnnounceList: tf.AnnounceList,
+		Comment:      tf.Comment,
+		CreatedBy:    tf.CreatedBy,
+		Private:      tf.IsPrivate(),
+		UpdateURL:    tf.Info.UpdateURL,
+		WebSeeds:     tf.URLList,
+		PieceLength:  tf.Info.PieceLength,
+		NumPieces:    tf.NumPieces(),
+		TotalLength:  tf.TotalLength(),
+		Trackers:     append([]string{}, tf.Trackers()...),
+	}
+	if info.Magnet, err = tf.MagnetLink(); err != nil {
+		return nil, err
+	}
+	if tf.CreationDate > 0 {
+		created := time.Unix(tf.CreationDate, 0).UTC()
+		info.CreationDate = &created
+	}
+	if tf.IsV2() {
+		hash, err := tf.InfoHashV2()
+		if err != nil {
+			return nil, fmt.Errorf("failed to calculate info hash: %v", err)
+		}
+		info.InfoHashV2 = hex.EncodeToString(hash[:])
+	}
+
+	if !tf.HasV1() {
+		for i, f := range tf.Info.FileTree {
+			path := filepath.Join(append([]string{tf.Info.Name}, f.Path...)...)
+			info.Files = append(info.Files, fileInfo{Index: i + 1, Path: path, Length: f.Length, Attr: f.Attr})
+		}
+	} else if len(tf.Info.Files) == 0 {
+		info.Files = []fileInfo{{Index: 1, Path: tf.Info.Name, Length: tf.Info.Length, Attr: tf.Info.Attr}}
+	}
+	for i, f := range tf.Info.Files {
+		path := filepath.Join(append([]string{tf.Info.Name}, f.Path...)...)
+		info.Files = append(info.Files, fileInfo{Index: i + 1, Path: path, Length: f.Length, Attr: f.Attr})
+	}
+
+	for i := 0; i < info.NumPieces; i++ {
+		hash, err := tf.PieceHash(i)
+		if err != nil {
+			return nil, err
+		}
+		info.PieceHashes = append(info.PieceHashes, hex.EncodeToString(hash[:]))
+	}
+	return info, nil
+}
+
+// scrapeSwarm scrapes every tracker of tf. Trackers that fail are listed
+// with their error and left out of the totals.
+func scrapeSwarm(route *netRoute, tf *torrent.TorrentFile) *swarmInfo {
+	swarm := &swarmInfo{Trackers: []scrapeRow{}}
+	infoHash, err := tf.InfoHash()
+	if err != nil {
+		return swarm
+	}
+	swarm.Trackers = scrapeAll(route, infoHash, tf.Trackers())
+	for _, row := range swarm.Trackers {
+		swarm.Seeders = max(swarm.Seeders, row.Seeders)
+		swarm.Leechers = max(swarm.Leechers, row.Leechers)
+		swarm.Completed = max(swarm.Completed, row.Completed)
+	}
+	return swarm
+}
+
+// answered reports whether any tracker answered the scrape
+func (s *swarmInfo) answered() bool {
+	for _, row := range s.Trackers {
+		if row.Error == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// printInfo prints the metadata for people
+func printInfo(info *torrentInfo) {
+	fmt.Printf("Name:         %s\n", info.Name)
+	fmt.Printf("Info Hash:    %s\n", info.InfoHash)
+	if info.InfoHashV2 != "" {
+		fmt.Printf("Info Hash v2: %s\n", info.InfoHashV2)
+	}
+	fmt.Printf("Magnet:       %s\n", info.Magnet)
+	if info.Announce != "" {
+		fmt.Printf("Announce:     %s\n", info.Announce)
+	}
+	for i, tier := range info.AnnounceList {
+		fmt.Printf("Tier %d:       %s\n", i+1, strings.Join(tier, ", "))
+	}
+	if info.Comment != "" {
+		fmt.Printf("Comment:      %s\n", info.Comment)
+	}
+	if info.CreatedBy != "" {
+		fmt.Printf("Created By:   %s\n", info.CreatedBy)
+	}
+	if info.CreationDate != nil {
+		fmt.Printf("Created:      %s\n", info.CreationDate.Format(time.RFC1123))
+	}
+	fmt.Printf("Private:      %t\n", info.Private)
+	if info.UpdateURL != "" {
+		fmt.Printf("Update URL:   %s\n", info.UpdateURL)
+	}
+	for _, url := range info.WebSeeds {
+		fmt.Printf("Web Seed:     %s\n", url)
+	}
+	fmt.Printf("Piece Length: %s\n", humanReadableSize(info.PieceLength))
+	fmt.Printf("Pieces:       %d\n", info.NumPieces)
+	fmt.Printf("Total Size:   %s\n", humanReadableSize(info.TotalLength))
+	if info.Swarm != nil {
+		if info.Swarm.answered() {
+			fmt.Printf("Swarm:        %d seeders, %d leechers, %d completed\n", info.Swarm.Seeders, info.Swarm.Leechers, info.Swarm.Completed)
+		} else {
+			fmt.Printf("Swarm:        unknown, no tracker answered\n")
+		}
+	}
+	fmt.Printf("Files:\n")
+	for _, f := range info.Files {
+		if !f.padding() {
+			fmt.Printf("  %s (%s)\n", f.Path, humanReadableSize(f.Length))
+		}
+	}
+}
+
+// printFiles prints a numbered file list to pick --files from
+func printFiles(files []fileInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, f := range files {
+		if !f.padding() {
+			fmt.Fprintf(w, "%d\t%s\t  %s\n", f.Index, humanReadableSize(f.Length), f.Path)
+		}
+	}
+	w.Flush()
+}
+
+// padding reports whether the file is BEP 47 padding, left out of listings
+func (f fileInfo) padding() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,82 @@
+// Package logging builds the structured loggers used throughout the client.
+// Library packages take an optional *slog.Logger and never log to a global
+// logger or exit the process; records carry fields such as component,
+// infohash and peer so they can be filtered.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// LevelWire is the most verbose level, below debug. It logs every message
+// exchanged with peers.
+const LevelWire = slog.LevelDebug - 4
+
+// Discard is a logger that drops every record
+var Discard = slog.New(discardHandler{})
+
+// Or returns l, or Discard if l is nil
+func Or(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return Discard
+	}
+	return l
+}
+
+// New creates a logger that writes records at level or above to w, formatted
+// as "text" or "json"
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: replaceLevel}
+
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// ParseLevel parses a level name: wire, debug, info, warn or error
+func ParseLevel(s string) (slog.Level, error) {
+	if strings.EqualFold(s, "wire") {
+		return LevelWire, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+	return level, nil
+}
+
+// replaceLevel names LevelWire in records, which slog would call DEBUG-4
+func replaceLevel(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.LevelKey {
+		if level, ok := a.Value.Any().(slog.Level); ok && level == LevelWire {
+			a.Value = slog.StringValue("WIRE")
+		}
+	}
+	return a
+}
+
+// InfoHash formats an info hash as a log attribute
+func InfoHash(h [20]byte) slog.Attr {
+	return slog.String("infohash", fmt.Sprintf("%x", h))
+}
+
+// discardHandler is a slog.Handler that is never enabled
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
@@ -0,0 +1,170 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		level   string
+		format  string
+		wantErr bool
+	}{
+		{"info", "text", false},
+		{"DEBUG", "json", false},
+		{"warn", "", false},
+		{"error", "JSON", false},
+		{"wire", "text", false},
+		{"verbose", "text", true},
+		{"info", "xml", true},
+	}
+
+	for _, tt := range tests {
+		_, err := New(&bytes.Buffer{}, tt.level, tt.format)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("New(%q, %q): expected error %v, got %v", tt.level, tt.format, tt.wantErr, err)
+		}
+	}
+}
+
+func TestLevelAndFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "warn", "json")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	logger = logger.With("component", "test", InfoHash([20]byte{0xab}))
+	logger.Info("hidden")
+	logger.Warn("shown", "peer", "1.2.3.4:6881")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 record, got %d: %q", len(lines), buf.String())
+	}
+
+	var record map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Invalid JSON record: %v", err)
+	}
+	want := map[string]string{
+		"level":     "WARN",
+		"msg":       "shown",
+		"component": "test",
+		"infohash":  "ab00000000000000000000000000000000000000",
+		"peer":      "1.2.3.4:6881",
+	}
+	for k, v := range want {
+		if record[k] != v {
+			t.Errorf("Expected %s=%q, got %q", k, v, record[k])
+		}
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	if Or(nil) != Discard {
+		t.Errorf("Expected Or(nil) to return Discard")
+	}
+	if Discard.Enabled(context.Background(), slog.LevelError) {
+		t.Errorf("Expected Discard to be disabled at every level")
+	}
+}
+
+func TestLevelWire(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "debug", "text")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	logger.Log(context.Background(), LevelWire, "hidden")
+	if buf.Len() != 0 {
+		t.Errorf("Expected no wire records at debug level, got %q", buf.String())
+	}
+
+	logger, _ = New(&buf, "WIRE", "text")
+	logger.Log(context.Background(), LevelWire, "shown")
+	if !strings.Contains(buf.String(), "level=WIRE msg=shown") {
+		t.Errorf("Expected a WIRE record, got %q", buf.String())
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.log")
+	os.WriteFile(path, []byte("old\n"), 0600)
+	r, err := OpenRotating(path, 10, 2)
+	if err != nil {
+		t.Fatalf("OpenRotating failed: %v", err)
+	}
+	defer r.Close()
+
+	// Appends to the existing file until the next write would pass 10 bytes
+	for _, line := range []string{"aaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddd\n", "eeeeeeeeeeeeeeee\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	want := map[string]string{
+		path:        "eeeeeeeeeeeeeeee\n",
+		path + ".1": "dddd\n",
+		path + ".2": "cccccccc\n",
+	}
+	for name, content := range want {
+		data, err := os.ReadFile(name)
+		if err != nil || string(data) != content {
+			t.Errorf("Expected %s to hold %q, got %q (%v)", filepath.Base(name), content, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("Expected at most 2 old files")
+	}
+}
+
+func TestTrace(t *testing.T) {
+	var logBuf, traceBuf bytes.Buffer
+	base, err := New(&logBuf, "info", "text")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	logger := slog.New(Tee(base.Handler(), NewTrace(&traceBuf))).With("peer", "10.0.0.1:6881")
+
+	logger.Info("peer connected")
+	logger.Debug("peer dropped")
+	logger.Log(context.Background(), LevelWire, "sent message", "dir", Sent, "msg", "Interested", "size", 5)
+
+	// The log gets its levels, the trace only the wire records
+	if !strings.Contains(logBuf.String(), "peer connected") || strings.Contains(logBuf.String(), "dropped") || strings.Contains(logBuf.String(), "Interested") {
+		t.Errorf("Expected only the info record in the log, got %q", logBuf.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(traceBuf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected one JSON record in the trace, got %q: %v", traceBuf.String(), err)
+	}
+	if record["level"] != "WIRE" || record["dir"] != "out" || record["peer"] != "10.0.0.1:6881" || record["time"] == nil {
+		t.Errorf("Unexpected trace record %v", record)
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://tracker.example.com:8080/announce", "http://tracker.example.com:8080/announce"},
+		{"https://tracker.example.com/a1b2c3d4e5/announce?passkey=secret", "https://tracker.example.com/…/announce"},
+		{"udp://tracker.example.com:1337", "udp://tracker.example.com:1337"},
+		{"not a url", "[invalid url]"},
+	}
+	for _, tt := range tests {
+		if got := RedactURL(tt.url); got != tt.want {
+			t.Errorf("RedactURL(%q): expected %q, got %q", tt.url, tt.want, got)
+		}
+	}
+}
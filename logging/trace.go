@@ -0,0 +1,103 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/url"
+	"path"
+)
+
+// Directions of traced traffic, for the "dir" attribute of wire records
+const (
+	Sent     = "out"
+	Received = "in"
+)
+
+// NewTrace creates a handler that writes only LevelWire records to w, as
+// JSON lines, e.g. to record every message exchanged with peers, trackers and
+// DHT nodes for a bug report. Wire records carry a summary of each message
+// and its size, never piece data.
+func NewTrace(w io.Writer) slog.Handler {
+	return traceHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: LevelWire, ReplaceAttr: replaceLevel})}
+}
+
+// traceHandler passes on only LevelWire records
+type traceHandler struct {
+	slog.Handler
+}
+
+func (h traceHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level == LevelWire
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{h.Handler.WithGroup(name)}
+}
+
+// Tee creates a handler that passes each record to every one of handlers
+// enabled for its level
+func Tee(handlers ...slog.Handler) slog.Handler {
+	return teeHandler(handlers)
+}
+
+// teeHandler hands records to several handlers
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+// RedactURL shortens a tracker URL to its scheme, host and last path
+// element, so logs shared for debugging don't leak the passkeys private
+// trackers put in the path or query
+func RedactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return "[invalid url]"
+	}
+	redacted := u.Scheme + "://" + u.Host
+	if dir, last := path.Split(u.Path); last != "" {
+		if dir != "/" {
+			redacted += "/…"
+		}
+		redacted += "/" + last
+	}
+	return redacted
+}
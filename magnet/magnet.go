@@ -0,0 +1,247 @@
+// Package magnet parses magnet URIs into the info hash, display name and
+// trackers needed to join a swarm without a .torrent file.
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Magnet holds the fields of a magnet URI used by the client
+// Format: magnet:?xt=urn:btih:<info hash>&xt=urn:btmh:<v2 info hash>&dn=<name>&tr=<tracker>&x.pe=<host:port>&so=<files>
+// A mutable torrent (BEP 46) is named by its publisher's key instead:
+// magnet:?xs=urn:btpk:<public key>&s=<salt>
+type Magnet struct {
+	InfoHash   [20]byte // zero for a mutable torrent until resolved
+	InfoHashV2 [32]byte // btmh: SHA-256 info hash of a v2 or hybrid torrent (BEP 52), or zero
+	PublicKey  []byte   // xs: ed25519 key whose DHT item names the current version (BEP 46), or nil
+	Salt       []byte   // s: salt of the DHT item, if any
+	Name       string   // dn: display name
+	Trackers   []string // tr: tracker announce URLs
+	Peers      []string // x.pe: peer addresses to connect to directly
+	SelectOnly []int    // so: 0-based indices of the only files to download (BEP 53); nil for all
+}
+
+// IsMagnet reports whether s looks like a magnet URI, after Clean
+func IsMagnet(s string) bool {
+	return strings.HasPrefix(strings.ToLower(Clean(s)), "magnet:")
+}
+
+// Clean undoes common damage to a magnet URI copied from a web page or passed
+// through a shell: surrounding whitespace, quotes that a shell such as
+// Windows cmd passed on literally, and HTML-escaped ampersands
+func Clean(s string) string {
+	s = strings.TrimSpace(s)
+	for len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		s = strings.TrimSpace(s[1 : len(s)-1])
+	}
+	return strings.ReplaceAll(s, "&amp;", "&")
+}
+
+// Parse parses a magnet URI. The URI is cleaned up with Clean first.
+func Parse(uri string) (*Magnet, error) {
+	uri = Clean(uri)
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link: %v", err)
+	}
+	if u.Scheme != "magnet" {
+		return nil, errors.New("invalid magnet link: scheme is not magnet")
+	}
+
+	q := u.Query()
+	m := &Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+		Peers:    q["x.pe"],
+	}
+
+	// Find the BitTorrent info hashes among the exact topics
+	found, foundV2 := false, false
+	for _, xt := range q["xt"] {
+		const prefix, prefixV2 = "urn:btih:", "urn:btmh:"
+		switch {
+		case !found && len(xt) >= len(prefix) && strings.EqualFold(xt[:len(prefix)], prefix):
+			if m.InfoHash, err = parseInfoHash(xt[len(prefix):]); err != nil {
+				return nil, err
+			}
+			found = true
+		case !foundV2 && len(xt) >= len(prefixV2) && strings.EqualFold(xt[:len(prefixV2)], prefixV2):
+			if m.InfoHashV2, err = parseInfoHashV2(xt[len(prefixV2):]); err != nil {
+				return nil, err
+			}
+			foundV2 = true
+		}
+	}
+
+	// A mutable torrent's publisher key (BEP 46)
+	for _, xs := range q["xs"] {
+		const prefix = "urn:btpk:"
+		if len(xs) < len(prefix) || !strings.EqualFold(xs[:len(prefix)], prefix) {
+			continue
+		}
+		key, err := hex.DecodeString(xs[len(prefix):])
+		if err != nil || len(key) != publicKeySize {
+			return nil, errors.New("invalid magnet link: invalid urn:btpk public key")
+		}
+		m.PublicKey = key
+		if s := q.Get("s"); s != "" {
+			if m.Salt, err = hex.DecodeString(s); err != nil {
+				return nil, errors.New("invalid magnet link: invalid salt")
+			}
+		}
+		break
+	}
+
+	if !found && m.PublicKey == nil {
+		if foundV2 {
+			return nil, errors.New("unsupported magnet link: v2-only torrents, with urn:btmh but no urn:btih, can't be downloaded")
+		}
+		return nil, errors.New("invalid magnet link: missing urn:btih exact topic or urn:btpk public key")
+	}
+
+	if so := q.Get("so"); so != "" {
+		if m.SelectOnly, err = parseSelectOnly(so); err != nil {
+			return nil, fmt.Errorf("invalid magnet link: %v", err)
+		}
+	}
+
+	return m, nil
+}
+
+// publicKeySize is the length of an ed25519 public key
+const publicKeySize = 32
+
+// Mutable reports whether the magnet names a mutable torrent (BEP 46)
+func (m *Magnet) Mutable() bool {
+	return m.PublicKey != nil
+}
+
+// maxSelectOnly bounds the file indices a select-only list may expand to, so
+// a range like 0-999999999 can't exhaust memory
+const maxSelectOnly = 1 << 20
+
+// parseSelectOnly parses a BEP 53 list of file indices and ranges, such as
+// "0,2,4-6", into sorted indices without duplicates
+func parseSelectOnly(s string) ([]int, error) {
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		a, err := strconv.Atoi(first)
+		if err != nil || a < 0 {
+			return nil, fmt.Errorf("invalid file index %q", part)
+		}
+		b := a
+		if isRange {
+			if b, err = strconv.Atoi(last); err != nil || b < a {
+				return nil, fmt.Errorf("invalid file range %q", part)
+			}
+		}
+		if b >= maxSelectOnly {
+			return nil, fmt.Errorf("file index %d too large", b)
+		}
+		for i := a; i <= b; i++ {
+			seen[i] = true
+		}
+	}
+	indices := make([]int, 0, len(seen))
+	for i := range seen {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	return indices, nil
+}
+
+// formatSelectOnly formats sorted file indices as a BEP 53 list, joining
+// consecutive ones into ranges
+func formatSelectOnly(indices []int) string {
+	var parts []string
+	for i := 0; i < len(indices); {
+		j := i
+		for j+1 < len(indices) && indices[j+1] == indices[j]+1 {
+			j++
+		}
+		if j > i {
+			parts = append(parts, fmt.Sprintf("%d-%d", indices[i], indices[j]))
+		} else {
+			parts = append(parts, strconv.Itoa(indices[i]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseInfoHash decodes a hex (40 chars) or base32 (32 chars) info hash
+func parseInfoHash(s string) ([20]byte, error) {
+	var hash [20]byte
+	var decoded []byte
+	var err error
+
+	switch len(s) {
+	case 40:
+		decoded, err = hex.DecodeString(s)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return hash, fmt.Errorf("invalid info hash length: %d", len(s))
+	}
+	if err != nil {
+		return hash, fmt.Errorf("invalid info hash: %v", err)
+	}
+
+	copy(hash[:], decoded)
+	return hash, nil
+}
+
+// sha256Multihash prefixes a v2 info hash in a btmh topic: the multihash
+// code of SHA-256 and the digest length, in hex
+const sha256Multihash = "1220"
+
+// parseInfoHashV2 parses a btmh topic: a SHA-256 multihash in hex
+func parseInfoHashV2(s string) ([32]byte, error) {
+	var hash [32]byte
+	decoded, err := hex.DecodeString(s)
+	if err != nil || len(decoded) != 2+len(hash) || hex.EncodeToString(decoded[:2]) != sha256Multihash {
+		return hash, errors.New("invalid magnet link: urn:btmh must be a SHA-256 multihash")
+	}
+	copy(hash[:], decoded[2:])
+	return hash, nil
+}
+
+// String formats the magnet as a URI with a hex info hash, a v2 info hash
+// if set and, for a mutable torrent, its public key. A mutable torrent not
+// yet resolved has only the key, and a v2-only one only the v2 hash.
+func (m *Magnet) String() string {
+	var params []string
+	if m.InfoHash != [20]byte{} || (!m.Mutable() && m.InfoHashV2 == [32]byte{}) {
+		params = append(params, fmt.Sprintf("xt=urn:btih:%x", m.InfoHash))
+	}
+	if m.InfoHashV2 != [32]byte{} {
+		params = append(params, fmt.Sprintf("xt=urn:btmh:%s%x", sha256Multihash, m.InfoHashV2))
+	}
+	if m.Mutable() {
+		params = append(params, fmt.Sprintf("xs=urn:btpk:%x", m.PublicKey))
+		if len(m.Salt) > 0 {
+			params = append(params, fmt.Sprintf("s=%x", m.Salt))
+		}
+	}
+	if m.Name != "" {
+		params = append(params, "dn="+url.QueryEscape(m.Name))
+	}
+	for _, tr := range m.Trackers {
+		params = append(params, "tr="+url.QueryEscape(tr))
+	}
+	for _, pe := range m.Peers {
+		params = append(params, "x.pe="+url.QueryEscape(pe))
+	}
+	if len(m.SelectOnly) > 0 {
+		params = append(params, "so="+formatSelectOnly(m.SelectOnly))
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
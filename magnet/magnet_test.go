@@ -0,0 +1,168 @@
+package magnet
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	const hexHash = "83e53cb48c4af4989cd1a53a5b4671da821b1ff4"
+
+	t.Run("HexInfoHash", func(t *testing.T) {
+		m, err := Parse("magnet:?xt=urn:btih:" + hexHash +
+			"&dn=debian.iso&tr=http%3A%2F%2Ftracker.example%2Fannounce&tr=udp%3A%2F%2Ftracker.example%3A6969")
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+
+		if hex.EncodeToString(m.InfoHash[:]) != hexHash {
+			t.Errorf("Expected info hash %s, got %x", hexHash, m.InfoHash)
+		}
+		if m.Name != "debian.iso" {
+			t.Errorf("Expected name debian.iso, got %s", m.Name)
+		}
+		if len(m.Trackers) != 2 || m.Trackers[0] != "http://tracker.example/announce" {
+			t.Errorf("Unexpected trackers: %v", m.Trackers)
+		}
+	})
+
+	t.Run("Base32InfoHash", func(t *testing.T) {
+		m, err := Parse("magnet:?xt=urn:btih:QPSTZNEMJL2JRHGRUU5FWRTR3KBBWH7U")
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		if hex.EncodeToString(m.InfoHash[:]) != hexHash {
+			t.Errorf("Expected info hash %s, got %x", hexHash, m.InfoHash)
+		}
+	})
+
+	t.Run("HybridInfoHashes", func(t *testing.T) {
+		v2Hash := strings.Repeat("5a", 32)
+		m, err := Parse("magnet:?xt=urn:btmh:1220" + v2Hash + "&xt=urn:btih:" + hexHash)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		if hex.EncodeToString(m.InfoHash[:]) != hexHash || hex.EncodeToString(m.InfoHashV2[:]) != v2Hash {
+			t.Errorf("Expected info hashes %s and %s, got %x and %x", hexHash, v2Hash, m.InfoHash, m.InfoHashV2)
+		}
+	})
+
+	t.Run("ShellAndCopyPasteDamage", func(t *testing.T) {
+		for _, uri := range []string{
+			"  magnet:?xt=urn:btih:" + hexHash + "&dn=debian.iso\n",
+			"'magnet:?xt=urn:btih:" + hexHash + "&dn=debian.iso'",
+			`"magnet:?xt=urn:btih:` + hexHash + `&dn=debian.iso"`,
+			"magnet:?xt=urn:btih:" + hexHash + "&amp;dn=debian.iso",
+			"MAGNET:?xt=URN:BTIH:" + hexHash + "&dn=debian.iso",
+		} {
+			if !IsMagnet(uri) {
+				t.Errorf("IsMagnet(%q) = false, expected true", uri)
+			}
+			m, err := Parse(uri)
+			if err != nil {
+				t.Errorf("Parse(%q) failed: %v", uri, err)
+				continue
+			}
+			if hex.EncodeToString(m.InfoHash[:]) != hexHash || m.Name != "debian.iso" {
+				t.Errorf("Parse(%q): unexpected result %+v", uri, m)
+			}
+		}
+		if IsMagnet("debian.torrent") {
+			t.Error("IsMagnet(debian.torrent) = true, expected false")
+		}
+	})
+
+	t.Run("SelectOnly", func(t *testing.T) {
+		m, err := Parse("magnet:?xt=urn:btih:" + hexHash + "&so=4-6,0,2,5")
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		if got := fmt.Sprint(m.SelectOnly); got != "[0 2 4 5 6]" {
+			t.Errorf("Expected files [0 2 4 5 6], got %s", got)
+		}
+		if !strings.HasSuffix(m.String(), "&so=0,2,4-6") {
+			t.Errorf("Expected the selection to round-trip, got %s", m.String())
+		}
+	})
+
+	t.Run("PublicKey", func(t *testing.T) {
+		key := strings.Repeat("ab", 32)
+		m, err := Parse("magnet:?xs=urn:btpk:" + key + "&s=73616c74&dn=series")
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		if !m.Mutable() || hex.EncodeToString(m.PublicKey) != key || string(m.Salt) != "salt" {
+			t.Errorf("Expected key %s and salt salt, got %x %q", key, m.PublicKey, m.Salt)
+		}
+		if m.InfoHash != [20]byte{} {
+			t.Errorf("Expected no info hash until resolved, got %x", m.InfoHash)
+		}
+		if uri := m.String(); uri != "magnet:?xs=urn:btpk:"+key+"&s=73616c74&dn=series" {
+			t.Errorf("Expected the key to round-trip, got %s", uri)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		for _, uri := range []string{
+			"http://example.com",
+			"magnet:?dn=missing-topic",
+			"magnet:?xt=urn:btih:1234",
+			"magnet:?xt=urn:btih:zz" + hexHash[2:],
+			"magnet:?xt=urn:btih:" + hexHash + "&so=1,x",
+			"magnet:?xt=urn:btih:" + hexHash + "&so=5-2",
+			"magnet:?xt=urn:btih:" + hexHash + "&so=0-99999999999",
+			"magnet:?xs=urn:btpk:abcd",
+			"magnet:?xs=urn:btpk:" + strings.Repeat("ab", 32) + "&s=zz",
+			"magnet:?xt=urn:btmh:1220" + strings.Repeat("5a", 32),
+			"magnet:?xt=urn:btih:" + hexHash + "&xt=urn:btmh:1114" + strings.Repeat("5a", 20),
+		} {
+			if _, err := Parse(uri); err == nil {
+				t.Errorf("Parse(%q) expected error, got nil", uri)
+			}
+		}
+	})
+}
+
+func TestString(t *testing.T) {
+	m := &Magnet{
+		InfoHash: [20]byte{0xab, 0xcd},
+		Name:     "my file & more.iso",
+		Trackers: []string{"udp://tracker.example:1337/announce", "http://t.example/a?x=1"},
+		Peers:    []string{"[::1]:6881"},
+	}
+
+	uri := m.String()
+	if !strings.HasPrefix(uri, "magnet:?xt=urn:btih:abcd000000") {
+		t.Errorf("Expected a hex info hash first, got %s", uri)
+	}
+
+	parsed, err := Parse(uri)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if parsed.InfoHash != m.InfoHash || parsed.Name != m.Name {
+		t.Errorf("Expected %x %q, got %x %q", m.InfoHash, m.Name, parsed.InfoHash, parsed.Name)
+	}
+	if strings.Join(parsed.Trackers, " ") != strings.Join(m.Trackers, " ") {
+		t.Errorf("Expected trackers %v, got %v", m.Trackers, parsed.Trackers)
+	}
+	if len(parsed.Peers) != 1 || parsed.Peers[0] != m.Peers[0] {
+		t.Errorf("Expected peers %v, got %v", m.Peers, parsed.Peers)
+	}
+}
+
+func TestStringV2(t *testing.T) {
+	m := &Magnet{InfoHash: [20]byte{0xab}, InfoHashV2: [32]byte{0xcd}}
+	expected := "magnet:?xt=urn:btih:ab" + strings.Repeat("0", 38) + "&xt=urn:btmh:1220cd" + strings.Repeat("0", 62)
+	if uri := m.String(); uri != expected {
+		t.Errorf("Expected %s, got %s", expected, uri)
+	}
+
+	// A v2-only torrent has no v1 info hash to give
+	m.InfoHash = [20]byte{}
+	if uri := m.String(); strings.Contains(uri, "btih") {
+		t.Errorf("Expected only a btmh topic, got %s", uri)
+	}
+}
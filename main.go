@@ -1,15 +1,52 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
-	"github.com/omkarkirpan/bittorrent-client/peer"
+	"github.com/omkarkirpan/bittorrent-client/config"
+	"github.com/omkarkirpan/bittorrent-client/download"
+	"github.com/omkarkirpan/bittorrent-client/magnet"
+	"github.com/omkarkirpan/bittorrent-client/session"
 	"github.com/omkarkirpan/bittorrent-client/torrent"
-	"github.com/omkarkirpan/bittorrent-client/tracker"
 )
 
+// torrentFetchTimeout bounds downloading a .torrent file given by URL
+const torrentFetchTimeout = 30 * time.Second
+
+// Exit codes. With several torrents the first failure decides the code.
+const (
+	exitOK          = 0   // Every torrent downloaded
+	exitFailure     = 1   // Any failure not covered below
+	exitUsage       = 2   // Invalid flags or config, or a torrent that couldn't be loaded
+	exitTracker     = 3   // No peers found and every tracker failed
+	exitNoPeers     = 4   // No peers found within --peer-timeout
+	exitStorage     = 5   // Files couldn't be created or written
+	exitInterrupted = 130 // Stopped by SIGINT or SIGTERM, as shells report for SIGINT
+)
+
+// exitCode maps the error a torrent failed with to an exit code
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, session.ErrTrackers):
+		return exitTracker
+	case errors.Is(err, download.ErrNoPeers):
+		return exitNoPeers
+	case errors.Is(err, download.ErrStorage):
+		return exitStorage
+	default:
+		return exitFailure
+	}
+}
+
 // humanReadableSize converts bytes to a human-readable format.
 func humanReadableSize(bytes int64) string {
 	const (
@@ -30,154 +67,265 @@ func humanReadableSize(bytes int64) string {
 	}
 }
 
-func main() {
-	fmt.Println("BitTorrent Client")
-
-	// Test parsing a torrent file
-	torrentFile, err := torrent.ParseFromFile("Debian.torrent")
-	if err != nil {
-		log.Fatalf("Error parsing torrent file: %v", err)
-	}
-
-	fmt.Printf("Torrent Name: %s\n", torrentFile.Info.Name)
-	fmt.Printf("Announce URL: %s\n", torrentFile.Announce)
-	fmt.Printf("Piece Length: %d bytes\n", torrentFile.Info.PieceLength)
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [download] [flags] <torrent>...\n", os.Args[0])
+	fmt.Fprintf(out, "       %s info|inspect [--json] [--scrape] [--files | --magnet] <torrent>\n", os.Args[0])
+	fmt.Fprintf(out, "       %s verify [--data dir] [--rename name] [--flat] [--resume] [--json] <torrent>\n", os.Args[0])
+	fmt.Fprintf(out, "       %s create --announce <url> [flags] <file or directory>...\n", os.Args[0])
+	fmt.Fprintf(out, "       %s edit [--add-tracker url] [--replace-tracker old=new] [flags] <torrent file>\n", os.Args[0])
+	fmt.Fprintf(out, "       %s scrape [--json] [--bind addr] [--proxy host:port] <torrent>\n", os.Args[0])
+	fmt.Fprintf(out, "       %s health [--sample n] [--no-dht] [--json] [--bind addr] [--proxy host:port] <torrent>\n", os.Args[0])
+	fmt.Fprintf(out, "       %s stream [--addr host:port] [--file index] [flags] <torrent>\n", os.Args[0])
+	fmt.Fprintf(out, "       %s daemon|serve [flags]\n", os.Args[0])
+	fmt.Fprintf(out, "       %s stats [--state-dir dir] [--json]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Each torrent is a .torrent file path, an http(s) URL of a .torrent file,")
+	fmt.Fprintln(out, "or a magnet link.")
+	fmt.Fprintln(out, "\nExit status: 0 when every torrent downloaded, 1 on other errors, 2 for invalid")
+	fmt.Fprintln(out, "flags or torrents, 3 when every tracker failed, 4 when no peers were found")
+	fmt.Fprintln(out, "within --peer-timeout, 5 on disk errors and 130 when interrupted.")
+	fmt.Fprintln(out, "\nSettings not given as flags are read from the config file and then from")
+	fmt.Fprintf(out, "%s<FLAG> environment variables, e.g. %s.\n", config.EnvPrefix, config.EnvName("output-dir"))
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
 
-	// Print file information
-	if torrentFile.Info.Length > 0 {
-		fmt.Printf("Single File Mode: %s (%d bytes)\n", torrentFile.Info.Name, torrentFile.Info.Length)
-	} else {
-		fmt.Printf("Multiple Files Mode: %d files\n", len(torrentFile.Info.Files))
-		for i, file := range torrentFile.Info.Files {
-			fmt.Printf("  File %d: %v (%d bytes)\n", i+1, file.Path, file.Length)
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "download":
+			os.Exit(runDownload(os.Args[2:]))
+		case "info", "inspect":
+			os.Exit(runInfo(os.Args[2:]))
+		case "verify":
+			os.Exit(runVerify(os.Args[2:]))
+		case "create":
+			os.Exit(runCreate(os.Args[2:]))
+		case "edit":
+			os.Exit(runEdit(os.Args[2:]))
+		case "scrape":
+			os.Exit(runScrape(os.Args[2:]))
+		case "health":
+			os.Exit(runHealth(os.Args[2:]))
+		case "stream":
+			os.Exit(runStream(os.Args[2:]))
+		case "daemon", "serve":
+			os.Exit(runDaemon(os.Args[2:]))
+		case "stats":
+			os.Exit(runStats(os.Args[2:]))
 		}
 	}
+	os.Exit(runDownload(os.Args[1:]))
+}
 
-	// Calculate and print the info hash
-	infoHash, err := torrentFile.InfoHash()
-	if err != nil {
-		log.Fatalf("Error calculating info hash: %v", err)
-	}
+// downloadOptions are the download command's settings on top of those it
+// shares with the daemon
+type downloadOptions struct {
+	options
+	json       bool
+	noProgress bool
+	showPeers  bool
+	showFiles  bool
+	rename     string
+	selection  fileSelection
+}
 
-	fmt.Printf("Info Hash: %x\n", infoHash)
+// register defines the flags for o on fs
+func (o *downloadOptions) register(fs *flag.FlagSet) {
+	o.options.register(fs)
+	fs.BoolVar(&o.json, "json", false, "report status as JSON lines instead of progress bars")
+	fs.BoolVar(&o.noProgress, "no-progress", false, "don't report progress while downloading, e.g. for scripts and cron jobs")
+	fs.BoolVar(&o.showPeers, "show-peers", false, "list each torrent's connected peers under its progress line")
+	fs.BoolVar(&o.showFiles, "show-files", false, "list the files of multi-file torrents with their progress under each torrent's progress line")
+	fs.StringVar(&o.rename, "rename", "", "save the content under this file or folder name instead of the torrent's name (one torrent only)")
+	o.selection.register(fs)
+}
 
-	// Print information about pieces
-	numPieces := torrentFile.NumPieces()
-	fmt.Printf("Number of Pieces: %d\n", numPieces)
-	fmt.Printf("Total Size: %s bytes\n", humanReadableSize(torrentFile.TotalLength()))
+// runDownload downloads the torrents given as arguments and returns the exit code
+func runDownload(arguments []string) int {
+	var opts downloadOptions
+	opts.register(flag.CommandLine)
+	flag.Usage = usage
+	flag.CommandLine.Parse(arguments)
 
-	// Print first few piece hashes
-	displayCount := 3
-	if displayCount > numPieces {
-		displayCount = numPieces
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Error: no torrent given")
+		usage()
+		return exitUsage
+	}
+	if opts.rename != "" && flag.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "Error: --rename needs a single torrent")
+		return exitUsage
+	}
+	if opts.selection.indices != "" && flag.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "Error: --files needs a single torrent")
+		return exitUsage
 	}
 
-	for i := 0; i < displayCount; i++ {
-		hash, err := torrentFile.PieceHash(i)
-		if err != nil {
-			log.Fatalf("Error getting piece hash: %v", err)
+	cfg, err := opts.load(flag.CommandLine)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	if cfg.SeedPause {
+		// Nothing could resume a paused torrent, so the download would never end
+		fmt.Fprintln(os.Stderr, "Error: --seed-pause only applies to the daemon")
+		return exitUsage
+	}
+	cfg.Rename = opts.rename
+	if cfg.Rename != "" {
+		if err := download.ValidateName(cfg.Rename); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --rename: %v\n", err)
+			return exitUsage
 		}
-		fmt.Printf("Piece %d Hash: %x (Length: %s bytes)\n", i, hash, humanReadableSize(torrentFile.PieceLength(i)))
+	}
+	if !opts.selection.empty() {
+		cfg.SelectFiles = opts.selection.priorities
 	}
 
-	// Also print last piece if there are more than the display count
-	if numPieces > displayCount {
-		hash, err := torrentFile.PieceHash(numPieces - 1)
+	// Load every torrent first, so bad arguments fail fast
+	fetch, err := fetchClient(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	code := exitOK
+	var args []torrentArg
+	for _, arg := range flag.Args() {
+		a, err := loadTorrentArg(arg, fetch)
+		if err == nil && a.tf != nil && cfg.SelectFiles != nil {
+			// Magnet links are checked once their metadata arrives
+			_, err = cfg.SelectFiles(a.tf)
+		}
 		if err != nil {
-			log.Fatalf("Error getting piece hash: %v", err)
+			fmt.Fprintf(os.Stderr, "Error loading %s: %v\n", arg, err)
+			code = exitUsage
+			continue
 		}
-		fmt.Printf("Last Piece (%d) Hash: %x (Length: %s bytes)\n",
-			numPieces-1, hash, humanReadableSize(torrentFile.PieceLength(numPieces-1)))
+		args = append(args, a)
+	}
+	if len(args) == 0 {
+		return code
 	}
 
-	// Discover peers
-	fmt.Println("\nDiscovering peers...")
-	peers, err := tracker.RequestPeers(torrentFile, 6881) // 6881 is a common BitTorrent port
+	sess, err := session.New(cfg)
 	if err != nil {
-		log.Fatalf("Error discovering peers: %v", err)
+		fmt.Fprintf(os.Stderr, "Error starting session: %v\n", err)
+		return exitFailure
 	}
+	defer sess.Close()
 
-	fmt.Printf("Found %d peers:\n", len(peers))
-	for i, p := range peers {
-		if i >= 5 {
-			fmt.Printf("... and %d more\n", len(peers)-5)
-			break
+	if opts.debugAddr != "" {
+		ln, err := startDebugServer(opts.debugAddr, sess, cfg.Logger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting debug server: %v\n", err)
+			return exitFailure
 		}
-		fmt.Printf("  %s\n", p.String())
+		defer ln.Close()
 	}
 
-	// Generate a peer ID (this should match the one used in tracker request)
-	var peerId [20]byte
-	copy(peerId[:], []byte("-GO0001-1234567890123"))
-
-	// Test peer handshake with the first few peers
-	fmt.Println("\nAttempting handshakes with peers...")
-
-	maxPeersToTry := 5
-	if len(peers) < maxPeersToTry {
-		maxPeersToTry = len(peers)
+	// Add every torrent before waiting so they download in parallel
+	var torrents []*session.Torrent
+	for _, a := range args {
+		t, err := a.add(sess)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error adding %s: %v\n", a.arg, err)
+			if code == exitOK {
+				code = exitUsage
+			}
+			continue
+		}
+		if !opts.json && !opts.noProgress && !opts.quiet {
+			fmt.Printf("Added %s (info hash %x)\n", t.Name(), t.InfoHash())
+		}
+		torrents = append(torrents, t)
 	}
 
-	handshakeSuccessful := false
-	var successfulPeer tracker.Peer
-	var successfulHandshake *peer.Handshake
+	ctx, stop := notifyShutdown(cfg.Logger)
+	defer stop()
 
-	// Try each peer until we get a successful handshake
-	for i := 0; i < maxPeersToTry && !handshakeSuccessful; i++ {
-		fmt.Printf("Trying peer %d: %s\n", i+1, peers[i].String())
+	display := newProgressDisplay(os.Stdout, torrents)
+	display.json = opts.json
+	display.quiet = opts.noProgress || opts.quiet
+	display.peers = opts.showPeers
+	display.files = opts.showFiles
+	display.run(ctx)
 
-		// Set a timeout for the handshake
-		handshakeChan := make(chan struct {
-			handshake *peer.Handshake
-			err       error
-		})
+	// Stop cleanly on SIGINT or SIGTERM instead of dying mid-write
+	if ctx.Err() != nil {
+		shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := sess.Shutdown(shutdown); err != nil {
+			fmt.Fprintf(os.Stderr, "Error stopping session: %v\n", err)
+		}
+		fmt.Fprintln(os.Stderr, "Interrupted")
+		return exitInterrupted
+	}
 
-		go func(p tracker.Peer) {
-			handshake, conn, err := peer.PerformHandshake(p.String(), infoHash, peerId)
-			if err == nil && conn != nil {
-				defer conn.Close()
-			}
-			handshakeChan <- struct {
-				handshake *peer.Handshake
-				err       error
-			}{handshake, err}
-		}(peers[i])
-
-		// Wait for handshake or timeout
-		select {
-		case result := <-handshakeChan:
-			if result.err != nil {
-				fmt.Printf("  Handshake failed: %v\n", result.err)
-			} else {
-				fmt.Println("  Handshake successful!")
-				handshakeSuccessful = true
-				successfulPeer = peers[i]
-				successfulHandshake = result.handshake
+	for _, t := range torrents {
+		if t.State() != session.StateComplete {
+			fmt.Fprintf(os.Stderr, "Failed to download %s: %v\n", t.Name(), t.Err())
+			if code == exitOK {
+				code = exitCode(t.Err())
 			}
-		case <-time.After(5 * time.Second):
-			fmt.Println("  Handshake timed out")
+			continue
+		}
+		if opts.json || opts.quiet {
+			continue
 		}
+		fmt.Printf("Downloaded %s (%s)\n", t.Name(), humanReadableSize(t.Stats().Wanted))
 	}
+	return code
+}
+
+// torrentArg is a torrent given on the command line as a magnet link, a URL
+// or a file path
+type torrentArg struct {
+	arg string
+	tf  *torrent.TorrentFile // nil for magnet links
+}
 
-	// If we found a successful peer, display information about it
-	if handshakeSuccessful {
-		fmt.Printf("\nSuccessfully connected to peer: %s\n", successfulPeer.String())
-		fmt.Printf("Remote peer ID: %x\n", successfulHandshake.PeerID)
+// errMutableMagnet is returned by commands that need an info hash when given
+// the magnet link of a mutable torrent, whose version only the DHT knows
+var errMutableMagnet = errors.New("magnet link names a mutable torrent (BEP 46) but no version of it")
 
-		// Check for extension support
-		if successfulHandshake.HasExtension(peer.ExtensionDHT) {
-			fmt.Println("Peer supports DHT")
-		}
-		if successfulHandshake.HasExtension(peer.ExtensionExtensions) {
-			fmt.Println("Peer supports Extension Protocol")
+// loadTorrentArg parses a magnet link, or loads a torrent file or a URL with
+// client
+func loadTorrentArg(arg string, client *http.Client) (torrentArg, error) {
+	if magnet.IsMagnet(arg) {
+		m, err := magnet.Parse(arg)
+		if err != nil {
+			return torrentArg{}, err
 		}
-		if successfulHandshake.HasExtension(peer.ExtensionFast) {
-			fmt.Println("Peer supports Fast Extension")
+		// Unquoted, a shell cuts the link off at the first & and runs the
+		// rest as separate commands, losing the trackers
+		if len(m.Trackers) == 0 && len(m.Peers) == 0 && !strings.Contains(arg, "&") {
+			fmt.Fprintf(os.Stderr, "Warning: magnet link has no trackers, so peers can only come from the DHT.\n")
+			fmt.Fprintf(os.Stderr, "If your shell cut it off at '&', put the link in quotes.\n")
 		}
-	} else {
-		fmt.Println("\nFailed to handshake with any peers. This can happen if:")
-		fmt.Println("1. The peers are not online or are not accepting connections")
-		fmt.Println("2. Network restrictions are preventing the connections")
-		fmt.Println("3. The peers have reached their connection limit")
+		return torrentArg{arg: arg}, nil
+	}
+
+	tf, err := torrent.LoadWith(client, arg)
+	return torrentArg{arg: arg, tf: tf}, err
+}
+
+// fetchClient returns a client for .torrent URLs that takes the same route
+// as a session with cfg, e.g. through its strict proxy
+func fetchClient(cfg session.Config) (*http.Client, error) {
+	client, err := session.NewHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	fetch := *client
+	fetch.Timeout = torrentFetchTimeout
+	return &fetch, nil
+}
+
+// add adds the torrent to sess
+func (a torrentArg) add(sess *session.Session) (*session.Torrent, error) {
+	if a.tf == nil {
+		return sess.AddMagnet(a.arg)
 	}
+	return sess.AddTorrent(a.tf)
 }
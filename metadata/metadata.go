@@ -0,0 +1,238 @@
+// Package metadata fetches the info dictionary of a torrent from peers using
+// the ut_metadata extension (BEP 9), which is how magnet links are resolved,
+// and answers peers fetching it from us.
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+	"github.com/omkarkirpan/bittorrent-client/peer"
+)
+
+// Protocol constants
+const (
+	BlockSize    = 16384            // Metadata is exchanged in 16 KiB pieces
+	MaxSize      = 10 * 1024 * 1024 // Refuse absurdly large metadata
+	FetchTimeout = 30 * time.Second
+	LocalID      = 1 // ID we assign to ut_metadata in our handshake
+)
+
+// ut_metadata message types
+const (
+	msgRequest = 0
+	msgData    = 1
+	msgReject  = 2
+)
+
+// Fetch connects to a peer, negotiates ut_metadata through the extension
+// protocol and downloads the info dictionary, verifying it against infoHash
+func Fetch(ctx context.Context, addr string, infoHash, peerID [20]byte) ([]byte, error) {
+	return FetchWith(ctx, nil, addr, infoHash, peerID)
+}
+
+// FetchWith is like Fetch but connects to the peer with dial
+func FetchWith(ctx context.Context, dial peer.DialFunc, addr string, infoHash, peerID [20]byte) ([]byte, error) {
+	h := peer.NewHandshake(infoHash, peerID)
+	h.SetExtension(peer.ExtensionExtensions)
+
+	remote, conn, err := peer.ConnectWith(ctx, dial, addr, h)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if !remote.HasExtension(peer.ExtensionExtensions) {
+		return nil, errors.New("peer does not support the extension protocol")
+	}
+
+	// Abort the exchange when the context is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	conn.SetDeadline(time.Now().Add(FetchTimeout))
+
+	return exchange(conn, infoHash)
+}
+
+// exchange runs the ut_metadata exchange over an established connection
+func exchange(rw io.ReadWriter, infoHash [20]byte) ([]byte, error) {
+	// Advertise ut_metadata in our extension handshake
+	hs := &peer.ExtensionHandshake{M: map[string]uint8{"ut_metadata": LocalID}, Client: peer.ClientVersion}
+	if _, err := hs.Message().WriteTo(rw); err != nil {
+		return nil, err
+	}
+
+	// Wait for the remote extension handshake
+	var remoteID uint8
+	var size int
+	for {
+		id, payload, err := readExtended(rw)
+		if err != nil {
+			return nil, err
+		}
+		if id != peer.ExtHandshakeID {
+			continue
+		}
+
+		remoteID, size, err = parseHandshake(payload)
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	// Request the pieces one at a time; metadata is small so pipelining gains little
+	numPieces := (size + BlockSize - 1) / BlockSize
+	buf := make([]byte, size)
+	for i := 0; i < numPieces; i++ {
+		req, err := bencode.EncodeDict(map[string]interface{}{"msg_type": msgRequest, "piece": i})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeExtended(rw, remoteID, req); err != nil {
+			return nil, err
+		}
+
+		data, err := readPiece(rw, i)
+		if err != nil {
+			return nil, err
+		}
+
+		// All pieces but the last are exactly BlockSize long
+		expected := BlockSize
+		if i == numPieces-1 {
+			expected = size - i*BlockSize
+		}
+		if len(data) != expected {
+			return nil, fmt.Errorf("metadata piece %d has length %d, expected %d", i, len(data), expected)
+		}
+		copy(buf[i*BlockSize:], data)
+	}
+
+	// Verify the metadata against the info hash
+	if sha1.Sum(buf) != infoHash {
+		return nil, fmt.Errorf("metadata doesn't match: %w", peer.ErrInfoHashMismatch)
+	}
+
+	return buf, nil
+}
+
+// Answer builds the answer to a ut_metadata message a peer sent us, given
+// the info dictionary we serve: the requested piece, or a reject when we
+// don't have it. Other message types need no answer, so it returns nil.
+func Answer(info, payload []byte) ([]byte, error) {
+	decoded, _, err := bencode.Decode(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata message: %v", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata message is not a dictionary")
+	}
+	if msgType, _ := dict["msg_type"].(int64); msgType != msgRequest {
+		return nil, nil
+	}
+
+	piece, _ := dict["piece"].(int64)
+	if piece < 0 || int(piece)*BlockSize >= len(info) {
+		return bencode.EncodeDict(map[string]interface{}{"msg_type": msgReject, "piece": piece})
+	}
+	header, err := bencode.EncodeDict(map[string]interface{}{"msg_type": msgData, "piece": piece, "total_size": len(info)})
+	if err != nil {
+		return nil, err
+	}
+	start := int(piece) * BlockSize
+	return append(header, info[start:min(start+BlockSize, len(info))]...), nil
+}
+
+// readPiece waits for the data message of the requested metadata piece
+func readPiece(r io.Reader, index int) ([]byte, error) {
+	for {
+		id, payload, err := readExtended(r)
+		if err != nil {
+			return nil, err
+		}
+		if id != LocalID {
+			continue
+		}
+
+		piece, data, err := parseData(payload)
+		if err != nil {
+			return nil, err
+		}
+		if piece == index {
+			return data, nil
+		}
+	}
+}
+
+// parseHandshake extracts the remote ut_metadata ID and metadata size
+func parseHandshake(payload []byte) (uint8, int, error) {
+	hs, err := peer.ParseExtensionHandshake(payload)
+	if err != nil {
+		return 0, 0, err
+	}
+	id := hs.M["ut_metadata"]
+	if id == 0 {
+		return 0, 0, errors.New("peer does not support ut_metadata")
+	}
+	if hs.MetadataSize <= 0 || hs.MetadataSize > MaxSize {
+		return 0, 0, fmt.Errorf("invalid metadata size: %d", hs.MetadataSize)
+	}
+	return id, hs.MetadataSize, nil
+}
+
+// parseData parses a ut_metadata data message: a bencoded header followed by raw bytes
+func parseData(payload []byte) (int, []byte, error) {
+	decoded, n, err := bencode.Decode(payload)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid metadata message: %v", err)
+	}
+
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return 0, nil, errors.New("metadata message is not a dictionary")
+	}
+
+	msgType, _ := dict["msg_type"].(int64)
+	piece, _ := dict["piece"].(int64)
+
+	switch msgType {
+	case msgData:
+		return int(piece), payload[n:], nil
+	case msgReject:
+		return 0, nil, fmt.Errorf("peer rejected metadata piece %d", piece)
+	default:
+		return 0, nil, fmt.Errorf("unexpected metadata message type: %d", msgType)
+	}
+}
+
+// writeExtended sends an extended message with the given extended ID
+func writeExtended(w io.Writer, id uint8, payload []byte) error {
+	msg := peer.FormatMessage(peer.MsgExtended, append([]byte{id}, payload...))
+	_, err := msg.WriteTo(w)
+	return err
+}
+
+// readExtended reads messages until an extended message arrives
+func readExtended(r io.Reader) (uint8, []byte, error) {
+	for {
+		msg, err := peer.ReadMessage(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		if msg.Length == 0 || msg.Type != peer.MsgExtended {
+			continue
+		}
+		if len(msg.Payload) == 0 {
+			return 0, nil, errors.New("empty extended message")
+		}
+		return msg.Payload[0], bytes.Clone(msg.Payload[1:]), nil
+	}
+}
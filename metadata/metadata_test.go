@@ -0,0 +1,137 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+	"github.com/omkarkirpan/bittorrent-client/peer"
+)
+
+// servePeer plays the remote side of a ut_metadata exchange over conn
+func servePeer(t *testing.T, conn net.Conn, info []byte) {
+	defer conn.Close()
+
+	// Read our extension handshake before replying; net.Pipe is unbuffered
+	if _, _, err := readExtended(conn); err != nil {
+		return
+	}
+
+	const remoteID = 3
+	hs, _ := bencode.EncodeDict(map[string]interface{}{
+		"m":             map[string]interface{}{"ut_metadata": remoteID},
+		"metadata_size": len(info),
+	})
+	if err := writeExtended(conn, peer.ExtHandshakeID, hs); err != nil {
+		return
+	}
+
+	for {
+		id, payload, err := readExtended(conn)
+		if err != nil {
+			return
+		}
+		if id != remoteID {
+			continue
+		}
+
+		answer, err := Answer(info, payload)
+		if err != nil {
+			t.Errorf("Invalid request: %v", err)
+			return
+		}
+		if err := writeExtended(conn, LocalID, answer); err != nil {
+			return
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	// Large enough to span two metadata pieces
+	info := bytes.Repeat([]byte("d4:name4:teste"), 2000)
+	infoHash := sha1.Sum(info)
+
+	t.Run("Success", func(t *testing.T) {
+		local, remote := net.Pipe()
+		defer local.Close()
+		go servePeer(t, remote, info)
+
+		got, err := exchange(local, infoHash)
+		if err != nil {
+			t.Fatalf("exchange failed: %v", err)
+		}
+		if !bytes.Equal(got, info) {
+			t.Errorf("Metadata mismatch: got %d bytes, expected %d", len(got), len(info))
+		}
+	})
+
+	t.Run("HashMismatch", func(t *testing.T) {
+		local, remote := net.Pipe()
+		defer local.Close()
+		go servePeer(t, remote, info)
+
+		_, err := exchange(local, [20]byte{1})
+		if !errors.Is(err, peer.ErrInfoHashMismatch) {
+			t.Errorf("Expected hash mismatch error, got %v", err)
+		}
+	})
+}
+
+func TestAnswer(t *testing.T) {
+	info := bytes.Repeat([]byte{'x'}, BlockSize+10)
+	testCases := []struct {
+		name    string
+		request string
+		answer  string // "" for no answer
+		wantErr bool
+	}{
+		{"FirstPiece", "d8:msg_typei0e5:piecei0ee", "d8:msg_typei1e5:piecei0e10:total_sizei16394ee" + string(info[:BlockSize]), false},
+		{"LastPiece", "d8:msg_typei0e5:piecei1ee", "d8:msg_typei1e5:piecei1e10:total_sizei16394ee" + string(info[BlockSize:]), false},
+		{"OutOfRange", "d8:msg_typei0e5:piecei2ee", "d8:msg_typei2e5:piecei2ee", false},
+		{"Negative", "d8:msg_typei0e5:piecei-1ee", "d8:msg_typei2e5:piecei-1ee", false},
+		{"Reject", "d8:msg_typei2e5:piecei0ee", "", false},
+		{"Invalid", "i0e", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			answer, err := Answer(info, []byte(tc.request))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error %v, got %v", tc.wantErr, err)
+			}
+			if string(answer) != tc.answer {
+				t.Errorf("Expected answer %.60q, got %.60q", tc.answer, answer)
+			}
+		})
+	}
+
+	// Without metadata every request is rejected
+	if answer, _ := Answer(nil, []byte("d8:msg_typei0e5:piecei0ee")); string(answer) != "d8:msg_typei2e5:piecei0ee" {
+		t.Errorf("Expected a reject without metadata, got %q", answer)
+	}
+}
+
+func TestParseHandshake(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		valid bool
+	}{
+		{"Valid", "d1:md11:ut_metadatai2ee13:metadata_sizei100ee", true},
+		{"NoMetadataSupport", "d1:md6:ut_pexi1ee13:metadata_sizei100ee", false},
+		{"MissingSize", "d1:md11:ut_metadatai2eee", false},
+		{"TooLarge", "d1:md11:ut_metadatai2ee13:metadata_sizei99999999ee", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := parseHandshake([]byte(tc.input))
+			if (err == nil) != tc.valid {
+				t.Errorf("parseHandshake(%q) error = %v, valid = %v", tc.input, err, tc.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Bitfield records which pieces a peer has, one bit per piece, high bit of
+// the first byte first, as sent in BITFIELD messages
+type Bitfield []byte
+
+// NewBitfield returns an empty bitfield for numPieces pieces
+func NewBitfield(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+// FullBitfield returns a bitfield for numPieces pieces with every piece set,
+// as a HAVE ALL message (BEP 6) stands for
+func FullBitfield(numPieces int) Bitfield {
+	bf := NewBitfield(numPieces)
+	for i := range bf {
+		bf[i] = 0xff
+	}
+	if spare := numPieces % 8; spare != 0 {
+		bf[len(bf)-1] = 0xff << (8 - spare)
+	}
+	return bf
+}
+
+// ParseBitfield parses a BITFIELD message from a peer of a torrent with
+// numPieces pieces. As BEP 3 asks, a payload of the wrong size, or with any
+// of the spare bits after the last piece set, is an error.
+func ParseBitfield(msg *Message, numPieces int) (Bitfield, error) {
+	if msg.Type != MsgBitfield {
+		return nil, errors.New("not a BITFIELD message")
+	}
+	if len(msg.Payload) != (numPieces+7)/8 {
+		return nil, fmt.Errorf("invalid bitfield length %d for %d pieces", len(msg.Payload), numPieces)
+	}
+	bf := Bitfield(append([]byte(nil), msg.Payload...))
+	if spare := numPieces % 8; spare != 0 && bf[len(bf)-1]&(0xff>>spare) != 0 {
+		return nil, errors.New("bitfield has spare bits set")
+	}
+	return bf, nil
+}
+
+// HasPiece reports whether the bit for a piece is set. Indexes out of range
+// have no bit.
+func (bf Bitfield) HasPiece(index int) bool {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return false
+	}
+	return bf[byteIndex]>>(7-index%8)&1 != 0
+}
+
+// SetPiece sets the bit for a piece. Indexes out of range are ignored.
+func (bf Bitfield) SetPiece(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] |= 1 << (7 - index%8)
+}
+
+// Count returns the number of pieces set
+func (bf Bitfield) Count() int {
+	n := 0
+	for _, b := range bf {
+		n += bits.OnesCount8(b)
+	}
+	return n
+}
+
+// Empty reports whether no piece is set
+func (bf Bitfield) Empty() bool {
+	for _, b := range bf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Complete reports whether every one of numPieces pieces is set
+func (bf Bitfield) Complete(numPieces int) bool {
+	for i := 0; i < numPieces; i++ {
+		if !bf.HasPiece(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Message returns the BITFIELD message announcing the pieces
+func (bf Bitfield) Message() *Message {
+	return FormatMessage(MsgBitfield, bf)
+}
@@ -0,0 +1,71 @@
+package peer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBitfield(t *testing.T) {
+	bf := NewBitfield(10)
+	if len(bf) != 2 || !bf.Empty() {
+		t.Fatalf("Expected 2 empty bytes, got %v", bf)
+	}
+	for _, i := range []int{0, 7, 9, 16, -1} {
+		bf.SetPiece(i)
+	}
+	if !bytes.Equal(bf, []byte{0x81, 0x40}) {
+		t.Errorf("Expected pieces 0, 7 and 9 set, got %08b", bf)
+	}
+	for i, want := range []bool{true, false, false, false, false, false, false, true, false, true, false} {
+		if got := bf.HasPiece(i); got != want {
+			t.Errorf("HasPiece(%d): expected %v, got %v", i, want, got)
+		}
+	}
+	if bf.Count() != 3 || bf.Empty() || bf.Complete(10) {
+		t.Errorf("Expected 3 of 10 pieces, got %d", bf.Count())
+	}
+
+	// It round-trips through a BITFIELD message
+	msg, err := ReadMessage(bytes.NewReader(bf.Message().Serialize()))
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	parsed, err := ParseBitfield(msg, 10)
+	if err != nil {
+		t.Fatalf("ParseBitfield failed: %v", err)
+	}
+	if !bytes.Equal(parsed, bf) {
+		t.Errorf("Expected %08b back, got %08b", bf, parsed)
+	}
+
+	// A full bitfield leaves the spare bits clear
+	full := FullBitfield(10)
+	if !bytes.Equal(full, []byte{0xff, 0xc0}) || !full.Complete(10) || full.Count() != 10 {
+		t.Errorf("Expected all 10 pieces set, got %08b", full)
+	}
+}
+
+func TestParseBitfield(t *testing.T) {
+	tests := []struct {
+		name      string
+		msg       *Message
+		numPieces int
+		wantErr   bool
+	}{
+		{"complete", FormatMessage(MsgBitfield, []byte{0xff, 0xc0}), 10, false},
+		{"whole bytes", FormatMessage(MsgBitfield, []byte{0xff}), 8, false},
+		{"too short", FormatMessage(MsgBitfield, []byte{0xff}), 10, true},
+		{"too long", FormatMessage(MsgBitfield, []byte{0xff, 0, 0}), 10, true},
+		{"spare bits set", FormatMessage(MsgBitfield, []byte{0xff, 0xe0}), 10, true},
+		{"wrong type", FormatMessage(MsgHave, []byte{0, 0, 0, 1}), 10, true},
+	}
+	for _, tt := range tests {
+		bf, err := ParseBitfield(tt.msg, tt.numPieces)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+		if err == nil && !bf.Complete(tt.numPieces) {
+			t.Errorf("%s: expected every piece set, got %08b", tt.name, bf)
+		}
+	}
+}
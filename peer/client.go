@@ -0,0 +1,308 @@
+package peer
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/logging"
+)
+
+// Keep-alive timing (BEP 3)
+const (
+	KeepAliveInterval = 2 * time.Minute // Idle time after which Run sends a keep-alive
+	IdleTimeout       = 3 * time.Minute // Silence after which Run gives up on the peer
+	writeTimeout      = 30 * time.Second
+)
+
+// Client is a connection to a peer after the handshake. It tracks the choke
+// and interest state of both sides and the pieces the peer has as messages
+// come and go. Sending and reading may happen from different goroutines, and
+// the state may be read from any.
+type Client struct {
+	Conn      net.Conn
+	Handshake *Handshake // The peer's handshake
+	numPieces int
+
+	// Logger, if set, traces every message sent and received at
+	// logging.LevelWire. Set it before the first Send or Read.
+	Logger *slog.Logger
+
+	choked         atomic.Bool // the peer is choking us
+	interested     atomic.Bool // we want pieces from the peer
+	peerChoked     atomic.Bool // we're choking the peer
+	peerInterested atomic.Bool // the peer wants pieces from us
+
+	mu       sync.Mutex
+	bitfield Bitfield
+
+	writeMu  sync.Mutex
+	lastSent atomic.Int64 // unix nanoseconds of the last message sent
+}
+
+// NewClient connects to a peer for a torrent with numPieces pieces and
+// completes the handshake. numPieces may be 0 when it isn't known yet, e.g.
+// before a magnet link's metadata arrives; HAVE and BITFIELD messages are
+// then taken as they come.
+func NewClient(ctx context.Context, peerAddr string, infoHash, peerID [20]byte, numPieces int, opts ...Option) (*Client, error) {
+	hs, conn, err := Connect(ctx, peerAddr, NewHandshake(infoHash, peerID), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientConn(conn, hs, numPieces), nil
+}
+
+// NewClientConn wraps a connection whose handshake is done, e.g. one from
+// PerformHandshake or accepted from a listener, with the peer's handshake
+func NewClientConn(conn net.Conn, hs *Handshake, numPieces int) *Client {
+	c := &Client{Conn: conn, Handshake: hs, numPieces: numPieces, bitfield: NewBitfield(numPieces)}
+	c.choked.Store(true)
+	c.peerChoked.Store(true)
+	c.lastSent.Store(time.Now().UnixNano())
+	return c
+}
+
+// Choked reports whether the peer is choking us; it is until it unchokes us
+func (c *Client) Choked() bool { return c.choked.Load() }
+
+// Interested reports whether we told the peer we want its pieces
+func (c *Client) Interested() bool { return c.interested.Load() }
+
+// PeerChoked reports whether we're choking the peer; we are until we unchoke it
+func (c *Client) PeerChoked() bool { return c.peerChoked.Load() }
+
+// PeerInterested reports whether the peer told us it wants our pieces
+func (c *Client) PeerInterested() bool { return c.peerInterested.Load() }
+
+// HasPiece reports whether the peer told us it has a piece
+func (c *Client) HasPiece(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bitfield.HasPiece(index)
+}
+
+// Bitfield returns a copy of the pieces the peer told us it has
+func (c *Client) Bitfield() Bitfield {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append(Bitfield(nil), c.bitfield...)
+}
+
+// Send writes a message to the peer, updating our side's state for CHOKE,
+// UNCHOKE, INTERESTED and NOT INTERESTED
+func (c *Client) Send(msg *Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := msg.WriteTo(c.Conn); err != nil {
+		return err
+	}
+	c.lastSent.Store(time.Now().UnixNano())
+	c.trace(logging.Sent, msg)
+	if msg.Length == 0 {
+		return nil
+	}
+	switch msg.Type {
+	case MsgChoke:
+		c.peerChoked.Store(true)
+	case MsgUnchoke:
+		c.peerChoked.Store(false)
+	case MsgInterested:
+		c.interested.Store(true)
+	case MsgNotInterested:
+		c.interested.Store(false)
+	}
+	return nil
+}
+
+// SendInterested tells the peer we want its pieces
+func (c *Client) SendInterested() error {
+	return c.Send(FormatMessage(MsgInterested, nil))
+}
+
+// SendNotInterested tells the peer we no longer want its pieces
+func (c *Client) SendNotInterested() error {
+	return c.Send(FormatMessage(MsgNotInterested, nil))
+}
+
+// SendChoke tells the peer we won't answer its requests
+func (c *Client) SendChoke() error {
+	return c.Send(FormatMessage(MsgChoke, nil))
+}
+
+// SendUnchoke tells the peer it may request pieces
+func (c *Client) SendUnchoke() error {
+	return c.Send(FormatMessage(MsgUnchoke, nil))
+}
+
+// SendRequest asks the peer for a block of a piece
+func (c *Client) SendRequest(index, begin, length int) error {
+	return c.Send(RequestMessage(uint32(index), uint32(begin), uint32(length)))
+}
+
+// SendHave tells the peer we have a piece
+func (c *Client) SendHave(index int) error {
+	return c.Send(FormatMessage(MsgHave, binary.BigEndian.AppendUint32(nil, uint32(index))))
+}
+
+// SendKeepAlive keeps the connection open while we have nothing to say
+func (c *Client) SendKeepAlive() error {
+	return c.Send(&KeepAliveMessage)
+}
+
+// Read reads the next message from the peer, skipping keep-alives, and
+// updates the peer's side of the state from CHOKE, UNCHOKE, INTERESTED,
+// NOT INTERESTED, HAVE, BITFIELD, HAVE ALL and HAVE NONE messages. Every
+// other message is only returned. A HAVE or BITFIELD that doesn't fit the
+// torrent is an error.
+func (c *Client) Read() (*Message, error) {
+	for {
+		msg, err := ReadMessage(c.Conn)
+		if err != nil {
+			return nil, err
+		}
+		c.trace(logging.Received, msg)
+		if msg.Length == 0 {
+			continue
+		}
+		if err := c.handle(msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+}
+
+// handle applies a message to the peer's side of the state
+func (c *Client) handle(msg *Message) error {
+	switch msg.Type {
+	case MsgChoke:
+		c.choked.Store(true)
+	case MsgUnchoke:
+		c.choked.Store(false)
+	case MsgInterested:
+		c.peerInterested.Store(true)
+	case MsgNotInterested:
+		c.peerInterested.Store(false)
+	case MsgHave:
+		index, err := ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.numPieces == 0 && int(index)/8 >= len(c.bitfield) {
+			c.bitfield = append(c.bitfield, make(Bitfield, int(index)/8+1-len(c.bitfield))...)
+		} else if c.numPieces > 0 && int(index) >= c.numPieces {
+			return fmt.Errorf("HAVE for piece %d of %d", index, c.numPieces)
+		}
+		c.bitfield.SetPiece(int(index))
+	case MsgBitfield:
+		bf := Bitfield(append([]byte(nil), msg.Payload...))
+		if c.numPieces > 0 {
+			var err error
+			if bf, err = ParseBitfield(msg, c.numPieces); err != nil {
+				return err
+			}
+		}
+		c.mu.Lock()
+		c.bitfield = bf
+		c.mu.Unlock()
+	case MsgHaveAll:
+		// Without the piece count, the peer's pieces stay unknown
+		if c.numPieces > 0 {
+			c.mu.Lock()
+			c.bitfield = FullBitfield(c.numPieces)
+			c.mu.Unlock()
+		}
+	case MsgHaveNone:
+		c.mu.Lock()
+		c.bitfield = NewBitfield(c.numPieces)
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// Run reads messages until ctx is done or the connection fails, passing each
+// to handle after the state is updated, and returns the error. A handle error
+// stops it too. Run sends a keep-alive whenever we've been silent for
+// KeepAliveInterval, and gives up on a peer silent for IdleTimeout. The
+// connection is left open.
+func (c *Client) Run(ctx context.Context, handle func(*Message) error) error {
+	done := make(chan struct{})
+	defer close(done)
+	// Cut the read short when ctx is done, and let that finish before
+	// returning so it can't cut short a later read
+	cancelled := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		c.Conn.SetReadDeadline(time.Now())
+		close(cancelled)
+	})
+	defer func() {
+		if !stop() {
+			<-cancelled
+		}
+	}()
+
+	// Keep the peer from dropping us while neither side has anything to say
+	go func() {
+		ticker := time.NewTicker(KeepAliveInterval / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if time.Since(time.Unix(0, c.lastSent.Load())) >= KeepAliveInterval {
+					c.SendKeepAlive()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(IdleTimeout))
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		msg, err := ReadMessage(c.Conn)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		c.trace(logging.Received, msg)
+		if msg.Length == 0 {
+			continue // a keep-alive still counts as hearing from the peer
+		}
+		if err := c.handle(msg); err != nil {
+			return err
+		}
+		if err := handle(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// trace logs a message exchanged with the peer at the wire level, going in
+// direction dir
+func (c *Client) trace(dir string, msg *Message) {
+	if c.Logger == nil || !c.Logger.Enabled(context.Background(), logging.LevelWire) {
+		return
+	}
+	event := "received message"
+	if dir == logging.Sent {
+		event = "sent message"
+	}
+	c.Logger.Log(context.Background(), logging.LevelWire, event, "dir", dir, "peer", c.Conn.RemoteAddr(), "msg", msg.String(), "size", 4+msg.Length)
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.Conn.Close()
+}
@@ -0,0 +1,162 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/logging"
+)
+
+// newTestClient returns a client for a torrent of numPieces pieces over a
+// pipe, and the peer's end of the pipe
+func newTestClient(t *testing.T, numPieces int) (*Client, net.Conn) {
+	ours, theirs := net.Pipe()
+	t.Cleanup(func() {
+		ours.Close()
+		theirs.Close()
+	})
+	return NewClientConn(ours, &Handshake{}, numPieces), theirs
+}
+
+func TestClientState(t *testing.T) {
+	c, theirs := newTestClient(t, 10)
+	if !c.Choked() || !c.PeerChoked() || c.Interested() || c.PeerInterested() {
+		t.Fatal("Expected both sides choked and not interested at first")
+	}
+
+	// What we send changes our side
+	go func() {
+		for {
+			if _, err := ReadMessage(theirs); err != nil {
+				return
+			}
+		}
+	}()
+	for _, send := range []func() error{c.SendInterested, c.SendUnchoke, c.SendKeepAlive, func() error { return c.SendRequest(1, 0, 16384) }, func() error { return c.SendHave(2) }} {
+		if err := send(); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	if !c.Interested() || c.PeerChoked() {
+		t.Errorf("Expected us interested and the peer unchoked")
+	}
+
+	// What the peer sends changes its side; keep-alives are skipped
+	go func() {
+		KeepAliveMessage.WriteTo(theirs)
+		FormatMessage(MsgUnchoke, nil).WriteTo(theirs)
+		FormatMessage(MsgInterested, nil).WriteTo(theirs)
+		FormatMessage(MsgBitfield, []byte{0x80, 0}).WriteTo(theirs)
+		FormatMessage(MsgHave, []byte{0, 0, 0, 9}).WriteTo(theirs)
+	}()
+	for _, want := range []MessageType{MsgUnchoke, MsgInterested, MsgBitfield, MsgHave} {
+		msg, err := c.Read()
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if msg.Type != want {
+			t.Errorf("Expected message type %d, got %d", want, msg.Type)
+		}
+	}
+	if c.Choked() || !c.PeerInterested() {
+		t.Errorf("Expected the peer to unchoke us and be interested")
+	}
+	if !c.HasPiece(0) || !c.HasPiece(9) || c.HasPiece(1) || c.Bitfield().Count() != 2 {
+		t.Errorf("Expected the peer to have pieces 0 and 9, got %08b", c.Bitfield())
+	}
+
+	// HAVE ALL and HAVE NONE replace the bitfield (BEP 6)
+	go FormatMessage(MsgHaveAll, nil).WriteTo(theirs)
+	if _, err := c.Read(); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if c.Bitfield().Count() != 10 || !c.Bitfield().Complete(10) {
+		t.Errorf("Expected the peer to have all 10 pieces after HAVE ALL, got %08b", c.Bitfield())
+	}
+	go FormatMessage(MsgHaveNone, nil).WriteTo(theirs)
+	if _, err := c.Read(); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !c.Bitfield().Empty() {
+		t.Errorf("Expected the peer to have no pieces after HAVE NONE, got %08b", c.Bitfield())
+	}
+}
+
+func TestClientTrace(t *testing.T) {
+	c, theirs := newTestClient(t, 10)
+	var buf bytes.Buffer
+	c.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: logging.LevelWire}))
+
+	go func() {
+		ReadMessage(theirs)
+		FormatMessage(MsgHave, []byte{0, 0, 0, 3}).WriteTo(theirs)
+	}()
+	if err := c.SendInterested(); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err := c.Read(); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	for _, want := range []string{`msg="sent message" dir=out`, "msg=Interested", `msg="received message" dir=in`, "msg=Have[3]"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q in the trace, got %q", want, buf.String())
+		}
+	}
+}
+
+func TestClientInvalidMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *Message
+	}{
+		{"HAVE beyond the torrent", FormatMessage(MsgHave, []byte{0, 0, 0, 10})},
+		{"short BITFIELD", FormatMessage(MsgBitfield, []byte{0xff})},
+		{"BITFIELD with spare bits", FormatMessage(MsgBitfield, []byte{0xff, 0xff})},
+	}
+	for _, tt := range tests {
+		c, theirs := newTestClient(t, 10)
+		go tt.msg.WriteTo(theirs)
+		if _, err := c.Read(); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestClientRun(t *testing.T) {
+	c, theirs := newTestClient(t, 4)
+	go func() {
+		FormatMessage(MsgHave, []byte{0, 0, 0, 3}).WriteTo(theirs)
+		PieceMessage(3, 0, []byte("data")).WriteTo(theirs)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var got []MessageType
+	err := c.Run(ctx, func(msg *Message) error {
+		got = append(got, msg.Type)
+		if msg.Type == MsgPiece {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected Run to stop when cancelled, got %v", err)
+	}
+	if len(got) != 2 || got[0] != MsgHave || got[1] != MsgPiece || !c.HasPiece(3) {
+		t.Errorf("Expected HAVE then PIECE with piece 3 recorded, got %v", got)
+	}
+
+	// A handler error stops it too
+	stop := errors.New("stop")
+	go FormatMessage(MsgUnchoke, nil).WriteTo(theirs)
+	if err := c.Run(context.Background(), func(*Message) error { return stop }); err != stop {
+		t.Errorf("Expected the handler's error, got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package peer
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// ClientVersion is the client name and version we report in the "v" field of
+// extension handshakes. It matches the GenerateID prefix.
+const ClientVersion = "bittorrent-client 0.0.1"
+
+// idPrefix identifies this client at the start of its Azureus-style peer IDs
+const idPrefix = "-GO0001-"
+
+// GenerateID returns a new peer ID for this client: its prefix followed by
+// random bytes
+func GenerateID() [20]byte {
+	var id [20]byte
+	copy(id[:], idPrefix)
+	rand.Read(id[len(idPrefix):])
+	return id
+}
+
+// azureusClients maps the two-letter codes of Azureus-style peer IDs
+// ("-qB4250-...") to client names
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BN": "Baidu Netdisk",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"GO": "bittorrent-client",
+	"KT": "KTorrent",
+	"LT": "libtorrent (Rasterbar)",
+	"lt": "libTorrent (rakshasa)",
+	"qB": "qBittorrent",
+	"QD": "QQDownload",
+	"SD": "Thunder",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"UM": "µTorrent Mac",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"XF": "Xfplay",
+	"XL": "Xunlei",
+}
+
+// shadowClients maps the first character of Shadow-style peer IDs
+// ("S58B-----...") to client names
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// shadowDigits are the characters of Shadow-style version numbers, each
+// standing for its index
+const shadowDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// ClientName guesses the client software from a peer ID. Azureus-style IDs
+// ("-TR2940-..."), Mainline-style IDs ("M7-4-3--..."), Shadow-style IDs
+// ("T03I-----...") and the fixed prefixes of a few other clients are
+// recognized; others yield an empty string.
+func ClientName(id [20]byte) string {
+	s := string(id[:])
+
+	// Azureus style: -XXabcd- where abcd is the version
+	if s[0] == '-' && s[7] == '-' {
+		code, version := s[1:3], s[3:7]
+		name, ok := azureusClients[code]
+		if !ok {
+			name = strings.TrimSpace(code)
+		}
+		return name + " " + azureusVersion(code, version)
+	}
+
+	// Mainline style: M1-2-3-- with the version between the dashes
+	if s[0] == 'M' {
+		if end := strings.Index(s[1:], "--"); end > 0 {
+			version := strings.ReplaceAll(s[1:end+1], "-", ".")
+			return "BitTorrent " + version
+		}
+	}
+
+	// Shadow style: a client character, up to five version characters and
+	// at least three dashes
+	if name, ok := shadowClients[s[0]]; ok {
+		if end := strings.Index(s[1:], "---"); end > 0 && end <= 5 {
+			if version, ok := shadowVersion(s[1 : end+1]); ok {
+				return name + " " + version
+			}
+		}
+	}
+	return prefixClient(id)
+}
+
+// shadowVersion decodes the version characters of a Shadow-style ID, each
+// a component: "58B" is 5.8.11
+func shadowVersion(chars string) (string, bool) {
+	parts := make([]string, len(chars))
+	for i := range len(chars) {
+		n := strings.IndexByte(shadowDigits, chars[i])
+		if n < 0 {
+			return "", false
+		}
+		parts[i] = fmt.Sprint(n)
+	}
+	return strings.Join(parts, "."), true
+}
+
+// prefixClient recognizes clients whose peer IDs start with a fixed prefix
+// of their own, such as BitComet's "exbc", or returns an empty string
+func prefixClient(id [20]byte) string {
+	s := string(id[:])
+	switch {
+	case strings.HasPrefix(s, "exbc"):
+		// The version is in two bytes; BitLord marks itself after them
+		name := "BitComet"
+		if s[6:10] == "LORD" {
+			name = "BitLord"
+		}
+		return fmt.Sprintf("%s %d.%02d", name, id[4], id[5])
+	case strings.HasPrefix(s, "-ML"):
+		if end := strings.IndexByte(s[3:], '-'); end > 0 {
+			return "MLDonkey " + s[3:3+end]
+		}
+	case strings.HasPrefix(s, "XBT") && isDigits(s[3:6]):
+		return "XBT Client " + strings.Join(strings.Split(s[3:6], ""), ".")
+	case strings.HasPrefix(s, "OP") && isDigits(s[2:6]):
+		return "Opera " + s[2:6]
+	case strings.HasPrefix(s, "AZ2500BT"):
+		return "BitTyrant"
+	case strings.HasPrefix(s, "Pando"):
+		return "Pando"
+	}
+	return ""
+}
+
+// isDigits reports whether s is all decimal digits
+func isDigits(s string) bool {
+	return strings.Trim(s, "0123456789") == ""
+}
+
+// azureusVersion formats the four version characters of an Azureus-style
+// ID. Most clients use one character per component with a trailing build
+// character that is usually 0: "4250" is 4.2.5.
+func azureusVersion(code, version string) string {
+	if code == "TR" && version[0] < '4' {
+		// Transmission before 4.0 used a major digit and two minor digits:
+		// "2940" is 2.94. Since 4.0 it follows the common scheme.
+		return version[:1] + "." + version[1:3]
+	}
+	parts := strings.Split(version[:3], "")
+	if version[3] != '0' {
+		parts = append(parts, version[3:])
+	}
+	return strings.Join(parts, ".")
+}
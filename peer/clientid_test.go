@@ -0,0 +1,35 @@
+package peer
+
+import "testing"
+
+func TestClientName(t *testing.T) {
+	testCases := []struct {
+		id       string
+		expected string
+	}{
+		{"-qB4250-abcdefghijkl", "qBittorrent 4.2.5"},
+		{"-qB4630-abcdefghijkl", "qBittorrent 4.6.3"},
+		{"-TR2940-abcdefghijkl", "Transmission 2.94"},
+		{"-TR4050-abcdefghijkl", "Transmission 4.0.5"},
+		{"-UT355S-abcdefghijkl", "µTorrent 3.5.5.S"},
+		{"-XX1000-abcdefghijkl", "XX 1.0.0"},
+		{"M7-4-3--abcdefghijkl", "BitTorrent 7.4.3"},
+		{"S58B-----abcdefghijk", "Shadow 5.8.11"},
+		{"T03I--00abcdefghijkl", ""},
+		{"T03I---abcdefghijklm", "BitTornado 0.3.18"},
+		{"exbc\x00\x3eabcdefghijkl", "BitComet 0.62"},
+		{"exbc\x00\x3eLORDefghijkl", "BitLord 0.62"},
+		{"-ML2.7.2-abcdefghijk", "MLDonkey 2.7.2"},
+		{"XBT054-abcdefghijklm", "XBT Client 0.5.4"},
+		{"OP8041abcdefghijklmn", "Opera 8041"},
+		{"abcdefghijklmnopqrst", ""},
+	}
+
+	for _, tc := range testCases {
+		var id [20]byte
+		copy(id[:], tc.id)
+		if got := ClientName(id); got != tc.expected {
+			t.Errorf("ClientName(%q): expected %q, got %q", tc.id, tc.expected, got)
+		}
+	}
+}
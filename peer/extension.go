@@ -0,0 +1,222 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+)
+
+// ExtHandshakeID is the extended message ID of the extension handshake (BEP 10)
+const ExtHandshakeID = 0
+
+// maxClientVersion bounds the length in characters of the "v" string we keep
+const maxClientVersion = 64
+
+// ErrExtensionUnsupported is returned when sending an extension message to a
+// peer that didn't offer the extension in its extension handshake
+var ErrExtensionUnsupported = errors.New("extension not supported by the peer")
+
+// ExtensionHandshake is the dictionary peers send in extended message 0 to
+// tell each other which extensions they support and a few facts about
+// themselves
+type ExtensionHandshake struct {
+	M            map[string]uint8 // Extension names and the IDs to send their messages with; 0 turns one off
+	Client       string           // "v", the client name and version, made safe to print
+	YourIP       net.IP           // The receiver's IP as the sender sees it, nil if not given
+	MetadataSize int              // Size of the info dictionary (BEP 9), 0 if not given
+	UploadOnly   bool             // The sender only uploads, e.g. as a partial seed (BEP 21)
+	ListenPort   uint16           // "p", the port the sender accepts connections on, 0 if not given
+	Reqq         int              // How many requests the sender queues per peer, 0 if not given
+}
+
+// Message returns the EXTENDED message carrying the handshake
+func (h *ExtensionHandshake) Message() *Message {
+	m := make(map[string]interface{}, len(h.M))
+	for name, id := range h.M {
+		m[name] = int64(id)
+	}
+	dict := map[string]interface{}{"m": m}
+	if h.Client != "" {
+		dict["v"] = h.Client
+	}
+	if ip4 := h.YourIP.To4(); ip4 != nil {
+		dict["yourip"] = string(ip4)
+	} else if ip6 := h.YourIP.To16(); ip6 != nil {
+		dict["yourip"] = string(ip6)
+	}
+	if h.MetadataSize > 0 {
+		dict["metadata_size"] = int64(h.MetadataSize)
+	}
+	if h.UploadOnly {
+		dict["upload_only"] = int64(1)
+	}
+	if h.ListenPort != 0 {
+		dict["p"] = int64(h.ListenPort)
+	}
+	if h.Reqq > 0 {
+		dict["reqq"] = int64(h.Reqq)
+	}
+	payload, _ := bencode.EncodeDict(dict)
+	return FormatMessage(MsgExtended, append([]byte{ExtHandshakeID}, payload...))
+}
+
+// ParseExtensionHandshake parses an extension handshake payload, without the
+// leading extended message ID. Fields of the wrong type or size are left
+// out, and message IDs that don't fit in a byte are dropped.
+func ParseExtensionHandshake(payload []byte) (*ExtensionHandshake, error) {
+	decoded, _, err := bencode.Decode(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extension handshake: %v", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("extension handshake is not a dictionary")
+	}
+
+	h := &ExtensionHandshake{M: make(map[string]uint8)}
+	m, _ := dict["m"].(map[string]interface{})
+	for name, v := range m {
+		if id, ok := v.(int64); ok && id >= 0 && id <= 255 {
+			h.M[name] = uint8(id)
+		}
+	}
+	if ip, _ := dict["yourip"].(string); len(ip) == net.IPv4len || len(ip) == net.IPv6len {
+		h.YourIP = net.IP(ip)
+	}
+	if size, _ := dict["metadata_size"].(int64); size > 0 && size <= int64(^uint32(0)) {
+		h.MetadataSize = int(size)
+	}
+	uploadOnly, _ := dict["upload_only"].(int64)
+	h.UploadOnly = uploadOnly != 0
+	if port, _ := dict["p"].(int64); port > 0 && port <= 65535 {
+		h.ListenPort = uint16(port)
+	}
+	if reqq, _ := dict["reqq"].(int64); reqq > 0 && reqq <= int64(^uint32(0)) {
+		h.Reqq = int(reqq)
+	}
+
+	// The string ends up on terminals, so drop anything that isn't printable
+	v, _ := dict["v"].(string)
+	v = strings.Map(func(r rune) rune {
+		if r == unicode.ReplacementChar || !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(v, ""))
+	if r := []rune(v); len(r) > maxClientVersion {
+		v = string(r[:maxClientVersion])
+	}
+	h.Client = strings.TrimSpace(v)
+	return h, nil
+}
+
+// ExtensionHandler handles the payload of an extended message, after the
+// extended message ID. An error drops the connection.
+type ExtensionHandler func(payload []byte) error
+
+// Extensions is the registry of extension protocol messages (BEP 10) on one
+// connection. Extensions such as ut_metadata register the ID they want
+// their messages sent to us with and a handler for them; the peer's
+// handshake tells which IDs to send ours with. The zero value is ready to
+// use, and it is safe for concurrent use.
+type Extensions struct {
+	mu       sync.Mutex
+	local    map[string]uint8
+	handlers map[uint8]ExtensionHandler
+	remote   map[string]uint8
+}
+
+// Register adds an extension, whose messages the peer is asked to send with
+// id, a nonzero ID no other extension uses
+func (e *Extensions) Register(name string, id uint8, handle ExtensionHandler) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if id == ExtHandshakeID {
+		return fmt.Errorf("extension %s: ID %d is the handshake's", name, id)
+	}
+	if _, ok := e.handlers[id]; ok {
+		return fmt.Errorf("extension %s: ID %d already taken", name, id)
+	}
+	if e.local == nil {
+		e.local = make(map[string]uint8)
+		e.handlers = make(map[uint8]ExtensionHandler)
+	}
+	e.local[name] = id
+	e.handlers[id] = handle
+	return nil
+}
+
+// Handshake returns our extension handshake offering every registered
+// extension. The caller may fill in the other fields.
+func (e *Extensions) Handshake() *ExtensionHandshake {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m := make(map[string]uint8, len(e.local))
+	for name, id := range e.local {
+		m[name] = id
+	}
+	return &ExtensionHandshake{M: m}
+}
+
+// Supports reports whether the peer offered an extension in its handshake
+func (e *Extensions) Supports(name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.remote[name] != 0
+}
+
+// Message returns an extension message to send the peer, with the ID the
+// peer asked for, or ErrExtensionUnsupported
+func (e *Extensions) Message(name string, payload []byte) (*Message, error) {
+	e.mu.Lock()
+	id := e.remote[name]
+	e.mu.Unlock()
+	if id == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrExtensionUnsupported, name)
+	}
+	return FormatMessage(MsgExtended, append([]byte{id}, payload...)), nil
+}
+
+// Handle handles an EXTENDED message from the peer. The peer's extension
+// handshake is parsed, remembered and returned; a later one updates the
+// IDs it lists and leaves the others. Messages of registered extensions go
+// to their handlers and the rest are ignored. A malformed handshake is an
+// error, which callers may choose to ignore.
+func (e *Extensions) Handle(msg *Message) (*ExtensionHandshake, error) {
+	if msg.Type != MsgExtended || len(msg.Payload) == 0 {
+		return nil, errors.New("not an extended message")
+	}
+	id, payload := msg.Payload[0], msg.Payload[1:]
+	if id != ExtHandshakeID {
+		e.mu.Lock()
+		handle := e.handlers[id]
+		e.mu.Unlock()
+		if handle == nil {
+			return nil, nil
+		}
+		return nil, handle(payload)
+	}
+
+	h, err := ParseExtensionHandshake(payload)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.remote == nil {
+		e.remote = make(map[string]uint8)
+	}
+	for name, id := range h.M {
+		if id == 0 {
+			delete(e.remote, name)
+		} else {
+			e.remote[name] = id
+		}
+	}
+	return h, nil
+}
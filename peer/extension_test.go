@@ -0,0 +1,117 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestExtensionHandshake(t *testing.T) {
+	testCases := []struct {
+		name string
+		hs   ExtensionHandshake
+	}{
+		{"IPv4", ExtensionHandshake{M: map[string]uint8{"ut_metadata": 1}, Client: "test 1.0", YourIP: net.IP{198, 51, 100, 1}, MetadataSize: 1234}},
+		{"IPv6", ExtensionHandshake{M: map[string]uint8{}, YourIP: net.ParseIP("2001:db8::1"), UploadOnly: true, ListenPort: 6881, Reqq: MaxQueuedRequests}},
+		{"Empty", ExtensionHandshake{M: map[string]uint8{}}},
+	}
+	for _, tc := range testCases {
+		msg := tc.hs.Message()
+		if msg.Type != MsgExtended || msg.Payload[0] != ExtHandshakeID {
+			t.Fatalf("%s: expected an extension handshake, got %v", tc.name, msg)
+		}
+		got, err := ParseExtensionHandshake(msg.Payload[1:])
+		if err != nil {
+			t.Fatalf("%s: ParseExtensionHandshake failed: %v", tc.name, err)
+		}
+		if len(got.M) != len(tc.hs.M) || got.M["ut_metadata"] != tc.hs.M["ut_metadata"] || got.Client != tc.hs.Client ||
+			!bytes.Equal(got.YourIP, tc.hs.YourIP) || got.MetadataSize != tc.hs.MetadataSize || got.UploadOnly != tc.hs.UploadOnly || got.ListenPort != tc.hs.ListenPort || got.Reqq != tc.hs.Reqq {
+			t.Errorf("%s: expected %+v back, got %+v", tc.name, tc.hs, *got)
+		}
+	}
+}
+
+func TestParseExtensionHandshake(t *testing.T) {
+	testCases := []struct {
+		name    string
+		payload string
+		client  string
+		m       map[string]uint8
+		wantErr bool
+	}{
+		{"Client", "d1:md6:ut_pexi2ee1:v17:qBittorrent 4.6.3e", "qBittorrent 4.6.3", map[string]uint8{"ut_pex": 2}, false},
+		{"Unprintable", "d1:v13:Evil\x1b[2J\x07 1.0e", "Evil[2J 1.0", map[string]uint8{}, false},
+		{"BadIDs", "d1:md1:ai-1e1:bi256e1:c1:xee", "", map[string]uint8{}, false},
+		{"NotBencode", "not bencode", "", nil, true},
+		{"NotDict", "i1e", "", nil, true},
+	}
+	for _, tc := range testCases {
+		h, err := ParseExtensionHandshake([]byte(tc.payload))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.wantErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if h.Client != tc.client || len(h.M) != len(tc.m) {
+			t.Errorf("%s: expected client %q and extensions %v, got %q and %v", tc.name, tc.client, tc.m, h.Client, h.M)
+		}
+		for name, id := range tc.m {
+			if h.M[name] != id {
+				t.Errorf("%s: expected %s at ID %d, got %d", tc.name, name, id, h.M[name])
+			}
+		}
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	var e Extensions
+	var got []string
+	if err := e.Register("ut_metadata", 3, func(payload []byte) error {
+		got = append(got, string(payload))
+		return nil
+	}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if err := e.Register("ut_pex", 3, nil); err == nil {
+		t.Error("Expected an error registering a taken ID")
+	}
+	if err := e.Register("ut_pex", ExtHandshakeID, nil); err == nil {
+		t.Error("Expected an error registering the handshake's ID")
+	}
+	if m := e.Handshake().M; len(m) != 1 || m["ut_metadata"] != 3 {
+		t.Errorf("Expected ut_metadata offered at ID 3, got %v", m)
+	}
+
+	// Nothing can be sent before the peer's handshake
+	if _, err := e.Message("ut_metadata", nil); !errors.Is(err, ErrExtensionUnsupported) {
+		t.Errorf("Expected ErrExtensionUnsupported, got %v", err)
+	}
+	hs := &ExtensionHandshake{M: map[string]uint8{"ut_metadata": 7, "ut_pex": 1}}
+	if h, err := e.Handle(hs.Message()); err != nil || h == nil {
+		t.Fatalf("Handle failed: %v", err)
+	}
+	msg, err := e.Message("ut_metadata", []byte("x"))
+	if err != nil || !bytes.Equal(msg.Payload, []byte{7, 'x'}) {
+		t.Errorf("Expected a message to ID 7, got %v (%v)", msg, err)
+	}
+
+	// A later handshake turns ut_pex off and leaves ut_metadata
+	hs = &ExtensionHandshake{M: map[string]uint8{"ut_pex": 0}}
+	e.Handle(hs.Message())
+	if !e.Supports("ut_metadata") || e.Supports("ut_pex") {
+		t.Errorf("Expected only ut_metadata supported, got ut_metadata %v and ut_pex %v", e.Supports("ut_metadata"), e.Supports("ut_pex"))
+	}
+
+	// Messages go to the handler registered for their ID; others are ignored
+	for _, payload := range [][]byte{{3, 'a'}, {9, 'b'}, {3, 'c'}} {
+		if _, err := e.Handle(FormatMessage(MsgExtended, payload)); err != nil {
+			t.Errorf("Handle(%v) failed: %v", payload, err)
+		}
+	}
+	if len(got) != 2 || got[0] != "a" || got[1] != "c" {
+		t.Errorf("Expected the handler to get a and c, got %q", got)
+	}
+}
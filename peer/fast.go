@@ -0,0 +1,35 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"slices"
+)
+
+// AllowedFastSet returns k pieces a peer at ip may request from us even
+// while we choke it, for a torrent with numPieces pieces (BEP 6). The set
+// depends only on the peer's /24 network and the info hash, so reconnecting
+// from another address on the same network gains the peer nothing. BEP 6
+// only defines the set for IPv4 peers; for others it is empty.
+func AllowedFastSet(ip net.IP, infoHash [20]byte, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces <= 0 {
+		return nil
+	}
+	k = min(k, numPieces)
+
+	x := append([]byte{ip4[0], ip4[1], ip4[2], 0}, infoHash[:]...)
+	set := make([]int, 0, k)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !slices.Contains(set, index) {
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
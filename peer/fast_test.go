@@ -0,0 +1,36 @@
+package peer
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// The test vectors of BEP 6
+	var infoHash [20]byte
+	for i := range infoHash {
+		infoHash[i] = 0xaa
+	}
+	testCases := []struct {
+		ip       string
+		k        int
+		expected []int
+	}{
+		{"80.4.4.200", 7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"80.4.4.200", 9, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+		{"80.4.4.1", 7, []int{1059, 431, 808, 1217, 287, 376, 1188}}, // same /24
+		{"2001:db8::1", 7, nil},
+	}
+	for _, tc := range testCases {
+		got := AllowedFastSet(net.ParseIP(tc.ip), infoHash, 1313, tc.k)
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("AllowedFastSet(%s, %d): expected %v, got %v", tc.ip, tc.k, tc.expected, got)
+		}
+	}
+
+	// A torrent with fewer pieces than asked for allows them all
+	if got := AllowedFastSet(net.ParseIP("80.4.4.200"), infoHash, 3, 10); len(got) != 3 {
+		t.Errorf("Expected all 3 pieces allowed, got %v", got)
+	}
+}
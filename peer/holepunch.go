@@ -0,0 +1,95 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// HolepunchType is the kind of a ut_holepunch message (BEP 55)
+type HolepunchType uint8
+
+const (
+	HolepunchRendezvous HolepunchType = 0 // asks a relay to introduce us to the peer at the address
+	HolepunchConnect    HolepunchType = 1 // from a relay: connect to the peer at the address, which is connecting to us
+	HolepunchError      HolepunchType = 2 // from a relay: it couldn't introduce us to the peer at the address
+)
+
+// HolepunchErr is why a relay couldn't introduce us to a peer
+type HolepunchErr uint32
+
+const (
+	HolepunchNoSuchPeer   HolepunchErr = 1 // the address isn't a valid peer
+	HolepunchNotConnected HolepunchErr = 2 // the relay isn't connected to the peer
+	HolepunchNoSupport    HolepunchErr = 3 // the peer doesn't support ut_holepunch
+	HolepunchNoSelf       HolepunchErr = 4 // the address is our own
+)
+
+func (e HolepunchErr) String() string {
+	switch e {
+	case HolepunchNoSuchPeer:
+		return "no such peer"
+	case HolepunchNotConnected:
+		return "not connected"
+	case HolepunchNoSupport:
+		return "no support"
+	case HolepunchNoSelf:
+		return "no self"
+	default:
+		return fmt.Sprintf("error %d", uint32(e))
+	}
+}
+
+// HolepunchMessage is the payload of a ut_holepunch message: a message type,
+// the address of the peer it is about and, for HolepunchError, the error code
+type HolepunchMessage struct {
+	Type HolepunchType
+	IP   net.IP
+	Port uint16
+	Err  HolepunchErr
+}
+
+// Addr returns the address of the peer the message is about, as host:port
+func (m *HolepunchMessage) Addr() string {
+	return (&net.TCPAddr{IP: m.IP, Port: int(m.Port)}).String()
+}
+
+// Encode returns the message's payload, with the address in its IPv4 form
+// where it has one
+func (m *HolepunchMessage) Encode() []byte {
+	b := []byte{byte(m.Type)}
+	if ip4 := m.IP.To4(); ip4 != nil {
+		b = append(append(b, 0), ip4...)
+	} else {
+		b = append(append(b, 1), m.IP.To16()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, m.Port)
+	return binary.BigEndian.AppendUint32(b, uint32(m.Err))
+}
+
+// ParseHolepunch parses a ut_holepunch payload
+func ParseHolepunch(payload []byte) (*HolepunchMessage, error) {
+	if len(payload) < 2 {
+		return nil, errors.New("holepunch message too short")
+	}
+	m := &HolepunchMessage{Type: HolepunchType(payload[0])}
+	if m.Type > HolepunchError {
+		return nil, fmt.Errorf("unknown holepunch message type %d", m.Type)
+	}
+	ipLen := net.IPv4len
+	switch payload[1] {
+	case 0:
+	case 1:
+		ipLen = net.IPv6len
+	default:
+		return nil, fmt.Errorf("unknown holepunch address type %d", payload[1])
+	}
+	if len(payload) != 2+ipLen+2+4 {
+		return nil, fmt.Errorf("invalid holepunch message length %d", len(payload))
+	}
+	m.IP = net.IP(append([]byte(nil), payload[2:2+ipLen]...))
+	m.Port = binary.BigEndian.Uint16(payload[2+ipLen:])
+	m.Err = HolepunchErr(binary.BigEndian.Uint32(payload[2+ipLen+2:]))
+	return m, nil
+}
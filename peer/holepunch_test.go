@@ -0,0 +1,50 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestHolepunchMessage(t *testing.T) {
+	testCases := []struct {
+		msg     HolepunchMessage
+		encoded []byte
+	}{
+		{
+			HolepunchMessage{Type: HolepunchRendezvous, IP: net.ParseIP("10.0.0.9"), Port: 6881},
+			[]byte{0, 0, 10, 0, 0, 9, 0x1a, 0xe1, 0, 0, 0, 0},
+		},
+		{
+			HolepunchMessage{Type: HolepunchError, IP: net.ParseIP("2001:db8::1"), Port: 1, Err: HolepunchNotConnected},
+			append(append([]byte{2, 1}, net.ParseIP("2001:db8::1")...), 0, 1, 0, 0, 0, 2),
+		},
+	}
+	for _, tc := range testCases {
+		encoded := tc.msg.Encode()
+		if !bytes.Equal(encoded, tc.encoded) {
+			t.Errorf("%s: expected %x, got %x", tc.msg.Addr(), tc.encoded, encoded)
+		}
+		parsed, err := ParseHolepunch(encoded)
+		if err != nil {
+			t.Fatalf("%s: ParseHolepunch failed: %v", tc.msg.Addr(), err)
+		}
+		if parsed.Type != tc.msg.Type || !parsed.IP.Equal(tc.msg.IP) || parsed.Port != tc.msg.Port || parsed.Err != tc.msg.Err {
+			t.Errorf("%s: expected %+v, got %+v", tc.msg.Addr(), tc.msg, parsed)
+		}
+	}
+	if addr := testCases[1].msg.Addr(); addr != "[2001:db8::1]:1" {
+		t.Errorf("Expected the address [2001:db8::1]:1, got %s", addr)
+	}
+
+	for _, payload := range [][]byte{
+		{0},
+		{3, 0, 10, 0, 0, 9, 0, 1, 0, 0, 0, 0},
+		{0, 2, 10, 0, 0, 9, 0, 1, 0, 0, 0, 0},
+		{0, 1, 10, 0, 0, 9, 0, 1, 0, 0, 0, 0},
+	} {
+		if _, err := ParseHolepunch(payload); err == nil {
+			t.Errorf("Expected an error parsing %x", payload)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync"
 )
 
 // MessageType represents the type of BitTorrent message
@@ -21,14 +22,29 @@ const (
 	MsgRequest       MessageType = 6
 	MsgPiece         MessageType = 7
 	MsgCancel        MessageType = 8
-	MsgPort          MessageType = 9 // Used by DHT extension
+	MsgPort          MessageType = 9  // Used by DHT extension
+	MsgSuggestPiece  MessageType = 13 // BEP 6: Fast Extension
+	MsgHaveAll       MessageType = 14 // BEP 6: Fast Extension
+	MsgHaveNone      MessageType = 15 // BEP 6: Fast Extension
+	MsgRejectRequest MessageType = 16 // BEP 6: Fast Extension
+	MsgAllowedFast   MessageType = 17 // BEP 6: Fast Extension
+	MsgExtended      MessageType = 20 // BEP 10: Extension Protocol
 )
 
+// IsFast reports whether the type is one of the Fast Extension's messages,
+// which only peers that both advertised it may send
+func (t MessageType) IsFast() bool {
+	return t >= MsgSuggestPiece && t <= MsgAllowedFast
+}
+
 // Message represents a BitTorrent protocol message
 type Message struct {
 	Length  uint32
 	Type    MessageType
 	Payload []byte
+
+	buf    []byte // what the message was read into, reused once it's released
+	pooled bool   // read by ReadPooledMessage and not yet released
 }
 
 // KeepAliveMessage is a message with a zero length and no ID or payload
@@ -36,65 +52,141 @@ var KeepAliveMessage = Message{Length: 0, Type: 0, Payload: nil}
 
 // Serialize converts a Message to its wire format
 func (m *Message) Serialize() []byte {
+	return m.AppendTo(make([]byte, 0, 4+m.wireLength()))
+}
+
+// AppendTo appends the message's wire format to dst and returns the extended
+// slice, so a connection can reuse one buffer for every message it sends
+func (m *Message) AppendTo(dst []byte) []byte {
 	if m.Length == 0 {
 		// Keep-alive message: just 4 bytes of zero
-		return make([]byte, 4)
+		return append(dst, 0, 0, 0, 0)
 	}
 
-	// Message length (4 bytes) + message type (1 byte) + payload
-	buffer := make([]byte, 4+1+len(m.Payload))
+	// Message length (4 bytes, excluding itself), message type (1 byte) and
+	// the payload
+	dst = binary.BigEndian.AppendUint32(dst, m.Length)
+	dst = append(dst, byte(m.Type))
+	return append(dst, m.Payload...)
+}
 
-	// Set the message length (excluding the length field itself)
-	binary.BigEndian.PutUint32(buffer[0:4], m.Length)
+// wireLength returns the message length as sent, excluding the length field
+func (m *Message) wireLength() int {
+	if m.Length == 0 {
+		return 0
+	}
+	return 1 + len(m.Payload)
+}
 
-	// Set the message type
-	buffer[4] = byte(m.Type)
+// maxPooled is the largest buffer kept for reuse, so one huge message doesn't
+// pin its buffer
+const maxPooled = 64 * 1024
 
-	// Copy the payload if any
-	if len(m.Payload) > 0 {
-		copy(buffer[5:], m.Payload)
-	}
+// scratch holds buffers WriteTo serializes messages into
+var scratch = sync.Pool{New: func() any { return new([]byte) }}
 
-	return buffer
+// messages holds released messages for ReadPooledMessage to read into
+var messages = sync.Pool{New: func() any { return new(Message) }}
+
+// WriteTo writes the message to w in a single Write, using a pooled buffer
+// instead of allocating one per message
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	buf := scratch.Get().(*[]byte)
+	*buf = m.AppendTo((*buf)[:0])
+	n, err := w.Write(*buf)
+	if cap(*buf) <= maxPooled {
+		scratch.Put(buf)
+	}
+	return int64(n), err
 }
 
+// MaxMessageLength bounds the messages ReadMessage accepts. It fits the
+// bitfield of a torrent with 16 million pieces after its message ID, and
+// blocks far larger than any client requests, while a peer announcing a bogus
+// length can't make us allocate gigabytes.
+const MaxMessageLength = 2<<20 + 1
+
 // ReadMessage reads a message from an io.Reader
 func ReadMessage(r io.Reader) (*Message, error) {
-	// Read message length (4 bytes)
-	lengthBuf := make([]byte, 4)
-	_, err := io.ReadFull(r, lengthBuf)
-	if err != nil {
+	m := &Message{}
+	if err := m.read(r); err != nil {
+		return nil, err
+	}
+	if m.Length == 0 {
+		return &KeepAliveMessage, nil
+	}
+	return m, nil
+}
+
+// ReadPooledMessage is like ReadMessage, but reads into a message released
+// earlier instead of allocating one, which matters for the stream of PIECE
+// messages of a fast download. Release the message once done with it;
+// messages that aren't released are simply garbage collected.
+func ReadPooledMessage(r io.Reader) (*Message, error) {
+	m := messages.Get().(*Message)
+	if err := m.read(r); err != nil {
+		messages.Put(m)
 		return nil, err
 	}
+	if m.Length == 0 {
+		messages.Put(m)
+		return &KeepAliveMessage, nil
+	}
+	m.pooled = true
+	return m, nil
+}
 
-	length := binary.BigEndian.Uint32(lengthBuf)
+// Release hands a message read by ReadPooledMessage back for reuse. Neither
+// the message nor its payload may be used afterwards. Releasing any other
+// message does nothing.
+func (m *Message) Release() {
+	if !m.pooled {
+		return
+	}
+	m.pooled = false
+	m.Payload = nil
+	if cap(m.buf) > maxPooled {
+		m.buf = nil
+	}
+	messages.Put(m)
+}
+
+// read reads a message into m, reusing its buffer if it is large enough
+func (m *Message) read(r io.Reader) error {
+	// Read message length (4 bytes)
+	if cap(m.buf) < 4 {
+		m.buf = make([]byte, 4)
+	}
+	if _, err := io.ReadFull(r, m.buf[:4]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(m.buf)
 
 	// If length is 0, it's a keep-alive message
+	m.Length, m.Type, m.Payload = length, 0, nil
 	if length == 0 {
-		return &KeepAliveMessage, nil
+		return nil
+	}
+	if length > MaxMessageLength {
+		return fmt.Errorf("message length %d exceeds the limit of %d", length, MaxMessageLength)
 	}
 
 	// Read message type and payload
-	messageBuf := make([]byte, length)
-	_, err = io.ReadFull(r, messageBuf)
-	if err != nil {
-		return nil, err
+	if cap(m.buf) < int(length) {
+		m.buf = make([]byte, length)
+	}
+	messageBuf := m.buf[:length]
+	if _, err := io.ReadFull(r, messageBuf); err != nil {
+		return err
 	}
 
-	// Message type is the first byte of the message
-	messageType := MessageType(messageBuf[0])
-
-	// Payload is the rest of the message
-	var payload []byte
+	// Message type is the first byte of the message, and the payload is
+	// the rest
+	m.Type = MessageType(messageBuf[0])
 	if length > 1 {
-		payload = messageBuf[1:]
+		m.Payload = messageBuf[1:]
 	}
-
-	return &Message{
-		Length:  length,
-		Type:    messageType,
-		Payload: payload,
-	}, nil
+	return nil
 }
 
 // FormatMessage creates a message of the specified type with the given payload
@@ -121,6 +213,62 @@ func RequestMessage(index, begin, length uint32) *Message {
 	return FormatMessage(MsgRequest, payload)
 }
 
+// PieceMessage creates a piece message carrying a block of piece data
+func PieceMessage(index, begin uint32, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], index) // Piece index
+	binary.BigEndian.PutUint32(payload[4:8], begin) // Offset within the piece
+	copy(payload[8:], block)
+
+	return FormatMessage(MsgPiece, payload)
+}
+
+// RejectMessage creates a REJECT REQUEST message telling the peer we won't
+// serve a block it requested (BEP 6)
+func RejectMessage(index, begin, length uint32) *Message {
+	msg := RequestMessage(index, begin, length)
+	msg.Type = MsgRejectRequest
+	return msg
+}
+
+// CancelMessage creates a CANCEL message withdrawing a block request
+func CancelMessage(index, begin, length uint32) *Message {
+	msg := RequestMessage(index, begin, length)
+	msg.Type = MsgCancel
+	return msg
+}
+
+// AllowedFastMessage creates an ALLOWED FAST message telling the peer it may
+// request a piece even while we choke it (BEP 6)
+func AllowedFastMessage(index uint32) *Message {
+	return FormatMessage(MsgAllowedFast, binary.BigEndian.AppendUint32(nil, index))
+}
+
+// SuggestMessage creates a SUGGEST PIECE message hinting that the peer
+// download a piece from us (BEP 6)
+func SuggestMessage(index uint32) *Message {
+	return FormatMessage(MsgSuggestPiece, binary.BigEndian.AppendUint32(nil, index))
+}
+
+// PortMessage creates a PORT message advertising our DHT port (BEP 5)
+func PortMessage(port uint16) *Message {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, port)
+
+	return FormatMessage(MsgPort, payload)
+}
+
+// ParsePort parses a PORT message, returning the peer's DHT port
+func ParsePort(msg *Message) (uint16, error) {
+	if msg.Type != MsgPort {
+		return 0, errors.New("not a PORT message")
+	}
+	if len(msg.Payload) != 2 {
+		return 0, errors.New("invalid PORT message payload length")
+	}
+	return binary.BigEndian.Uint16(msg.Payload), nil
+}
+
 // ParseHave parses a HAVE message payload
 func ParseHave(msg *Message) (uint32, error) {
 	if msg.Type != MsgHave {
@@ -134,6 +282,67 @@ func ParseHave(msg *Message) (uint32, error) {
 	return binary.BigEndian.Uint32(msg.Payload), nil
 }
 
+// ParseSuggest parses a SUGGEST PIECE message payload
+func ParseSuggest(msg *Message) (uint32, error) {
+	return parseIndex(msg, MsgSuggestPiece, "SUGGEST PIECE")
+}
+
+// ParseAllowedFast parses an ALLOWED FAST message payload
+func ParseAllowedFast(msg *Message) (uint32, error) {
+	return parseIndex(msg, MsgAllowedFast, "ALLOWED FAST")
+}
+
+// parseIndex parses the payload of a message of type t carrying only a
+// piece index
+func parseIndex(msg *Message, t MessageType, name string) (uint32, error) {
+	if msg.Type != t {
+		return 0, fmt.Errorf("not a %s message", name)
+	}
+	if len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("invalid %s message payload length", name)
+	}
+	return binary.BigEndian.Uint32(msg.Payload), nil
+}
+
+// ParseRequest parses a REQUEST message payload
+func ParseRequest(msg *Message) (index, begin, length uint32, err error) {
+	if msg.Type != MsgRequest {
+		return 0, 0, 0, errors.New("not a REQUEST message")
+	}
+	return parseBlock(msg, "REQUEST")
+}
+
+// ParseReject parses a REJECT REQUEST message payload, which names the
+// rejected block like a REQUEST
+func ParseReject(msg *Message) (index, begin, length uint32, err error) {
+	if msg.Type != MsgRejectRequest {
+		return 0, 0, 0, errors.New("not a REJECT REQUEST message")
+	}
+	return parseBlock(msg, "REJECT REQUEST")
+}
+
+// ParseCancel parses a CANCEL message payload, which names the withdrawn
+// block like a REQUEST
+func ParseCancel(msg *Message) (index, begin, length uint32, err error) {
+	if msg.Type != MsgCancel {
+		return 0, 0, 0, errors.New("not a CANCEL message")
+	}
+	return parseBlock(msg, "CANCEL")
+}
+
+// parseBlock parses the index, begin and length payload of a message named
+// name
+func parseBlock(msg *Message, name string) (index, begin, length uint32, err error) {
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("invalid %s message payload length", name)
+	}
+
+	index = binary.BigEndian.Uint32(msg.Payload[0:4])
+	begin = binary.BigEndian.Uint32(msg.Payload[4:8])
+	length = binary.BigEndian.Uint32(msg.Payload[8:12])
+	return index, begin, length, nil
+}
+
 // ParsePiece parses a PIECE message payload
 func ParsePiece(pieceIndex uint32, msg *Message) (uint32, []byte, error) {
 	if msg.Type != MsgPiece {
@@ -155,7 +364,8 @@ func ParsePiece(pieceIndex uint32, msg *Message) (uint32, []byte, error) {
 	return begin, data, nil
 }
 
-// String returns a string representation of a message
+// String returns a string representation of a message. Malformed messages
+// are shown with their payload length instead of their fields.
 func (m *Message) String() string {
 	if m.Length == 0 {
 		return "KeepAlive"
@@ -172,27 +382,66 @@ func (m *Message) String() string {
 	case MsgNotInterested:
 		typeName = "NotInterested"
 	case MsgHave:
-		index := binary.BigEndian.Uint32(m.Payload)
-		return fmt.Sprintf("Have[%d]", index)
+		typeName = "Have"
+		if len(m.Payload) == 4 {
+			index := binary.BigEndian.Uint32(m.Payload)
+			return fmt.Sprintf("Have[%d]", index)
+		}
 	case MsgBitfield:
 		return fmt.Sprintf("Bitfield[%d bytes]", len(m.Payload))
 	case MsgRequest:
-		index := binary.BigEndian.Uint32(m.Payload[0:4])
-		begin := binary.BigEndian.Uint32(m.Payload[4:8])
-		length := binary.BigEndian.Uint32(m.Payload[8:12])
-		return fmt.Sprintf("Request[%d:%d:%d]", index, begin, length)
+		typeName = "Request"
+		if len(m.Payload) == 12 {
+			index := binary.BigEndian.Uint32(m.Payload[0:4])
+			begin := binary.BigEndian.Uint32(m.Payload[4:8])
+			length := binary.BigEndian.Uint32(m.Payload[8:12])
+			return fmt.Sprintf("Request[%d:%d:%d]", index, begin, length)
+		}
 	case MsgPiece:
-		index := binary.BigEndian.Uint32(m.Payload[0:4])
-		begin := binary.BigEndian.Uint32(m.Payload[4:8])
-		return fmt.Sprintf("Piece[%d:%d:%d bytes]", index, begin, len(m.Payload)-8)
+		typeName = "Piece"
+		if len(m.Payload) >= 8 {
+			index := binary.BigEndian.Uint32(m.Payload[0:4])
+			begin := binary.BigEndian.Uint32(m.Payload[4:8])
+			return fmt.Sprintf("Piece[%d:%d:%d bytes]", index, begin, len(m.Payload)-8)
+		}
 	case MsgCancel:
-		index := binary.BigEndian.Uint32(m.Payload[0:4])
-		begin := binary.BigEndian.Uint32(m.Payload[4:8])
-		length := binary.BigEndian.Uint32(m.Payload[8:12])
-		return fmt.Sprintf("Cancel[%d:%d:%d]", index, begin, length)
+		typeName = "Cancel"
+		if len(m.Payload) == 12 {
+			index := binary.BigEndian.Uint32(m.Payload[0:4])
+			begin := binary.BigEndian.Uint32(m.Payload[4:8])
+			length := binary.BigEndian.Uint32(m.Payload[8:12])
+			return fmt.Sprintf("Cancel[%d:%d:%d]", index, begin, length)
+		}
 	case MsgPort:
-		port := binary.BigEndian.Uint16(m.Payload)
-		return fmt.Sprintf("Port[%d]", port)
+		typeName = "Port"
+		if len(m.Payload) == 2 {
+			port := binary.BigEndian.Uint16(m.Payload)
+			return fmt.Sprintf("Port[%d]", port)
+		}
+	case MsgSuggestPiece:
+		typeName = "SuggestPiece"
+		if len(m.Payload) == 4 {
+			return fmt.Sprintf("SuggestPiece[%d]", binary.BigEndian.Uint32(m.Payload))
+		}
+	case MsgHaveAll:
+		typeName = "HaveAll"
+	case MsgHaveNone:
+		typeName = "HaveNone"
+	case MsgRejectRequest:
+		typeName = "RejectRequest"
+		if len(m.Payload) == 12 {
+			index := binary.BigEndian.Uint32(m.Payload[0:4])
+			begin := binary.BigEndian.Uint32(m.Payload[4:8])
+			length := binary.BigEndian.Uint32(m.Payload[8:12])
+			return fmt.Sprintf("RejectRequest[%d:%d:%d]", index, begin, length)
+		}
+	case MsgAllowedFast:
+		typeName = "AllowedFast"
+		if len(m.Payload) == 4 {
+			return fmt.Sprintf("AllowedFast[%d]", binary.BigEndian.Uint32(m.Payload))
+		}
+	case MsgExtended:
+		typeName = "Extended"
 	default:
 		typeName = fmt.Sprintf("Unknown(%d)", m.Type)
 	}
@@ -3,6 +3,7 @@ package peer
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
 	"testing"
 )
 
@@ -49,6 +50,39 @@ func TestMessageSerialization(t *testing.T) {
 	}
 }
 
+func TestMessageAppendTo(t *testing.T) {
+	msgs := []*Message{
+		&KeepAliveMessage,
+		FormatMessage(MsgUnchoke, nil),
+		FormatMessage(MsgHave, []byte{0, 0, 0, 7}),
+		PieceMessage(1, 16384, bytes.Repeat([]byte{0xab}, 16384)),
+	}
+
+	buf := make([]byte, 0, 32*1024)
+	for _, msg := range msgs {
+		expected := msg.Serialize()
+		if got := msg.AppendTo([]byte("prefix")); !bytes.Equal(got, append([]byte("prefix"), expected...)) {
+			t.Errorf("Expected AppendTo to append %s as serialized", msg)
+		}
+		var w bytes.Buffer
+		if n, err := msg.WriteTo(&w); err != nil || n != int64(len(expected)) || !bytes.Equal(w.Bytes(), expected) {
+			t.Errorf("Expected WriteTo to write %s as serialized, wrote %d bytes (err: %v)", msg, n, err)
+		}
+
+		// Reusing a buffer, or the pool, costs no allocations, though the race
+		// detector makes some of its own
+		if raceEnabled {
+			continue
+		}
+		if allocs := testing.AllocsPerRun(100, func() { buf = msg.AppendTo(buf[:0]) }); allocs != 0 {
+			t.Errorf("Expected AppendTo of %s not to allocate, got %.1f allocations", msg, allocs)
+		}
+		if allocs := testing.AllocsPerRun(100, func() { msg.WriteTo(io.Discard) }); allocs >= 1 {
+			t.Errorf("Expected WriteTo of %s not to allocate, got %.1f allocations", msg, allocs)
+		}
+	}
+}
+
 func TestMessageDeserialization(t *testing.T) {
 	// Create a keep-alive message
 	keepAliveBytes := make([]byte, 4)
@@ -97,6 +131,85 @@ func TestMessageDeserialization(t *testing.T) {
 	if index != 42 {
 		t.Errorf("Expected piece index 42, got %d", index)
 	}
+
+	// The bitfield of a torrent with 16 million pieces still fits
+	bitfield := FormatMessage(MsgBitfield, make([]byte, 16<<20/8)).Serialize()
+	if msg, err := ReadMessage(bytes.NewReader(bitfield)); err != nil || len(msg.Payload) != 2<<20 {
+		t.Errorf("Expected a 2 MiB bitfield, got error %v", err)
+	}
+
+	// A bogus length is rejected before anything is allocated
+	binary.BigEndian.PutUint32(msgBytes[0:4], MaxMessageLength+1)
+	if _, err := ReadMessage(bytes.NewReader(msgBytes)); err == nil {
+		t.Error("Expected error for a message over MaxMessageLength")
+	}
+}
+
+func TestReadPooledMessage(t *testing.T) {
+	wire := PieceMessage(3, 16384, bytes.Repeat([]byte{0xab}, 16384)).Serialize()
+	wire = append(wire, 0, 0, 0, 0) // keep-alive
+	r := bytes.NewReader(wire)
+
+	msg, err := ReadPooledMessage(r)
+	if err != nil {
+		t.Fatalf("ReadPooledMessage failed: %v", err)
+	}
+	begin, block, err := ParsePiece(3, msg)
+	if err != nil || begin != 16384 || len(block) != 16384 || block[0] != 0xab {
+		t.Errorf("Expected the block at 16384, got %d bytes at %d (err: %v)", len(block), begin, err)
+	}
+	msg.Release()
+	msg.Release() // a second release does nothing
+
+	if msg, err := ReadPooledMessage(r); err != nil || msg != &KeepAliveMessage {
+		t.Errorf("Expected the keep-alive message, got %v (err: %v)", msg, err)
+	}
+	KeepAliveMessage.Release()
+	if _, err := ReadPooledMessage(r); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+
+	// Released messages are read into again instead of allocating, though the
+	// race detector makes allocations of its own
+	if raceEnabled {
+		return
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Reset(wire)
+		msg, _ := ReadPooledMessage(r)
+		msg.Release()
+	})
+	if allocs >= 1 {
+		t.Errorf("Expected ReadPooledMessage not to allocate, got %.1f allocations", allocs)
+	}
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	wire := PieceMessage(3, 16384, make([]byte, 16384)).Serialize()
+	r := bytes.NewReader(wire)
+
+	b.Run("ReadMessage", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(wire)))
+		for i := 0; i < b.N; i++ {
+			r.Reset(wire)
+			if _, err := ReadMessage(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ReadPooledMessage", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(wire)))
+		for i := 0; i < b.N; i++ {
+			r.Reset(wire)
+			msg, err := ReadPooledMessage(r)
+			if err != nil {
+				b.Fatal(err)
+			}
+			msg.Release()
+		}
+	})
 }
 
 func TestMessageHelpers(t *testing.T) {
@@ -138,4 +251,82 @@ func TestMessageHelpers(t *testing.T) {
 	if msgString != expected {
 		t.Errorf("Expected string representation %s, got %s", expected, msgString)
 	}
+
+	// Test ParseRequest
+	i, b, l, err := ParseRequest(requestMsg)
+	if err != nil || i != index || b != begin || l != length {
+		t.Errorf("Expected request %d:%d:%d, got %d:%d:%d (err: %v)", index, begin, length, i, b, l, err)
+	}
+	if _, _, _, err := ParseRequest(PortMessage(1)); err == nil {
+		t.Error("Expected error parsing a non-request message")
+	}
+
+	// Test PieceMessage
+	pieceMsg := PieceMessage(index, begin, []byte("block"))
+	gotBegin, block, err := ParsePiece(index, pieceMsg)
+	if err != nil || gotBegin != begin || string(block) != "block" {
+		t.Errorf("Expected block at %d, got %q at %d (err: %v)", begin, block, gotBegin, err)
+	}
+
+	// Test PortMessage
+	portMsg := PortMessage(6881)
+	if portMsg.Type != MsgPort || portMsg.Length != 3 {
+		t.Errorf("Expected Port message of length 3, got type %d length %d", portMsg.Type, portMsg.Length)
+	}
+	if portMsg.String() != "Port[6881]" {
+		t.Errorf("Expected string representation Port[6881], got %s", portMsg.String())
+	}
+	if port, err := ParsePort(portMsg); err != nil || port != 6881 {
+		t.Errorf("Expected port 6881, got %d (err: %v)", port, err)
+	}
+	if _, err := ParsePort(FormatMessage(MsgPort, []byte{1})); err == nil {
+		t.Error("Expected error parsing a short PORT message")
+	}
+
+	// Test CancelMessage
+	cancelMsg := CancelMessage(index, begin, length)
+	if cancelMsg.String() != "Cancel[7:1024:16384]" {
+		t.Errorf("Expected string representation Cancel[7:1024:16384], got %s", cancelMsg.String())
+	}
+	i, b, l, err = ParseCancel(cancelMsg)
+	if err != nil || i != index || b != begin || l != length {
+		t.Errorf("Expected cancel %d:%d:%d, got %d:%d:%d (err: %v)", index, begin, length, i, b, l, err)
+	}
+	if _, _, _, err := ParseCancel(requestMsg); err == nil {
+		t.Error("Expected error parsing a request as a cancel")
+	}
+
+	// Test the Fast extension messages
+	rejectMsg := RejectMessage(index, begin, length)
+	if rejectMsg.String() != "RejectRequest[7:1024:16384]" {
+		t.Errorf("Expected string representation RejectRequest[7:1024:16384], got %s", rejectMsg.String())
+	}
+	i, b, l, err = ParseReject(rejectMsg)
+	if err != nil || i != index || b != begin || l != length {
+		t.Errorf("Expected reject %d:%d:%d, got %d:%d:%d (err: %v)", index, begin, length, i, b, l, err)
+	}
+	if _, _, _, err := ParseReject(requestMsg); err == nil {
+		t.Error("Expected error parsing a request as a reject")
+	}
+	if got, err := ParseAllowedFast(AllowedFastMessage(index)); err != nil || got != index {
+		t.Errorf("Expected allowed fast piece %d, got %d (err: %v)", index, got, err)
+	}
+	if got, err := ParseSuggest(SuggestMessage(index)); err != nil || got != index {
+		t.Errorf("Expected suggested piece %d, got %d (err: %v)", index, got, err)
+	}
+	if _, err := ParseSuggest(AllowedFastMessage(index)); err == nil {
+		t.Error("Expected error parsing an ALLOWED FAST message as a suggestion")
+	}
+	if _, err := ParseAllowedFast(FormatMessage(MsgAllowedFast, []byte{1})); err == nil {
+		t.Error("Expected error parsing a short ALLOWED FAST message")
+	}
+	if !MsgHaveAll.IsFast() || MsgPort.IsFast() || MsgExtended.IsFast() {
+		t.Error("Expected only the Fast extension's messages to be fast")
+	}
+
+	// Malformed messages show their length instead of panicking
+	short := FormatMessage(MsgHave, []byte{1, 2})
+	if short.String() != "Have[2 bytes]" {
+		t.Errorf("Expected string representation Have[2 bytes], got %s", short.String())
+	}
 }
@@ -0,0 +1,7 @@
+//go:build !race
+
+package peer
+
+// raceEnabled is set when the race detector is on, since it makes
+// allocations of its own
+const raceEnabled = false
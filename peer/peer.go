@@ -4,20 +4,35 @@ package peer
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/transport"
 )
 
 // Constants for the protocol
 const (
 	ProtocolIdentifier = "BitTorrent protocol"
-	HandshakeLength    = 68 // Total length of a handshake message
-	ConnectionTimeout  = 3 * time.Second
+	HandshakeLength    = 68              // Total length of a handshake message
+	ConnectionTimeout  = 3 * time.Second // Default for dialing and the handshake
 )
 
+// ErrInfoHashMismatch is returned when a peer answers a handshake for a
+// different torrent, or sends metadata that doesn't hash to the info hash
+var ErrInfoHashMismatch = errors.New("info hash mismatch")
+
+// ErrUnknownInfoHash is returned when an incoming peer asks for a torrent we
+// aren't serving
+var ErrUnknownInfoHash = errors.New("unknown info hash")
+
+// ErrUnreachable is returned when the connection to a peer can't be opened,
+// as opposed to failing once open
+var ErrUnreachable = errors.New("failed to connect to peer")
+
 // Handshake represents a BitTorrent handshake message
 type Handshake struct {
 	Pstr     string   // Protocol identifier
@@ -97,40 +112,144 @@ func NewHandshake(infoHash [20]byte, peerID [20]byte) *Handshake {
 }
 
 // PerformHandshake connects to a peer and completes the handshake
-func PerformHandshake(peerAddr string, infoHash [20]byte, peerID [20]byte) (*Handshake, net.Conn, error) {
-	conn, err := net.DialTimeout("tcp", peerAddr, ConnectionTimeout)
+func PerformHandshake(ctx context.Context, peerAddr string, infoHash [20]byte, peerID [20]byte) (*Handshake, net.Conn, error) {
+	return Connect(ctx, peerAddr, NewHandshake(infoHash, peerID))
+}
+
+// AcceptHandshake completes the handshake of an incoming connection, the
+// reverse of Connect: it reads the remote handshake first, asks lookup
+// whether we serve the torrent it names, and only then replies with ourID
+// and the given extensions, as BEP 3 has the receiving side do. A torrent we
+// don't serve gets no reply and ErrUnknownInfoHash. The connection is left
+// open either way; bounding the handshake with a deadline is up to the
+// caller.
+func AcceptHandshake(conn net.Conn, lookup func(infoHash [20]byte) bool, ourID [20]byte, extensions ...ExtensionBit) (*Handshake, error) {
+	inHandshake, err := ParseHandshake(conn)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to connect to peer: %v", err)
+		return nil, fmt.Errorf("failed to read handshake: %v", err)
+	}
+	if inHandshake.Pstr != ProtocolIdentifier {
+		return nil, fmt.Errorf("unknown protocol %q", inHandshake.Pstr)
+	}
+	if !lookup(inHandshake.InfoHash) {
+		return nil, ErrUnknownInfoHash
 	}
 
-	// Set deadlines to prevent hanging
-	conn.SetDeadline(time.Now().Add(ConnectionTimeout))
+	reply := NewHandshake(inHandshake.InfoHash, ourID)
+	for _, bit := range extensions {
+		reply.SetExtension(bit)
+	}
+	if _, err := conn.Write(reply.Serialize()); err != nil {
+		return nil, fmt.Errorf("failed to send handshake: %v", err)
+	}
+	return inHandshake, nil
+}
+
+// DialFunc opens a network connection, like net.Dialer.DialContext
+type DialFunc = transport.DialFunc
+
+// Option changes how Connect reaches a peer
+type Option func(*connectOptions)
+
+// connectOptions holds the settings Options change
+type connectOptions struct {
+	dial    transport.Dialer
+	timeout time.Duration
+}
+
+// WithDialTimeout bounds dialing and the handshake together; the default is
+// ConnectionTimeout
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *connectOptions) {
+		if d > 0 {
+			o.timeout = d
+		}
+	}
+}
+
+// WithDialer opens connections with dial, e.g. to bind them to a local address
+// or go through a proxy. The default is a plain TCP dial.
+func WithDialer(dial DialFunc) Option {
+	return func(o *connectOptions) {
+		if dial != nil {
+			o.dial = dial
+		}
+	}
+}
+
+// WithTransport opens connections through t, e.g. uTP or an in-memory network
+// in tests
+func WithTransport(t transport.Dialer) Option {
+	return func(o *connectOptions) {
+		if t != nil {
+			o.dial = t
+		}
+	}
+}
+
+// Connect dials a peer and exchanges the given handshake, which allows callers
+// to advertise extensions through its reserved bytes. It gives up when ctx is
+// done.
+func Connect(ctx context.Context, peerAddr string, outHandshake *Handshake, opts ...Option) (*Handshake, net.Conn, error) {
+	o := connectOptions{dial: &transport.TCP{}, timeout: ConnectionTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	infoHash := outHandshake.InfoHash
+
+	dialCtx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	conn, err := o.dial.DialContext(dialCtx, "tcp", peerAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+
+	// Set deadlines to prevent hanging, and cut the handshake short when ctx
+	// is done
+	conn.SetDeadline(time.Now().Add(o.timeout))
 	defer conn.SetDeadline(time.Time{}) // Reset deadline after handshake
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
 
-	// Create and send our handshake
-	outHandshake := NewHandshake(infoHash, peerID)
+	// Send our handshake
 	_, err = conn.Write(outHandshake.Serialize())
 	if err != nil {
 		conn.Close()
-		return nil, nil, fmt.Errorf("failed to send handshake: %v", err)
+		return nil, nil, fmt.Errorf("failed to send handshake: %w", contextErr(ctx, err))
 	}
 
 	// Read and parse the response handshake
 	inHandshake, err := ParseHandshake(conn)
 	if err != nil {
 		conn.Close()
-		return nil, nil, fmt.Errorf("failed to read handshake: %v", err)
+		return nil, nil, fmt.Errorf("failed to read handshake: %w", contextErr(ctx, err))
 	}
 
 	// Verify the info hash
 	if !bytes.Equal(inHandshake.InfoHash[:], infoHash[:]) {
 		conn.Close()
-		return nil, nil, errors.New("info hash mismatch")
+		return nil, nil, ErrInfoHashMismatch
 	}
 
 	return inHandshake, conn, nil
 }
 
+// ConnectWith is like Connect but opens the connection with dial, like
+// WithDialer. A nil dial uses a plain TCP dial.
+func ConnectWith(ctx context.Context, dial DialFunc, peerAddr string, outHandshake *Handshake, opts ...Option) (*Handshake, net.Conn, error) {
+	return Connect(ctx, peerAddr, outHandshake, append([]Option{WithDialer(dial)}, opts...)...)
+}
+
+// contextErr returns ctx's error in place of err once ctx is done, since a
+// cancelled handshake otherwise fails with a misleading timeout
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
 // ExtensionBit represents a protocol extension bit position
 type ExtensionBit uint8
 
@@ -141,8 +260,8 @@ const (
 	// ExtensionExtensions is bit 5 of reserved byte 5 (BEP 10: Extension Protocol)
 	ExtensionExtensions ExtensionBit = 5
 
-	// ExtensionFast is bit 7 of reserved byte 7 (BEP 6: Fast Extension)
-	ExtensionFast ExtensionBit = 7
+	// ExtensionFast is bit 2 of reserved byte 7 (BEP 6: Fast Extension)
+	ExtensionFast ExtensionBit = 2
 )
 
 // SetExtension enables a specific extension in the handshake
@@ -154,8 +273,8 @@ func (h *Handshake) SetExtension(bit ExtensionBit) {
 		// Extension Protocol is bit 5 of byte 5
 		h.Reserved[5] |= 32 // 2^5 = 32
 	} else if bit == ExtensionFast {
-		// Fast Extension is bit 7 of byte 7
-		h.Reserved[7] |= 128 // 2^7 = 128
+		// Fast Extension is bit 2 of byte 7
+		h.Reserved[7] |= 4 // 2^2 = 4
 	}
 }
 
@@ -166,7 +285,7 @@ func (h *Handshake) HasExtension(bit ExtensionBit) bool {
 	} else if bit == ExtensionExtensions {
 		return (h.Reserved[5] & 32) != 0
 	} else if bit == ExtensionFast {
-		return (h.Reserved[7] & 128) != 0
+		return (h.Reserved[7] & 4) != 0
 	}
 	return false
 }
@@ -2,7 +2,11 @@ package peer
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestHandshakeSerialization(t *testing.T) {
@@ -74,4 +78,103 @@ func TestExtensionBits(t *testing.T) {
 	if h.Reserved[5] != 32 {
 		t.Errorf("Expected byte 5 to have value 32, got %d", h.Reserved[5])
 	}
+
+	// The Fast extension is bit 2 in reserved byte 7 (BEP 6)
+	h.SetExtension(ExtensionFast)
+	if !h.HasExtension(ExtensionFast) || h.Reserved[7] != 5 {
+		t.Errorf("Expected byte 7 to have value 5 with the Fast extension, got %d", h.Reserved[7])
+	}
+}
+
+func TestConnectDialTimeout(t *testing.T) {
+	// A peer that accepts but never answers the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	_, _, err = Connect(context.Background(), ln.Addr().String(), NewHandshake([20]byte{1}, [20]byte{2}), WithDialTimeout(100*time.Millisecond))
+	if err == nil {
+		t.Fatal("Expected error from a silent peer")
+	}
+	if elapsed := time.Since(start); elapsed >= ConnectionTimeout {
+		t.Errorf("Expected the handshake to time out after 100ms, took %v", elapsed)
+	}
+
+	// Cancelling the context cuts the handshake short too
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, _, err = Connect(ctx, ln.Addr().String(), NewHandshake([20]byte{1}, [20]byte{2}))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the context's error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= ConnectionTimeout {
+		t.Errorf("Expected the handshake to stop after 100ms, took %v", elapsed)
+	}
+}
+
+func TestAcceptHandshake(t *testing.T) {
+	served := [20]byte{1}
+	serving := func(infoHash [20]byte) bool { return infoHash == served }
+
+	tests := []struct {
+		name      string
+		handshake *Handshake
+		wantErr   error
+		wantReply bool
+	}{
+		{"served", NewHandshake(served, [20]byte{2}), nil, true},
+		{"not served", NewHandshake([20]byte{3}, [20]byte{2}), ErrUnknownInfoHash, false},
+		{"other protocol", &Handshake{Pstr: "Other protocol", InfoHash: served}, errors.New("unknown protocol"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+			replies := make(chan *Handshake, 1)
+			go func() {
+				remote.Write(tt.handshake.Serialize())
+				hs, _ := ParseHandshake(remote)
+				replies <- hs
+			}()
+
+			hs, err := AcceptHandshake(local, serving, [20]byte{9}, ExtensionFast)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("Expected no error, got: %v", err)
+			case tt.wantErr != nil && err == nil:
+				t.Fatalf("Expected error %v, got none", tt.wantErr)
+			case errors.Is(tt.wantErr, ErrUnknownInfoHash) && !errors.Is(err, ErrUnknownInfoHash):
+				t.Errorf("Expected ErrUnknownInfoHash, got %v", err)
+			}
+			if err == nil && hs.PeerID != tt.handshake.PeerID {
+				t.Errorf("Expected the remote peer ID %x, got %x", tt.handshake.PeerID, hs.PeerID)
+			}
+
+			// We only answer a handshake for a torrent we serve
+			if !tt.wantReply {
+				local.Close()
+			}
+			reply := <-replies
+			if tt.wantReply != (reply != nil) {
+				t.Fatalf("Expected a reply %v, got %v", tt.wantReply, reply)
+			}
+			if reply != nil && (reply.InfoHash != served || reply.PeerID != [20]byte{9} || !reply.HasExtension(ExtensionFast)) {
+				t.Errorf("Expected our handshake for the served torrent with Fast, got %+v", reply)
+			}
+		})
+	}
 }
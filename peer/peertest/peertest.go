@@ -0,0 +1,269 @@
+// Package peertest provides a scriptable peer for testing code that talks the
+// peer wire protocol. A MockPeer plays a fixed script of steps, such as
+// sending malformed messages, choking early, serving corrupt pieces or
+// dripping data slowly, so behaviour against hostile or buggy peers can be
+// tested deterministically.
+package peertest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/peer"
+)
+
+// Step is one action of a script. It returns an error to end the script.
+type Step func(c *Conn) error
+
+// Conn is the mock's end of a connection to the client under test
+type Conn struct {
+	net.Conn
+	Handshake *peer.Handshake // What the client sent; nil with SkipHandshake
+	mock      *MockPeer
+}
+
+// Send writes a message to the client
+func (c *Conn) Send(msg *peer.Message) error {
+	_, err := c.Write(msg.Serialize())
+	return err
+}
+
+// Receive reads the next message from the client and records it
+func (c *Conn) Receive() (*peer.Message, error) {
+	msg, err := peer.ReadMessage(c)
+	if err != nil {
+		return nil, err
+	}
+	c.mock.mu.Lock()
+	c.mock.received = append(c.mock.received, msg)
+	c.mock.mu.Unlock()
+	return msg, nil
+}
+
+// MockPeer answers the handshake and then plays Script on every connection.
+// The connection is closed when the script ends.
+type MockPeer struct {
+	InfoHash      [20]byte
+	PeerID        [20]byte
+	Reserved      [8]byte // Reserved bytes of our handshake, e.g. to claim extensions
+	SkipHandshake bool    // Play the script right away, e.g. to send a bad handshake
+	Script        []Step
+
+	mu       sync.Mutex
+	received []*peer.Message
+	errs     []error
+}
+
+// Serve plays the script on conn and closes it. Its error is also recorded
+// for Err.
+func (m *MockPeer) Serve(conn net.Conn) error {
+	defer conn.Close()
+	err := m.serve(&Conn{Conn: conn, mock: m})
+	if err != nil {
+		m.mu.Lock()
+		m.errs = append(m.errs, err)
+		m.mu.Unlock()
+	}
+	return err
+}
+
+func (m *MockPeer) serve(c *Conn) error {
+	if !m.SkipHandshake {
+		hs, err := peer.ParseHandshake(c)
+		if err != nil {
+			return fmt.Errorf("failed to read handshake: %v", err)
+		}
+		c.Handshake = hs
+		reply := &peer.Handshake{Pstr: peer.ProtocolIdentifier, Reserved: m.Reserved, InfoHash: m.InfoHash, PeerID: m.PeerID}
+		if _, err := c.Write(reply.Serialize()); err != nil {
+			return fmt.Errorf("failed to send handshake: %v", err)
+		}
+	}
+
+	for i, step := range m.Script {
+		if err := step(c); err != nil {
+			return fmt.Errorf("step %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Listen accepts connections on localhost until the test ends, playing the
+// script on each, and returns the listen address
+func (m *MockPeer) Listen(tb testing.TB) *net.TCPAddr {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("Listen failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	tb.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m.Serve(conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+// Pipe plays the script on one end of an in-memory connection and returns
+// the other end, for code that takes a net.Conn rather than dialing, e.g.
+// peer.AcceptHandshake. Closing it ends the script.
+func (m *MockPeer) Pipe() net.Conn {
+	client, mock := net.Pipe()
+	go m.Serve(mock)
+	return client
+}
+
+// Received returns the messages the scripts have read so far
+func (m *MockPeer) Received() []*peer.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*peer.Message(nil), m.received...)
+}
+
+// Err returns the errors that ended scripts early, joined, or nil
+func (m *MockPeer) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return errors.Join(m.errs...)
+}
+
+// Send sends messages in order
+func Send(msgs ...*peer.Message) Step {
+	return func(c *Conn) error {
+		for _, msg := range msgs {
+			if err := c.Send(msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// SendRaw sends bytes as they are, e.g. a message with a bogus length
+func SendRaw(b []byte) Step {
+	return func(c *Conn) error {
+		_, err := c.Write(b)
+		return err
+	}
+}
+
+// Drip sends b in chunks of size bytes, pausing interval between them, like
+// a slow or congested peer
+func Drip(b []byte, size int, interval time.Duration) Step {
+	return func(c *Conn) error {
+		for len(b) > 0 {
+			n := min(size, len(b))
+			if _, err := c.Write(b[:n]); err != nil {
+				return err
+			}
+			b = b[n:]
+			if len(b) > 0 {
+				time.Sleep(interval)
+			}
+		}
+		return nil
+	}
+}
+
+// Sleep pauses the script
+func Sleep(d time.Duration) Step {
+	return func(c *Conn) error {
+		time.Sleep(d)
+		return nil
+	}
+}
+
+// Bitfield sends a bitfield claiming every one of numPieces pieces
+func Bitfield(numPieces int) Step {
+	bitfield := peer.NewBitfield(numPieces)
+	for i := 0; i < numPieces; i++ {
+		bitfield.SetPiece(i)
+	}
+	return Send(bitfield.Message())
+}
+
+// Expect reads messages until one of type t arrives, skipping others
+func Expect(t peer.MessageType) Step {
+	return func(c *Conn) error {
+		for {
+			msg, err := c.Receive()
+			if err != nil {
+				return fmt.Errorf("expected message type %d: %v", t, err)
+			}
+			if msg.Length > 0 && msg.Type == t {
+				return nil
+			}
+		}
+	}
+}
+
+// ServeRequests answers n block requests with data, split into pieces of
+// pieceLength, or every request until the client hangs up if n is 0. Tamper,
+// if set, may change each block before it is sent, e.g. to corrupt a piece.
+// Other messages are skipped.
+func ServeRequests(data []byte, pieceLength, n int, tamper func(index int, block []byte)) Step {
+	return func(c *Conn) error {
+		for served := 0; n == 0 || served < n; {
+			msg, err := c.Receive()
+			if err != nil && n == 0 {
+				return nil // the client hung up
+			}
+			if err != nil {
+				return err
+			}
+			if msg.Length == 0 || msg.Type != peer.MsgRequest {
+				continue
+			}
+
+			index, begin, length, err := peer.ParseRequest(msg)
+			if err != nil {
+				return err
+			}
+			start := int(index)*pieceLength + int(begin)
+			if start+int(length) > len(data) {
+				return fmt.Errorf("request for piece %d at %d beyond the data", index, begin)
+			}
+			block := append([]byte(nil), data[start:start+int(length)]...)
+			if tamper != nil {
+				tamper(int(index), block)
+			}
+			if err := c.Send(peer.PieceMessage(index, begin, block)); err != nil {
+				return err
+			}
+			served++
+		}
+		return nil
+	}
+}
+
+// Hang reads and records messages until the client hangs up, keeping the
+// connection open without answering
+func Hang() Step {
+	return func(c *Conn) error {
+		for {
+			if _, err := c.Receive(); err != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package peertest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/peer"
+)
+
+func TestMockPeer(t *testing.T) {
+	infoHash := [20]byte{1}
+	unchoke := peer.FormatMessage(peer.MsgUnchoke, nil)
+	mock := &MockPeer{
+		InfoHash: infoHash,
+		PeerID:   [20]byte{'m'},
+		Script: []Step{
+			Bitfield(3),
+			Expect(peer.MsgInterested),
+			Drip(unchoke.Serialize(), 1, time.Millisecond),
+			ServeRequests([]byte("abcdefgh"), 4, 1, func(index int, block []byte) { block[0] = 'X' }),
+		},
+	}
+	addr := mock.Listen(t)
+
+	hs, conn, err := peer.PerformHandshake(context.Background(), addr.String(), infoHash, [20]byte{'c'})
+	if err != nil {
+		t.Fatalf("PerformHandshake failed: %v", err)
+	}
+	defer conn.Close()
+	if hs.PeerID != mock.PeerID {
+		t.Errorf("Expected peer ID %q, got %q", mock.PeerID, hs.PeerID)
+	}
+
+	conn.Write(peer.FormatMessage(peer.MsgNotInterested, nil).Serialize())
+	conn.Write(peer.FormatMessage(peer.MsgInterested, nil).Serialize())
+	conn.Write(peer.RequestMessage(1, 0, 4).Serialize())
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	expected := []string{"Bitfield[1 bytes]", "Unchoke", "Piece[1:0:4 bytes]"}
+	var last *peer.Message
+	for _, want := range expected {
+		msg, err := peer.ReadMessage(conn)
+		if err != nil {
+			t.Fatalf("ReadMessage failed: %v", err)
+		}
+		if msg.String() != want {
+			t.Errorf("Expected %s, got %s", want, msg)
+		}
+		last = msg
+	}
+	if string(last.Payload[8:]) != "Xfgh" {
+		t.Errorf("Expected the tampered block, got %q", last.Payload[8:])
+	}
+
+	// The script ends after one block, closing the connection
+	if _, err := peer.ReadMessage(conn); err == nil {
+		t.Error("Expected the connection to be closed after the script")
+	}
+	if err := mock.Err(); err != nil {
+		t.Errorf("Expected the script to succeed, got %v", err)
+	}
+	if got := len(mock.Received()); got != 3 {
+		t.Errorf("Expected 3 messages received, got %d", got)
+	}
+}
+
+func TestMockPeerScriptError(t *testing.T) {
+	mock := &MockPeer{Script: []Step{Expect(peer.MsgInterested)}}
+	addr := mock.Listen(t)
+
+	_, conn, err := peer.PerformHandshake(context.Background(), addr.String(), [20]byte{}, [20]byte{'c'})
+	if err != nil {
+		t.Fatalf("PerformHandshake failed: %v", err)
+	}
+	conn.Close()
+
+	for deadline := time.Now().Add(5 * time.Second); mock.Err() == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the script to fail when the client hangs up")
+		}
+	}
+}
+
+func TestMockPeerPipe(t *testing.T) {
+	infoHash := [20]byte{2}
+	mock := &MockPeer{InfoHash: infoHash, PeerID: [20]byte{'m'}, Script: []Step{Bitfield(8)}}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return mock.Pipe(), nil
+	}
+
+	hs, conn, err := peer.ConnectWith(context.Background(), dial, "mock:6881", peer.NewHandshake(infoHash, [20]byte{'c'}))
+	if err != nil {
+		t.Fatalf("ConnectWith failed: %v", err)
+	}
+	defer conn.Close()
+	if hs.PeerID != mock.PeerID {
+		t.Errorf("Expected peer ID %q, got %q", mock.PeerID, hs.PeerID)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if msg, err := peer.ReadMessage(conn); err != nil || msg.Type != peer.MsgBitfield {
+		t.Errorf("Expected the scripted bitfield, got %v (err: %v)", msg, err)
+	}
+}
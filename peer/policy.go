@@ -0,0 +1,95 @@
+package peer
+
+import (
+	"strings"
+)
+
+// Action is what a ClientPolicy does with a peer
+type Action int
+
+// Actions a ClientPolicy can take
+const (
+	Allow    Action = iota
+	Refuse          // drop the connection
+	Throttle        // cap what we upload to the peer
+)
+
+// KnownBadClients are patterns matching clients that download from the swarm
+// without uploading back, such as offline download services, or that fake
+// their identity. Refusing them is common practice.
+var KnownBadClients = []string{
+	"-XL", "Xunlei*",
+	"-SD", "Thunder*",
+	"-XF", "Xfplay*",
+	"-QD", "QQDownload*",
+	"-BN", "Baidu Netdisk*",
+}
+
+// ClientPolicy decides how peers are treated from the client they run.
+// Patterns match either the start of the peer ID when they begin with a dash,
+// such as "-XL" or "-UT3550-", or else the client name and version that
+// ClientName guesses from the peer ID or that the peer reports in its
+// extension handshake, such as "Transmission 2.*". A * matches any text, and
+// names are matched case-insensitively.
+type ClientPolicy struct {
+	Refuse   []string // clients whose connections are dropped
+	Throttle []string // clients that get a capped upload rate
+}
+
+// Decide returns the action for a peer with the given ID, and the client
+// it reported in its extension handshake, or "" if it didn't yet. Refuse
+// rules win over Throttle rules.
+func (p ClientPolicy) Decide(id [20]byte, client string) Action {
+	for _, pattern := range p.Refuse {
+		if MatchClient(pattern, id, client) {
+			return Refuse
+		}
+	}
+	for _, pattern := range p.Throttle {
+		if MatchClient(pattern, id, client) {
+			return Throttle
+		}
+	}
+	return Allow
+}
+
+// Empty reports whether the policy has no rules
+func (p ClientPolicy) Empty() bool {
+	return len(p.Refuse) == 0 && len(p.Throttle) == 0
+}
+
+// MatchClient reports whether a ClientPolicy pattern matches a peer with the
+// given ID and reported client
+func MatchClient(pattern string, id [20]byte, client string) bool {
+	if pattern == "" {
+		return false
+	}
+	if pattern[0] == '-' {
+		return strings.HasPrefix(string(id[:]), pattern)
+	}
+	if name := ClientName(id); name != "" && matchGlob(strings.ToLower(pattern), strings.ToLower(name)) {
+		return true
+	}
+	return client != "" && matchGlob(strings.ToLower(pattern), strings.ToLower(client))
+}
+
+// matchGlob matches s against a pattern in which * stands for any text
+func matchGlob(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, last)
+}
@@ -0,0 +1,58 @@
+package peer
+
+import "testing"
+
+func TestClientPolicy(t *testing.T) {
+	policy := ClientPolicy{
+		Refuse:   append([]string{"-UT3550-"}, KnownBadClients...),
+		Throttle: []string{"transmission 2.*", "*leech*"},
+	}
+
+	testCases := []struct {
+		id       string
+		client   string
+		expected Action
+	}{
+		{"-qB4630-abcdefghijkl", "", Allow},
+		{"-XL0012-abcdefghijkl", "", Refuse},
+		{"-UT3550-abcdefghijkl", "", Refuse},
+		{"-UT3560-abcdefghijkl", "", Allow},
+		{"-TR2940-abcdefghijkl", "", Throttle},
+		{"-TR4050-abcdefghijkl", "", Allow},
+		// The extension handshake can give a faked peer ID away
+		{"-qB4630-abcdefghijkl", "Xunlei 0.0.1.2", Refuse},
+		{"abcdefghijklmnopqrst", "SuperLeecher/1.0", Throttle},
+		{"abcdefghijklmnopqrst", "", Allow},
+	}
+
+	for _, tc := range testCases {
+		var id [20]byte
+		copy(id[:], tc.id)
+		if got := policy.Decide(id, tc.client); got != tc.expected {
+			t.Errorf("Decide(%q, %q): expected %v, got %v", tc.id, tc.client, tc.expected, got)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	testCases := []struct {
+		pattern, s string
+		expected   bool
+	}{
+		{"abc", "abc", true},
+		{"abc", "abcd", false},
+		{"a*", "abc", true},
+		{"*c", "abc", true},
+		{"a*c", "ac", true},
+		{"a*b*c", "axbyc", true},
+		{"a*b*c", "axcyb", false},
+		{"ab*bc", "abc", false},
+		{"*", "", true},
+	}
+
+	for _, tc := range testCases {
+		if got := matchGlob(tc.pattern, tc.s); got != tc.expected {
+			t.Errorf("matchGlob(%q, %q): expected %v, got %v", tc.pattern, tc.s, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+)
+
+// castagnoli is the CRC32-C table canonical priorities are computed with
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Masks applied to both IPs before hashing (BEP 40): the more of their prefix
+// the IPs share, the more of it is kept, so peers on one network don't all
+// rank alike
+var (
+	v4Masks = [][]byte{
+		{0xff, 0xff, 0x55, 0x55}, // different /16
+		{0xff, 0xff, 0xff, 0x55}, // same /16
+		{0xff, 0xff, 0xff, 0xff}, // same /24
+	}
+	v6Masks = [][]byte{
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55}, // different /48
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55}, // same /48
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55, 0x55}, // same /56
+	}
+)
+
+// Priority returns the canonical peer priority of two endpoints (BEP 40).
+// Both ends of a connection compute the same value, so clients that prefer
+// higher priorities when choosing whom to dial or whom to drop agree with
+// each other, and every peer ends up well connected. The endpoints must be of
+// the same address family.
+func Priority(a, b *net.TCPAddr) uint32 {
+	if a.IP.Equal(b.IP) {
+		// Same host: the ports decide, lowest first
+		lo, hi := uint16(a.Port), uint16(b.Port)
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		return crc32.Checksum(binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, lo), hi), castagnoli)
+	}
+
+	// The masks widen one byte past the first prefix the IPs share
+	ipA, ipB, masks, prefix := a.IP.To4(), b.IP.To4(), v4Masks, 2 // bytes of a /16
+	if ipA == nil || ipB == nil {
+		ipA, ipB, masks, prefix = a.IP.To16(), b.IP.To16(), v6Masks, 6 // bytes of a /48
+	}
+	mask := masks[0]
+	switch {
+	case bytes.Equal(ipA[:prefix+1], ipB[:prefix+1]):
+		mask = masks[2]
+	case bytes.Equal(ipA[:prefix], ipB[:prefix]):
+		mask = masks[1]
+	}
+
+	maskedA, maskedB := make([]byte, len(ipA)), make([]byte, len(ipB))
+	for i := range mask {
+		maskedA[i], maskedB[i] = ipA[i]&mask[i], ipB[i]&mask[i]
+	}
+	if bytes.Compare(maskedA, maskedB) > 0 {
+		maskedA, maskedB = maskedB, maskedA
+	}
+	return crc32.Checksum(append(maskedA, maskedB...), castagnoli)
+}
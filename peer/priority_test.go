@@ -0,0 +1,39 @@
+package peer
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPriority(t *testing.T) {
+	// The test vectors of BEP 40
+	testCases := []struct {
+		a, b     string
+		expected uint32
+	}{
+		{"123.213.32.10:0", "98.76.54.32:0", 0xec2d7224},
+		{"123.213.32.10:0", "123.213.32.234:0", 0x99568189},
+		{"123.213.32.234:0", "123.213.32.10:0", 0x99568189},
+		{"127.0.0.1:1234", "127.0.0.1:5678", 0x9a053363},
+		{"127.0.0.1:5678", "127.0.0.1:1234", 0x9a053363},
+	}
+	for _, tc := range testCases {
+		a, _ := net.ResolveTCPAddr("tcp", tc.a)
+		b, _ := net.ResolveTCPAddr("tcp", tc.b)
+		if got := Priority(a, b); got != tc.expected {
+			t.Errorf("Priority(%s, %s): expected %08x, got %08x", tc.a, tc.b, tc.expected, got)
+		}
+	}
+
+	// IPv6 priorities are symmetric too, and addresses differing only in
+	// masked-out bits rank alike
+	a, _ := net.ResolveTCPAddr("tcp", "[2001:db8:1::1]:6881")
+	b, _ := net.ResolveTCPAddr("tcp", "[2001:db8:2::2]:6881")
+	c, _ := net.ResolveTCPAddr("tcp", "[2001:db8:2::8]:6881")
+	if Priority(a, b) != Priority(b, a) {
+		t.Error("Expected IPv6 priorities to be symmetric")
+	}
+	if Priority(a, b) != Priority(a, c) {
+		t.Error("Expected addresses differing in masked-out bits to rank alike")
+	}
+}
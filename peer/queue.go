@@ -0,0 +1,110 @@
+package peer
+
+import (
+	"context"
+	"sync"
+)
+
+// MaxQueuedRequests is how many block requests a peer may have queued with
+// us by default, advertised as "reqq" in the extension handshake
+const MaxQueuedRequests = 250
+
+// Request names a block a peer asked us for
+type Request struct {
+	Index, Begin, Length uint32
+}
+
+// RequestQueue holds the block requests a peer is waiting on us to serve,
+// in the order they arrived, so a CANCEL can withdraw one before we read it
+// from disk. The zero value is ready to use and safe for concurrent use.
+type RequestQueue struct {
+	// Max caps the requests queued at once, MaxQueuedRequests if 0
+	Max int
+
+	mu      sync.Mutex
+	pending []Request
+	notify  chan struct{} // signalled when a request is pushed
+}
+
+// Push queues a request. It returns false without queueing it if the queue
+// is full; a request that is already queued is accepted but not queued twice.
+func (q *RequestQueue) Push(r Request) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, p := range q.pending {
+		if p == r {
+			return true
+		}
+	}
+	limit := q.Max
+	if limit == 0 {
+		limit = MaxQueuedRequests
+	}
+	if len(q.pending) >= limit {
+		return false
+	}
+	q.pending = append(q.pending, r)
+	select {
+	case q.signal() <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Cancel removes a queued request, reporting whether it was queued
+func (q *RequestQueue) Cancel(r Request) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, p := range q.pending {
+		if p == r {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Pop removes and returns the oldest request, waiting for one to be pushed
+// until ctx is done
+func (q *RequestQueue) Pop(ctx context.Context) (Request, error) {
+	for {
+		q.mu.Lock()
+		if len(q.pending) > 0 {
+			r := q.pending[0]
+			q.pending = q.pending[1:]
+			q.mu.Unlock()
+			return r, nil
+		}
+		notify := q.signal()
+		q.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return Request{}, ctx.Err()
+		}
+	}
+}
+
+// Len returns the number of queued requests
+func (q *RequestQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Clear drops every queued request, e.g. when choking the peer
+func (q *RequestQueue) Clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = nil
+}
+
+// signal returns the notify channel, making it on first use. q.mu must be
+// held.
+func (q *RequestQueue) signal() chan struct{} {
+	if q.notify == nil {
+		q.notify = make(chan struct{}, 1)
+	}
+	return q.notify
+}
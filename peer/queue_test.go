@@ -0,0 +1,63 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRequestQueue(t *testing.T) {
+	q := &RequestQueue{Max: 3}
+	a, b, c := Request{0, 0, 16384}, Request{0, 16384, 16384}, Request{1, 0, 16384}
+	for _, r := range []Request{a, b, a, c} {
+		if !q.Push(r) {
+			t.Fatalf("Expected %v to be queued", r)
+		}
+	}
+	if q.Len() != 3 {
+		t.Errorf("Expected a duplicate to be queued once, got %d requests", q.Len())
+	}
+	if q.Push(Request{2, 0, 16384}) {
+		t.Error("Expected a full queue to refuse a request")
+	}
+
+	// A cancelled request is never popped
+	if !q.Cancel(b) {
+		t.Error("Expected a queued request to be cancelled")
+	}
+	if q.Cancel(b) {
+		t.Error("Expected cancelling it again to report false")
+	}
+	ctx := context.Background()
+	for _, expected := range []Request{a, c} {
+		if got, err := q.Pop(ctx); err != nil || got != expected {
+			t.Errorf("Expected to pop %v, got %v (err: %v)", expected, got, err)
+		}
+	}
+
+	// Pop waits for a push, or for ctx
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Push(b)
+	}()
+	if got, err := q.Pop(ctx); err != nil || got != b {
+		t.Errorf("Expected to pop %v once pushed, got %v (err: %v)", b, got, err)
+	}
+	q.Push(a)
+	q.Clear()
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := q.Pop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Pop on a cleared queue to wait for ctx, got %v", err)
+	}
+
+	// The zero value takes MaxQueuedRequests
+	var zero RequestQueue
+	for i := range MaxQueuedRequests {
+		zero.Push(Request{Index: uint32(i)})
+	}
+	if zero.Push(Request{Index: MaxQueuedRequests}) {
+		t.Errorf("Expected the zero value to hold %d requests", MaxQueuedRequests)
+	}
+}
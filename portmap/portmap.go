@@ -0,0 +1,337 @@
+// Package portmap asks the local gateway to forward a port to us, so that
+// peers behind other NATs can connect. It speaks PCP (RFC 6887) and falls back
+// to its predecessor NAT-PMP (RFC 6886), which many routers still only support,
+// and then to UPnP IGD, which most of the others do.
+package portmap
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol constants
+const (
+	ServerPort = 5351 // UDP port of both NAT-PMP and PCP servers
+
+	natpmpVersion = 0
+	pcpVersion    = 2
+
+	natpmpOpExternalAddr = 0
+	natpmpOpMapUDP       = 1
+	natpmpOpMapTCP       = 2
+	pcpOpMap             = 1
+	responseBit          = 0x80
+
+	resultSuccess        = 0
+	resultUnsupportedVer = 1 // same code in NAT-PMP and PCP
+
+	initialTimeout = 250 * time.Millisecond // doubled after every retry, as both RFCs suggest
+	maxAttempts    = 4
+)
+
+// Method is the protocol used to create a mapping
+type Method string
+
+const (
+	PCP    Method = "pcp"
+	NATPMP Method = "nat-pmp"
+	UPnP   Method = "upnp"
+)
+
+// Mapping is a port forwarded by the gateway
+type Mapping struct {
+	Protocol     string // "tcp" or "udp"
+	InternalPort uint16
+	ExternalPort uint16
+	ExternalIP   net.IP        // nil if the gateway didn't report it
+	Lifetime     time.Duration // renew before this runs out
+	Method       Method
+	nonce        [12]byte // PCP mapping nonce, needed to renew or delete
+}
+
+// Client talks to one gateway
+type Client struct {
+	addr *net.UDPAddr
+	ssdp *net.UDPAddr // where to search for a UPnP gateway; nil skips UPnP
+
+	mu     sync.Mutex
+	method Method // protocol the gateway answered last, tried first next time
+	igd    *igd   // the UPnP gateway found, if any
+}
+
+// NewClient returns a client for the gateway at the given IP
+func NewClient(gateway net.IP) *Client {
+	return &Client{addr: &net.UDPAddr{IP: gateway, Port: ServerPort}, ssdp: ssdpAddr}
+}
+
+// AddMapping asks the gateway to forward an external port to internalPort on
+// this host for the given lifetime. PCP is tried first, then NAT-PMP and then
+// UPnP if the gateway doesn't speak them. The gateway may pick a different
+// external port, except with UPnP.
+func (c *Client) AddMapping(ctx context.Context, protocol string, internalPort uint16, lifetime time.Duration) (*Mapping, error) {
+	return c.request(ctx, &Mapping{Protocol: protocol, InternalPort: internalPort, ExternalPort: internalPort}, lifetime)
+}
+
+// Renew extends a mapping returned by AddMapping, keeping its external port
+// if the gateway allows it
+func (c *Client) Renew(ctx context.Context, m *Mapping, lifetime time.Duration) (*Mapping, error) {
+	return c.request(ctx, m, lifetime)
+}
+
+// DeleteMapping removes a mapping by requesting a lifetime of zero
+func (c *Client) DeleteMapping(ctx context.Context, m *Mapping) error {
+	_, err := c.request(ctx, m, 0)
+	return err
+}
+
+// request creates, renews or deletes a mapping with whichever protocol the
+// gateway supports
+func (c *Client) request(ctx context.Context, m *Mapping, lifetime time.Duration) (*Mapping, error) {
+	if m.Protocol != "tcp" && m.Protocol != "udp" {
+		return nil, fmt.Errorf("unsupported protocol: %s", m.Protocol)
+	}
+
+	c.mu.Lock()
+	method := c.method
+	c.mu.Unlock()
+
+	methods := []Method{PCP, NATPMP}
+	if c.ssdp != nil {
+		methods = append(methods, UPnP)
+	}
+	for i := range methods {
+		if methods[i] == method {
+			methods[0], methods[i] = methods[i], methods[0]
+		}
+	}
+
+	var lastErr error
+	for _, method := range methods {
+		var result *Mapping
+		var err error
+		switch method {
+		case PCP:
+			result, err = c.mapPCP(ctx, m, lifetime)
+		case NATPMP:
+			result, err = c.mapNATPMP(ctx, m, lifetime)
+		default:
+			result, err = c.mapUPnP(ctx, m, lifetime)
+		}
+		if err == nil {
+			c.mu.Lock()
+			c.method = method
+			c.mu.Unlock()
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// mapNATPMP requests a mapping with NAT-PMP
+// Request: <version=0><opcode><reserved:2><internal port:2><external port:2><lifetime:4>
+func (c *Client) mapNATPMP(ctx context.Context, m *Mapping, lifetime time.Duration) (*Mapping, error) {
+	conn, err := net.DialUDP("udp4", nil, c.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	opcode := byte(natpmpOpMapTCP)
+	if m.Protocol == "udp" {
+		opcode = natpmpOpMapUDP
+	}
+
+	req := make([]byte, 12)
+	req[0] = natpmpVersion
+	req[1] = opcode
+	binary.BigEndian.PutUint16(req[4:6], m.InternalPort)
+	binary.BigEndian.PutUint16(req[6:8], m.ExternalPort)
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+
+	// Response: <version><opcode+128><result:2><epoch:4><internal port:2><external port:2><lifetime:4>
+	resp, err := exchange(ctx, conn, req, func(resp []byte) bool {
+		return len(resp) >= 4 && resp[1] == opcode|responseBit
+	})
+	if err != nil {
+		return nil, err
+	}
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != resultSuccess {
+		return nil, fmt.Errorf("nat-pmp: gateway returned result code %d", code)
+	}
+	if len(resp) < 16 {
+		return nil, errors.New("nat-pmp: short mapping response")
+	}
+
+	result := &Mapping{
+		Protocol:     m.Protocol,
+		InternalPort: binary.BigEndian.Uint16(resp[8:10]),
+		ExternalPort: binary.BigEndian.Uint16(resp[10:12]),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second,
+		Method:       NATPMP,
+	}
+
+	// The external address needs a separate request, it's only informational
+	if lifetime > 0 {
+		result.ExternalIP, _ = c.externalAddressNATPMP(ctx, conn)
+	}
+	return result, nil
+}
+
+// externalAddressNATPMP asks a NAT-PMP gateway for its public IPv4 address
+func (c *Client) externalAddressNATPMP(ctx context.Context, conn *net.UDPConn) (net.IP, error) {
+	// Response: <version><128><result:2><epoch:4><external IP:4>
+	resp, err := exchange(ctx, conn, []byte{natpmpVersion, natpmpOpExternalAddr}, func(resp []byte) bool {
+		return len(resp) >= 12 && resp[1] == natpmpOpExternalAddr|responseBit
+	})
+	if err != nil {
+		return nil, err
+	}
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != resultSuccess {
+		return nil, fmt.Errorf("nat-pmp: gateway returned result code %d", code)
+	}
+	return net.IP(resp[8:12]), nil
+}
+
+// mapPCP requests a mapping with a PCP MAP request
+// Header:  <version=2><opcode><reserved:2><lifetime:4><client IP:16>
+// Payload: <nonce:12><protocol><reserved:3><internal port:2><external port:2><external IP:16>
+func (c *Client) mapPCP(ctx context.Context, m *Mapping, lifetime time.Duration) (*Mapping, error) {
+	conn, err := net.DialUDP("udp", nil, c.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	nonce := m.nonce
+	if nonce == [12]byte{} {
+		rand.Read(nonce[:])
+	}
+	protocol := byte(6)
+	if m.Protocol == "udp" {
+		protocol = 17
+	}
+
+	req := make([]byte, 60)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:8], uint32(lifetime/time.Second))
+	copy(req[8:24], conn.LocalAddr().(*net.UDPAddr).IP.To16())
+	copy(req[24:36], nonce[:])
+	req[36] = protocol
+	binary.BigEndian.PutUint16(req[40:42], m.InternalPort)
+	binary.BigEndian.PutUint16(req[42:44], m.ExternalPort)
+	if m.ExternalIP != nil {
+		copy(req[44:60], m.ExternalIP.To16())
+	} else if c.addr.IP.To4() != nil {
+		copy(req[44:60], net.IPv4zero.To16())
+	}
+
+	// Response header: <version><opcode+128><reserved><result><lifetime:4><epoch:4><reserved:12>
+	// A NAT-PMP-only gateway answers with version 0 and "unsupported version"
+	resp, err := exchange(ctx, conn, req, func(resp []byte) bool {
+		return len(resp) >= 4 && (resp[0] == natpmpVersion || resp[1] == pcpOpMap|responseBit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] != pcpVersion {
+		return nil, errors.New("pcp: gateway only supports nat-pmp")
+	}
+	if resp[3] != resultSuccess {
+		return nil, fmt.Errorf("pcp: gateway returned result code %d", resp[3])
+	}
+	if len(resp) < 60 {
+		return nil, errors.New("pcp: short mapping response")
+	}
+	if string(resp[24:36]) != string(nonce[:]) {
+		return nil, errors.New("pcp: response nonce mismatch")
+	}
+
+	return &Mapping{
+		Protocol:     m.Protocol,
+		InternalPort: binary.BigEndian.Uint16(resp[40:42]),
+		ExternalPort: binary.BigEndian.Uint16(resp[42:44]),
+		ExternalIP:   net.IP(resp[44:60]).To16(),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second,
+		Method:       PCP,
+		nonce:        nonce,
+	}, nil
+}
+
+// exchange sends req until a datagram accepted by match arrives, doubling the
+// timeout after every attempt
+func exchange(ctx context.Context, conn *net.UDPConn, req []byte, match func([]byte) bool) ([]byte, error) {
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	buf := make([]byte, 1100) // PCP messages are at most 1100 bytes
+	timeout := initialTimeout
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(timeout)
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buf)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				// ICMP port unreachable: nothing listens on the gateway
+				return nil, err
+			}
+			if match(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+		timeout *= 2
+	}
+	return nil, errors.New("gateway did not respond")
+}
+
+// DefaultGateway returns the IPv4 default gateway from the kernel routing
+// table. It is only implemented on Linux.
+func DefaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing table: %v", err)
+	}
+	defer f.Close()
+
+	// Format: Iface Destination Gateway Flags ... with addresses as
+	// little-endian hex, e.g. "eth0 00000000 0101A8C0 0003 ..."
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // skip the header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		return net.IPv4(raw[3], raw[2], raw[1], raw[0]), nil
+	}
+	return nil, errors.New("no default gateway found")
+}
@@ -0,0 +1,240 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGateway answers NAT-PMP requests and, if pcp is set, PCP MAP requests.
+// Every mapping is given the internal port plus 1000.
+func fakeGateway(t *testing.T, pcp bool) *Client {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1100)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := buf[:n]
+
+			var resp []byte
+			switch {
+			case req[0] == pcpVersion && pcp:
+				resp = make([]byte, 60)
+				resp[0] = pcpVersion
+				resp[1] = req[1] | responseBit
+				copy(resp[4:8], req[4:8])
+				copy(resp[24:40], req[24:40])
+				internal := binary.BigEndian.Uint16(req[40:42])
+				binary.BigEndian.PutUint16(resp[40:42], internal)
+				binary.BigEndian.PutUint16(resp[42:44], internal+1000)
+				copy(resp[44:60], net.IPv4(203, 0, 113, 7).To16())
+
+			case req[0] != natpmpVersion:
+				resp = make([]byte, 8)
+				resp[1] = req[1] | responseBit
+				binary.BigEndian.PutUint16(resp[2:4], resultUnsupportedVer)
+
+			case req[1] == natpmpOpExternalAddr:
+				resp = make([]byte, 12)
+				resp[1] = responseBit
+				copy(resp[8:12], net.IPv4(203, 0, 113, 7).To4())
+
+			default:
+				resp = make([]byte, 16)
+				resp[1] = req[1] | responseBit
+				internal := binary.BigEndian.Uint16(req[4:6])
+				binary.BigEndian.PutUint16(resp[8:10], internal)
+				binary.BigEndian.PutUint16(resp[10:12], internal+1000)
+				copy(resp[12:16], req[8:12])
+			}
+			conn.WriteToUDP(resp, addr)
+		}
+	}()
+
+	return &Client{addr: conn.LocalAddr().(*net.UDPAddr)}
+}
+
+func TestAddMapping(t *testing.T) {
+	testCases := []struct {
+		name   string
+		pcp    bool
+		method Method
+	}{
+		{"PCP", true, PCP},
+		{"NAT-PMP fallback", false, NATPMP},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fakeGateway(t, tc.pcp)
+			ctx := context.Background()
+
+			m, err := client.AddMapping(ctx, "tcp", 6881, time.Hour)
+			if err != nil {
+				t.Fatalf("AddMapping failed: %v", err)
+			}
+			if m.Method != tc.method {
+				t.Errorf("Expected method %s, got %s", tc.method, m.Method)
+			}
+			if m.InternalPort != 6881 || m.ExternalPort != 7881 {
+				t.Errorf("Expected 6881 -> 7881, got %d -> %d", m.InternalPort, m.ExternalPort)
+			}
+			if m.Lifetime != time.Hour {
+				t.Errorf("Expected lifetime 1h, got %v", m.Lifetime)
+			}
+			if !m.ExternalIP.Equal(net.IPv4(203, 0, 113, 7)) {
+				t.Errorf("Expected external IP 203.0.113.7, got %v", m.ExternalIP)
+			}
+
+			if err := client.DeleteMapping(ctx, m); err != nil {
+				t.Errorf("DeleteMapping failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestAddMappingNoGateway(t *testing.T) {
+	// Reserve a port and close it so nothing answers there
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %v", err)
+	}
+	client := &Client{addr: conn.LocalAddr().(*net.UDPAddr)}
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := client.AddMapping(ctx, "tcp", 6881, time.Hour); err == nil {
+		t.Error("Expected error when no gateway answers")
+	}
+	if _, err := client.AddMapping(ctx, "sctp", 6881, time.Hour); err == nil {
+		t.Error("Expected error for unsupported protocol")
+	}
+}
+
+// fakeIGD answers SSDP searches and serves a UPnP gateway whose WAN
+// connection service sits in an embedded device. If permanentOnly is set it
+// refuses mappings with a lease like some routers. It returns the SSDP
+// address and the SOAP actions received, with their arguments.
+func fakeIGD(t *testing.T, permanentOnly bool) (*net.UDPAddr, func() []string) {
+	var mu sync.Mutex
+	var actions []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/desc.xml" {
+			fmt.Fprint(w, `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL></service></serviceList>
+</device></deviceList></device></deviceList></device></root>`)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		action := r.Header.Get("SOAPAction")
+		mu.Lock()
+		actions = append(actions, action+" "+string(body))
+		mu.Unlock()
+		switch {
+		case strings.Contains(action, "#AddPortMapping") && permanentOnly && !strings.Contains(string(body), "<NewLeaseDuration>0<"):
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail>
+<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>725</errorCode><errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError>
+</detail></s:Fault></s:Body></s:Envelope>`)
+		case strings.Contains(action, "#GetExternalIPAddress"):
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewExternalIPAddress>203.0.113.9</NewExternalIPAddress></u:GetExternalIPAddressResponse>
+</s:Body></s:Envelope>`)
+		default:
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body></s:Body></s:Envelope>`)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !strings.Contains(string(buf[:n]), "InternetGatewayDevice") {
+				continue
+			}
+			conn.WriteToUDP([]byte("HTTP/1.1 200 OK\r\nLOCATION: "+srv.URL+"/desc.xml\r\nST: "+ssdpSearchTarget+"\r\n\r\n"), addr)
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), actions...)
+	}
+}
+
+func TestAddMappingUPnP(t *testing.T) {
+	for _, permanentOnly := range []bool{false, true} {
+		t.Run(fmt.Sprintf("permanent only %v", permanentOnly), func(t *testing.T) {
+			// Nothing answers NAT-PMP or PCP
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatalf("ListenUDP failed: %v", err)
+			}
+			addr := conn.LocalAddr().(*net.UDPAddr)
+			conn.Close()
+			ssdp, actions := fakeIGD(t, permanentOnly)
+			client := &Client{addr: addr, ssdp: ssdp}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			m, err := client.AddMapping(ctx, "tcp", 6881, time.Hour)
+			if err != nil {
+				t.Fatalf("AddMapping failed: %v", err)
+			}
+			if m.Method != UPnP || m.ExternalPort != 6881 || m.Lifetime != time.Hour {
+				t.Errorf("Expected a UPnP mapping of port 6881 for 1h, got %s %d for %v", m.Method, m.ExternalPort, m.Lifetime)
+			}
+			if !m.ExternalIP.Equal(net.IPv4(203, 0, 113, 9)) {
+				t.Errorf("Expected external IP 203.0.113.9, got %v", m.ExternalIP)
+			}
+			if err := client.DeleteMapping(ctx, m); err != nil {
+				t.Errorf("DeleteMapping failed: %v", err)
+			}
+
+			got := actions()
+			lease := "<NewLeaseDuration>3600<"
+			if permanentOnly {
+				lease = "<NewLeaseDuration>0<"
+			}
+			add := got[len(got)-3]
+			if !strings.Contains(add, "#AddPortMapping") || !strings.Contains(add, lease) ||
+				!strings.Contains(add, "<NewProtocol>TCP<") || !strings.Contains(add, "<NewInternalClient>127.0.0.1<") {
+				t.Errorf("Expected AddPortMapping of TCP port 6881 to 127.0.0.1 with %s, got %s", lease, add)
+			}
+			if !strings.Contains(got[len(got)-1], "#DeletePortMapping") {
+				t.Errorf("Expected DeletePortMapping last, got %s", got[len(got)-1])
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UPnP IGD constants
+const (
+	ssdpSearchTarget = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	upnpDescription  = "bittorrent-client"
+	upnpTimeout      = 5 * time.Second // bounds every HTTP request to the gateway
+	maxDescription   = 1 << 20         // device descriptions and SOAP replies are far smaller
+
+	upnpErrOnlyPermanent = 725 // OnlyPermanentLeasesSupported
+)
+
+// ssdpAddr is where gateways listen for SSDP searches
+var ssdpAddr = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+// upnpHTTP is the client used for device descriptions and SOAP actions
+var upnpHTTP = &http.Client{Timeout: upnpTimeout}
+
+// igd is the WAN connection service of a UPnP Internet Gateway Device
+type igd struct {
+	controlURL  string
+	serviceType string // urn:schemas-upnp-org:service:WANIPConnection:1 or the like
+	localIP     net.IP // our address on the gateway's network
+}
+
+// upnpError is the error a gateway answers a SOAP action with
+type upnpError struct {
+	code        int
+	description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.code, e.description)
+}
+
+// mapUPnP requests, renews or, with a lifetime of zero, deletes a mapping
+// through a UPnP gateway. Gateways that only grant permanent mappings get one;
+// renewing it just adds it again.
+func (c *Client) mapUPnP(ctx context.Context, m *Mapping, lifetime time.Duration) (*Mapping, error) {
+	gateway, err := c.discoverIGD(ctx)
+	if err != nil {
+		return nil, err
+	}
+	protocol := strings.ToUpper(m.Protocol)
+	external := strconv.Itoa(int(m.ExternalPort))
+
+	if lifetime == 0 {
+		_, err := gateway.call(ctx, "DeletePortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", external},
+			{"NewProtocol", protocol},
+		})
+		return nil, err
+	}
+
+	add := func(lease time.Duration) error {
+		_, err := gateway.call(ctx, "AddPortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", external},
+			{"NewProtocol", protocol},
+			{"NewInternalPort", strconv.Itoa(int(m.InternalPort))},
+			{"NewInternalClient", gateway.localIP.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", upnpDescription},
+			{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+		})
+		return err
+	}
+	err = add(lifetime)
+	var upnpErr *upnpError
+	if errors.As(err, &upnpErr) && upnpErr.code == upnpErrOnlyPermanent {
+		err = add(0)
+	}
+	if err != nil {
+		if !errors.As(err, &upnpErr) {
+			// The gateway may have gone or moved: search again next time
+			c.mu.Lock()
+			c.igd = nil
+			c.mu.Unlock()
+		}
+		return nil, err
+	}
+
+	result := &Mapping{
+		Protocol:     m.Protocol,
+		InternalPort: m.InternalPort,
+		ExternalPort: m.ExternalPort,
+		Lifetime:     lifetime,
+		Method:       UPnP,
+	}
+	if reply, err := gateway.call(ctx, "GetExternalIPAddress", nil); err == nil {
+		result.ExternalIP = net.ParseIP(reply["NewExternalIPAddress"])
+	}
+	return result, nil
+}
+
+// discoverIGD returns the gateway's WAN connection service, searching for it
+// with SSDP the first time
+func (c *Client) discoverIGD(ctx context.Context) (*igd, error) {
+	c.mu.Lock()
+	gateway := c.igd
+	c.mu.Unlock()
+	if gateway != nil {
+		return gateway, nil
+	}
+
+	location, err := c.searchIGD(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gateway, err = describeIGD(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.igd = gateway
+	c.mu.Unlock()
+	return gateway, nil
+}
+
+// searchIGD multicasts an SSDP search for Internet Gateway Devices and
+// returns the description URL of the first to answer, repeating the search
+// with a doubling timeout like exchange
+func (c *Client) searchIGD(ctx context.Context) (string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	req := []byte("M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr.String() + "\r\n" +
+		"ST: " + ssdpSearchTarget + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n")
+	buf := make([]byte, 2048)
+	timeout := initialTimeout
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if _, err := conn.WriteToUDP(req, c.ssdp); err != nil {
+			return "", err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return "", err
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				continue
+			}
+			if location := resp.Header.Get("Location"); location != "" {
+				return location, nil
+			}
+		}
+		timeout *= 2
+	}
+	return "", errors.New("no UPnP gateway found")
+}
+
+// upnpDevice is a device in a UPnP device description, with its services and
+// embedded devices
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// findService returns the control URL and type of the first WAN connection
+// service in the device tree
+func (d *upnpDevice) findService() (controlURL, serviceType string) {
+	for _, s := range d.Services {
+		if strings.Contains(s.ServiceType, ":WANIPConnection:") || strings.Contains(s.ServiceType, ":WANPPPConnection:") {
+			return s.ControlURL, s.ServiceType
+		}
+	}
+	for i := range d.Devices {
+		if controlURL, serviceType = d.Devices[i].findService(); controlURL != "" {
+			return controlURL, serviceType
+		}
+	}
+	return "", ""
+}
+
+// describeIGD fetches a gateway's device description and finds its WAN
+// connection service
+func describeIGD(ctx context.Context, location string) (*igd, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := upnpHTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch gateway description: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch gateway description: %s", resp.Status)
+	}
+
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxDescription)).Decode(&root); err != nil {
+		return nil, fmt.Errorf("invalid gateway description: %v", err)
+	}
+	controlURL, serviceType := root.Device.findService()
+	if controlURL == "" {
+		return nil, errors.New("gateway has no WAN connection service")
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return nil, fmt.Errorf("invalid gateway URL base: %v", err)
+		}
+	}
+	control, err := base.Parse(controlURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gateway control URL: %v", err)
+	}
+
+	// The address we reach the gateway from is the one it should forward to.
+	// Dialing UDP sends nothing, so any port will do.
+	conn, err := net.Dial("udp4", net.JoinHostPort(control.Hostname(), "80"))
+	if err != nil {
+		return nil, err
+	}
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	return &igd{controlURL: control.String(), serviceType: serviceType, localIP: localIP}, nil
+}
+
+// call invokes a SOAP action on the gateway's WAN connection service with
+// args in order, and returns the text of the reply's elements by name
+func (g *igd) call(ctx context.Context, action string, args [][2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + g.serviceType + `">`)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		xml.EscapeText(&body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+g.serviceType+"#"+action+`"`)
+	resp, err := upnpHTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %v", action, err)
+	}
+	defer resp.Body.Close()
+
+	reply, err := parseSOAP(io.LimitReader(resp.Body, maxDescription))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s reply: %v", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		code, err := strconv.Atoi(reply["errorCode"])
+		if err != nil {
+			return nil, fmt.Errorf("%s failed: %s", action, resp.Status)
+		}
+		return nil, &upnpError{code: code, description: reply["errorDescription"]}
+	}
+	return reply, nil
+}
+
+// parseSOAP returns the text of every element of a SOAP envelope that holds
+// only text, by local name. UPnP replies never repeat a name.
+func parseSOAP(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	decoder := xml.NewDecoder(r)
+	var name string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			name = token.Name.Local
+			values[name] = ""
+		case xml.CharData:
+			if name != "" {
+				values[name] += strings.TrimSpace(string(token))
+			}
+		case xml.EndElement:
+			name = ""
+		}
+	}
+}
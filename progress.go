@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/api"
+	"github.com/omkarkirpan/bittorrent-client/download"
+	"github.com/omkarkirpan/bittorrent-client/session"
+)
+
+// Progress display tuning
+const (
+	refreshInterval = 500 * time.Millisecond // Redraw rate on a terminal
+	logInterval     = 30 * time.Second       // Status line rate when not on a terminal
+	jsonInterval    = time.Second            // Status object rate in JSON mode
+	barWidth        = 20
+)
+
+// progressDisplay shows a status line per torrent. On a terminal the lines
+// are redrawn in place; otherwise they're printed every logInterval. In JSON
+// mode it prints an api.TorrentStatus object per torrent and line instead.
+// When quiet it only waits. With peers set each torrent's connected peers are
+// listed under its line, and with files set the files of multi-file
+// torrents.
+type progressDisplay struct {
+	out      io.Writer
+	tty      bool
+	json     bool
+	quiet    bool
+	peers    bool
+	files    bool
+	torrents []*session.Torrent
+	lines    int // lines drawn last time, to move back over
+}
+
+func newProgressDisplay(out *os.File, torrents []*session.Torrent) *progressDisplay {
+	return &progressDisplay{
+		out:      out,
+		tty:      isTerminal(out),
+		torrents: torrents,
+	}
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// run redraws the display until every torrent is done or ctx is cancelled
+func (p *progressDisplay) run(ctx context.Context) {
+	interval := refreshInterval
+	if p.json {
+		interval = jsonInterval
+	} else if !p.tty {
+		interval = logInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Wake up as soon as a torrent finishes too, since the log interval is
+	// long enough to keep scripts waiting
+	for !p.allDone() {
+		select {
+		case <-ticker.C:
+		case <-p.nextDone():
+		case <-ctx.Done():
+			return
+		}
+		p.draw()
+	}
+	if p.tty || p.json {
+		p.draw()
+	}
+}
+
+// nextDone returns the Done channel of a torrent that hasn't finished yet, or
+// nil if all have
+func (p *progressDisplay) nextDone() <-chan struct{} {
+	for _, t := range p.torrents {
+		select {
+		case <-t.Done():
+		default:
+			return t.Done()
+		}
+	}
+	return nil
+}
+
+// allDone reports whether every torrent has completed or failed
+func (p *progressDisplay) allDone() bool {
+	for _, t := range p.torrents {
+		select {
+		case <-t.Done():
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// torrentDetails is the JSON status of a torrent with its peers or files
+// listed
+type torrentDetails struct {
+	api.TorrentStatus
+	PeerList *[]api.PeerStatus `json:"peer_list,omitempty"` // nil unless peers are shown
+	FileList []api.FileStatus  `json:"file_list,omitempty"`
+}
+
+// draw prints a line per torrent, followed by its peers and files if enabled
+func (p *progressDisplay) draw() {
+	if p.quiet {
+		return
+	}
+	var b strings.Builder
+	tty := p.tty && !p.json
+	if tty && p.lines > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", p.lines)
+	}
+
+	lines := 0
+	for _, t := range p.torrents {
+		if p.json {
+			status := torrentDetails{TorrentStatus: api.NewTorrentStatus(t)}
+			if p.peers {
+				peers := []api.PeerStatus{}
+				for _, peer := range t.Peers() {
+					peers = append(peers, api.NewPeerStatus(peer))
+				}
+				status.PeerList = &peers
+			}
+			if p.files {
+				for _, f := range t.Files() {
+					status.FileList = append(status.FileList, api.NewFileStatus(f))
+				}
+			}
+			line, _ := json.Marshal(status)
+			b.Write(line)
+			b.WriteByte('\n')
+			continue
+		}
+
+		rows := []string{statusLine(t)}
+		if p.peers {
+			for _, peer := range t.Peers() {
+				rows = append(rows, peerLine(peer))
+			}
+		}
+		if files := t.Files(); p.files && len(files) > 1 {
+			for _, f := range files {
+				if !f.Padding {
+					rows = append(rows, fileLine(f))
+				}
+			}
+		}
+		for _, row := range rows {
+			if tty {
+				b.WriteString("\x1b[2K")
+			}
+			b.WriteString(row)
+			b.WriteByte('\n')
+		}
+		lines += len(rows)
+	}
+	if tty {
+		// Clear what's left of a longer previous drawing, e.g. departed peers
+		b.WriteString("\x1b[J")
+	}
+	p.lines = lines
+
+	io.WriteString(p.out, b.String())
+}
+
+// peerLine formats one connected peer: address, client, flags (I incoming,
+// C choking us, i interested in our pieces, S seed), how much of the torrent
+// it has, the transfer rates and the request latency once measured
+func peerLine(p download.PeerInfo) string {
+	client := p.Client
+	if client == "" {
+		client = "unknown"
+	}
+	var flags strings.Builder
+	for _, f := range []struct {
+		set  bool
+		flag byte
+	}{{p.Incoming, 'I'}, {p.Choked, 'C'}, {p.Interested, 'i'}, {p.Seed, 'S'}} {
+		if f.set {
+			flags.WriteByte(f.flag)
+		}
+	}
+	line := fmt.Sprintf("    %-40s %-22s %-4s %5.1f%%  down %s/s  up %s/s",
+		p.Addr, client, flags.String(), p.Progress*100, humanReadableSize(int64(p.DownloadRate)), humanReadableSize(int64(p.UploadRate)))
+	if p.Latency > 0 {
+		line += fmt.Sprintf("  latency %v", p.Latency.Round(time.Millisecond))
+	}
+	return line
+}
+
+// fileLine formats the progress of one file of a multi-file torrent
+func fileLine(f session.FileProgress) string {
+	percent := 100.0
+	if f.Length > 0 {
+		percent = float64(f.Done) * 100 / float64(f.Length)
+	}
+	filled := int(percent / 100 * barWidth)
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", barWidth-filled)
+	return fmt.Sprintf("    [%s] %5.1f%%  %s (%s)", bar, percent, f.Path, humanReadableSize(f.Length))
+}
+
+// metadataLine formats the progress of a magnet link still waiting for its
+// metadata: the peers found so far and how the trackers answered
+func metadataLine(t *session.Torrent, name string) string {
+	known := 0
+	for _, n := range t.PeerCounts() {
+		known += n
+	}
+	trackers, ok := 0, 0
+	for _, tr := range t.Trackers() {
+		trackers++
+		if !tr.LastAnnounce.IsZero() && tr.Err == nil {
+			ok++
+		}
+	}
+
+	elapsed := time.Since(t.Added()).Round(time.Second)
+	line := fmt.Sprintf("%s: fetching metadata  peers found %d", name, known)
+	if trackers > 0 {
+		line += fmt.Sprintf("  trackers ok %d/%d", ok, trackers)
+	}
+	return line + fmt.Sprintf("  waiting %s", elapsed)
+}
+
+// statusLine formats one torrent's progress
+func statusLine(t *session.Torrent) string {
+	stats := t.Stats()
+	name := t.Name()
+	if name == "" {
+		name = fmt.Sprintf("%x", t.InfoHash())
+	}
+	if stats.Pieces == 0 {
+		if t.State() != session.StateFetchingMetadata {
+			return fmt.Sprintf("%s: %s", name, t.State())
+		}
+		return metadataLine(t, name)
+	}
+
+	filled := int(stats.Percent() / 100 * barWidth)
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", barWidth-filled)
+
+	eta := "-"
+	switch d, ok := stats.ETA(); {
+	case t.State() == session.StateComplete:
+		eta = "done"
+	case t.State() == session.StateSeeding:
+		eta = fmt.Sprintf("seeding, ratio %.2f", stats.Ratio())
+	case t.State() == session.StateQueued:
+		eta = "queued"
+	case ok:
+		eta = d.String()
+	}
+
+	line := fmt.Sprintf("%s [%s] %5.1f%%  down %s/s  up %s/s  peers %d (%d seeds)  ETA %s  pieces %d/%d verified",
+		name, bar, stats.Percent(), humanReadableSize(int64(stats.DownloadRate)), humanReadableSize(int64(stats.UploadRate)),
+		stats.Peers, stats.Seeds, eta, stats.PiecesDone, stats.Pieces)
+	if stats.HashFailures > 0 {
+		line += fmt.Sprintf(", %d failed (%s wasted)", stats.HashFailures, humanReadableSize(stats.Wasted))
+	}
+	// Whether the swarm can still finish the download
+	if t.State() == session.StateDownloading && stats.Peers > 0 {
+		line += fmt.Sprintf("  copies %.2f", stats.Copies)
+		if stats.Unavailable > 0 {
+			line += fmt.Sprintf(", %d pieces unavailable", stats.Unavailable)
+		}
+	}
+	return line
+}
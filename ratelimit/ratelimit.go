@@ -0,0 +1,122 @@
+// Package ratelimit implements token bucket limiters for transfer rates.
+// Limits can be changed while transfers are waiting on them, and a nil
+// *Limiter never limits.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/clock"
+)
+
+// Limiter allows up to a number of bytes per second, with bursts of up to
+// one second's worth
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64 // bytes per second; 0 means unlimited
+	tokens  float64
+	last    time.Time
+	changed chan struct{} // closed when the rate changes, to wake waiters
+	clock   clock.Clock
+	parent  *Limiter // also waited on, or nil
+}
+
+// Option changes how a Limiter is set up
+type Option func(*Limiter)
+
+// WithClock refills the bucket by the time of c, e.g. a fake clock in tests
+func WithClock(c clock.Clock) Option {
+	return func(l *Limiter) {
+		l.clock = clock.Or(c)
+	}
+}
+
+// WithParent makes transfers wait on parent too, so the limiter can cap a
+// share of what parent allows, e.g. one torrent of the session
+func WithParent(parent *Limiter) Option {
+	return func(l *Limiter) {
+		l.parent = parent
+	}
+}
+
+// New returns a limiter allowing rate bytes per second, or any rate if it's
+// 0. It starts with a full burst.
+func New(rate int64, opts ...Option) *Limiter {
+	l := &Limiter{changed: make(chan struct{}), clock: clock.Real}
+	for _, opt := range opts {
+		opt(l)
+	}
+	l.SetLimit(rate)
+	l.tokens = l.rate
+	return l
+}
+
+// Limit returns the allowed bytes per second, 0 meaning unlimited
+func (l *Limiter) Limit() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+// SetLimit changes the allowed bytes per second, 0 meaning unlimited.
+// Waiting transfers pick up the new rate immediately.
+func (l *Limiter) SetLimit(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(max(rate, 0))
+	l.tokens = min(l.tokens, l.rate)
+	l.last = l.clock.Now()
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Wait blocks until n bytes may be transferred, by the limiter and its
+// parent, or ctx is done
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	if err := l.wait(ctx, n); err != nil {
+		return err
+	}
+	return l.parent.Wait(ctx, n)
+}
+
+// wait blocks until the limiter's own bucket allows n bytes
+func (l *Limiter) wait(ctx context.Context, n int) error {
+	for {
+		l.mu.Lock()
+		if l.rate == 0 {
+			l.mu.Unlock()
+			return nil
+		}
+
+		// Refill, allowing a burst of one second or a single transfer of n
+		now := l.clock.Now()
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, max(l.rate, float64(n)))
+		l.last = now
+		if l.tokens >= float64(n) {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((float64(n) - l.tokens) / l.rate * float64(time.Second))
+		changed := l.changed
+		l.mu.Unlock()
+
+		timer := l.clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-changed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/clock"
+)
+
+func TestWait(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	l := New(100000, WithClock(fake))
+	ctx := context.Background()
+
+	// The first second's worth is a burst
+	for i := 0; i < 10; i++ {
+		if err := l.Wait(ctx, 10000); err != nil {
+			t.Fatalf("Wait failed: %v", err)
+		}
+	}
+
+	// The next 50000 bytes take 0.5s
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 5; i++ {
+			if err := l.Wait(ctx, 10000); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	start := fake.Now()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Wait failed: %v", err)
+			}
+			if elapsed := fake.Since(start); elapsed != 500*time.Millisecond {
+				t.Errorf("Expected 0.5s for 50000 bytes at 100000/s, took %v", elapsed)
+			}
+			return
+		default:
+		}
+		if fake.Waiters() > 0 {
+			fake.Advance(10 * time.Millisecond)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSetLimit(t *testing.T) {
+	l := New(10)
+	if l.Limit() != 10 {
+		t.Errorf("Expected limit 10, got %d", l.Limit())
+	}
+
+	// Lifting the limit wakes a transfer that would wait for minutes
+	l.Wait(context.Background(), 10)
+	done := make(chan error)
+	go func() { done <- l.Wait(context.Background(), 1000) }()
+	time.Sleep(20 * time.Millisecond)
+	l.SetLimit(0)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Wait failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Wait to return once the limit was lifted")
+	}
+}
+
+func TestWaitCancel(t *testing.T) {
+	l := New(1)
+	l.Wait(context.Background(), 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, 1000); err == nil {
+		t.Error("Expected error when the context is done")
+	}
+
+	var unlimited *Limiter
+	if err := unlimited.Wait(context.Background(), 1<<30); err != nil || unlimited.Limit() != 0 {
+		t.Error("Expected a nil limiter not to limit")
+	}
+}
+
+func TestParent(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	parent := New(1000, WithClock(fake))
+	unlimited := New(0, WithParent(parent), WithClock(fake))
+	ctx := context.Background()
+
+	// An unlimited child still takes from its parent's bucket
+	if err := unlimited.Wait(ctx, 1000); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- unlimited.Wait(ctx, 500) }()
+	for fake.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("Expected Wait to block on the parent's empty bucket")
+	default:
+	}
+	fake.Advance(500 * time.Millisecond)
+	if err := <-done; err != nil {
+		t.Errorf("Wait failed: %v", err)
+	}
+
+	// A child's lower limit caps it below its parent's
+	child := New(10, WithParent(New(0)), WithClock(fake))
+	child.Wait(ctx, 10)
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := child.Wait(ctx, 10); err == nil {
+		t.Error("Expected the child's own limit to apply")
+	}
+}
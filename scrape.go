@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/magnet"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// scrapeTimeout bounds each tracker's scrape
+const scrapeTimeout = 15 * time.Second
+
+// scrapeRow is one tracker's answer, in the JSON output too
+type scrapeRow struct {
+	Tracker   string `json:"tracker"`
+	Seeders   int    `json:"seeders"`
+	Leechers  int    `json:"leechers"`
+	Completed int    `json:"completed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// runScrape implements the scrape command and returns the exit code
+func runScrape(args []string) int {
+	fs := flag.NewFlagSet("scrape", flag.ContinueOnError)
+	jsonOutput := fs.Bool("json", false, "print the results as JSON")
+	var opts netOptions
+	opts.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s scrape [--json] [--bind addr] [--proxy host:port] <torrent>\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Asks every tracker of a torrent file, URL or magnet link for its seeders,")
+		fmt.Fprintln(fs.Output(), "leechers and completed downloads. Exits with status 3 if no tracker answered.\n\nFlags:")
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	route, err := opts.route()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	infoHash, trackers, err := loadTrackers(route, positional[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	if len(trackers) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: the torrent has no trackers")
+		return exitUsage
+	}
+
+	rows := scrapeAll(route, infoHash, trackers)
+	if *jsonOutput {
+		if err := printJSON(rows); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitFailure
+		}
+	} else {
+		printScrapeTable(os.Stdout, rows)
+	}
+
+	for _, row := range rows {
+		if row.Error == "" {
+			return exitOK
+		}
+	}
+	return exitTracker
+}
+
+// scrapeAll asks every tracker at once and returns their answers in the
+// torrent's order
+func scrapeAll(route *netRoute, infoHash [20]byte, trackers []string) []scrapeRow {
+	rows := make([]scrapeRow, len(trackers))
+	done := make(chan struct{})
+	for i, announce := range trackers {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+			defer cancel()
+
+			rows[i].Tracker = announce
+			result, err := route.scrape(ctx, announce, infoHash)
+			if err != nil {
+				rows[i].Error = err.Error()
+				return
+			}
+			rows[i].Seeders, rows[i].Leechers, rows[i].Completed = result.Seeders, result.Leechers, result.Completed
+		}()
+	}
+	for range trackers {
+		<-done
+	}
+	return rows
+}
+
+// printScrapeTable prints scrape answers as a table
+func printScrapeTable(out io.Writer, rows []scrapeRow) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TRACKER\tSEEDERS\tLEECHERS\tCOMPLETED")
+	for _, row := range rows {
+		if row.Error != "" {
+			fmt.Fprintf(w, "%s\terror: %s\n", row.Tracker, row.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", row.Tracker, row.Seeders, row.Leechers, row.Completed)
+	}
+	w.Flush()
+}
+
+// loadTrackers returns the info hash and trackers of a torrent file, URL or
+// magnet link
+func loadTrackers(route *netRoute, arg string) ([20]byte, []string, error) {
+	if magnet.IsMagnet(arg) {
+		m, err := magnet.Parse(arg)
+		if err != nil {
+			return [20]byte{}, nil, err
+		}
+		if m.InfoHash == [20]byte{} {
+			return [20]byte{}, nil, errMutableMagnet
+		}
+		return m.InfoHash, m.Trackers, nil
+	}
+
+	tf, err := torrent.LoadWith(route.fetch, arg)
+	if err != nil {
+		return [20]byte{}, nil, err
+	}
+	infoHash, err := tf.InfoHash()
+	if err != nil {
+		return [20]byte{}, nil, fmt.Errorf("failed to calculate info hash: %v", err)
+	}
+	return infoHash, tf.Trackers(), nil
+}
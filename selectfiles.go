@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/omkarkirpan/bittorrent-client/download"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// fileSelection picks the files of a torrent to download. Files are chosen
+// by index as listed by "info --files" and by glob; without either every
+// file is chosen. Excluded files are then dropped.
+type fileSelection struct {
+	indices string
+	include stringList
+	exclude stringList
+}
+
+// register defines the file selection flags on fs
+func (s *fileSelection) register(fs *flag.FlagSet) {
+	fs.StringVar(&s.indices, "files", "", "only download these files, by index as listed by \"info --files\", e.g. 1,3-5 (one torrent only)")
+	fs.Var(&s.include, "include", "only download files whose path or name matches this `glob`, e.g. '*.mkv'; may be repeated")
+	fs.Var(&s.exclude, "exclude", "don't download files whose path or name matches this `glob`; may be repeated")
+}
+
+// empty reports whether no selection was given, so every file is downloaded
+func (s *fileSelection) empty() bool {
+	return s.indices == "" && len(s.include) == 0 && len(s.exclude) == 0
+}
+
+// priorities resolves the selection against tf's files, in the form
+// session.Config.SelectFiles returns
+func (s *fileSelection) priorities(tf *torrent.TorrentFile) ([]download.Priority, error) {
+	paths := torrentPaths(tf)
+	chosen := make([]bool, len(paths))
+
+	// Choose by index and include globs, or everything without them
+	if s.indices == "" && len(s.include) == 0 {
+		for i := range chosen {
+			chosen[i] = true
+		}
+	}
+	if s.indices != "" {
+		indices, err := parseIndices(s.indices, len(paths))
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range indices {
+			chosen[i-1] = true
+		}
+	}
+	for _, pattern := range s.include {
+		for i, p := range paths {
+			ok, err := matchFile(pattern, p)
+			if err != nil {
+				return nil, err
+			}
+			chosen[i] = chosen[i] || ok
+		}
+	}
+
+	// Drop excluded files
+	for _, pattern := range s.exclude {
+		for i, p := range paths {
+			ok, err := matchFile(pattern, p)
+			if err != nil {
+				return nil, err
+			}
+			chosen[i] = chosen[i] && !ok
+		}
+	}
+
+	priorities := make([]download.Priority, len(paths))
+	selected := false
+	for i, ok := range chosen {
+		if ok {
+			selected = true
+		} else {
+			priorities[i] = download.PrioritySkip
+		}
+	}
+	if !selected {
+		return nil, errors.New("no files match the selection")
+	}
+	return priorities, nil
+}
+
+// torrentPaths returns the slash-separated paths of tf's files inside the
+// torrent, in torrent order
+func torrentPaths(tf *torrent.TorrentFile) []string {
+	if len(tf.Info.Files) == 0 {
+		return []string{tf.Info.Name}
+	}
+	paths := make([]string, len(tf.Info.Files))
+	for i, f := range tf.Info.Files {
+		paths[i] = strings.Join(f.Path, "/")
+	}
+	return paths
+}
+
+// matchFile reports whether a glob matches a file's path, or its name for
+// patterns without a slash
+func matchFile(pattern, file string) (bool, error) {
+	if !strings.Contains(pattern, "/") {
+		file = path.Base(file)
+	}
+	ok, err := path.Match(pattern, file)
+	if err != nil {
+		return false, fmt.Errorf("invalid glob %q: %v", pattern, err)
+	}
+	return ok, nil
+}
+
+// parseIndices parses a list of 1-based indices and ranges like "1,3-5",
+// each of which must be at most n
+func parseIndices(s string, n int) ([]int, error) {
+	var indices []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		first, last, isRange := strings.Cut(part, "-")
+		a, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file index %q", part)
+		}
+		b := a
+		if isRange {
+			if b, err = strconv.Atoi(last); err != nil || b < a {
+				return nil, fmt.Errorf("invalid file range %q", part)
+			}
+		}
+		if a < 1 || b > n {
+			return nil, fmt.Errorf("file index %s out of range: the torrent has %d files", part, n)
+		}
+		for i := a; i <= b; i++ {
+			indices = append(indices, i)
+		}
+	}
+	return indices, nil
+}
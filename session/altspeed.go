@@ -0,0 +1,182 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// altScheduleCheck is how often the alternative speed and bandwidth
+// schedules are checked
+const altScheduleCheck = time.Minute
+
+// Schedule is a daily time window, on some days of the week, during which the
+// alternative rate limits apply
+type Schedule struct {
+	Days  [7]bool       // days the window starts on, indexed by time.Weekday
+	Start time.Duration // since midnight
+	End   time.Duration // since midnight; before Start, the window runs past midnight
+}
+
+// weekdays are the day names ParseSchedule accepts, indexed by time.Weekday
+var weekdays = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseSchedule parses a window such as "09:00-17:00", every day, or
+// "mon-fri 09:00-17:00" or "sat,sun 22:00-06:00" on some days. A window
+// ending before it starts runs past midnight.
+func ParseSchedule(s string) (*Schedule, error) {
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid schedule %q: expected [days] hh:mm-hh:mm", s)
+	}
+
+	sc := &Schedule{}
+	if len(fields) == 1 {
+		sc.Days = [7]bool{true, true, true, true, true, true, true}
+	} else {
+		for _, part := range strings.Split(fields[0], ",") {
+			first, last, isRange := strings.Cut(part, "-")
+			a, b := weekday(first), weekday(last)
+			if !isRange {
+				b = a
+			}
+			if a < 0 || b < 0 {
+				return nil, fmt.Errorf("invalid schedule %q: unknown day in %q", s, part)
+			}
+			for d := a; ; d = (d + 1) % 7 {
+				sc.Days[d] = true
+				if d == b {
+					break
+				}
+			}
+		}
+	}
+
+	start, end, ok := strings.Cut(fields[len(fields)-1], "-")
+	var err error
+	if !ok {
+		return nil, fmt.Errorf("invalid schedule %q: expected a time window such as 09:00-17:00", s)
+	}
+	if sc.Start, err = clockTime(start); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %v", s, err)
+	}
+	if sc.End, err = clockTime(end); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %v", s, err)
+	}
+	if sc.Start == sc.End {
+		return nil, fmt.Errorf("invalid schedule %q: the window is empty", s)
+	}
+	return sc, nil
+}
+
+// weekday returns the index of a day name, or -1
+func weekday(name string) int {
+	for i, day := range weekdays {
+		if name == day {
+			return i
+		}
+	}
+	return -1
+}
+
+// clockTime parses hh:mm into the time since midnight
+func clockTime(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Active reports whether t falls in the window. A window running past
+// midnight belongs to the day it starts on.
+func (sc *Schedule) Active(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	since := t.Sub(midnight)
+	today, yesterday := t.Weekday(), (t.Weekday()+6)%7
+	if sc.Start < sc.End {
+		return sc.Days[today] && since >= sc.Start && since < sc.End
+	}
+	return (sc.Days[today] && since >= sc.Start) || (sc.Days[yesterday] && since < sc.End)
+}
+
+// AltSpeed reports whether the alternative rate limits are in effect
+func (s *Session) AltSpeed() bool {
+	s.limitsMu.Lock()
+	defer s.limitsMu.Unlock()
+	return s.altSpeed
+}
+
+// SetAltSpeed switches between the normal and the alternative rate limits
+// ("turtle mode"), e.g. to leave bandwidth for a video call. Running
+// transfers pick up the new limits immediately. With Config.AltSchedule, the
+// schedule switches again at the next start or end of its window.
+func (s *Session) SetAltSpeed(on bool) {
+	s.limitsMu.Lock()
+	defer s.limitsMu.Unlock()
+	if s.altSpeed == on {
+		return
+	}
+	s.altSpeed = on
+	s.applyLimits()
+	s.log.Info("alternative speed limits switched", "on", on)
+}
+
+// AltRateLimits returns the alternative download and upload limits in bytes
+// per second, 0 meaning unlimited
+func (s *Session) AltRateLimits() (download, upload int64) {
+	s.limitsMu.Lock()
+	defer s.limitsMu.Unlock()
+	return s.altLimits[0], s.altLimits[1]
+}
+
+// SetAltRateLimits changes the alternative download and upload limits in
+// bytes per second, 0 meaning unlimited. They take effect immediately when
+// the alternative limits are in effect.
+func (s *Session) SetAltRateLimits(download, upload int64) error {
+	if download < 0 || upload < 0 {
+		return errors.New("rate limits can't be negative")
+	}
+	s.limitsMu.Lock()
+	defer s.limitsMu.Unlock()
+	s.altLimits = [2]int64{download, upload}
+	s.applyLimits()
+	s.log.Info("alternative rate limits changed", "download", download, "upload", upload)
+	return nil
+}
+
+// applyLimits sets the limiters to the limits in effect: the alternative
+// limits, else those of the bandwidth rule in effect unless it pauses, else
+// the normal ones. The caller must hold s.limitsMu.
+func (s *Session) applyLimits() {
+	limits := s.limits
+	switch {
+	case s.altSpeed:
+		limits = s.altLimits
+	case s.rule != nil && !s.rule.Pause:
+		limits = [2]int64{s.rule.MaxDownload, s.rule.MaxUpload}
+	}
+	s.downLimit.SetLimit(limits[0])
+	s.upLimit.SetLimit(limits[1])
+}
+
+// watchAltSchedule switches the alternative rate limits on and off as
+// Config.AltSchedule's window starts and ends, until the session is closed.
+// In between, SetAltSpeed can override it.
+func (s *Session) watchAltSchedule() {
+	defer s.wg.Done()
+	active := s.cfg.AltSchedule.Active(s.clock.Now())
+	s.SetAltSpeed(active)
+	for {
+		select {
+		case <-s.clock.After(altScheduleCheck):
+			if now := s.cfg.AltSchedule.Active(s.clock.Now()); now != active {
+				active = now
+				s.SetAltSpeed(active)
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package session
+
+import "time"
+
+// BandwidthRule sets the session's rate limits during the window of its
+// Schedule, or pauses the running torrents
+type BandwidthRule struct {
+	Schedule
+	MaxDownload int64 // bytes per second during the window; 0 is unlimited
+	MaxUpload   int64
+	Pause       bool // pause running torrents during the window, and resume them after
+}
+
+// activeRule returns the index of the first rule whose window t falls in,
+// or -1
+func activeRule(rules []BandwidthRule, t time.Time) int {
+	for i := range rules {
+		if rules[i].Active(t) {
+			return i
+		}
+	}
+	return -1
+}
+
+// BandwidthRule returns the Config.BandwidthSchedule rule in effect, and
+// false if none is
+func (s *Session) BandwidthRule() (BandwidthRule, bool) {
+	s.limitsMu.Lock()
+	defer s.limitsMu.Unlock()
+	if s.rule == nil {
+		return BandwidthRule{}, false
+	}
+	return *s.rule, true
+}
+
+// setBandwidthRule puts a rule, or none if rule is nil, in effect
+func (s *Session) setBandwidthRule(rule *BandwidthRule) {
+	s.limitsMu.Lock()
+	defer s.limitsMu.Unlock()
+	s.rule = rule
+	s.applyLimits()
+	if rule == nil {
+		s.log.Info("bandwidth schedule back to the normal limits")
+	} else {
+		s.log.Info("bandwidth schedule rule in effect", "download", rule.MaxDownload, "upload", rule.MaxUpload, "pause", rule.Pause)
+	}
+}
+
+// watchBandwidthSchedule applies the Config.BandwidthSchedule rule in effect
+// as windows start and end, until the session is closed. While a Pause rule
+// is in effect, torrents that start running are paused too; only those it
+// paused are resumed after.
+func (s *Session) watchBandwidthSchedule() {
+	defer s.wg.Done()
+	rules := s.cfg.BandwidthSchedule
+	current := -1
+	var paused []*Torrent
+	for {
+		i := activeRule(rules, s.clock.Now())
+		if i != current {
+			current = i
+			var rule *BandwidthRule
+			if i >= 0 {
+				rule = &rules[i]
+			}
+			s.setBandwidthRule(rule)
+		}
+
+		if current >= 0 && rules[current].Pause {
+			for _, t := range s.Torrents() {
+				switch t.State() {
+				case StateFetchingMetadata, StateDownloading, StateSeeding, StateQueued:
+					if err := t.Pause(); err == nil {
+						paused = append(paused, t)
+					}
+				}
+			}
+		} else {
+			for _, t := range paused {
+				if err := t.Resume(); err != nil {
+					t.log.Debug("not resumed after the scheduled pause", "error", err)
+				}
+			}
+			paused = nil
+		}
+
+		select {
+		case <-s.clock.After(altScheduleCheck):
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
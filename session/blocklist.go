@@ -0,0 +1,151 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/blocklist"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+)
+
+// defaultBlocklistRefresh is how often the blocklist is reloaded by default
+const defaultBlocklistRefresh = 24 * time.Hour
+
+// BlockStats counts what the blocklist filtered out
+type BlockStats struct {
+	Connections int64 // Incoming and outgoing peer connections refused
+	Peers       int64 // Peers from trackers or given directly that were dropped
+	DHT         int64 // DHT packets, nodes and peers ignored
+	Ranges      int   // Address ranges in the current list
+}
+
+// loadBlocklist reads the configured blocklist and replaces the current one.
+// A downloaded list is cached in the state directory, and the cached copy is
+// used when the download fails.
+func (s *Session) loadBlocklist() error {
+	var cache string
+	if s.cfg.StateDir != "" {
+		cache = s.cfg.StateDir.Blocklist()
+	}
+	list, err := blocklist.LoadCached(s.http, s.cfg.Blocklist, cache)
+	if list == nil {
+		return err
+	}
+	if err != nil {
+		s.log.Warn("blocklist download failed, using the cached copy", "error", err)
+	}
+	s.blocklist.Store(list)
+	s.log.Info("blocklist loaded", "source", s.cfg.Blocklist, "ranges", list.Len())
+	return nil
+}
+
+// refreshBlocklist reloads the blocklist periodically until the session
+// closes. A failed reload keeps the previous list.
+func (s *Session) refreshBlocklist() {
+	defer s.wg.Done()
+
+	interval := s.cfg.BlocklistRefresh
+	if interval <= 0 {
+		interval = defaultBlocklistRefresh
+	}
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if err := s.loadBlocklist(); err != nil {
+				s.log.Warn("blocklist reload failed, keeping the previous list", "error", err)
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// isBlocked reports whether the blocklist covers ip
+func (s *Session) isBlocked(ip net.IP) bool {
+	list := s.blocklist.Load()
+	return list != nil && list.Contains(ip)
+}
+
+// dhtBlocked is the DHT's filter, counting what it rejects
+func (s *Session) dhtBlocked(ip net.IP) bool {
+	if s.isBlocked(ip) {
+		s.blockedDHT.Add(1)
+		return true
+	}
+	return false
+}
+
+// filterPeers drops blocked peers
+func (s *Session) filterPeers(peers []tracker.Peer) []tracker.Peer {
+	allowed := make([]tracker.Peer, 0, len(peers))
+	for _, p := range peers {
+		if s.isBlocked(p.IP) {
+			s.blockedPeers.Add(1)
+			continue
+		}
+		allowed = append(allowed, p)
+	}
+	return allowed
+}
+
+// banPeer bans a peer for the rest of the session after a torrent banned it
+// for sending corrupt pieces, dropping its connections to other torrents too
+func (s *Session) banPeer(ip string) {
+	s.bannedMu.Lock()
+	if s.banned == nil {
+		s.banned = make(map[string]bool)
+	}
+	s.banned[ip] = true
+	s.bannedMu.Unlock()
+
+	s.log.Warn("peer banned for sending corrupt pieces", "ip", ip)
+	for _, t := range s.Torrents() {
+		t.stats.Ban(ip)
+	}
+}
+
+// isBanned reports whether the peer at ip was banned
+func (s *Session) isBanned(ip net.IP) bool {
+	s.bannedMu.Lock()
+	defer s.bannedMu.Unlock()
+	return ip != nil && s.banned[ip.String()]
+}
+
+// dialPeer opens a peer connection unless the address is blocked or banned,
+// since the list may have changed after the peer was discovered
+func (s *Session) dialPeer(ctx context.Context, network, addr string) (net.Conn, error) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		ip := net.ParseIP(host)
+		if s.isBlocked(ip) {
+			s.blockedConns.Add(1)
+			return nil, fmt.Errorf("peer %s is blocklisted", addr)
+		}
+		if s.isBanned(ip) {
+			return nil, fmt.Errorf("peer %s is banned", addr)
+		}
+	}
+	if s.dial != nil {
+		return s.dial(ctx, network, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// BlockStats returns how many connections, peers and DHT messages the
+// blocklist has filtered out, and how many ranges it holds
+func (s *Session) BlockStats() BlockStats {
+	stats := BlockStats{
+		Connections: s.blockedConns.Load(),
+		Peers:       s.blockedPeers.Load(),
+		DHT:         s.blockedDHT.Load(),
+	}
+	if list := s.blocklist.Load(); list != nil {
+		stats.Ranges = list.Len()
+	}
+	return stats
+}
@@ -0,0 +1,79 @@
+package session
+
+import (
+	"errors"
+)
+
+// Connection budget tuning
+const (
+	defaultMaxConnections = 500 // Peer connections across all torrents unless Config.MaxConnections says otherwise
+	downloadingWeight     = 4   // Slots a downloading torrent gets for each one a seeding torrent gets
+)
+
+// connWeight returns the claim a torrent in a state has on the connection
+// budget. Downloads need peers most; seeds serve whoever connects, and
+// stopped torrents need none.
+func connWeight(state State) int {
+	switch state {
+	case StateFetchingMetadata, StateDownloading:
+		return downloadingWeight
+	case StateSeeding:
+		return 1
+	}
+	return 0
+}
+
+// connLimit returns how many peer connections t may have: its override, or
+// else its share of Config.MaxConnections, what overrides leave of it split
+// in proportion to the weight of each torrent's state, and at most
+// Config.MaxPeers. A torrent always gets at least one.
+func (t *Torrent) connLimit() int {
+	if n := t.connOverride(); n > 0 {
+		return n
+	}
+
+	budget := t.session.cfg.MaxConnections
+	weight := max(connWeight(t.State()), 1)
+	total := weight
+	for _, other := range t.session.Torrents() {
+		if other == t {
+			continue
+		}
+		if n := other.connOverride(); n > 0 {
+			budget -= n
+			continue
+		}
+		total += connWeight(other.State())
+	}
+	share := max(budget, 0) * weight / total
+	return min(max(share, 1), t.session.cfg.MaxPeers)
+}
+
+// connOverride returns the torrent's own connection cap, or 0
+func (t *Torrent) connOverride() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.maxConns
+}
+
+// MaxConnections returns how many peer connections the torrent may have at
+// once: the cap set with SetMaxConnections, or else its share of the
+// session's budget, which changes as other torrents start and finish
+func (t *Torrent) MaxConnections() int {
+	return t.connLimit()
+}
+
+// SetMaxConnections caps the torrent's peer connections at n instead of its
+// share of the session's budget, taking them out of the budget the other
+// torrents share. 0 goes back to the share. Connections beyond a lowered cap
+// are kept, but new ones are refused until the torrent is under it.
+func (t *Torrent) SetMaxConnections(n int) error {
+	if n < 0 {
+		return errors.New("connection limit can't be negative")
+	}
+	t.mu.Lock()
+	t.maxConns = n
+	t.mu.Unlock()
+	t.log.Info("connection limit changed", "max_connections", n)
+	return nil
+}
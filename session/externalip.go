@@ -0,0 +1,141 @@
+package session
+
+import (
+	"net"
+	"sync"
+)
+
+// External IP discovery tuning
+const (
+	minIPVotes  = 2  // distinct sources that must agree on an address before we trust it
+	maxIPVoters = 64 // sources remembered per address family, the oldest forgotten first
+)
+
+// ipVotes reconciles the external IPs trackers (BEP 24) and peers, in the
+// "yourip" field of their extension handshakes, tell us they see us at. Each
+// source has one vote per address family, its latest report. An address is
+// trusted once enough sources report it and a majority agrees, so a single
+// lying or confused peer can't move it.
+type ipVotes struct {
+	mu        sync.Mutex
+	voters    [2]map[string]net.IP // by family, IPv4 first: source -> reported IP
+	order     [2][]string          // sources in the order they first voted
+	confident [2]net.IP
+}
+
+// family returns the index of ip's address family
+func family(ip net.IP) int {
+	if ip.To4() != nil {
+		return 0
+	}
+	return 1
+}
+
+// vote records that source sees us at ip and returns the trusted address of
+// ip's family if the vote changed it, or nil
+func (v *ipVotes) vote(source string, ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	f := family(ip)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.voters[f] == nil {
+		v.voters[f] = make(map[string]net.IP)
+	}
+	if _, ok := v.voters[f][source]; !ok {
+		v.order[f] = append(v.order[f], source)
+		if len(v.order[f]) > maxIPVoters {
+			delete(v.voters[f], v.order[f][0])
+			v.order[f] = v.order[f][1:]
+		}
+	}
+	v.voters[f][source] = ip
+
+	// Tally the votes
+	counts := make(map[string]int)
+	var best string
+	for _, reported := range v.voters[f] {
+		key := string(reported)
+		counts[key]++
+		if counts[key] > counts[best] {
+			best = key
+		}
+	}
+	if counts[best] < minIPVotes || counts[best]*2 <= len(v.voters[f]) || net.IP(best).Equal(v.confident[f]) {
+		return nil
+	}
+	v.confident[f] = net.IP(best)
+	return v.confident[f]
+}
+
+// trusted returns the trusted external address of a family, or nil
+func (v *ipVotes) trusted(ipv6 bool) net.IP {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if ipv6 {
+		return v.confident[1]
+	}
+	return v.confident[0]
+}
+
+// reportExternalIP records the external IP a tracker or peer reported. Only
+// public addresses count: peers on our network see a private one.
+func (s *Session) reportExternalIP(source string, ip net.IP) {
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return
+	}
+	trusted := s.externalIPs.vote(source, ip)
+	if trusted == nil {
+		return
+	}
+
+	nat := !localIP(trusted)
+	s.log.Info("external IP discovered", "ip", trusted, "nat", nat)
+	if nat && trusted.To4() != nil && !s.cfg.NoListen && !s.cfg.PortMapping && s.incoming.Load() == 0 {
+		s.log.Warn("behind NAT and no peer has connected to us yet; forward the listen port or enable port mapping to accept incoming peers",
+			"port", s.cfg.Port)
+	}
+
+	// BEP 42 ties the DHT node ID to the address; IPv4 wins when we run both
+	if node, _ := s.dhtNode(); node != nil && (trusted.To4() != nil || s.externalIPs.trusted(false) == nil) {
+		node.SetExternalIP(trusted)
+	}
+}
+
+// localIP reports whether ip is an address of this host
+func localIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NATStatus is what we know about how peers reach us
+type NATStatus struct {
+	ExternalIPv4 net.IP // trusted external addresses, nil until enough trackers and peers agree
+	ExternalIPv6 net.IP
+	BehindNAT    bool  // the external IPv4 address isn't one of this host's
+	PortMapped   bool  // the gateway forwards the listen port
+	Incoming     int64 // connections peers opened to us
+}
+
+// NATStatus returns what trackers and peers told us about our external
+// addresses, to diagnose why peers might not reach us
+func (s *Session) NATStatus() NATStatus {
+	status := NATStatus{
+		ExternalIPv4: s.externalIPs.trusted(false),
+		ExternalIPv6: s.externalIPs.trusted(true),
+		PortMapped:   s.portMapped.Load(),
+		Incoming:     s.incoming.Load(),
+	}
+	status.BehindNAT = status.ExternalIPv4 != nil && !localIP(status.ExternalIPv4)
+	return status
+}
@@ -0,0 +1,27 @@
+package session
+
+import "time"
+
+// Hooks let metrics, tracing and other telemetry observe a session without it
+// depending on them. Unlike Subscribe, they are called synchronously from the
+// goroutine doing the work and never miss anything, so they must return
+// quickly. Nil hooks are skipped.
+type Hooks struct {
+	// OnPeerConnect is called once a connection to a peer is ready
+	OnPeerConnect func(infoHash [20]byte, addr string)
+
+	// OnBlockReceived is called with every block of piece data that arrives
+	OnBlockReceived func(infoHash [20]byte, addr string, piece, begin, length int)
+
+	// OnAnnounce is called after every announce to a tracker, with the peers
+	// it returned, how long it took and why it failed
+	OnAnnounce func(infoHash [20]byte, tracker string, peers int, took time.Duration, err error)
+
+	// OnPieceVerified is called after every hash check of a downloaded piece
+	OnPieceVerified func(infoHash [20]byte, piece int, ok bool)
+
+	// OnStats is called with a snapshot of every torrent's activity each
+	// time the transfer rates are sampled, once a second, so user
+	// interfaces needn't poll
+	OnStats func(infoHash [20]byte, stats Stats)
+}
@@ -0,0 +1,77 @@
+package session
+
+import (
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/stats"
+)
+
+// statsSaveInterval is how often lifetime statistics are written to disk
+const statsSaveInterval = time.Minute
+
+// openStats opens the lifetime statistics database in the state directory.
+// Without a state directory nothing is recorded.
+func (s *Session) openStats() {
+	if s.cfg.StateDir == "" {
+		return
+	}
+	db, err := stats.Open(s.cfg.StateDir.Stats())
+	if err != nil {
+		s.log.Warn("stats database unreadable, starting over", "error", err)
+	}
+	s.lifetime = db
+}
+
+// Lifetime returns the database of lifetime transfer totals, or nil without
+// a state directory
+func (s *Session) Lifetime() *stats.DB {
+	return s.lifetime
+}
+
+// saveStats writes the lifetime statistics if they changed
+func (s *Session) saveStats() {
+	if s.lifetime == nil {
+		return
+	}
+	if err := s.lifetime.Save(); err != nil {
+		s.log.Warn("failed to save stats", "error", err)
+	}
+}
+
+// recordLifetime adds the bytes moved since the last call, and the time
+// spent downloading or seeding, to the torrent's lifetime totals. The
+// time seeding counts towards SeedLimits.Time in later runs too.
+func (t *Torrent) recordLifetime(now time.Time) {
+	db := t.session.lifetime
+	if db == nil {
+		return
+	}
+	down, up := t.stats.Downloaded.Load(), t.stats.Uploaded.Load()
+
+	t.mu.Lock()
+	delta := stats.Totals{Downloaded: down - t.recorded.Downloaded, Uploaded: up - t.recorded.Uploaded}
+	if (t.state == StateDownloading || t.state == StateSeeding) && !t.recordedAt.IsZero() {
+		delta.Active = now.Sub(t.recordedAt)
+		if t.state == StateSeeding {
+			delta.Seeding = delta.Active
+		}
+	}
+	t.recorded.Downloaded, t.recorded.Uploaded, t.recordedAt = down, up, now
+	name := t.name
+	var length int64
+	if t.meta != nil {
+		length = t.meta.TotalLength()
+	}
+	t.mu.Unlock()
+
+	db.Record(t.infoHash, name, length, delta, now)
+}
+
+// Lifetime returns the torrent's transfer totals across every run, up to
+// the last second or so. It returns false without a state directory.
+func (t *Torrent) Lifetime() (stats.Torrent, bool) {
+	if t.session.lifetime == nil {
+		return stats.Torrent{}, false
+	}
+	return t.session.lifetime.Torrent(t.infoHash)
+}
@@ -0,0 +1,226 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/peer"
+	"github.com/omkarkirpan/bittorrent-client/transport"
+)
+
+// handshakeTimeout bounds how long an incoming peer may take to send its handshake
+const handshakeTimeout = 10 * time.Second
+
+// listen opens the incoming peer listeners, trying Port and then the fallback
+// range, or a random port, and records the port it got in s.cfg.Port
+func (s *Session) listen() error {
+	candidates := []uint16{s.cfg.Port}
+	if s.cfg.RandomPort {
+		candidates = []uint16{0}
+	} else if first, last := s.cfg.PortRange[0], s.cfg.PortRange[1]; first != 0 && first <= last {
+		for port := int(first); port <= int(last); port++ {
+			if uint16(port) != s.cfg.Port {
+				candidates = append(candidates, uint16(port))
+			}
+		}
+	}
+
+	var err error
+	for _, port := range candidates {
+		if err = s.listenOn(port); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	s.cfg.Port = uint16(s.listeners[0].Addr().(*net.TCPAddr).Port)
+	for _, ln := range s.listeners {
+		s.wg.Add(1)
+		go s.acceptLoop(ln)
+	}
+	return nil
+}
+
+// listener returns what incoming peer listeners are opened with
+func (s *Session) listener() transport.Listener {
+	if s.cfg.Transport != nil {
+		return s.cfg.Transport
+	}
+	if s.bind != nil {
+		return &transport.TCP{ListenConfig: net.ListenConfig{Control: s.bind.Control}}
+	}
+	return &transport.TCP{}
+}
+
+// listenOn opens a listener on port for each enabled address family. Port 0
+// lets the first listener pick a port that the others then share. Failing to
+// listen on IPv6 is not fatal when IPv4 works. With a bind address, families
+// the binding has no address for are skipped.
+func (s *Session) listenOn(port uint16) error {
+
+	var bindErr error
+	for _, ipv6 := range []bool{false, true} {
+		if (!ipv6 && s.cfg.DisableIPv4) || (ipv6 && s.cfg.DisableIPv6) {
+			continue
+		}
+
+		network, host := "tcp4", "0.0.0.0"
+		if ipv6 {
+			network, host = "tcp6", "::"
+		}
+		if s.bind != nil {
+			ip, err := s.bind.LocalIP(ipv6)
+			if err != nil {
+				bindErr = err
+				continue
+			}
+			host = ip.String()
+		}
+
+		ln, err := s.listener().Listen(s.ctx, network, net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			if ipv6 && len(s.listeners) > 0 {
+				continue
+			}
+			s.closeListeners()
+			s.listeners = nil
+			return fmt.Errorf("failed to listen on %s: %v", network, err)
+		}
+		s.listeners = append(s.listeners, ln)
+		port = uint16(ln.Addr().(*net.TCPAddr).Port)
+	}
+
+	if len(s.listeners) == 0 {
+		return fmt.Errorf("failed to listen: %v", bindErr)
+	}
+	return nil
+}
+
+// closeListeners stops accepting incoming connections
+func (s *Session) closeListeners() {
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+}
+
+// ListenAddrs returns the addresses incoming peer connections are accepted on
+func (s *Session) ListenAddrs() []net.Addr {
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, ln := range s.listeners {
+		addrs[i] = ln.Addr()
+	}
+	return addrs
+}
+
+// listensIPv6 reports whether incoming connections are accepted over IPv6
+func (s *Session) listensIPv6() bool {
+	for _, ln := range s.listeners {
+		if ln.Addr().(*net.TCPAddr).IP.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptLoop accepts incoming peer connections until the listener is closed
+func (s *Session) acceptLoop(ln net.Listener) {
+	defer s.wg.Done()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			s.log.Debug("accept failed", "error", err)
+			continue
+		}
+		go s.handleIncoming(conn)
+	}
+}
+
+// handleIncoming completes the handshake of an incoming connection and hands
+// it to the torrent it asks for
+func (s *Session) handleIncoming(conn net.Conn) {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && s.isBlocked(addr.IP) {
+		s.blockedConns.Add(1)
+		conn.Close()
+		return
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && s.isBanned(addr.IP) {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	var t *Torrent
+	serving := func(infoHash [20]byte) bool {
+		s.mu.Lock()
+		t = s.torrents[infoHash]
+		s.mu.Unlock()
+		return t != nil && (t.State() == StateDownloading || t.State() == StateSeeding)
+	}
+	hs, err := peer.AcceptHandshake(conn, serving, s.peerID, peer.ExtensionExtensions, peer.ExtensionFast)
+	if err != nil {
+		if !errors.Is(err, peer.ErrUnknownInfoHash) {
+			s.log.Debug("invalid handshake from incoming peer", "peer", conn.RemoteAddr(), "error", err)
+		}
+		conn.Close()
+		return
+	}
+
+	if s.cfg.ClientPolicy.Decide(hs.PeerID, "") == peer.Refuse {
+		s.log.Debug("incoming peer refused by client policy", "peer", conn.RemoteAddr(), "client", peer.ClientName(hs.PeerID))
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.incoming.Add(1)
+
+	t.addIncoming(conn, hs.PeerID, hs.HasExtension(peer.ExtensionExtensions), hs.HasExtension(peer.ExtensionFast))
+}
+
+// globalIPv6 returns a public IPv6 address of this host, or nil if it has none
+func globalIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil {
+			continue
+		}
+		if ipNet.IP.IsGlobalUnicast() && !ipNet.IP.IsPrivate() {
+			return ipNet.IP
+		}
+	}
+	return nil
+}
+
+// externalAddr returns our address as peers see it in the IPv6 or IPv4
+// family, or nil if unknown: a public IP the sockets are bound to or, for
+// IPv6, a global address of this host, or else the address trackers and
+// peers agree they see us at
+func (s *Session) externalAddr(ipv6 bool) *net.TCPAddr {
+	var ip net.IP
+	if s.bind != nil {
+		if local, err := s.bind.LocalIP(ipv6); err == nil && local.IsGlobalUnicast() && !local.IsPrivate() {
+			ip = local
+		}
+	} else if ipv6 {
+		ip = globalIPv6()
+	}
+	if ip == nil {
+		ip = s.externalIPs.trusted(ipv6)
+	}
+	if ip == nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(s.AnnouncePort())}
+}
@@ -0,0 +1,120 @@
+package session
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/dht"
+	"github.com/omkarkirpan/bittorrent-client/magnet"
+)
+
+// mutableTimeout bounds the DHT lookups of a mutable torrent's current version
+const mutableTimeout = 30 * time.Second
+
+// mutableSource is where a mutable torrent (BEP 46) learns about new
+// versions: the DHT item its publisher signs with their key
+type mutableSource struct {
+	key  [ed25519.PublicKeySize]byte
+	salt []byte
+	seq  int64 // sequence number of the item that named this version
+}
+
+// newMutableSource returns the source a magnet link's public key names
+func newMutableSource(m *magnet.Magnet) *mutableSource {
+	src := &mutableSource{salt: m.Salt}
+	copy(src.key[:], m.PublicKey)
+	return src
+}
+
+// mutableItem returns the DHT node, once bootstrapped, and the current item
+// of a mutable torrent's publisher
+func (s *Session) mutableItem(ctx context.Context, key [ed25519.PublicKeySize]byte, salt []byte) (*dht.Server, *dht.Item, error) {
+	node, ready := s.dhtNode()
+	if node == nil {
+		return nil, nil, errors.New("mutable torrents need the DHT, which is disabled")
+	}
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	it, err := node.Get(ctx, key, salt)
+	return node, it, err
+}
+
+// resolve looks up the info hash of the current version of a mutable torrent
+// in the DHT, and the sequence number of the item naming it
+func (src *mutableSource) resolve(ctx context.Context, s *Session) ([20]byte, int64, error) {
+	var infoHash [20]byte
+	_, it, err := s.mutableItem(ctx, src.key, src.salt)
+	if err != nil {
+		return infoHash, 0, fmt.Errorf("failed to resolve mutable torrent: %v", err)
+	}
+	v, _ := it.Value.(map[string]interface{})
+	ih, _ := v["ih"].(string)
+	if len(ih) != len(infoHash) {
+		return infoHash, 0, errors.New("failed to resolve mutable torrent: item does not name an info hash")
+	}
+	copy(infoHash[:], ih)
+	return infoHash, it.Seq, nil
+}
+
+// checkMutable asks the DHT whether the publisher of a mutable torrent pushed
+// a newer version, and adds it as the torrent's successor
+func (s *Session) checkMutable(ctx context.Context, t *Torrent) {
+	ctx, cancel := context.WithTimeout(ctx, mutableTimeout)
+	defer cancel()
+	infoHash, seq, err := t.mutable.resolve(ctx, s)
+	if err != nil {
+		if ctx.Err() == nil {
+			t.log.Warn("update check failed", "error", err)
+		}
+		return
+	}
+	if seq <= t.mutable.seq || infoHash == t.infoHash {
+		return
+	}
+
+	next := newTorrent(s, infoHash, "", t.trackers, t.direct)
+	next.mutable = &mutableSource{key: t.mutable.key, salt: t.mutable.salt, seq: seq}
+	if err := s.start(next); errors.Is(err, ErrTorrentExists) {
+		next = s.Torrent(infoHash)
+	} else if err != nil {
+		t.log.Warn("failed to add the newer version", "error", err)
+		return
+	}
+	if next != nil {
+		s.adoptSuccessor(t, next)
+	}
+}
+
+// Publish points the mutable torrent of a key and salt at a new version
+// (BEP 46): it stores an item naming infoHash in the DHT, with a sequence
+// number above the current one, so clients following the torrent move to it.
+// It returns the magnet link of the mutable torrent.
+func (s *Session) Publish(ctx context.Context, key ed25519.PrivateKey, salt []byte, infoHash [20]byte) (*magnet.Magnet, error) {
+	m := &magnet.Magnet{PublicKey: key.Public().(ed25519.PublicKey), Salt: salt}
+	src := newMutableSource(m)
+	node, current, err := s.mutableItem(ctx, src.key, salt)
+	if node == nil {
+		return nil, err
+	}
+	seq := int64(1)
+	if current != nil {
+		seq = current.Seq + 1
+	}
+
+	it, err := dht.NewItem(key, salt, seq, map[string]interface{}{"ih": string(infoHash[:])})
+	if err != nil {
+		return nil, err
+	}
+	if err := node.Put(ctx, it); err != nil {
+		return nil, fmt.Errorf("failed to publish: %v", err)
+	}
+	s.log.Info("published mutable torrent version", "key", fmt.Sprintf("%x", src.key), "seq", seq,
+		"infohash", fmt.Sprintf("%x", infoHash))
+	return m, nil
+}
@@ -0,0 +1,301 @@
+package session
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/clock"
+	"github.com/omkarkirpan/bittorrent-client/peer"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+)
+
+// PeerSource identifies where a peer address was learned. Higher values are
+// preferred when choosing which peers to connect to.
+type PeerSource int
+
+const (
+	SourceDHT PeerSource = iota
+	SourceTracker
+	SourcePEX
+	SourceDirect // given explicitly, e.g. x.pe in a magnet link
+)
+
+// String returns the source name
+func (s PeerSource) String() string {
+	switch s {
+	case SourceDHT:
+		return "dht"
+	case SourceTracker:
+		return "tracker"
+	case SourcePEX:
+		return "pex"
+	case SourceDirect:
+		return "direct"
+	default:
+		return fmt.Sprintf("PeerSource(%d)", int(s))
+	}
+}
+
+// sourceCaps limits how many new peers each source may add per capWindow, so
+// one noisy source can't crowd out peers from better ones. Sources without an
+// entry are unlimited.
+var sourceCaps = map[PeerSource]int{
+	SourceDHT:     100,
+	SourceTracker: 200,
+	SourcePEX:     50,
+}
+
+const capWindow = time.Minute
+
+// Redial tuning for peers whose connection failed or ended
+const (
+	peerRetry       = 30 * time.Second // Wait before redialing a peer, doubling with each failure in a row
+	maxPeerFailures = 5                // Failed connections in a row before a peer is forgotten
+)
+
+// allowedForPrivate reports whether a source may supply peers for a private
+// torrent (BEP 27): only its trackers, plus addresses the user gave explicitly
+func allowedForPrivate(source PeerSource) bool {
+	return source == SourceTracker || source == SourceDirect
+}
+
+// poolEntry is a known peer address
+type poolEntry struct {
+	peer    tracker.Peer
+	source  PeerSource          // best source that reported this peer
+	sources map[PeerSource]bool // every source that reported it
+	seq     int                 // insertion order, for FIFO within a source
+	taken   bool                // handed out for a connection attempt
+	failed  int                 // connection attempts failed in a row
+	retryAt time.Time           // not handed out again before this
+}
+
+// peerPool merges peers from all discovery sources, deduplicating by endpoint
+type peerPool struct {
+	mu          sync.Mutex
+	entries     map[string]*poolEntry
+	seq         int
+	windowStart time.Time
+	clock       clock.Clock
+	accepted    map[PeerSource]int
+	private     bool
+
+	// self, if set, returns our address as peers see it in the family of
+	// IPv6 or IPv4, or nil if unknown. Peers are then ranked by their
+	// canonical priority with it (BEP 40).
+	self func(ipv6 bool) *net.TCPAddr
+}
+
+func newPeerPool(clk clock.Clock) *peerPool {
+	return &peerPool{
+		clock:    clk,
+		entries:  make(map[string]*poolEntry),
+		accepted: make(map[PeerSource]int),
+	}
+}
+
+// peerKey identifies a peer by its IP:port endpoint
+func peerKey(p tracker.Peer) string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
+// Add merges peers reported by a source and returns how many were new. Known
+// peers are upgraded to the better source; new ones count against the cap.
+func (p *peerPool) Add(source PeerSource, peers []tracker.Peer) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.private && !allowedForPrivate(source) {
+		return 0
+	}
+
+	// Start a new rate-cap window if the previous one has passed
+	if p.clock.Since(p.windowStart) > capWindow {
+		p.windowStart = p.clock.Now()
+		p.accepted = make(map[PeerSource]int)
+	}
+
+	added := 0
+	for _, peer := range peers {
+		if peer.Port == 0 || peer.IP == nil || peer.IP.IsUnspecified() {
+			continue
+		}
+
+		key := peerKey(peer)
+		if e, ok := p.entries[key]; ok {
+			e.sources[source] = true
+			if source > e.source {
+				e.source = source
+			}
+			continue
+		}
+
+		if limit, ok := sourceCaps[source]; ok && p.accepted[source] >= limit {
+			continue
+		}
+		p.accepted[source]++
+
+		p.seq++
+		p.entries[key] = &poolEntry{
+			peer:    peer,
+			source:  source,
+			sources: map[PeerSource]bool{source: true},
+			seq:     p.seq,
+		}
+		added++
+	}
+	return added
+}
+
+// SetPrivate restricts the pool to sources allowed for private torrents and
+// forgets peers that were only learned from other sources
+func (p *peerPool) SetPrivate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.private = true
+	for key, e := range p.entries {
+		for source := range e.sources {
+			if !allowedForPrivate(source) {
+				delete(e.sources, source)
+			}
+		}
+		if len(e.sources) == 0 {
+			delete(p.entries, key)
+			continue
+		}
+
+		// Re-derive the best remaining source
+		e.source = SourceDHT
+		for source := range e.sources {
+			if source > e.source {
+				e.source = source
+			}
+		}
+	}
+}
+
+// Best returns up to n peers in priority order without marking them taken
+func (p *peerPool) Best(n int) []tracker.Peer {
+	return p.pick(n, false)
+}
+
+// Take returns up to n peers that haven't been handed out yet, in priority
+// order, and marks them taken
+func (p *peerPool) Take(n int) []tracker.Peer {
+	return p.pick(n, true)
+}
+
+func (p *peerPool) pick(n int, take bool) []tracker.Peer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+	candidates := make([]*poolEntry, 0, len(p.entries))
+	for _, e := range p.entries {
+		if !e.taken && !now.Before(e.retryAt) {
+			candidates = append(candidates, e)
+		}
+	}
+
+	// Better sources first, then peers reported by more sources, then those
+	// with a higher canonical priority, then oldest first
+	priority := p.priorities(candidates)
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.source != b.source {
+			return a.source > b.source
+		}
+		if len(a.sources) != len(b.sources) {
+			return len(a.sources) > len(b.sources)
+		}
+		if priority[a] != priority[b] {
+			return priority[a] > priority[b]
+		}
+		return a.seq < b.seq
+	})
+
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+
+	peers := make([]tracker.Peer, len(candidates))
+	for i, e := range candidates {
+		peers[i] = e.peer
+		if take {
+			e.taken = true
+		}
+	}
+	return peers
+}
+
+// Connected records that a connection to a peer handed out by Take opened,
+// clearing its failures
+func (p *peerPool) Connected(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[addr]; ok {
+		e.failed = 0
+	}
+}
+
+// Release returns a peer handed out by Take once its connection is gone, to
+// be handed out again after peerRetry. Each failure in a row doubles the
+// wait, and a peer that fails maxPeerFailures times is forgotten.
+func (p *peerPool) Release(addr string, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[addr]
+	if !ok || !e.taken {
+		return
+	}
+	if failed {
+		e.failed++
+		if e.failed >= maxPeerFailures {
+			delete(p.entries, addr)
+			return
+		}
+	}
+	e.taken = false
+	e.retryAt = p.clock.Now().Add(peerRetry << max(e.failed-1, 0))
+}
+
+// priorities returns the canonical priority of each entry with our address
+// (BEP 40). Without a known address of the entry's family it is 0.
+func (p *peerPool) priorities(entries []*poolEntry) map[*poolEntry]uint32 {
+	priority := make(map[*poolEntry]uint32, len(entries))
+	if p.self == nil {
+		return priority
+	}
+	self := map[bool]*net.TCPAddr{false: p.self(false), true: p.self(true)}
+	for _, e := range entries {
+		ipv6 := e.peer.IP.To4() == nil
+		if self[ipv6] != nil {
+			priority[e] = peer.Priority(self[ipv6], &net.TCPAddr{IP: e.peer.IP, Port: int(e.peer.Port)})
+		}
+	}
+	return priority
+}
+
+// Len returns the number of known peers
+func (p *peerPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.entries)
+}
+
+// Counts returns how many known peers have each source as their best source
+func (p *peerPool) Counts() map[PeerSource]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	counts := make(map[PeerSource]int)
+	for _, e := range p.entries {
+		counts[e.source]++
+	}
+	return counts
+}
@@ -0,0 +1,195 @@
+package session
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/clock"
+	"github.com/omkarkirpan/bittorrent-client/peer"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+)
+
+func testPeer(last byte) tracker.Peer {
+	return tracker.Peer{IP: net.IPv4(10, 0, 0, last), Port: 6881}
+}
+
+func TestPeerPoolPriority(t *testing.T) {
+	pool := newPeerPool(clock.Real)
+	pool.Add(SourceDHT, []tracker.Peer{testPeer(1), testPeer(2)})
+	pool.Add(SourceTracker, []tracker.Peer{testPeer(3)})
+	pool.Add(SourceDirect, []tracker.Peer{testPeer(4)})
+	pool.Add(SourcePEX, []tracker.Peer{testPeer(5)})
+
+	// Direct > PEX > tracker > DHT, FIFO within a source
+	expected := []byte{4, 5, 3, 1, 2}
+	best := pool.Best(10)
+	if len(best) != len(expected) {
+		t.Fatalf("Expected %d peers, got %d", len(expected), len(best))
+	}
+	for i, p := range best {
+		if p.IP.To4()[3] != expected[i] {
+			t.Errorf("Position %d: expected 10.0.0.%d, got %s", i, expected[i], p.IP)
+		}
+	}
+}
+
+func TestPeerPoolMerge(t *testing.T) {
+	pool := newPeerPool(clock.Real)
+	pool.Add(SourceDHT, []tracker.Peer{testPeer(1), testPeer(2)})
+
+	// Same endpoint reported by a better source is upgraded, not duplicated
+	if added := pool.Add(SourcePEX, []tracker.Peer{testPeer(2)}); added != 0 {
+		t.Errorf("Expected no new peers, got %d", added)
+	}
+	if pool.Len() != 2 {
+		t.Errorf("Expected 2 peers, got %d", pool.Len())
+	}
+
+	counts := pool.Counts()
+	if counts[SourceDHT] != 1 || counts[SourcePEX] != 1 {
+		t.Errorf("Unexpected source counts: %v", counts)
+	}
+	if best := pool.Best(1); best[0].IP.To4()[3] != 2 {
+		t.Errorf("Expected upgraded peer first, got %s", best[0].IP)
+	}
+}
+
+func TestPeerPoolTake(t *testing.T) {
+	pool := newPeerPool(clock.Real)
+	pool.Add(SourceTracker, []tracker.Peer{testPeer(1), testPeer(2), testPeer(3)})
+
+	if first := pool.Take(2); len(first) != 2 {
+		t.Fatalf("Expected 2 peers, got %d", len(first))
+	}
+	rest := pool.Take(10)
+	if len(rest) != 1 || rest[0].IP.To4()[3] != 3 {
+		t.Errorf("Expected only the untaken peer, got %v", rest)
+	}
+	if more := pool.Take(10); len(more) != 0 {
+		t.Errorf("Expected no peers left, got %v", more)
+	}
+}
+
+func TestPeerPoolRelease(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	pool := newPeerPool(fake)
+	pool.Add(SourceTracker, []tracker.Peer{testPeer(1), testPeer(2)})
+	pool.Take(2)
+	one, two := testPeer(1).String(), testPeer(2).String()
+
+	// A dropped peer is redialed after a while, a failing one later still
+	pool.Connected(one)
+	pool.Release(one, false)
+	pool.Release(two, true)
+	if peers := pool.Take(10); len(peers) != 0 {
+		t.Errorf("Expected released peers to wait, got %v", peers)
+	}
+	fake.Advance(peerRetry)
+	if peers := pool.Take(10); len(peers) != 2 {
+		t.Errorf("Expected both peers back after %v, got %v", peerRetry, peers)
+	}
+	pool.Release(two, true)
+	fake.Advance(peerRetry)
+	if peers := pool.Take(10); len(peers) != 0 {
+		t.Errorf("Expected the wait to double after a second failure, got %v", peers)
+	}
+	fake.Advance(peerRetry)
+	if peers := pool.Take(10); len(peers) != 1 {
+		t.Errorf("Expected the failing peer back, got %v", peers)
+	}
+
+	// Too many failures in a row and the peer is forgotten
+	for i := 2; i < maxPeerFailures; i++ {
+		pool.Release(two, true)
+		fake.Advance(peerRetry << i)
+		pool.Take(10)
+	}
+	if pool.Len() != 1 {
+		t.Errorf("Expected the failing peer to be forgotten, got %d peers", pool.Len())
+	}
+}
+
+func TestPeerPoolSourceCap(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	pool := newPeerPool(fake)
+
+	var peers []tracker.Peer
+	for i := 0; i < sourceCaps[SourcePEX]+10; i++ {
+		peers = append(peers, tracker.Peer{IP: net.IPv4(10, 1, byte(i/256), byte(i)), Port: 6881})
+	}
+
+	if added := pool.Add(SourcePEX, peers); added != sourceCaps[SourcePEX] {
+		t.Errorf("Expected PEX capped at %d, got %d", sourceCaps[SourcePEX], added)
+	}
+
+	// The cap is per source, so other sources are still accepted
+	if added := pool.Add(SourceDHT, []tracker.Peer{testPeer(1)}); added != 1 {
+		t.Errorf("Expected DHT peer to be accepted, got %d", added)
+	}
+
+	// The cap applies per window
+	if added := pool.Add(SourcePEX, []tracker.Peer{testPeer(2)}); added != 0 {
+		t.Errorf("Expected PEX peer over the cap to be refused, got %d", added)
+	}
+	fake.Advance(capWindow + time.Second)
+	if added := pool.Add(SourcePEX, []tracker.Peer{testPeer(2)}); added != 1 {
+		t.Errorf("Expected PEX peer to be accepted in a new window, got %d", added)
+	}
+
+	// Invalid endpoints are ignored
+	if added := pool.Add(SourceDirect, []tracker.Peer{{IP: net.IPv4zero, Port: 1}, {IP: net.IPv4(1, 2, 3, 4)}}); added != 0 {
+		t.Errorf("Expected invalid peers to be ignored, got %d", added)
+	}
+}
+
+func TestPeerPoolPrivate(t *testing.T) {
+	pool := newPeerPool(clock.Real)
+	pool.Add(SourceDHT, []tracker.Peer{testPeer(1), testPeer(2)})
+	pool.Add(SourceTracker, []tracker.Peer{testPeer(2), testPeer(3)})
+	pool.Add(SourcePEX, []tracker.Peer{testPeer(4)})
+
+	pool.SetPrivate()
+
+	// Only peers also known from the tracker survive
+	if pool.Len() != 2 {
+		t.Errorf("Expected 2 tracker peers, got %d", pool.Len())
+	}
+	counts := pool.Counts()
+	if counts[SourceTracker] != 2 || counts[SourceDHT] != 0 || counts[SourcePEX] != 0 {
+		t.Errorf("Unexpected source counts: %v", counts)
+	}
+
+	// DHT and PEX peers are refused from now on
+	for _, source := range []PeerSource{SourceDHT, SourcePEX} {
+		if added := pool.Add(source, []tracker.Peer{testPeer(9)}); added != 0 {
+			t.Errorf("Expected %v peer to be refused, got %d added", source, added)
+		}
+	}
+	if added := pool.Add(SourceTracker, []tracker.Peer{testPeer(9)}); added != 1 {
+		t.Errorf("Expected tracker peer to be accepted, got %d", added)
+	}
+}
+
+func TestPeerPoolCanonicalPriority(t *testing.T) {
+	pool := newPeerPool(clock.Real)
+	self := &net.TCPAddr{IP: net.IPv4(123, 213, 32, 10), Port: 6881}
+	pool.self = func(ipv6 bool) *net.TCPAddr {
+		if ipv6 {
+			return nil
+		}
+		return self
+	}
+	peers := []tracker.Peer{testPeer(1), testPeer(2), testPeer(3), testPeer(4)}
+	pool.Add(SourceTracker, peers)
+
+	// Peers from the same source are dialed in order of their priority
+	taken := pool.Take(len(peers))
+	for i := 1; i < len(taken); i++ {
+		prev := peer.Priority(self, &net.TCPAddr{IP: taken[i-1].IP, Port: int(taken[i-1].Port)})
+		next := peer.Priority(self, &net.TCPAddr{IP: taken[i].IP, Port: int(taken[i].Port)})
+		if prev < next {
+			t.Errorf("Expected peers in descending priority, got %08x before %08x", prev, next)
+		}
+	}
+}
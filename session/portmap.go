@@ -0,0 +1,79 @@
+package session
+
+import (
+	"context"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/portmap"
+)
+
+// Port mapping tuning
+const (
+	mappingLifetime  = time.Hour        // Lifetime requested from the gateway
+	mappingRetryWait = 5 * time.Minute  // Pause after the gateway failed to map the port
+	minRenewWait     = 30 * time.Second // Lower bound on renewals if the gateway grants short lifetimes
+)
+
+// mapPort keeps the listen port forwarded on the gateway and advertises the
+// external port it was given, until the session closes
+func (s *Session) mapPort(client *portmap.Client) {
+	defer s.wg.Done()
+
+	var m *portmap.Mapping
+	for {
+		var err error
+		renewing := m != nil
+		if m == nil {
+			m, err = client.AddMapping(s.ctx, "tcp", s.cfg.Port, mappingLifetime)
+		} else {
+			m, err = client.Renew(s.ctx, m, mappingLifetime)
+		}
+
+		wait := mappingRetryWait
+		if err != nil {
+			if s.ctx.Err() == nil {
+				s.log.Warn("port mapping failed", "port", s.cfg.Port, "retry_in", wait, "error", err)
+			}
+			m = nil
+			s.portMapped.Store(false)
+			s.setAnnouncePort(s.cfg.Port)
+		} else {
+			if !renewing {
+				s.log.Info("port mapped", "port", s.cfg.Port, "external_port", m.ExternalPort, "method", m.Method)
+			}
+			s.portMapped.Store(true)
+			s.setAnnouncePort(m.ExternalPort)
+			// The gateway's address counts as one more report of our external IP
+			if m.ExternalIP != nil {
+				s.reportExternalIP("gateway", m.ExternalIP)
+			}
+			wait = max(m.Lifetime/2, minRenewWait)
+		}
+
+		select {
+		case <-s.clock.After(wait):
+		case <-s.ctx.Done():
+			if m != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+				client.DeleteMapping(ctx, m)
+				cancel()
+			}
+			return
+		}
+	}
+}
+
+// setAnnouncePort records the port advertised to trackers and the DHT
+func (s *Session) setAnnouncePort(port uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.announcePort = port
+}
+
+// AnnouncePort returns the TCP port advertised to trackers and the DHT: the
+// external port from the gateway when port mapping succeeded, Config.Port otherwise
+func (s *Session) AnnouncePort() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.announcePort
+}
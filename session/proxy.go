@@ -0,0 +1,82 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/omkarkirpan/bittorrent-client/bind"
+	"github.com/omkarkirpan/bittorrent-client/socks5"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+)
+
+// useProxy routes peer connections through the SOCKS5 proxy. In strict mode
+// nothing falls back to a direct connection; NewHTTPClient sends tracker
+// requests through it too.
+func (s *Session) useProxy() {
+	direct := s.dial
+	if direct == nil {
+		direct = (&net.Dialer{}).DialContext
+	}
+	s.proxy = &socks5.Dialer{
+		ProxyAddr: s.cfg.Proxy,
+		Username:  s.cfg.ProxyUsername,
+		Password:  s.cfg.ProxyPassword,
+		Forward:   direct,
+	}
+
+	if s.cfg.ProxyStrict {
+		s.dial = s.proxy.DialContext
+		return
+	}
+
+	// Fall back to a direct connection only when the proxy is down
+	s.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := s.proxy.DialContext(ctx, network, addr)
+		if errors.Is(err, socks5.ErrProxyUnavailable) {
+			return direct(ctx, network, addr)
+		}
+		return conn, err
+	}
+}
+
+// NewHTTPClient returns the client a session with cfg talks to trackers, web
+// seeds and blocklist servers with: bound to BindAddress, and in strict proxy
+// mode sent through the proxy, so that web traffic can't take another route.
+// Fetching .torrent files by URL should use it too, even before the session
+// starts. Otherwise it is cfg.HTTPClient or tracker.DefaultClient.
+func NewHTTPClient(cfg Config) (*http.Client, error) {
+	strict := cfg.Proxy != "" && cfg.ProxyStrict
+	if cfg.BindAddress == "" && !strict {
+		if cfg.HTTPClient != nil {
+			return cfg.HTTPClient, nil
+		}
+		return tracker.DefaultClient, nil
+	}
+
+	dial := (&net.Dialer{Timeout: tracker.ConnectTimeout}).DialContext
+	if cfg.BindAddress != "" {
+		b, err := bind.Parse(cfg.BindAddress)
+		if err != nil {
+			return nil, err
+		}
+		dial = b.DialContext
+	}
+	if strict {
+		proxy := &socks5.Dialer{
+			ProxyAddr: cfg.Proxy,
+			Username:  cfg.ProxyUsername,
+			Password:  cfg.ProxyPassword,
+			Forward:   dial,
+		}
+		dial = proxy.DialContext
+	}
+	return &http.Client{Transport: tracker.NewTransport(dial)}, nil
+}
+
+// HTTPClient returns the client the session talks to trackers with, see
+// NewHTTPClient
+func (s *Session) HTTPClient() *http.Client {
+	return s.http
+}
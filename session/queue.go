@@ -0,0 +1,187 @@
+package session
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"time"
+)
+
+// Queue tuning
+const (
+	// A download that has received nothing for this long stops taking up one
+	// of Config.MaxActiveDownloads, so a queued torrent can start
+	stallTime = 5 * time.Minute
+)
+
+// errSeedQueued ends a run whose torrent completed while every seeding slot
+// was taken
+var errSeedQueued = errors.New("queued for seeding")
+
+// ForceStart reports whether the torrent runs regardless of
+// Config.MaxActiveDownloads and Config.MaxActiveSeeds
+func (t *Torrent) ForceStart() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.forceStart
+}
+
+// SetForceStart lets the torrent run regardless of the session's active
+// limits, without taking up a slot, and starts it at once if it is queued.
+// Turning it off again puts the torrent back under the limits, where it
+// keeps running but takes up a slot.
+func (t *Torrent) SetForceStart(force bool) error {
+	s := t.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.torrents[t.infoHash] != t {
+		return errRemoved
+	}
+
+	t.mu.Lock()
+	t.forceStart = force
+	queued := t.state == StateQueued
+	t.mu.Unlock()
+	t.log.Info("forced start changed", "force", force)
+	if queued && s.ctx.Err() == nil {
+		s.admit(t)
+	}
+	return nil
+}
+
+// QueuePosition returns the torrent's place in the queue, from 1 for the
+// next to start, or 0 if it isn't queued
+func (t *Torrent) QueuePosition() int {
+	return slices.Index(t.session.Queue(), t) + 1
+}
+
+// Queue returns the queued torrents in the order they start: the order they
+// were added
+func (s *Session) Queue() []*Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queued()
+}
+
+// queued returns the queued torrents in the order they start. The caller
+// must hold s.mu.
+func (s *Session) queued() []*Torrent {
+	var queue []*Torrent
+	for _, t := range s.torrents {
+		if t.State() == StateQueued {
+			queue = append(queue, t)
+		}
+	}
+	slices.SortFunc(queue, func(a, b *Torrent) int { return cmp.Compare(a.queueSeq, b.queueSeq) })
+	return queue
+}
+
+// slotFree reports whether a torrent other than t can start downloading, or
+// seeding, within Config.MaxActiveDownloads or Config.MaxActiveSeeds.
+// Forced torrents and stalled downloads don't count. The caller must hold
+// s.mu.
+func (s *Session) slotFree(t *Torrent, seeding bool) bool {
+	limit := s.cfg.MaxActiveDownloads
+	if seeding {
+		limit = s.cfg.MaxActiveSeeds
+	}
+	if limit <= 0 {
+		return true
+	}
+
+	now := s.clock.Now()
+	active := 0
+	for _, other := range s.torrents {
+		if other == t {
+			continue
+		}
+		other.mu.Lock()
+		switch {
+		case other.forceStart:
+		case seeding && other.state == StateSeeding:
+			active++
+		case !seeding && (other.state == StateFetchingMetadata || other.state == StateDownloading) && now.Sub(other.progressAt) < stallTime:
+			active++
+		}
+		other.mu.Unlock()
+	}
+	return active < limit
+}
+
+// admit runs t if it is forced or a slot is free for it, and queues it
+// otherwise. Complete torrents need a seeding slot when the session seeds
+// and a downloading one, briefly, when it doesn't. The caller must hold
+// s.mu.
+func (s *Session) admit(t *Torrent) {
+	t.mu.Lock()
+	seeding := s.cfg.Seed && t.meta != nil && t.piecesDone >= t.wanted
+	forced, state, stopped := t.forceStart, t.state, t.stopped
+	t.mu.Unlock()
+
+	select {
+	case <-stopped:
+	default:
+		return // its last run is still stopping, and promotes the queue once it has
+	}
+
+	if !forced && !s.slotFree(t, seeding) {
+		if state != StateQueued {
+			t.mu.Lock()
+			t.state = StateQueued
+			t.mu.Unlock()
+			t.log.Info("torrent queued")
+		}
+		return
+	}
+	t.mu.Lock()
+	t.state = StateFetchingMetadata
+	if t.meta != nil {
+		t.state = StateDownloading
+	}
+	t.mu.Unlock()
+	s.runTorrent(t)
+}
+
+// promote starts queued torrents, in the order they were added, while slots
+// are free for them. It is called whenever a torrent's run stops, as it
+// completes, stops seeding or is paused or removed, when a download moves on
+// to seeding, and regularly to notice stalled downloads.
+func (s *Session) promote() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		return
+	}
+	for _, t := range s.queued() {
+		s.admit(t)
+	}
+}
+
+// startSeeding moves a torrent that completed its download to seeding if a
+// seeding slot is free, and to the queue otherwise, reporting which, and
+// whether it had been queued for seeding before, so its completion was
+// already handled. Either way its downloading slot goes to the next queued
+// torrent: at once when it seeds, and once its run has stopped when it is
+// queued.
+func (t *Torrent) startSeeding() (seeding, requeued bool) {
+	s := t.session
+	s.mu.Lock()
+	t.mu.Lock()
+	forced := t.forceStart
+	t.mu.Unlock()
+	seeding = forced || s.slotFree(t, true)
+	t.mu.Lock()
+	requeued = t.seedQueued
+	t.seedQueued = !seeding
+	t.state = StateSeeding
+	if !seeding {
+		t.state = StateQueued
+	}
+	t.mu.Unlock()
+	s.mu.Unlock()
+
+	if seeding {
+		s.promote()
+	}
+	return seeding, requeued
+}
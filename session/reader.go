@@ -0,0 +1,142 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/omkarkirpan/bittorrent-client/download"
+)
+
+// Reader reads one file of a torrent while it downloads. A read blocks until
+// the piece under it has been written, fetching that piece ahead of the
+// others, so the reader can back an HTTP response to a media player. It
+// implements io.ReadSeekCloser.
+type Reader struct {
+	t           *Torrent
+	ctx         context.Context
+	span        download.FileSpan
+	pieceLength int64
+	pos         int64
+	f           *os.File // opened at the first read, once the file exists
+}
+
+// NewReader returns a reader for the file at index, in torrent order. Reads
+// fail once ctx is done. The torrent's metadata must be known.
+func (t *Torrent) NewReader(ctx context.Context, index int) (*Reader, error) {
+	tf := t.Metadata()
+	if tf == nil {
+		return nil, errors.New("torrent metadata not fetched yet")
+	}
+	spans, err := download.FileSpans(tf, t.session.layout())
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index >= len(spans) {
+		return nil, fmt.Errorf("torrent has no file %d", index)
+	}
+	return &Reader{t: t, ctx: ctx, span: spans[index], pieceLength: tf.Info.PieceLength}, nil
+}
+
+// Size returns the length of the file
+func (r *Reader) Size() int64 {
+	return r.span.Length
+}
+
+// Read reads up to the end of the current piece, waiting for it to be
+// downloaded first
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.span.Length {
+		return 0, io.EOF
+	}
+	off := r.span.Offset + r.pos
+	piece := off / r.pieceLength
+	if err := r.t.waitPiece(r.ctx, int(piece)); err != nil {
+		return 0, err
+	}
+	if r.f == nil {
+		f, err := os.Open(r.span.Path)
+		if err != nil {
+			return 0, err
+		}
+		r.f = f
+	}
+
+	n := min(int64(len(p)), r.span.Length-r.pos, (piece+1)*r.pieceLength-off)
+	read, err := r.f.ReadAt(p[:n], r.pos)
+	r.pos += int64(read)
+	if err == io.EOF && read > 0 {
+		err = nil
+	}
+	return read, err
+}
+
+// Seek sets the offset of the next read
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.span.Length
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close closes the file
+func (r *Reader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
+
+// waitPiece blocks until a piece has been written, ctx is done or the
+// torrent finishes without it. A missing piece, and the ones after it, move
+// to the front of the download queue, so a reader seeking ahead doesn't
+// wait for everything in between.
+func (t *Torrent) waitPiece(ctx context.Context, index int) error {
+	for bumped := false; ; bumped = true {
+		t.mu.Lock()
+		if index < len(t.written) && t.written[index] {
+			t.mu.Unlock()
+			return nil
+		}
+		if index < len(t.priorities) && t.priorities[index] == download.PrioritySkip {
+			t.mu.Unlock()
+			return fmt.Errorf("piece %d belongs to skipped files", index)
+		}
+		wake, done := t.wake, t.done
+		t.mu.Unlock()
+		if !bumped {
+			t.readahead(index)
+		}
+
+		select {
+		case <-wake:
+		case <-done:
+			// The last piece may have been written just before
+			t.mu.Lock()
+			ok := index < len(t.written) && t.written[index]
+			err := t.err
+			t.mu.Unlock()
+			if ok {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("torrent stopped before piece %d was downloaded", index)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
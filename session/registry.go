@@ -0,0 +1,127 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/omkarkirpan/bittorrent-client/magnet"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// Registry entries: a torrent's .torrent file once its metadata is known,
+// and a magnet link before, or for a mutable torrent, which has to be
+// followed by its key
+const (
+	registryTorrent = ".torrent"
+	registryMagnet  = ".magnet"
+)
+
+// remember records t in the state directory's registry, so the next session
+// with Config.KeepTorrents adds it again. It is called as t is added and
+// again once its metadata is fetched.
+func (t *Torrent) remember() {
+	s := t.session
+	if !s.cfg.KeepTorrents || s.cfg.StateDir == "" {
+		return
+	}
+
+	ext, data := registryMagnet, []byte(t.magnet().String()+"\n")
+	if meta := t.Metadata(); meta != nil && t.mutable == nil {
+		encoded, err := meta.Encode()
+		if err != nil {
+			t.log.Warn("failed to remember torrent", "error", err)
+			return
+		}
+		ext, data = registryTorrent, encoded
+	}
+
+	// Write a temporary file first so a crash can't leave half a file behind
+	base := filepath.Join(s.cfg.StateDir.Registry(), fmt.Sprintf("%x", t.infoHash))
+	err := os.MkdirAll(filepath.Dir(base), 0700)
+	if err == nil {
+		err = os.WriteFile(base+ext+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(base+ext+".tmp", base+ext)
+	}
+	if err != nil {
+		t.log.Warn("failed to remember torrent", "error", err)
+		return
+	}
+	if ext == registryTorrent {
+		os.Remove(base + registryMagnet)
+	}
+}
+
+// forget removes t from the state directory's registry
+func (t *Torrent) forget() {
+	s := t.session
+	if !s.cfg.KeepTorrents || s.cfg.StateDir == "" {
+		return
+	}
+	base := filepath.Join(s.cfg.StateDir.Registry(), fmt.Sprintf("%x", t.infoHash))
+	for _, ext := range []string{registryTorrent, registryMagnet} {
+		if err := os.Remove(base + ext); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.log.Warn("failed to forget torrent", "error", err)
+		}
+	}
+}
+
+// magnet returns a magnet link for t, with its trackers, direct peers,
+// selected files and, for a mutable torrent, its publisher's key
+func (t *Torrent) magnet() *magnet.Magnet {
+	m := &magnet.Magnet{
+		InfoHash:   t.infoHash,
+		Name:       t.Name(),
+		Trackers:   t.trackers,
+		Peers:      t.direct,
+		SelectOnly: t.selectOnly,
+	}
+	if t.mutable != nil {
+		m.PublicKey, m.Salt = t.mutable.key[:], t.mutable.salt
+	}
+	return m
+}
+
+// restoreTorrents adds the torrents remembered in the state directory's
+// registry. Entries that can't be added are logged and skipped.
+func (s *Session) restoreTorrents() {
+	dir := s.cfg.StateDir.Registry()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			s.log.Warn("torrent registry unreadable", "error", err)
+		}
+		return
+	}
+
+	restored := 0
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		var err error
+		switch filepath.Ext(e.Name()) {
+		case registryTorrent:
+			var tf *torrent.TorrentFile
+			if tf, err = torrent.ParseFromFile(path); err == nil {
+				_, err = s.AddTorrent(tf)
+			}
+		case registryMagnet:
+			var data []byte
+			if data, err = os.ReadFile(path); err == nil {
+				_, err = s.AddMagnet(strings.TrimSpace(string(data)))
+			}
+		default:
+			continue // e.g. a temporary file left by a crash
+		}
+		if err != nil {
+			s.log.Warn("failed to restore torrent", "path", path, "error", err)
+			continue
+		}
+		restored++
+	}
+	s.log.Info("restored torrents", "torrents", restored)
+}
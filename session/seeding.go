@@ -0,0 +1,98 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errSeedPaused ends a run that paused the torrent at its seeding limit
+var errSeedPaused = errors.New("paused at the seeding limit")
+
+// SeedLimits say when a complete torrent stops seeding: once it has
+// uploaded Ratio times its size or has seeded for Time, whichever comes
+// first. With a StateDir both count earlier runs too. Zero fields set no
+// limit.
+type SeedLimits struct {
+	Ratio float64
+	Time  time.Duration
+
+	// Pause pauses the torrent at the limit instead of completing it, so it
+	// stays in the session and can be resumed. Limits that count earlier
+	// runs are reached again right away, so raise them before resuming.
+	Pause bool
+}
+
+// SeedLimits returns the torrent's seeding limits: those set with
+// SetSeedLimits, or else the session's SeedRatio, SeedTime and SeedPause
+func (t *Torrent) SeedLimits() SeedLimits {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.seedLimits != nil {
+		return *t.seedLimits
+	}
+	cfg := t.session.cfg
+	return SeedLimits{Ratio: cfg.SeedRatio, Time: cfg.SeedTime, Pause: cfg.SeedPause}
+}
+
+// SetSeedLimits gives the torrent its own seeding limits instead of the
+// session's, or the session's again if limits is nil. A seeding torrent
+// picks them up within a second. They only apply when the session seeds.
+func (t *Torrent) SetSeedLimits(limits *SeedLimits) error {
+	if limits != nil && (limits.Ratio < 0 || limits.Time < 0) {
+		return errors.New("seeding limits can't be negative")
+	}
+	t.mu.Lock()
+	if limits != nil {
+		own := *limits
+		limits = &own
+	}
+	t.seedLimits = limits
+	t.mu.Unlock()
+	if limits == nil {
+		t.log.Info("seeding limits reset to the session's")
+	} else {
+		t.log.Info("seeding limits changed", "ratio", limits.Ratio, "time", limits.Time, "pause", limits.Pause)
+	}
+	return nil
+}
+
+// seedUntilLimit calls reached once the torrent has reached its
+// SeedLimits, telling it whether to pause, and otherwise waits for ctx to be
+// cancelled
+func (t *Torrent) seedUntilLimit(ctx context.Context, reached func(pause bool)) {
+	clk := t.session.clock
+	start := clk.Now()
+	ticker := clk.NewTicker(seedCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			return
+		}
+
+		limits := t.SeedLimits()
+		if limits.Ratio <= 0 && limits.Time <= 0 {
+			continue
+		}
+
+		// Uploads and seeding of earlier runs count too
+		stats := t.Stats()
+		ratio, seeded := stats.Ratio(), clk.Since(start)
+		if lifetime, ok := t.Lifetime(); ok {
+			ratio = max(ratio, lifetime.Ratio())
+			seeded = max(seeded, lifetime.Seeding)
+		}
+		if limits.Ratio > 0 && ratio >= limits.Ratio {
+			t.log.Info("seed ratio reached", "ratio", ratio, "pause", limits.Pause)
+			reached(limits.Pause)
+			return
+		}
+		if limits.Time > 0 && seeded >= limits.Time {
+			t.log.Info("seed time reached", "ratio", ratio, "seeded", seeded, "pause", limits.Pause)
+			reached(limits.Pause)
+			return
+		}
+	}
+}
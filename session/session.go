@@ -0,0 +1,853 @@
+// Package session manages torrents that share a peer ID, a DHT node and a
+// download directory. It ties peer discovery, metadata fetching for magnet
+// links and the download engine together.
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/bind"
+	"github.com/omkarkirpan/bittorrent-client/blocklist"
+	"github.com/omkarkirpan/bittorrent-client/clock"
+	"github.com/omkarkirpan/bittorrent-client/dht"
+	"github.com/omkarkirpan/bittorrent-client/download"
+	"github.com/omkarkirpan/bittorrent-client/events"
+	"github.com/omkarkirpan/bittorrent-client/logging"
+	"github.com/omkarkirpan/bittorrent-client/magnet"
+	"github.com/omkarkirpan/bittorrent-client/peer"
+	"github.com/omkarkirpan/bittorrent-client/portmap"
+	"github.com/omkarkirpan/bittorrent-client/ratelimit"
+	"github.com/omkarkirpan/bittorrent-client/socks5"
+	"github.com/omkarkirpan/bittorrent-client/statedir"
+	"github.com/omkarkirpan/bittorrent-client/stats"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+	"github.com/omkarkirpan/bittorrent-client/transport"
+)
+
+// Errors returned when looking up torrents, for errors.Is
+var (
+	ErrTorrentNotFound = errors.New("torrent not found")
+	ErrTorrentExists   = errors.New("torrent already added")
+)
+
+// DefaultPort is the TCP port peers are accepted on unless Config.Port says
+// otherwise
+const DefaultPort = 6881
+
+// DefaultThrottleRate is the upload rate in bytes per second shared by peers
+// the client policy throttles unless Config.ThrottleRate says otherwise
+const DefaultThrottleRate = 16 << 10
+
+// Config controls a Session
+type Config struct {
+	DownloadDir string       // Where torrent content is written
+	Rename      string       // Saves content under this name instead of the torrent's; for sessions with one torrent
+	Flat        bool         // Put a multi-file torrent's files directly in DownloadDir, without its folder
+	StateDir    statedir.Dir // Keeps resume data and other state between runs; empty keeps resume data in DownloadDir
+	Port        uint16       // Preferred TCP port for incoming peers; defaults to DefaultPort
+	RandomPort  bool         // Listen on a random port picked at every start instead of Port
+	PortRange   [2]uint16    // First and last port to try when Port is taken, e.g. {6881, 6889}
+	DisableIPv4 bool         // Don't accept incoming peers over IPv4
+	DisableIPv6 bool         // Don't accept incoming peers over IPv6
+	NoListen    bool         // Don't accept incoming peers at all and don't announce ourselves to the DHT
+	DisableDHT  bool         // Don't start a DHT node
+	NoHolepunch bool         // Don't connect to or relay for peers behind NATs through other peers (BEP 55)
+	DHT         dht.Config   // DHT settings when enabled; port 0 shares the listen port
+	BindAddress string       // Local IP or interface name (e.g. a VPN's "tun0") all sockets use
+	PortMapping bool         // Forward Port on the gateway with PCP, NAT-PMP or UPnP
+	Gateway     net.IP       // Gateway for port mapping; defaults to the system default gateway
+
+	Proxy         string // host:port of a SOCKS5 proxy for outgoing peer connections
+	ProxyUsername string // Optional proxy credentials
+	ProxyPassword string
+	ProxyUDP      bool // Also relay DHT traffic through the proxy (UDP ASSOCIATE)
+	ProxyStrict   bool // Never connect directly: trackers use the proxy too and DHT needs ProxyUDP
+
+	// Transport dials and accepts peer connections, e.g. over uTP or an
+	// in-memory network in tests. Nil uses TCP. Trackers and the DHT don't
+	// use it.
+	Transport transport.Transport
+
+	// Hooks are called as peers connect, blocks arrive, trackers answer and
+	// pieces are checked, e.g. to feed metrics
+	Hooks Hooks
+
+	// Clock, if set, replaces the system clock for the session's timers,
+	// such as seeding limits, retries and stalled pieces, so tests can
+	// advance time instead of sleeping
+	Clock clock.Clock
+
+	// HTTPClient talks to HTTP trackers and blocklist servers; nil uses
+	// tracker.DefaultClient, which has connect and response timeouts.
+	// BindAddress and ProxyStrict replace it, so tracker traffic can't take
+	// another route.
+	HTTPClient *http.Client
+
+	PeerTimeout time.Duration // Fail a torrent after this long without peers; 0 waits forever
+	MaxPeers    int           // Peers connected to per torrent; defaults to 50
+	NumWant     int           // Peers asked of each tracker per announce; 0 lets the tracker decide
+
+	// MaxConnections is the peer connection budget shared by all torrents,
+	// downloading ones getting more than seeds; see Torrent.MaxConnections.
+	// Defaults to 500.
+	MaxConnections int
+
+	// Sequential fetches the first and last piece of every file first and
+	// the rest in order, keeping the next few missing pieces ahead of the
+	// others, so media players can start before the download ends
+	Sequential bool
+
+	MaxDownload int64 // Bytes per second of piece data received across all torrents; 0 is unlimited
+	MaxUpload   int64 // Bytes per second of piece data sent across all torrents; 0 is unlimited
+
+	// OnComplete, if set, is called in its own goroutine once a torrent has
+	// downloaded every wanted piece, e.g. to run post-processing. Close waits
+	// for it to return.
+	OnComplete func(t *Torrent)
+
+	// SelectFiles, if set, is called once a torrent's metadata is known and
+	// returns a priority per file in torrent order, e.g. to skip files. Nil
+	// downloads every file. An error fails the torrent.
+	SelectFiles func(tf *torrent.TorrentFile) ([]download.Priority, error)
+
+	Seed      bool          // Keep uploading after a download completes instead of finishing
+	SeedRatio float64       // With Seed, stop once this many times the torrent size was uploaded, counting earlier runs with a StateDir; 0 means no limit
+	SeedTime  time.Duration // With Seed, stop after seeding this long, counting earlier runs with a StateDir; 0 means no limit
+	SeedPause bool          // Pause torrents that reach SeedRatio or SeedTime instead of completing them
+
+	// KeepTorrents remembers added torrents in StateDir's registry until
+	// they're removed, and adds them again when the session starts, so a
+	// restarted daemon carries on with them
+	KeepTorrents bool
+
+	// AnnounceWhilePaused keeps a paused torrent's regular announces going,
+	// asking for no peers, so it stays listed in the swarm, instead of
+	// leaving the trackers with a stopped announce
+	AnnounceWhilePaused bool
+
+	Blocklist        string        // Path or URL of a P2P, DAT or CIDR blocklist, optionally gzipped
+	BlocklistRefresh time.Duration // How often the blocklist is reloaded; defaults to daily
+
+	// BanAfter, if set, bans a peer's IP for the rest of the session once
+	// this many pieces it sent to one torrent failed the hash check, so a
+	// peer poisoning the swarm can't keep a download retrying forever
+	BanAfter int
+
+	// WriteCache, if set, is how many bytes of verified pieces each torrent
+	// holds in memory before writing them together in torrent order. The
+	// cache is flushed when a download completes, is paused or stopped.
+	WriteCache int64
+
+	// Allocate is how a torrent's files get their disk space when its
+	// download starts. Either way the download fails at once, with
+	// download.ErrDiskFull, if the disk lacks room for what is left.
+	Allocate download.Allocation
+
+	// UpdateInterval, if set, is how often torrents whose metadata names an
+	// update feed (BEP 39), and mutable torrents (BEP 46), check for a newer
+	// version, which is then added alongside. RetireUpdated removes a torrent,
+	// keeping its files, once the version that replaced it completes.
+	UpdateInterval time.Duration
+	RetireUpdated  bool
+
+	// ClientPolicy refuses or throttles peers by the client they run, as
+	// guessed from their peer ID or reported in their extension handshake.
+	// Throttled peers share ThrottleRate bytes per second of uploads, which
+	// defaults to DefaultThrottleRate.
+	ClientPolicy peer.ClientPolicy
+	ThrottleRate int64
+
+	// AltMaxDownload and AltMaxUpload are the alternative rate limits
+	// ("turtle mode") that SetAltSpeed switches to, in bytes per second; 0 is
+	// unlimited. AltSpeed starts the session with them in effect, and
+	// AltSchedule, if set, switches to them during its window and back after.
+	AltMaxDownload int64
+	AltMaxUpload   int64
+	AltSpeed       bool
+	AltSchedule    *Schedule
+
+	// BandwidthSchedule's rules take over from MaxDownload and MaxUpload
+	// during their windows, the first that applies winning, unless the
+	// alternative limits are in effect. See BandwidthRule.
+	BandwidthSchedule []BandwidthRule
+
+	// MaxActiveDownloads and MaxActiveSeeds, if set, are how many torrents
+	// download and seed at once. The others wait in StateQueued, in the
+	// order they were added, and start as slots free up: when a torrent
+	// completes, stops seeding, is paused or removed, or, for downloads, has
+	// received nothing for five minutes. Torrents started with
+	// Torrent.SetForceStart don't count.
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+
+	Logger *slog.Logger // Receives log records from the session and its torrents; nil discards them
+}
+
+// Session runs any number of torrents
+type Session struct {
+	cfg    Config
+	peerID [20]byte
+	key    uint32       // sent with every announce, so trackers know us when our IP changes
+	logger *slog.Logger // base logger handed to components
+	log    *slog.Logger
+	clock  clock.Clock
+
+	listeners []net.Listener
+	bind      *bind.Binding  // nil when sockets aren't bound
+	dial      peer.DialFunc  // opens peer connections from the bind address or via the proxy
+	http      *http.Client   // talks to HTTP trackers and blocklist servers
+	proxy     *socks5.Dialer // nil without a proxy
+
+	downLimit *ratelimit.Limiter // shared by every torrent's download
+	upLimit   *ratelimit.Limiter
+	throttled *ratelimit.Limiter // shared by peers throttled by the client policy
+
+	limitsMu  sync.Mutex
+	limits    [2]int64 // normal download and upload limits
+	altLimits [2]int64 // alternative limits, in effect when altSpeed is set
+	altSpeed  bool
+	rule      *BandwidthRule // the BandwidthSchedule rule in effect, nil if none
+
+	blocklist    atomic.Pointer[blocklist.List]
+	blockedConns atomic.Int64
+	blockedPeers atomic.Int64
+	blockedDHT   atomic.Int64
+
+	bannedMu sync.Mutex
+	banned   map[string]bool // IPs of peers banned for sending corrupt pieces
+
+	events   events.Bus
+	lifetime *stats.DB // nil without a state directory
+
+	externalIPs ipVotes      // our address as trackers and peers see it
+	incoming    atomic.Int64 // connections peers opened to us
+	portMapped  atomic.Bool  // the gateway forwards the listen port
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	dhtWG  sync.WaitGroup // DHT bootstrap goroutines
+	hookWG sync.WaitGroup // running OnComplete calls
+
+	mu           sync.Mutex
+	torrents     map[[20]byte]*Torrent
+	announcePort uint16
+	dht          *dht.Server
+	dhtReady     chan struct{} // closed once the DHT bootstrap has finished
+	queueSeq     uint64        // torrents added so far, numbering their places in the queue
+}
+
+// Option changes a Config field, for callers that prefer options to filling
+// in the struct
+type Option func(*Config)
+
+// WithMaxPeers sets how many peers each torrent connects to
+func WithMaxPeers(n int) Option {
+	return func(cfg *Config) { cfg.MaxPeers = n }
+}
+
+// WithPort sets the preferred TCP port for incoming peers
+func WithPort(port uint16) Option {
+	return func(cfg *Config) { cfg.Port = port }
+}
+
+// WithLogger sets where log records from the session and its torrents go
+func WithLogger(l *slog.Logger) Option {
+	return func(cfg *Config) { cfg.Logger = l }
+}
+
+// New creates a session and, unless disabled, starts joining the DHT. Options
+// are applied to cfg in order before anything starts.
+func New(cfg Config, opts ...Option) (*Session, error) {
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.DownloadDir == "" {
+		cfg.DownloadDir = "."
+	}
+	if cfg.Port == 0 {
+		cfg.Port = DefaultPort
+	}
+	if cfg.ThrottleRate <= 0 {
+		cfg.ThrottleRate = DefaultThrottleRate
+	}
+	if cfg.MaxPeers < 0 {
+		return nil, fmt.Errorf("invalid peer limit %d", cfg.MaxPeers)
+	}
+	if cfg.MaxPeers == 0 {
+		cfg.MaxPeers = defaultMaxPeers
+	}
+	if cfg.MaxConnections < 0 {
+		return nil, fmt.Errorf("invalid connection limit %d", cfg.MaxConnections)
+	}
+	if cfg.MaxConnections == 0 {
+		cfg.MaxConnections = defaultMaxConnections
+	}
+	if cfg.Rename != "" {
+		if err := download.ValidateName(cfg.Rename); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Session{
+		cfg:       cfg,
+		peerID:    peer.GenerateID(),
+		key:       announceKey(),
+		torrents:  make(map[[20]byte]*Torrent),
+		logger:    logging.Or(cfg.Logger),
+		clock:     clock.Or(cfg.Clock),
+		downLimit: ratelimit.New(cfg.MaxDownload, ratelimit.WithClock(cfg.Clock)),
+		upLimit:   ratelimit.New(cfg.MaxUpload, ratelimit.WithClock(cfg.Clock)),
+		throttled: ratelimit.New(cfg.ThrottleRate, ratelimit.WithClock(cfg.Clock)),
+		limits:    [2]int64{cfg.MaxDownload, cfg.MaxUpload},
+		altLimits: [2]int64{cfg.AltMaxDownload, cfg.AltMaxUpload},
+		altSpeed:  cfg.AltSpeed,
+	}
+	s.applyLimits()
+	s.log = s.logger.With("component", "session")
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	if cfg.DisableIPv4 && cfg.DisableIPv6 {
+		return nil, errors.New("both address families disabled")
+	}
+
+	// Bound sockets fail rather than fall back to another route
+	var err error
+	if s.http, err = NewHTTPClient(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.BindAddress != "" {
+		b, err := bind.Parse(cfg.BindAddress)
+		if err != nil {
+			return nil, err
+		}
+		s.bind = b
+		s.dial = b.DialContext
+	}
+	if cfg.Transport != nil {
+		if cfg.BindAddress != "" {
+			return nil, errors.New("a bind address can't be used with a custom transport")
+		}
+		s.dial = cfg.Transport.DialContext
+	}
+	if cfg.Proxy != "" {
+		s.useProxy()
+	}
+
+	s.openStats()
+	s.wg.Add(1)
+	go s.trackRates()
+	if cfg.UpdateInterval > 0 {
+		s.wg.Add(1)
+		go s.watchUpdates()
+	}
+	if cfg.AltSchedule != nil {
+		s.wg.Add(1)
+		go s.watchAltSchedule()
+	}
+	if len(cfg.BandwidthSchedule) > 0 {
+		s.wg.Add(1)
+		go s.watchBandwidthSchedule()
+	}
+
+	if cfg.Blocklist != "" {
+		if err := s.loadBlocklist(); err != nil {
+			return nil, err
+		}
+		s.wg.Add(1)
+		go s.refreshBlocklist()
+	}
+
+	// The port actually bound is the one advertised everywhere. Trackers
+	// insist on a port even when we don't listen.
+	if cfg.NoListen {
+		if cfg.PortMapping {
+			s.Close()
+			return nil, errors.New("port mapping needs a listen port")
+		}
+		s.log.Info("not listening for peers")
+	} else {
+		if err := s.listen(); err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.log.Info("listening for peers", "addrs", s.ListenAddrs())
+	}
+	s.announcePort = s.cfg.Port
+
+	if cfg.PortMapping {
+		gateway := cfg.Gateway
+		if gateway == nil {
+			var err error
+			if gateway, err = portmap.DefaultGateway(); err != nil {
+				s.Close()
+				return nil, fmt.Errorf("port mapping: %v", err)
+			}
+		}
+		s.wg.Add(1)
+		go s.mapPort(portmap.NewClient(gateway))
+	}
+
+	if cfg.DisableDHT {
+		s.dhtReady = closedChan()
+	} else if err := s.startDHT(cfg.DHT); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if cfg.KeepTorrents && cfg.StateDir != "" {
+		s.restoreTorrents()
+	}
+	return s, nil
+}
+
+// startDHT starts a DHT node and bootstraps it in the background. The caller
+// must hold s.mu or have exclusive access to s.
+func (s *Session) startDHT(cfg dht.Config) error {
+	// Bind the DHT sockets too, dropping families the binding lacks
+	if s.bind != nil {
+		if ip, err := s.bind.LocalIP(false); err == nil {
+			cfg.LocalIPv4 = ip
+		} else {
+			cfg.DisableIPv4 = true
+		}
+		if ip, err := s.bind.LocalIP(true); err == nil {
+			cfg.LocalIPv6 = ip
+		} else {
+			cfg.DisableIPv6 = true
+		}
+		lc := net.ListenConfig{Control: s.bind.Control}
+		cfg.ListenPacket = func(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+			return lc.ListenPacket(s.ctx, network, laddr.String())
+		}
+	}
+
+	cfg.Blocked = s.dhtBlocked
+	if cfg.Logger == nil {
+		cfg.Logger = s.logger.With("component", "dht")
+	}
+
+	if s.proxy != nil && s.cfg.ProxyUDP {
+		// The relay is reached over IPv4, so run an IPv4 DHT only
+		cfg.DisableIPv4, cfg.DisableIPv6 = false, true
+		cfg.ListenPacket = func(network string, laddr *net.UDPAddr) (net.PacketConn, error) {
+			return s.proxy.ListenPacket(s.ctx, laddr)
+		}
+	} else if s.proxy != nil && s.cfg.ProxyStrict {
+		s.dht, s.dhtReady = nil, closedChan()
+		return errors.New("DHT can't run in strict proxy mode without ProxyUDP")
+	}
+
+	// Without an explicit port, share the listen port if it's free over UDP
+	var server *dht.Server
+	var err error
+	if cfg.Port == 0 {
+		shared := cfg
+		shared.Port = int(s.cfg.Port)
+		server, err = dht.NewServer(shared)
+	}
+	if server == nil {
+		server, err = dht.NewServer(cfg)
+	}
+	if err != nil {
+		s.dht, s.dhtReady = nil, closedChan()
+		return fmt.Errorf("failed to start DHT: %v", err)
+	}
+	if s.cfg.StateDir != "" {
+		// Rejoin through the nodes we knew last run rather than the bootstrap nodes
+		if n, err := server.LoadTable(s.cfg.StateDir.DHT()); err == nil {
+			s.log.Info("loaded DHT nodes", "nodes", n)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			s.log.Warn("failed to load DHT nodes", "error", err)
+		}
+	}
+	if ip := s.externalIPs.trusted(false); ip != nil {
+		server.SetExternalIP(ip)
+	}
+	s.dht = server
+	s.dhtReady = s.bootstrap(server)
+	return nil
+}
+
+// bootstrap joins the DHT without blocking the caller, since it takes a few
+// seconds. The returned channel is closed when it has finished.
+func (s *Session) bootstrap(server *dht.Server) chan struct{} {
+	ready := make(chan struct{})
+	s.dhtWG.Add(1)
+	go func() {
+		defer s.dhtWG.Done()
+		defer close(ready)
+		if err := server.Bootstrap(s.ctx); err != nil && s.ctx.Err() == nil {
+			s.log.Warn("DHT bootstrap failed", "error", err)
+		}
+	}()
+	return ready
+}
+
+// saveDHT saves the DHT node's routing table for the next run when there is
+// a state directory. The caller must hold s.mu.
+func (s *Session) saveDHT() {
+	if s.dht == nil || s.cfg.StateDir == "" {
+		return
+	}
+	if err := s.dht.SaveTable(s.cfg.StateDir.DHT()); err != nil {
+		s.log.Warn("failed to save DHT nodes", "error", err)
+	}
+}
+
+// dhtNode returns the DHT node, or nil when DHT is disabled, and a channel
+// that is closed once the node has bootstrapped
+func (s *Session) dhtNode() (*dht.Server, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dht, s.dhtReady
+}
+
+// SetDHTConfig applies new DHT settings to a running session. If only the
+// bootstrap nodes change, the current node keeps its routing table and
+// bootstraps again from the new nodes. Any other change restarts the node.
+func (s *Session) SetDHTConfig(disable bool, cfg dht.Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx.Err() != nil {
+		return errors.New("session is closed")
+	}
+
+	old := s.cfg.DHT
+	s.cfg.DisableDHT = disable
+	s.cfg.DHT = cfg
+
+	if s.dht != nil && !disable && sameSockets(old, cfg) {
+		s.dht.SetBootstrapNodes(cfg.BootstrapNodes)
+		s.dhtReady = s.bootstrap(s.dht)
+		return nil
+	}
+
+	// Release the old sockets first, the new node may need the same port
+	if s.dht != nil {
+		s.saveDHT()
+		s.dht.Close()
+		s.dht, s.dhtReady = nil, closedChan()
+	}
+	if disable {
+		return nil
+	}
+	return s.startDHT(cfg)
+}
+
+// sameSockets reports whether two DHT configs listen on the same sockets in
+// the same mode
+func sameSockets(a, b dht.Config) bool {
+	return a.Port == b.Port && a.DisableIPv4 == b.DisableIPv4 && a.DisableIPv6 == b.DisableIPv6 &&
+		a.ReadOnly == b.ReadOnly && a.LocalIPv4.Equal(b.LocalIPv4) && a.LocalIPv6.Equal(b.LocalIPv6)
+}
+
+// DHTNodes returns the number of nodes in the DHT routing tables, or zeros
+// when DHT is disabled
+func (s *Session) DHTNodes() (ipv4, ipv6 int) {
+	node, _ := s.dhtNode()
+	if node == nil {
+		return 0, 0
+	}
+	return node.NumNodes()
+}
+
+// Subscribe returns a subscription to events of the given types from every
+// torrent, or of every type if none are given. Up to buffer events wait for
+// the subscriber; more are dropped. Closing the session ends it.
+func (s *Session) Subscribe(buffer int, types ...events.Type) *events.Subscription {
+	return s.events.Subscribe(buffer, types...)
+}
+
+// PeerID returns the peer ID used for all torrents of the session
+func (s *Session) PeerID() [20]byte {
+	return s.peerID
+}
+
+// announceKey returns a random tracker key for the session, never 0, which
+// would send none
+func announceKey() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:]) | 1
+}
+
+// RateLimits returns the normal download and upload limits in bytes per
+// second, 0 meaning unlimited. The alternative limits may be in effect
+// instead; see AltSpeed.
+func (s *Session) RateLimits() (download, upload int64) {
+	s.limitsMu.Lock()
+	defer s.limitsMu.Unlock()
+	return s.limits[0], s.limits[1]
+}
+
+// SetRateLimits changes the normal download and upload limits in bytes per
+// second, 0 meaning unlimited. Running transfers pick up the new limits
+// immediately, unless the alternative limits or a BandwidthSchedule rule are
+// in effect.
+func (s *Session) SetRateLimits(download, upload int64) error {
+	if download < 0 || upload < 0 {
+		return errors.New("rate limits can't be negative")
+	}
+	s.limitsMu.Lock()
+	defer s.limitsMu.Unlock()
+	s.limits = [2]int64{download, upload}
+	s.applyLimits()
+	s.log.Info("rate limits changed", "download", download, "upload", upload)
+	return nil
+}
+
+// layout returns where torrent content goes on disk
+func (s *Session) layout() download.Layout {
+	return download.Layout{Dir: s.cfg.DownloadDir, Name: s.cfg.Rename, Flat: s.cfg.Flat}
+}
+
+// AddTorrent starts downloading a parsed torrent file
+func (s *Session) AddTorrent(tf *torrent.TorrentFile) (*Torrent, error) {
+	if !tf.HasV1() {
+		return nil, errors.New("v2-only torrents are not supported yet")
+	}
+	infoHash, err := tf.InfoHash()
+	if err != nil {
+		return nil, err
+	}
+
+	t := newTorrent(s, infoHash, tf.Info.Name, tf.Trackers(), nil)
+	t.setMetadata(tf)
+	return t, s.start(t)
+}
+
+// AddMagnet starts a download from a magnet link. Peers are discovered through
+// the magnet's trackers and the DHT, the metadata is fetched from them with
+// ut_metadata, and then the download proceeds like a regular torrent. The
+// current version of a mutable torrent (BEP 46) is first looked up in the
+// DHT, which can take a few seconds.
+func (s *Session) AddMagnet(uri string) (*Torrent, error) {
+	m, err := magnet.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if node, _ := s.dhtNode(); len(m.Trackers) == 0 && len(m.Peers) == 0 && node == nil {
+		return nil, errors.New("magnet link has no trackers or peers and DHT is disabled")
+	}
+
+	// A mutable torrent starts at the version its publisher last pushed,
+	// unless the link names one
+	var src *mutableSource
+	if m.Mutable() {
+		src = newMutableSource(m)
+		if m.InfoHash == [20]byte{} {
+			ctx, cancel := context.WithTimeout(s.ctx, mutableTimeout)
+			m.InfoHash, src.seq, err = src.resolve(ctx, s)
+			cancel()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	t := newTorrent(s, m.InfoHash, m.Name, m.Trackers, m.Peers)
+	t.selectOnly = m.SelectOnly
+	t.mutable = src
+	return t, s.start(t)
+}
+
+// start registers a torrent and runs it in the background
+func (s *Session) start(t *Torrent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx.Err() != nil {
+		return errors.New("session is closed")
+	}
+	if _, ok := s.torrents[t.infoHash]; ok {
+		return fmt.Errorf("%w: %x", ErrTorrentExists, t.infoHash)
+	}
+	s.torrents[t.infoHash] = t
+	s.queueSeq++
+	t.queueSeq = s.queueSeq
+	t.log.Info("torrent added", "name", t.Name())
+	t.remember()
+	s.admit(t)
+	return nil
+}
+
+// runTorrent runs a torrent in the background until it finishes or is
+// stopped, and then lets queued torrents take the slot it had. The caller
+// must hold s.mu.
+func (s *Session) runTorrent(t *Torrent) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	stopped := make(chan struct{})
+	t.mu.Lock()
+	t.cancel, t.stopped = cancel, stopped
+	t.progressAt = s.clock.Now()
+	t.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.promote()
+		defer close(stopped)
+		defer cancel()
+		t.run(ctx)
+	}()
+}
+
+// Torrent returns the torrent with the given info hash, or nil
+func (s *Session) Torrent(infoHash [20]byte) *Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.torrents[infoHash]
+}
+
+// Remove stops a torrent and removes it from the session. Downloaded files
+// are left on disk.
+func (s *Session) Remove(infoHash [20]byte) error {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	delete(s.torrents, infoHash)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %x", ErrTorrentNotFound, infoHash)
+	}
+
+	t.mu.Lock()
+	cancel, stopped := t.cancel, t.stopped
+	t.mu.Unlock()
+	cancel()
+	<-stopped
+
+	t.recordLifetime(s.clock.Now())
+	t.forget()
+	t.finish(errRemoved)
+	t.log.Info("torrent removed")
+	return nil
+}
+
+// trackRates samples the transfer rates of every torrent, and records their
+// lifetime totals and resume data, until the session is closed
+func (s *Session) trackRates() {
+	defer s.wg.Done()
+
+	ticker := s.clock.NewTicker(rateInterval)
+	defer ticker.Stop()
+	last, saved := s.clock.Now(), s.clock.Now()
+	for {
+		select {
+		case now := <-ticker.C():
+			for _, t := range s.Torrents() {
+				t.sampleRates(now.Sub(last))
+				t.recordLifetime(now)
+				if hook := s.cfg.Hooks.OnStats; hook != nil {
+					hook(t.infoHash, t.Stats())
+				}
+			}
+			s.promote() // in place of downloads that stalled
+			last = now
+			if now.Sub(saved) >= statsSaveInterval {
+				s.saveStats()
+				for _, t := range s.Torrents() {
+					t.saveResume()
+				}
+				saved = now
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// Torrents returns all torrents in the session
+func (s *Session) Torrents() []*Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	torrents := make([]*Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		torrents = append(torrents, t)
+	}
+	return torrents
+}
+
+// Shutdown stops the session cleanly: every torrent is stopped and its files
+// flushed, and trackers are told we're leaving with a stopped announce. Stopped
+// announces still pending when ctx is done are abandoned, and Shutdown then
+// returns ctx's error. The session is closed afterwards either way.
+func (s *Session) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	torrents := make([]*Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		torrents = append(torrents, t)
+	}
+	s.mu.Unlock()
+
+	// Stop the torrents first, so the announces report final totals
+	s.cancel()
+	s.closeListeners()
+	s.wg.Wait()
+
+	var wg sync.WaitGroup
+	for _, t := range torrents {
+		wg.Add(1)
+		go func(t *Torrent) {
+			defer wg.Done()
+			t.announceStopped(ctx)
+		}(t)
+	}
+	wg.Wait()
+	s.log.Info("session shut down", "torrents", len(torrents))
+
+	if err := s.Close(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("stopped announces abandoned: %w", err)
+	}
+	return nil
+}
+
+// Close stops all torrents and the DHT node at once, without notifying
+// trackers. Calling Close after Shutdown is harmless.
+func (s *Session) Close() error {
+	s.cancel()
+	s.closeListeners()
+	s.wg.Wait()
+
+	now := s.clock.Now()
+	for _, t := range s.Torrents() {
+		t.recordLifetime(now)
+	}
+	s.saveStats()
+
+	s.mu.Lock()
+	if s.dht != nil {
+		s.saveDHT()
+		s.dht.Close()
+		s.dht = nil
+	}
+	s.mu.Unlock()
+
+	s.dhtWG.Wait()
+	s.hookWG.Wait()
+	s.events.Close()
+	return nil
+}
+
+// closedChan returns a channel that is already closed
+func closedChan() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
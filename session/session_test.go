@@ -0,0 +1,2422 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+	"github.com/omkarkirpan/bittorrent-client/clock"
+	"github.com/omkarkirpan/bittorrent-client/dht"
+	"github.com/omkarkirpan/bittorrent-client/download"
+	"github.com/omkarkirpan/bittorrent-client/events"
+	"github.com/omkarkirpan/bittorrent-client/logging"
+	"github.com/omkarkirpan/bittorrent-client/peer"
+	"github.com/omkarkirpan/bittorrent-client/peer/peertest"
+	"github.com/omkarkirpan/bittorrent-client/statedir"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+	"github.com/omkarkirpan/bittorrent-client/tracker/trackertest"
+	"github.com/omkarkirpan/bittorrent-client/transport"
+)
+
+// seeder is a fake peer that serves both the metadata and the content of a torrent
+type seeder struct {
+	info        []byte // bencoded info dictionary
+	infoHash    [20]byte
+	data        []byte
+	pieceLength int
+	numPieces   int
+	gate        chan struct{} // if set, each block is only sent once a value is taken from it
+}
+
+func newSeeder(name string, data []byte, pieceLength int) *seeder {
+	var pieces []byte
+	for i := 0; i < len(data); i += pieceLength {
+		hash := sha1.Sum(data[i:min(i+pieceLength, len(data))])
+		pieces = append(pieces, hash[:]...)
+	}
+
+	info, _ := bencode.EncodeDict(map[string]interface{}{
+		"name":         name,
+		"length":       len(data),
+		"piece length": pieceLength,
+		"pieces":       string(pieces),
+	})
+
+	return &seeder{
+		info:        info,
+		infoHash:    sha1.Sum(info),
+		data:        data,
+		pieceLength: pieceLength,
+		numPieces:   len(pieces) / 20,
+	}
+}
+
+// listen accepts connections on localhost and returns the listen address
+func (s *seeder) listen(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	return s.accept(t, ln)
+}
+
+// accept serves the connections ln accepts and returns its address
+func (s *seeder) accept(t *testing.T, ln net.Listener) string {
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (s *seeder) serve(conn net.Conn) {
+	defer conn.Close()
+
+	if _, err := peer.ParseHandshake(conn); err != nil {
+		return
+	}
+	hs := peer.NewHandshake(s.infoHash, [20]byte{'s'})
+	hs.SetExtension(peer.ExtensionExtensions)
+	conn.Write(hs.Serialize())
+
+	s.serveMessages(conn)
+}
+
+// dial connects to addr like a peer that found us, and serves the torrent
+func (s *seeder) dial(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	conn.Write(peer.NewHandshake(s.infoHash, [20]byte{'s'}).Serialize())
+	if _, err := peer.ParseHandshake(conn); err != nil {
+		conn.Close()
+		return err
+	}
+
+	go func() {
+		defer conn.Close()
+		s.serveMessages(conn)
+	}()
+	return nil
+}
+
+// serveMessages sends our bitfield and answers requests after the handshake
+func (s *seeder) serveMessages(conn net.Conn) {
+	bitfield := make([]byte, (s.numPieces+7)/8)
+	for i := 0; i < s.numPieces; i++ {
+		bitfield[i/8] |= 1 << (7 - i%8)
+	}
+	conn.Write(peer.FormatMessage(peer.MsgBitfield, bitfield).Serialize())
+
+	const ourMetadataID = 2
+	var theirMetadataID int64
+	for {
+		msg, err := peer.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		if msg.Length == 0 {
+			continue
+		}
+
+		switch msg.Type {
+		case peer.MsgInterested:
+			conn.Write(peer.FormatMessage(peer.MsgUnchoke, nil).Serialize())
+
+		case peer.MsgRequest:
+			index := binary.BigEndian.Uint32(msg.Payload[0:4])
+			begin := binary.BigEndian.Uint32(msg.Payload[4:8])
+			length := binary.BigEndian.Uint32(msg.Payload[8:12])
+			start := int(index)*s.pieceLength + int(begin)
+			if s.gate != nil {
+				<-s.gate
+			}
+			payload := append(bytes.Clone(msg.Payload[0:8]), s.data[start:start+int(length)]...)
+			conn.Write(peer.FormatMessage(peer.MsgPiece, payload).Serialize())
+
+		case peer.MsgExtended:
+			decoded, _, err := bencode.Decode(msg.Payload[1:])
+			if err != nil {
+				return
+			}
+			dict := decoded.(map[string]interface{})
+
+			if msg.Payload[0] == 0 {
+				// Extension handshake: remember their ut_metadata ID and reply.
+				// Download connections offer no extensions.
+				m, _ := dict["m"].(map[string]interface{})
+				theirMetadataID, _ = m["ut_metadata"].(int64)
+				reply, _ := bencode.EncodeDict(map[string]interface{}{
+					"m":             map[string]interface{}{"ut_metadata": ourMetadataID},
+					"metadata_size": len(s.info),
+				})
+				conn.Write(peer.FormatMessage(peer.MsgExtended, append([]byte{0}, reply...)).Serialize())
+				continue
+			}
+
+			// Metadata request
+			piece := int(dict["piece"].(int64))
+			end := min((piece+1)*16384, len(s.info))
+			header, _ := bencode.EncodeDict(map[string]interface{}{"msg_type": 1, "piece": piece})
+			payload := append([]byte{byte(theirMetadataID)}, header...)
+			payload = append(payload, s.info[piece*16384:end]...)
+			conn.Write(peer.FormatMessage(peer.MsgExtended, payload).Serialize())
+		}
+	}
+}
+
+// newTestSession creates a session listening on a random port
+func newTestSession(t *testing.T, cfg Config) (*Session, error) {
+	t.Helper()
+	cfg.RandomPort = true
+	return New(cfg)
+}
+
+func TestAddMagnet(t *testing.T) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	s := newSeeder("content.bin", data, 32768)
+	addr := s.listen(t)
+
+	dir := t.TempDir()
+	sess, err := newTestSession(t, Config{DownloadDir: dir, DisableDHT: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	uri := "magnet:?xt=urn:btih:" + hex.EncodeToString(s.infoHash[:]) + "&x.pe=" + addr
+	tor, err := sess.AddMagnet(uri)
+	if err != nil {
+		t.Fatalf("AddMagnet failed: %v", err)
+	}
+
+	select {
+	case <-tor.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Download did not finish, state: %v", tor.State())
+	}
+
+	if tor.State() != StateComplete {
+		t.Fatalf("Expected state complete, got %v (err: %v)", tor.State(), tor.Err())
+	}
+	if tor.Name() != "content.bin" {
+		t.Errorf("Expected name from metadata, got %q", tor.Name())
+	}
+	if done, total := tor.Progress(); done != total || total != s.numPieces {
+		t.Errorf("Expected %d/%d pieces, got %d/%d", s.numPieces, s.numPieces, done, total)
+	}
+	if stats := tor.Stats(); stats.Downloaded != int64(len(data)) || stats.Verified != int64(s.numPieces) {
+		t.Errorf("Expected %d bytes and %d pieces verified, got %+v", len(data), s.numPieces, stats)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "content.bin"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Downloaded content does not match")
+	}
+}
+
+func TestAddMagnetSelectOnly(t *testing.T) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	s := newSeeder("content", data, 16384)
+
+	// Two files, the first filling whole pieces
+	var pieces []byte
+	for i := 0; i < len(data); i += s.pieceLength {
+		hash := sha1.Sum(data[i:min(i+s.pieceLength, len(data))])
+		pieces = append(pieces, hash[:]...)
+	}
+	s.info, _ = bencode.EncodeDict(map[string]interface{}{
+		"name":         "content",
+		"piece length": s.pieceLength,
+		"pieces":       string(pieces),
+		"files": []interface{}{
+			map[string]interface{}{"length": 32768, "path": []interface{}{"skipped.bin"}},
+			map[string]interface{}{"length": len(data) - 32768, "path": []interface{}{"wanted.bin"}},
+		},
+	})
+	s.infoHash = sha1.Sum(s.info)
+	addr := s.listen(t)
+
+	dir := t.TempDir()
+	sess, err := newTestSession(t, Config{DownloadDir: dir, DisableDHT: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	// Out of range indices are ignored
+	uri := "magnet:?xt=urn:btih:" + hex.EncodeToString(s.infoHash[:]) + "&x.pe=" + addr + "&so=1,5-7"
+	tor, err := sess.AddMagnet(uri)
+	if err != nil {
+		t.Fatalf("AddMagnet failed: %v", err)
+	}
+	select {
+	case <-tor.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Download did not finish, state: %v", tor.State())
+	}
+
+	if done, total := tor.Progress(); done != total || total != s.numPieces-2 {
+		t.Errorf("Expected %d/%d pieces, got %d/%d", s.numPieces-2, s.numPieces-2, done, total)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "content", "wanted.bin"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(got, data[32768:]) {
+		t.Error("Downloaded content does not match")
+	}
+	if stats := tor.Stats(); stats.Downloaded != int64(len(data)-32768) {
+		t.Errorf("Expected only the selected file's %d bytes downloaded, got %d", len(data)-32768, stats.Downloaded)
+	}
+	expected := []FileProgress{
+		{Path: "skipped.bin", Length: 32768, Done: 0, Priority: download.PrioritySkip},
+		{Path: "wanted.bin", Length: int64(len(data) - 32768), Done: int64(len(data) - 32768)},
+	}
+	if files := tor.Files(); !slices.Equal(files, expected) {
+		t.Errorf("Expected file progress %+v, got %+v", expected, files)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	s := newSeeder("content.bin", data, 32768)
+
+	var network transport.Memory
+	ln, err := network.Listen(context.Background(), "tcp", "10.0.0.2:6881")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := s.accept(t, ln)
+
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, Transport: &network})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	// Incoming peers arrive over the transport too
+	conn, err := network.DialContext(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(sess.cfg.Port))))
+	if err != nil {
+		t.Fatalf("Expected the session to listen on the transport, got %v", err)
+	}
+	conn.Close()
+
+	tor, err := sess.AddMagnet("magnet:?xt=urn:btih:" + hex.EncodeToString(s.infoHash[:]) + "&x.pe=" + addr)
+	if err != nil {
+		t.Fatalf("AddMagnet failed: %v", err)
+	}
+	select {
+	case <-tor.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Download did not finish, state: %v", tor.State())
+	}
+	if tor.State() != StateComplete {
+		t.Fatalf("Expected state complete, got %v (err: %v)", tor.State(), tor.Err())
+	}
+
+	if _, err := New(Config{BindAddress: "127.0.0.1", Transport: &network}); err == nil {
+		t.Error("Expected a bind address with a transport to fail")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	s := newSeeder("content.bin", data, 32768)
+	addr := s.listen(t)
+
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+	sub := sess.Subscribe(100)
+
+	tor, err := sess.AddMagnet("magnet:?xt=urn:btih:" + hex.EncodeToString(s.infoHash[:]) + "&x.pe=" + addr)
+	if err != nil {
+		t.Fatalf("AddMagnet failed: %v", err)
+	}
+	select {
+	case <-tor.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Download did not finish, state: %v", tor.State())
+	}
+
+	// Closing the session ends the subscription once every event is in
+	sess.Close()
+	counts := make(map[events.Type]int)
+	for e := range sub.Events() {
+		if e.InfoHash != s.infoHash {
+			t.Errorf("Expected info hash %x on %v, got %x", s.infoHash, e.Type, e.InfoHash)
+		}
+		counts[e.Type]++
+	}
+	expected := map[events.Type]int{
+		events.MetadataReceived: 1,
+		events.PeerConnected:    1,
+		events.PeerDisconnected: 1,
+		events.PieceVerified:    s.numPieces,
+		events.TorrentCompleted: 1,
+	}
+	for typ, n := range expected {
+		if counts[typ] != n {
+			t.Errorf("Expected %d %v events, got %d", n, typ, counts[typ])
+		}
+	}
+}
+
+func TestAddMagnetErrors(t *testing.T) {
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	if _, err := sess.AddMagnet("not a magnet"); err == nil {
+		t.Error("Expected error for invalid magnet link")
+	}
+
+	// Without trackers, peers or DHT there is no way to find the swarm
+	if _, err := sess.AddMagnet("magnet:?xt=urn:btih:83e53cb48c4af4989cd1a53a5b4671da821b1ff4"); err == nil {
+		t.Error("Expected error for magnet link with no peer sources")
+	}
+}
+
+func TestSetDHTConfig(t *testing.T) {
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	// A private network: one node that we bootstrap from
+	router, err := dht.NewServer(dht.Config{DisableIPv6: true, BootstrapNodes: []string{}})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	defer router.Close()
+
+	// Enabling DHT at runtime starts a node
+	cfg := dht.Config{DisableIPv6: true, BootstrapNodes: []string{}}
+	if err := sess.SetDHTConfig(false, cfg); err != nil {
+		t.Fatalf("SetDHTConfig failed: %v", err)
+	}
+	node, ready := sess.dhtNode()
+	if node == nil {
+		t.Fatal("Expected DHT node to be running")
+	}
+	<-ready
+
+	// Changing only the bootstrap nodes keeps the node and re-bootstraps it
+	cfg.BootstrapNodes = []string{fmt.Sprintf("127.0.0.1:%d", router.Port())}
+	if err := sess.SetDHTConfig(false, cfg); err != nil {
+		t.Fatalf("SetDHTConfig failed: %v", err)
+	}
+	same, ready := sess.dhtNode()
+	if same != node {
+		t.Error("Expected node to be kept when only bootstrap nodes change")
+	}
+	<-ready
+	if n, _ := node.NumNodes(); n != 1 {
+		t.Errorf("Expected the bootstrap node in the routing table, got %d nodes", n)
+	}
+
+	// Changing the port restarts the node
+	cfg.Port = node.Port() + 1
+	if err := sess.SetDHTConfig(false, cfg); err != nil {
+		t.Fatalf("SetDHTConfig failed: %v", err)
+	}
+	restarted, _ := sess.dhtNode()
+	if restarted == node || restarted == nil {
+		t.Fatal("Expected a new node after changing the port")
+	}
+	if restarted.Port() != cfg.Port {
+		t.Errorf("Expected port %d, got %d", cfg.Port, restarted.Port())
+	}
+
+	// Disabling stops it
+	if err := sess.SetDHTConfig(true, cfg); err != nil {
+		t.Fatalf("SetDHTConfig failed: %v", err)
+	}
+	if node, _ := sess.dhtNode(); node != nil {
+		t.Error("Expected DHT to be disabled")
+	}
+}
+
+func TestMutableTorrent(t *testing.T) {
+	// A private network: one node that both sessions bootstrap from
+	router, err := dht.NewServer(dht.Config{DisableIPv6: true, BootstrapNodes: []string{}})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	defer router.Close()
+	cfg := dht.Config{DisableIPv6: true, BootstrapNodes: []string{fmt.Sprintf("127.0.0.1:%d", router.Port())}}
+
+	var sessions []*Session
+	for i := 0; i < 2; i++ {
+		sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DHT: cfg})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		defer sess.Close()
+		sessions = append(sessions, sess)
+	}
+	publisher, follower := sessions[0], sessions[1]
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	first, second := [20]byte{1}, [20]byte{2}
+
+	m, err := publisher.Publish(ctx, key, []byte("daily"), first)
+	if err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	// The public key resolves to the published version
+	tor, err := follower.AddMagnet(m.String())
+	if err != nil {
+		t.Fatalf("AddMagnet failed: %v", err)
+	}
+	if tor.InfoHash() != first {
+		t.Fatalf("Expected info hash %x, got %x", first, tor.InfoHash())
+	}
+
+	// Nothing new yet
+	follower.checkUpdates(ctx)
+	if next := tor.Successor(); next != nil {
+		t.Fatalf("Expected no successor before an update, got %x", next.InfoHash())
+	}
+
+	// The publisher pushes a new version and the follower picks it up
+	if _, err := publisher.Publish(ctx, key, []byte("daily"), second); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	follower.checkUpdates(ctx)
+	next := tor.Successor()
+	if next == nil || next.InfoHash() != second {
+		t.Fatalf("Expected successor %x, got %v", second, next)
+	}
+	if next.mutable == nil || next.mutable.seq != 2 {
+		t.Errorf("Expected the successor to follow sequence number 2, got %+v", next.mutable)
+	}
+}
+
+func TestIncomingPeer(t *testing.T) {
+	testCases := []struct {
+		name string
+		host string
+	}{
+		{"IPv4", "127.0.0.1"},
+		{"IPv6", "::1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := make([]byte, 50000)
+			for i := range data {
+				data[i] = byte(i % 241)
+			}
+			s := newSeeder("incoming.bin", data, 16384)
+			info, err := torrent.ParseInfo(s.info)
+			if err != nil {
+				t.Fatalf("ParseInfo failed: %v", err)
+			}
+			tf := &torrent.TorrentFile{Info: *info}
+
+			dir := t.TempDir()
+			sess, err := newTestSession(t, Config{DownloadDir: dir, DisableDHT: true})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			defer sess.Close()
+
+			// No trackers or peers: the download waits for the seeder to dial in
+			tor, err := sess.AddTorrent(tf)
+			if err != nil {
+				t.Fatalf("AddTorrent failed: %v", err)
+			}
+			addr := net.JoinHostPort(tc.host, strconv.Itoa(int(sess.cfg.Port)))
+			if err := s.dial(addr); err != nil {
+				t.Skipf("Cannot connect over %s: %v", tc.name, err)
+			}
+
+			select {
+			case <-tor.Done():
+			case <-time.After(30 * time.Second):
+				t.Fatalf("Download did not finish, state: %v", tor.State())
+			}
+			if tor.State() != StateComplete {
+				t.Fatalf("Expected state complete, got %v (err: %v)", tor.State(), tor.Err())
+			}
+
+			got, err := os.ReadFile(filepath.Join(dir, "incoming.bin"))
+			if err != nil {
+				t.Fatalf("ReadFile failed: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("Downloaded content does not match")
+			}
+		})
+	}
+}
+
+func TestExternalIP(t *testing.T) {
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DHT: dht.Config{DisableIPv6: true, BootstrapNodes: []string{}}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	external, other := net.IPv4(203, 0, 113, 7), net.IPv4(198, 51, 100, 1)
+	steps := []struct {
+		source   string
+		ip       net.IP
+		expected net.IP
+	}{
+		{"tracker http://a/announce", external, nil},               // one source isn't enough
+		{"peer 10.0.0.2", net.IPv4(192, 168, 1, 10), nil},          // private addresses don't count
+		{"peer 198.51.100.9", other, nil},                          // no majority
+		{"peer 198.51.100.10", external, external},                 // two of three agree
+		{"peer 198.51.100.9", external, external},                  // a source changes its vote
+		{"tracker http://b/announce", other, external},             // still a majority
+		{"peer 2001:db8::9", net.ParseIP("2001:db8::7"), external}, // families are counted apart
+	}
+	for i, step := range steps {
+		sess.reportExternalIP(step.source, step.ip)
+		if got := sess.NATStatus().ExternalIPv4; !got.Equal(step.expected) {
+			t.Errorf("Step %d: expected external IP %v, got %v", i, step.expected, got)
+		}
+	}
+	if status := sess.NATStatus(); !status.BehindNAT || status.ExternalIPv6 != nil {
+		t.Errorf("Expected to be behind NAT without an IPv6 address, got %+v", status)
+	}
+
+	// The DHT node ID follows the address (BEP 42), and trackers get it as a hint
+	node, _ := sess.dhtNode()
+	if !node.ID().SecureFor(external) {
+		t.Errorf("Expected a DHT node ID secure for %v, got %v", external, node.ID())
+	}
+	if addr := sess.externalAddr(false); addr == nil || !addr.IP.Equal(external) {
+		t.Errorf("Expected our external address to be %v, got %v", external, addr)
+	}
+}
+
+func TestListenPortFallback(t *testing.T) {
+	// Occupy a port so the session has to fall back to the next one
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer taken.Close()
+	port := uint16(taken.Addr().(*net.TCPAddr).Port)
+
+	sess, err := New(Config{
+		DownloadDir: t.TempDir(),
+		DisableDHT:  true,
+		Port:        port,
+		PortRange:   [2]uint16{port, port + 5},
+	})
+	if err != nil {
+		t.Skipf("No free port in fallback range: %v", err)
+	}
+	defer sess.Close()
+
+	got := sess.AnnouncePort()
+	if got <= port || got > port+5 {
+		t.Errorf("Expected a fallback port in %d-%d, got %d", port+1, port+5, got)
+	}
+	for _, addr := range sess.ListenAddrs() {
+		if addr.(*net.TCPAddr).Port != int(got) {
+			t.Errorf("Expected all listeners on port %d, got %v", got, addr)
+		}
+	}
+}
+
+func TestNoListen(t *testing.T) {
+	sess, err := New(Config{DownloadDir: t.TempDir(), DisableDHT: true, NoListen: true, Port: 6999})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+	if addrs := sess.ListenAddrs(); len(addrs) != 0 {
+		t.Errorf("Expected no listeners, got %v", addrs)
+	}
+	if port := sess.AnnouncePort(); port != 6999 {
+		t.Errorf("Expected announce port 6999, got %d", port)
+	}
+
+	if _, err := New(Config{DownloadDir: t.TempDir(), DisableDHT: true, NoListen: true, PortMapping: true}); err == nil {
+		t.Error("Expected error for port mapping without a listener")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	sess, err := New(Config{DownloadDir: t.TempDir(), DisableDHT: true, NoListen: true}, WithPort(6999), WithMaxPeers(7))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+	if port := sess.AnnouncePort(); port != 6999 {
+		t.Errorf("Expected announce port 6999, got %d", port)
+	}
+	if sess.cfg.MaxPeers != 7 {
+		t.Errorf("Expected 7 peers, got %d", sess.cfg.MaxPeers)
+	}
+
+	if _, err := New(Config{DownloadDir: t.TempDir(), DisableDHT: true, NoListen: true}, WithMaxPeers(-1)); err == nil {
+		t.Error("Expected error for a negative peer limit")
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.p2p")
+	if err := os.WriteFile(path, []byte("Loopback:127.0.0.0-127.255.255.255\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, Blocklist: path})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	// Directly given peers are dropped before they're ever dialed
+	uri := "magnet:?xt=urn:btih:83e53cb48c4af4989cd1a53a5b4671da821b1ff4&x.pe=127.0.0.1:6881"
+	if _, err := sess.AddMagnet(uri); err != nil {
+		t.Fatalf("AddMagnet failed: %v", err)
+	}
+
+	// Incoming connections from blocked addresses are closed right away
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(sess.AnnouncePort()))))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected blocked connection to be closed")
+	}
+
+	// The magnet's peers are filtered in the background
+	stats := sess.BlockStats()
+	for deadline := time.Now().Add(5 * time.Second); stats.Peers == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		stats = sess.BlockStats()
+	}
+	if stats.Peers != 1 || stats.Connections != 1 || stats.Ranges != 1 {
+		t.Errorf("Expected 1 range and 1 blocked peer and connection, got %+v", stats)
+	}
+
+	if _, err := newTestSession(t, Config{DisableDHT: true, Blocklist: "/nonexistent/list.p2p"}); err == nil {
+		t.Error("Expected error for missing blocklist")
+	}
+}
+
+func TestBanPeer(t *testing.T) {
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, BanAfter: 3})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+	tor, err := sess.AddMagnet("magnet:?xt=urn:btih:83e53cb48c4af4989cd1a53a5b4671da821b1ff4&x.pe=10.0.0.1:6881")
+	if err != nil {
+		t.Fatalf("AddMagnet failed: %v", err)
+	}
+
+	// A peer banned by one torrent is banned by the others and the session
+	sess.banPeer("127.0.0.1")
+	if !tor.stats.Banned("127.0.0.1") {
+		t.Error("Expected the torrent to ban 127.0.0.1")
+	}
+	if _, err := sess.dialPeer(context.Background(), "tcp", "127.0.0.1:6881"); err == nil {
+		t.Error("Expected dialing a banned peer to fail")
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(sess.AnnouncePort()))))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the banned peer's connection to be closed")
+	}
+}
+
+// socksProxy is a no-auth SOCKS5 server that only supports CONNECT to IPv4
+// addresses, counting the connections it relays
+func socksProxy(t *testing.T, relayed *atomic.Int64) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 10)
+				if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+					return
+				}
+				io.ReadFull(conn, buf[:buf[1]])
+				conn.Write([]byte{5, 0})
+
+				// <version><cmd><reserved><atyp=1><ip:4><port:2>
+				if _, err := io.ReadFull(conn, buf); err != nil || buf[3] != 1 {
+					return
+				}
+				addr := &net.TCPAddr{IP: net.IP(buf[4:8]), Port: int(binary.BigEndian.Uint16(buf[8:]))}
+				target, err := net.Dial("tcp", addr.String())
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				relayed.Add(1)
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestProxy(t *testing.T) {
+	data := make([]byte, 50000)
+	s := newSeeder("content.bin", data, 16384)
+	addr := s.listen(t)
+	uri := "magnet:?xt=urn:btih:" + hex.EncodeToString(s.infoHash[:]) + "&x.pe=" + addr
+
+	// A closed port stands in for a proxy that is down
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	down.Close()
+
+	var relayed atomic.Int64
+	up := socksProxy(t, &relayed)
+
+	tests := []struct {
+		name     string
+		proxy    string
+		strict   bool
+		complete bool
+	}{
+		{"proxy", up, false, true},
+		{"fallback", down.Addr().String(), false, true},
+		{"strict", down.Addr().String(), true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relayed.Store(0)
+			sess, err := newTestSession(t, Config{
+				DownloadDir: t.TempDir(),
+				DisableDHT:  true,
+				Proxy:       tt.proxy,
+				ProxyStrict: tt.strict,
+			})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			defer sess.Close()
+
+			tor, err := sess.AddMagnet(uri)
+			if err != nil {
+				t.Fatalf("AddMagnet failed: %v", err)
+			}
+
+			select {
+			case <-tor.Done():
+			case <-time.After(3 * time.Second):
+			}
+			if complete := tor.State() == StateComplete; complete != tt.complete {
+				t.Errorf("Expected complete %v, got state %v (err: %v)", tt.complete, tor.State(), tor.Err())
+			}
+			if tt.proxy == up && relayed.Load() == 0 {
+				t.Error("Expected peer connections to go through the proxy")
+			}
+		})
+	}
+
+	// Strict mode has no way to reach the DHT without a UDP relay
+	if _, err := newTestSession(t, Config{Proxy: up, ProxyStrict: true}); err == nil {
+		t.Error("Expected error for DHT in strict proxy mode")
+	}
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	var relayed atomic.Int64
+	up := socksProxy(t, &relayed)
+
+	// Only strict mode sends web traffic through the proxy
+	if client, err := NewHTTPClient(Config{Proxy: up}); err != nil || client != tracker.DefaultClient {
+		t.Errorf("Expected tracker.DefaultClient without strict mode, got %v (err: %v)", client, err)
+	}
+	client, err := NewHTTPClient(Config{Proxy: up, ProxyStrict: true})
+	if err != nil {
+		t.Fatalf("NewHTTPClient failed: %v", err)
+	}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	resp.Body.Close()
+	if relayed.Load() != 1 {
+		t.Errorf("Expected the request to go through the proxy, got %d relayed", relayed.Load())
+	}
+
+	if _, err := NewHTTPClient(Config{BindAddress: "not an address"}); err == nil {
+		t.Error("Expected error for an invalid bind address")
+	}
+}
+
+// logBuffer collects log output written from several goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestPauseResumeRemove(t *testing.T) {
+	var logs logBuffer
+	logger, _ := logging.New(&logs, "info", "text")
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, Logger: logger})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	// A peer that never answers keeps the torrent fetching metadata
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer silent.Close()
+
+	uri := "magnet:?xt=urn:btih:83e53cb48c4af4989cd1a53a5b4671da821b1ff4&x.pe=" + silent.Addr().String()
+	tor, err := sess.AddMagnet(uri)
+	if err != nil {
+		t.Fatalf("AddMagnet failed: %v", err)
+	}
+
+	if err := tor.Resume(); err == nil {
+		t.Error("Expected error resuming a running torrent")
+	}
+	if err := tor.Pause(); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	if tor.State() != StatePaused {
+		t.Errorf("Expected state paused, got %v", tor.State())
+	}
+	if err := tor.Pause(); err == nil {
+		t.Error("Expected error pausing a paused torrent")
+	}
+
+	if err := tor.Resume(); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if tor.State() != StateFetchingMetadata {
+		t.Errorf("Expected state fetching metadata, got %v", tor.State())
+	}
+
+	if sess.Torrent(tor.InfoHash()) != tor {
+		t.Error("Expected to look up the torrent by info hash")
+	}
+	if _, err := sess.AddMagnet(uri); !errors.Is(err, ErrTorrentExists) {
+		t.Errorf("Expected ErrTorrentExists adding the torrent twice, got %v", err)
+	}
+	if err := sess.Remove(tor.InfoHash()); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	select {
+	case <-tor.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected removed torrent to be done")
+	}
+	if tor.State() != StateFailed || tor.Err() == nil {
+		t.Errorf("Expected removed torrent to fail, got %v (err: %v)", tor.State(), tor.Err())
+	}
+	if len(sess.Torrents()) != 0 {
+		t.Error("Expected no torrents after Remove")
+	}
+	if err := sess.Remove(tor.InfoHash()); !errors.Is(err, ErrTorrentNotFound) {
+		t.Errorf("Expected ErrTorrentNotFound removing an unknown torrent, got %v", err)
+	}
+	if err := tor.Resume(); err == nil {
+		t.Error("Expected error resuming a removed torrent")
+	}
+
+	// Each lifecycle change is logged with the torrent's info hash
+	for _, msg := range []string{"torrent added", "torrent paused", "torrent resumed", "torrent removed"} {
+		want := fmt.Sprintf("msg=%q component=torrent infohash=83e53cb48c4af4989cd1a53a5b4671da821b1ff4", msg)
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("Expected log record %q, got:\n%s", want, logs.String())
+		}
+	}
+}
+
+func TestPauseAnnounce(t *testing.T) {
+	s := newSeeder("pause.bin", make([]byte, 40000), 16384)
+	info, err := torrent.ParseInfo(s.info)
+	if err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+
+	for _, keep := range []bool{false, true} {
+		// A tracker that knows no peers, so the torrent keeps waiting for some
+		fake := clock.NewFake(time.Now())
+		tr := &trackertest.Tracker{}
+		sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, Clock: fake, AnnounceWhilePaused: keep})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		defer sess.Close()
+		tor, err := sess.AddTorrent(&torrent.TorrentFile{Announce: tr.Listen(t), Info: *info})
+		if err != nil {
+			t.Fatalf("AddTorrent failed: %v", err)
+		}
+		lastAnnounce := func() trackertest.Announce {
+			announces := tr.Announces()
+			if len(announces) == 0 {
+				return trackertest.Announce{}
+			}
+			return announces[len(announces)-1]
+		}
+		for deadline := time.Now().Add(5 * time.Second); !tor.announcers[0].Started(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("Expected a started announce")
+			}
+		}
+
+		if err := tor.Pause(); err != nil {
+			t.Fatalf("Pause failed: %v", err)
+		}
+		if !keep {
+			// The trackers hear we're leaving, and that we're back on resume
+			if a := lastAnnounce(); a.Event != tracker.EventStopped {
+				t.Errorf("Expected a stopped announce on pause, got %q", a.Event)
+			}
+			if err := tor.Resume(); err != nil {
+				t.Fatalf("Resume failed: %v", err)
+			}
+			for deadline := time.Now().Add(5 * time.Second); lastAnnounce().Event != tracker.EventStarted; time.Sleep(5 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected a started announce on resume, got %q", lastAnnounce().Event)
+				}
+			}
+			continue
+		}
+
+		// Otherwise the regular announces go on, asking for no peers
+		for deadline := time.Now().Add(5 * time.Second); !lastAnnounce().NoPeers; time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected an announce asking for no peers, got %+v", lastAnnounce())
+			}
+			fake.Advance(trackertest.DefaultInterval)
+		}
+		for _, a := range tr.Announces() {
+			if a.Event == tracker.EventStopped {
+				t.Error("Expected no stopped announce while paused")
+			}
+		}
+		if err := tor.Resume(); err != nil {
+			t.Fatalf("Resume failed: %v", err)
+		}
+		if tor.State() != StateDownloading {
+			t.Errorf("Expected the resumed torrent downloading, got %v", tor.State())
+		}
+	}
+}
+
+func TestResumeWhilePausedAnnounce(t *testing.T) {
+	s := newSeeder("resume.bin", make([]byte, 40000), 16384)
+	info, err := torrent.ParseInfo(s.info)
+	if err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+	fake := clock.NewFake(time.Now())
+	tr := &trackertest.Tracker{}
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, Clock: fake, AnnounceWhilePaused: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+	tor, err := sess.AddTorrent(&torrent.TorrentFile{Announce: tr.Listen(t), Info: *info})
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); !tor.announcers[0].Started(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a started announce")
+		}
+	}
+	if err := tor.Pause(); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+
+	// Hold up the paused torrent's next announce while it's being made, and
+	// resume meanwhile
+	tor.mu.Lock()
+	fake.Advance(trackertest.DefaultInterval)
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan error, 1)
+	go func() { done <- tor.Resume() }()
+	time.Sleep(50 * time.Millisecond)
+	tor.mu.Unlock()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Resume failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Resume to return while a paused announce is in flight")
+	}
+	if tor.State() != StateDownloading {
+		t.Errorf("Expected the resumed torrent downloading, got %v", tor.State())
+	}
+}
+
+func TestPauseResumeRace(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		// A peer that never answers keeps every run connected to it until
+		// the run stops
+		silent, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		defer silent.Close()
+		var mu sync.Mutex
+		var conns []net.Conn
+		go func() {
+			for {
+				conn, err := silent.Accept()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				conns = append(conns, conn)
+				mu.Unlock()
+			}
+		}()
+
+		tr := &trackertest.Tracker{}
+		sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, Clock: clock.NewFake(time.Now()), AnnounceWhilePaused: keep})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		defer sess.Close()
+		tor, err := sess.AddMagnet("magnet:?xt=urn:btih:83e53cb48c4af4989cd1a53a5b4671da821b1ff4&tr=" + url.QueryEscape(tr.Listen(t)) + "&x.pe=" + silent.Addr().String())
+		if err != nil {
+			t.Fatalf("AddMagnet failed: %v", err)
+		}
+		lastAnnounce := func() trackertest.Announce {
+			announces := tr.Announces()
+			if len(announces) == 0 {
+				return trackertest.Announce{}
+			}
+			return announces[len(announces)-1]
+		}
+
+		for range 20 {
+			if err := tor.Pause(); err != nil {
+				t.Fatalf("Pause failed: %v", err)
+			}
+			if err := tor.Resume(); err != nil {
+				t.Fatalf("Resume failed: %v", err)
+			}
+
+			// Resume as soon as the torrent shows as paused, often while Pause
+			// still waits for its run to stop
+			paused := make(chan error, 1)
+			go func() { paused <- tor.Pause() }()
+			for tor.State() != StatePaused {
+				runtime.Gosched()
+			}
+			tor.Resume()
+			<-paused
+
+			// Whichever won, the torrent must be left in one piece
+			if tor.State() == StatePaused {
+				if err := tor.Resume(); err != nil {
+					t.Fatalf("Resume after the race failed: %v", err)
+				}
+			}
+			if state := tor.State(); state != StateFetchingMetadata {
+				t.Fatalf("Expected the torrent fetching metadata, got %v", state)
+			}
+			// The trackers mustn't hear we left after hearing we're back
+			if !keep {
+				for deadline := time.Now().Add(5 * time.Second); lastAnnounce().Event != tracker.EventStarted; time.Sleep(5 * time.Millisecond) {
+					if time.Now().After(deadline) {
+						t.Fatalf("Expected started as the last announce of the running torrent, got %q", lastAnnounce().Event)
+					}
+				}
+			}
+		}
+
+		// Once paused, no run may be left behind holding a connection
+		if err := tor.Pause(); err != nil {
+			t.Fatalf("Pause failed: %v", err)
+		}
+		mu.Lock()
+		open := slices.Clone(conns)
+		mu.Unlock()
+		for _, conn := range open {
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := io.Copy(io.Discard, conn); errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal("Expected every connection closed once paused")
+			}
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, MaxActiveDownloads: 1, Clock: fake})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	// Peers that never answer keep the torrents fetching metadata
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer silent.Close()
+	var torrents []*Torrent
+	for i := range 3 {
+		uri := fmt.Sprintf("magnet:?xt=urn:btih:%040x&x.pe=%s", i+1, silent.Addr())
+		tor, err := sess.AddMagnet(uri)
+		if err != nil {
+			t.Fatalf("AddMagnet failed: %v", err)
+		}
+		torrents = append(torrents, tor)
+	}
+	first, second, third := torrents[0], torrents[1], torrents[2]
+	waitState := func(tor *Torrent, state State) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); tor.State() != state; time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected state %v, got %v", state, tor.State())
+			}
+		}
+	}
+
+	// Only the first takes the slot; the others wait in the order added
+	if first.State() != StateFetchingMetadata || second.State() != StateQueued || third.State() != StateQueued {
+		t.Fatalf("Expected one torrent running and two queued, got %v, %v and %v", first.State(), second.State(), third.State())
+	}
+	if second.QueuePosition() != 1 || third.QueuePosition() != 2 || first.QueuePosition() != 0 {
+		t.Errorf("Expected queue positions 0, 1 and 2, got %d, %d and %d", first.QueuePosition(), second.QueuePosition(), third.QueuePosition())
+	}
+
+	// A forced torrent starts at once without taking the slot
+	if err := third.SetForceStart(true); err != nil {
+		t.Fatalf("SetForceStart failed: %v", err)
+	}
+	if third.State() != StateFetchingMetadata || !third.ForceStart() {
+		t.Errorf("Expected the forced torrent to start, got %v", third.State())
+	}
+	if queue := sess.Queue(); len(queue) != 1 || queue[0] != second {
+		t.Errorf("Expected the second torrent alone in the queue, got %d", len(queue))
+	}
+
+	// Pausing the first hands its slot on, and resuming it queues it
+	if err := first.Pause(); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	waitState(second, StateFetchingMetadata)
+	if err := first.Resume(); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if first.State() != StateQueued {
+		t.Errorf("Expected the resumed torrent queued, got %v", first.State())
+	}
+
+	// A download that receives nothing for long stops holding the slot
+	fake.Advance(stallTime)
+	waitState(first, StateFetchingMetadata)
+	if second.State() != StateFetchingMetadata {
+		t.Errorf("Expected the stalled torrent to keep running, got %v", second.State())
+	}
+
+	// Queued torrents can be paused and removed
+	if err := second.Pause(); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	if err := second.Resume(); err != nil || second.State() != StateQueued {
+		t.Fatalf("Expected the resumed torrent queued, got %v (err: %v)", second.State(), err)
+	}
+	if err := second.Pause(); err != nil || second.State() != StatePaused {
+		t.Errorf("Expected the queued torrent paused, got %v (err: %v)", second.State(), err)
+	}
+	second.Resume()
+	if err := sess.Remove(second.InfoHash()); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if len(sess.Queue()) != 0 {
+		t.Errorf("Expected an empty queue, got %d torrents", len(sess.Queue()))
+	}
+}
+
+func TestMockSwarm(t *testing.T) {
+	data := make([]byte, 40000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	s := newSeeder("mockswarm.bin", data, 16384)
+	info, err := torrent.ParseInfo(s.info)
+	if err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+
+	// The tracker knows one seed: a mock peer serving every block
+	mock := &peertest.MockPeer{
+		InfoHash: s.infoHash,
+		PeerID:   [20]byte{'m'},
+		Script: []peertest.Step{
+			peertest.Bitfield(s.numPieces),
+			peertest.Send(peer.FormatMessage(peer.MsgUnchoke, nil)),
+			peertest.ServeRequests(data, s.pieceLength, 0, nil),
+		},
+	}
+	addr := mock.Listen(t)
+	tr := &trackertest.Tracker{}
+	tr.AddPeer(s.infoHash, tracker.Peer{IP: addr.IP, Port: uint16(addr.Port)}, true)
+
+	dir := t.TempDir()
+	sess, err := newTestSession(t, Config{DownloadDir: dir, DisableDHT: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+	tor, err := sess.AddTorrent(&torrent.TorrentFile{Announce: tr.Listen(t), Info: *info})
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+	select {
+	case <-tor.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the download to complete")
+	}
+	if err := tor.Err(); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "mockswarm.bin")); !bytes.Equal(got, data) {
+		t.Error("Downloaded data does not match")
+	}
+
+	// The tracker hears the download start and, in the background, complete
+	var events []string
+	for deadline := time.Now().Add(5 * time.Second); !slices.Contains(events, tracker.EventCompleted); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected started and completed announces, got %q", events)
+		}
+		events = events[:0]
+		for _, a := range tr.Announces() {
+			events = append(events, a.Event)
+		}
+	}
+	if events[0] != tracker.EventStarted {
+		t.Errorf("Expected a started announce first, got %q", events)
+	}
+}
+
+func TestAvailability(t *testing.T) {
+	s := newSeeder("avail.bin", make([]byte, 40000), 16384)
+	info, err := torrent.ParseInfo(s.info)
+	if err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+
+	// The only peer has the first two of three pieces, and keeps us choked
+	mock := &peertest.MockPeer{
+		InfoHash: s.infoHash,
+		PeerID:   [20]byte{'m'},
+		Script: []peertest.Step{
+			peertest.Send(peer.FormatMessage(peer.MsgBitfield, []byte{0b11000000})),
+			peertest.Hang(),
+		},
+	}
+	addr := mock.Listen(t)
+	tr := &trackertest.Tracker{}
+	tr.AddPeer(s.infoHash, tracker.Peer{IP: addr.IP, Port: uint16(addr.Port)}, false)
+
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+	tor, err := sess.AddTorrent(&torrent.TorrentFile{Announce: tr.Listen(t), Info: *info})
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+
+	var avail Availability
+	for deadline := time.Now().Add(5 * time.Second); !slices.Equal(avail.Pieces, []int{1, 1, 0}); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected availability [1 1 0], got %v", avail.Pieces)
+		}
+		avail = tor.Availability()
+	}
+	if avail.DistributedCopies != 2.0/3 || avail.Unavailable != 1 || avail.Completable() {
+		t.Errorf("Expected 0.67 copies and one piece unavailable, got %+v", avail)
+	}
+	if stats := tor.Stats(); stats.Copies != avail.DistributedCopies || stats.Unavailable != 1 {
+		t.Errorf("Expected the stats to report the availability, got %+v", stats)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := newSeeder("shutdown.bin", make([]byte, 40000), 16384)
+	info, err := torrent.ParseInfo(s.info)
+	if err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+
+	// A tracker that knows no peers, so the torrent keeps waiting for some
+	events := make(chan url.Values, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query()
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer ts.Close()
+
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	tor, err := sess.AddTorrent(&torrent.TorrentFile{Announce: ts.URL, Info: *info})
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+
+	select {
+	case q := <-events:
+		if q.Get("event") != "started" || q.Get("left") != "40000" {
+			t.Errorf("Expected a started announce with 40000 bytes left first, got event %q left %q", q.Get("event"), q.Get("left"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected an announce")
+	}
+	// The announce is recorded just after the tracker answers
+	for tor.Trackers()[0].LastAnnounce.IsZero() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sess.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	select {
+	case q := <-events:
+		if q.Get("event") != "stopped" || q.Get("left") != "40000" {
+			t.Errorf("Expected a stopped announce with 40000 bytes left, got event %q left %q", q.Get("event"), q.Get("left"))
+		}
+	default:
+		t.Error("Expected a stopped announce during Shutdown")
+	}
+	select {
+	case <-tor.Done():
+	default:
+		t.Error("Expected the torrent to be stopped after Shutdown")
+	}
+	if _, err := sess.AddTorrent(&torrent.TorrentFile{Info: *info}); err == nil {
+		t.Error("Expected error adding a torrent after Shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := newSeeder("timeout.bin", make([]byte, 40000), 16384)
+	info, err := torrent.ParseInfo(s.info)
+	if err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+
+	// A tracker that never answers the stopped announce
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("event") == "stopped" {
+			<-release
+			return
+		}
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	tor, err := sess.AddTorrent(&torrent.TorrentFile{Announce: ts.URL, Info: *info})
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected an announce")
+	}
+	for tor.Trackers()[0].LastAnnounce.IsZero() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := sess.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Shutdown to report the deadline, got %v", err)
+	}
+	select {
+	case <-tor.Done():
+	default:
+		t.Error("Expected the torrent to be stopped after Shutdown")
+	}
+}
+
+func TestPeerTimeout(t *testing.T) {
+	s := newSeeder("lonely.bin", make([]byte, 20000), 16384)
+	info, err := torrent.ParseInfo(s.info)
+	if err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	testCases := []struct {
+		name         string
+		announce     string
+		wantTrackers bool
+	}{
+		{"no trackers", "", false},
+		{"failing tracker", broken.URL, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, PeerTimeout: 200 * time.Millisecond})
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			defer sess.Close()
+
+			tor, err := sess.AddTorrent(&torrent.TorrentFile{Announce: tc.announce, Info: *info})
+			if err != nil {
+				t.Fatalf("AddTorrent failed: %v", err)
+			}
+			select {
+			case <-tor.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("Expected the torrent to give up without peers")
+			}
+
+			if !errors.Is(tor.Err(), download.ErrNoPeers) {
+				t.Errorf("Expected ErrNoPeers, got %v", tor.Err())
+			}
+			if errors.Is(tor.Err(), ErrTrackers) != tc.wantTrackers {
+				t.Errorf("Expected ErrTrackers %v, got %v", tc.wantTrackers, tor.Err())
+			}
+		})
+	}
+}
+
+func TestSeedRatio(t *testing.T) {
+	data := make([]byte, 40000)
+	for i := range data {
+		data[i] = byte(i % 239)
+	}
+	s := newSeeder("seed.bin", data, 16384)
+	info, err := torrent.ParseInfo(s.info)
+	if err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+
+	// The first session seeds until it has uploaded the torrent once
+	seeding, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, Seed: true, SeedRatio: 1})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer seeding.Close()
+	seedPort := strconv.Itoa(int(seeding.cfg.Port))
+
+	// The tracker hands the seeding session out to everyone else
+	events := make(chan url.Values, 8)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("port") == seedPort {
+			events <- q
+			w.Write([]byte("d8:intervali1800e5:peers0:e"))
+			return
+		}
+		compact := binary.BigEndian.AppendUint16([]byte{127, 0, 0, 1}, seeding.cfg.Port)
+		fmt.Fprintf(w, "d8:intervali1800e5:peers%d:%se", len(compact), compact)
+	}))
+	defer ts.Close()
+	tf := &torrent.TorrentFile{Announce: ts.URL, Info: *info}
+
+	tor, err := seeding.AddTorrent(tf)
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+	if err := s.dial(net.JoinHostPort("127.0.0.1", seedPort)); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); tor.State() != StateSeeding; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected state seeding, got %v (err: %v)", tor.State(), tor.Err())
+		}
+	}
+
+	// A second session downloads everything from the first
+	dir := t.TempDir()
+	leeching, err := newTestSession(t, Config{DownloadDir: dir, DisableDHT: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer leeching.Close()
+	leech, err := leeching.AddTorrent(tf)
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+
+	for _, tr := range []*Torrent{leech, tor} {
+		select {
+		case <-tr.Done():
+		case <-time.After(15 * time.Second):
+			t.Fatalf("Torrent did not finish, state: %v", tr.State())
+		}
+		if tr.State() != StateComplete {
+			t.Fatalf("Expected state complete, got %v (err: %v)", tr.State(), tr.Err())
+		}
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "seed.bin"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Downloaded content does not match")
+	}
+	if ratio := tor.Stats().Ratio(); ratio < 1 {
+		t.Errorf("Expected ratio of at least 1, got %.2f", ratio)
+	}
+
+	// Reaching the ratio leaves the tracker
+	stopped := false
+	for len(events) > 0 {
+		if q := <-events; q.Get("event") == "stopped" {
+			stopped = true
+		}
+	}
+	if !stopped {
+		t.Error("Expected a stopped announce once the seed ratio was reached")
+	}
+}
+
+func TestResumeData(t *testing.T) {
+	data := make([]byte, 40000)
+	for i := range data {
+		data[i] = byte(i % 233)
+	}
+	s := newSeeder("resumed.bin", data, 16384)
+	info, err := torrent.ParseInfo(s.info)
+	if err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+
+	// The data is on disk already and a verify run recorded it
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "resumed.bin"), data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	state := statedir.Dir(t.TempDir())
+	if err := download.SaveResume(state.Resume(s.infoHash), s.infoHash, filepath.Join(dir, "resumed.bin"), []bool{true, true, true}, nil); err != nil {
+		t.Fatalf("SaveResume failed: %v", err)
+	}
+
+	completed := make(chan string, 2)
+	sess, err := newTestSession(t, Config{DownloadDir: dir, StateDir: state, DisableDHT: true, OnComplete: func(tor *Torrent) {
+		completed <- tor.Path()
+	}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	// No peers are needed to finish
+	tor, err := sess.AddTorrent(&torrent.TorrentFile{Info: *info})
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+	select {
+	case <-tor.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the resumed torrent to complete, state: %v", tor.State())
+	}
+	if tor.State() != StateComplete {
+		t.Errorf("Expected state complete, got %v (err: %v)", tor.State(), tor.Err())
+	}
+	if done, total := tor.Progress(); done != total {
+		t.Errorf("Expected %d/%d pieces done, got %d", total, total, done)
+	}
+
+	// The completion hook runs once, and Close waits for it
+	sess.Close()
+	if len(completed) != 1 {
+		t.Fatalf("Expected the completion hook to run once, ran %d times", len(completed))
+	}
+	if path := <-completed; path != filepath.Join(dir, "resumed.bin") {
+		t.Errorf("Expected hook for %s, got %s", filepath.Join(dir, "resumed.bin"), path)
+	}
+}
+
+func TestSaveResume(t *testing.T) {
+	data := make([]byte, 40000)
+	for i := range data {
+		data[i] = byte(i % 239)
+	}
+	s := newSeeder("saved.bin", data, 16384)
+	addr := s.listen(t)
+
+	dir := t.TempDir()
+	state := statedir.Dir(t.TempDir())
+	sess, err := newTestSession(t, Config{DownloadDir: dir, StateDir: state, DisableDHT: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	tor, err := sess.AddMagnet("magnet:?xt=urn:btih:" + hex.EncodeToString(s.infoHash[:]) + "&x.pe=" + addr)
+	if err != nil {
+		t.Fatalf("AddMagnet failed: %v", err)
+	}
+	select {
+	case <-tor.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Download did not finish, state: %v", tor.State())
+	}
+
+	// Stopping saves the pieces downloaded for the next run
+	sess.Close()
+	have, err := download.LoadResume(state.Resume(s.infoHash), s.infoHash, filepath.Join(dir, "saved.bin"), s.numPieces)
+	if err != nil {
+		t.Fatalf("LoadResume failed: %v", err)
+	}
+	for i, ok := range have {
+		if !ok {
+			t.Errorf("Expected piece %d in the resume data", i)
+		}
+	}
+}
+
+func TestKeepTorrents(t *testing.T) {
+	file := newSeeder("kept.bin", make([]byte, 40000), 16384)
+	info, err := torrent.ParseInfo(file.info)
+	if err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+	linked := newSeeder("linked.bin", make([]byte, 20000), 16384)
+	uri := "magnet:?xt=urn:btih:" + hex.EncodeToString(linked.infoHash[:]) + "&tr=http%3A%2F%2F127.0.0.1%3A1%2Fannounce"
+
+	dir, state := t.TempDir(), statedir.Dir(t.TempDir())
+	cfg := Config{DownloadDir: dir, StateDir: state, DisableDHT: true, KeepTorrents: true}
+	sess, err := newTestSession(t, cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, err := sess.AddTorrent(&torrent.TorrentFile{Announce: "http://127.0.0.1:1/announce", Info: *info}); err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+	if _, err := sess.AddMagnet(uri); err != nil {
+		t.Fatalf("AddMagnet failed: %v", err)
+	}
+	sess.Close()
+
+	// The next session carries on with both, until one is removed
+	for _, expected := range [][][20]byte{{file.infoHash, linked.infoHash}, {linked.infoHash}} {
+		sess, err := newTestSession(t, cfg)
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		var got [][20]byte
+		for _, tor := range sess.Torrents() {
+			got = append(got, tor.InfoHash())
+		}
+		slices.SortFunc(got, func(a, b [20]byte) int { return bytes.Compare(a[:], b[:]) })
+		slices.SortFunc(expected, func(a, b [20]byte) int { return bytes.Compare(a[:], b[:]) })
+		if !slices.Equal(got, expected) {
+			t.Errorf("Expected torrents %x, got %x", expected, got)
+		}
+		if tor := sess.Torrent(file.infoHash); tor != nil {
+			if tor.Name() != "kept.bin" {
+				t.Errorf("Expected the torrent restored with its metadata, got %q", tor.Name())
+			}
+			if err := sess.Remove(file.infoHash); err != nil {
+				t.Fatalf("Remove failed: %v", err)
+			}
+		}
+		sess.Close()
+	}
+
+	// Without KeepTorrents, nothing is restored
+	cfg.KeepTorrents = false
+	sess, err = newTestSession(t, cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+	if n := len(sess.Torrents()); n != 0 {
+		t.Errorf("Expected no torrents restored, got %d", n)
+	}
+}
+
+func TestSelectFiles(t *testing.T) {
+	s := newSeeder("selected.bin", make([]byte, 40000), 16384)
+	info, err := torrent.ParseInfo(s.info)
+	if err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+
+	// Skipping the only file leaves nothing to download
+	var selected *torrent.TorrentFile
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, SelectFiles: func(tf *torrent.TorrentFile) ([]download.Priority, error) {
+		if tf.Info.Name == "broken" {
+			return nil, errors.New("no such file")
+		}
+		selected = tf
+		return []download.Priority{download.PrioritySkip}, nil
+	}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	tor, err := sess.AddTorrent(&torrent.TorrentFile{Info: *info})
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+	select {
+	case <-tor.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the torrent to complete, state: %v", tor.State())
+	}
+	if tor.State() != StateComplete || selected == nil {
+		t.Errorf("Expected state complete after selecting files, got %v (err: %v)", tor.State(), tor.Err())
+	}
+	if stats := tor.Stats(); stats.Pieces != 0 || stats.Wanted != 0 || stats.Length != 40000 {
+		t.Errorf("Expected nothing wanted of 40000 bytes, got %d pieces, %d of %d bytes", stats.Pieces, stats.Wanted, stats.Length)
+	}
+
+	// A failed selection fails the torrent
+	failed := sess.Subscribe(1, events.TorrentFailed)
+	broken := *info
+	broken.Name = "broken"
+	tor, err = sess.AddTorrent(&torrent.TorrentFile{Info: broken})
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+	select {
+	case <-tor.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the torrent to fail, state: %v", tor.State())
+	}
+	if tor.State() != StateFailed {
+		t.Errorf("Expected state failed, got %v", tor.State())
+	}
+	select {
+	case e := <-failed.Events():
+		if e.InfoHash != tor.InfoHash() || e.Err == nil {
+			t.Errorf("Expected a failure event for the torrent, got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected a torrent failed event")
+	}
+}
+
+func TestSetFilePriorities(t *testing.T) {
+	info, _ := bencode.EncodeDict(map[string]interface{}{
+		"name":         "album",
+		"piece length": 16384,
+		"pieces":       strings.Repeat("x", 20*3),
+		"files": []interface{}{
+			map[string]interface{}{"length": 16384, "path": []interface{}{"a.flac"}},
+			map[string]interface{}{"length": 32768, "path": []interface{}{"b.flac"}},
+		},
+	})
+	parsed, err := torrent.ParseInfo(info)
+	if err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+	tf := &torrent.TorrentFile{Info: *parsed}
+
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+	tor := newTorrent(sess, [20]byte{1}, "album", nil, nil)
+	if err := tor.SetFilePriorities([]download.Priority{download.PrioritySkip, download.PriorityNormal}); err == nil {
+		t.Error("Expected an error before the metadata is known")
+	}
+
+	// A paused torrent applies new priorities when it resumes
+	tor.setMetadata(tf)
+	tor.state = StatePaused
+	tor.written[0] = true
+	if err := tor.SetFilePriorities([]download.Priority{download.PriorityNormal}); err == nil {
+		t.Error("Expected an error for the wrong number of files")
+	}
+	if err := tor.SetFilePriorities([]download.Priority{download.PrioritySkip, download.PriorityHigh}); err != nil {
+		t.Fatalf("SetFilePriorities failed: %v", err)
+	}
+	if err := tor.selectFiles(tf); err != nil {
+		t.Fatalf("selectFiles failed: %v", err)
+	}
+	if done, total := tor.Progress(); done != 0 || total != 2 {
+		t.Errorf("Expected 0/2 pieces wanted once the first file is skipped, got %d/%d", done, total)
+	}
+	files := tor.Files()
+	if len(files) != 2 || files[0].Priority != download.PrioritySkip || files[1].Priority != download.PriorityHigh || files[0].Done != 16384 {
+		t.Errorf("Expected a.flac skipped with 16384 bytes kept and b.flac high priority, got %+v", files)
+	}
+
+	tor.state = StateComplete
+	if err := tor.SetFilePriorities([]download.Priority{download.PriorityNormal, download.PriorityNormal}); err == nil {
+		t.Error("Expected an error changing the files of a complete torrent")
+	}
+}
+
+func TestSequentialPriorities(t *testing.T) {
+	s := newSeeder("movie.mkv", make([]byte, 40000), 16384)
+	info, err := torrent.ParseInfo(s.info)
+	if err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, Sequential: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	// The first and last of the three pieces come first
+	tor := newTorrent(sess, s.infoHash, info.Name, nil, nil)
+	if err := tor.selectFiles(&torrent.TorrentFile{Info: *info}); err != nil {
+		t.Fatalf("selectFiles failed: %v", err)
+	}
+	expected := []download.Priority{download.PriorityHigh, download.PriorityNormal, download.PriorityHigh}
+	if !slices.Equal(tor.priorities, expected) {
+		t.Errorf("Expected priorities %v, got %v", expected, tor.priorities)
+	}
+}
+
+func TestReader(t *testing.T) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i % 241)
+	}
+	s := newSeeder("video.mkv", data, 32768)
+	addr := s.listen(t)
+
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, Sequential: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+	tor, err := sess.AddMagnet("magnet:?xt=urn:btih:" + hex.EncodeToString(s.infoHash[:]) + "&x.pe=" + addr)
+	if err != nil {
+		t.Fatalf("AddMagnet failed: %v", err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); tor.Metadata() == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Metadata did not arrive")
+		}
+	}
+
+	// Reads wait for the download to catch up
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	r, err := tor.NewReader(ctx, 0)
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+	defer r.Close()
+	if r.Size() != int64(len(data)) {
+		t.Errorf("Expected size %d, got %d", len(data), r.Size())
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Read content does not match")
+	}
+
+	if _, err := r.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	tail := make([]byte, 20)
+	if n, err := io.ReadFull(r, tail); n != 10 || err != io.ErrUnexpectedEOF || !bytes.Equal(tail[:n], data[len(data)-10:]) {
+		t.Errorf("Expected the last 10 bytes after seeking, got %d bytes (err: %v)", n, err)
+	}
+	if _, err := tor.NewReader(ctx, 1); err == nil {
+		t.Error("Expected error for a file index out of range")
+	}
+}
+
+func TestReaderPriority(t *testing.T) {
+	const pieces, target = 20, 15
+	s := newSeeder("film.mkv", make([]byte, pieces*16384), 16384)
+	s.gate = make(chan struct{})
+	defer close(s.gate)
+	addr := s.listen(t)
+
+	var mu sync.Mutex
+	var verified []int
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, Hooks: Hooks{
+		OnPieceVerified: func(_ [20]byte, piece int, ok bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			verified = append(verified, piece)
+		},
+	}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+	tor, err := sess.AddMagnet("magnet:?xt=urn:btih:" + hex.EncodeToString(s.infoHash[:]) + "&x.pe=" + addr)
+	if err != nil {
+		t.Fatalf("AddMagnet failed: %v", err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); tor.Metadata() == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Metadata did not arrive")
+		}
+	}
+
+	// A reader seeking far past the download waits on that piece, which
+	// moves ahead of the ones in between
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	r, err := tor.NewReader(ctx, 0)
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+	defer r.Close()
+	if _, err := r.Seek(target*16384, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		read <- err
+	}()
+
+	// Let the seeder send one block, a whole piece, at a time
+	for done := false; !done; {
+		select {
+		case s.gate <- struct{}{}:
+		case err := <-read:
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			done = true
+		case <-ctx.Done():
+			t.Fatal("Expected the read to return")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	before := slices.Index(verified, target)
+	if before < 0 {
+		t.Fatalf("Expected piece %d verified, got %v", target, verified)
+	}
+	// Only the pieces already being fetched as the reader seeked may come first
+	if before > 2 {
+		t.Errorf("Expected piece %d among the first pieces fetched, got %v", target, verified)
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	// 2024-01-01 was a Monday
+	at := func(day int, clock string) time.Time {
+		tm, _ := time.Parse("2006-01-02 15:04", fmt.Sprintf("2024-01-%02d %s", day, clock))
+		return tm
+	}
+
+	testCases := []struct {
+		schedule string
+		at       time.Time
+		active   bool
+	}{
+		{"09:00-17:00", at(1, "09:00"), true},
+		{"09:00-17:00", at(7, "16:59"), true},
+		{"09:00-17:00", at(1, "17:00"), false},
+		{"mon-fri 09:00-17:00", at(5, "12:00"), true},
+		{"mon-fri 09:00-17:00", at(6, "12:00"), false},
+		{"Sat,Sun 09:00-17:00", at(7, "12:00"), true},
+		{"fri-mon 09:00-17:00", at(2, "12:00"), false},
+		// Past midnight, the window belongs to the day it starts on
+		{"fri 22:00-06:00", at(5, "23:00"), true},
+		{"fri 22:00-06:00", at(6, "05:59"), true},
+		{"fri 22:00-06:00", at(5, "05:00"), false},
+	}
+
+	for _, tc := range testCases {
+		sc, err := ParseSchedule(tc.schedule)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q) failed: %v", tc.schedule, err)
+			continue
+		}
+		if got := sc.Active(tc.at); got != tc.active {
+			t.Errorf("%q at %s: expected active %v, got %v", tc.schedule, tc.at.Format("Mon 15:04"), tc.active, got)
+		}
+	}
+
+	for _, invalid := range []string{"", "09:00", "9-17", "mon-fry 09:00-17:00", "09:00-09:00", "mon 09:00-17:00 extra"} {
+		if _, err := ParseSchedule(invalid); err == nil {
+			t.Errorf("ParseSchedule(%q) expected error, got nil", invalid)
+		}
+	}
+}
+
+func TestAltSpeed(t *testing.T) {
+	// Start inside the window of the schedule
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	fake := clock.NewFake(start)
+	schedule, _ := ParseSchedule("12:00-13:00")
+	sess, err := newTestSession(t, Config{
+		DownloadDir: t.TempDir(), DisableDHT: true, Clock: fake,
+		MaxDownload: 1000, MaxUpload: 2000, AltMaxDownload: 100, AltMaxUpload: 200, AltSchedule: schedule,
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	effective := func() [2]int64 {
+		return [2]int64{sess.downLimit.Limit(), sess.upLimit.Limit()}
+	}
+	waitFor := func(on bool, expected [2]int64) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); sess.AltSpeed() != on || effective() != expected; time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected alternative speed %v with limits %v, got %v with %v", on, expected, sess.AltSpeed(), effective())
+			}
+		}
+	}
+	waitFor(true, [2]int64{100, 200})
+
+	// A manual toggle wins until the schedule changes again
+	sess.SetAltSpeed(false)
+	waitFor(false, [2]int64{1000, 2000})
+	sess.SetAltSpeed(true)
+
+	// Changing the normal limits while turtle mode is on keeps it on
+	if err := sess.SetRateLimits(3000, 4000); err != nil {
+		t.Fatalf("SetRateLimits failed: %v", err)
+	}
+	waitFor(true, [2]int64{100, 200})
+	if down, up := sess.RateLimits(); down != 3000 || up != 4000 {
+		t.Errorf("Expected normal limits 3000/4000, got %d/%d", down, up)
+	}
+
+	// The window ends
+	for deadline := time.Now().Add(5 * time.Second); sess.AltSpeed(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the schedule to switch the alternative limits off")
+		}
+		fake.Advance(altScheduleCheck)
+	}
+	waitFor(false, [2]int64{3000, 4000})
+}
+
+func TestBandwidthSchedule(t *testing.T) {
+	// Start inside the window of the first rule
+	fake := clock.NewFake(time.Date(2024, 1, 1, 12, 50, 0, 0, time.Local))
+	limited, _ := ParseSchedule("12:00-13:00")
+	pause, _ := ParseSchedule("13:00-13:30")
+	sess, err := newTestSession(t, Config{
+		DownloadDir: t.TempDir(), DisableDHT: true, Clock: fake,
+		MaxDownload: 1000, MaxUpload: 2000, AltMaxDownload: 10, AltMaxUpload: 20,
+		BandwidthSchedule: []BandwidthRule{
+			{Schedule: *limited, MaxDownload: 100, MaxUpload: 200},
+			{Schedule: *pause, Pause: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	waitFor := func(expected [2]int64) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); [2]int64{sess.downLimit.Limit(), sess.upLimit.Limit()} != expected; time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected limits %v, got %d/%d", expected, sess.downLimit.Limit(), sess.upLimit.Limit())
+			}
+		}
+	}
+	waitFor([2]int64{100, 200})
+	if rule, ok := sess.BandwidthRule(); !ok || rule.MaxDownload != 100 {
+		t.Errorf("Expected the first rule in effect, got %+v (%v)", rule, ok)
+	}
+
+	// Turtle mode wins over the schedule
+	sess.SetAltSpeed(true)
+	waitFor([2]int64{10, 20})
+	sess.SetAltSpeed(false)
+	waitFor([2]int64{100, 200})
+
+	// A peer that never answers keeps the torrent fetching metadata
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer silent.Close()
+	tor, err := sess.AddMagnet("magnet:?xt=urn:btih:83e53cb48c4af4989cd1a53a5b4671da821b1ff4&x.pe=" + silent.Addr().String())
+	if err != nil {
+		t.Fatalf("AddMagnet failed: %v", err)
+	}
+
+	// The pause rule pauses the torrent, and resumes it when its window ends
+	advanceUntil := func(state State) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); tor.State() != state; time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the torrent to be %v, got %v", state, tor.State())
+			}
+			fake.Advance(altScheduleCheck)
+		}
+	}
+	advanceUntil(StatePaused)
+	waitFor([2]int64{1000, 2000})
+	advanceUntil(StateFetchingMetadata)
+	if _, ok := sess.BandwidthRule(); ok {
+		t.Error("Expected no rule in effect after the windows")
+	}
+}
+
+func TestTorrentRateLimits(t *testing.T) {
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, Clock: clock.NewFake(time.Now()), MaxDownload: 1000})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+	tor := newTorrent(sess, [20]byte{1}, "", nil, nil)
+
+	if err := tor.SetRateLimits(500, 0); err != nil {
+		t.Fatalf("SetRateLimits failed: %v", err)
+	}
+	if down, up := tor.RateLimits(); down != 500 || up != 0 {
+		t.Errorf("Expected limits 500/0, got %d/%d", down, up)
+	}
+	if err := tor.SetRateLimits(-1, 0); err == nil {
+		t.Error("Expected a negative limit to be rejected")
+	}
+
+	// The torrent's transfers count against the session's limit too
+	if err := tor.SetRateLimits(0, 0); err != nil {
+		t.Fatalf("SetRateLimits failed: %v", err)
+	}
+	ctx := context.Background()
+	if err := tor.downLimit.Wait(ctx, 1000); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := sess.downLimit.Wait(ctx, 1000); err == nil {
+		t.Error("Expected the torrent's download to use up the session's burst")
+	}
+}
+
+func TestStatsHook(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	snapshots := make(chan Stats, 10)
+	hooks := Hooks{OnStats: func(infoHash [20]byte, stats Stats) {
+		if infoHash == [20]byte{1} {
+			snapshots <- stats
+		}
+	}}
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, Clock: fake, Hooks: hooks})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+	tor := newTorrent(sess, [20]byte{1}, "", nil, nil)
+	tor.stats.Downloaded.Store(1000)
+	sess.mu.Lock()
+	sess.torrents[tor.infoHash] = tor
+	sess.mu.Unlock()
+
+	// Each rate sample hands out a snapshot
+	for deadline := time.Now().Add(5 * time.Second); len(snapshots) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected OnStats to be called")
+		}
+		if fake.Waiters() > 0 {
+			fake.Advance(rateInterval)
+		}
+	}
+	if stats := <-snapshots; stats.Downloaded != 1000 || stats.DownloadRate <= 0 {
+		t.Errorf("Expected 1000 bytes downloaded at a positive rate, got %+v", stats)
+	}
+	sess.mu.Lock()
+	delete(sess.torrents, tor.infoHash)
+	sess.mu.Unlock()
+}
+
+func TestConnLimit(t *testing.T) {
+	sess, err := newTestSession(t, Config{DownloadDir: t.TempDir(), DisableDHT: true, MaxConnections: 100, MaxPeers: 50})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer sess.Close()
+
+	// Torrents in given states, not running
+	add := func(id byte, state State) *Torrent {
+		tor := newTorrent(sess, [20]byte{id}, "", nil, nil)
+		tor.state = state
+		sess.mu.Lock()
+		sess.torrents[tor.infoHash] = tor
+		sess.mu.Unlock()
+		return tor
+	}
+	defer func() {
+		sess.mu.Lock()
+		clear(sess.torrents)
+		sess.mu.Unlock()
+	}()
+
+	// Alone, a download is capped by MaxPeers
+	a := add(1, StateDownloading)
+	if got := a.MaxConnections(); got != 50 {
+		t.Errorf("Expected a lone download to get MaxPeers connections, got %d", got)
+	}
+
+	// Downloads get four slots for each one a seed gets; paused torrents none
+	b := add(2, StateDownloading)
+	var seeds []*Torrent
+	for i := byte(0); i < 4; i++ {
+		seeds = append(seeds, add(10+i, StateSeeding))
+	}
+	add(20, StatePaused)
+	if got := a.MaxConnections(); got != 33 {
+		t.Errorf("Expected a download to get 100*4/12 connections, got %d", got)
+	}
+	if got := seeds[0].MaxConnections(); got != 8 {
+		t.Errorf("Expected a seed to get 100/12 connections, got %d", got)
+	}
+
+	// An override comes out of the others' budget
+	if err := b.SetMaxConnections(30); err != nil {
+		t.Fatalf("SetMaxConnections failed: %v", err)
+	}
+	if got := b.MaxConnections(); got != 30 {
+		t.Errorf("Expected the override of 30 connections, got %d", got)
+	}
+	if got := a.MaxConnections(); got != 35 {
+		t.Errorf("Expected a download to get 70*4/8 connections, got %d", got)
+	}
+	if err := b.SetMaxConnections(-1); err == nil {
+		t.Error("Expected a negative limit to be rejected")
+	}
+
+	// However tight the budget, every torrent gets a connection
+	if err := b.SetMaxConnections(1000); err != nil {
+		t.Fatalf("SetMaxConnections failed: %v", err)
+	}
+	if got := seeds[0].MaxConnections(); got != 1 {
+		t.Errorf("Expected a seed to keep 1 connection, got %d", got)
+	}
+}
@@ -0,0 +1,593 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+	"github.com/omkarkirpan/bittorrent-client/clock"
+	"github.com/omkarkirpan/bittorrent-client/download"
+	"github.com/omkarkirpan/bittorrent-client/statedir"
+	"github.com/omkarkirpan/bittorrent-client/stats"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+	"github.com/omkarkirpan/bittorrent-client/transport"
+)
+
+// swarmTracker is the announce URL of a swarm's tracker
+const swarmTracker = "http://tracker.swarm/announce"
+
+// swarm runs sessions that reach each other over an in-memory network and
+// find each other through an in-memory tracker, so whole transfers run without
+// sockets
+type swarm struct {
+	t       *testing.T
+	network transport.Memory
+
+	mu      sync.Mutex
+	peers   map[string]map[string]bool // info hash to announced host:port
+	events  []string                   // events announced, in order
+	files   map[string][]byte          // served under filesHost by path
+	clients int
+}
+
+// filesHost is the host the swarm serves files put with serve from
+const filesHost = "files.swarm"
+
+func newSwarm(t *testing.T) *swarm {
+	return &swarm{t: t, peers: make(map[string]map[string]bool), files: make(map[string][]byte)}
+}
+
+// serve makes data available to the swarm's sessions over HTTP and returns
+// its URL
+func (sw *swarm) serve(path string, data []byte) string {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.files[path] = data
+	return "http://" + filesHost + path
+}
+
+// join starts a session on the swarm's network with its own IP address
+func (sw *swarm) join(cfg Config) *Session {
+	sw.t.Helper()
+	sw.mu.Lock()
+	sw.clients++
+	ip := net.IPv4(10, 0, 0, byte(sw.clients)).String()
+	sw.mu.Unlock()
+
+	if cfg.DownloadDir == "" {
+		cfg.DownloadDir = sw.t.TempDir()
+	}
+	cfg.DisableDHT = true
+	cfg.DisableIPv6 = true
+	cfg.Transport = &sw.network
+	cfg.HTTPClient = &http.Client{Transport: &trackerTransport{tracker: sw, remoteIP: ip}}
+	s, err := newTestSession(sw.t, cfg)
+	if err != nil {
+		sw.t.Fatalf("New failed: %v", err)
+	}
+	sw.t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// torrent returns a torrent of data announced to the swarm's tracker
+func (sw *swarm) torrent(name string, data []byte, pieceLength int) *torrent.TorrentFile {
+	var pieces []byte
+	for i := 0; i < len(data); i += pieceLength {
+		hash := sha1.Sum(data[i:min(i+pieceLength, len(data))])
+		pieces = append(pieces, hash[:]...)
+	}
+	return &torrent.TorrentFile{
+		Announce: swarmTracker,
+		Info: torrent.TorrentInfo{
+			Name:        name,
+			Length:      int64(len(data)),
+			PieceLength: int64(pieceLength),
+			Pieces:      string(pieces),
+		},
+	}
+}
+
+// seed adds tf to s with data in place, as written by seedFiles, and waits
+// for it to seed
+func (sw *swarm) seed(s *Session, tf *torrent.TorrentFile, data []byte) *Torrent {
+	sw.t.Helper()
+	sw.seedFiles(s, tf, data)
+	infoHash, _ := tf.InfoHash()
+	tor, err := s.AddTorrent(tf)
+	if err != nil {
+		sw.t.Fatalf("AddTorrent failed: %v", err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); tor.State() != StateSeeding || !sw.announced(infoHash, s); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			sw.t.Fatalf("Expected the torrent to seed and be announced, got %v (err: %v)", tor.State(), tor.Err())
+		}
+	}
+	return tor
+}
+
+// seedFiles writes data, split into tf's files, into s's download directory
+// and records it as verified, so adding tf to s seeds it
+func (sw *swarm) seedFiles(s *Session, tf *torrent.TorrentFile, data []byte) {
+	sw.t.Helper()
+	dir := s.cfg.DownloadDir
+	if len(tf.Info.Files) == 0 {
+		if err := os.WriteFile(filepath.Join(dir, tf.Info.Name), data, 0o644); err != nil {
+			sw.t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	for _, f := range tf.Info.Files {
+		path := filepath.Join(append([]string{dir, tf.Info.Name}, f.Path...)...)
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, data[:f.Length], 0o644); err != nil {
+			sw.t.Fatalf("WriteFile failed: %v", err)
+		}
+		data = data[f.Length:]
+	}
+	layout := download.Layout{Dir: dir}
+	result, err := download.Verify(tf, layout, nil)
+	if err != nil {
+		sw.t.Fatalf("Verify failed: %v", err)
+	}
+	infoHash, _ := tf.InfoHash()
+	if err := download.SaveResume(download.ResumePath(dir, infoHash), infoHash, layout.Root(tf), result.Have, nil); err != nil {
+		sw.t.Fatalf("SaveResume failed: %v", err)
+	}
+}
+
+// announced reports whether s announced the torrent to the tracker
+func (sw *swarm) announced(infoHash [20]byte, s *Session) bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	for addr := range sw.peers[string(infoHash[:])] {
+		if _, port, _ := net.SplitHostPort(addr); port == strconv.Itoa(int(s.cfg.Port)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP answers announces with every other peer of the torrent, and
+// requests for files put with serve
+func (sw *swarm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Host == filesHost {
+		sw.mu.Lock()
+		data, ok := sw.files[r.URL.Path]
+		sw.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+		return
+	}
+
+	q := r.URL.Query()
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	self := net.JoinHostPort(host, q.Get("port"))
+
+	sw.mu.Lock()
+	peers := sw.peers[q.Get("info_hash")]
+	if peers == nil {
+		peers = make(map[string]bool)
+		sw.peers[q.Get("info_hash")] = peers
+	}
+	var compact []byte
+	for addr := range peers {
+		if addr == self {
+			continue
+		}
+		ap, _ := net.ResolveTCPAddr("tcp4", addr)
+		compact = binary.BigEndian.AppendUint16(append(compact, ap.IP.To4()...), uint16(ap.Port))
+	}
+	if event := q.Get("event"); event != "" {
+		sw.events = append(sw.events, event)
+	}
+	if q.Get("event") == "stopped" {
+		delete(peers, self)
+	} else {
+		peers[self] = true
+	}
+	sw.mu.Unlock()
+
+	resp, _ := bencode.EncodeDict(map[string]interface{}{
+		"interval": 1800,
+		"peers":    string(compact),
+	})
+	w.Write(resp)
+}
+
+// trackerTransport hands HTTP requests to the swarm's tracker and file server
+// in process, as if they came from remoteIP
+type trackerTransport struct {
+	tracker  http.Handler
+	remoteIP string
+}
+
+func (tt *trackerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host != "tracker.swarm" && r.URL.Host != filesHost {
+		return nil, fmt.Errorf("no server at %s", r.URL.Host)
+	}
+	r = r.Clone(r.Context())
+	r.RemoteAddr = net.JoinHostPort(tt.remoteIP, "1")
+	rec := httptest.NewRecorder()
+	tt.tracker.ServeHTTP(rec, r)
+	return rec.Result(), nil
+}
+
+func TestSwarm(t *testing.T) {
+	data := make([]byte, 300000)
+	rand.Read(data)
+
+	sw := newSwarm(t)
+	tf := sw.torrent("swarm.bin", data, 32768)
+	seeding := sw.join(Config{Seed: true})
+	sw.seed(seeding, tf, data)
+
+	// Hooks see every connection, block, announce and hash check
+	var connects, announces, verified atomic.Int64
+	var received atomic.Int64
+	hooks := Hooks{
+		OnPeerConnect: func(infoHash [20]byte, addr string) { connects.Add(1) },
+		OnBlockReceived: func(infoHash [20]byte, addr string, piece, begin, length int) {
+			received.Add(int64(length))
+		},
+		OnAnnounce: func(infoHash [20]byte, tracker string, peers int, took time.Duration, err error) {
+			if tracker == swarmTracker && peers == 1 && err == nil {
+				announces.Add(1)
+			}
+		},
+		OnPieceVerified: func(infoHash [20]byte, piece int, ok bool) {
+			if ok {
+				verified.Add(1)
+			}
+		},
+	}
+
+	dir := t.TempDir()
+	leeching := sw.join(Config{DownloadDir: dir, Hooks: hooks})
+	tor, err := leeching.AddTorrent(tf)
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+	select {
+	case <-tor.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Download did not finish, state: %v", tor.State())
+	}
+	if tor.State() != StateComplete {
+		t.Fatalf("Expected state complete, got %v (err: %v)", tor.State(), tor.Err())
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "swarm.bin"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Downloaded content does not match")
+	}
+	if stats := tor.Stats(); stats.Verified != int64(tf.NumPieces()) || stats.HashFailures != 0 {
+		t.Errorf("Expected %d pieces verified and none failed, got %+v", tf.NumPieces(), stats)
+	}
+	if connects.Load() != 1 || announces.Load() != 1 || received.Load() != int64(len(data)) || verified.Load() != int64(tf.NumPieces()) {
+		t.Errorf("Expected hooks for 1 connection, 1 announce, %d bytes and %d pieces, got %d, %d, %d and %d",
+			len(data), tf.NumPieces(), connects.Load(), announces.Load(), received.Load(), verified.Load())
+	}
+
+	// Both peers announced they started, and the leecher that it completed
+	for deadline := time.Now().Add(5 * time.Second); !slices.Equal(sw.announcedEvents(), []string{"started", "started", "completed"}); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected started, started and completed announces, got %v", sw.announcedEvents())
+		}
+	}
+}
+
+func TestSwarmSeedTime(t *testing.T) {
+	data := make([]byte, 50000)
+	rand.Read(data)
+
+	// Seeding for a day takes no time on a fake clock
+	fake := clock.NewFake(time.Now())
+	sw := newSwarm(t)
+	tf := sw.torrent("seedtime.bin", data, 16384)
+	seeding := sw.join(Config{Seed: true, SeedTime: 24 * time.Hour, Clock: fake})
+	tor := sw.seed(seeding, tf, data)
+
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		select {
+		case <-tor.Done():
+		default:
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected seeding to stop, state: %v", tor.State())
+			}
+			fake.Advance(time.Hour)
+			continue
+		}
+		break
+	}
+	if tor.State() != StateComplete {
+		t.Errorf("Expected state complete, got %v (err: %v)", tor.State(), tor.Err())
+	}
+	if seeded := fake.Since(tor.Added()); seeded < 24*time.Hour {
+		t.Errorf("Expected seeding to stop after a day, stopped after %v", seeded)
+	}
+}
+
+func TestSwarmSeedPause(t *testing.T) {
+	data := make([]byte, 50000)
+	rand.Read(data)
+
+	// The session seeds without limits; the torrent gets its own
+	fake := clock.NewFake(time.Now())
+	sw := newSwarm(t)
+	tf := sw.torrent("seedpause.bin", data, 16384)
+	seeding := sw.join(Config{Seed: true, Clock: fake})
+	tor := sw.seed(seeding, tf, data)
+	if err := tor.SetSeedLimits(&SeedLimits{Time: time.Hour, Pause: true}); err != nil {
+		t.Fatalf("SetSeedLimits failed: %v", err)
+	}
+	if err := tor.SetSeedLimits(&SeedLimits{Ratio: -1}); err == nil {
+		t.Error("Expected error for a negative ratio")
+	}
+	if limits := tor.SeedLimits(); limits.Time != time.Hour || !limits.Pause {
+		t.Errorf("Expected the torrent's own limits, got %+v", limits)
+	}
+
+	// Reaching the limit pauses the torrent rather than completing it
+	for deadline := time.Now().Add(10 * time.Second); tor.State() != StatePaused; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the torrent paused, state: %v", tor.State())
+		}
+		fake.Advance(10 * time.Minute)
+	}
+	select {
+	case <-tor.Done():
+		t.Fatal("Expected a paused torrent not to be done")
+	default:
+	}
+
+	// Back on the session's limits, none, it seeds again once resumed
+	tor.SetSeedLimits(nil)
+	if err := tor.Resume(); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); tor.State() != StateSeeding; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the torrent seeding again, state: %v", tor.State())
+		}
+	}
+	fake.Advance(2 * time.Hour)
+	time.Sleep(20 * time.Millisecond)
+	if tor.State() != StateSeeding {
+		t.Errorf("Expected the torrent still seeding without limits, got %v", tor.State())
+	}
+
+	// Pausing a seeding torrent doesn't complete it either
+	if err := tor.Pause(); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	if tor.State() != StatePaused {
+		t.Errorf("Expected the torrent paused, got %v", tor.State())
+	}
+	select {
+	case <-tor.Done():
+		t.Error("Expected a paused seeding torrent not to be done")
+	default:
+	}
+}
+
+func TestSwarmSeedQueue(t *testing.T) {
+	first, second := make([]byte, 30000), make([]byte, 30000)
+	rand.Read(first)
+	rand.Read(second)
+
+	// With one seeding slot, the second torrent waits for it once complete
+	sw := newSwarm(t)
+	seeding := sw.join(Config{Seed: true, MaxActiveSeeds: 1})
+	a := sw.seed(seeding, sw.torrent("first.bin", first, 16384), first)
+	tf := sw.torrent("second.bin", second, 16384)
+	sw.seedFiles(seeding, tf, second)
+	b, err := seeding.AddTorrent(tf)
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); b.State() != StateQueued; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the second torrent queued for seeding, got %v", b.State())
+		}
+	}
+	if done, total := b.Progress(); done != total {
+		t.Errorf("Expected the queued torrent complete, got %d of %d pieces", done, total)
+	}
+
+	// Pausing the seeding one hands the slot on
+	if err := a.Pause(); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); b.State() != StateSeeding; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the second torrent seeding, got %v", b.State())
+		}
+	}
+}
+
+// announcedEvents returns the events announced to the tracker so far
+func (sw *swarm) announcedEvents() []string {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return append([]string(nil), sw.events...)
+}
+
+func TestSwarmPartialSeed(t *testing.T) {
+	data := make([]byte, 80000)
+	rand.Read(data)
+
+	// Two files, each filling whole pieces
+	sw := newSwarm(t)
+	tf := sw.torrent("partial", data, 16384)
+	tf.Info.Length = 0
+	tf.Info.Files = []torrent.FileInfo{
+		{Length: 32768, Path: []string{"wanted.bin"}},
+		{Length: int64(len(data)) - 32768, Path: []string{"skipped.bin"}},
+	}
+	seeding := sw.join(Config{Seed: true})
+	seedTorrent := sw.seed(seeding, tf, data)
+
+	leeching := sw.join(Config{Seed: true, SelectFiles: func(tf *torrent.TorrentFile) ([]download.Priority, error) {
+		return []download.Priority{download.PriorityNormal, download.PrioritySkip}, nil
+	}})
+	tor, err := leeching.AddTorrent(tf)
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+
+	// Once the wanted file is done, trackers hear we're a partial seed and
+	// peers that we only upload
+	for deadline := time.Now().Add(10 * time.Second); !tor.PartialSeed(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a partial seed, state: %v (err: %v)", tor.State(), tor.Err())
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		events := sw.announcedEvents()
+		peers := seedTorrent.Peers()
+		if len(events) > 0 && events[len(events)-1] == tracker.EventPaused && len(peers) == 1 && peers[0].UploadOnly {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a paused announce and an upload-only peer, got events %v and peers %+v", events, peers)
+		}
+	}
+	if seedTorrent.PartialSeed() {
+		t.Error("Expected a full seed not to be a partial seed")
+	}
+}
+
+func TestSwarmLifetimeStats(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.Read(data)
+
+	sw := newSwarm(t)
+	tf := sw.torrent("lifetime.bin", data, 16384)
+	state := statedir.Dir(t.TempDir())
+	seeding := sw.join(Config{Seed: true, StateDir: state})
+	seedTorrent := sw.seed(seeding, tf, data)
+
+	leeching := sw.join(Config{})
+	tor, err := leeching.AddTorrent(tf)
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+	select {
+	case <-tor.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Download did not finish, state: %v", tor.State())
+	}
+	for deadline := time.Now().Add(5 * time.Second); seedTorrent.Stats().Uploaded < int64(len(data)); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the seed to upload %d bytes, uploaded %d", len(data), seedTorrent.Stats().Uploaded)
+		}
+	}
+
+	// Closing the session saves the totals, which the next run starts from
+	seeding.Close()
+	db, err := stats.Open(state.Stats())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	record, ok := db.Torrent(seedTorrent.InfoHash())
+	if !ok {
+		t.Fatal("Expected a record for the seeded torrent")
+	}
+	if record.Name != "lifetime.bin" || record.Length != int64(len(data)) || record.Uploaded != seedTorrent.Stats().Uploaded {
+		t.Errorf("Expected lifetime.bin, %d bytes and %d uploaded, got %s, %d and %d",
+			len(data), seedTorrent.Stats().Uploaded, record.Name, record.Length, record.Uploaded)
+	}
+	if record.Ratio() < 1 {
+		t.Errorf("Expected a lifetime ratio of at least 1, got %v", record.Ratio())
+	}
+
+	// A ratio reached in an earlier run stops seeding right away
+	again := sw.join(Config{Seed: true, SeedRatio: 1, StateDir: state})
+	tor = sw.seed(again, tf, data)
+	select {
+	case <-tor.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected seeding to stop at the lifetime ratio, state: %v", tor.State())
+	}
+	if lifetime, _ := tor.Lifetime(); lifetime.Uploaded != record.Uploaded {
+		t.Errorf("Expected %d bytes uploaded over the torrent's lifetime, got %d", record.Uploaded, lifetime.Uploaded)
+	}
+}
+
+func TestSwarmUpdateFeed(t *testing.T) {
+	v1Data, v2Data := make([]byte, 50000), make([]byte, 60000)
+	rand.Read(v1Data)
+	rand.Read(v2Data)
+
+	// The publisher seeds both versions and lists the newest first
+	sw := newSwarm(t)
+	feedURL := "http://" + filesHost + "/feed.rss"
+	v1, v2 := sw.torrent("dataset-v1", v1Data, 16384), sw.torrent("dataset-v2", v2Data, 16384)
+	v1.Info.UpdateURL, v2.Info.UpdateURL = feedURL, feedURL
+	seeding := sw.join(Config{Seed: true})
+	sw.seed(seeding, v1, v1Data)
+	sw.seed(seeding, v2, v2Data)
+	for path, tf := range map[string]*torrent.TorrentFile{"/v1.torrent": v1, "/v2.torrent": v2} {
+		data, _ := tf.Encode()
+		sw.serve(path, data)
+	}
+	sw.serve("/feed.rss", []byte("<rss><channel><item><link>v2.torrent</link></item><item><link>v1.torrent</link></item></channel></rss>"))
+
+	leeching := sw.join(Config{UpdateInterval: time.Hour, RetireUpdated: true})
+	old, err := leeching.AddTorrent(v1)
+	if err != nil {
+		t.Fatalf("AddTorrent failed: %v", err)
+	}
+	select {
+	case <-old.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Download did not finish, state: %v", old.State())
+	}
+
+	// The check adds the newer version, which retires the old one once done
+	leeching.checkUpdates(context.Background())
+	next := old.Successor()
+	if next == nil || next.Name() != "dataset-v2" {
+		t.Fatalf("Expected dataset-v2 as successor, got %v", next)
+	}
+	select {
+	case <-next.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Download did not finish, state: %v", next.State())
+	}
+	for deadline := time.Now().Add(5 * time.Second); leeching.Torrent(old.InfoHash()) != nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the old version to be retired")
+		}
+	}
+	if _, err := os.Stat(filepath.Join(leeching.cfg.DownloadDir, "dataset-v1")); err != nil {
+		t.Errorf("Expected the old version's files to be kept: %v", err)
+	}
+
+	// Up to date, nothing more is added
+	leeching.checkUpdates(context.Background())
+	if n := len(leeching.Torrents()); n != 1 {
+		t.Errorf("Expected 1 torrent, got %d", n)
+	}
+}
@@ -0,0 +1,1584 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/download"
+	"github.com/omkarkirpan/bittorrent-client/events"
+	"github.com/omkarkirpan/bittorrent-client/logging"
+	"github.com/omkarkirpan/bittorrent-client/metadata"
+	"github.com/omkarkirpan/bittorrent-client/ratelimit"
+	"github.com/omkarkirpan/bittorrent-client/stats"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+	"github.com/omkarkirpan/bittorrent-client/transport"
+)
+
+// Peer discovery and metadata tuning
+const (
+	announceTimeout   = 15 * time.Second // Wait at most this long for trackers
+	metadataPeers     = 5                // Peers asked for metadata in parallel
+	metadataRetryWait = 30 * time.Second // Pause before rediscovering peers for metadata
+	defaultMaxPeers   = 50               // Peers connected to for a download unless Config.MaxPeers says otherwise
+	peerRefill        = 10 * time.Second // How often a download's free connection slots are filled from the pool
+	incomingBacklog   = 16               // Incoming connections waiting for the download engine
+	rateInterval      = time.Second      // How often transfer rates are sampled
+	rateSmoothing     = 0.3              // Weight of the newest rate sample in the moving average
+	seedCheckInterval = time.Second      // How often seeding limits are checked
+	dhtPingTimeout    = 10 * time.Second // Wait for a DHT node a peer advertises to answer a ping
+	readaheadPieces   = 4                // Missing pieces kept at the front of the queue in sequential mode
+)
+
+// errRemoved is the error of a torrent removed from its session
+var errRemoved = errors.New("torrent removed")
+
+// ErrTrackers marks a torrent that found no peers while every tracker
+// failed. Such errors also match download.ErrNoPeers.
+var ErrTrackers = errors.New("every tracker failed")
+
+// State is the lifecycle state of a torrent
+type State int
+
+const (
+	StateFetchingMetadata State = iota
+	StateDownloading
+	StateComplete
+	StateFailed
+	StatePaused
+	StateSeeding
+	StateQueued // waiting for a slot within Config.MaxActiveDownloads or MaxActiveSeeds
+)
+
+// String returns a human-readable state name
+func (s State) String() string {
+	switch s {
+	case StateFetchingMetadata:
+		return "fetching metadata"
+	case StateDownloading:
+		return "downloading"
+	case StateComplete:
+		return "complete"
+	case StateFailed:
+		return "failed"
+	case StatePaused:
+		return "paused"
+	case StateSeeding:
+		return "seeding"
+	case StateQueued:
+		return "queued"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// Torrent is a torrent managed by a session
+type Torrent struct {
+	session  *Session
+	infoHash [20]byte
+	trackers []string
+	direct   []string // peer addresses given directly, e.g. by x.pe in a magnet link
+	// One per supported tracker, keeping it posted for the torrent's life
+	announcers []*tracker.Announcer
+	// Files to download by index, from so in a magnet link (BEP 53); nil for
+	// all. Config.SelectFiles takes precedence.
+	selectOnly []int
+	pool       *peerPool
+	incoming   chan download.IncomingConn // handshaken connections from peers that dialed us
+	stats      download.Stats
+	log        *slog.Logger
+	added      time.Time
+
+	mu         sync.Mutex
+	name       string
+	meta       *torrent.TorrentFile
+	state      State
+	piecesDone int           // wanted pieces written
+	have       []bool        // pieces written, kept across pause and resume
+	written    []bool        // pieces known to be on disk; unlike have, always guarded by mu
+	wake       chan struct{} // closed and replaced when a piece is written
+	err        error
+	done       chan struct{}
+	cancel     context.CancelFunc // stops the current run
+	stopped    chan struct{}      // closed when the current run has returned
+
+	// Pieces to download as selected by Config.SelectFiles: a priority per
+	// piece, or nil for all, and the number and size of the wanted pieces
+	priorities   []download.Priority
+	wanted       int
+	wantedLength int64
+	// File priorities: set with SetFilePriorities, taking precedence over
+	// Config.SelectFiles, and as last selected, nil when all are normal
+	fileOverride []download.Priority
+	files        []download.Priority
+
+	trackerStatus map[string]TrackerStatus
+
+	// Smoothed transfer rates in bytes per second
+	downRate, upRate float64
+	lastDown, lastUp int64
+
+	// What recordLifetime last added to the lifetime totals, and when
+	recorded   stats.Totals
+	recordedAt time.Time
+
+	successor *Torrent       // newer version from the update feed, once added
+	mutable   *mutableSource // publisher of a mutable torrent (BEP 46), or nil
+
+	maxConns   int         // connection cap set with SetMaxConnections; 0 for the fair share
+	seedLimits *SeedLimits // set with SetSeedLimits; nil for the session's
+
+	// The torrent's own rate limits, within the session's
+	downLimit *ratelimit.Limiter
+	upLimit   *ratelimit.Limiter
+
+	resumeDirty bool // pieces were written since the resume data was last saved
+
+	queueSeq   uint64    // place in the queue: torrents added earlier start first
+	forceStart bool      // set with SetForceStart: runs regardless of the active limits
+	progressAt time.Time // when the current run started or last received piece data
+	seedQueued bool      // completed while every seeding slot was taken
+}
+
+func newTorrent(s *Session, infoHash [20]byte, name string, trackers, direct []string) *Torrent {
+	t := &Torrent{
+		session:  s,
+		infoHash: infoHash,
+		name:     name,
+		trackers: trackers,
+		direct:   direct,
+		pool:     newPeerPool(s.clock),
+		done:     make(chan struct{}),
+		wake:     make(chan struct{}),
+		cancel:   func() {},
+		stopped:  closedChan(), // queued torrents haven't run yet
+		added:    s.clock.Now(),
+		log:      s.logger.With("component", "torrent", logging.InfoHash(infoHash)),
+
+		downLimit: ratelimit.New(0, ratelimit.WithParent(s.downLimit), ratelimit.WithClock(s.clock)),
+		upLimit:   ratelimit.New(0, ratelimit.WithParent(s.upLimit), ratelimit.WithClock(s.clock)),
+	}
+	t.pool.self = s.externalAddr
+	for _, url := range trackers {
+		if !strings.HasPrefix(url, "http") && !strings.HasPrefix(url, "udp://") {
+			continue // only HTTP and UDP trackers are supported
+		}
+		t.announcers = append(t.announcers, &tracker.Announcer{
+			URL:      url,
+			Request:  t.announceRequest,
+			Send:     t.announce,
+			Answered: t.trackerAnswered(url),
+			Clock:    s.clock,
+		})
+	}
+	// Without incoming peers, the download gives up once every peer is gone
+	if !s.cfg.NoListen {
+		t.incoming = make(chan download.IncomingConn, incomingBacklog)
+	}
+	return t
+}
+
+// InfoHash returns the torrent's info hash
+func (t *Torrent) InfoHash() [20]byte {
+	return t.infoHash
+}
+
+// Added returns when the torrent was added to the session
+func (t *Torrent) Added() time.Time {
+	return t.added
+}
+
+// Name returns the torrent name, which may be empty until metadata arrives
+func (t *Torrent) Name() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.name
+}
+
+// Path returns where the torrent's content is saved: its file, or its folder
+// for multi-file torrents. It's empty until metadata arrives.
+func (t *Torrent) Path() string {
+	meta := t.Metadata()
+	if meta == nil {
+		return ""
+	}
+	return t.session.layout().Root(meta)
+}
+
+// Metadata returns the parsed torrent, or nil while it is still being fetched
+func (t *Torrent) Metadata() *torrent.TorrentFile {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.meta
+}
+
+// State returns the current lifecycle state
+func (t *Torrent) State() State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// Progress returns the number of verified pieces and the number of pieces to
+// download, which is every piece unless files were skipped
+func (t *Torrent) Progress() (done, total int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.piecesDone, t.wanted
+}
+
+// FileProgress is how much of one file of a torrent has been downloaded
+type FileProgress struct {
+	Path     string // Path within the torrent, with / between folders
+	Length   int64
+	Done     int64 // Bytes in pieces verified and written
+	Priority download.Priority
+	Padding  bool // Zeros aligning the next file to a piece (BEP 47), which aren't saved
+}
+
+// Files returns the progress of each file of the torrent, in the torrent's
+// order, or nil until its metadata arrives
+func (t *Torrent) Files() []FileProgress {
+	t.mu.Lock()
+	tf, written, priorities := t.meta, slices.Clone(t.written), t.files
+	if t.fileOverride != nil {
+		priorities = t.fileOverride // not applied yet, if the run is restarting
+	}
+	t.mu.Unlock()
+	if tf == nil {
+		return nil
+	}
+
+	done := download.FileProgress(tf, written)
+	priority := func(i int) download.Priority {
+		if i < len(priorities) {
+			return priorities[i]
+		}
+		return download.PriorityNormal
+	}
+	if len(tf.Info.Files) == 0 {
+		return []FileProgress{{Path: tf.Info.Name, Length: tf.Info.Length, Done: done[0], Priority: priority(0)}}
+	}
+	files := make([]FileProgress, len(tf.Info.Files))
+	for i, f := range tf.Info.Files {
+		files[i] = FileProgress{Path: strings.Join(f.Path, "/"), Length: f.Length, Done: done[i], Priority: priority(i), Padding: f.IsPadding()}
+	}
+	return files
+}
+
+// SetFilePriorities changes which files of the torrent are downloaded, and
+// how eagerly, with a priority per file in the torrent's order. It takes
+// precedence over Config.SelectFiles. A running torrent restarts its
+// download to apply it, keeping the pieces it has; a paused one applies it
+// when resumed.
+func (t *Torrent) SetFilePriorities(priorities []download.Priority) error {
+	t.mu.Lock()
+	if t.meta == nil {
+		t.mu.Unlock()
+		return errors.New("torrent metadata not fetched yet")
+	}
+	if n := max(len(t.meta.Info.Files), 1); len(priorities) != n {
+		t.mu.Unlock()
+		return fmt.Errorf("got %d file priorities for %d files", len(priorities), n)
+	}
+	state := t.state
+	if state == StateComplete || state == StateFailed {
+		t.mu.Unlock()
+		return fmt.Errorf("can't change the files of a torrent that is %v", state)
+	}
+	t.fileOverride = slices.Clone(priorities)
+	running := state == StateDownloading || state == StateSeeding
+	if running {
+		t.state = StatePaused
+	}
+	cancel, stopped := t.cancel, t.stopped
+	t.mu.Unlock()
+
+	t.log.Info("file priorities changed")
+	if !running {
+		return nil
+	}
+	cancel()
+	<-stopped
+	return t.Resume()
+}
+
+// PartialSeed reports whether the torrent is seeding the files selected for
+// download without having the others (BEP 21)
+func (t *Torrent) PartialSeed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state == StateSeeding && t.meta != nil && t.wanted < t.meta.NumPieces()
+}
+
+// Stats is a snapshot of a torrent's transfer activity
+type Stats struct {
+	Downloaded   int64   // Bytes of piece data received
+	Uploaded     int64   // Bytes of piece data sent
+	DownloadRate float64 // Recent download speed in bytes per second
+	UploadRate   float64 // Recent upload speed in bytes per second
+	Peers        int     // Connected peers
+	Seeds        int     // Connected peers that have the whole torrent
+	Leeches      int     // Connected peers still downloading
+	PiecesDone   int     // Pieces verified and written
+	Pieces       int     // Pieces to download, 0 until metadata arrives
+	Length       int64   // Total size in bytes, 0 until metadata arrives
+	Wanted       int64   // Size of the pieces to download; Length unless files are skipped
+	Verified     int64   // Hash checks passed
+	HashFailures int64   // Hash checks failed
+	Wasted       int64   // Bytes of piece data discarded after failing the hash check
+	Copies       float64 // Distributed copies of the torrent among connected peers; see Availability
+	Unavailable  int     // Wanted pieces we lack that no connected peer has
+}
+
+// Stats returns the torrent's current transfer activity
+func (t *Torrent) Stats() Stats {
+	done, total := t.Progress()
+	t.mu.Lock()
+	downRate, upRate := t.downRate, t.upRate
+	var length int64
+	if t.meta != nil {
+		length = t.meta.TotalLength()
+	}
+	wanted := t.wantedLength
+	t.mu.Unlock()
+	avail := t.Availability()
+	return Stats{
+		Downloaded:   t.stats.Downloaded.Load(),
+		Uploaded:     t.stats.Uploaded.Load(),
+		Peers:        int(t.stats.Peers.Load()),
+		Seeds:        int(t.stats.Seeds.Load()),
+		Leeches:      max(int(t.stats.Peers.Load()-t.stats.Seeds.Load()), 0),
+		DownloadRate: downRate,
+		UploadRate:   upRate,
+		PiecesDone:   done,
+		Pieces:       total,
+		Length:       length,
+		Wanted:       wanted,
+		Verified:     t.stats.Verified.Load(),
+		HashFailures: t.stats.HashFailures.Load(),
+		Wasted:       t.stats.Wasted.Load(),
+		Copies:       avail.DistributedCopies,
+		Unavailable:  avail.Unavailable,
+	}
+}
+
+// Availability is how the connected peers cover a torrent's pieces
+type Availability struct {
+	Pieces []int // Connected peers having each piece, nil until metadata arrives
+	// Whole copies of the torrent among the connected peers: the fewest
+	// peers having any piece, plus the fraction of pieces more have. 2.7
+	// means every piece is available twice and 70% of them three times.
+	DistributedCopies float64
+	Unavailable       int // Wanted pieces we lack that no connected peer has
+}
+
+// Completable reports whether the connected peers have every wanted piece
+// we lack, i.e. whether the download can finish without new peers
+func (a Availability) Completable() bool {
+	return a.Unavailable == 0
+}
+
+// Availability returns how many connected peers have each of the torrent's
+// pieces
+func (t *Torrent) Availability() Availability {
+	t.mu.Lock()
+	tf, written, priorities := t.meta, slices.Clone(t.written), t.priorities
+	t.mu.Unlock()
+	if tf == nil {
+		return Availability{}
+	}
+
+	pieces := make([]int, tf.NumPieces())
+	copy(pieces, t.stats.Availability())
+	a := Availability{Pieces: pieces, DistributedCopies: download.DistributedCopies(pieces)}
+	for i, n := range pieces {
+		skipped := priorities != nil && priorities[i] == download.PrioritySkip
+		if n == 0 && !skipped && (i >= len(written) || !written[i]) {
+			a.Unavailable++
+		}
+	}
+	return a
+}
+
+// Percent returns how much of the torrent has been downloaded
+func (s Stats) Percent() float64 {
+	if s.Pieces == 0 {
+		return 0
+	}
+	return float64(s.PiecesDone) * 100 / float64(s.Pieces)
+}
+
+// Ratio returns the bytes uploaded per byte of torrent size
+func (s Stats) Ratio() float64 {
+	if s.Length == 0 {
+		return 0
+	}
+	return float64(s.Uploaded) / float64(s.Length)
+}
+
+// ETA estimates the time left at the current download rate. It returns
+// false when there is nothing to base an estimate on.
+func (s Stats) ETA() (time.Duration, bool) {
+	if s.Pieces == 0 || s.DownloadRate <= 0 {
+		return 0, false
+	}
+	left := float64(s.Wanted) * (1 - float64(s.PiecesDone)/float64(s.Pieces))
+	return time.Duration(left / s.DownloadRate * float64(time.Second)).Round(time.Second), true
+}
+
+// sampleRates updates the torrent's and its peers' transfer rates with the
+// bytes moved over elapsed
+func (t *Torrent) sampleRates(elapsed time.Duration) {
+	t.stats.SampleRates(elapsed, rateSmoothing)
+	down, up := t.stats.Downloaded.Load(), t.stats.Uploaded.Load()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if down > t.lastDown {
+		t.progressAt = t.session.clock.Now()
+	}
+	seconds := elapsed.Seconds()
+	t.downRate += rateSmoothing * (float64(down-t.lastDown)/seconds - t.downRate)
+	t.upRate += rateSmoothing * (float64(up-t.lastUp)/seconds - t.upRate)
+	t.lastDown, t.lastUp = down, up
+}
+
+// TrackerStatus is the outcome of the last announce to a tracker
+type TrackerStatus struct {
+	URL          string
+	LastAnnounce time.Time // Zero if the tracker hasn't been announced to yet
+	Peers        int       // Peers returned by the last announce
+	Err          error     // Error of the last announce, if it failed
+}
+
+// Trackers returns the torrent's trackers and how their last announces went
+func (t *Torrent) Trackers() []TrackerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	statuses := make([]TrackerStatus, 0, len(t.trackers))
+	for _, url := range t.trackers {
+		status, ok := t.trackerStatus[url]
+		if !ok {
+			status = TrackerStatus{URL: url}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// setTrackerStatus records the result of an announce
+func (t *Torrent) setTrackerStatus(status TrackerStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.trackerStatus == nil {
+		t.trackerStatus = make(map[string]TrackerStatus)
+	}
+	t.trackerStatus[status.URL] = status
+}
+
+// Peers returns the peers the torrent is connected to
+func (t *Torrent) Peers() []download.PeerInfo {
+	return t.stats.PeerList()
+}
+
+// Suspects returns the peers that sent pieces failing the hash check, the
+// most failures first, over every run of the torrent
+func (t *Torrent) Suspects() []download.Suspect {
+	return t.stats.Suspects()
+}
+
+// QueuedPieces returns the number of pieces waiting for a peer to download
+// them, or 0 when the torrent isn't downloading
+func (t *Torrent) QueuedPieces() int {
+	return t.stats.Queued()
+}
+
+// RateLimits returns the torrent's own download and upload limits in bytes
+// per second, 0 meaning unlimited. The session's limits apply on top.
+func (t *Torrent) RateLimits() (download, upload int64) {
+	return t.downLimit.Limit(), t.upLimit.Limit()
+}
+
+// SetRateLimits changes the torrent's own download and upload limits in
+// bytes per second, 0 meaning only the session's limits apply. Running
+// transfers pick up the new limits immediately.
+func (t *Torrent) SetRateLimits(download, upload int64) error {
+	if download < 0 || upload < 0 {
+		return errors.New("rate limits can't be negative")
+	}
+	t.downLimit.SetLimit(download)
+	t.upLimit.SetLimit(upload)
+	t.log.Info("rate limits changed", "download", download, "upload", upload)
+	return nil
+}
+
+// Pause stops the download, or seeding, and disconnects from all peers, or
+// takes the torrent out of the queue. Cached pieces are written and the
+// resume data saved, so Resume carries on where the torrent left off
+// without checking the files again. Trackers are told we're leaving, or,
+// with Config.AnnounceWhilePaused, kept posted while asking for no peers.
+func (t *Torrent) Pause() error {
+	s := t.session
+	s.mu.Lock()
+	t.mu.Lock()
+	state := t.state
+	if state != StateFetchingMetadata && state != StateDownloading && state != StateSeeding && state != StateQueued {
+		t.mu.Unlock()
+		s.mu.Unlock()
+		return fmt.Errorf("can't pause a torrent that is %v", state)
+	}
+	t.state = StatePaused
+	cancel, stopped := t.cancel, t.stopped
+	t.mu.Unlock()
+	s.mu.Unlock()
+
+	cancel()
+	<-stopped
+	t.log.Info("torrent paused")
+	if state == StateQueued {
+		return nil // queued torrents aren't announced
+	}
+
+	s.mu.Lock()
+	if t.resumable() != nil {
+		s.mu.Unlock()
+		return nil // resumed, removed or closed meanwhile, so no longer ours to announce
+	}
+	if s.cfg.AnnounceWhilePaused {
+		t.keepAnnouncing()
+		s.mu.Unlock()
+		return nil
+	}
+	// Resume and Remove wait for the stopped announce like for a run, so it
+	// can't reach the trackers after the next started one
+	done := make(chan struct{})
+	t.mu.Lock()
+	t.cancel, t.stopped = func() {}, done
+	t.mu.Unlock()
+	s.mu.Unlock()
+
+	defer close(done)
+	ctx, stop := context.WithTimeout(s.ctx, announceTimeout)
+	defer stop()
+	t.announceStopped(ctx)
+	return nil
+}
+
+// keepAnnouncing sends the trackers' regular announces while the torrent is
+// paused, until it is resumed or removed, so it stays listed in the swarm.
+// announceRequest asks for no peers meanwhile.
+func (t *Torrent) keepAnnouncing() {
+	s := t.session
+	ctx, cancel := context.WithCancel(s.ctx)
+	stopped := make(chan struct{})
+	t.mu.Lock()
+	t.cancel, t.stopped = cancel, stopped
+	t.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(stopped)
+		var wg sync.WaitGroup
+		for _, a := range t.announcers {
+			wg.Add(1)
+			go func(a *tracker.Announcer) {
+				defer wg.Done()
+				a.Run(ctx)
+			}(a)
+		}
+		wg.Wait()
+	}()
+}
+
+// Resume restarts a paused torrent, or queues it if no slot is free for it
+func (t *Torrent) Resume() error {
+	s := t.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if err := t.resumable(); err != nil {
+			return err // also once removed, closed or resumed while we waited
+		}
+		t.mu.Lock()
+		cancel, stopped := t.cancel, t.stopped
+		t.mu.Unlock()
+		select {
+		case <-stopped:
+			t.log.Info("torrent resumed")
+			s.admit(t)
+			return nil
+		default:
+		}
+
+		// Stop the announces kept going while paused, or wait for Pause to
+		// finish. Announces take s.mu for the announce port, so wait without
+		// holding it, then look again: Pause may have started announcing.
+		s.mu.Unlock()
+		cancel()
+		<-stopped
+		s.mu.Lock()
+	}
+}
+
+// resumable reports why t can't be resumed, if it can't. The caller must hold
+// s.mu.
+func (t *Torrent) resumable() error {
+	s := t.session
+	if s.ctx.Err() != nil {
+		return errors.New("session is closed")
+	}
+	if s.torrents[t.infoHash] != t {
+		return errRemoved
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state != StatePaused {
+		return fmt.Errorf("can't resume a torrent that is %v", t.state)
+	}
+	return nil
+}
+
+// PeerCounts returns the number of known peers by their preferred source
+func (t *Torrent) PeerCounts() map[PeerSource]int {
+	return t.pool.Counts()
+}
+
+// Done is closed when the torrent completes or fails. With seeding enabled
+// it completes once seeding stops.
+func (t *Torrent) Done() <-chan struct{} {
+	return t.done
+}
+
+// Err returns the error that stopped the torrent, if any
+func (t *Torrent) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// setMetadata records the torrent metadata and moves on to downloading
+func (t *Torrent) setMetadata(tf *torrent.TorrentFile) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.meta = tf
+	t.name = tf.Info.Name
+	t.have = make([]bool, tf.NumPieces())
+	t.written = make([]bool, tf.NumPieces())
+	t.wanted, t.wantedLength = tf.NumPieces(), tf.TotalLength()
+	if t.state != StatePaused {
+		t.state = StateDownloading
+	}
+
+	// Private torrents must not leak into the DHT or PEX
+	if tf.IsPrivate() {
+		t.pool.SetPrivate()
+	}
+}
+
+// isPrivate reports whether the torrent's metadata marks it private
+func (t *Torrent) isPrivate() bool {
+	meta := t.Metadata()
+	return meta != nil && meta.IsPrivate()
+}
+
+// addIncoming queues a connection from a peer that dialed us for the
+// download engine, dropping it if the queue is full
+func (t *Torrent) addIncoming(conn net.Conn, peerID [20]byte, extensions, fast bool) {
+	select {
+	case t.incoming <- download.IncomingConn{Conn: conn, PeerID: peerID, Extensions: extensions, Fast: fast}:
+	default:
+		conn.Close()
+	}
+}
+
+// finish records the final state and wakes up waiters. Only the first call
+// has any effect.
+func (t *Torrent) finish(err error) {
+	t.mu.Lock()
+	select {
+	case <-t.done:
+		t.mu.Unlock()
+		return
+	default:
+	}
+	if err != nil {
+		t.state = StateFailed
+		t.err = err
+	} else {
+		t.state = StateComplete
+	}
+	close(t.done)
+	t.mu.Unlock()
+
+	switch {
+	case err == nil:
+		t.log.Info("torrent complete")
+	case t.session.ctx.Err() != nil:
+		t.log.Info("torrent stopped")
+	case err != errRemoved:
+		t.log.Error("torrent failed", "error", err)
+		t.publish(events.Event{Type: events.TorrentFailed, Err: err})
+	}
+
+	// Drop connections the engine didn't pick up
+	for drained := false; !drained; {
+		select {
+		case in := <-t.incoming:
+			in.Conn.Close()
+		default:
+			drained = true
+		}
+	}
+}
+
+// run fetches metadata if needed and downloads the torrent. A run stopped by
+// Pause or Remove rather than by the session closing leaves the torrent
+// unfinished.
+func (t *Torrent) run(ctx context.Context) {
+	stoppedEarly := func() bool {
+		return ctx.Err() != nil && t.session.ctx.Err() == nil
+	}
+
+	if t.Metadata() == nil {
+		tf, err := t.resolveMetadata(ctx)
+		if err != nil {
+			if !stoppedEarly() {
+				t.finish(t.explainNoPeers(err))
+			}
+			return
+		}
+		t.setMetadata(tf)
+		t.remember()
+		t.log.Info("metadata fetched", "name", tf.Info.Name, "pieces", tf.NumPieces())
+		t.publish(events.Event{Type: events.MetadataReceived})
+	}
+
+	err := t.download(ctx)
+	if errors.Is(err, errSeedPaused) {
+		t.log.Info("torrent paused at its seeding limit")
+		return
+	}
+	if errors.Is(err, errSeedQueued) {
+		t.log.Info("torrent complete, queued for seeding")
+		return
+	}
+	if stoppedEarly() && t.State() == StatePaused {
+		return // seeding ends without an error when paused
+	}
+	if err == nil || !stoppedEarly() {
+		t.finish(t.explainNoPeers(err))
+	}
+	// Seeding torrents ran the hook when they started seeding
+	if err == nil && !t.session.cfg.Seed {
+		t.runHook()
+	}
+}
+
+// explainNoPeers marks a no-peers error with ErrTrackers when every tracker
+// failed, since the trackers are then the likely cause
+func (t *Torrent) explainNoPeers(err error) error {
+	if !errors.Is(err, download.ErrNoPeers) {
+		return err
+	}
+	statuses := t.Trackers()
+	if len(statuses) == 0 {
+		return err
+	}
+	for _, status := range statuses {
+		if status.Err == nil {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %w", ErrTrackers, err)
+}
+
+// resolveMetadata discovers peers and fetches the info dictionary from them,
+// retrying until it succeeds, ctx is cancelled or Config.PeerTimeout passes
+func (t *Torrent) resolveMetadata(ctx context.Context) (*torrent.TorrentFile, error) {
+	timeout := t.session.cfg.PeerTimeout
+	clk := t.session.clock
+	start := clk.Now()
+	for {
+		t.discoverPeers(ctx)
+		info, err := t.fetchMetadata(ctx, t.pool.Best(t.connLimit()))
+		if err == nil {
+			tf := &torrent.TorrentFile{Info: *info}
+			if len(t.trackers) > 0 {
+				tf.Announce = t.trackers[0]
+				tf.AnnounceList = [][]string{t.trackers}
+			}
+			return tf, nil
+		}
+		wait := metadataRetryWait
+		if timeout > 0 {
+			left := timeout - clk.Since(start)
+			if left <= 0 {
+				return nil, fmt.Errorf("%w: no peer sent the metadata within %v: %v", download.ErrNoPeers, timeout, err)
+			}
+			wait = min(wait, left)
+		}
+		t.log.Debug("metadata not fetched, retrying", "error", err, "retry_in", wait)
+
+		select {
+		case <-clk.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// fetchMetadata asks several peers at once for the metadata and returns the
+// first copy that matches the info hash
+func (t *Torrent) fetchMetadata(ctx context.Context, peers []tracker.Peer) (*torrent.TorrentInfo, error) {
+	if len(peers) == 0 {
+		return nil, errors.New("no peers found")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		info *torrent.TorrentInfo
+		err  error
+	}
+	results := make(chan result, len(peers))
+	sem := make(chan struct{}, metadataPeers)
+
+	for _, p := range peers {
+		go func(p tracker.Peer) {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results <- result{err: ctx.Err()}
+				return
+			}
+
+			data, err := metadata.FetchWith(ctx, t.session.dialPeer, p.String(), t.infoHash, t.session.peerID)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			info, err := torrent.ParseInfo(data)
+			results <- result{info: info, err: err}
+		}(p)
+	}
+
+	var lastErr error
+	for range peers {
+		r := <-results
+		if r.err == nil {
+			return r.info, nil
+		}
+		lastErr = r.err
+	}
+	return nil, fmt.Errorf("failed to fetch metadata: %v", lastErr)
+}
+
+// download discovers peers for the full download and runs the engine. With
+// Config.Seed set it keeps uploading after the download completes, until a
+// seeding limit is reached or ctx is cancelled.
+func (t *Torrent) download(ctx context.Context) error {
+	tf := t.Metadata()
+	cfg := t.session.cfg
+
+	// Without discovered peers we still wait for peers to connect to us
+	t.discoverPeers(ctx)
+	peers := t.pool.Take(t.connLimit())
+
+	if err := t.selectFiles(tf); err != nil {
+		return err
+	}
+	t.loadResume(tf)
+	t.mu.Lock()
+	opts := download.CreateOptions{Allocate: cfg.Allocate, Priorities: t.files}
+	t.mu.Unlock()
+	files, err := download.CreateFilesWith(tf, t.session.layout(), opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := files.Close(); err != nil {
+			t.log.Error("failed to flush files", "error", err)
+		}
+		t.saveResume()
+	}()
+
+	task := &download.Task{
+		Torrent:       tf,
+		InfoHash:      t.infoHash,
+		PeerID:        t.session.peerID,
+		Peers:         peers,
+		Output:        files,
+		Incoming:      t.incoming,
+		Dial:          t.session.dialPeer,
+		Stats:         &t.stats,
+		DownloadLimit: t.downLimit,
+		UploadLimit:   t.upLimit,
+		ThrottleLimit: t.session.throttled,
+		MaxConns:      t.connLimit,
+		BanAfter:      cfg.BanAfter,
+		WriteCache:    cfg.WriteCache,
+		PeerBanned:    t.session.banPeer,
+		PeerTimeout:   t.session.cfg.PeerTimeout,
+		Clock:         t.session.clock,
+		Logger:        t.session.logger.With("component", "download", logging.InfoHash(t.infoHash)),
+		Have:          t.have,
+		Written: func(index int) {
+			t.markWritten(index)
+			t.publish(events.Event{Type: events.PieceVerified, Piece: index})
+		},
+		PeerConnected: func(addr string) {
+			t.pool.Connected(addr)
+			if hook := cfg.Hooks.OnPeerConnect; hook != nil {
+				hook(t.infoHash, addr)
+			}
+			t.publish(events.Event{Type: events.PeerConnected, Peer: addr})
+		},
+		PeerDisconnected: func(addr string) {
+			t.pool.Release(addr, false)
+			t.publish(events.Event{Type: events.PeerDisconnected, Peer: addr})
+		},
+		PeerFailed: func(addr string) {
+			t.pool.Release(addr, true)
+		},
+		ExternalIP: func(peer, ip net.IP) {
+			t.session.reportExternalIP("peer "+peer.String(), ip)
+		},
+		Priorities:    t.priorities,
+		WebSeeds:      tf.URLList,
+		WebSeedClient: t.session.http,
+		Progress: func(done, total int) {
+			t.mu.Lock()
+			t.piecesDone = done
+			t.mu.Unlock()
+		},
+	}
+	if hook := cfg.Hooks.OnBlockReceived; hook != nil {
+		task.BlockReceived = func(addr string, index, begin, length int) {
+			hook(t.infoHash, addr, index, begin, length)
+		}
+	}
+	task.PieceChecked = func(index int, ok bool) {
+		if !ok {
+			t.publish(events.Event{Type: events.PieceFailed, Piece: index})
+		}
+		if hook := cfg.Hooks.OnPieceVerified; hook != nil {
+			hook(t.infoHash, index, ok)
+		}
+	}
+	if !cfg.ClientPolicy.Empty() {
+		task.ClientPolicy = cfg.ClientPolicy.Decide
+	}
+	peersCtx, stopPeers := context.WithCancel(ctx)
+	defer stopPeers()
+	fill := t.managePeers(peersCtx, task)
+	if !tf.IsPrivate() {
+		t.exchangePeers(task, fill)
+	}
+	if node, _ := t.session.dhtNode(); node != nil && !tf.IsPrivate() {
+		task.DHTPort = uint16(node.Port())
+		task.DHTNode = func(addr string) {
+			go func() {
+				ctx, cancel := context.WithTimeout(ctx, dhtPingTimeout)
+				defer cancel()
+				if err := node.AddNode(ctx, addr); err != nil {
+					t.log.Debug("DHT node from PORT message unreachable", "node", addr, "error", err)
+				}
+			}()
+		}
+	}
+
+	// Trackers hear when the whole torrent has been downloaded, unless it
+	// already was
+	incomplete := t.left() > 0
+	task.Complete = func() {
+		if !incomplete || t.left() > 0 {
+			return
+		}
+		t.session.wg.Add(1)
+		go func() {
+			defer t.session.wg.Done()
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), announceTimeout)
+			defer cancel()
+			t.announceEvent(ctx, tracker.EventCompleted)
+		}()
+	}
+
+	// Seed until a limit is reached, or right away with every seeding slot
+	// taken, then leave the trackers like on shutdown
+	stopSeeding := make(chan struct{})
+	pauseAtLimit, queued := false, false // set before stopSeeding is closed
+	if cfg.Seed {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		task.Seed = true
+		completed := task.Complete
+		task.Complete = func() {
+			completed()
+			seeding, requeued := t.startSeeding()
+			if !requeued {
+				t.runHook()
+			}
+			if !seeding {
+				queued = true
+				close(stopSeeding)
+				cancel()
+				return
+			}
+			if t.PartialSeed() {
+				// Trackers count us as a partial seed rather than a
+				// leecher that stopped making progress (BEP 21)
+				t.log.Info("selected files complete, seeding them")
+				t.session.wg.Add(1)
+				go func() {
+					defer t.session.wg.Done()
+					t.announceEvent(ctx, tracker.EventPaused)
+				}()
+			} else {
+				t.log.Info("torrent complete, seeding")
+			}
+			go t.seedUntilLimit(ctx, func(pause bool) {
+				pauseAtLimit = pause
+				close(stopSeeding)
+				cancel()
+			})
+		}
+	}
+
+	// Announce again whenever the trackers ask, until the download stops
+	announceCtx, stopAnnouncing := context.WithCancel(ctx)
+	defer stopAnnouncing()
+	for _, a := range t.announcers {
+		t.session.wg.Add(1)
+		go func(a *tracker.Announcer) {
+			defer t.session.wg.Done()
+			a.Run(announceCtx)
+		}(a)
+	}
+
+	if err := task.Run(ctx); err != nil {
+		return err
+	}
+
+	select {
+	case <-stopSeeding:
+		stopCtx, cancel := context.WithTimeout(context.Background(), announceTimeout)
+		defer cancel()
+		t.announceStopped(stopCtx)
+		if queued {
+			return errSeedQueued
+		}
+		if pauseAtLimit {
+			t.mu.Lock()
+			t.state = StatePaused
+			t.mu.Unlock()
+			return errSeedPaused
+		}
+	default:
+	}
+	return nil
+}
+
+// runHook publishes TorrentCompleted and calls Config.OnComplete in the
+// background, once the download is complete
+func (t *Torrent) runHook() {
+	t.publish(events.Event{Type: events.TorrentCompleted})
+	hook := t.session.cfg.OnComplete
+	if hook == nil {
+		return
+	}
+	t.session.hookWG.Add(1)
+	go func() {
+		defer t.session.hookWG.Done()
+		hook(t)
+	}()
+}
+
+// loadResume marks the pieces recorded as verified in the resume data, e.g.
+// by the verify command, before the first run. Resume data is looked for in
+// the state directory, then in the download directory where older versions
+// kept it.
+func (t *Torrent) loadResume(tf *torrent.TorrentFile) {
+	cfg := t.session.cfg
+	root := t.session.layout().Root(tf)
+	path := download.ResumePath(cfg.DownloadDir, t.infoHash)
+	if cfg.StateDir != "" {
+		if _, err := os.Stat(cfg.StateDir.Resume(t.infoHash)); err == nil {
+			path = cfg.StateDir.Resume(t.infoHash)
+		}
+	}
+	have, err := download.LoadResume(path, t.infoHash, root, tf.NumPieces())
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		t.log.Warn("ignoring resume data", "path", path, "error", err)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.piecesDone > 0 {
+		return // resumed from a pause; our own record is newer
+	}
+	loaded, done := 0, 0
+	for i, ok := range have {
+		if !ok {
+			continue
+		}
+		t.have[i] = true
+		t.written[i] = true
+		loaded++
+		if t.priorities == nil || t.priorities[i] != download.PrioritySkip {
+			done++
+		}
+	}
+	t.piecesDone = done
+	t.wakeReaders()
+	t.log.Info("resume data loaded", "pieces", loaded)
+}
+
+// publish sends e, stamped with the torrent's info hash, to the session's
+// subscribers
+func (t *Torrent) publish(e events.Event) {
+	e.InfoHash = t.infoHash
+	t.session.events.Publish(e)
+}
+
+// saveResume writes resume data recording the pieces on disk, if pieces
+// were written since it was last saved, so a restart doesn't download or
+// hash them again. It goes to the state directory if there is one, or else
+// next to the download.
+func (t *Torrent) saveResume() {
+	t.mu.Lock()
+	if !t.resumeDirty || t.meta == nil {
+		t.mu.Unlock()
+		return
+	}
+	tf, written := t.meta, slices.Clone(t.written)
+	t.resumeDirty = false
+	t.mu.Unlock()
+
+	cfg := t.session.cfg
+	path := download.ResumePath(cfg.DownloadDir, t.infoHash)
+	if cfg.StateDir != "" {
+		path = cfg.StateDir.Resume(t.infoHash)
+	}
+	root := t.session.layout().Root(tf)
+	if err := download.SaveResume(path, t.infoHash, root, written, download.FileProgress(tf, written)); err != nil {
+		t.log.Warn("failed to save resume data", "path", path, "error", err)
+	}
+}
+
+// markWritten records that a piece is on disk and wakes readers waiting for
+// it. In sequential mode the next missing pieces move to the front of the
+// queue, so a failed piece put back at its end doesn't stall playback.
+func (t *Torrent) markWritten(index int) {
+	t.mu.Lock()
+	t.written[index] = true
+	t.resumeDirty = true
+	t.wakeReaders()
+	t.mu.Unlock()
+	if t.session.cfg.Sequential {
+		t.readahead(0)
+	}
+}
+
+// readahead asks the download to fetch the first wanted pieces from index on
+// that aren't written yet, up to readaheadPieces of them, before the rest
+func (t *Torrent) readahead(index int) {
+	t.mu.Lock()
+	var pieces []int
+	for i := index; i < len(t.written) && len(pieces) < readaheadPieces; i++ {
+		if !t.written[i] && (i >= len(t.priorities) || t.priorities[i] != download.PrioritySkip) {
+			pieces = append(pieces, i)
+		}
+	}
+	t.mu.Unlock()
+	t.stats.Prioritize(pieces)
+}
+
+// wakeReaders wakes every reader waiting for a piece. The caller must hold
+// t.mu.
+func (t *Torrent) wakeReaders() {
+	close(t.wake)
+	t.wake = make(chan struct{})
+}
+
+// selectFiles asks Config.SelectFiles which files to download and records
+// the resulting piece priorities, with the edges of every wanted file first
+// in sequential mode. It runs again on every resume, with the same outcome
+// for the same callback.
+func (t *Torrent) selectFiles(tf *torrent.TorrentFile) error {
+	selectFiles, sequential := t.session.cfg.SelectFiles, t.session.cfg.Sequential
+	if selectFiles == nil && t.selectOnly != nil {
+		selectFiles = t.selectOnlyFiles
+	}
+	t.mu.Lock()
+	if override := t.fileOverride; override != nil {
+		selectFiles = func(*torrent.TorrentFile) ([]download.Priority, error) {
+			return override, nil
+		}
+	}
+	t.mu.Unlock()
+	if selectFiles == nil && !sequential {
+		return nil
+	}
+	var files, pieces []download.Priority
+	if selectFiles != nil {
+		var err error
+		if files, err = selectFiles(tf); err != nil {
+			return fmt.Errorf("failed to select files: %v", err)
+		}
+		if pieces, err = download.PiecePriorities(tf, files); err != nil {
+			return err
+		}
+	} else {
+		pieces = make([]download.Priority, tf.NumPieces())
+	}
+	if sequential {
+		download.PrioritizeFileEdges(tf, files, pieces)
+	}
+
+	wanted, length := 0, int64(0)
+	for i, p := range pieces {
+		if p != download.PrioritySkip {
+			wanted++
+			length += tf.PieceLength(i)
+		}
+	}
+	skipped := 0
+	for _, p := range files {
+		if p == download.PrioritySkip {
+			skipped++
+		}
+	}
+
+	t.mu.Lock()
+	t.priorities, t.wanted, t.wantedLength = pieces, wanted, length
+	t.files = files
+	// Pieces kept from an earlier run may have been skipped then
+	t.piecesDone = 0
+	for i, ok := range t.written {
+		if ok && pieces[i] != download.PrioritySkip {
+			t.piecesDone++
+		}
+	}
+	t.mu.Unlock()
+	if skipped > 0 {
+		t.log.Info("files selected", "files", len(files)-skipped, "skipped", skipped, "pieces", wanted)
+	}
+	return nil
+}
+
+// selectOnlyFiles picks the files a magnet link's select-only list names
+// (BEP 53). Indices beyond the torrent's files are ignored, and every file is
+// downloaded if that leaves none.
+func (t *Torrent) selectOnlyFiles(tf *torrent.TorrentFile) ([]download.Priority, error) {
+	files := make([]download.Priority, max(len(tf.Info.Files), 1))
+	for i := range files {
+		files[i] = download.PrioritySkip
+	}
+	selected := 0
+	for _, i := range t.selectOnly {
+		if i < len(files) {
+			files[i] = download.PriorityNormal
+			selected++
+		}
+	}
+	if selected == 0 {
+		t.log.Warn("magnet link selects no file of the torrent, downloading all", "files", len(files))
+		for i := range files {
+			files[i] = download.PriorityNormal
+		}
+	}
+	return files, nil
+}
+
+// discoverPeers queries the trackers and the DHT and merges the peers they
+// return, along with any direct addresses, into the torrent's peer pool
+func (t *Torrent) discoverPeers(ctx context.Context) {
+	type sourcePeers struct {
+		source PeerSource
+		peers  []tracker.Peer
+	}
+	found := make(chan sourcePeers, len(t.announcers)+1)
+	pending := 0
+
+	// Trackers' peers join the pool as they answer
+	for _, a := range t.announcers {
+		pending++
+		go func(a *tracker.Announcer) {
+			a.Announce(ctx, "")
+			found <- sourcePeers{SourceTracker, nil}
+		}(a)
+	}
+
+	// Private torrents never announce to or search the DHT
+	if node, ready := t.session.dhtNode(); node != nil && !t.isPrivate() {
+		pending++
+		go func() {
+			select {
+			case <-ready:
+			case <-ctx.Done():
+				found <- sourcePeers{SourceDHT, nil}
+				return
+			}
+			// Peers can't reach us without a listener, so only look
+			var peers []tracker.Peer
+			if t.session.cfg.NoListen {
+				peers, _ = node.GetPeers(ctx, t.infoHash)
+			} else {
+				peers, _ = node.Announce(ctx, t.infoHash, int(t.session.AnnouncePort()))
+			}
+			found <- sourcePeers{SourceDHT, peers}
+		}()
+	}
+
+	var direct []tracker.Peer
+	for _, addr := range t.direct {
+		if p, err := parsePeerAddr(addr); err == nil {
+			direct = append(direct, p)
+		}
+	}
+	t.pool.Add(SourceDirect, t.session.filterPeers(direct))
+
+	timeout := time.After(announceTimeout)
+	for ; pending > 0; pending-- {
+		select {
+		case r := <-found:
+			t.pool.Add(r.source, r.peers)
+		case <-timeout:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// managePeers keeps a download's connections topped up until ctx is done:
+// every peerRefill, while there is room for more connections, the best
+// peers in the pool that aren't connected or waiting to be redialed are
+// handed to the download to dial. It returns the function that does so, to
+// fill the room at once when new peers arrive.
+func (t *Torrent) managePeers(ctx context.Context, task *download.Task) func() {
+	morePeers := make(chan tracker.Peer, defaultMaxPeers)
+	task.MorePeers = morePeers
+	fill := func() {
+		room := min(t.connLimit()-int(t.stats.Peers.Load()), cap(morePeers)) - len(morePeers)
+		if room <= 0 {
+			return
+		}
+		for _, p := range t.pool.Take(room) {
+			select {
+			case morePeers <- p:
+			default:
+				t.pool.Release(p.String(), false)
+			}
+		}
+	}
+
+	go func() {
+		ticker := t.session.clock.NewTicker(peerRefill)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				fill()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return fill
+}
+
+// exchangePeers turns on peer exchange (BEP 11) for a download, with
+// holepunching (BEP 55) unless Config.NoHolepunch is set. Peers that
+// connected peers tell us about join the pool, and fill hands the best of
+// them to the download while there is room for more connections.
+func (t *Torrent) exchangePeers(task *download.Task, fill func()) {
+	task.Holepunch = !t.session.cfg.NoHolepunch
+	task.PeersFound = func(peers []tracker.Peer) {
+		if t.pool.Add(SourcePEX, t.session.filterPeers(peers)) > 0 {
+			fill()
+		}
+	}
+}
+
+// announceStopped tells every tracker that accepted our last announce that
+// we're leaving, so it stops handing out our address. It returns when all
+// trackers have answered or ctx is done.
+func (t *Torrent) announceStopped(ctx context.Context) {
+	t.announceEvent(ctx, tracker.EventStopped)
+}
+
+// announceEvent sends event to every tracker that accepted our started
+// announce. It returns when all trackers have answered or ctx is done.
+func (t *Torrent) announceEvent(ctx context.Context, event string) {
+	var wg sync.WaitGroup
+	for _, a := range t.announcers {
+		if !a.Started() {
+			continue
+		}
+		wg.Add(1)
+		go func(a *tracker.Announcer) {
+			defer wg.Done()
+			if event == tracker.EventStopped {
+				a.Stop(ctx)
+			} else {
+				a.Announce(ctx, event)
+			}
+		}(a)
+	}
+	wg.Wait()
+}
+
+// announceRequest returns an announce with our current totals, for the
+// trackers' Announcers to send
+func (t *Torrent) announceRequest() *tracker.AnnounceRequest {
+	stats := t.Stats()
+	req := &tracker.AnnounceRequest{
+		InfoHash:   t.infoHash,
+		PeerID:     t.session.peerID,
+		Key:        t.session.key,
+		NumWant:    t.session.cfg.NumWant,
+		NoPeers:    t.State() == StatePaused,
+		Port:       t.session.AnnouncePort(),
+		Uploaded:   stats.Uploaded,
+		Downloaded: stats.Downloaded,
+		Left:       t.left(),
+		IP:         t.session.externalIPs.trusted(false),
+	}
+	if t.session.listensIPv6() {
+		if req.IPv6 = globalIPv6(); req.IPv6 == nil {
+			req.IPv6 = t.session.externalIPs.trusted(true)
+		}
+	}
+	return req
+}
+
+// trackerAnswered returns what to do with the answers of the tracker at
+// url. Announces looking for peers, started and regular ones, are recorded
+// and their peers join the pool; events only matter if they fail.
+func (t *Torrent) trackerAnswered(url string) func(string, *tracker.AnnounceResult, error, time.Duration) {
+	return func(event string, result *tracker.AnnounceResult, err error, took time.Duration) {
+		if event != "" && event != tracker.EventStarted {
+			if err != nil {
+				t.log.Debug(event+" announce failed", "tracker", url, "error", err)
+			}
+			return
+		}
+
+		var peers []tracker.Peer
+		if err == nil {
+			peers = result.Peers
+			if result.ExternalIP != nil {
+				t.session.reportExternalIP("tracker "+url, result.ExternalIP)
+			}
+		}
+		t.setTrackerStatus(TrackerStatus{URL: url, LastAnnounce: t.session.clock.Now(), Peers: len(peers), Err: err})
+		if hook := t.session.cfg.Hooks.OnAnnounce; hook != nil {
+			hook(t.infoHash, url, len(peers), took, err)
+		}
+		switch {
+		case err != nil && errors.Is(err, context.Canceled):
+			// Stopped while waiting; nothing to report
+		case err != nil:
+			t.log.Warn("announce failed", "tracker", url, "error", err)
+			t.publish(events.Event{Type: events.AnnounceFailed, Tracker: url, Err: err})
+		default:
+			t.log.Debug("announced", "tracker", url, "peers", len(peers))
+			t.publish(events.Event{Type: events.AnnounceOK, Tracker: url, Peers: len(peers)})
+		}
+		t.pool.Add(SourceTracker, t.session.filterPeers(peers))
+	}
+}
+
+// announce sends req to a tracker, tracing the announce and the answer at
+// the wire level
+func (t *Torrent) announce(ctx context.Context, announce string, req *tracker.AnnounceRequest) (*tracker.AnnounceResult, error) {
+	tracing := t.log.Enabled(ctx, logging.LevelWire)
+	if tracing {
+		t.log.Log(ctx, logging.LevelWire, "tracker announce", "dir", logging.Sent, "tracker", logging.RedactURL(announce),
+			"event", req.Event, "left", req.Left, "uploaded", req.Uploaded, "downloaded", req.Downloaded)
+	}
+	var result *tracker.AnnounceResult
+	var err error
+	if strings.HasPrefix(announce, "udp://") {
+		result, err = t.announceUDP(ctx, announce, req)
+	} else {
+		result, err = tracker.AnnounceResultContext(ctx, t.session.http, announce, req)
+	}
+	if tracing {
+		attrs := []interface{}{"dir", logging.Received, "tracker", logging.RedactURL(announce)}
+		if err != nil {
+			attrs = append(attrs, "error", strings.ReplaceAll(err.Error(), announce, logging.RedactURL(announce)))
+		} else {
+			attrs = append(attrs, "peers", len(result.Peers))
+		}
+		t.log.Log(ctx, logging.LevelWire, "tracker response", attrs...)
+	}
+	return result, err
+}
+
+// announceUDP announces to a UDP tracker from the bind address, if any. The
+// SOCKS proxy only relays UDP by association, so in strict proxy mode UDP
+// trackers are refused rather than reached directly.
+func (t *Torrent) announceUDP(ctx context.Context, announce string, req *tracker.AnnounceRequest) (*tracker.AnnounceResult, error) {
+	if t.session.proxy != nil && t.session.cfg.ProxyStrict {
+		return nil, errors.New("UDP trackers can't be used in strict proxy mode")
+	}
+	var dial transport.DialFunc
+	if t.session.bind != nil {
+		dial = t.session.bind.DialContext
+	}
+	return tracker.AnnounceUDP(ctx, dial, announce, req)
+}
+
+// left returns the number of bytes still to download, or 0 without metadata
+func (t *Torrent) left() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.meta == nil {
+		return 0
+	}
+	var left int64
+	for i, written := range t.written {
+		if !written {
+			left += t.meta.PieceLength(i)
+		}
+	}
+	return left
+}
+
+// parsePeerAddr parses a host:port peer address
+func parsePeerAddr(addr string) (tracker.Peer, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return tracker.Peer{}, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return tracker.Peer{}, fmt.Errorf("invalid peer IP: %s", host)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return tracker.Peer{}, fmt.Errorf("invalid peer port: %s", portStr)
+	}
+	return tracker.Peer{IP: ip, Port: uint16(port)}, nil
+}
@@ -0,0 +1,109 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/omkarkirpan/bittorrent-client/events"
+	"github.com/omkarkirpan/bittorrent-client/feed"
+)
+
+// watchUpdates checks the update feeds of the session's torrents (BEP 39),
+// and the DHT items of mutable torrents (BEP 46), every Config.UpdateInterval, and retires replaced torrents as their
+// successors complete, until the session is closed
+func (s *Session) watchUpdates() {
+	defer s.wg.Done()
+	completed := s.events.Subscribe(16, events.TorrentCompleted)
+	defer completed.Close()
+	for {
+		select {
+		case <-s.clock.After(s.cfg.UpdateInterval):
+			s.checkUpdates(s.ctx)
+		case e, ok := <-completed.Events():
+			if !ok {
+				return
+			}
+			for _, t := range s.Torrents() {
+				if next := t.Successor(); next != nil && next.infoHash == e.InfoHash {
+					s.retire(t, next)
+				}
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// checkUpdates asks the update feed of every torrent that has one, or the DHT
+// for mutable torrents, whether a newer version was published, and adds it. The old torrent keeps running;
+// with Config.RetireUpdated it is removed once the new one completes.
+func (s *Session) checkUpdates(ctx context.Context) {
+	for _, t := range s.Torrents() {
+		if next := t.Successor(); next != nil {
+			s.retire(t, next)
+			continue
+		}
+		if t.mutable != nil {
+			s.checkMutable(ctx, t)
+			continue
+		}
+		tf := t.Metadata()
+		if tf == nil || tf.Info.UpdateURL == "" {
+			continue
+		}
+
+		latest, err := feed.Latest(ctx, s.http, tf)
+		if err != nil {
+			if ctx.Err() == nil {
+				t.log.Warn("update check failed", "feed", tf.Info.UpdateURL, "error", err)
+			}
+			continue
+		}
+		if latest == nil {
+			continue
+		}
+		next, err := s.AddTorrent(latest)
+		if errors.Is(err, ErrTorrentExists) {
+			infoHash, _ := latest.InfoHash()
+			next = s.Torrent(infoHash)
+		} else if err != nil {
+			t.log.Warn("failed to add the newer version", "name", latest.Info.Name, "error", err)
+			continue
+		}
+		if next != nil {
+			s.adoptSuccessor(t, next)
+		}
+	}
+}
+
+// adoptSuccessor records next as the newer version of t
+func (s *Session) adoptSuccessor(t, next *Torrent) {
+	t.log.Info("newer version found", "successor", fmt.Sprintf("%x", next.infoHash))
+	t.mu.Lock()
+	t.successor = next
+	t.mu.Unlock()
+	s.retire(t, next)
+}
+
+// retire removes a torrent replaced by a newer version once that has every
+// wanted piece, if Config.RetireUpdated asks for it. Files are left on disk.
+func (s *Session) retire(t, next *Torrent) {
+	if !s.cfg.RetireUpdated {
+		return
+	}
+	if state := next.State(); state != StateComplete && state != StateSeeding {
+		return
+	}
+	if err := s.Remove(t.infoHash); err == nil {
+		t.log.Info("retired by newer version", "successor", fmt.Sprintf("%x", next.infoHash))
+	}
+}
+
+// Successor returns the newer version of the torrent its update feed (BEP 39)
+// or publisher (BEP 46) announced and that the session added, or nil
+func (t *Torrent) Successor() *Torrent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.successor
+}
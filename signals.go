@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds stopped announces and in-flight API requests at exit
+const shutdownTimeout = 10 * time.Second
+
+// notifyShutdown returns a context that is cancelled on the first SIGINT or
+// SIGTERM, so the caller can shut down cleanly. A second signal exits the
+// process at once. stop releases the signal handlers.
+func notifyShutdown(log *slog.Logger) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Warn("shutting down, send the signal again to exit at once", "signal", sig.String())
+			cancel()
+		case <-done:
+			return
+		}
+
+		select {
+		case <-sigs:
+			fmt.Fprintln(os.Stderr, "Forced exit")
+			os.Exit(exitInterrupted)
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigs)
+		close(done)
+		cancel()
+	}
+}
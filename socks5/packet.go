@@ -0,0 +1,82 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"time"
+)
+
+// PacketConn sends and receives UDP datagrams through a SOCKS5 relay. Each
+// datagram carries a header naming its real destination or source:
+// <reserved:2><frag><atyp><address><port><data>
+type PacketConn struct {
+	ctrl  net.Conn // the association lives as long as this connection
+	udp   *net.UDPConn
+	relay *net.UDPAddr
+}
+
+// ReadFrom reads the next datagram relayed to us and returns its original
+// sender. Fragmented datagrams are dropped.
+func (c *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := c.udp.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(c.relay.IP) || n < 4 || buf[2] != 0 {
+			continue
+		}
+
+		r := bytes.NewReader(buf[3:n])
+		src, err := readAddr(r)
+		if err != nil || src.IP == nil {
+			continue
+		}
+		return copy(p, buf[n-r.Len():n]), src, nil
+	}
+}
+
+// WriteTo sends a datagram to addr through the relay
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("socks5: not a UDP address")
+	}
+
+	packet, err := appendAddr([]byte{0, 0, 0}, udpAddr.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.udp.WriteToUDP(append(packet, p...), c.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the association
+func (c *PacketConn) Close() error {
+	c.ctrl.Close()
+	return c.udp.Close()
+}
+
+// LocalAddr returns the local address of the UDP socket
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.udp.LocalAddr()
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.udp.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	return c.udp.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return c.udp.SetWriteDeadline(t)
+}
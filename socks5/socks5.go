@@ -0,0 +1,289 @@
+// Package socks5 is a SOCKS5 client (RFC 1928) with username/password
+// authentication (RFC 1929). It proxies TCP connections with CONNECT and UDP
+// datagrams with UDP ASSOCIATE.
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Protocol constants
+const (
+	version = 5
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+	userPassVersion    = 1
+
+	cmdConnect      = 1
+	cmdUDPAssociate = 3
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+
+	handshakeTimeout = 10 * time.Second
+)
+
+// Reply codes from RFC 1928
+var replyErrors = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// ErrProxyUnavailable is returned when the proxy itself can't be reached, as
+// opposed to the proxy failing to reach the destination
+var ErrProxyUnavailable = errors.New("socks5: proxy unavailable")
+
+// Dialer connects through a SOCKS5 proxy
+type Dialer struct {
+	ProxyAddr string // host:port of the proxy
+	Username  string // optional credentials
+	Password  string
+
+	// Forward opens the connection to the proxy itself; nil uses net.Dialer
+	Forward func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DialContext connects to addr through the proxy. Only TCP is supported;
+// use ListenPacket for UDP.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks5: unsupported network %s", network)
+	}
+
+	conn, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.request(ctx, conn, cmdConnect, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ListenPacket asks the proxy to relay UDP datagrams for us. The returned
+// connection sends and receives through the relay, and stops working once
+// closed or when the proxy drops the association.
+func (d *Dialer) ListenPacket(ctx context.Context, laddr *net.UDPAddr) (*PacketConn, error) {
+	ctrl, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	udp, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	// Tell the proxy which address our datagrams come from, if we know it
+	local := udp.LocalAddr().(*net.UDPAddr)
+	from := net.JoinHostPort(local.IP.String(), strconv.Itoa(local.Port))
+	if local.IP.IsUnspecified() {
+		from = net.JoinHostPort("0.0.0.0", "0")
+	}
+	relay, err := d.request(ctx, ctrl, cmdUDPAssociate, from)
+	if err != nil {
+		ctrl.Close()
+		udp.Close()
+		return nil, err
+	}
+
+	// A relay on an unspecified address lives on the proxy host
+	if relay.IP.IsUnspecified() {
+		if tcp, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = tcp.IP
+		}
+	}
+
+	pc := &PacketConn{ctrl: ctrl, udp: udp, relay: relay}
+
+	// The association ends with the control connection, so watch it
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		udp.Close()
+	}()
+	return pc, nil
+}
+
+// connect opens a connection to the proxy and authenticates
+func (d *Dialer) connect(ctx context.Context) (net.Conn, error) {
+	forward := d.Forward
+	if forward == nil {
+		forward = (&net.Dialer{}).DialContext
+	}
+	conn, err := forward(ctx, "tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProxyUnavailable, err)
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := d.authenticate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// authenticate negotiates the authentication method
+// Greeting: <version><nmethods><methods...>, reply: <version><method>
+func (d *Dialer) authenticate(conn net.Conn) error {
+	greeting := []byte{version, 1, methodNoAuth}
+	if d.Username != "" {
+		greeting = []byte{version, 2, methodNoAuth, methodUserPass}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("socks5: %v", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("socks5: %v", err)
+	}
+	if reply[0] != version {
+		return errors.New("socks5: proxy is not a SOCKS5 server")
+	}
+
+	switch reply[1] {
+	case methodNoAuth:
+		return nil
+	case methodUserPass:
+		// <version=1><ulen><username><plen><password>, reply: <version><status>
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return errors.New("socks5: credentials too long")
+		}
+		req := []byte{userPassVersion, byte(len(d.Username))}
+		req = append(req, d.Username...)
+		req = append(req, byte(len(d.Password)))
+		req = append(req, d.Password...)
+		if _, err := conn.Write(req); err != nil {
+			return fmt.Errorf("socks5: %v", err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("socks5: %v", err)
+		}
+		if reply[1] != 0 {
+			return errors.New("socks5: authentication failed")
+		}
+		return nil
+	default:
+		return errors.New("socks5: no acceptable authentication method")
+	}
+}
+
+// request sends a command and returns the bound address from the reply
+// Request: <version><cmd><reserved><address>, reply: <version><rep><reserved><address>
+func (d *Dialer) request(ctx context.Context, conn net.Conn, cmd byte, addr string) (*net.UDPAddr, error) {
+	dst, err := appendAddr(nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	req := append([]byte{version, cmd, 0}, dst...)
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("socks5: %v", err)
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("socks5: %v", err)
+	}
+	if header[1] != 0 {
+		if msg, ok := replyErrors[header[1]]; ok {
+			return nil, fmt.Errorf("socks5: %s", msg)
+		}
+		return nil, fmt.Errorf("socks5: request failed with code %d", header[1])
+	}
+
+	bound, err := readAddr(conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return bound, nil
+}
+
+// appendAddr encodes host:port as <atyp><address><port>
+func appendAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid port %s", portStr)
+	}
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, errors.New("socks5: host name too long")
+		}
+		b = append(b, atypDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, atypIPv4), ip4...)
+	} else {
+		b = append(append(b, atypIPv6), ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readAddr decodes <atyp><address><port>. Domain names are returned with a
+// nil IP since we never ask the proxy to bind to one.
+func readAddr(r io.Reader) (*net.UDPAddr, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return nil, fmt.Errorf("socks5: %v", err)
+	}
+
+	var ip net.IP
+	switch atyp[0] {
+	case atypIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case atypIPv6:
+		ip = make(net.IP, net.IPv6len)
+	case atypDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return nil, fmt.Errorf("socks5: %v", err)
+		}
+		if _, err := io.ReadFull(r, make([]byte, n[0])); err != nil {
+			return nil, fmt.Errorf("socks5: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("socks5: unknown address type %d", atyp[0])
+	}
+	if _, err := io.ReadFull(r, ip); err != nil {
+		return nil, fmt.Errorf("socks5: %v", err)
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, fmt.Errorf("socks5: %v", err)
+	}
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port))}, nil
+}
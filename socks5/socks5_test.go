@@ -0,0 +1,193 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeProxy is a minimal SOCKS5 server requiring user "u" with password "p"
+func fakeProxy(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveProxy(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveProxy(conn net.Conn) {
+	defer conn.Close()
+
+	// Greeting: insist on username/password
+	buf := make([]byte, 512)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	io.ReadFull(conn, buf[:buf[1]])
+	conn.Write([]byte{version, methodUserPass})
+
+	io.ReadFull(conn, buf[:2])
+	user := make([]byte, buf[1])
+	io.ReadFull(conn, user)
+	io.ReadFull(conn, buf[:1])
+	pass := make([]byte, buf[0])
+	io.ReadFull(conn, pass)
+	if string(user) != "u" || string(pass) != "p" {
+		conn.Write([]byte{userPassVersion, 1})
+		return
+	}
+	conn.Write([]byte{userPassVersion, 0})
+
+	// Request
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return
+	}
+	cmd := buf[1]
+	dst, err := readAddr(conn)
+	if err != nil {
+		return
+	}
+
+	switch cmd {
+	case cmdConnect:
+		target, err := net.Dial("tcp", dst.String())
+		if err != nil {
+			conn.Write([]byte{version, 5, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		conn.Write([]byte{version, 0, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+
+	case cmdUDPAssociate:
+		relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		reply, _ := appendAddr([]byte{version, 0, 0}, relay.LocalAddr().String())
+		conn.Write(reply)
+
+		// Relay datagrams between the client and their destinations
+		go func() {
+			var client *net.UDPAddr
+			packet := make([]byte, 65536)
+			for {
+				n, from, err := relay.ReadFromUDP(packet)
+				if err != nil {
+					return
+				}
+				if client == nil || from.String() == client.String() {
+					client = from
+					r := bytes.NewReader(packet[3:n])
+					dst, err := readAddr(r)
+					if err != nil {
+						continue
+					}
+					relay.WriteToUDP(packet[n-r.Len():n], dst)
+					continue
+				}
+				wrapped, _ := appendAddr([]byte{0, 0, 0}, from.String())
+				relay.WriteToUDP(append(wrapped, packet[:n]...), client)
+			}
+		}()
+		io.Copy(io.Discard, conn)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	// An echo server to reach through the proxy
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	proxy := fakeProxy(t)
+	d := &Dialer{ProxyAddr: proxy, Username: "u", Password: "p"}
+	conn, err := d.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Errorf("Expected echo of ping, got %q (err: %v)", reply, err)
+	}
+
+	// Wrong credentials are rejected
+	bad := &Dialer{ProxyAddr: proxy, Username: "u", Password: "wrong"}
+	if _, err := bad.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Error("Expected authentication failure")
+	}
+}
+
+func TestListenPacket(t *testing.T) {
+	// A UDP echo server to reach through the relay
+	echo, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	d := &Dialer{ProxyAddr: fakeProxy(t), Username: "u", Password: "p"}
+	pc, err := d.ListenPacket(context.Background(), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer pc.Close()
+
+	target := echo.LocalAddr().(*net.UDPAddr)
+	if _, err := pc.WriteTo([]byte("hello"), target); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+
+	buf := make([]byte, 1500)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Errorf("Expected hello, got %q", buf[:n])
+	}
+	if from.String() != target.String() {
+		t.Errorf("Expected datagram from %s, got %s", target, from)
+	}
+}
@@ -0,0 +1,194 @@
+// Package statedir lays out the directory where the client keeps its state
+// between runs: resume data, the DHT routing table, the torrent registry and
+// the stats database. When the directory moves, Open carries the state over
+// from the last location used.
+package statedir
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// appName is the directory state lives in under the per-user state location
+const appName = "bittorrent-client"
+
+// recordName is the file in the default directory that remembers the last
+// directory used, so a moved directory can be migrated
+const recordName = "location"
+
+// Dir is a state directory
+type Dir string
+
+// Default returns the default state directory: $XDG_STATE_HOME or
+// ~/.local/state on Unix, and the per-user application data directory on
+// macOS and Windows
+func Default() (string, error) {
+	switch runtime.GOOS {
+	case "windows":
+		dir, err := os.UserCacheDir() // %LocalAppData%
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, appName), nil
+	case "darwin", "ios":
+		dir, err := os.UserConfigDir() // ~/Library/Application Support
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, appName), nil
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, appName), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", appName), nil
+}
+
+// Resume returns where a torrent's resume data is kept
+func (d Dir) Resume(infoHash [20]byte) string {
+	return filepath.Join(string(d), "resume", fmt.Sprintf("%x.resume", infoHash))
+}
+
+// DHT returns where the DHT routing table is kept
+func (d Dir) DHT() string {
+	return filepath.Join(string(d), "dht.dat")
+}
+
+// Registry returns the directory where added torrents are remembered, one
+// file each, until they're removed
+func (d Dir) Registry() string {
+	return filepath.Join(string(d), "torrents")
+}
+
+// Stats returns where the transfer statistics database is kept
+func (d Dir) Stats() string {
+	return filepath.Join(string(d), "stats.db")
+}
+
+// Blocklist returns where the last downloaded blocklist is kept
+func (d Dir) Blocklist() string {
+	return filepath.Join(string(d), "blocklist.cache")
+}
+
+// Open creates the state directory at path, or the default one if path is
+// empty. If a different directory was used last time, its state is moved
+// over first.
+func Open(path string) (Dir, error) {
+	def, err := Default()
+	if err != nil {
+		return "", fmt.Errorf("no default state directory: %v", err)
+	}
+	if path == "" {
+		path = def
+	}
+	return open(path, filepath.Join(def, recordName))
+}
+
+// open creates the directory at path, migrating from the directory recorded
+// in the record file and then recording path there
+func open(path, record string) (Dir, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return "", fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	if last, err := os.ReadFile(record); err == nil {
+		if last := strings.TrimSpace(string(last)); last != "" && last != path {
+			if err := migrate(last, path, filepath.Base(record)); err != nil {
+				return "", fmt.Errorf("failed to move state from %s: %v", last, err)
+			}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(record), 0700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(record, []byte(path+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return Dir(path), nil
+}
+
+// migrate moves every entry of the old directory that the new one doesn't
+// have yet, except the record file, and removes the old directory if that
+// leaves it empty
+func migrate(from, to, record string) error {
+	entries, err := os.ReadDir(from)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() == record {
+			continue
+		}
+		src, dst := filepath.Join(from, e.Name()), filepath.Join(to, e.Name())
+		if to == src || strings.HasPrefix(to, src+string(filepath.Separator)) {
+			continue // the new directory is inside the old one
+		}
+		if _, err := os.Lstat(dst); err == nil {
+			continue // the new directory's own state wins
+		}
+		if err := move(src, dst); err != nil {
+			return err
+		}
+	}
+	os.Remove(from) // fails harmlessly if anything is left
+	return nil
+}
+
+// move renames src to dst, copying and deleting instead across file systems
+func move(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		return copyFile(path, target)
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyFile copies a regular file
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,72 @@
+package statedir
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDefault(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		t.Skip("XDG_STATE_HOME only applies on Unix")
+	}
+	t.Setenv("XDG_STATE_HOME", "/var/lib/me")
+	dir, err := Default()
+	if err != nil {
+		t.Fatalf("Default failed: %v", err)
+	}
+	if dir != filepath.Join("/var/lib/me", appName) {
+		t.Errorf("Expected %s, got %s", filepath.Join("/var/lib/me", appName), dir)
+	}
+
+	// Relative values are invalid per the spec and ignored
+	t.Setenv("XDG_STATE_HOME", "relative")
+	t.Setenv("HOME", "/home/me")
+	if dir, _ := Default(); dir != filepath.Join("/home/me", ".local", "state", appName) {
+		t.Errorf("Expected ~/.local/state default, got %s", dir)
+	}
+}
+
+func TestOpenMigrates(t *testing.T) {
+	root := t.TempDir()
+	record := filepath.Join(root, "default", recordName)
+	old, moved := filepath.Join(root, "old"), filepath.Join(root, "new")
+
+	d, err := open(old, record)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	resume := d.Resume([20]byte{1})
+	os.MkdirAll(filepath.Dir(resume), 0700)
+	os.WriteFile(resume, []byte("old resume"), 0600)
+	os.WriteFile(d.DHT(), []byte("old dht"), 0600)
+
+	// The new directory keeps its own files and gains the others
+	os.MkdirAll(moved, 0700)
+	os.WriteFile(filepath.Join(moved, "dht.dat"), []byte("new dht"), 0600)
+	d, err = open(moved, record)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	for path, expected := range map[string]string{d.Resume([20]byte{1}): "old resume", d.DHT(): "new dht"} {
+		if got, err := os.ReadFile(path); err != nil || string(got) != expected {
+			t.Errorf("%s: expected %q, got %q (err: %v)", path, expected, got, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(old, "resume")); !os.IsNotExist(err) {
+		t.Errorf("Expected resume data to be moved out of the old directory")
+	}
+
+	// Moving into a subdirectory of the old location must not recurse
+	nested := filepath.Join(moved, "nested")
+	if _, err := open(nested, record); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(nested, "resume")); err != nil {
+		t.Errorf("Expected resume data in the nested directory: %v", err)
+	}
+	if got, _ := os.ReadFile(record); string(got) != nested+"\n" {
+		t.Errorf("Expected %s to be recorded, got %q", nested, got)
+	}
+}
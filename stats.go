@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/statedir"
+	"github.com/omkarkirpan/bittorrent-client/stats"
+)
+
+// statsReport is the JSON form of the stats command's output
+type statsReport struct {
+	Downloaded int64      `json:"downloaded"`
+	Uploaded   int64      `json:"uploaded"`
+	Active     float64    `json:"active_seconds"`
+	Torrents   []statsRow `json:"torrents"`
+}
+
+// statsRow is one torrent's lifetime totals
+type statsRow struct {
+	InfoHash   string    `json:"info_hash"`
+	Name       string    `json:"name"`
+	Length     int64     `json:"length"`
+	Downloaded int64     `json:"downloaded"`
+	Uploaded   int64     `json:"uploaded"`
+	Ratio      float64   `json:"ratio"`
+	Active     float64   `json:"active_seconds"`
+	Seeding    float64   `json:"seeding_seconds"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastActive time.Time `json:"last_active"`
+}
+
+// runStats implements the stats command and returns the exit code
+func runStats(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	stateDir := fs.String("state-dir", "", "state directory the totals were recorded in, as given to --state-dir when downloading (default: the per-user state directory)")
+	jsonOutput := fs.Bool("json", false, "print the totals as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s stats [--state-dir dir] [--json]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Shows lifetime download and upload totals, ratios and active time, overall")
+		fmt.Fprintln(fs.Output(), "and per torrent, as recorded across every run.\n\nFlags:")
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	state, err := statedir.Open(*stateDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitStorage
+	}
+	db, err := stats.Open(state.Stats())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitStorage
+	}
+
+	report := newStatsReport(db)
+	if *jsonOutput {
+		if err := printJSON(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitFailure
+		}
+		return exitOK
+	}
+	printStatsTable(os.Stdout, report)
+	return exitOK
+}
+
+// newStatsReport summarizes a stats database
+func newStatsReport(db *stats.DB) *statsReport {
+	global := db.Global()
+	report := &statsReport{
+		Downloaded: global.Downloaded,
+		Uploaded:   global.Uploaded,
+		Active:     global.Active.Seconds(),
+		Torrents:   []statsRow{},
+	}
+	for _, t := range db.Torrents() {
+		report.Torrents = append(report.Torrents, statsRow{
+			InfoHash:   fmt.Sprintf("%x", t.InfoHash),
+			Name:       t.Name,
+			Length:     t.Length,
+			Downloaded: t.Downloaded,
+			Uploaded:   t.Uploaded,
+			Ratio:      t.Ratio(),
+			Active:     t.Active.Seconds(),
+			Seeding:    t.Seeding.Seconds(),
+			FirstSeen:  t.FirstSeen,
+			LastActive: t.LastActive,
+		})
+	}
+	return report
+}
+
+// printStatsTable prints lifetime totals as a table, most recently active
+// torrents first
+func printStatsTable(out io.Writer, report *statsReport) {
+	fmt.Fprintf(out, "Total: %s down, %s up, active %v\n\n", humanReadableSize(report.Downloaded),
+		humanReadableSize(report.Uploaded), time.Duration(report.Active*float64(time.Second)).Round(time.Second))
+	if len(report.Torrents) == 0 {
+		fmt.Fprintln(out, "No torrents recorded yet")
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDOWNLOADED\tUPLOADED\tRATIO\tACTIVE\tSEEDING\tLAST ACTIVE")
+	for _, row := range report.Torrents {
+		name := row.Name
+		if name == "" {
+			name = row.InfoHash
+		}
+		lastActive := "never"
+		if !row.LastActive.IsZero() {
+			lastActive = row.LastActive.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.2f\t%v\t%v\t%s\n", name, humanReadableSize(row.Downloaded), humanReadableSize(row.Uploaded),
+			row.Ratio, time.Duration(row.Active*float64(time.Second)).Round(time.Second),
+			time.Duration(row.Seeding*float64(time.Second)).Round(time.Second), lastActive)
+	}
+	w.Flush()
+}
@@ -0,0 +1,241 @@
+// Package stats keeps lifetime transfer totals per torrent in a database file
+// that survives restarts, independently of resume data, so ratios and time
+// spent seeding add up across runs
+package stats
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+)
+
+// version is the database format written by Save
+const version = 1
+
+// Totals are transfer amounts and time spent active
+type Totals struct {
+	Downloaded int64         // Bytes of piece data received
+	Uploaded   int64         // Bytes of piece data sent
+	Active     time.Duration // Time spent downloading or seeding
+	Seeding    time.Duration // Of Active, the time spent seeding
+}
+
+// Add returns the sum of t and o
+func (t Totals) Add(o Totals) Totals {
+	return Totals{
+		Downloaded: t.Downloaded + o.Downloaded,
+		Uploaded:   t.Uploaded + o.Uploaded,
+		Active:     t.Active + o.Active,
+		Seeding:    t.Seeding + o.Seeding,
+	}
+}
+
+// Torrent is the lifetime record of one torrent
+type Torrent struct {
+	InfoHash   [20]byte
+	Name       string
+	Length     int64     // Total size in bytes, 0 if never known
+	FirstSeen  time.Time // When the torrent was first recorded
+	LastActive time.Time // When activity was last recorded
+	Totals
+}
+
+// Ratio returns the bytes uploaded per byte of torrent size over the
+// torrent's lifetime
+func (t Torrent) Ratio() float64 {
+	if t.Length == 0 {
+		return 0
+	}
+	return float64(t.Uploaded) / float64(t.Length)
+}
+
+// DB is a stats database backed by a file. It is safe for concurrent use.
+type DB struct {
+	path string
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+	dirty    bool // changed since the last Save
+}
+
+// Open reads the database at path. A missing file is an empty database. A
+// file that can't be read still returns an empty database along with the
+// error, so callers may carry on and start over.
+func Open(path string) (*DB, error) {
+	db := &DB{path: path, torrents: make(map[[20]byte]*Torrent)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return db, nil
+	}
+	if err != nil {
+		return db, err
+	}
+	if err := db.load(data); err != nil {
+		db.torrents = make(map[[20]byte]*Torrent)
+		return db, fmt.Errorf("invalid stats database %s: %v", path, err)
+	}
+	return db, nil
+}
+
+// load parses a database written by Save
+func (db *DB) load(data []byte) error {
+	decoded, _, err := bencode.Decode(data)
+	if err != nil {
+		return err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return errors.New("not a dictionary")
+	}
+	if v, _ := dict["version"].(int64); v != version {
+		return fmt.Errorf("unsupported version %d", v)
+	}
+	torrents, _ := dict["torrents"].(map[string]interface{})
+	for key, value := range torrents {
+		var infoHash [20]byte
+		if n, err := hex.Decode(infoHash[:], []byte(key)); err != nil || n != len(infoHash) {
+			return fmt.Errorf("invalid info hash %q", key)
+		}
+		rec, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid record for %s", key)
+		}
+		name, _ := rec["name"].(string)
+		length, _ := rec["length"].(int64)
+		downloaded, _ := rec["downloaded"].(int64)
+		uploaded, _ := rec["uploaded"].(int64)
+		active, _ := rec["active"].(int64)
+		seeding, _ := rec["seeding"].(int64)
+		firstSeen, _ := rec["first seen"].(int64)
+		lastActive, _ := rec["last active"].(int64)
+		db.torrents[infoHash] = &Torrent{
+			InfoHash:   infoHash,
+			Name:       name,
+			Length:     length,
+			FirstSeen:  time.Unix(firstSeen, 0),
+			LastActive: time.Unix(lastActive, 0),
+			Totals: Totals{
+				Downloaded: downloaded,
+				Uploaded:   uploaded,
+				Active:     time.Duration(active) * time.Millisecond,
+				Seeding:    time.Duration(seeding) * time.Millisecond,
+			},
+		}
+	}
+	return nil
+}
+
+// Record adds delta to a torrent's totals at now, creating its record if
+// needed. A non-empty name and a non-zero length replace the recorded ones.
+func (db *DB) Record(infoHash [20]byte, name string, length int64, delta Totals, now time.Time) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, ok := db.torrents[infoHash]
+	if !ok {
+		t = &Torrent{InfoHash: infoHash, FirstSeen: now}
+		db.torrents[infoHash] = t
+	}
+	if name != "" {
+		t.Name = name
+	}
+	if length != 0 {
+		t.Length = length
+	}
+	if delta != (Totals{}) {
+		t.Totals = t.Totals.Add(delta)
+		t.LastActive = now
+	}
+	db.dirty = true
+}
+
+// Torrent returns the record of a torrent
+func (db *DB) Torrent(infoHash [20]byte) (Torrent, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, ok := db.torrents[infoHash]
+	if !ok {
+		return Torrent{}, false
+	}
+	return *t, true
+}
+
+// Torrents returns every record, most recently active first
+func (db *DB) Torrents() []Torrent {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	torrents := make([]Torrent, 0, len(db.torrents))
+	for _, t := range db.torrents {
+		torrents = append(torrents, *t)
+	}
+	sort.Slice(torrents, func(i, j int) bool {
+		if !torrents[i].LastActive.Equal(torrents[j].LastActive) {
+			return torrents[i].LastActive.After(torrents[j].LastActive)
+		}
+		return torrents[i].Name < torrents[j].Name
+	})
+	return torrents
+}
+
+// Global returns the totals of every torrent ever recorded
+func (db *DB) Global() Totals {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var total Totals
+	for _, t := range db.torrents {
+		total = total.Add(t.Totals)
+	}
+	return total
+}
+
+// Save writes the database to its file if it changed since it was opened or
+// last saved
+func (db *DB) Save() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.dirty {
+		return nil
+	}
+
+	torrents := make(map[string]interface{}, len(db.torrents))
+	for infoHash, t := range db.torrents {
+		torrents[hex.EncodeToString(infoHash[:])] = map[string]interface{}{
+			"name":        t.Name,
+			"length":      t.Length,
+			"downloaded":  t.Downloaded,
+			"uploaded":    t.Uploaded,
+			"active":      t.Active.Milliseconds(),
+			"seeding":     t.Seeding.Milliseconds(),
+			"first seen":  t.FirstSeen.Unix(),
+			"last active": t.LastActive.Unix(),
+		}
+	}
+	data, err := bencode.EncodeDict(map[string]interface{}{
+		"version":  version,
+		"torrents": torrents,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write a temporary file first so a crash can't leave half a file behind
+	if err := os.MkdirAll(filepath.Dir(db.path), 0700); err != nil {
+		return err
+	}
+	tmp := db.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, db.path); err != nil {
+		return err
+	}
+	db.dirty = false
+	return nil
+}
@@ -0,0 +1,77 @@
+package stats
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "stats.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	db.Record([20]byte{1}, "", 0, Totals{Downloaded: 100, Active: time.Second}, now)
+	db.Record([20]byte{1}, "one", 1000, Totals{Downloaded: 900, Uploaded: 500, Active: 2 * time.Second, Seeding: time.Second}, now.Add(time.Minute))
+	db.Record([20]byte{2}, "two", 200, Totals{Uploaded: 400}, now)
+	if err := db.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// The totals survive a restart
+	db, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	one, ok := db.Torrent([20]byte{1})
+	if !ok {
+		t.Fatal("Expected a record for the first torrent")
+	}
+	expected := Totals{Downloaded: 1000, Uploaded: 500, Active: 3 * time.Second, Seeding: time.Second}
+	if one.Name != "one" || one.Length != 1000 || one.Totals != expected {
+		t.Errorf("Expected one, 1000 bytes and %+v, got %s, %d and %+v", expected, one.Name, one.Length, one.Totals)
+	}
+	if !one.FirstSeen.Equal(now) || !one.LastActive.Equal(now.Add(time.Minute)) {
+		t.Errorf("Expected first seen %v and last active %v, got %v and %v", now, now.Add(time.Minute), one.FirstSeen, one.LastActive)
+	}
+	if one.Ratio() != 0.5 {
+		t.Errorf("Expected ratio 0.5, got %v", one.Ratio())
+	}
+
+	if global := db.Global(); global.Downloaded != 1000 || global.Uploaded != 900 {
+		t.Errorf("Expected 1000 bytes down and 900 up in total, got %+v", global)
+	}
+	if torrents := db.Torrents(); len(torrents) != 2 || torrents[0].Name != "one" {
+		t.Errorf("Expected the most recently active torrent first, got %+v", torrents)
+	}
+}
+
+func TestOpenMissingAndCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.db")
+	db, err := Open(path)
+	if err != nil || len(db.Torrents()) != 0 {
+		t.Fatalf("Expected an empty database for a missing file, got %d records (err: %v)", len(db.Torrents()), err)
+	}
+
+	// Nothing changed, so nothing is written
+	if err := db.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Expected no file to be written for an unchanged database")
+	}
+
+	// A corrupt file still yields a usable empty database
+	os.WriteFile(path, []byte("garbage"), 0600)
+	db, err = Open(path)
+	if err == nil {
+		t.Error("Expected an error for a corrupt file")
+	}
+	if db == nil || len(db.Torrents()) != 0 {
+		t.Error("Expected an empty database alongside the error")
+	}
+}
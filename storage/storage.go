@@ -0,0 +1,78 @@
+// Package storage reads and writes a torrent's pieces on disk. A piece of a
+// multi-file torrent may span several files; FileStorage maps a block of a
+// piece onto the files it covers, laid out the way a download lays them out.
+package storage
+
+import (
+	"fmt"
+
+	"github.com/omkarkirpan/bittorrent-client/download"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// FileStorage keeps a torrent's pieces in its files on disk
+type FileStorage struct {
+	t     *torrent.TorrentFile
+	files *download.Files
+}
+
+// NewFileStorage creates, or opens, the files of t as laid out by l, along
+// with the directories of their paths
+func NewFileStorage(t *torrent.TorrentFile, l download.Layout) (*FileStorage, error) {
+	files, err := download.CreateFiles(t, l)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{t: t, files: files}, nil
+}
+
+// ReadBlock reads len(p) bytes of piece index, starting at begin within the
+// piece. Parts of files not written yet read as zeros.
+func (s *FileStorage) ReadBlock(index, begin int, p []byte) error {
+	off, err := s.offset(index, begin, len(p))
+	if err != nil {
+		return err
+	}
+	_, err = s.files.ReadAt(p, off)
+	return err
+}
+
+// WriteBlock writes p into piece index, starting at begin within the piece
+func (s *FileStorage) WriteBlock(index, begin int, p []byte) error {
+	off, err := s.offset(index, begin, len(p))
+	if err != nil {
+		return err
+	}
+	_, err = s.files.WriteAt(p, off)
+	return err
+}
+
+// ReadPiece returns the whole piece index. The last piece is usually shorter
+// than the others.
+func (s *FileStorage) ReadPiece(index int) ([]byte, error) {
+	if index < 0 || index >= s.t.NumPieces() {
+		return nil, fmt.Errorf("piece %d out of range", index)
+	}
+	piece := make([]byte, s.t.PieceLength(index))
+	if err := s.ReadBlock(index, 0, piece); err != nil {
+		return nil, err
+	}
+	return piece, nil
+}
+
+// Close flushes the files to disk and closes them
+func (s *FileStorage) Close() error {
+	return s.files.Close()
+}
+
+// offset returns the torrent offset of a block, checking that it lies within
+// its piece
+func (s *FileStorage) offset(index, begin, length int) (int64, error) {
+	if index < 0 || index >= s.t.NumPieces() {
+		return 0, fmt.Errorf("piece %d out of range", index)
+	}
+	if begin < 0 || int64(begin)+int64(length) > s.t.PieceLength(index) {
+		return 0, fmt.Errorf("block at %d of %d bytes is outside piece %d", begin, length, index)
+	}
+	return int64(index)*s.t.Info.PieceLength + int64(begin), nil
+}
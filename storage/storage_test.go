@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/omkarkirpan/bittorrent-client/download"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+func TestFileStorage(t *testing.T) {
+	// Pieces of 10 bytes over files of 5, 20 and 12 bytes: piece 0 covers a
+	// and b, 2 covers b and sub/c, and the last piece is 7 bytes
+	tf := &torrent.TorrentFile{
+		Info: torrent.TorrentInfo{
+			Name:        "multi",
+			PieceLength: 10,
+			Pieces:      string(make([]byte, 4*20)),
+			Files: []torrent.FileInfo{
+				{Length: 5, Path: []string{"a"}},
+				{Length: 20, Path: []string{"b"}},
+				{Length: 12, Path: []string{"sub", "c"}},
+			},
+		},
+	}
+	data := make([]byte, tf.TotalLength())
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	dir := t.TempDir()
+	s, err := NewFileStorage(tf, download.Layout{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewFileStorage failed: %v", err)
+	}
+	for i := range tf.NumPieces() {
+		piece := data[i*10 : min(i*10+10, len(data))]
+		// Write each piece in two blocks, the second starting mid-piece
+		if err := s.WriteBlock(i, 0, piece[:4]); err != nil {
+			t.Fatalf("WriteBlock of piece %d failed: %v", i, err)
+		}
+		if err := s.WriteBlock(i, 4, piece[4:]); err != nil {
+			t.Fatalf("WriteBlock of piece %d failed: %v", i, err)
+		}
+	}
+
+	last, err := s.ReadPiece(3)
+	if err != nil || !bytes.Equal(last, data[30:]) {
+		t.Errorf("Expected the 7-byte last piece, got %v (err: %v)", last, err)
+	}
+	block := make([]byte, 6)
+	if err := s.ReadBlock(2, 2, block); err != nil || !bytes.Equal(block, data[22:28]) {
+		t.Errorf("Expected a block spanning b and sub/c, got %v (err: %v)", block, err)
+	}
+
+	for _, tt := range []struct {
+		index, begin, length int
+	}{
+		{-1, 0, 1},
+		{4, 0, 1},
+		{0, -1, 1},
+		{0, 5, 6},
+		{3, 0, 8}, // past the end of the short last piece
+	} {
+		if err := s.WriteBlock(tt.index, tt.begin, make([]byte, tt.length)); err == nil {
+			t.Errorf("Expected error for %d bytes at %d of piece %d", tt.length, tt.begin, tt.index)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	for _, f := range []struct {
+		path string
+		data []byte
+	}{
+		{"a", data[:5]},
+		{"b", data[5:25]},
+		{filepath.Join("sub", "c"), data[25:]},
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, "multi", f.path))
+		if err != nil || !bytes.Equal(got, f.data) {
+			t.Errorf("Expected %s to hold %v, got %v (err: %v)", f.path, f.data, got, err)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/download"
+	"github.com/omkarkirpan/bittorrent-client/session"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// streamOptions are the stream command's settings on top of those of a
+// download
+type streamOptions struct {
+	options
+	addr string
+	file int
+}
+
+// register defines the flags for o on fs
+func (o *streamOptions) register(fs *flag.FlagSet) {
+	o.options.register(fs)
+	fs.StringVar(&o.addr, "addr", "127.0.0.1:8888", "address to serve the file on")
+	fs.IntVar(&o.file, "file", 0, "stream the file with this `index` as listed by \"info --files\" (default: the largest file)")
+}
+
+// runStream downloads one file of a torrent in order and serves it over HTTP
+// while it downloads, until interrupted. It returns the exit code.
+func runStream(args []string) int {
+	fs := flag.NewFlagSet("stream", flag.ContinueOnError)
+	var opts streamOptions
+	opts.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s stream [flags] <torrent>\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Downloads a file in order and serves it over HTTP with range requests,")
+		fmt.Fprintln(fs.Output(), "so a player such as VLC can play it while it downloads.")
+		fmt.Fprintln(fs.Output(), "\nFlags:")
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	if opts.file < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --file must be a positive index")
+		return exitUsage
+	}
+
+	cfg, err := opts.load(fs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	cfg.Sequential = true
+	cfg.SelectFiles = func(tf *torrent.TorrentFile) ([]download.Priority, error) {
+		index, err := streamFile(tf, opts.file)
+		if err != nil {
+			return nil, err
+		}
+		priorities := make([]download.Priority, len(torrentPaths(tf)))
+		for i := range priorities {
+			if i != index {
+				priorities[i] = download.PrioritySkip
+			}
+		}
+		return priorities, nil
+	}
+
+	fetch, err := fetchClient(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	a, err := loadTorrentArg(positional[0], fetch)
+	if err == nil && a.tf != nil {
+		_, err = streamFile(a.tf, opts.file)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading %s: %v\n", positional[0], err)
+		return exitUsage
+	}
+
+	// Claim the address before starting anything else
+	ln, err := net.Listen("tcp", opts.addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+	defer ln.Close()
+
+	sess, err := session.New(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error starting session: %v\n", err)
+		return exitFailure
+	}
+	defer sess.Close()
+	t, err := a.add(sess)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error adding %s: %v\n", a.arg, err)
+		return exitUsage
+	}
+
+	ctx, stop := notifyShutdown(cfg.Logger)
+	defer stop()
+
+	// Magnet links need their metadata before we know what to serve
+	tf := waitMetadata(ctx, t)
+	if tf == nil {
+		if ctx.Err() != nil {
+			return exitOK
+		}
+		fmt.Fprintf(os.Stderr, "Failed to download %s: %v\n", t.Name(), t.Err())
+		return exitCode(t.Err())
+	}
+	index, err := streamFile(tf, opts.file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	name := filepath.Base(torrentPaths(tf)[index])
+
+	server := &http.Server{Handler: streamHandler(t, index, name)}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ln) }()
+	if !opts.quiet {
+		fmt.Printf("Streaming %s at http://%s/%s\n", name, ln.Addr(), url.PathEscape(name))
+	}
+
+	display := newProgressDisplay(os.Stdout, []*session.Torrent{t})
+	display.quiet = opts.quiet
+	displayed := make(chan struct{})
+	go func() {
+		display.run(ctx)
+		close(displayed)
+	}()
+
+	// Keep serving once the download is done, until interrupted
+	code := exitOK
+	select {
+	case err := <-served:
+		fmt.Fprintf(os.Stderr, "Error serving %s: %v\n", name, err)
+		return exitFailure
+	case <-displayed:
+		if t.State() == session.StateFailed {
+			fmt.Fprintf(os.Stderr, "Failed to download %s: %v\n", t.Name(), t.Err())
+			code = exitCode(t.Err())
+			break
+		}
+		if ctx.Err() == nil && !opts.quiet {
+			fmt.Println("Download complete, still streaming; press Ctrl+C to stop")
+		}
+		select {
+		case err := <-served:
+			fmt.Fprintf(os.Stderr, "Error serving %s: %v\n", name, err)
+			return exitFailure
+		case <-ctx.Done():
+		}
+	}
+
+	shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdown); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "Error stopping server: %v\n", err)
+	}
+	if err := sess.Shutdown(shutdown); err != nil {
+		fmt.Fprintf(os.Stderr, "Error stopping session: %v\n", err)
+	}
+	return code
+}
+
+// streamHandler serves the file at index of t, with range requests, at any
+// path. Reads wait for the pieces they need.
+func streamHandler(t *session.Torrent, index int, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := t.NewReader(r.Context(), index)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer reader.Close()
+		http.ServeContent(w, r, name, time.Time{}, reader)
+	})
+}
+
+// streamFile returns the index in torrent order of the file to stream: the
+// one at the 1-based index, or the largest file if index is 0
+func streamFile(tf *torrent.TorrentFile, index int) (int, error) {
+	paths := torrentPaths(tf)
+	if index > len(paths) {
+		return 0, fmt.Errorf("file %d is out of range: the torrent has %d files", index, len(paths))
+	}
+	if index > 0 {
+		return index - 1, nil
+	}
+	largest := 0
+	for i, f := range tf.Info.Files {
+		if f.Length > tf.Info.Files[largest].Length {
+			largest = i
+		}
+	}
+	return largest, nil
+}
+
+// waitMetadata waits until t's metadata is known and returns it, or returns
+// nil if t finishes or ctx is done first
+func waitMetadata(ctx context.Context, t *session.Torrent) *torrent.TorrentFile {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if tf := t.Metadata(); tf != nil {
+			return tf
+		}
+		select {
+		case <-ticker.C:
+		case <-t.Done():
+			return t.Metadata()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
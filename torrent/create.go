@@ -0,0 +1,254 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Piece length bounds for AutoPieceLength
+const (
+	minPieceLength  = 16 << 10 // 16 KiB
+	maxPieceLength  = 16 << 20 // 16 MiB
+	targetNumPieces = 1500     // Keeps .torrent files small without huge pieces
+)
+
+// hashMemory bounds the piece data read ahead for the hashers, though at
+// least two pieces are
+const hashMemory = 64 << 20
+
+// CreateOptions configures Create
+type CreateOptions struct {
+	// Name is the torrent's name, which clients use for its file or top
+	// directory. It defaults to the base name of the only path and must be
+	// set when there are several.
+	Name string
+
+	// Trackers are announce URLs. The first becomes the announce key; with
+	// more than one, each gets its own tier in announce-list.
+	Trackers    []string
+	PieceLength int64 // 0 picks one with AutoPieceLength
+	Private     bool
+	Comment     string
+	CreatedBy   string
+
+	// UpdateURL, if set, is a feed the publisher announces newer versions of
+	// the torrent in (BEP 39)
+	UpdateURL string
+
+	// HashWorkers is how many pieces are hashed at once while the next ones
+	// are read; 0 means one per CPU
+	HashWorkers int
+
+	// Progress, if set, is called after each piece is hashed. Calls don't
+	// overlap, but may come from different goroutines.
+	Progress func(done, total int)
+}
+
+// AutoPieceLength picks a power-of-two piece length giving roughly 1500
+// pieces for a torrent of totalLength bytes, between 16 KiB and 16 MiB
+func AutoPieceLength(totalLength int64) int64 {
+	length := int64(minPieceLength)
+	for length < maxPieceLength && totalLength/length > targetNumPieces {
+		length *= 2
+	}
+	return length
+}
+
+// Create builds a torrent of the files and directories at paths, hashing
+// their content. A single file becomes a single-file torrent. Otherwise the
+// torrent holds every regular file under paths, each directory walked in
+// lexical order; with one directory its content sits at the top, with
+// several paths each appears there under its base name.
+func Create(paths []string, opts CreateOptions) (*TorrentFile, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("at least one file or directory is required")
+	}
+	if len(opts.Trackers) == 0 {
+		return nil, errors.New("at least one tracker is required")
+	}
+	if opts.PieceLength < 0 || opts.PieceLength%minPieceLength != 0 {
+		return nil, fmt.Errorf("piece length must be a multiple of %d", minPieceLength)
+	}
+
+	info := TorrentInfo{Name: opts.Name}
+	if info.Name == "" {
+		if len(paths) > 1 {
+			return nil, errors.New("a name is required for a torrent of several paths")
+		}
+		info.Name = filepath.Base(filepath.Clean(paths[0]))
+	}
+
+	// Collect the files in torrent order
+	var files []string
+	seen := make(map[string]bool)
+	for _, root := range paths {
+		stat, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 1 && !stat.IsDir() {
+			files = []string{root}
+			info.Length = stat.Size()
+			break
+		}
+
+		// With several roots each keeps its own name inside the torrent
+		var prefix []string
+		if len(paths) > 1 {
+			base := filepath.Base(filepath.Clean(root))
+			if seen[base] {
+				return nil, fmt.Errorf("%s appears twice in the torrent", base)
+			}
+			seen[base] = true
+			prefix = []string{base}
+		}
+		if !stat.IsDir() {
+			files = append(files, root)
+			info.Files = append(info.Files, FileInfo{Length: stat.Size(), Path: prefix})
+			continue
+		}
+		err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			files = append(files, p)
+			path := append(append([]string{}, prefix...), strings.Split(filepath.ToSlash(rel), "/")...)
+			info.Files = append(info.Files, FileInfo{Length: fi.Size(), Path: path})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s has no files", strings.Join(paths, ", "))
+	}
+
+	t := &TorrentFile{
+		Announce:     opts.Trackers[0],
+		CreationDate: time.Now().Unix(),
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		Info:         info,
+	}
+	if len(opts.Trackers) > 1 {
+		for _, tr := range opts.Trackers {
+			t.AnnounceList = append(t.AnnounceList, []string{tr})
+		}
+	}
+	if opts.Private {
+		t.Info.Private = 1
+	}
+	t.Info.UpdateURL = opts.UpdateURL
+
+	totalLength := t.TotalLength()
+	if totalLength == 0 {
+		return nil, errors.New("can't create a torrent of empty files")
+	}
+	t.Info.PieceLength = opts.PieceLength
+	if t.Info.PieceLength == 0 {
+		t.Info.PieceLength = AutoPieceLength(totalLength)
+	}
+
+	pieces, err := hashFiles(files, t.Info.PieceLength, totalLength, opts.HashWorkers, opts.Progress)
+	if err != nil {
+		return nil, err
+	}
+	t.Info.Pieces = pieces
+	return t, nil
+}
+
+// hashFiles hashes the files as one stream cut into pieces and returns the
+// concatenated piece hashes. Pieces are read in order and hashed by workers
+// in parallel, with a few read ahead so the disk and CPUs are both busy.
+func hashFiles(paths []string, pieceLength, totalLength int64, workers int, progress func(done, total int)) (string, error) {
+	numPieces := int((totalLength + pieceLength - 1) / pieceLength)
+	readers := make([]io.Reader, 0, len(paths))
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	stream := io.MultiReader(readers...)
+
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	inFlight := max(2, min(2*workers, int(hashMemory/pieceLength)))
+	workers = min(workers, inFlight)
+
+	// Buffers go round between the reader and the hashers; there are never
+	// more than inFlight, so returning one never blocks
+	buffers := make(chan []byte, inFlight)
+	for i := 0; i < inFlight; i++ {
+		buffers <- make([]byte, pieceLength)
+	}
+	type piece struct {
+		index int
+		data  []byte
+	}
+	jobs := make(chan piece)
+	hashes := make([]byte, numPieces*sha1.Size)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		hashed int
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				sum := sha1.Sum(p.data)
+				copy(hashes[p.index*sha1.Size:], sum[:])
+				buffers <- p.data[:cap(p.data)]
+				if progress != nil {
+					mu.Lock()
+					hashed++
+					progress(hashed, numPieces)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	var err error
+	for i := 0; i < numPieces; i++ {
+		buf := <-buffers
+		n, readErr := io.ReadFull(stream, buf)
+		if readErr == io.ErrUnexpectedEOF && i == numPieces-1 {
+			readErr = nil
+		}
+		if readErr != nil {
+			err = fmt.Errorf("failed to read piece %d: %v", i, readErr)
+			break
+		}
+		jobs <- piece{index: i, data: buf[:n]}
+	}
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return "", err
+	}
+	return string(hashes), nil
+}
@@ -0,0 +1,199 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+)
+
+// Edit is a change to a torrent's metadata, made with TorrentFile.Edit.
+// Fields left zero change nothing.
+type Edit struct {
+	ReplaceTrackers map[string]string // Old announce URL to new one, which takes its place
+	RemoveTrackers  []string
+	AddTrackers     []string // Appended, each as a backup tier of its own (BEP 12)
+
+	RemoveWebSeeds []string
+	AddWebSeeds    []string
+
+	Comment   *string
+	CreatedBy *string
+
+	// Private, if set, marks the torrent private (BEP 27) or not. Unlike
+	// the other changes it changes the info hash, so the torrent joins a new
+	// swarm, without the peers of the old one.
+	Private *bool
+}
+
+// Edit changes the torrent's metadata as e says, and reports whether its
+// info hash changed. Nothing is changed if e names a tracker or web seed the
+// torrent doesn't have, or an invalid URL. Keys of the info dictionary that
+// TorrentInfo doesn't model are kept.
+func (t *TorrentFile) Edit(e Edit) (bool, error) {
+	trackers := t.Trackers()
+	for old, replacement := range e.ReplaceTrackers {
+		if !slices.Contains(trackers, old) {
+			return false, fmt.Errorf("tracker %q not in the torrent", old)
+		}
+		if err := checkURL(replacement, "http", "https", "udp"); err != nil {
+			return false, err
+		}
+	}
+	for _, u := range e.RemoveTrackers {
+		if !slices.Contains(trackers, u) {
+			return false, fmt.Errorf("tracker %q not in the torrent", u)
+		}
+	}
+	for _, u := range e.AddTrackers {
+		if err := checkURL(u, "http", "https", "udp"); err != nil {
+			return false, err
+		}
+	}
+	for _, u := range e.RemoveWebSeeds {
+		if !slices.Contains(t.URLList, u) {
+			return false, fmt.Errorf("web seed %q not in the torrent", u)
+		}
+	}
+	for _, u := range e.AddWebSeeds {
+		if err := checkURL(u, "http", "https"); err != nil {
+			return false, err
+		}
+	}
+
+	changed := false
+	if e.Private != nil && *e.Private != t.IsPrivate() {
+		if err := t.setPrivate(*e.Private); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	for old, replacement := range e.ReplaceTrackers {
+		t.mapTrackers(func(u string) string {
+			if u == old {
+				return replacement
+			}
+			return u
+		})
+	}
+	for _, removed := range e.RemoveTrackers {
+		t.mapTrackers(func(u string) string {
+			if u == removed {
+				return ""
+			}
+			return u
+		})
+	}
+	for _, u := range e.AddTrackers {
+		t.addTracker(u)
+	}
+
+	for _, u := range e.RemoveWebSeeds {
+		t.URLList = slices.DeleteFunc(t.URLList, func(seed string) bool { return seed == u })
+	}
+	for _, u := range e.AddWebSeeds {
+		if !slices.Contains(t.URLList, u) {
+			t.URLList = append(t.URLList, u)
+		}
+	}
+
+	if e.Comment != nil {
+		t.Comment = *e.Comment
+	}
+	if e.CreatedBy != nil {
+		t.CreatedBy = *e.CreatedBy
+	}
+	return changed, nil
+}
+
+// mapTrackers replaces every announce URL with what fn returns for it,
+// dropping those it returns "" for and the tiers left empty. The announce
+// URL falls back to the first in the list if it was dropped.
+func (t *TorrentFile) mapTrackers(fn func(u string) string) {
+	if t.Announce != "" {
+		t.Announce = fn(t.Announce)
+	}
+	tiers := t.AnnounceList[:0]
+	for _, tier := range t.AnnounceList {
+		var kept []string
+		for _, u := range tier {
+			if u = fn(u); u != "" && !slices.Contains(kept, u) {
+				kept = append(kept, u)
+			}
+		}
+		if len(kept) > 0 {
+			tiers = append(tiers, kept)
+		}
+	}
+	t.AnnounceList = tiers
+	if len(t.AnnounceList) == 0 {
+		t.AnnounceList = nil
+	}
+	if t.Announce == "" && len(t.AnnounceList) > 0 {
+		t.Announce = t.AnnounceList[0][0]
+	}
+}
+
+// addTracker appends an announce URL the torrent doesn't have as a tier of
+// its own, starting an announce list if the torrent has a single tracker
+func (t *TorrentFile) addTracker(u string) {
+	switch {
+	case slices.Contains(t.Trackers(), u):
+	case t.Announce == "" && len(t.AnnounceList) == 0:
+		t.Announce = u
+	case len(t.AnnounceList) == 0:
+		t.AnnounceList = [][]string{{t.Announce}, {u}}
+	default:
+		t.AnnounceList = append(t.AnnounceList, []string{u})
+		if t.Announce == "" {
+			t.Announce = t.AnnounceList[0][0]
+		}
+	}
+}
+
+// setPrivate sets the private flag, in the info dictionary as it was parsed
+// too, so keys TorrentInfo doesn't model stay part of the new info hash
+func (t *TorrentFile) setPrivate(private bool) error {
+	parsed := t.Info.raw != nil && !t.Info.edited()
+	t.Info.Private = 0
+	if private {
+		t.Info.Private = 1
+	}
+	if !parsed {
+		return nil
+	}
+
+	decoded, _, err := bencode.Decode(t.Info.raw)
+	if err != nil {
+		return err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return errors.New("info is not a dictionary")
+	}
+	delete(dict, "private")
+	if private {
+		dict["private"] = int64(1)
+	}
+	encoded, err := bencode.EncodeDict(dict)
+	if err != nil {
+		return err
+	}
+	t.Info.keepRaw(encoded)
+	return nil
+}
+
+// checkURL checks that u is an absolute URL with one of the given schemes
+func checkURL(u string, schemes ...string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %v", u, err)
+	}
+	if !slices.Contains(schemes, parsed.Scheme) || parsed.Host == "" {
+		return fmt.Errorf("invalid URL %q: want an absolute %v URL", u, schemes)
+	}
+	return nil
+}
@@ -1,13 +1,19 @@
 package torrent
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"reflect"
+	"slices"
+	"strings"
 
 	"github.com/omkarkirpan/bittorrent-client/bencode"
+	"github.com/omkarkirpan/bittorrent-client/magnet"
 )
 
 // Encoder interface for a future bencode encoder
@@ -17,18 +23,52 @@ type Encoder interface {
 
 // FileInfo represents information about a file in the torrent
 type FileInfo struct {
-	Length int64
-	Path   []string
+	Length      int64    `bencode:"length"`
+	Path        []string `bencode:"path"`
+	Attr        string   `bencode:"attr,omitempty"`         // BEP 47 attributes; see IsPadding and the like
+	SymlinkPath []string `bencode:"symlink path,omitempty"` // Target of a symlink, relative to the torrent's folder
+}
+
+// IsPadding reports whether the file is padding (BEP 47): zeros aligning
+// the next file to a piece boundary, which aren't saved
+func (f FileInfo) IsPadding() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+// IsExecutable reports whether the file should be saved as executable
+func (f FileInfo) IsExecutable() bool {
+	return strings.Contains(f.Attr, "x")
+}
+
+// IsHidden reports whether the file should be hidden
+func (f FileInfo) IsHidden() bool {
+	return strings.Contains(f.Attr, "h")
+}
+
+// IsSymlink reports whether the file is a symbolic link to SymlinkPath,
+// with no content of its own
+func (f FileInfo) IsSymlink() bool {
+	return strings.Contains(f.Attr, "l")
 }
 
 // TorrentInfo represents the "info" dictionary in a torrent file
 type TorrentInfo struct {
 	PieceLength int64      `bencode:"piece length"`
-	Pieces      string     `bencode:"pieces"`
+	Pieces      string     `bencode:"pieces,omitempty"` // required unless the torrent is v2 only
 	Name        string     `bencode:"name"`
 	Length      int64      `bencode:"length,omitempty"`
 	Files       []FileInfo `bencode:"files,omitempty"`
+	Attr        string     `bencode:"attr,omitempty"` // BEP 47 attributes of a single-file torrent's file
 	Private     int64      `bencode:"private,omitempty"`
+	UpdateURL   string     `bencode:"update-url,omitempty"` // BEP 39: feed announcing newer versions
+
+	// BitTorrent v2 (BEP 52). A hybrid torrent has these as well as the v1
+	// fields above, describing the same files.
+	MetaVersion int64    `bencode:"meta version,omitempty"`
+	FileTree    []FileV2 `bencode:"-"` // the "file tree", flattened in path order
+
+	raw    []byte       // the dictionary as parsed, with any keys not modeled above
+	parsed *TorrentInfo // the fields above as parsed, to tell if they were edited since
 }
 
 // TorrentFile represents the structure of a torrent file
@@ -40,6 +80,11 @@ type TorrentFile struct {
 	CreatedBy    string      `bencode:"created by,omitempty"`
 	Encoding     string      `bencode:"encoding,omitempty"`
 	Info         TorrentInfo `bencode:"info"`
+	URLList      []string    `bencode:"-"` // BEP 19: web seeds serving the content over HTTP
+
+	// PieceLayers maps the merkle root of each v2 file larger than a piece to
+	// the concatenated SHA-256 hashes of its pieces (BEP 52)
+	PieceLayers map[string]string `bencode:"piece layers,omitempty"`
 }
 
 // ParseFromFile loads and parses a .torrent file
@@ -58,142 +103,200 @@ func ParseFromFile(path string) (*TorrentFile, error) {
 	return Parse(data)
 }
 
-// Parse parses torrent data from a byte slice
-func Parse(data []byte) (*TorrentFile, error) {
-	decoded, _, err := bencode.Decode(data)
+// MaxFileSize bounds the size of a .torrent file read by Load or LoadWith
+const MaxFileSize = 10 << 20
+
+// Load parses a .torrent file from a local path or an http(s) URL
+func Load(source string) (*TorrentFile, error) {
+	return LoadWith(http.DefaultClient, source)
+}
+
+// LoadWith is like Load but downloads URLs with client
+func LoadWith(client *http.Client, source string) (*TorrentFile, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return ParseFromFile(source)
+	}
+
+	resp, err := client.Get(source)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to download torrent: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download torrent: %s", resp.Status)
 	}
 
-	dict, ok := decoded.(map[string]interface{})
-	if !ok {
-		return nil, errors.New("torrent file is not a dictionary")
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download torrent: %v", err)
 	}
+	if len(data) > MaxFileSize {
+		return nil, errors.New("torrent file too large")
+	}
+	return Parse(data)
+}
 
-	// Convert the generic map to our TorrentFile struct
+// Parse parses torrent data from a byte slice
+func Parse(data []byte) (*TorrentFile, error) {
 	torrent := &TorrentFile{}
+	if err := bencode.Unmarshal(data, torrent); err != nil {
+		return nil, err
+	}
+	raw, err := bencode.Lookup(data, "info")
+	if err != nil {
+		return nil, err
+	}
+	torrent.URLList = parseURLList(data)
+	if err := torrent.Info.parseV2(raw); err != nil {
+		return nil, err
+	}
+	if err := torrent.Info.check(); err != nil {
+		return nil, err
+	}
+	torrent.Info.keepRaw(raw)
+	return torrent, nil
+}
 
-	// Parse announce URL
-	if announce, ok := dict["announce"].(string); ok {
-		torrent.Announce = announce
-	} else {
-		return nil, errors.New("missing or invalid announce URL")
-	}
-
-	// Parse announce-list if it exists
-	if announceList, ok := dict["announce-list"].([]interface{}); ok {
-		for _, tier := range announceList {
-			if tierList, ok := tier.([]interface{}); ok {
-				var stringTier []string
-				for _, url := range tierList {
-					if strURL, ok := url.(string); ok {
-						stringTier = append(stringTier, strURL)
-					}
-				}
-				torrent.AnnounceList = append(torrent.AnnounceList, stringTier)
+// parseURLList reads the "url-list" key, which holds either one URL or a
+// list of them. Anything else is ignored, like other malformed optional keys.
+func parseURLList(data []byte) []string {
+	raw, err := bencode.Lookup(data, "url-list")
+	if err != nil {
+		return nil
+	}
+	var value interface{}
+	if err := bencode.Unmarshal(raw, &value); err != nil {
+		return nil
+	}
+	var urls []string
+	switch value := value.(type) {
+	case string:
+		urls = append(urls, value)
+	case []interface{}:
+		for _, item := range value {
+			if url, ok := item.(string); ok {
+				urls = append(urls, url)
 			}
 		}
 	}
+	return slices.DeleteFunc(urls, func(url string) bool { return url == "" })
+}
 
-	// Parse optional fields
-	if creationDate, ok := dict["creation date"].(int64); ok {
-		torrent.CreationDate = creationDate
+// ParseInfo parses a bencoded info dictionary on its own, as received from
+// peers when fetching metadata for a magnet link. data must hold nothing
+// else, as it is kept to hash.
+func ParseInfo(data []byte) (*TorrentInfo, error) {
+	info := &TorrentInfo{}
+	if err := bencode.Unmarshal(data, info); err != nil {
+		return nil, err
 	}
-
-	if comment, ok := dict["comment"].(string); ok {
-		torrent.Comment = comment
+	if err := info.parseV2(data); err != nil {
+		return nil, err
 	}
-
-	if createdBy, ok := dict["created by"].(string); ok {
-		torrent.CreatedBy = createdBy
+	if err := info.check(); err != nil {
+		return nil, err
 	}
+	info.keepRaw(data)
+	return info, nil
+}
 
-	if encoding, ok := dict["encoding"].(string); ok {
-		torrent.Encoding = encoding
+// keepRaw remembers the encoded dictionary the info was parsed from
+func (info *TorrentInfo) keepRaw(raw []byte) {
+	parsed := *info
+	parsed.raw, parsed.parsed = nil, nil
+	parsed.Files = slices.Clone(info.Files)
+	for i, f := range parsed.Files {
+		parsed.Files[i].Path = slices.Clone(f.Path)
+		parsed.Files[i].SymlinkPath = slices.Clone(f.SymlinkPath)
 	}
-
-	// Parse info dictionary (required)
-	infoDict, ok := dict["info"].(map[string]interface{})
-	if !ok {
-		return nil, errors.New("missing or invalid info dictionary")
+	parsed.FileTree = slices.Clone(info.FileTree)
+	for i, f := range parsed.FileTree {
+		parsed.FileTree[i].Path = slices.Clone(f.Path)
 	}
+	info.raw, info.parsed = bytes.Clone(raw), &parsed
+}
 
-	// Parse piece length (required)
-	pieceLength, ok := infoDict["piece length"].(int64)
-	if !ok {
-		return nil, errors.New("missing or invalid piece length")
-	}
-	torrent.Info.PieceLength = pieceLength
+// edited reports whether the fields were changed since the info was parsed
+func (info *TorrentInfo) edited() bool {
+	current := *info
+	current.raw, current.parsed = nil, nil
+	return !reflect.DeepEqual(current, *info.parsed)
+}
 
-	// Parse pieces (required)
-	pieces, ok := infoDict["pieces"].(string)
-	if !ok {
-		return nil, errors.New("missing or invalid pieces")
+// check enforces what the struct tags can't express
+func (info *TorrentInfo) check() error {
+	if info.MetaVersion == 2 {
+		if err := info.checkV2(); err != nil {
+			return err
+		}
+		if info.Pieces == "" && info.Length == 0 && info.Files == nil {
+			return nil // v2 only
+		}
 	}
-	torrent.Info.Pieces = pieces
-
-	// Parse name (required)
-	name, ok := infoDict["name"].(string)
-	if !ok {
-		return nil, errors.New("missing or invalid name")
+	if info.Pieces == "" {
+		return errors.New("missing or invalid pieces")
 	}
-	torrent.Info.Name = name
-
-	// Parse length or files (mutually exclusive)
-	if length, ok := infoDict["length"].(int64); ok {
-		// Single file mode
-		torrent.Info.Length = length
-	} else if files, ok := infoDict["files"].([]interface{}); ok {
-		// Multiple files mode
-		for _, fileDict := range files {
-			if fileMap, ok := fileDict.(map[string]interface{}); ok {
-				fileInfo := FileInfo{}
-
-				// Parse file length
-				if fileLength, ok := fileMap["length"].(int64); ok {
-					fileInfo.Length = fileLength
-				} else {
-					return nil, errors.New("missing or invalid file length")
-				}
-
-				// Parse file path
-				if pathList, ok := fileMap["path"].([]interface{}); ok {
-					for _, pathElem := range pathList {
-						if pathStr, ok := pathElem.(string); ok {
-							fileInfo.Path = append(fileInfo.Path, pathStr)
-						}
-					}
-				} else {
-					return nil, errors.New("missing or invalid file path")
-				}
-
-				torrent.Info.Files = append(torrent.Info.Files, fileInfo)
-			}
+	if info.Length == 0 && info.Files == nil {
+		return errors.New("torrent must have either length or files")
+	}
+	for _, f := range info.Files {
+		if f.IsSymlink() && len(f.SymlinkPath) == 0 {
+			return fmt.Errorf("symlink %q has no target", f.Path)
 		}
-	} else {
-		return nil, errors.New("torrent must have either length or files")
 	}
+	return nil
+}
 
-	// Parse private flag (optional)
-	if private, ok := infoDict["private"].(int64); ok {
-		torrent.Info.Private = private
+// InfoBytes returns the bencoded info dictionary, as peers exchange it with
+// ut_metadata (BEP 9). A parsed one is returned exactly as it was encoded,
+// with keys such as "source" that TorrentInfo doesn't model, so the info
+// hash matches everyone else's. One built in code, or whose fields were
+// edited, is encoded from its fields.
+func (t *TorrentFile) InfoBytes() ([]byte, error) {
+	if t.Info.raw != nil && !t.Info.edited() {
+		return t.Info.raw, nil
 	}
-
-	return torrent, nil
+	return bencode.EncodeDict(t.infoDict())
 }
 
 // InfoHash returns the SHA-1 hash of the bencoded info dictionary
 func (t *TorrentFile) InfoHash() ([20]byte, error) {
-	// We need to re-encode just the info dictionary
+	encoded, err := t.InfoBytes()
+	if err != nil {
+		return [20]byte{}, err
+	}
+
+	// Calculate SHA-1 hash
+	return sha1.Sum(encoded), nil
+}
+
+// infoDict returns the info dictionary in the generic form the encoder takes
+func (t *TorrentFile) infoDict() map[string]interface{} {
 	infoDict := map[string]interface{}{
 		"piece length": t.Info.PieceLength,
-		"pieces":       t.Info.Pieces,
 		"name":         t.Info.Name,
 	}
+	if t.Info.Private != 0 {
+		infoDict["private"] = t.Info.Private
+	}
+	if t.Info.UpdateURL != "" {
+		infoDict["update-url"] = t.Info.UpdateURL
+	}
+	if t.IsV2() {
+		infoDict["meta version"] = t.Info.MetaVersion
+		infoDict["file tree"] = t.Info.fileTreeDict()
+		if !t.HasV1() {
+			return infoDict
+		}
+	}
 
 	// Add conditional fields
+	infoDict["pieces"] = t.Info.Pieces
 	if t.Info.Length > 0 {
 		infoDict["length"] = t.Info.Length
+		if t.Info.Attr != "" {
+			infoDict["attr"] = t.Info.Attr
+		}
 	} else {
 		// For multi-file torrents
 		files := make([]interface{}, 0, len(t.Info.Files))
@@ -202,22 +305,114 @@ func (t *TorrentFile) InfoHash() ([20]byte, error) {
 				"length": file.Length,
 				"path":   file.Path,
 			}
+			if file.Attr != "" {
+				fileDict["attr"] = file.Attr
+			}
+			if len(file.SymlinkPath) > 0 {
+				fileDict["symlink path"] = file.SymlinkPath
+			}
 			files = append(files, fileDict)
 		}
 		infoDict["files"] = files
 	}
-	if t.Info.Private != 0 {
-		infoDict["private"] = t.Info.Private
+	return infoDict
+}
+
+// Encode returns the bencoded .torrent file
+func (t *TorrentFile) Encode() ([]byte, error) {
+	info, err := t.InfoBytes()
+	if err != nil {
+		return nil, err
+	}
+	dict := map[string]interface{}{
+		"announce": t.Announce,
+		"info":     bencode.RawValue(info),
+	}
+	if len(t.AnnounceList) > 0 {
+		tiers := make([]interface{}, len(t.AnnounceList))
+		for i, tier := range t.AnnounceList {
+			tiers[i] = tier
+		}
+		dict["announce-list"] = tiers
+	}
+	if t.CreationDate != 0 {
+		dict["creation date"] = t.CreationDate
+	}
+	if t.Comment != "" {
+		dict["comment"] = t.Comment
+	}
+	if t.CreatedBy != "" {
+		dict["created by"] = t.CreatedBy
+	}
+	if t.Encoding != "" {
+		dict["encoding"] = t.Encoding
+	}
+	if len(t.URLList) > 0 {
+		dict["url-list"] = t.URLList
+	}
+	if len(t.PieceLayers) > 0 {
+		layers := make(map[string]interface{}, len(t.PieceLayers))
+		for root, hashes := range t.PieceLayers {
+			layers[root] = hashes
+		}
+		dict["piece layers"] = layers
 	}
+	return bencode.EncodeDict(dict)
+}
 
-	// For now, we'll re-encode manually since we haven't implemented an encoder yet
-	encoded, err := bencode.EncodeDict(infoDict)
+// WriteTo writes the bencoded .torrent file to w
+func (t *TorrentFile) WriteTo(w io.Writer) (int64, error) {
+	data, err := t.Encode()
 	if err != nil {
-		return [20]byte{}, err
+		return 0, err
 	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
 
-	// Calculate SHA-1 hash
-	return sha1.Sum(encoded), nil
+// Save writes the .torrent file to path, replacing any file there
+func (t *TorrentFile) Save(path string) error {
+	data, err := t.Encode()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Trackers returns the announce URL followed by the announce list, without
+// duplicates, since the announce URL usually reappears in the list
+func (t *TorrentFile) Trackers() []string {
+	var trackers []string
+	seen := map[string]bool{}
+	for _, url := range append([]string{t.Announce}, slices.Concat(t.AnnounceList...)...) {
+		if url != "" && !seen[url] {
+			seen[url] = true
+			trackers = append(trackers, url)
+		}
+	}
+	return trackers
+}
+
+// MagnetLink returns a magnet URI naming the torrent by its info hash, and
+// by its v2 info hash if it has v2 metadata, with its name and trackers, to
+// share it without the .torrent file
+func (t *TorrentFile) MagnetLink() (string, error) {
+	m := &magnet.Magnet{Name: t.Info.Name, Trackers: t.Trackers()}
+	if t.HasV1() {
+		hash, err := t.InfoHash()
+		if err != nil {
+			return "", err
+		}
+		m.InfoHash = hash
+	}
+	if t.IsV2() {
+		hash, err := t.InfoHashV2()
+		if err != nil {
+			return "", err
+		}
+		m.InfoHashV2 = hash
+	}
+	return m.String(), nil
 }
 
 // PieceHash returns the hash for a specific piece
@@ -261,6 +456,12 @@ func (t *TorrentFile) PieceLength(index int) int64 {
 	return t.Info.PieceLength
 }
 
+// IsPrivate reports whether the torrent is private (BEP 27). Peers of a
+// private torrent may only be obtained from its trackers.
+func (t *TorrentFile) IsPrivate() bool {
+	return t.Info.Private == 1
+}
+
 // TotalLength returns the total size of all files in the torrent
 func (t *TorrentFile) TotalLength() int64 {
 	if t.Info.Length > 0 {
@@ -273,5 +474,10 @@ func (t *TorrentFile) TotalLength() int64 {
 	for _, file := range t.Info.Files {
 		totalLength += file.Length
 	}
+	if !t.HasV1() {
+		for _, file := range t.Info.FileTree {
+			totalLength += file.Length
+		}
+	}
 	return totalLength
 }
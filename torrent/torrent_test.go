@@ -1,9 +1,20 @@
 package torrent
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
 )
 
 // loadTorrentFile is a helper function to parse the torrent file and fail the test if it cannot be loaded.
@@ -37,6 +48,36 @@ func TestParseFromFile(t *testing.T) {
 	})
 }
 
+func TestLoad(t *testing.T) {
+	data, err := os.ReadFile("../Debian.torrent")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/debian.torrent" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	for _, source := range []string{"../Debian.torrent", server.URL + "/debian.torrent"} {
+		tf, err := Load(source)
+		if err != nil {
+			t.Errorf("Load(%s) failed: %v", source, err)
+			continue
+		}
+		if tf.Info.Name != "debian-12.9.0-amd64-DVD-1.iso" {
+			t.Errorf("Expected Debian torrent from %s, got %q", source, tf.Info.Name)
+		}
+	}
+
+	if _, err := Load(server.URL + "/missing.torrent"); err == nil {
+		t.Error("Expected error for missing URL")
+	}
+}
+
 func TestInfoHash(t *testing.T) {
 	torrentFile := loadTorrentFile(t)
 
@@ -70,6 +111,243 @@ func TestInfoHash(t *testing.T) {
 	})
 }
 
+func TestInfoHashExtraKeys(t *testing.T) {
+	// Keys we don't model, here "source", are part of the hash
+	info := "d6:lengthi3e4:name1:a12:piece lengthi16384e6:pieces20:" + strings.Repeat("x", 20) + "6:source3:ABCe"
+	data := []byte("d8:announce3:url4:info" + info + "e")
+	expected := sha1.Sum([]byte(info))
+
+	tf, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if hash, err := tf.InfoHash(); err != nil || hash != expected {
+		t.Errorf("Expected info hash %x, got %x (err: %v)", expected, hash, err)
+	}
+	parsed, err := ParseInfo([]byte(info))
+	if err != nil {
+		t.Fatalf("ParseInfo failed: %v", err)
+	}
+	if hash, _ := (&TorrentFile{Info: *parsed}).InfoHash(); hash != expected {
+		t.Errorf("Expected info hash %x from ParseInfo, got %x", expected, hash)
+	}
+
+	// Writing the torrent out keeps them
+	encoded, err := tf.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if string(encoded) != string(data) {
+		t.Errorf("Expected %q after encoding, got %q", data, encoded)
+	}
+
+	// Edited fields are encoded afresh
+	tf.Info.Name = "b"
+	if hash, _ := tf.InfoHash(); hash == expected {
+		t.Error("Expected the info hash to change with the name")
+	}
+}
+
+func TestV2(t *testing.T) {
+	rootA, rootB := strings.Repeat("a", 32), strings.Repeat("b", 32)
+	fileTree := map[string]interface{}{
+		"b.bin": map[string]interface{}{"": map[string]interface{}{"length": int64(40000), "pieces root": rootB}},
+		"dir": map[string]interface{}{
+			"a.txt": map[string]interface{}{"": map[string]interface{}{"length": int64(10), "pieces root": rootA}},
+			"empty": map[string]interface{}{"": map[string]interface{}{"length": int64(0)}},
+		},
+	}
+	v2Info := map[string]interface{}{
+		"name":         "album",
+		"piece length": int64(16384),
+		"meta version": int64(2),
+		"file tree":    fileTree,
+	}
+	layer := strings.Repeat("1", 32) + strings.Repeat("2", 32) + strings.Repeat("3", 32)
+	encode := func(info map[string]interface{}) []byte {
+		t.Helper()
+		data, err := bencode.EncodeDict(map[string]interface{}{
+			"announce":     "url",
+			"info":         info,
+			"piece layers": map[string]interface{}{rootB: layer},
+		})
+		if err != nil {
+			t.Fatalf("EncodeDict failed: %v", err)
+		}
+		return data
+	}
+
+	tf, err := Parse(encode(v2Info))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	expectedFiles := []FileV2{
+		{Path: []string{"b.bin"}, Length: 40000, PiecesRoot: [32]byte([]byte(rootB))},
+		{Path: []string{"dir", "a.txt"}, Length: 10, PiecesRoot: [32]byte([]byte(rootA))},
+		{Path: []string{"dir", "empty"}},
+	}
+	if !reflect.DeepEqual(tf.Info.FileTree, expectedFiles) {
+		t.Errorf("Expected files %+v, got %+v", expectedFiles, tf.Info.FileTree)
+	}
+	if !tf.IsV2() || tf.HasV1() || tf.TotalLength() != 40010 {
+		t.Errorf("Expected a v2-only torrent of 40010 bytes, got v2 %t, v1 %t, %d bytes", tf.IsV2(), tf.HasV1(), tf.TotalLength())
+	}
+	infoBytes, _ := bencode.Lookup(encode(v2Info), "info")
+	if hash, err := tf.InfoHashV2(); err != nil || hash != sha256.Sum256(infoBytes) {
+		t.Errorf("Expected v2 info hash %x, got %x (err: %v)", sha256.Sum256(infoBytes), hash, err)
+	}
+	hashes, err := tf.PieceLayer(tf.Info.FileTree[0])
+	if err != nil || len(hashes) != 3 || hashes[2] != [32]byte([]byte(strings.Repeat("3", 32))) {
+		t.Errorf("Expected 3 piece hashes for b.bin, got %d (err: %v)", len(hashes), err)
+	}
+	if hashes, err := tf.PieceLayer(tf.Info.FileTree[1]); err != nil || hashes != nil {
+		t.Errorf("Expected no piece layer for a file within a piece, got %d hashes (err: %v)", len(hashes), err)
+	}
+
+	// Encoding the fields afresh gives the same dictionary
+	tf.Info.raw = nil
+	if encoded, err := tf.Encode(); err != nil || string(encoded) != string(encode(v2Info)) {
+		t.Errorf("Expected %q after encoding, got %q (err: %v)", encode(v2Info), encoded, err)
+	}
+
+	// A hybrid torrent has both hashes
+	hybrid := map[string]interface{}{"pieces": strings.Repeat("x", 60), "files": []interface{}{
+		map[string]interface{}{"length": int64(40000), "path": []string{"b.bin"}},
+		map[string]interface{}{"length": int64(10), "path": []string{"dir", "a.txt"}},
+	}}
+	for k, v := range v2Info {
+		hybrid[k] = v
+	}
+	tf, err = Parse(encode(hybrid))
+	if err != nil {
+		t.Fatalf("Parse of the hybrid failed: %v", err)
+	}
+	infoBytes, _ = bencode.Lookup(encode(hybrid), "info")
+	hashV1, _ := tf.InfoHash()
+	hashV2, _ := tf.InfoHashV2()
+	if !tf.IsV2() || !tf.HasV1() || tf.NumPieces() != 3 || hashV1 != sha1.Sum(infoBytes) || hashV2 != sha256.Sum256(infoBytes) {
+		t.Errorf("Expected a hybrid torrent with 3 v1 pieces and both info hashes, got v2 %t, v1 %t, %d pieces", tf.IsV2(), tf.HasV1(), tf.NumPieces())
+	}
+	link, _ := tf.MagnetLink()
+	if !strings.Contains(link, fmt.Sprintf("xt=urn:btih:%x&xt=urn:btmh:1220%x", hashV1, hashV2)) {
+		t.Errorf("Expected a magnet link with both info hashes, got %s", link)
+	}
+
+	// A v1 torrent has no v2 hash
+	if _, err := loadTorrentFile(t).InfoHashV2(); err == nil {
+		t.Error("Expected an error for the v2 info hash of a v1 torrent")
+	}
+
+	testCases := []struct {
+		name string
+		edit func(info map[string]interface{})
+		err  string
+	}{
+		{"Unknown meta version", func(info map[string]interface{}) { info["meta version"] = int64(3) }, "unsupported meta version 3"},
+		{"No file tree", func(info map[string]interface{}) { delete(info, "file tree") }, "missing or invalid file tree"},
+		{"Short pieces root", func(info map[string]interface{}) {
+			info["file tree"] = map[string]interface{}{"a": map[string]interface{}{"": map[string]interface{}{"length": int64(1), "pieces root": "x"}}}
+		}, `missing or invalid pieces root of ["a"]`},
+		{"Piece length", func(info map[string]interface{}) { info["piece length"] = int64(20000) }, "v2 piece length must be a power of two of at least 16 KiB, got 20000"},
+		{"v1 without pieces", func(info map[string]interface{}) { delete(info, "meta version"); info["length"] = int64(1) }, "missing or invalid pieces"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			info := map[string]interface{}{}
+			for k, v := range v2Info {
+				info[k] = v
+			}
+			tc.edit(info)
+			if _, err := Parse(encode(info)); err == nil || err.Error() != tc.err {
+				t.Errorf("Expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestURLList(t *testing.T) {
+	info := "d6:lengthi3e4:name1:a12:piece lengthi16384e6:pieces20:" + strings.Repeat("x", 20) + "e"
+	testCases := []struct {
+		urlList  string
+		expected []string
+	}{
+		{"", nil},
+		{"8:url-list13:http://a/file", []string{"http://a/file"}},
+		{"8:url-listl9:http://a/0:i1e9:http://b/e", []string{"http://a/", "http://b/"}},
+		{"8:url-listi1e", nil},
+	}
+	for _, tc := range testCases {
+		data := []byte("d8:announce3:url4:info" + info + tc.urlList + "e")
+		tf, err := Parse(data)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		if !reflect.DeepEqual(tf.URLList, tc.expected) {
+			t.Errorf("%s: expected web seeds %q, got %q", tc.urlList, tc.expected, tf.URLList)
+		}
+	}
+
+	// Web seeds are written out as a list
+	tf, _ := Parse([]byte("d8:announce3:url4:info" + info + "8:url-list9:http://a/e"))
+	encoded, err := tf.Encode()
+	if expected := "d8:announce3:url4:info" + info + "8:url-listl9:http://a/ee"; err != nil || string(encoded) != expected {
+		t.Errorf("Expected %q, got %q (err: %v)", expected, encoded, err)
+	}
+}
+
+func TestFileAttributes(t *testing.T) {
+	files := "ld4:attr1:x6:lengthi5e4:pathl5:a.bineed4:attr1:p6:lengthi3e4:pathl4:.pad1:3eed4:attr1:l6:lengthi0e4:pathl4:linke12:symlink pathl5:a.bineee"
+	info := "d5:files" + files + "4:name1:d12:piece lengthi16384e6:pieces20:" + strings.Repeat("x", 20) + "e"
+	tf, err := Parse([]byte("d8:announce3:url4:info" + info + "e"))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	testCases := []struct {
+		padding, executable, symlink bool
+		target                       []string
+	}{
+		{false, true, false, nil},
+		{true, false, false, nil},
+		{false, false, true, []string{"a.bin"}},
+	}
+	for i, tc := range testCases {
+		f := tf.Info.Files[i]
+		if f.IsPadding() != tc.padding || f.IsExecutable() != tc.executable || f.IsSymlink() != tc.symlink || f.IsHidden() {
+			t.Errorf("File %d: expected padding %v, executable %v and symlink %v, got attributes %q", i, tc.padding, tc.executable, tc.symlink, f.Attr)
+		}
+		if !reflect.DeepEqual(f.SymlinkPath, tc.target) {
+			t.Errorf("File %d: expected symlink path %q, got %q", i, tc.target, f.SymlinkPath)
+		}
+	}
+	if tf.TotalLength() != 8 {
+		t.Errorf("Expected padding to count towards the length, got %d", tf.TotalLength())
+	}
+
+	// The attributes are encoded from the fields too
+	built := &TorrentFile{Info: TorrentInfo{Name: "d", PieceLength: 16384, Pieces: tf.Info.Pieces, Files: tf.Info.Files}}
+	if encoded, err := built.InfoBytes(); err != nil || string(encoded) != info {
+		t.Errorf("Expected %q, got %q (err: %v)", info, encoded, err)
+	}
+
+	noTarget := strings.Replace(info, "12:symlink pathl5:a.bine", "", 1)
+	if _, err := ParseInfo([]byte(noTarget)); err == nil {
+		t.Error("Expected an error for a symlink without a target")
+	}
+}
+
+func TestMagnetLink(t *testing.T) {
+	tf := loadTorrentFile(t)
+	link, err := tf.MagnetLink()
+	if err != nil {
+		t.Fatalf("MagnetLink failed: %v", err)
+	}
+	expected := "magnet:?xt=urn:btih:83e53cb48c4af4989cd1a53a5b4671da821b1ff4&dn=debian-12.9.0-amd64-DVD-1.iso&tr=http%3A%2F%2Fbttracker.debian.org%3A6969%2Fannounce"
+	if link != expected {
+		t.Errorf("Expected %s, got %s", expected, link)
+	}
+}
+
 func TestPieceHash(t *testing.T) {
 	torrentFile := loadTorrentFile(t)
 
@@ -100,3 +378,226 @@ func TestPieceHash(t *testing.T) {
 		})
 	}
 }
+
+func TestIsPrivate(t *testing.T) {
+	torrentFile := loadTorrentFile(t)
+	if torrentFile.IsPrivate() {
+		t.Errorf("Debian torrent should not be private")
+	}
+
+	torrentFile.Info.Private = 1
+	if !torrentFile.IsPrivate() {
+		t.Errorf("Torrent with private=1 should be private")
+	}
+}
+
+func TestAutoPieceLength(t *testing.T) {
+	testCases := []struct {
+		totalLength int64
+		expected    int64
+	}{
+		{1000, 16 << 10},
+		{100 << 20, 128 << 10},
+		{4 << 30, 4 << 20},
+		{1 << 40, 16 << 20},
+	}
+
+	for _, tc := range testCases {
+		if got := AutoPieceLength(tc.totalLength); got != tc.expected {
+			t.Errorf("AutoPieceLength(%d): expected %d, got %d", tc.totalLength, tc.expected, got)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "album")
+	files := map[string]string{
+		"b.txt":        strings.Repeat("b", 20000),
+		"a/track1.txt": strings.Repeat("1", 30000),
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	hashed := 0
+	tf, err := Create([]string{dir}, CreateOptions{
+		Trackers:  []string{"udp://tracker.example:1337/announce", "http://backup.example/announce"},
+		Private:   true,
+		Comment:   "test",
+		UpdateURL: "http://feed.example/album.rss",
+		Progress:  func(done, total int) { hashed = done },
+	})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	if tf.Info.Name != "album" || tf.Info.PieceLength != 16<<10 || tf.NumPieces() != 4 || hashed != 4 {
+		t.Errorf("Expected album with 4 pieces of 16 KiB, got %s with %d pieces of %d (hashed %d)", tf.Info.Name, tf.NumPieces(), tf.Info.PieceLength, hashed)
+	}
+	if len(tf.Info.Files) != 2 || strings.Join(tf.Info.Files[0].Path, "/") != "a/track1.txt" {
+		t.Errorf("Expected files in lexical order, got %+v", tf.Info.Files)
+	}
+
+	// The files are hashed as one stream in torrent order
+	data := files["a/track1.txt"] + files["b.txt"]
+	for i := 0; i < tf.NumPieces(); i++ {
+		hash, _ := tf.PieceHash(i)
+		end := min((i+1)*16384, len(data))
+		if hash != sha1.Sum([]byte(data[i*16384:end])) {
+			t.Errorf("Piece %d has the wrong hash", i)
+		}
+	}
+
+	// Encoding and parsing it again keeps everything, including the info hash
+	encoded, err := tf.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	parsed, err := Parse(encoded)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	want, _ := tf.InfoHash()
+	got, _ := parsed.InfoHash()
+	if got != want {
+		t.Errorf("Expected info hash %x after parsing, got %x", want, got)
+	}
+	if parsed.Announce != tf.Announce || len(parsed.AnnounceList) != 2 || !parsed.IsPrivate() || parsed.Comment != "test" || parsed.Info.UpdateURL != "http://feed.example/album.rss" {
+		t.Errorf("Expected trackers, private flag, comment and update URL to survive encoding, got %+v", parsed)
+	}
+
+	// Hashing in parallel gives the same pieces, and the saved file parses
+	single, err := Create([]string{dir}, CreateOptions{Trackers: []string{"http://t"}, HashWorkers: 1})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	multi, err := Create([]string{dir}, CreateOptions{Trackers: []string{"http://t"}, HashWorkers: 8})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if single.Info.Pieces != tf.Info.Pieces || multi.Info.Pieces != tf.Info.Pieces {
+		t.Error("Expected the same piece hashes with 1 and 8 hash workers")
+	}
+	path := filepath.Join(t.TempDir(), "album.torrent")
+	if err := multi.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if saved, err := ParseFromFile(path); err != nil || saved.Info.Pieces != tf.Info.Pieces {
+		t.Errorf("Expected the saved torrent to parse with the same pieces (err: %v)", err)
+	}
+
+	if _, err := Create([]string{dir}, CreateOptions{}); err == nil {
+		t.Error("Expected error without trackers")
+	}
+	if _, err := Create([]string{dir}, CreateOptions{Trackers: []string{"http://t"}, PieceLength: 1000}); err == nil {
+		t.Error("Expected error with a piece length that isn't a multiple of 16 KiB")
+	}
+
+	// Several paths each keep their name under the torrent's
+	notes := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(notes, []byte("liner notes"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	both, err := Create([]string{dir, notes}, CreateOptions{Name: "release", Trackers: []string{"http://t"}})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	var names []string
+	for _, f := range both.Info.Files {
+		names = append(names, strings.Join(f.Path, "/"))
+	}
+	if both.Info.Name != "release" || strings.Join(names, " ") != "album/a/track1.txt album/b.txt notes.txt" {
+		t.Errorf("Expected release with album/a/track1.txt, album/b.txt and notes.txt, got %s with %v", both.Info.Name, names)
+	}
+	if both.TotalLength() != int64(len(data)+len("liner notes")) {
+		t.Errorf("Expected %d bytes, got %d", len(data)+len("liner notes"), both.TotalLength())
+	}
+	if _, err := Create([]string{dir, notes}, CreateOptions{Trackers: []string{"http://t"}}); err == nil {
+		t.Error("Expected error for several paths without a name")
+	}
+	if _, err := Create([]string{dir, dir}, CreateOptions{Name: "twice", Trackers: []string{"http://t"}}); err == nil {
+		t.Error("Expected error for two paths with the same name")
+	}
+}
+
+func TestEdit(t *testing.T) {
+	info := "d6:lengthi3e4:name1:a12:piece lengthi16384e6:pieces20:" + strings.Repeat("x", 20) + "6:source3:ABCe"
+	parse := func() *TorrentFile {
+		tf, err := Parse([]byte("d8:announce9:http://a/4:info" + info + "e"))
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		return tf
+	}
+
+	// Trackers are replaced in place, removed and appended as tiers
+	tf := parse()
+	comment := "moved"
+	changed, err := tf.Edit(Edit{
+		ReplaceTrackers: map[string]string{"http://a/": "udp://b:1337"},
+		AddTrackers:     []string{"http://c/", "http://d/"},
+		AddWebSeeds:     []string{"https://mirror/"},
+		Comment:         &comment,
+	})
+	if err != nil || changed {
+		t.Fatalf("Expected an edit keeping the info hash, got changed %v (err: %v)", changed, err)
+	}
+	if want := [][]string{{"udp://b:1337"}, {"http://c/"}, {"http://d/"}}; tf.Announce != "udp://b:1337" || !reflect.DeepEqual(tf.AnnounceList, want) {
+		t.Errorf("Expected announce udp://b:1337 and tiers %v, got %s and %v", want, tf.Announce, tf.AnnounceList)
+	}
+	if hash, _ := tf.InfoHash(); hash != sha1.Sum([]byte(info)) {
+		t.Errorf("Expected the info hash to stay %x, got %x", sha1.Sum([]byte(info)), hash)
+	}
+	if tf.Comment != "moved" || !reflect.DeepEqual(tf.URLList, []string{"https://mirror/"}) {
+		t.Errorf("Expected the comment and web seed set, got %q and %v", tf.Comment, tf.URLList)
+	}
+
+	if _, err := tf.Edit(Edit{RemoveTrackers: []string{"udp://b:1337"}, RemoveWebSeeds: []string{"https://mirror/"}}); err != nil {
+		t.Fatalf("Edit failed: %v", err)
+	}
+	if want := [][]string{{"http://c/"}, {"http://d/"}}; tf.Announce != "http://c/" || !reflect.DeepEqual(tf.AnnounceList, want) {
+		t.Errorf("Expected announce http://c/ and tiers %v, got %s and %v", want, tf.Announce, tf.AnnounceList)
+	}
+	if len(tf.URLList) != 0 {
+		t.Errorf("Expected no web seeds, got %v", tf.URLList)
+	}
+
+	// Making it private changes the info hash but keeps unmodeled keys,
+	// and making it public again restores it
+	tf = parse()
+	private, public := true, false
+	if changed, err := tf.Edit(Edit{Private: &private}); err != nil || !changed || !tf.IsPrivate() {
+		t.Fatalf("Expected a private torrent with a new info hash, got changed %v (err: %v)", changed, err)
+	}
+	encoded, _ := tf.InfoBytes()
+	if want := strings.Replace(info, "6:source", "7:privatei1e6:source", 1); string(encoded) != want {
+		t.Errorf("Expected info %q, got %q", want, encoded)
+	}
+	if changed, err := tf.Edit(Edit{Private: &public}); err != nil || !changed {
+		t.Fatalf("Expected the info hash to change back, got changed %v (err: %v)", changed, err)
+	}
+	if hash, _ := tf.InfoHash(); hash != sha1.Sum([]byte(info)) {
+		t.Errorf("Expected the original info hash %x, got %x", sha1.Sum([]byte(info)), hash)
+	}
+
+	// Bad edits change nothing
+	for _, e := range []Edit{
+		{RemoveTrackers: []string{"http://missing/"}},
+		{ReplaceTrackers: map[string]string{"http://a/": "ftp://b/"}},
+		{AddTrackers: []string{"not a url"}},
+		{RemoveWebSeeds: []string{"http://missing/"}},
+		{AddTrackers: []string{"http://ok/"}, AddWebSeeds: []string{"udp://seed/"}},
+	} {
+		tf := parse()
+		if _, err := tf.Edit(e); err == nil {
+			t.Errorf("%+v: expected an error", e)
+		}
+		if tf.Announce != "http://a/" || tf.AnnounceList != nil {
+			t.Errorf("%+v: expected the trackers unchanged, got %s and %v", e, tf.Announce, tf.AnnounceList)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package torrent
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+)
+
+// FileV2 is a file in the "file tree" of a v2 torrent (BEP 52). Its pieces
+// are the leaves of a merkle tree of SHA-256 hashes over 16 KiB blocks.
+type FileV2 struct {
+	Path       []string
+	Length     int64
+	PiecesRoot [32]byte // root of the file's merkle tree; zero for an empty file
+	Attr       string   // BEP 47 attributes, as in FileInfo
+}
+
+// blockSize is the size of the blocks hashed into v2 merkle trees
+const blockSize = 16 << 10
+
+// parseV2 reads the file tree of a v2 or hybrid info dictionary, which
+// doesn't fit a struct as its keys are file names
+func (info *TorrentInfo) parseV2(raw []byte) error {
+	if info.MetaVersion == 0 {
+		return nil
+	}
+	if info.MetaVersion != 2 {
+		return fmt.Errorf("unsupported meta version %d", info.MetaVersion)
+	}
+
+	var tree struct {
+		FileTree map[string]interface{} `bencode:"file tree"`
+	}
+	if err := bencode.Unmarshal(raw, &tree); err != nil {
+		return err
+	}
+	info.FileTree = nil
+	return info.walkFileTree(tree.FileTree, nil)
+}
+
+// walkFileTree appends the files under a directory of the file tree, in
+// the order of their paths
+func (info *TorrentInfo) walkFileTree(dir map[string]interface{}, path []string) error {
+	names := make([]string, 0, len(dir))
+	for name := range dir {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		node, ok := dir[name].(map[string]interface{})
+		if !ok || name == "" {
+			return fmt.Errorf("invalid file tree entry %q", append(path, name))
+		}
+		filePath := append(slices.Clone(path), name)
+		props, isFile := node[""].(map[string]interface{})
+		if !isFile {
+			if err := info.walkFileTree(node, filePath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		length, ok := props["length"].(int64)
+		if !ok || length < 0 {
+			return fmt.Errorf("missing or invalid length of %q", filePath)
+		}
+		attr, _ := props["attr"].(string)
+		file := FileV2{Path: filePath, Length: length, Attr: attr}
+		if length > 0 {
+			root, ok := props["pieces root"].(string)
+			if !ok || len(root) != sha256.Size {
+				return fmt.Errorf("missing or invalid pieces root of %q", filePath)
+			}
+			copy(file.PiecesRoot[:], root)
+		}
+		info.FileTree = append(info.FileTree, file)
+	}
+	return nil
+}
+
+// checkV2 enforces what BEP 52 requires of the v2 fields
+func (info *TorrentInfo) checkV2() error {
+	if len(info.FileTree) == 0 {
+		return errors.New("missing or invalid file tree")
+	}
+	if n := info.PieceLength; n < blockSize || n&(n-1) != 0 {
+		return fmt.Errorf("v2 piece length must be a power of two of at least 16 KiB, got %d", n)
+	}
+	return nil
+}
+
+// fileTreeDict returns the file tree in the generic form the encoder takes
+func (info *TorrentInfo) fileTreeDict() map[string]interface{} {
+	tree := map[string]interface{}{}
+	for _, file := range info.FileTree {
+		dir := tree
+		for _, name := range file.Path {
+			next, ok := dir[name].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				dir[name] = next
+			}
+			dir = next
+		}
+		props := map[string]interface{}{"length": file.Length}
+		if file.Length > 0 {
+			props["pieces root"] = string(file.PiecesRoot[:])
+		}
+		if file.Attr != "" {
+			props["attr"] = file.Attr
+		}
+		dir[""] = props
+	}
+	return tree
+}
+
+// IsV2 reports whether the torrent has v2 metadata (BEP 52), on its own or
+// alongside v1 metadata in a hybrid torrent
+func (t *TorrentFile) IsV2() bool {
+	return t.Info.MetaVersion == 2
+}
+
+// HasV1 reports whether the torrent has v1 metadata: piece hashes and a file
+// list. Torrents without it can't be downloaded yet.
+func (t *TorrentFile) HasV1() bool {
+	return !t.IsV2() || t.Info.Pieces != ""
+}
+
+// InfoHashV2 returns the SHA-256 hash of the bencoded info dictionary, which
+// identifies a v2 or hybrid torrent
+func (t *TorrentFile) InfoHashV2() ([32]byte, error) {
+	if !t.IsV2() {
+		return [32]byte{}, errors.New("torrent has no v2 metadata")
+	}
+	encoded, err := t.InfoBytes()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(encoded), nil
+}
+
+// PieceLayer returns the SHA-256 hashes of the pieces of a v2 file, against
+// which downloaded pieces are verified. A file no larger than a piece has no
+// layer, as its pieces root is the hash of its only piece.
+func (t *TorrentFile) PieceLayer(file FileV2) ([][32]byte, error) {
+	if file.Length <= t.Info.PieceLength {
+		return nil, nil
+	}
+	layer, ok := t.PieceLayers[string(file.PiecesRoot[:])]
+	if !ok {
+		return nil, fmt.Errorf("no piece layer for %q", file.Path)
+	}
+	numPieces := (file.Length + t.Info.PieceLength - 1) / t.Info.PieceLength
+	if int64(len(layer)) != numPieces*sha256.Size {
+		return nil, fmt.Errorf("piece layer for %q has %d bytes, expected %d", file.Path, len(layer), numPieces*sha256.Size)
+	}
+	hashes := make([][32]byte, numPieces)
+	for i := range hashes {
+		copy(hashes[i][:], layer[i*sha256.Size:])
+	}
+	return hashes, nil
+}
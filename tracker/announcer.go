@@ -0,0 +1,143 @@
+package tracker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/clock"
+)
+
+// Announce intervals used when the tracker doesn't say, or says too little
+const (
+	DefaultInterval = 30 * time.Minute // Between announces when the tracker gives no interval
+	MinimumInterval = time.Minute      // Shortest interval honored, whatever the tracker says
+	RetryInterval   = time.Minute      // First wait after a failed announce, doubling up to DefaultInterval
+)
+
+// Announcer keeps a torrent announced to one tracker the way trackers expect:
+// a started announce first, regular ones at the interval the tracker asks for
+// (never sooner than its min interval), and completed, paused or stopped
+// when they happen, each with the totals at the time
+type Announcer struct {
+	URL string
+
+	// Request returns the announce to send without its event: who we are
+	// and our current uploaded, downloaded and left totals
+	Request func() *AnnounceRequest
+
+	// Send, if set, delivers an announce, e.g. over a bound socket or with
+	// logging. Otherwise AnnounceResultContext sends it with
+	// DefaultClient.
+	Send func(ctx context.Context, url string, req *AnnounceRequest) (*AnnounceResult, error)
+
+	// Answered, if set, is called with the outcome of every announce,
+	// including the ones Run sends, and how long it took
+	Answered func(event string, result *AnnounceResult, err error, took time.Duration)
+
+	// Clock, if set, times the intervals instead of the system clock
+	Clock clock.Clock
+
+	mu       sync.Mutex
+	started  bool      // the tracker accepted our started announce and hasn't been sent stopped since
+	next     time.Time // when the next regular announce is due
+	failures int       // announces failed in a row
+	id       string    // the tracker id the tracker last gave, sent back with every announce
+}
+
+// Announce sends one announce with event, or a regular one if event is
+// empty, and schedules the next regular announce by the tracker's answer.
+// A regular announce is sent as a started one until the tracker accepts
+// one; a stopped announce makes the next one a started one again.
+func (a *Announcer) Announce(ctx context.Context, event string) (*AnnounceResult, error) {
+	a.mu.Lock()
+	if event == "" && !a.started {
+		event = EventStarted
+	}
+	id := a.id
+	a.mu.Unlock()
+
+	clk := clock.Or(a.Clock)
+	req := a.Request()
+	req.Event = event
+	if req.TrackerID == "" {
+		req.TrackerID = id
+	}
+	start := clk.Now()
+	send := a.Send
+	if send == nil {
+		send = func(ctx context.Context, url string, req *AnnounceRequest) (*AnnounceResult, error) {
+			return AnnounceResultContext(ctx, DefaultClient, url, req)
+		}
+	}
+	result, err := send(ctx, a.URL, req)
+
+	a.mu.Lock()
+	switch {
+	case err != nil:
+		a.failures++
+		a.next = clk.Now().Add(min(RetryInterval<<min(a.failures-1, 5), DefaultInterval))
+	case event == EventStopped:
+		a.started = false
+		a.failures = 0
+	default:
+		if event == EventStarted {
+			a.started = true
+		}
+		a.failures = 0
+		if result.TrackerID != "" {
+			a.id = result.TrackerID
+		}
+		interval := result.Interval
+		if interval <= 0 {
+			interval = DefaultInterval
+		}
+		a.next = clk.Now().Add(max(interval, result.MinInterval, MinimumInterval))
+	}
+	a.mu.Unlock()
+
+	if a.Answered != nil {
+		a.Answered(event, result, err, clk.Since(start))
+	}
+	return result, err
+}
+
+// Started reports whether the tracker accepted our started announce, and
+// so expects to hear when we complete or stop
+func (a *Announcer) Started() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.started
+}
+
+// Run sends regular announces whenever they are due, until ctx is done. It
+// doesn't send stopped; call Stop for that once Run has returned.
+func (a *Announcer) Run(ctx context.Context) {
+	clk := clock.Or(a.Clock)
+	for ctx.Err() == nil {
+		a.mu.Lock()
+		wait := a.next.Sub(clk.Now())
+		a.mu.Unlock()
+
+		if wait <= 0 {
+			a.Announce(ctx, "")
+			continue
+		}
+		// Events sent meanwhile push the next announce back, so look again
+		select {
+		case <-clk.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Stop tells the tracker we're leaving with a stopped announce, if it
+// accepted our started one
+func (a *Announcer) Stop(ctx context.Context) error {
+	if !a.Started() {
+		return nil
+	}
+	_, err := a.Announce(ctx, EventStopped)
+	return err
+}
@@ -0,0 +1,109 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// DefaultConcurrency is how many trackers AnnounceAll announces to at once
+// unless told otherwise
+const DefaultConcurrency = 8
+
+// WithConcurrency bounds how many trackers AnnounceAll announces to at once
+func WithConcurrency(n int) Option {
+	return func(o *announceOptions) {
+		if n > 0 {
+			o.concurrency = n
+		}
+	}
+}
+
+// MultiResult is what a torrent's trackers answered to AnnounceAll
+type MultiResult struct {
+	Peers []Peer // From every tracker that answered, each address once, in tier order
+
+	// The most seeders and leechers any tracker counted. Trackers of one
+	// swarm mostly see the same peers, so adding their counts up would
+	// count most peers several times.
+	Seeders  int
+	Leechers int
+
+	Results map[string]*AnnounceResult // By announce URL, for the trackers that answered
+	Errors  map[string]error           // By announce URL, for the trackers that failed
+}
+
+// AnnounceAll announces req to every tracker of the torrent at once, all
+// tiers together, instead of trying them one after another (BEP 12), so
+// slow or dead trackers don't hold up the peers of the others. Its info hash
+// is the torrent's. It fails only if no tracker answered, with every
+// tracker's error, and gives up when ctx is done.
+func AnnounceAll(ctx context.Context, torrentFile *torrent.TorrentFile, req *AnnounceRequest, opts ...Option) (*MultiResult, error) {
+	infoHash, err := torrentFile.InfoHash()
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate info hash: %v", err)
+	}
+	trackers := torrentFile.Trackers()
+	if len(trackers) == 0 {
+		return nil, errors.New("torrent has no trackers")
+	}
+	o := newAnnounceOptions(opts)
+
+	results := make([]*AnnounceResult, len(trackers))
+	errs := make([]error, len(trackers))
+	slots := make(chan struct{}, o.concurrency)
+	var wg sync.WaitGroup
+	for i, announce := range trackers {
+		if u, err := url.Parse(announce); err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp") {
+			errs[i] = fmt.Errorf("unsupported tracker %s", announce)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-slots }()
+
+			r := *req
+			r.InfoHash = infoHash
+			results[i], errs[i] = AnnounceResultContext(ctx, o.client, announce, &r)
+		}()
+	}
+	wg.Wait()
+
+	multi := &MultiResult{Results: map[string]*AnnounceResult{}, Errors: map[string]error{}}
+	seen := map[string]bool{}
+	for i, announce := range trackers {
+		if errs[i] != nil {
+			multi.Errors[announce] = errs[i]
+			continue
+		}
+		result := results[i]
+		multi.Results[announce] = result
+		multi.Seeders = max(multi.Seeders, result.Seeders)
+		multi.Leechers = max(multi.Leechers, result.Leechers)
+		for _, p := range result.Peers {
+			if addr := p.String(); !seen[addr] {
+				seen[addr] = true
+				multi.Peers = append(multi.Peers, p)
+			}
+		}
+	}
+	if len(multi.Results) == 0 {
+		joined := make([]error, 0, len(trackers))
+		for i, announce := range trackers {
+			joined = append(joined, fmt.Errorf("%s: %w", announce, errs[i]))
+		}
+		return nil, errors.Join(joined...)
+	}
+	return multi, nil
+}
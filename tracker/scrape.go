@@ -0,0 +1,111 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+	"github.com/omkarkirpan/bittorrent-client/transport"
+)
+
+// ErrScrapeUnsupported is returned for HTTP trackers whose announce URL
+// doesn't follow the convention that lets the scrape URL be derived from it
+var ErrScrapeUnsupported = errors.New("tracker doesn't support scraping")
+
+// ScrapeResult holds a tracker's counts for one torrent's swarm
+type ScrapeResult struct {
+	Seeders   int // Peers with the whole torrent
+	Leechers  int // Peers still downloading
+	Completed int // Downloads the tracker has seen finish
+}
+
+// Scrape asks the tracker at announce how many peers the torrent's swarm
+// has. HTTP(S) and UDP (BEP 15) trackers are supported; client is used for
+// HTTP trackers, and UDP trackers are scraped with ScrapeUDP over a plain
+// UDP socket.
+func Scrape(ctx context.Context, client *http.Client, announce string, infoHash [20]byte) (*ScrapeResult, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid announce URL: %v", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(ctx, client, u, infoHash)
+	case "udp":
+		return ScrapeUDP(ctx, nil, announce, infoHash)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+// ScrapeUDP scrapes a udp:// tracker (BEP 15) over a socket opened with dial,
+// e.g. one bound to an interface. A nil dial opens a plain UDP socket.
+func ScrapeUDP(ctx context.Context, dial transport.DialFunc, announce string, infoHash [20]byte) (*ScrapeResult, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid announce URL: %v", err)
+	}
+	if u.Scheme != "udp" {
+		return nil, fmt.Errorf("not a UDP tracker: %s", announce)
+	}
+	conn, err := dialUDP(ctx, dial, u.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.scrape(ctx, infoHash)
+}
+
+// scrapeHTTP scrapes an HTTP tracker. The scrape URL replaces "announce" at
+// the start of the announce URL's last path segment with "scrape".
+func scrapeHTTP(ctx context.Context, client *http.Client, u *url.URL, infoHash [20]byte) (*ScrapeResult, error) {
+	i := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return nil, ErrScrapeUnsupported
+	}
+	scrapeURL := *u
+	scrapeURL.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(u.Path[i+1:], "announce")
+	q := scrapeURL.Query()
+	q.Set("info_hash", string(infoHash[:]))
+	scrapeURL.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scrapeURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scrape URL: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("scrape request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("scrape request failed: %s", resp.Status)
+	}
+	// Parse d5:filesd20:<info hash>d8:complete...eee as it arrives
+	var reply struct {
+		FailureReason string `bencode:"failure reason,omitempty"`
+		Files         map[string]struct {
+			Complete   int `bencode:"complete,omitempty"`
+			Incomplete int `bencode:"incomplete,omitempty"`
+			Downloaded int `bencode:"downloaded,omitempty"`
+		} `bencode:"files,omitempty"`
+	}
+	d := bencode.NewDecoder(resp.Body)
+	d.Limits = responseLimits
+	if err := d.Decode(&reply); err != nil {
+		return nil, fmt.Errorf("failed to parse scrape response: %w", err)
+	}
+	if reply.FailureReason != "" {
+		return nil, &FailureError{Reason: reply.FailureReason}
+	}
+	stats, ok := reply.Files[string(infoHash[:])]
+	if !ok {
+		return nil, errors.New("tracker doesn't know the torrent")
+	}
+	return &ScrapeResult{Seeders: stats.Complete, Leechers: stats.Incomplete, Completed: stats.Downloaded}, nil
+}
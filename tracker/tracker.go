@@ -1,7 +1,10 @@
 package tracker
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -9,9 +12,11 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/omkarkirpan/bittorrent-client/bencode"
+	"github.com/omkarkirpan/bittorrent-client/peer"
 	"github.com/omkarkirpan/bittorrent-client/torrent"
 )
 
@@ -21,73 +26,332 @@ type Peer struct {
 	Port uint16
 }
 
-// String returns a string representation of a peer
+// String returns a string representation of a peer, with IPv6 addresses in
+// brackets so it can be dialed
 func (p Peer) String() string {
-	return fmt.Sprintf("%s:%d", p.IP.String(), p.Port)
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
 
 // TrackerResponse represents the response from a tracker
 type TrackerResponse struct {
-	Interval    int    `bencode:"interval"`
+	Interval    int    `bencode:"interval,omitempty"`
 	MinInterval int    `bencode:"min interval,omitempty"`
 	Complete    int    `bencode:"complete,omitempty"`
 	Incomplete  int    `bencode:"incomplete,omitempty"`
-	Peers       string `bencode:"peers"`
-	// We'll ignore the dictionary model of peers for now
+	Peers       string `bencode:"peers,omitempty"`
+	Peers6      string `bencode:"peers6,omitempty"`      // BEP 7: compact IPv6 peers
+	ExternalIP  net.IP `bencode:"external ip,omitempty"` // BEP 24: our IP as the tracker sees it
+	TrackerID   string `bencode:"tracker id,omitempty"`  // To send back in later announces
+	PeerList    []Peer `bencode:"-"`                     // Peers sent in the original dictionary model instead of Peers
 }
 
-// RequestPeers sends a request to the tracker and returns a list of peers
-func RequestPeers(torrentFile *torrent.TorrentFile, port uint16) ([]Peer, error) {
-	// Generate a random peer ID (20 bytes)
-	peerId := generatePeerId()
+// dictPeer is a peer in the original dictionary model, whose IP is written
+// out, IPv4 or IPv6
+type dictPeer struct {
+	IP   string `bencode:"ip,omitempty"`
+	Port int64  `bencode:"port,omitempty"`
+}
+
+// FailureError is a tracker's refusal of a request, with the reason it gave
+// in its "failure reason" or error response. Use errors.As to find it.
+type FailureError struct {
+	Reason string
+}
+
+func (e *FailureError) Error() string {
+	return "tracker error: " + e.Reason
+}
+
+// Announce events. Regular announces send no event.
+const (
+	EventStarted   = "started"
+	EventStopped   = "stopped"
+	EventCompleted = "completed"
+	EventPaused    = "paused" // BEP 21: we have every piece we want but not the whole torrent
+)
+
+// responseLimits bound what we decode of an HTTP tracker's response. Even
+// 200 IPv6 peers take a few kilobytes; anything far beyond is hostile.
+var responseLimits = bencode.Limits{MaxString: 1 << 20, MaxValues: 100000}
+
+// Timeouts and retries of HTTP announces. A tracker that accepts the
+// connection but never answers would otherwise hold an announce forever.
+const (
+	ConnectTimeout  = 15 * time.Second       // To connect to the tracker, TLS handshake included
+	ResponseTimeout = 30 * time.Second       // From sending the request to the response headers
+	AnnounceTimeout = time.Minute            // For one attempt, reading the response included
+	AnnounceRetries = 2                      // Attempts after the first, on transient failures only
+	RetryBackoff    = 500 * time.Millisecond // Before the first retry, doubling for each one after
+)
+
+// UserAgent is what HTTP announces and scrapes tell trackers we are
+var UserAgent = strings.Replace(peer.ClientVersion, " ", "/", 1)
+
+// DefaultClient is the HTTP client announces use unless given another, with
+// the connect and response timeouts of NewTransport
+var DefaultClient = &http.Client{Transport: NewTransport(nil)}
+
+// NewTransport returns an HTTP transport for talking to trackers, which gives
+// up on connections and responses that take longer than ConnectTimeout and
+// ResponseTimeout. It connects with dial, or directly, through the
+// environment's proxy if any, when dial is nil.
+func NewTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Transport {
+	t := &http.Transport{
+		DialContext:           dial,
+		TLSHandshakeTimeout:   ConnectTimeout,
+		ResponseHeaderTimeout: ResponseTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   2,
+	}
+	if dial == nil {
+		t.DialContext = (&net.Dialer{Timeout: ConnectTimeout}).DialContext
+		t.Proxy = http.ProxyFromEnvironment
+	}
+	return t
+}
+
+// AnnounceRequest holds the parameters sent to a tracker
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string // One of the Event constants, or empty
+	IPv6       net.IP // BEP 7: our IPv6 address, advertised when we also listen on IPv6
+	IP         net.IP // Our external IPv4 address as a hint for the tracker, if known
+
+	// Key identifies us to the tracker across IP address changes. Keep it
+	// for the whole session; 0 sends none over HTTP and a random one over
+	// UDP.
+	Key uint32
+
+	NumWant   int    // Peers wanted; 0 lets the tracker decide
+	NoPeers   bool   // Ask for no peers at all, e.g. to stay listed while paused; overrides NumWant
+	TrackerID string // The tracker id the tracker last answered with, if any
+}
+
+// AnnounceResult is what a tracker answered to an announce
+type AnnounceResult struct {
+	Peers      []Peer // IPv4 and IPv6 peers
+	ExternalIP net.IP // BEP 24: our IP as the tracker sees it, nil if it didn't say
+
+	// How long the tracker wants us to wait before announcing again, and
+	// at least; 0 if it didn't say
+	Interval    time.Duration
+	MinInterval time.Duration
+
+	TrackerID string // To send back in later announces, empty if the tracker gave none
+
+	// The swarm's peers with the whole torrent and those still downloading,
+	// as the tracker counts them; 0 if it didn't say
+	Seeders  int
+	Leechers int
+}
+
+// Option changes how announces reach a tracker
+type Option func(*announceOptions)
+
+// announceOptions holds the settings Options change
+type announceOptions struct {
+	client      *http.Client
+	concurrency int
+}
 
-	// Calculate the info hash
-	infoHash, err := torrentFile.InfoHash()
+// WithHTTPClient sends announces with client, e.g. one with a transport
+// bound to a local address. The default is DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *announceOptions) {
+		if client != nil {
+			o.client = client
+		}
+	}
+}
+
+// newAnnounceOptions applies opts to the defaults
+func newAnnounceOptions(opts []Option) announceOptions {
+	o := announceOptions{client: DefaultClient, concurrency: DefaultConcurrency}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// RequestPeers asks every tracker of the torrent for peers, like AnnounceAll,
+// and returns those of all that answered. It fails only if none did, and
+// gives up when ctx is done.
+func RequestPeers(ctx context.Context, torrentFile *torrent.TorrentFile, port uint16, opts ...Option) ([]Peer, error) {
+	result, err := AnnounceAll(ctx, torrentFile, &AnnounceRequest{
+		PeerID: generatePeerId(),
+		Port:   port,
+		Left:   torrentFile.TotalLength(),
+	}, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to calculate info hash: %v", err)
+		return nil, err
 	}
+	return result.Peers, nil
+}
+
+// Announce contacts the tracker at announce for the given info hash and returns
+// the peers it knows about, both IPv4 and IPv6. It only needs the info hash, so
+// it also works for magnet links whose metadata hasn't been fetched yet.
+func Announce(announce string, req *AnnounceRequest, opts ...Option) ([]Peer, error) {
+	return AnnounceContext(context.Background(), newAnnounceOptions(opts).client, announce, req)
+}
+
+// AnnounceWith is like Announce but sends the request with client, like
+// WithHTTPClient
+func AnnounceWith(client *http.Client, announce string, req *AnnounceRequest) ([]Peer, error) {
+	return AnnounceContext(context.Background(), client, announce, req)
+}
 
+// AnnounceContext is like AnnounceWith but gives up when ctx is done
+func AnnounceContext(ctx context.Context, client *http.Client, announce string, req *AnnounceRequest) ([]Peer, error) {
+	result, err := AnnounceResultContext(ctx, client, announce, req)
+	if err != nil {
+		return nil, err
+	}
+	return result.Peers, nil
+}
+
+// AnnounceResultContext is like AnnounceContext but returns everything of
+// interest in the tracker's answer, not just the peers. udp:// trackers are
+// announced to with AnnounceUDP, over a plain UDP socket.
+//
+// Each HTTP attempt gives up after AnnounceTimeout. Attempts that fail for
+// reasons that may pass, a network error, a timeout or a 5xx or 429 status,
+// are retried up to AnnounceRetries times with exponential backoff; refusals
+// and malformed answers are not.
+func AnnounceResultContext(ctx context.Context, client *http.Client, announce string, req *AnnounceRequest) (*AnnounceResult, error) {
 	// Construct the tracker URL with query parameters
-	announceURL, err := url.Parse(torrentFile.Announce)
+	announceURL, err := url.Parse(announce)
 	if err != nil {
 		return nil, fmt.Errorf("invalid announce URL: %v", err)
 	}
+	if announceURL.Scheme == "udp" {
+		return AnnounceUDP(ctx, nil, announce, req)
+	}
+	if client == nil {
+		client = DefaultClient
+	}
 
 	q := announceURL.Query()
-	q.Set("info_hash", string(infoHash[:]))
-	q.Set("peer_id", string(peerId[:]))
-	q.Set("port", strconv.Itoa(int(port)))
-	q.Set("uploaded", "0")
-	q.Set("downloaded", "0")
-	q.Set("left", strconv.FormatInt(torrentFile.TotalLength(), 10))
+	q.Set("info_hash", string(req.InfoHash[:]))
+	q.Set("peer_id", string(req.PeerID[:]))
+	q.Set("port", strconv.Itoa(int(req.Port)))
+	q.Set("uploaded", strconv.FormatInt(req.Uploaded, 10))
+	q.Set("downloaded", strconv.FormatInt(req.Downloaded, 10))
+	q.Set("left", strconv.FormatInt(req.Left, 10))
 	q.Set("compact", "1")
+	if req.Event != "" {
+		q.Set("event", req.Event)
+	}
+	if req.IPv6 != nil {
+		q.Set("ipv6", req.IPv6.String())
+	}
+	if ip4 := req.IP.To4(); ip4 != nil {
+		q.Set("ip", ip4.String())
+	}
+	if req.Key != 0 {
+		q.Set("key", fmt.Sprintf("%08X", req.Key))
+	}
+	if req.NoPeers {
+		q.Set("numwant", "0")
+	} else if req.NumWant > 0 {
+		q.Set("numwant", strconv.Itoa(req.NumWant))
+	}
+	if req.TrackerID != "" {
+		q.Set("trackerid", req.TrackerID)
+	}
 	announceURL.RawQuery = q.Encode()
 
+	for attempt := 0; ; attempt++ {
+		result, retry, err := announceHTTP(ctx, client, announceURL.String())
+		if !retry || attempt == AnnounceRetries {
+			return result, err
+		}
+		select {
+		case <-time.After(RetryBackoff << attempt):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// announceHTTP makes one attempt at an HTTP announce, and reports whether a
+// failure is worth another
+func announceHTTP(ctx context.Context, client *http.Client, announceURL string) (*AnnounceResult, bool, error) {
+	attemptCtx, cancel := context.WithTimeout(ctx, AnnounceTimeout)
+	defer cancel()
+
 	// Send the HTTP GET request to the tracker
-	resp, err := http.Get(announceURL.String())
+	httpReq, err := http.NewRequestWithContext(attemptCtx, http.MethodGet, announceURL, nil)
 	if err != nil {
-		return nil, fmt.Errorf("tracker request failed: %v", err)
+		return nil, false, fmt.Errorf("invalid announce URL: %v", err)
+	}
+	httpReq.Header.Set("User-Agent", UserAgent)
+	httpReq.Header.Set("Accept-Encoding", "gzip")
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		// Our own cancellation is final; the attempt timing out is not
+		return nil, ctx.Err() == nil, fmt.Errorf("tracker request failed: %v", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return nil, true, fmt.Errorf("tracker request failed: %s", resp.Status)
+	}
 
-	// Read and parse the response
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read tracker response: %v", err)
+	// Setting Accept-Encoding ourselves leaves decompression to us
+	body := io.Reader(resp.Body)
+	if resp.Header.Get("Content-Encoding") == "gzip" && !resp.Uncompressed {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to parse tracker response: %v", err)
+		}
+		defer gz.Close()
+		body = gz
 	}
 
+	// Parse the response as it arrives
+	result, err := parseAnnounceResult(body)
+	if err != nil && ctx.Err() == nil && attemptCtx.Err() != nil {
+		return nil, true, fmt.Errorf("tracker request failed: %v", attemptCtx.Err())
+	}
+	return result, false, err
+}
+
+// parseAnnounceResult decodes an HTTP tracker's answer to an announce
+func parseAnnounceResult(body io.Reader) (*AnnounceResult, error) {
 	trackerResp, err := parseTrackerResponse(body)
+	var failure *FailureError
+	if errors.As(err, &failure) {
+		return nil, err
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse tracker response: %v", err)
+		return nil, fmt.Errorf("failed to parse tracker response: %w", err)
 	}
 
-	// Parse the compact peer list
+	// Parse the compact peer lists
 	peers, err := parsePeers(trackerResp.Peers)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse peer list: %v", err)
 	}
+	peers6, err := parsePeers6(trackerResp.Peers6)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peer list: %v", err)
+	}
 
-	return peers, nil
+	peers = append(peers, trackerResp.PeerList...)
+	return &AnnounceResult{
+		Peers:       append(peers, peers6...),
+		ExternalIP:  trackerResp.ExternalIP,
+		Interval:    time.Duration(trackerResp.Interval) * time.Second,
+		MinInterval: time.Duration(trackerResp.MinInterval) * time.Second,
+		TrackerID:   trackerResp.TrackerID,
+		Seeders:     trackerResp.Complete,
+		Leechers:    trackerResp.Incomplete,
+	}, nil
 }
 
 // generatePeerId creates a 20-byte peer ID with the prefix -GO0001-
@@ -106,45 +370,39 @@ func generatePeerId() [20]byte {
 }
 
 // parseTrackerResponse decodes the bencoded tracker response
-func parseTrackerResponse(body []byte) (*TrackerResponse, error) {
-	decoded, _, err := bencode.Decode(body)
-	if err != nil {
+func parseTrackerResponse(r io.Reader) (*TrackerResponse, error) {
+	// A failure has none of the other fields, and a tracker serving only
+	// IPv6 peers may omit "peers", so which fields are required is checked
+	// after decoding
+	var reply struct {
+		TrackerResponse
+		FailureReason string     `bencode:"failure reason,omitempty"`
+		HasInterval   *int64     `bencode:"interval,omitempty"`
+		HasPeers      *string    `bencode:"peers,omitempty"`
+		HasPeers6     *string    `bencode:"peers6,omitempty"`
+		DictPeers     []dictPeer `bencode:"peers,omitempty"`
+	}
+	d := bencode.NewDecoder(r)
+	d.Limits = responseLimits
+	if err := d.Decode(&reply); err != nil {
 		return nil, err
 	}
-
-	dict, ok := decoded.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("tracker response is not a dictionary")
+	if reply.FailureReason != "" {
+		return nil, &FailureError{Reason: reply.FailureReason}
 	}
-
-	response := &TrackerResponse{}
-
-	// Parse required fields
-	if interval, ok := dict["interval"].(int64); ok {
-		response.Interval = int(interval)
-	} else {
+	if reply.HasInterval == nil {
 		return nil, fmt.Errorf("missing or invalid interval")
 	}
-
-	if peers, ok := dict["peers"].(string); ok {
-		response.Peers = peers
-	} else {
+	if reply.HasPeers == nil && reply.DictPeers == nil && reply.HasPeers6 == nil {
 		return nil, fmt.Errorf("missing or invalid peers")
 	}
 
-	// Parse optional fields
-	if minInterval, ok := dict["min interval"].(int64); ok {
-		response.MinInterval = int(minInterval)
-	}
-
-	if complete, ok := dict["complete"].(int64); ok {
-		response.Complete = int(complete)
-	}
-
-	if incomplete, ok := dict["incomplete"].(int64); ok {
-		response.Incomplete = int(incomplete)
+	// A 4 or 16 byte address; anything else is ignored
+	response := &reply.TrackerResponse
+	response.PeerList = parseDictPeers(reply.DictPeers)
+	if len(response.ExternalIP) != net.IPv4len && len(response.ExternalIP) != net.IPv6len {
+		response.ExternalIP = nil
 	}
-
 	return response, nil
 }
 
@@ -168,3 +426,42 @@ func parsePeers(compactPeers string) ([]Peer, error) {
 
 	return peers, nil
 }
+
+// parseDictPeers converts peers in the dictionary model, skipping any whose
+// IP or port is invalid, such as ones given by host name
+func parseDictPeers(dictPeers []dictPeer) []Peer {
+	var peers []Peer
+	for _, p := range dictPeers {
+		ip := net.ParseIP(p.IP)
+		if ip == nil || p.Port <= 0 || p.Port > 65535 {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		peers = append(peers, Peer{IP: ip, Port: uint16(p.Port)})
+	}
+	return peers
+}
+
+// parsePeers6 extracts peers from the compact IPv6 peer list (BEP 7)
+func parsePeers6(compactPeers string) ([]Peer, error) {
+	peerData := []byte(compactPeers)
+
+	// Each peer is represented by 18 bytes: 16 for IP, 2 for port
+	if len(peerData)%18 != 0 {
+		return nil, fmt.Errorf("invalid IPv6 peer list length: %d", len(peerData))
+	}
+
+	peers := make([]Peer, 0, len(peerData)/18)
+
+	for i := 0; i < len(peerData); i += 18 {
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, peerData[i:i+16])
+		port := binary.BigEndian.Uint16(peerData[i+16 : i+18])
+
+		peers = append(peers, Peer{IP: ip, Port: port})
+	}
+
+	return peers, nil
+}
@@ -1,10 +1,22 @@
 package tracker_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+	"github.com/omkarkirpan/bittorrent-client/clock"
 	"github.com/omkarkirpan/bittorrent-client/torrent"
 	"github.com/omkarkirpan/bittorrent-client/tracker"
 )
@@ -39,7 +51,7 @@ func TestRequestPeersSuccess(t *testing.T) {
 	}
 
 	// Call RequestPeers using the dummy torrent file.
-	peers, err := tracker.RequestPeers(torrentFile, 6881)
+	peers, err := tracker.RequestPeers(context.Background(), torrentFile, 6881)
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
 	}
@@ -81,9 +93,546 @@ func TestRequestPeersError(t *testing.T) {
 		},
 	}
 
-	_, err := tracker.RequestPeers(torrentFile, 6881)
+	_, err := tracker.RequestPeers(context.Background(), torrentFile, 6881)
 	if err == nil {
 		t.Fatal("Expected error from RequestPeers, got nil")
 	}
 	t.Logf("RequestPeers returned expected error: %v", err)
 }
+
+func TestAnnounceFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason17:torrent not founde"))
+	}))
+	defer ts.Close()
+
+	_, err := tracker.Announce(ts.URL, &tracker.AnnounceRequest{Port: 6881})
+	var failure *tracker.FailureError
+	if !errors.As(err, &failure) {
+		t.Fatalf("Expected a FailureError, got %v", err)
+	}
+	if failure.Reason != "torrent not found" {
+		t.Errorf("Expected reason %q, got %q", "torrent not found", failure.Reason)
+	}
+}
+
+func TestAnnounceOversized(t *testing.T) {
+	// A peer list claiming 100MB is refused before it is buffered
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1800e5:peers104857600:"))
+		w.Write(make([]byte, 4096))
+	}))
+	defer ts.Close()
+
+	_, err := tracker.Announce(ts.URL, &tracker.AnnounceRequest{Port: 6881})
+	if !errors.Is(err, bencode.ErrStringTooLong) {
+		t.Errorf("Expected bencode.ErrStringTooLong, got %v", err)
+	}
+}
+
+// TestAnnounceIPv6 checks that IPv6 peers are parsed and our IPv6 address is advertised.
+func TestAnnounceIPv6(t *testing.T) {
+	// Peer: IP: 2001:db8::1, Port: 6881
+	compactPeers6 := string(net.ParseIP("2001:db8::1")) + "\x1a\xe1"
+	response := "d8:intervali1800e6:peers618:" + compactPeers6 + "e"
+
+	var advertised string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		advertised = r.URL.Query().Get("ipv6")
+		w.Write([]byte(response))
+	}))
+	defer ts.Close()
+
+	peers, err := tracker.Announce(ts.URL, &tracker.AnnounceRequest{
+		Port: 6881,
+		IPv6: net.ParseIP("2001:db8::2"),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if advertised != "2001:db8::2" {
+		t.Errorf("Expected ipv6=2001:db8::2, got %q", advertised)
+	}
+	if len(peers) != 1 {
+		t.Fatalf("Expected 1 peer, got %d", len(peers))
+	}
+	if peers[0].String() != "[2001:db8::1]:6881" {
+		t.Errorf("Unexpected peer: got %s, expected [2001:db8::1]:6881", peers[0])
+	}
+
+	// Peers in the dictionary model spell out their IPs, either family.
+	// Host names and invalid ports are skipped.
+	response = "d8:intervali1800e5:peersl" +
+		"d2:ip11:2001:db8::37:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti6882ee" +
+		"d2:ip8:10.0.0.14:porti6883ee" +
+		"d2:ip11:example.com4:porti6884ee" +
+		"d2:ip8:10.0.0.24:porti70000ee" +
+		"ee"
+	peers, err = tracker.Announce(ts.URL, &tracker.AnnounceRequest{Port: 6881})
+	if err != nil {
+		t.Fatalf("Expected no error for dictionary peers, got: %v", err)
+	}
+	var addrs []string
+	for _, p := range peers {
+		addrs = append(addrs, p.String())
+	}
+	if expected := []string{"[2001:db8::3]:6882", "10.0.0.1:6883"}; !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("Expected peers %v, got %v", expected, addrs)
+	}
+}
+
+func TestAnnounceExternalIP(t *testing.T) {
+	testCases := []struct {
+		externalIP string
+		expected   net.IP
+	}{
+		{"4:\xcb\x00\x71\x07", net.IPv4(203, 0, 113, 7)},
+		{"16:" + string(net.ParseIP("2001:db8::7")), net.ParseIP("2001:db8::7")},
+		{"3:abc", nil},
+		{"i1e", nil},
+	}
+	for _, tc := range testCases {
+		var hint string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hint = r.URL.Query().Get("ip")
+			w.Write([]byte("d11:external ip" + tc.externalIP + "8:intervali1800e5:peers0:e"))
+		}))
+
+		result, err := tracker.AnnounceResultContext(context.Background(), http.DefaultClient, ts.URL, &tracker.AnnounceRequest{
+			Port: 6881,
+			IP:   net.IPv4(198, 51, 100, 1),
+		})
+		ts.Close()
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if !result.ExternalIP.Equal(tc.expected) {
+			t.Errorf("Expected external IP %v for %q, got %v", tc.expected, tc.externalIP, result.ExternalIP)
+		}
+		if hint != "198.51.100.1" {
+			t.Errorf("Expected ip=198.51.100.1, got %q", hint)
+		}
+	}
+}
+
+func TestAnnounceContext(t *testing.T) {
+	var query url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer ts.Close()
+
+	_, err := tracker.AnnounceContext(context.Background(), http.DefaultClient, ts.URL, &tracker.AnnounceRequest{
+		Port:       6881,
+		Uploaded:   5,
+		Downloaded: 7,
+		Left:       11,
+		Event:      tracker.EventStopped,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	want := map[string]string{"event": "stopped", "uploaded": "5", "downloaded": "7", "left": "11"}
+	for k, v := range want {
+		if query.Get(k) != v {
+			t.Errorf("Expected %s=%s, got %q", k, v, query.Get(k))
+		}
+	}
+
+	// A cancelled context aborts the request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tracker.AnnounceContext(ctx, http.DefaultClient, ts.URL, &tracker.AnnounceRequest{}); err == nil {
+		t.Error("Expected error with a cancelled context")
+	}
+}
+
+// roundTripFunc lets a test intercept HTTP requests
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestAnnounceWithHTTPClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer ts.Close()
+
+	used := false
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		used = true
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	if _, err := tracker.Announce(ts.URL, &tracker.AnnounceRequest{Port: 6881}, tracker.WithHTTPClient(client)); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !used {
+		t.Error("Expected the announce to go through the given client")
+	}
+}
+
+func TestAnnounceHTTPClient(t *testing.T) {
+	var query url.Values
+	var header http.Header
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, header = r.URL.Query(), r.Header
+		switch requests.Add(1) {
+		case 1:
+			// A transient failure is retried
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		default:
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write([]byte("d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe110:tracker id3:abce"))
+			gz.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(buf.Bytes())
+		}
+	}))
+	defer ts.Close()
+
+	result, err := tracker.AnnounceResultContext(context.Background(), nil, ts.URL, &tracker.AnnounceRequest{
+		Port:      6881,
+		Key:       0xdeadbeef,
+		NumWant:   80,
+		TrackerID: "xyz",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests.Load())
+	}
+	if len(result.Peers) != 1 || result.TrackerID != "abc" {
+		t.Errorf("Expected 1 peer and tracker id abc from the gzipped response, got %d and %q", len(result.Peers), result.TrackerID)
+	}
+	want := map[string]string{"key": "DEADBEEF", "numwant": "80", "trackerid": "xyz"}
+	for k, v := range want {
+		if query.Get(k) != v {
+			t.Errorf("Expected %s=%s, got %q", k, v, query.Get(k))
+		}
+	}
+	if header.Get("User-Agent") != tracker.UserAgent || header.Get("Accept-Encoding") != "gzip" {
+		t.Errorf("Expected our User-Agent and gzip accepted, got %q and %q", header.Get("User-Agent"), header.Get("Accept-Encoding"))
+	}
+
+	// Refusals aren't retried
+	requests.Store(0)
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("d14:failure reason6:bannede"))
+	}))
+	defer refusing.Close()
+	if _, err := tracker.AnnounceResultContext(context.Background(), nil, refusing.URL, &tracker.AnnounceRequest{}); err == nil || requests.Load() != 1 {
+		t.Errorf("Expected one refused request, got %d (err: %v)", requests.Load(), err)
+	}
+}
+
+func TestAnnounceAll(t *testing.T) {
+	tracker1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:completei5e10:incompletei2e8:intervali1800e5:peers12:\x7f\x00\x00\x01\x1a\xe1\x7f\x00\x00\x02\x1a\xe1e"))
+	}))
+	defer tracker1.Close()
+	tracker2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:completei3e10:incompletei7e8:intervali1800e5:peers12:\x7f\x00\x00\x02\x1a\xe1\x7f\x00\x00\x03\x1a\xe1e"))
+	}))
+	defer tracker2.Close()
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason6:bannede"))
+	}))
+	defer refusing.Close()
+
+	torrentFile := &torrent.TorrentFile{
+		Announce:     tracker1.URL,
+		AnnounceList: [][]string{{tracker1.URL}, {refusing.URL, tracker2.URL, "wss://tracker.example/announce"}},
+		Info:         torrent.TorrentInfo{Name: "dummy", PieceLength: 262144},
+	}
+	result, err := tracker.AnnounceAll(context.Background(), torrentFile, &tracker.AnnounceRequest{Port: 6881}, tracker.WithConcurrency(2))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	var peers []string
+	for _, p := range result.Peers {
+		peers = append(peers, p.String())
+	}
+	if want := []string{"127.0.0.1:6881", "127.0.0.2:6881", "127.0.0.3:6881"}; !reflect.DeepEqual(peers, want) {
+		t.Errorf("Expected peers %v, got %v", want, peers)
+	}
+	if result.Seeders != 5 || result.Leechers != 7 {
+		t.Errorf("Expected the most seeders and leechers of any tracker, 5 and 7, got %d and %d", result.Seeders, result.Leechers)
+	}
+	if len(result.Results) != 2 || len(result.Errors) != 2 {
+		t.Errorf("Expected 2 answers and 2 failures, got %d and %d", len(result.Results), len(result.Errors))
+	}
+	var failure *tracker.FailureError
+	if !errors.As(result.Errors[refusing.URL], &failure) {
+		t.Errorf("Expected the refusal recorded, got %v", result.Errors[refusing.URL])
+	}
+
+	// It only fails if every tracker did
+	torrentFile.Announce, torrentFile.AnnounceList = refusing.URL, nil
+	if _, err := tracker.AnnounceAll(context.Background(), torrentFile, &tracker.AnnounceRequest{}); !errors.As(err, &failure) {
+		t.Errorf("Expected the refusal as the error, got %v", err)
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape.php" || r.URL.Query().Get("info_hash") != string(infoHash[:]) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("d5:filesd20:" + string(infoHash[:]) + "d8:completei12e10:downloadedi345e10:incompletei6eeee"))
+	}))
+	defer ts.Close()
+
+	result, err := tracker.Scrape(context.Background(), http.DefaultClient, ts.URL+"/announce.php?key=x", infoHash)
+	if err != nil {
+		t.Fatalf("Scrape failed: %v", err)
+	}
+	if *result != (tracker.ScrapeResult{Seeders: 12, Leechers: 6, Completed: 345}) {
+		t.Errorf("Expected 12 seeders, 6 leechers and 345 completed, got %+v", result)
+	}
+
+	if _, err := tracker.Scrape(context.Background(), http.DefaultClient, ts.URL+"/tracker", infoHash); !errors.Is(err, tracker.ErrScrapeUnsupported) {
+		t.Errorf("Expected ErrScrapeUnsupported, got %v", err)
+	}
+}
+
+func TestScrapeUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer conn.Close()
+
+	// A fake UDP tracker answering connect and scrape requests
+	infoHash := [20]byte{4, 5, 6}
+	const connID = 0x1122334455667788
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			action := binary.BigEndian.Uint32(buf[8:12])
+			txID := buf[12:16]
+			var resp []byte
+			switch {
+			case action == 0 && n == 16 && binary.BigEndian.Uint64(buf[0:8]) == 0x41727101980:
+				resp = binary.BigEndian.AppendUint32(nil, 0)
+				resp = append(resp, txID...)
+				resp = binary.BigEndian.AppendUint64(resp, connID)
+			case action == 2 && n == 36 && binary.BigEndian.Uint64(buf[0:8]) == connID && [20]byte(buf[16:36]) == infoHash:
+				resp = binary.BigEndian.AppendUint32(nil, 2)
+				resp = append(resp, txID...)
+				for _, v := range []uint32{7, 100, 3} { // seeders, completed, leechers
+					resp = binary.BigEndian.AppendUint32(resp, v)
+				}
+			default:
+				resp = binary.BigEndian.AppendUint32(nil, 3)
+				resp = append(resp, txID...)
+				resp = append(resp, "bad request"...)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	result, err := tracker.Scrape(ctx, nil, "udp://"+conn.LocalAddr().String()+"/announce", infoHash)
+	if err != nil {
+		t.Fatalf("Scrape failed: %v", err)
+	}
+	if *result != (tracker.ScrapeResult{Seeders: 7, Leechers: 3, Completed: 100}) {
+		t.Errorf("Expected 7 seeders, 3 leechers and 100 completed, got %+v", result)
+	}
+
+	var failure *tracker.FailureError
+	if _, err := tracker.Scrape(ctx, nil, "udp://"+conn.LocalAddr().String(), [20]byte{9}); !errors.As(err, &failure) || failure.Reason != "bad request" {
+		t.Errorf("Expected the tracker's error message, got %v", err)
+	}
+
+	dialed := false
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = true
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	if _, err := tracker.ScrapeUDP(ctx, dial, "udp://"+conn.LocalAddr().String()+"/announce", infoHash); err != nil || !dialed {
+		t.Errorf("Expected ScrapeUDP to open its socket with dial, got dialed %v and error %v", dialed, err)
+	}
+}
+
+func TestAnnounceUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer conn.Close()
+
+	// A fake UDP tracker answering connect and announce requests, which
+	// records what announces carried
+	const connID = 0x0102030405060708
+	type announce struct {
+		event   uint32
+		port    uint16
+		urlData string
+	}
+	announces := make(chan announce, 2)
+	connects := 0
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			action := binary.BigEndian.Uint32(buf[8:12])
+			txID := buf[12:16]
+			resp := binary.BigEndian.AppendUint32(nil, action)
+			resp = append(resp, txID...)
+			switch {
+			case action == 0 && n == 16:
+				connects++
+				resp = binary.BigEndian.AppendUint64(resp, connID)
+			case action == 1 && n >= 98 && binary.BigEndian.Uint64(buf[0:8]) == connID:
+				a := announce{event: binary.BigEndian.Uint32(buf[80:84]), port: binary.BigEndian.Uint16(buf[96:98])}
+				for opts := buf[98:n]; len(opts) >= 2 && opts[0] == 2; opts = opts[2+int(opts[1]):] {
+					a.urlData += string(opts[2 : 2+int(opts[1])])
+				}
+				announces <- a
+				for _, v := range []uint32{1800, 3, 7} { // interval, leechers, seeders
+					resp = binary.BigEndian.AppendUint32(resp, v)
+				}
+				resp = append(resp, 10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2)
+			default:
+				resp = binary.BigEndian.AppendUint32(nil, 3)
+				resp = append(resp, txID...)
+				resp = append(resp, "bad request"...)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	req := &tracker.AnnounceRequest{InfoHash: [20]byte{1}, PeerID: [20]byte{2}, Port: 6881, Left: 100, Event: tracker.EventStarted}
+	announceURL := "udp://" + conn.LocalAddr().String() + "/announce?passkey=abc"
+	peers, err := tracker.AnnounceContext(ctx, nil, announceURL, req)
+	if err != nil {
+		t.Fatalf("Announce failed: %v", err)
+	}
+	if len(peers) != 2 || peers[0].String() != "10.0.0.1:6881" || peers[1].String() != "10.0.0.2:6882" {
+		t.Errorf("Expected peers 10.0.0.1:6881 and 10.0.0.2:6882, got %v", peers)
+	}
+	if got := <-announces; got != (announce{event: 2, port: 6881, urlData: "/announce?passkey=abc"}) {
+		t.Errorf("Expected a started announce for port 6881 with the URL's path, got %+v", got)
+	}
+
+	// The connection ID is reused for the next announce
+	req.Event = ""
+	if _, err := tracker.AnnounceUDP(ctx, nil, announceURL, req); err != nil {
+		t.Fatalf("Announce failed: %v", err)
+	}
+	if got := <-announces; got.event != 0 {
+		t.Errorf("Expected a regular announce, got event %d", got.event)
+	}
+	if connects != 1 {
+		t.Errorf("Expected 1 connect exchange for 2 announces, got %d", connects)
+	}
+}
+
+func TestAnnouncer(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	events := make(chan string, 4)
+	var fail atomic.Bool
+	a := &tracker.Announcer{
+		URL:     "http://tracker.example/announce",
+		Request: func() *tracker.AnnounceRequest { return &tracker.AnnounceRequest{Left: 100} },
+		Send: func(ctx context.Context, url string, req *tracker.AnnounceRequest) (*tracker.AnnounceResult, error) {
+			events <- req.Event
+			if fail.Load() {
+				return nil, errors.New("tracker down")
+			}
+			if req.Event != tracker.EventStarted && req.TrackerID != "abc" {
+				t.Errorf("Expected the tracker id echoed, got %q", req.TrackerID)
+			}
+			return &tracker.AnnounceResult{Interval: 10 * time.Minute, MinInterval: 20 * time.Minute, TrackerID: "abc"}, nil
+		},
+		Clock: fake,
+	}
+	expect := func(event string) {
+		t.Helper()
+		select {
+		case got := <-events:
+			if got != event {
+				t.Errorf("Expected event %q, got %q", event, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected an announce with event %q", event)
+		}
+	}
+	advance := func(d time.Duration) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); fake.Waiters() == 0; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("Expected Run to wait for the next announce")
+			}
+		}
+		fake.Advance(d)
+	}
+
+	// The first announce is a started one
+	ctx, cancel := context.WithCancel(context.Background())
+	a.Announce(ctx, "")
+	expect(tracker.EventStarted)
+	if !a.Started() {
+		t.Error("Expected the announcer to be started")
+	}
+
+	// Regular announces wait for the min interval, which is longer here
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	advance(19 * time.Minute)
+	select {
+	case got := <-events:
+		t.Fatalf("Expected no announce before the min interval, got %q", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+	advance(time.Minute)
+	expect("")
+
+	// A failed announce is retried sooner
+	fail.Store(true)
+	advance(20 * time.Minute)
+	expect("")
+	fail.Store(false)
+	advance(tracker.RetryInterval)
+	expect("")
+
+	// Events go out as they happen, and stopped once Run is done
+	a.Announce(ctx, tracker.EventCompleted)
+	expect(tracker.EventCompleted)
+	cancel()
+	<-done
+	if err := a.Stop(context.Background()); err != nil {
+		t.Errorf("Stop failed: %v", err)
+	}
+	expect(tracker.EventStopped)
+	if a.Started() {
+		t.Error("Expected the announcer not to be started after stopping")
+	}
+	if err := a.Stop(context.Background()); err != nil || len(events) != 0 {
+		t.Errorf("Expected no second stopped announce, got %d (err: %v)", len(events), err)
+	}
+}
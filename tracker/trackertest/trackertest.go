@@ -0,0 +1,416 @@
+// Package trackertest provides an in-process tracker for testing code that
+// announces to HTTP or UDP trackers (BEP 3, BEP 15). A Tracker keeps a real
+// swarm for every torrent announced to it, hands each peer the others and
+// records every announce, so announcers and downloads can be tested
+// deterministically without the network.
+package trackertest
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/bencode"
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+)
+
+// DefaultInterval is the announce interval a Tracker asks for unless
+// Interval is set
+const DefaultInterval = 30 * time.Minute
+
+// DefaultNumWant is how many peers a Tracker hands out when the announce
+// doesn't say
+const DefaultNumWant = 50
+
+// UDP tracker protocol (BEP 15)
+const (
+	udpProtocolID     = 0x41727101980
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+	udpConnID         = 0x7472616b74657374 // handed to every client
+)
+
+// udpEvents maps the UDP event codes to announce events
+var udpEvents = [4]string{"", tracker.EventCompleted, tracker.EventStarted, tracker.EventStopped}
+
+// Announce is an announce the tracker received
+type Announce struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Peer       tracker.Peer // Where the peer accepts connections, as the tracker sees it
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string
+	Key        uint32
+	NumWant    int    // 0 if the peer didn't say
+	NoPeers    bool   // the peer asked for no peers, with a numwant of 0
+	TrackerID  string // Over HTTP, the tracker id the peer sent back
+}
+
+// Tracker is a tracker for tests. The zero value is ready to use; set its
+// fields before the first announce.
+type Tracker struct {
+	Interval    time.Duration // DefaultInterval if 0
+	MinInterval time.Duration // not sent if 0
+	TrackerID   string        // Sent with HTTP answers if set
+
+	mu        sync.Mutex
+	failure   string // set by SetFailure
+	swarms    map[[20]byte]map[string]*member
+	completed map[[20]byte]int
+	announces []Announce
+}
+
+// member is a peer in a torrent's swarm
+type member struct {
+	peer tracker.Peer
+	seed bool
+}
+
+// Listen serves the tracker over HTTP on localhost until the test ends and
+// returns its announce URL
+func (tr *Tracker) Listen(tb testing.TB) string {
+	tb.Helper()
+	server := httptest.NewServer(tr)
+	tb.Cleanup(server.Close)
+	return server.URL + "/announce"
+}
+
+// ListenUDP serves the tracker over UDP on localhost until the test ends and
+// returns its announce URL
+func (tr *Tracker) ListenUDP(tb testing.TB) string {
+	tb.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("ListenPacket failed: %v", err)
+	}
+	done := make(chan struct{})
+	tb.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := tr.serveUDP(buf[:n], addr); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return "udp://" + conn.LocalAddr().String() + "/announce"
+}
+
+// SetFailure makes every announce and scrape fail with reason, or succeed
+// again if it is empty
+func (tr *Tracker) SetFailure(reason string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.failure = reason
+}
+
+// failed returns the reason set with SetFailure
+func (tr *Tracker) failed() string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.failure
+}
+
+// AddPeer puts a peer in a torrent's swarm without it announcing, e.g. a
+// mock peer the code under test should find
+func (tr *Tracker) AddPeer(infoHash [20]byte, p tracker.Peer, seed bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.swarm(infoHash)[p.String()] = &member{peer: p, seed: seed}
+}
+
+// Announces returns the announces received so far, oldest first
+func (tr *Tracker) Announces() []Announce {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return slices.Clone(tr.announces)
+}
+
+// Peers returns the peers in a torrent's swarm, ordered by address
+func (tr *Tracker) Peers(infoHash [20]byte) []tracker.Peer {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.others(infoHash, "", 0)
+}
+
+// ServeHTTP answers announces to paths ending in "announce" and scrapes to
+// paths ending in "scrape"
+func (tr *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var reply map[string]interface{}
+	switch failure := tr.failed(); {
+	case failure != "":
+		reply = map[string]interface{}{"failure reason": failure}
+	case strings.HasSuffix(r.URL.Path, "announce"):
+		a, err := parseHTTPAnnounce(q, r.RemoteAddr)
+		if err != nil {
+			reply = map[string]interface{}{"failure reason": err.Error()}
+			break
+		}
+		peers, seeders, leechers := tr.announce(a)
+		reply = map[string]interface{}{
+			"interval":   int64(tr.interval().Seconds()),
+			"complete":   int64(seeders),
+			"incomplete": int64(leechers),
+		}
+		var compact, compact6 []byte
+		for _, p := range peers {
+			if ip4 := p.IP.To4(); ip4 != nil {
+				compact = binary.BigEndian.AppendUint16(append(compact, ip4...), p.Port)
+			} else {
+				compact6 = binary.BigEndian.AppendUint16(append(compact6, p.IP.To16()...), p.Port)
+			}
+		}
+		reply["peers"] = string(compact)
+		if len(compact6) > 0 {
+			reply["peers6"] = string(compact6)
+		}
+		if tr.MinInterval > 0 {
+			reply["min interval"] = int64(tr.MinInterval.Seconds())
+		}
+		if tr.TrackerID != "" {
+			reply["tracker id"] = tr.TrackerID
+		}
+	case strings.HasSuffix(r.URL.Path, "scrape"):
+		files := map[string]interface{}{}
+		for _, hash := range q["info_hash"] {
+			if len(hash) != 20 {
+				continue
+			}
+			seeders, leechers, completed := tr.Scrape([20]byte([]byte(hash)))
+			files[hash] = map[string]interface{}{
+				"complete":   int64(seeders),
+				"incomplete": int64(leechers),
+				"downloaded": int64(completed),
+			}
+		}
+		reply = map[string]interface{}{"files": files}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	body, _ := bencode.EncodeDict(reply)
+	w.Write(body)
+}
+
+// Scrape returns a torrent's seeders, leechers and completed downloads
+func (tr *Tracker) Scrape(infoHash [20]byte) (seeders, leechers, completed int) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	seeders, leechers = tr.counts(infoHash)
+	return seeders, leechers, tr.completed[infoHash]
+}
+
+// parseHTTPAnnounce reads an announce from its query. The peer's address is
+// the one it connected from, or its ip parameter.
+func parseHTTPAnnounce(q map[string][]string, remoteAddr string) (Announce, error) {
+	get := func(key string) string {
+		if v := q[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	var a Announce
+	infoHash, peerID := get("info_hash"), get("peer_id")
+	if len(infoHash) != 20 || len(peerID) != 20 {
+		return a, errors.New("invalid info_hash or peer_id")
+	}
+	a.InfoHash, a.PeerID = [20]byte([]byte(infoHash)), [20]byte([]byte(peerID))
+	port, err := strconv.ParseUint(get("port"), 10, 16)
+	if err != nil {
+		return a, errors.New("invalid port")
+	}
+	host, _, _ := net.SplitHostPort(remoteAddr)
+	ip := net.ParseIP(host)
+	if hint := net.ParseIP(get("ip")); hint != nil {
+		ip = hint
+	}
+	a.Peer = tracker.Peer{IP: ip, Port: uint16(port)}
+	a.Uploaded, _ = strconv.ParseInt(get("uploaded"), 10, 64)
+	a.Downloaded, _ = strconv.ParseInt(get("downloaded"), 10, 64)
+	a.Left, _ = strconv.ParseInt(get("left"), 10, 64)
+	a.Event = get("event")
+	if key, err := hex.DecodeString(get("key")); err == nil && len(key) == 4 {
+		a.Key = binary.BigEndian.Uint32(key)
+	}
+	a.NumWant, _ = strconv.Atoi(get("numwant"))
+	a.NoPeers = get("numwant") == "0"
+	a.TrackerID = get("trackerid")
+	return a, nil
+}
+
+// serveUDP answers a UDP tracker request, or returns nil to ignore it
+func (tr *Tracker) serveUDP(req []byte, addr net.Addr) []byte {
+	if len(req) < 16 {
+		return nil
+	}
+	connID, action := binary.BigEndian.Uint64(req[0:8]), binary.BigEndian.Uint32(req[8:12])
+	resp := func(action uint32) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, action), req[12:16]...)
+	}
+	fail := func(reason string) []byte {
+		return append(resp(udpActionError), reason...)
+	}
+
+	switch failure := tr.failed(); {
+	case action == udpActionConnect && connID == udpProtocolID:
+		return binary.BigEndian.AppendUint64(resp(udpActionConnect), udpConnID)
+	case connID != udpConnID:
+		return fail("unknown connection ID")
+	case failure != "":
+		return fail(failure)
+	case action == udpActionAnnounce && len(req) >= 98:
+		udpAddr, _ := addr.(*net.UDPAddr)
+		a := Announce{
+			InfoHash:   [20]byte(req[16:36]),
+			PeerID:     [20]byte(req[36:56]),
+			Downloaded: int64(binary.BigEndian.Uint64(req[56:64])),
+			Left:       int64(binary.BigEndian.Uint64(req[64:72])),
+			Uploaded:   int64(binary.BigEndian.Uint64(req[72:80])),
+			Key:        binary.BigEndian.Uint32(req[88:92]),
+			Peer:       tracker.Peer{Port: binary.BigEndian.Uint16(req[96:98])},
+		}
+		if event := binary.BigEndian.Uint32(req[80:84]); event < uint32(len(udpEvents)) {
+			a.Event = udpEvents[event]
+		}
+		if numWant := int32(binary.BigEndian.Uint32(req[92:96])); numWant > 0 {
+			a.NumWant = int(numWant)
+		} else if numWant == 0 {
+			a.NoPeers = true
+		}
+		if udpAddr != nil {
+			a.Peer.IP = udpAddr.IP
+		}
+		if ip := net.IP(req[84:88]); !ip.Equal(net.IPv4zero) {
+			a.Peer.IP = ip
+		}
+
+		peers, seeders, leechers := tr.announce(a)
+		out := resp(udpActionAnnounce)
+		out = binary.BigEndian.AppendUint32(out, uint32(tr.interval().Seconds()))
+		out = binary.BigEndian.AppendUint32(out, uint32(leechers))
+		out = binary.BigEndian.AppendUint32(out, uint32(seeders))
+		for _, p := range peers {
+			if ip4 := p.IP.To4(); ip4 != nil {
+				out = binary.BigEndian.AppendUint16(append(out, ip4...), p.Port)
+			}
+		}
+		return out
+	case action == udpActionScrape:
+		out := resp(udpActionScrape)
+		for hashes := req[16:]; len(hashes) >= 20; hashes = hashes[20:] {
+			seeders, leechers, completed := tr.Scrape([20]byte(hashes[:20]))
+			for _, v := range []int{seeders, completed, leechers} {
+				out = binary.BigEndian.AppendUint32(out, uint32(v))
+			}
+		}
+		return out
+	default:
+		return fail("unsupported request")
+	}
+}
+
+// announce records an announce, updates the swarm and returns the peers to
+// hand out with the swarm's counts
+func (tr *Tracker) announce(a Announce) (peers []tracker.Peer, seeders, leechers int) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.announces = append(tr.announces, a)
+
+	key := a.Peer.String()
+	swarm := tr.swarm(a.InfoHash)
+	switch a.Event {
+	case tracker.EventStopped:
+		delete(swarm, key)
+	case tracker.EventCompleted:
+		if tr.completed == nil {
+			tr.completed = make(map[[20]byte]int)
+		}
+		tr.completed[a.InfoHash]++
+		fallthrough
+	default:
+		swarm[key] = &member{peer: a.Peer, seed: a.Left == 0}
+	}
+
+	numWant := a.NumWant
+	if numWant == 0 {
+		numWant = DefaultNumWant
+	}
+	if a.Event != tracker.EventStopped && !a.NoPeers {
+		peers = tr.others(a.InfoHash, key, numWant)
+	}
+	seeders, leechers = tr.counts(a.InfoHash)
+	return peers, seeders, leechers
+}
+
+// swarm returns a torrent's swarm, making it if needed. tr.mu must be held.
+func (tr *Tracker) swarm(infoHash [20]byte) map[string]*member {
+	if tr.swarms == nil {
+		tr.swarms = make(map[[20]byte]map[string]*member)
+	}
+	if tr.swarms[infoHash] == nil {
+		tr.swarms[infoHash] = make(map[string]*member)
+	}
+	return tr.swarms[infoHash]
+}
+
+// others returns up to n peers of a swarm other than the one at key, all if
+// n is 0, ordered by address. tr.mu must be held.
+func (tr *Tracker) others(infoHash [20]byte, key string, n int) []tracker.Peer {
+	keys := make([]string, 0, len(tr.swarms[infoHash]))
+	for k := range tr.swarms[infoHash] {
+		if k != key {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	if n > 0 && len(keys) > n {
+		keys = keys[:n]
+	}
+	peers := make([]tracker.Peer, len(keys))
+	for i, k := range keys {
+		peers[i] = tr.swarms[infoHash][k].peer
+	}
+	return peers
+}
+
+// counts returns a swarm's seeders and leechers. tr.mu must be held.
+func (tr *Tracker) counts(infoHash [20]byte) (seeders, leechers int) {
+	for _, m := range tr.swarms[infoHash] {
+		if m.seed {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+	return seeders, leechers
+}
+
+// interval returns the announce interval to ask for
+func (tr *Tracker) interval() time.Duration {
+	if tr.Interval > 0 {
+		return tr.Interval
+	}
+	return DefaultInterval
+}
@@ -0,0 +1,75 @@
+package trackertest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/tracker"
+)
+
+func TestTracker(t *testing.T) {
+	for _, udp := range []bool{false, true} {
+		name := "HTTP"
+		if udp {
+			name = "UDP"
+		}
+		tr := &Tracker{Interval: 10 * time.Minute}
+		url := tr.Listen(t)
+		if udp {
+			url = tr.ListenUDP(t)
+		}
+		infoHash := [20]byte{1, 2, 3}
+		tr.AddPeer(infoHash, tracker.Peer{IP: net.IPv4(10, 0, 0, 9), Port: 6881}, true)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		announcer := func(id byte, left int64) *tracker.Announcer {
+			return &tracker.Announcer{URL: url, Request: func() *tracker.AnnounceRequest {
+				return &tracker.AnnounceRequest{InfoHash: infoHash, PeerID: [20]byte{id}, Port: 7000 + uint16(id), Left: left, Key: 0xABCD0000 + uint32(id)}
+			}}
+		}
+
+		// Each peer that announces is handed the ones before it
+		first, second := announcer(1, 100), announcer(2, 0)
+		if _, err := first.Announce(ctx, ""); err != nil {
+			t.Fatalf("%s: first announce failed: %v", name, err)
+		}
+		result, err := second.Announce(ctx, "")
+		if err != nil {
+			t.Fatalf("%s: second announce failed: %v", name, err)
+		}
+		if len(result.Peers) != 2 || result.Peers[0].String() != "10.0.0.9:6881" || result.Peers[1].String() != "127.0.0.1:7001" {
+			t.Errorf("%s: expected the added peer and the first, got %v", name, result.Peers)
+		}
+		if result.Seeders != 2 || result.Leechers != 1 || result.Interval != 10*time.Minute {
+			t.Errorf("%s: expected 2 seeders, 1 leecher and a 10m interval, got %+v", name, result)
+		}
+
+		announces := tr.Announces()
+		if len(announces) != 2 || announces[1].Event != tracker.EventStarted || announces[1].PeerID != [20]byte{2} || announces[1].Key != 0xABCD0002 {
+			t.Errorf("%s: expected two started announces, got %+v", name, announces)
+		}
+
+		// Leaving takes the peer out of the swarm
+		if err := first.Stop(ctx); err != nil {
+			t.Fatalf("%s: Stop failed: %v", name, err)
+		}
+		if peers := tr.Peers(infoHash); len(peers) != 2 {
+			t.Errorf("%s: expected 2 peers left, got %v", name, peers)
+		}
+		scrape, err := tracker.Scrape(ctx, tracker.DefaultClient, url, infoHash)
+		if err != nil || scrape.Seeders != 2 || scrape.Leechers != 0 {
+			t.Errorf("%s: expected 2 seeders scraped, got %+v (err: %v)", name, scrape, err)
+		}
+
+		// A failing tracker says why
+		tr.SetFailure("torrent not registered")
+		var failure *tracker.FailureError
+		if _, err := announcer(3, 0).Announce(ctx, ""); !errors.As(err, &failure) || failure.Reason != "torrent not registered" {
+			t.Errorf("%s: expected the failure reason, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/omkarkirpan/bittorrent-client/transport"
+)
+
+// UDP tracker protocol (BEP 15)
+const (
+	udpProtocolID     = 0x41727101980 // Magic constant identifying connect requests
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+	udpRetryTimeout   = 15 * time.Second // Wait for the first answer; doubled for each resend
+	udpMaxRetries     = 8
+	udpConnIDLifetime = time.Minute // How long a tracker accepts a connection ID
+	udpMaxPacket      = 2048
+	udpOptionURLData  = 2 // BEP 41: the announce URL's path and query
+)
+
+// udpEvents maps announce events to their UDP codes. The paused event (BEP
+// 21) has none and is sent as a regular announce.
+var udpEvents = map[string]uint32{EventCompleted: 1, EventStarted: 2, EventStopped: 3}
+
+// connIDs caches the connection IDs trackers handed out, by host, so announces
+// and scrapes within a minute of each other skip the connect exchange
+var connIDs = struct {
+	sync.Mutex
+	m map[string]cachedConnID
+}{m: make(map[string]cachedConnID)}
+
+// cachedConnID is a connection ID and when it was obtained
+type cachedConnID struct {
+	id  uint64
+	got time.Time
+}
+
+// udpConn is a connection to a UDP tracker that has completed the connect
+// exchange
+type udpConn struct {
+	conn   net.Conn
+	host   string
+	connID uint64
+	cached bool // connID came from the cache and may have expired
+}
+
+// dialUDP connects to the UDP tracker at host:port with dial, or a plain UDP
+// socket if nil, and obtains a connection ID unless a recent one is cached
+func dialUDP(ctx context.Context, dial transport.DialFunc, host string) (*udpConn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "udp", host)
+	if err != nil {
+		return nil, fmt.Errorf("tracker request failed: %v", err)
+	}
+	c := &udpConn{conn: conn, host: host}
+
+	connIDs.Lock()
+	cached, ok := connIDs.m[host]
+	connIDs.Unlock()
+	if ok && time.Since(cached.got) < udpConnIDLifetime {
+		c.connID, c.cached = cached.id, true
+		return c, nil
+	}
+	if err := c.connect(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// connect obtains a fresh connection ID and caches it
+func (c *udpConn) connect(ctx context.Context) error {
+	req := binary.BigEndian.AppendUint64(nil, udpProtocolID)
+	req = binary.BigEndian.AppendUint32(req, udpActionConnect)
+	resp, err := c.roundTrip(ctx, req, udpActionConnect, 8)
+	if err != nil {
+		return err
+	}
+	c.connID, c.cached = binary.BigEndian.Uint64(resp), false
+
+	connIDs.Lock()
+	connIDs.m[c.host] = cachedConnID{id: c.connID, got: time.Now()}
+	connIDs.Unlock()
+	return nil
+}
+
+// Close closes the connection
+func (c *udpConn) Close() error {
+	return c.conn.Close()
+}
+
+// request sends an action with its body after the connection ID and returns
+// the answer's payload. When the tracker refuses a cached connection ID,
+// which it may have expired early, it connects again and retries once.
+func (c *udpConn) request(ctx context.Context, action uint32, body []byte, minLen int) ([]byte, error) {
+	send := func() ([]byte, error) {
+		req := binary.BigEndian.AppendUint64(nil, c.connID)
+		req = binary.BigEndian.AppendUint32(req, action)
+		return c.roundTrip(ctx, append(req, body...), action, minLen)
+	}
+	resp, err := send()
+	var failure *FailureError
+	if c.cached && errors.As(err, &failure) {
+		if err := c.connect(ctx); err != nil {
+			return nil, err
+		}
+		resp, err = send()
+	}
+	return resp, err
+}
+
+// scrape asks for the swarm counts of one torrent
+func (c *udpConn) scrape(ctx context.Context, infoHash [20]byte) (*ScrapeResult, error) {
+	resp, err := c.request(ctx, udpActionScrape, infoHash[:], 12)
+	if err != nil {
+		return nil, err
+	}
+	return &ScrapeResult{
+		Seeders:   int(binary.BigEndian.Uint32(resp[0:4])),
+		Completed: int(binary.BigEndian.Uint32(resp[4:8])),
+		Leechers:  int(binary.BigEndian.Uint32(resp[8:12])),
+	}, nil
+}
+
+// announce sends an announce request. urlData is the path and query of the
+// announce URL, which trackers that host several announce paths need (BEP
+// 41).
+func (c *udpConn) announce(ctx context.Context, req *AnnounceRequest, urlData string) (*AnnounceResult, error) {
+	body := append(append([]byte(nil), req.InfoHash[:]...), req.PeerID[:]...)
+	body = binary.BigEndian.AppendUint64(body, uint64(req.Downloaded))
+	body = binary.BigEndian.AppendUint64(body, uint64(req.Left))
+	body = binary.BigEndian.AppendUint64(body, uint64(req.Uploaded))
+	body = binary.BigEndian.AppendUint32(body, udpEvents[req.Event])
+	var ip [4]byte
+	if ip4 := req.IP.To4(); ip4 != nil {
+		ip = [4]byte(ip4)
+	}
+	body = append(body, ip[:]...)
+	key := req.Key
+	if key == 0 {
+		var random [4]byte
+		rand.Read(random[:])
+		key = binary.BigEndian.Uint32(random[:])
+	}
+	body = binary.BigEndian.AppendUint32(body, key)
+	numWant := ^uint32(0) // as many peers as the tracker likes
+	if req.NoPeers {
+		numWant = 0
+	} else if req.NumWant > 0 {
+		numWant = uint32(req.NumWant)
+	}
+	body = binary.BigEndian.AppendUint32(body, numWant)
+	body = binary.BigEndian.AppendUint16(body, req.Port)
+	for len(urlData) > 0 {
+		chunk := urlData[:min(len(urlData), 255)]
+		body = append(append(body, udpOptionURLData, byte(len(chunk))), chunk...)
+		urlData = urlData[len(chunk):]
+	}
+
+	resp, err := c.request(ctx, udpActionAnnounce, body, 12)
+	if err != nil {
+		return nil, err
+	}
+
+	// Over IPv6 the peers are 18 bytes each, otherwise 6
+	compact := string(resp[12:])
+	var peers []Peer
+	if addr, ok := c.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		peers, err = parsePeers6(compact)
+	} else {
+		peers, err = parsePeers(compact)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peer list: %v", err)
+	}
+	interval := time.Duration(binary.BigEndian.Uint32(resp[0:4])) * time.Second
+	return &AnnounceResult{
+		Peers:    peers,
+		Interval: interval,
+		Leechers: int(binary.BigEndian.Uint32(resp[4:8])),
+		Seeders:  int(binary.BigEndian.Uint32(resp[8:12])),
+	}, nil
+}
+
+// AnnounceUDP announces to a UDP tracker (BEP 15), opening its socket with
+// dial, e.g. one bound to a local address, or a plain UDP socket if nil.
+// AnnounceResultContext uses it for udp:// URLs.
+func AnnounceUDP(ctx context.Context, dial transport.DialFunc, announce string, req *AnnounceRequest) (*AnnounceResult, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid announce URL: %v", err)
+	}
+	if u.Scheme != "udp" {
+		return nil, fmt.Errorf("not a UDP tracker: %s", announce)
+	}
+	conn, err := dialUDP(ctx, dial, u.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	urlData := u.RequestURI()
+	if urlData == "/" {
+		urlData = ""
+	}
+	return conn.announce(ctx, req, urlData)
+}
+
+// roundTrip sends a request made of a header and the action-specific body,
+// inserting a fresh transaction ID after the first 12 bytes, and resends it
+// until an answer with that ID arrives, ctx is done or the tracker stayed
+// silent through every resend. The wait doubles with each resend, from
+// udpRetryTimeout. It returns the answer's payload after the action and
+// transaction ID, which must be at least minLen bytes.
+func (c *udpConn) roundTrip(ctx context.Context, req []byte, action uint32, minLen int) ([]byte, error) {
+	var txID [4]byte
+	rand.Read(txID[:])
+	packet := append(append(req[:12:12], txID[:]...), req[12:]...)
+
+	buf := make([]byte, udpMaxPacket)
+	for try := 0; try <= udpMaxRetries; try++ {
+		if _, err := c.conn.Write(packet); err != nil {
+			return nil, fmt.Errorf("tracker request failed: %v", err)
+		}
+
+		deadline := time.Now().Add(udpRetryTimeout << try)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		c.conn.SetReadDeadline(deadline)
+		stop := context.AfterFunc(ctx, func() { c.conn.SetReadDeadline(time.Now()) })
+
+		for {
+			n, err := c.conn.Read(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break // resend
+			}
+			if err != nil {
+				stop()
+				return nil, fmt.Errorf("tracker request failed: %v", err)
+			}
+			if n < 8 || [4]byte(buf[4:8]) != txID {
+				continue // a late answer to an earlier request
+			}
+			stop()
+
+			switch got := binary.BigEndian.Uint32(buf[0:4]); {
+			case got == udpActionError:
+				return nil, &FailureError{Reason: string(buf[8:n])}
+			case got != action || n-8 < minLen:
+				return nil, fmt.Errorf("invalid tracker response for action %d", action)
+			}
+			return buf[8:n], nil
+		}
+		stop()
+
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("tracker request failed: %v", err)
+		}
+	}
+	return nil, errors.New("tracker request failed: no answer")
+}
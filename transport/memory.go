@@ -0,0 +1,264 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrConnRefused is returned when dialing an address nobody listens on
+var ErrConnRefused = errors.New("connection refused")
+
+// Memory is an in-process network for tests. Addresses are IP:port pairs as
+// with TCP; a listener on an unspecified address such as 0.0.0.0 accepts
+// connections to any IP of its family. Writes are buffered, so both ends can
+// send at once like over a socket. The zero value is ready to use.
+type Memory struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+	nextPort  int
+}
+
+// firstPort is the first port handed out for port 0
+const firstPort = 40000
+
+// DialContext connects to a listener on the network
+func (m *Memory) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	remote, err := resolve(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	l := m.listeners[remote.String()]
+	if l == nil {
+		wildcard := &net.TCPAddr{IP: net.IPv4zero, Port: remote.Port}
+		if remote.IP.To4() == nil {
+			wildcard.IP = net.IPv6unspecified
+		}
+		l = m.listeners[wildcard.String()]
+	}
+	local := &net.TCPAddr{IP: loopback(remote.IP), Port: m.port()}
+	m.mu.Unlock()
+	if l == nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: remote, Err: ErrConnRefused}
+	}
+
+	a, b := net.Pipe()
+	client := newMemConn(a, local, remote)
+	server := newMemConn(b, remote, local)
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: remote, Err: ErrConnRefused}
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: remote, Err: ctx.Err()}
+	}
+}
+
+// Listen listens on addr. Port 0 picks an unused port.
+func (m *Memory) Listen(ctx context.Context, network, addr string) (net.Listener, error) {
+	local, err := resolve(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if local.Port == 0 {
+		local.Port = m.port()
+	}
+	key := local.String()
+	if _, ok := m.listeners[key]; ok {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: local, Err: errors.New("address already in use")}
+	}
+	if m.listeners == nil {
+		m.listeners = make(map[string]*memListener)
+	}
+	l := &memListener{
+		memory: m,
+		addr:   local,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+	m.listeners[key] = l
+	return l, nil
+}
+
+// port returns an unused port. m.mu must be held.
+func (m *Memory) port() int {
+	if m.nextPort == 0 {
+		m.nextPort = firstPort
+	}
+	for {
+		p := m.nextPort
+		m.nextPort++
+		if !m.inUse(p) {
+			return p
+		}
+	}
+}
+
+// inUse reports whether any listener has port p. m.mu must be held.
+func (m *Memory) inUse(p int) bool {
+	for _, l := range m.listeners {
+		if l.addr.Port == p {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve parses an IP:port address
+func resolve(network, addr string) (*net.TCPAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+	ip := net.IPv4zero
+	if network == "tcp6" {
+		ip = net.IPv6unspecified
+	}
+	if host != "" {
+		if ip = net.ParseIP(host); ip == nil {
+			return nil, fmt.Errorf("%q isn't an IP address", host)
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// loopback returns the loopback address of ip's family, which dialing
+// connections appear to come from
+func loopback(ip net.IP) net.IP {
+	if ip.To4() == nil {
+		return net.IPv6loopback
+	}
+	return net.IPv4(127, 0, 0, 1).To4()
+}
+
+// memListener accepts connections dialed on a Memory network
+type memListener struct {
+	memory *Memory
+	addr   *net.TCPAddr
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Accept waits for the next connection
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+// Close stops listening
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.memory.mu.Lock()
+		delete(l.memory.listeners, l.addr.String())
+		l.memory.mu.Unlock()
+	})
+	return nil
+}
+
+// Addr returns the address listened on
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memConn is one end of a connection on a Memory network. net.Pipe doesn't
+// buffer, so writes are queued and copied into it by a goroutine.
+type memConn struct {
+	net.Conn
+	local, remote net.Addr
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	closed bool
+}
+
+func newMemConn(pipe net.Conn, local, remote net.Addr) *memConn {
+	c := &memConn{Conn: pipe, local: local, remote: remote}
+	c.cond = sync.NewCond(&c.mu)
+	go c.writeLoop()
+	return c
+}
+
+// writeLoop copies queued writes into the pipe until the connection closes
+func (c *memConn) writeLoop() {
+	for {
+		c.mu.Lock()
+		for len(c.queue) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		b := c.queue[0]
+		c.queue = c.queue[1:]
+		c.mu.Unlock()
+
+		if _, err := c.Conn.Write(b); err != nil {
+			c.Close()
+			return
+		}
+	}
+}
+
+// Write queues p for the peer without waiting for it to be read
+func (c *memConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, &net.OpError{Op: "write", Net: "tcp", Addr: c.remote, Err: net.ErrClosed}
+	}
+	c.queue = append(c.queue, append([]byte(nil), p...))
+	c.cond.Signal()
+	return len(p), nil
+}
+
+// Close closes both directions. Writes the peer hasn't read yet are lost.
+func (c *memConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.queue = nil
+	c.cond.Signal()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// SetDeadline sets the read deadline; writes never block
+func (c *memConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline does nothing since writes never block
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
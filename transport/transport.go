@@ -0,0 +1,51 @@
+// Package transport abstracts how peer connections are opened and accepted,
+// so the protocol code runs unchanged over plain TCP, a proxy, uTP or an
+// in-memory network in tests.
+package transport
+
+import (
+	"context"
+	"net"
+)
+
+// Dialer opens outgoing connections, like net.Dialer
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Listener opens listeners for incoming connections, like net.ListenConfig.
+// Listeners' addresses must be *net.TCPAddr so their ports can be announced.
+type Listener interface {
+	Listen(ctx context.Context, network, addr string) (net.Listener, error)
+}
+
+// Transport both dials and listens
+type Transport interface {
+	Dialer
+	Listener
+}
+
+// DialFunc adapts a dial function to the Dialer interface
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialContext calls f
+func (f DialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// TCP is the default transport: plain TCP sockets. The zero value is ready to
+// use.
+type TCP struct {
+	Dialer       net.Dialer
+	ListenConfig net.ListenConfig
+}
+
+// DialContext connects to addr over TCP
+func (t *TCP) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return t.Dialer.DialContext(ctx, network, addr)
+}
+
+// Listen listens for TCP connections on addr
+func (t *TCP) Listen(ctx context.Context, network, addr string) (net.Listener, error) {
+	return t.ListenConfig.Listen(ctx, network, addr)
+}
@@ -0,0 +1,131 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// roundTrip dials a listener on tr and has both ends write before reading,
+// which deadlocks unless writes are buffered
+func roundTrip(t *testing.T, tr Transport, listenAddr, dialHost string) {
+	t.Helper()
+	ln, err := tr.Listen(context.Background(), "tcp4", listenAddr)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	if port == 0 {
+		t.Fatal("Expected the listener to get a port")
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	client, err := tr.DialContext(context.Background(), "tcp", net.JoinHostPort(dialHost, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	defer client.Close()
+	server := <-accepted
+	if server == nil {
+		t.Fatal("Accept failed")
+	}
+	defer server.Close()
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := server.Write([]byte("pong")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	for _, c := range []struct {
+		conn     net.Conn
+		expected string
+	}{{server, "ping"}, {client, "pong"}} {
+		c.conn.SetDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c.conn, buf); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if string(buf) != c.expected {
+			t.Errorf("Expected %q, got %q", c.expected, buf)
+		}
+	}
+
+	if server.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Errorf("Expected the server to see %v, got %v", client.LocalAddr(), server.RemoteAddr())
+	}
+}
+
+func TestTCP(t *testing.T) {
+	roundTrip(t, &TCP{}, "127.0.0.1:0", "127.0.0.1")
+}
+
+func TestMemory(t *testing.T) {
+	var m Memory
+	roundTrip(t, &m, "0.0.0.0:0", "10.1.2.3")
+	roundTrip(t, &m, "10.0.0.1:7000", "10.0.0.1")
+
+	if _, err := m.DialContext(context.Background(), "tcp", "10.0.0.1:7000"); !errors.Is(err, ErrConnRefused) {
+		t.Errorf("Expected a closed listener to refuse connections, got %v", err)
+	}
+
+	ln, err := m.Listen(context.Background(), "tcp", "10.0.0.1:7000")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if _, err := m.Listen(context.Background(), "tcp", "10.0.0.1:7000"); err == nil {
+		t.Error("Expected listening twice on an address to fail")
+	}
+
+	// Nobody accepts, so dialing waits until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := m.DialContext(ctx, "tcp", "10.0.0.1:7000"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the dial to time out, got %v", err)
+	}
+
+	// Closing the listener fails Accept
+	go ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected Accept to fail with net.ErrClosed, got %v", err)
+	}
+}
+
+func TestMemoryClose(t *testing.T) {
+	var m Memory
+	ln, _ := m.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := m.DialContext(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected EOF once the peer closes, got %v", err)
+	}
+	conn.Close()
+	if _, err := conn.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected writing a closed connection to fail, got %v", err)
+	}
+}
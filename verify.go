@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/omkarkirpan/bittorrent-client/download"
+	"github.com/omkarkirpan/bittorrent-client/magnet"
+	"github.com/omkarkirpan/bittorrent-client/statedir"
+	"github.com/omkarkirpan/bittorrent-client/torrent"
+)
+
+// verifyReport is the JSON form of a verify run
+type verifyReport struct {
+	Name     string           `json:"name"`
+	Pieces   int              `json:"pieces"`
+	Verified int              `json:"verified"`
+	Missing  int              `json:"missing"`
+	Corrupt  []int            `json:"corrupt"`
+	Bitfield string           `json:"bitfield"`
+	Files    []fileCompletion `json:"files"`
+	Resume   string           `json:"resume,omitempty"`
+}
+
+// fileCompletion is how much of a file's data is verified
+type fileCompletion struct {
+	Path     string  `json:"path"`
+	Length   int64   `json:"length"`
+	Verified int64   `json:"verified"`
+	Percent  float64 `json:"percent"`
+}
+
+// runVerify implements the verify command and returns the exit code
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	dataDir := fs.String("data", ".", "directory holding the torrent's data, as given to --output-dir when downloading")
+	rename := fs.String("rename", "", "file or folder name the content was saved under, as given to --rename when downloading")
+	flat := fs.Bool("flat", false, "the files are directly in --data, as downloaded with --flat")
+	writeResume := fs.Bool("resume", false, "write resume data so a download into the same directory skips the verified pieces")
+	stateDir := fs.String("state-dir", "", "state directory to write resume data to, as given to --state-dir when downloading (default: the per-user state directory)")
+	jsonOutput := fs.Bool("json", false, "print the result as JSON")
+	var opts netOptions
+	opts.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify [flags] <torrent file or URL>\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Hashes the data on disk and reports per-file completion and corrupt pieces.")
+		fmt.Fprintln(fs.Output(), "Exits with status 0 when every piece is verified and 1 otherwise.\n\nFlags:")
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	arg := positional[0]
+	if magnet.IsMagnet(arg) {
+		fmt.Fprintln(os.Stderr, "Error: magnet links carry no piece hashes to verify against")
+		return exitUsage
+	}
+	route, err := opts.route()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	tf, err := torrent.LoadWith(route.fetch, arg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	infoHash, err := tf.InfoHash()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to calculate info hash: %v\n", err)
+		return exitUsage
+	}
+
+	// Show hashing progress on a terminal only
+	var progress func(done, total int)
+	if isTerminal(os.Stderr) {
+		progress = func(done, total int) {
+			if done%16 == 0 || done == total {
+				fmt.Fprintf(os.Stderr, "\rVerifying %s: %d/%d pieces", tf.Info.Name, done, total)
+			}
+		}
+	}
+	layout := download.Layout{Dir: *dataDir, Name: *rename, Flat: *flat}
+	result, err := download.Verify(tf, layout, progress)
+	if progress != nil {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitCode(err)
+	}
+
+	report := newVerifyReport(tf, result)
+	if *writeResume {
+		state, err := statedir.Open(*stateDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitStorage
+		}
+		path := state.Resume(infoHash)
+		if err := download.SaveResume(path, infoHash, layout.Root(tf), result.Have, download.FileProgress(tf, result.Have)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing resume data: %v\n", err)
+			return exitStorage
+		}
+		report.Resume = path
+	}
+
+	if *jsonOutput {
+		if err := printJSON(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitFailure
+		}
+	} else {
+		printVerifyReport(report)
+	}
+
+	if report.Verified != report.Pieces {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// newVerifyReport summarizes a verify result
+func newVerifyReport(tf *torrent.TorrentFile, result *download.VerifyResult) *verifyReport {
+	report := &verifyReport{
+		Name:     tf.Info.Name,
+		Pieces:   tf.NumPieces(),
+		Corrupt:  result.Corrupt,
+		Bitfield: hex.EncodeToString(result.Bitfield()),
+	}
+	if report.Corrupt == nil {
+		report.Corrupt = []int{}
+	}
+	for _, have := range result.Have {
+		if have {
+			report.Verified++
+		}
+	}
+	report.Missing = report.Pieces - report.Verified - len(result.Corrupt)
+
+	paths := []string{tf.Info.Name}
+	lengths := []int64{tf.Info.Length}
+	padding := []bool{false}
+	if len(tf.Info.Files) > 0 {
+		paths, lengths, padding = nil, nil, nil
+		for _, f := range tf.Info.Files {
+			paths = append(paths, filepath.Join(append([]string{tf.Info.Name}, f.Path...)...))
+			lengths = append(lengths, f.Length)
+			padding = append(padding, f.IsPadding())
+		}
+	}
+	for i, verified := range download.FileProgress(tf, result.Have) {
+		if padding[i] {
+			continue
+		}
+		percent := 100.0
+		if lengths[i] > 0 {
+			percent = float64(verified) * 100 / float64(lengths[i])
+		}
+		report.Files = append(report.Files, fileCompletion{Path: paths[i], Length: lengths[i], Verified: verified, Percent: percent})
+	}
+	return report
+}
+
+// printVerifyReport prints a verify result for people
+func printVerifyReport(report *verifyReport) {
+	fmt.Printf("Files:\n")
+	for _, f := range report.Files {
+		fmt.Printf("  %5.1f%%  %s (%s)\n", f.Percent, f.Path, humanReadableSize(f.Length))
+	}
+	if len(report.Corrupt) > 0 {
+		corrupt := make([]string, len(report.Corrupt))
+		for i, index := range report.Corrupt {
+			corrupt[i] = fmt.Sprint(index)
+		}
+		fmt.Printf("Corrupt pieces: %s\n", strings.Join(corrupt, ", "))
+	}
+	fmt.Printf("%d/%d pieces verified, %d corrupt, %d missing\n", report.Verified, report.Pieces, len(report.Corrupt), report.Missing)
+	if report.Resume != "" {
+		fmt.Printf("Resume data written to %s\n", report.Resume)
+	}
+}
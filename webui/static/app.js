@@ -0,0 +1,196 @@
+"use strict";
+
+const refreshInterval = 1000;
+let selected = null;
+let tokenAsked = false;
+
+function formatBytes(n) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i === 0 ? n : n.toFixed(2)) + " " + units[i];
+}
+
+function formatETA(seconds) {
+  if (seconds === undefined) return "-";
+  const h = Math.floor(seconds / 3600);
+  const m = Math.floor((seconds % 3600) / 60);
+  const s = seconds % 60;
+  return (h ? h + "h" : "") + (h || m ? m + "m" : "") + s + "s";
+}
+
+function showError(message) {
+  const el = document.getElementById("error");
+  el.textContent = message || "";
+  el.hidden = !message;
+}
+
+async function api(method, path, body) {
+  const options = { method, headers: {} };
+  if (body !== undefined) {
+    options.headers["Content-Type"] = "application/json";
+    options.body = JSON.stringify(body);
+  }
+  const token = localStorage.getItem("apiToken");
+  if (token) options.headers["Authorization"] = "Bearer " + token;
+  const resp = await fetch("/api/torrents" + path, options);
+  if (resp.status === 401 && !tokenAsked) {
+    // The daemon was started with --api-token: ask for it once and keep it
+    tokenAsked = true;
+    const given = prompt("API token:");
+    if (given) {
+      localStorage.setItem("apiToken", given);
+      return api(method, path, body);
+    }
+  }
+  if (resp.status === 204) return null;
+  const data = await resp.json();
+  if (!resp.ok) throw new Error(data.error || resp.statusText);
+  return data;
+}
+
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (className) td.className = className;
+  return td;
+}
+
+function button(td, label, action) {
+  const b = document.createElement("button");
+  b.textContent = label;
+  b.onclick = async (event) => {
+    event.stopPropagation();
+    try {
+      await action();
+      showError();
+      refresh();
+    } catch (err) {
+      showError(err.message);
+    }
+  };
+  td.appendChild(b);
+}
+
+function renderTorrents(torrents) {
+  const body = document.querySelector("#torrents tbody");
+  body.replaceChildren();
+  document.getElementById("empty").hidden = torrents.length > 0;
+  torrents.sort((a, b) => (a.name || a.info_hash).localeCompare(b.name || b.info_hash));
+
+  for (const t of torrents) {
+    const row = body.insertRow();
+    if (t.info_hash === selected) row.className = "selected";
+
+    const name = cell(row, t.name || t.info_hash, "name");
+    name.title = t.error || t.info_hash;
+    name.onclick = () => {
+      selected = t.info_hash;
+      refresh();
+    };
+
+    cell(row, t.state);
+    const progress = row.insertCell();
+    const bar = document.createElement("span");
+    bar.className = "bar";
+    const fill = document.createElement("div");
+    fill.style.width = t.percent + "%";
+    bar.appendChild(fill);
+    progress.append(bar, " " + t.percent.toFixed(1) + "%");
+
+    cell(row, formatBytes(t.download_rate) + "/s");
+    cell(row, formatBytes(t.upload_rate) + "/s");
+    cell(row, t.peers + " (" + t.seeds + " seeds)");
+    cell(row, formatETA(t.eta_seconds));
+
+    const actions = row.insertCell();
+    const path = "/" + t.info_hash;
+    if (t.state === "paused") {
+      button(actions, "Resume", () => api("POST", path + "/resume"));
+    } else if (t.state === "downloading" || t.state === "fetching metadata") {
+      button(actions, "Pause", () => api("POST", path + "/pause"));
+    } else if (t.state === "queued") {
+      button(actions, "Start now", () => api("PUT", path + "/force-start", { force_start: true }));
+    }
+    button(actions, "Remove", () => api("DELETE", path));
+  }
+
+  if (selected && !torrents.some((t) => t.info_hash === selected)) {
+    selected = null;
+  }
+}
+
+async function renderDetails() {
+  const details = document.getElementById("details");
+  if (!selected) {
+    details.hidden = true;
+    return;
+  }
+
+  const path = "/" + selected;
+  const [status, peers, trackers] = await Promise.all([
+    api("GET", path),
+    api("GET", path + "/peers"),
+    api("GET", path + "/trackers"),
+  ]);
+  document.getElementById("details-name").textContent = status.name || status.info_hash;
+
+  const peerBody = document.querySelector("#peers tbody");
+  peerBody.replaceChildren();
+  for (const p of peers) {
+    const row = peerBody.insertRow();
+    cell(row, p.addr);
+    cell(row, p.client || "unknown").title = p.peer_id;
+    cell(row, peerFlags(p));
+    cell(row, (p.progress * 100).toFixed(1) + "%");
+    cell(row, formatBytes(p.download_rate) + "/s");
+    cell(row, formatBytes(p.upload_rate) + "/s");
+    cell(row, formatBytes(p.downloaded));
+    cell(row, formatBytes(p.uploaded));
+  }
+
+  const trackerBody = document.querySelector("#trackers tbody");
+  trackerBody.replaceChildren();
+  for (const t of trackers) {
+    const row = trackerBody.insertRow();
+    cell(row, t.url);
+    cell(row, t.last_announce ? new Date(t.last_announce).toLocaleTimeString() : "never");
+    cell(row, t.peers);
+    cell(row, t.error || "");
+  }
+  details.hidden = false;
+}
+
+// peerFlags abbreviates a peer's state: I incoming, C choking us,
+// i interested in our pieces, S seed
+function peerFlags(p) {
+  return (p.incoming ? "I" : "") + (p.choked ? "C" : "") + (p.interested ? "i" : "") + (p.seed ? "S" : "");
+}
+
+async function refresh() {
+  try {
+    renderTorrents(await api("GET", ""));
+    await renderDetails();
+  } catch (err) {
+    showError(err.message);
+  }
+}
+
+document.getElementById("add").onsubmit = async (event) => {
+  event.preventDefault();
+  const input = document.getElementById("uri");
+  try {
+    await api("POST", "", { uri: input.value.trim() });
+    input.value = "";
+    showError();
+    refresh();
+  } catch (err) {
+    showError(err.message);
+  }
+};
+
+refresh();
+setInterval(refresh, refreshInterval);
@@ -0,0 +1,19 @@
+// Package webui embeds a single-page dashboard for the REST API served by
+// package api. The page polls /api/torrents and lets the user add magnet
+// links and pause, resume or remove torrents.
+package webui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the dashboard files
+func Handler() http.Handler {
+	files, _ := fs.Sub(static, "static")
+	return http.FileServer(http.FS(files))
+}